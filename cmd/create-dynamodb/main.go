@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -25,21 +26,38 @@ func main() {
 
 	client := dynamodb.NewFromConfig(cfg)
 
-	tableName := "QueryRuns"
+	createTable(client, "QueryRuns", []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("Id"),
+			KeyType:       types.KeyTypeHash,
+		},
+	})
 
-	param := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String("Id"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
+	// The table is used to find runs by user-defined labels.
+	createTable(client, "RunLabels", []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("Label"),
+			KeyType:       types.KeyTypeHash,
 		},
-		KeySchema: []types.KeySchemaElement{
-			{
-				AttributeName: aws.String("Id"),
-				KeyType:       types.KeyTypeHash,
-			},
+		{
+			AttributeName: aws.String("SortKey"),
+			KeyType:       types.KeyTypeRange,
 		},
+	})
+}
+
+func createTable(client *dynamodb.Client, tableName string, keySchema []types.KeySchemaElement) {
+	attributes := make([]types.AttributeDefinition, 0, len(keySchema))
+	for _, key := range keySchema {
+		attributes = append(attributes, types.AttributeDefinition{
+			AttributeName: key.AttributeName,
+			AttributeType: types.ScalarAttributeTypeS,
+		})
+	}
+
+	param := &dynamodb.CreateTableInput{
+		AttributeDefinitions: attributes,
+		KeySchema:            keySchema,
 		ProvisionedThroughput: &types.ProvisionedThroughput{
 			ReadCapacityUnits:  aws.Int64(5),
 			WriteCapacityUnits: aws.Int64(5),
@@ -48,10 +66,35 @@ func main() {
 		TableClass: types.TableClassStandard,
 	}
 
-	_, err = client.CreateTable(context.TODO(), param)
+	_, err := client.CreateTable(context.TODO(), param)
 	if err != nil {
-		zlog.Fatal().Err(err).Msg("table creation failed")
+		zlog.Fatal().Err(err).Str("table_name", tableName).Msg("table creation failed")
 	}
 
 	zlog.Info().Str("table_name", tableName).Msg("created successfully")
+
+	enableTTL(client, tableName)
+}
+
+// enableTTL makes ExpiresAt the TTL attribute, so runs are removed after run_storage.ttl.
+// Items without the attribute are kept forever.
+func enableTTL(client *dynamodb.Client, tableName string) {
+	// TTL can be enabled only for active tables.
+	err := dynamodb.NewTableExistsWaiter(client).Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("table_name", tableName).Msg("table has not become active")
+	}
+
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		zlog.Fatal().Err(err).Str("table_name", tableName).Msg("failed to enable TTL")
+	}
 }
@@ -3,29 +3,64 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 
+	"clickhouse-playground/internal/blocklist"
+	"clickhouse-playground/internal/canary"
 	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/fiddleimport"
+	"clickhouse-playground/internal/health"
+	"clickhouse-playground/internal/outputproc"
+	"clickhouse-playground/internal/policy"
+	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/qrunner/coordinator"
+	"clickhouse-playground/internal/qrunner/dockerengine"
+	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/internal/resultcache"
+	"clickhouse-playground/pkg/chsemver"
+	api "clickhouse-playground/pkg/restapi"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	gconfig "github.com/gookit/config/v2"
 	gyaml "github.com/gookit/config/v2/yaml"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
 )
 
 const DefaultConfigPath = "config.yml"
 const DefaultMaxQueryLength = 2500
 const DefaultMaxOutputLength = 25000
 
+// maxDynamoDBFilesSize bounds files of runs saved in DynamoDB. Files are saved with the run,
+// and DynamoDB items cannot exceed 400 KB.
+const maxDynamoDBFilesSize = 256 * 1024
+
+// benchmarkTool is the name of the tool that enables benchmarks in clients.
+const benchmarkTool = "benchmark"
+
 type RunnerType string
 
 const (
 	RunnerTypeDockerEngine RunnerType = "DOCKER_ENGINE"
+	RunnerTypeKubernetes   RunnerType = "KUBERNETES"
+)
+
+type RunStorageType string
+
+const (
+	RunStorageDynamoDB RunStorageType = "dynamodb"
+	RunStorageMemory   RunStorageType = "memory"
+	RunStorageNone     RunStorageType = "none"
 )
 
 type LogFormat string
@@ -41,12 +76,50 @@ type Config struct {
 
 	DockerImage DockerImage `mapstructure:"docker_image"`
 
-	API API `mapstructure:"api"`
+	API   API   `mapstructure:"api"`
+	Admin Admin `mapstructure:"admin"`
 
-	Settings CHSettings `mapstucture:"settings"`
+	Settings CHSettings `mapstructure:"settings"`
 	Limits   Limits     `mapstructure:"limits"`
 
+	// Deadlines bound the readiness wait and runs. The run timeout defaults to api.server_timeout.
+	Deadlines Deadlines `mapstructure:"deadlines"`
+
+	ResultCache ResultCache `mapstructure:"result_cache"`
+
+	// RunStorage is where runs are saved to be shared. DynamoDB tables are configured in AWS.
+	RunStorage RunStorage `mapstructure:"run_storage"`
+
+	Policy Policy `mapstructure:"policy"`
+
+	// OutputProcessing transforms outputs before they are stored and returned. It's disabled if it's nil.
+	OutputProcessing *OutputProcessing `mapstructure:"output_processing"`
+
+	// BlockList rejects requests of blocked clients. It's stored with runs. It's disabled if it's nil.
+	BlockList *BlockList `mapstructure:"block_list"`
+
+	// Import enables importing fiddles from external links. It's disabled if it's nil.
+	Import *Import `mapstructure:"import"`
+
+	// Bisect enables bisections of queries across versions. It's disabled if it's nil.
+	Bisect *Bisect `mapstructure:"bisect"`
+
+	// Sessions enables interactive sessions over WebSocket. It's disabled if it's nil.
+	Sessions *Sessions `mapstructure:"sessions"`
+
+	// Canary enables canary checks of new versions. It's disabled if it's nil.
+	Canary *Canary `mapstructure:"canary"`
+
+	// Branding is reported to clients by GET /api/meta.
+	Branding Branding `mapstructure:"branding"`
+
+	// Metrics are served by a separate listener, so they are not exposed with the API.
 	PrometheusExportAddress string `mapstructure:"prometheus_address"`
+	PrometheusPath          string `mapstructure:"prometheus_path"`
+
+	Health Health `mapstructure:"health"`
+
+	Maintenance Maintenance `mapstructure:"maintenance"`
 
 	AWS AWS `mapstructure:"aws"`
 
@@ -56,11 +129,263 @@ type Config struct {
 
 type CHSettings struct {
 	DefaultFormat *string `mapstructure:"default_format"`
+
+	// AllowedFormats are output formats runs can request. Any format is allowed if it's empty.
+	AllowedFormats []string `mapstructure:"allowed_formats"`
+}
+
+type Branding struct {
+	Name       string `mapstructure:"name"`
+	ContactURL string `mapstructure:"contact_url"`
 }
 
 type Limits struct {
 	MaxQueryLength  uint64 `mapstructure:"max_query_length"`
 	MaxOutputLength uint64 `mapstructure:"max_output_length"`
+
+	// MaxFilesSize bounds the total size of files of a run. Runs cannot have files if it's 0.
+	MaxFilesSize uint64 `mapstructure:"max_files_size"`
+
+	// Compressed bodies of runs are limited before and after decompression.
+	MaxCompressedBodyLength uint64 `mapstructure:"max_compressed_body_length"`
+	MaxExpandedBodyLength   uint64 `mapstructure:"max_expanded_body_length"`
+}
+
+type Deadlines struct {
+	ReadinessTimeout time.Duration  `mapstructure:"readiness_timeout"`
+	MaxExecRetries   int            `mapstructure:"max_exec_retries"`
+	Rules            []DeadlineRule `mapstructure:"rules"`
+}
+
+// DeadlineRule overrides the deadlines for a range of versions. Unset fields keep the defaults.
+type DeadlineRule struct {
+	MinVersion       string         `mapstructure:"min_version"`
+	MaxVersion       string         `mapstructure:"max_version"`
+	ReadinessTimeout *time.Duration `mapstructure:"readiness_timeout"`
+	MaxExecRetries   *int           `mapstructure:"max_exec_retries"`
+	RunTimeout       *time.Duration `mapstructure:"run_timeout"`
+}
+
+func (c *Config) toDeadlineConfig() queryrun.DeadlineConfig {
+	cfg := queryrun.DeadlineConfig{
+		Defaults: queryrun.Deadlines{
+			ReadinessTimeout: c.Deadlines.ReadinessTimeout,
+			MaxExecRetries:   c.Deadlines.MaxExecRetries,
+			RunTimeout:       c.API.ServerTimeout,
+		},
+	}
+	for _, r := range c.Deadlines.Rules {
+		cfg.Rules = append(cfg.Rules, queryrun.DeadlineRule{
+			MinVersion:       r.MinVersion,
+			MaxVersion:       r.MaxVersion,
+			ReadinessTimeout: r.ReadinessTimeout,
+			MaxExecRetries:   r.MaxExecRetries,
+			RunTimeout:       r.RunTimeout,
+		})
+	}
+
+	return cfg
+}
+
+type ResultCache struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	TTL          time.Duration `mapstructure:"ttl"`
+	MaxSizeBytes uint64        `mapstructure:"max_size_bytes"`
+}
+
+type RunStorage struct {
+	Type RunStorageType `mapstructure:"type"`
+
+	// TTL is how long runs are kept. If it's 0, runs are kept forever.
+	TTL time.Duration `mapstructure:"ttl"`
+
+	// MaxRuns is the number of runs kept in memory storage. If it's 0, the default limit is used.
+	MaxRuns int `mapstructure:"max_runs"`
+}
+
+type OutputProcessing struct {
+	// Redaction replaces values matching the patterns. It's disabled if it's nil.
+	Redaction *Redaction `mapstructure:"redaction"`
+
+	// MaxStreamLength truncates stdout and stderr by the size guard, the last processor.
+	MaxStreamLength uint64 `mapstructure:"max_stream_length"`
+}
+
+type Redaction struct {
+	Patterns    []string `mapstructure:"patterns"`
+	Replacement string   `mapstructure:"replacement"`
+}
+
+// toPipeline builds the processors in order. The size guard is always the last one.
+func (c *OutputProcessing) toPipeline() (*outputproc.Pipeline, error) {
+	var processors []outputproc.Processor
+	if c.Redaction != nil {
+		redactor, err := outputproc.NewRedactor(c.Redaction.Patterns, c.Redaction.Replacement)
+		if err != nil {
+			return nil, err
+		}
+
+		processors = append(processors, redactor)
+	}
+
+	processors = append(processors, outputproc.NewSizeGuard(c.MaxStreamLength))
+
+	return outputproc.NewPipeline(processors...), nil
+}
+
+type BlockList struct {
+	// Message is returned to blocked clients.
+	Message string `mapstructure:"message"`
+
+	// RefreshInterval is how often changes made through other instances are picked up.
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+type Import struct {
+	AllowedHosts []string      `mapstructure:"allowed_hosts"`
+	MaxSizeBytes int64         `mapstructure:"max_size_bytes"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+	MaxRedirects *int          `mapstructure:"max_redirects"`
+}
+
+type Canary struct {
+	Queries        []CanaryQuery `mapstructure:"queries"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	QueueSize      int           `mapstructure:"queue_size"`
+	WebhookURL     string        `mapstructure:"webhook_url" redact:"true"`
+	WebhookTimeout time.Duration `mapstructure:"webhook_timeout"`
+}
+
+type CanaryQuery struct {
+	Query  string `mapstructure:"query"`
+	Expect string `mapstructure:"expect"`
+}
+
+func (c *Canary) toCanaryConfig() canary.Config {
+	cfg := canary.Config{
+		Timeout:        c.Timeout,
+		QueueSize:      c.QueueSize,
+		WebhookURL:     c.WebhookURL,
+		WebhookTimeout: c.WebhookTimeout,
+	}
+	for _, q := range c.Queries {
+		cfg.Queries = append(cfg.Queries, canary.Query{Query: q.Query, Expect: q.Expect})
+	}
+
+	return cfg
+}
+
+func (i *Import) toFetcherConfig() fiddleimport.Config {
+	return fiddleimport.Config{
+		AllowedHosts: i.AllowedHosts,
+		MaxSizeBytes: i.MaxSizeBytes,
+		Timeout:      i.Timeout,
+		MaxRedirects: *i.MaxRedirects,
+	}
+}
+
+type Bisect struct {
+	MaxRuns     uint          `mapstructure:"max_runs"`
+	Parallelism uint          `mapstructure:"parallelism"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+}
+
+func (b *Bisect) toBisectConfig() *api.BisectConfig {
+	if b == nil {
+		return nil
+	}
+
+	return &api.BisectConfig{
+		MaxRuns:     b.MaxRuns,
+		Parallelism: b.Parallelism,
+		Timeout:     b.Timeout,
+	}
+}
+
+type Sessions struct {
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	MaxSessions uint          `mapstructure:"max_sessions"`
+}
+
+func (s *Sessions) toSessionConfig() *api.SessionConfig {
+	if s == nil {
+		return nil
+	}
+
+	return &api.SessionConfig{
+		MaxDuration: s.MaxDuration,
+		IdleTimeout: s.IdleTimeout,
+		MaxSessions: s.MaxSessions,
+	}
+}
+
+// Health configures dependency checks of the health document.
+type Health struct {
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+
+	// MaxTagAge is how long the docker tag cache can stay without updates until it's considered failing.
+	MaxTagAge time.Duration `mapstructure:"max_tag_age"`
+
+	// ReadinessTimeout bounds the readiness probe, its checks are run on every request.
+	ReadinessTimeout time.Duration `mapstructure:"readiness_timeout"`
+
+	// Criticality overrides the default criticality of dependencies. Keys are dependency names or patterns,
+	// e.g. "runner:*". Values are "critical" or "degraded".
+	Criticality map[string]health.Criticality `mapstructure:"criticality"`
+}
+
+// Maintenance configures the maintenance mode, in which runs are served from the result cache only.
+type Maintenance struct {
+	// Manual disables entering the mode while all runners are down, so it's entered through the admin API only.
+	Manual bool `mapstructure:"manual"`
+
+	// Message is reported to clients while runners are down. If it's empty, health.DefaultMaintenanceMessage is used.
+	Message string `mapstructure:"message"`
+}
+
+func (m Maintenance) toMaintenanceConfig(interval time.Duration) health.MaintenanceConfig {
+	cfg := health.MaintenanceConfig{Interval: interval, Message: m.Message}
+	if !m.Manual {
+		cfg.Dependency = "runners"
+	}
+
+	return cfg
+}
+
+// criticality returns the criticality of the dependency: an exact name is preferred to patterns.
+func (h Health) criticality(name string, def health.Criticality) health.Criticality {
+	if c, ok := h.Criticality[name]; ok {
+		return c
+	}
+
+	for pattern, c := range h.Criticality {
+		if matched, _ := path.Match(pattern, name); matched {
+			return c
+		}
+	}
+
+	return def
+}
+
+// Policy describes queries that are rejected before execution. All queries are allowed by default.
+type Policy struct {
+	DeniedStatements []string `mapstructure:"denied_statements"`
+	DeniedClauses    []string `mapstructure:"denied_clauses"`
+	DeniedTables     []string `mapstructure:"denied_tables"`
+	DeniedFunctions  []string `mapstructure:"denied_functions"`
+	MaxStatements    int      `mapstructure:"max_statements"`
+}
+
+func (p Policy) toPolicyConfig() policy.Config {
+	return policy.Config{
+		DeniedStatements: p.DeniedStatements,
+		DeniedClauses:    p.DeniedClauses,
+		DeniedTables:     p.DeniedTables,
+		DeniedFunctions:  p.DeniedFunctions,
+		MaxStatements:    p.MaxStatements,
+	}
 }
 
 type DockerImage struct {
@@ -68,23 +393,310 @@ type DockerImage struct {
 	OS                  string        `mapstructure:"os"`
 	Architecture        string        `mapstructure:"architecture"`
 	CacheExpirationTime time.Duration `mapstructure:"image_tags_cache_expiration_time"`
+
+	// DefaultVersion is the version preselected by clients. It's reported by GET /api/meta.
+	DefaultVersion string `mapstructure:"default_version"`
+
+	// LTS are the long-term support series (e.g. 23.3) the lts version alias is resolved within.
+	LTS []string `mapstructure:"lts"`
+
+	DockerHubRequestTimeout time.Duration `mapstructure:"dockerhub_request_timeout"`
+
+	// Tags are listed by pages; a refresh fails if it takes more pages or time, and the previous list is kept.
+	DockerHubMaxPages     int           `mapstructure:"dockerhub_max_pages"`
+	DockerHubFetchTimeout time.Duration `mapstructure:"dockerhub_fetch_timeout"`
+
+	// DockerHubRetry configures retries of requests throttled by Docker Hub.
+	DockerHubRetry DockerHubRetry `mapstructure:"dockerhub_retry"`
+
+	Deprecations Deprecations `mapstructure:"deprecations"`
+
+	Validation TagValidation `mapstructure:"validation"`
+
+	Rolling RollingTags `mapstructure:"rolling"`
+
+	Journal TagJournal `mapstructure:"journal"`
+
+	// Registries configure registries other than Docker Hub that host repositories, and credentials of
+	// private registries. Credentials of docker.io are only used to pull images.
+	Registries []Registry `mapstructure:"registries"`
+}
+
+// Registry is an OCI distribution registry, e.g. ghcr.io. Anonymous access is used without credentials.
+type Registry struct {
+	Host string `mapstructure:"host"`
+
+	// URL is the base URL of the registry API. It defaults to https://<host>.
+	URL string `mapstructure:"url"`
+
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	// Token is a bearer token used instead of the username and the password.
+	Token string `mapstructure:"token"`
+
+	// MaxRPS bounds requests to the registry API. It defaults to registry.DefaultMaxRPS.
+	MaxRPS int `mapstructure:"max_rps"`
+}
+
+type DockerHubRetry struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+}
+
+// TagJournal keeps recent changes of the tag list for GET /api/tags/changes.
+type TagJournal struct {
+	Size int    `mapstructure:"size"`
+	Path string `mapstructure:"path"`
+}
+
+// RollingTags are tags re-pushed with every build, e.g. head.
+type RollingTags struct {
+	Tags            []string      `mapstructure:"tags"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+type TagValidation struct {
+	Frequency  time.Duration `mapstructure:"frequency"`
+	SampleSize int           `mapstructure:"sample_size"`
+	MissTTL    time.Duration `mapstructure:"miss_ttl"`
+}
+
+type Deprecations struct {
+	Reject bool              `mapstructure:"reject"`
+	Rules  []DeprecationRule `mapstructure:"rules"`
+}
+
+type DeprecationRule struct {
+	MinVersion string `mapstructure:"min_version"`
+	MaxVersion string `mapstructure:"max_version"`
+	Message    string `mapstructure:"message"`
+}
+
+// toMeta describes the deployment to clients.
+func (c *Config) toMeta() api.Meta {
+	defaultFormat := dockerengine.DefaultConfig.DefaultOutputFormat
+	if c.Settings.DefaultFormat != nil {
+		defaultFormat = *c.Settings.DefaultFormat
+	}
+
+	meta := api.Meta{
+		Branding: api.Branding{
+			Name:       c.Branding.Name,
+			ContactURL: c.Branding.ContactURL,
+		},
+		Limits: api.MetaLimits{
+			MaxQueryLength:  c.Limits.MaxQueryLength,
+			MaxOutputLength: c.Limits.MaxOutputLength,
+			TimeoutMs:       c.API.ServerTimeout.Milliseconds(),
+			MaxStatements:   c.Policy.MaxStatements,
+
+			ContentEncodings:      api.ContentEncodings,
+			MaxExpandedBodyLength: c.Limits.MaxExpandedBodyLength,
+			MaxFilesSize:          c.Limits.MaxFilesSize,
+		},
+		Features: api.MetaFeatures{
+			Compare:     true,
+			Import:      c.Import != nil,
+			Bisect:      c.Bisect != nil,
+			Sessions:    c.Sessions != nil,
+			Uploads:     c.Limits.MaxFilesSize > 0,
+			ResultCache: c.ResultCache.Enabled,
+			Tools:       []string{},
+		},
+		Formats: api.MetaFormats{
+			Default: defaultFormat,
+			Allowed: append([]string{}, c.Settings.AllowedFormats...),
+		},
+		Settings: []string{"output_format"},
+		Versions: api.MetaVersions{
+			Default:          c.DockerImage.DefaultVersion,
+			Deprecated:       []api.DeprecatedVersions{},
+			RejectDeprecated: c.DockerImage.Deprecations.Reject,
+		},
+	}
+
+	// Tools and reservations are configured per runner, a feature is enabled if any runner has it.
+	tools := make(map[string]struct{})
+	for _, r := range c.Runners {
+		// Pods of Kubernetes runners use the network of the cluster and support neither tools nor preparation.
+		if r.Kubernetes != nil {
+			meta.Features.NetworkIsolation = lessIsolated(meta.Features.NetworkIsolation, api.NetworkIsolationDefault)
+		}
+		if r.DockerEngine == nil {
+			continue
+		}
+
+		meta.Features.Prepare = meta.Features.Prepare || r.DockerEngine.Reservation != nil
+		meta.Features.NetworkIsolation = lessIsolated(meta.Features.NetworkIsolation, r.DockerEngine.networkIsolation())
+		for _, t := range r.DockerEngine.Tools {
+			if _, exists := tools[t.Name]; !exists {
+				tools[t.Name] = struct{}{}
+				meta.Features.Tools = append(meta.Features.Tools, t.Name)
+			}
+		}
+	}
+	_, meta.Features.Benchmark = tools[benchmarkTool]
+
+	for _, r := range c.DockerImage.Deprecations.Rules {
+		meta.Versions.Deprecated = append(meta.Versions.Deprecated, api.DeprecatedVersions{
+			MinVersion: r.MinVersion,
+			MaxVersion: r.MaxVersion,
+			Message:    r.Message,
+		})
+	}
+
+	return meta
+}
+
+func (d Deprecations) toDeprecationConfig() dockertag.DeprecationConfig {
+	cfg := dockertag.DeprecationConfig{RejectDeprecated: d.Reject}
+	for _, r := range d.Rules {
+		cfg.Rules = append(cfg.Rules, dockertag.DeprecationRule{
+			MinVersion: r.MinVersion,
+			MaxVersion: r.MaxVersion,
+			Message:    r.Message,
+		})
+	}
+
+	return cfg
+}
+
+// Admin configures the admin API. It's served only if the address is set.
+type Admin struct {
+	ListeningAddress string `mapstructure:"address"`
 }
 
 type API struct {
 	ListeningAddress string        `mapstructure:"address"`
 	ServerTimeout    time.Duration `mapstructure:"server_timeout"`
+	LookupTimeout    time.Duration `mapstructure:"lookup_timeout"`
+	TrustedProxies   []string      `mapstructure:"trusted_proxies"`
+	TimingsWindow    time.Duration `mapstructure:"timings_window"`
+	TimingsMaxRuns   int           `mapstructure:"timings_max_runs"`
+	Keys             []APIKey      `mapstructure:"keys"`
+
+	// FinishAbandonedRuns keeps runs going after their clients have disconnected, so the results are saved.
+	FinishAbandonedRuns bool `mapstructure:"finish_abandoned_runs"`
+
+	// ExposeServerLogs returns the logs tail of database servers that have not started with the run error.
+	ExposeServerLogs bool `mapstructure:"expose_server_logs"`
+
+	// DrainTimeout bounds the wait for runs in progress on shutdown, new runs are rejected meanwhile.
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+
+	// MaxInFlightRuns limits the number of runs a single client can have in progress.
+	MaxInFlightRuns MaxInFlightRuns `mapstructure:"max_inflight_runs"`
+
+	// Quota limits the request rate and the daily runs of a client address.
+	Quota *ClientQuota `mapstructure:"quota"`
+
+	// RequestLog configures access logs. Failed requests are always logged.
+	RequestLog RequestLog `mapstructure:"request_log"`
+}
+
+type RequestLog struct {
+	SuccessLevel    string `mapstructure:"success_level"`
+	SuccessSampling uint64 `mapstructure:"success_sampling"`
+}
+
+func (l RequestLog) toRequestLogConfig() api.RequestLogConfig {
+	// The level has been validated.
+	level, _ := zerolog.ParseLevel(l.SuccessLevel)
+
+	return api.RequestLogConfig{
+		SuccessLevel:    level,
+		SuccessSampling: l.SuccessSampling,
+	}
+}
+
+// MaxInFlightRuns are limits of anonymous clients (by address) and API keys. Zero means no limit.
+type MaxInFlightRuns struct {
+	Anonymous     uint `mapstructure:"anonymous"`
+	Authenticated uint `mapstructure:"authenticated"`
+}
+
+type ClientQuota struct {
+	RequestsPerMinute uint     `mapstructure:"requests_per_minute"`
+	Burst             uint     `mapstructure:"burst"`
+	DailyRuns         uint     `mapstructure:"daily_runs"`
+	Exempt            []string `mapstructure:"exempt"`
+}
+
+type APIKey struct {
+	Name        string   `mapstructure:"name"`
+	Key         string   `mapstructure:"key" redact:"true"`
+	Permissions []string `mapstructure:"permissions"`
+}
+
+func (a API) toAPIKeys() api.APIKeys {
+	keys := make(api.APIKeys, len(a.Keys))
+	for _, k := range a.Keys {
+		keys[k.Key] = api.APIKey{
+			Name:        k.Name,
+			Permissions: k.Permissions,
+		}
+	}
+
+	return keys
 }
 
 type AWS struct {
 	AccessKeyID     string `mapstructure:"access_key_id"`
-	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SecretAccessKey string `mapstructure:"secret_access_key" redact:"true"`
 	Region          string `mapstructure:"region"`
 
 	QueryRunsTableName string `mapstructure:"query_runs_table"`
+	RunLabelsTableName string `mapstructure:"run_labels_table"`
+	RunStagesIndexName string `mapstructure:"run_stages_index"`
 }
 
 type Coordinator struct {
 	HealthCheckRetryDelay time.Duration `mapstructure:"health_check_retry_delay"`
+
+	// Balancing is the strategy runs are distributed among runners by.
+	Balancing coordinator.Balancing `mapstructure:"balancing"`
+
+	// RetryOnAnotherRunner executes a run failed by the Docker daemon once more on another runner.
+	RetryOnAnotherRunner bool `mapstructure:"retry_on_another_runner"`
+
+	// WarmPool enables sizing of warm pools by version popularity.
+	WarmPool *WarmPool `mapstructure:"warm_pool"`
+
+	// Scheduler queues runs by priority classes while runners are busy.
+	Scheduler *Scheduler `mapstructure:"scheduler"`
+
+	// CircuitBreaker rejects runs right away while the Docker daemon or the registries are failing.
+	CircuitBreaker *CircuitBreaker `mapstructure:"circuit_breaker"`
+}
+
+type WarmPool struct {
+	ResizeInterval time.Duration `mapstructure:"resize_interval"`
+	HalfLife       time.Duration `mapstructure:"half_life"`
+
+	// HintsPath is the file the popularity is saved to on shutdown and restored from on start.
+	HintsPath string `mapstructure:"hints_path"`
+}
+
+type Scheduler struct {
+	Capacity     uint                      `mapstructure:"capacity"`
+	QueueTimeout time.Duration             `mapstructure:"queue_timeout"`
+	MaxQueued    uint                      `mapstructure:"max_queued"`
+	Classes      map[string]SchedulerClass `mapstructure:"classes"`
+}
+
+type CircuitBreaker struct {
+	FailureRate  float64       `mapstructure:"failure_rate"`
+	MinRequests  uint          `mapstructure:"min_requests"`
+	Window       time.Duration `mapstructure:"window"`
+	OpenDuration time.Duration `mapstructure:"open_duration"`
+}
+
+type SchedulerClass struct {
+	Weight         uint `mapstructure:"weight"`
+	MaxConcurrency uint `mapstructure:"max_concurrency"`
+	MaxQueued      uint `mapstructure:"max_queued"`
 }
 
 type Runner struct {
@@ -93,19 +705,179 @@ type Runner struct {
 	Weight         uint       `mapstructure:"weight"`
 	MaxConcurrency *uint32    `mapstructure:"max_concurrency"`
 
+	// Fallback runners execute runs only while primary ones are dead or saturated, or when they fail runs.
+	Fallback bool `mapstructure:"fallback"`
+
 	DockerEngine *DockerEngine `mapstructure:"docker_engine"`
+	Kubernetes   *Kubernetes   `mapstructure:"kubernetes"`
 }
 
 type DockerEngine struct {
 	DaemonURL        *string         `mapstructure:"daemon_url"`
+	DaemonTLS        *DaemonTLS      `mapstructure:"daemon_tls"`
 	CustomConfigPath *string         `mapstructure:"custom_config_path"`
 	QuotasPath       *string         `mapstructure:"quotas_path"`
 	GC               *DockerEngineGC `mapstructure:"gc"`
-	Prewarm          *Prewarm        `mapsctucture:"prewarm"`
+	Prewarm          *Prewarm        `mapstructure:"prewarm"`
+
+	CommandTemplates []CommandTemplate `mapstructure:"command_templates"`
+	Tools            []Tool            `mapstructure:"tools"`
+
+	RestrictedMode    bool               `mapstructure:"restricted_mode"`
+	RestrictedProfile *RestrictedProfile `mapstructure:"restricted_profile"`
+
+	Reservation *Reservation `mapstructure:"reservation"`
+
+	// Egress enables the restricted egress network mode: database containers reach only allowlisted hosts.
+	Egress *Egress `mapstructure:"egress"`
+
+	// NetworkIsolation cuts containers off the network. It's enabled in none mode by default in restricted mode,
+	// unless egress or container.network_mode is set.
+	NetworkIsolation *NetworkIsolation `mapstructure:"network_isolation"`
+
+	// Mirrors are registries tried before the upstream one, e.g. a pull-through cache.
+	Mirrors       []Mirror       `mapstructure:"mirrors"`
+	MirrorTimeout *time.Duration `mapstructure:"mirror_timeout"`
+
+	// PullRetry retries upstream pulls failed because of transient registry errors.
+	PullRetry *PullRetry `mapstructure:"pull_retry"`
+
+	// PullTimeout bounds an upstream pull attempt, separately from the run deadline. 0 disables the bound.
+	PullTimeout *time.Duration `mapstructure:"pull_timeout"`
+
+	// Architecture overrides the architecture of pulled images, which is the daemon host one by default.
+	Architecture string `mapstructure:"architecture"`
+
+	// SnapshotLogsKB is the max size of the logs tail kept in container snapshots of failed runs.
+	SnapshotLogsKB *uint `mapstructure:"snapshot_logs_kb"`
+
+	// StartupLogsKB is the max size of the logs tail attached to errors of servers that have not started.
+	StartupLogsKB *uint `mapstructure:"startup_logs_kb"`
+
+	// MaxExecutionTime bounds the query execution. The container of a timed-out query is killed.
+	MaxExecutionTime time.Duration `mapstructure:"max_execution_time"`
+
+	// MaxOutputMB bounds the output of a run. Longer outputs are truncated, and the client is stopped.
+	MaxOutputMB uint64 `mapstructure:"max_output_mb"`
+
+	// MaxResultRows is passed to the client with result_overflow_mode=break to stop huge results early.
+	MaxResultRows uint64 `mapstructure:"max_result_rows"`
+
+	// ReadinessPollInterval is the interval between readiness probes of a started server.
+	ReadinessPollInterval *time.Duration `mapstructure:"readiness_poll_interval"`
+
+	// KeepContainerOnFailure holds containers of runs failed because of the infrastructure for HoldPeriod.
+	KeepContainerOnFailure bool           `mapstructure:"keep_container_on_failure"`
+	HoldPeriod             *time.Duration `mapstructure:"hold_period"`
+
+	// Remediation tunes automatic remediations of failures to create or start containers.
+	Remediation *Remediation `mapstructure:"remediation"`
 
 	Container ContainerSettings `mapstructure:"container"`
 }
 
+type CommandTemplate struct {
+	MinVersion string   `mapstructure:"min_version"`
+	MaxVersion string   `mapstructure:"max_version"`
+	Argv       []string `mapstructure:"argv"`
+}
+
+type Tool struct {
+	Name   string      `mapstructure:"name"`
+	Argv   []string    `mapstructure:"argv"`
+	Params []ToolParam `mapstructure:"params"`
+
+	NativeOnly bool `mapstructure:"native_only"`
+}
+
+type ToolParam struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+	Default string `mapstructure:"default"`
+}
+
+type RestrictedProfile struct {
+	MaxExecutionTime *time.Duration `mapstructure:"max_execution_time"`
+	MaxMemoryUsageMB *uint64        `mapstructure:"max_memory_usage_mb"`
+	MaxResultRows    *uint64        `mapstructure:"max_result_rows"`
+}
+
+type Egress struct {
+	ProxyImage string   `mapstructure:"proxy_image"`
+	Allowlist  []string `mapstructure:"allowlist"`
+}
+
+// networkIsolation returns the network access of database containers as reported to clients.
+func (d *DockerEngine) networkIsolation() string {
+	switch {
+	case d.NetworkIsolation != nil && d.NetworkIsolation.Mode == dockerengine.IsolationInternal:
+		return api.NetworkIsolationInternal
+	case d.NetworkIsolation != nil:
+		return api.NetworkIsolationNone
+	case d.Egress != nil:
+		return api.NetworkIsolationEgress
+	case d.Container.NetworkMode != nil && *d.Container.NetworkMode == "none":
+		return api.NetworkIsolationNone
+	default:
+		return api.NetworkIsolationDefault
+	}
+}
+
+// lessIsolated returns the mode that gives more network access.
+func lessIsolated(a, b string) string {
+	rank := map[string]int{
+		api.NetworkIsolationNone:     1,
+		api.NetworkIsolationInternal: 2,
+		api.NetworkIsolationEgress:   3,
+		api.NetworkIsolationDefault:  4,
+	}
+	if rank[b] > rank[a] {
+		return b
+	}
+
+	return a
+}
+
+// DaemonTLS secures the connection to a tcp:// daemon. The client is authenticated if the cert and the key are set.
+type DaemonTLS struct {
+	CAPath   string `mapstructure:"ca_path"`
+	CertPath string `mapstructure:"cert_path"`
+	KeyPath  string `mapstructure:"key_path"`
+}
+
+type NetworkIsolation struct {
+	// Mode is none (no network at all) or internal (a dedicated internal network without external access).
+	Mode    string `mapstructure:"mode"`
+	Network string `mapstructure:"network"`
+
+	// DisableRemoteFunctions restricts url(), s3(), remote() and similar functions to the local server.
+	DisableRemoteFunctions bool `mapstructure:"disable_remote_functions"`
+}
+
+type Mirror struct {
+	Repository string   `mapstructure:"repository"`
+	Endpoints  []string `mapstructure:"endpoints"`
+}
+
+type PullRetry struct {
+	MaxAttempts  uint          `mapstructure:"max_attempts"`
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	MaxDelay     time.Duration `mapstructure:"max_delay"`
+}
+
+type Reservation struct {
+	TTL             time.Duration `mapstructure:"ttl"`
+	MaxReservations uint          `mapstructure:"max_reservations"`
+	MaxPerClient    uint          `mapstructure:"max_reservations_per_client"`
+}
+
+type Remediation struct {
+	MinInterval            *time.Duration `mapstructure:"min_interval"`
+	MemoryFailureThreshold *uint          `mapstructure:"memory_failure_threshold"`
+	MemoryFailureWindow    *time.Duration `mapstructure:"memory_failure_window"`
+	ThrottlePeriod         *time.Duration `mapstructure:"throttle_period"`
+}
+
 type DockerEngineGC struct {
 	TriggerFrequency time.Duration `mapstructure:"trigger_frequency"`
 
@@ -113,66 +885,293 @@ type DockerEngineGC struct {
 
 	ImageGCCountThreshold *uint `mapstructure:"image_count_threshold"`
 	ImageBufferSize       uint  `mapstructure:"image_buffer_size"`
+
+	ImageSizeBudgetMB *uint64 `mapstructure:"image_size_budget_mb"`
+
+	DiskPressure *DiskPressureGC `mapstructure:"disk_pressure"`
+
+	DisableContainers     bool `mapstructure:"disable_containers"`
+	DisableEgressNetworks bool `mapstructure:"disable_egress_networks"`
+	DisableVolumes        bool `mapstructure:"disable_volumes"`
+	PruneBuildCache       bool `mapstructure:"prune_build_cache"`
+}
+
+// DiskPressureGC evicts least recently used images once the disk usage exceeds the high watermark.
+type DiskPressureGC struct {
+	// Either the filesystem of the data root is measured, or the total size reported by the daemon is bounded by the capacity.
+	DataRoot   string  `mapstructure:"data_root"`
+	CapacityMB *uint64 `mapstructure:"capacity_mb"`
+
+	HighWatermarkPercent uint `mapstructure:"high_watermark_percent"`
+	LowWatermarkPercent  uint `mapstructure:"low_watermark_percent"`
 }
 
 type Prewarm struct {
 	MaxWarmContainers *uint `mapstructure:"max_warm_containers"`
+
+	// Bounds of the warm pool allocation, they are used if coordinator.warm_pool is set.
+	MinPerVersion uint            `mapstructure:"min_per_version"`
+	MaxPerVersion uint            `mapstructure:"max_per_version"`
+	Pinned        []PinnedVersion `mapstructure:"pinned"`
+
+	IdleTTL time.Duration `mapstructure:"idle_ttl"`
+}
+
+type PinnedVersion struct {
+	Version string `mapstructure:"version"`
+	Count   uint   `mapstructure:"count"`
 }
 
 type ContainerSettings struct {
-	NetworkMode   *string `mapstucture:"network_mode"`
+	NetworkMode   *string `mapstructure:"network_mode"`
 	CPULimit      float64 `mapstructure:"cpu_limit"`
 	CPUSet        string  `mapstructure:"cpu_cores_set"`
 	MemoryLimitMB float64 `mapstructure:"memory_limit_mb"`
+	PidsLimit     int64   `mapstructure:"pids_limit"`
 }
 
-func (r *Runner) Validate() error {
-	if r.Name == "" {
-		return errors.New("runner.name is required")
-	}
+// Kubernetes configures a runner executing runs in pods of a cluster.
+type Kubernetes struct {
+	// APIServer, TokenPath and CAPath default to the in-cluster ones of the service account.
+	APIServer string  `mapstructure:"api_server"`
+	TokenPath *string `mapstructure:"token_path"`
+	CAPath    *string `mapstructure:"ca_path"`
+
+	Namespace        string            `mapstructure:"namespace"`
+	ImagePullSecrets []string          `mapstructure:"image_pull_secrets"`
+	NodeSelector     map[string]string `mapstructure:"node_selector"`
+
+	Resources KubernetesResources `mapstructure:"resources"`
+
+	ReadinessTimeout *time.Duration `mapstructure:"readiness_timeout"`
+	MaxExecutionTime time.Duration  `mapstructure:"max_execution_time"`
+	MaxOutputMB      uint64         `mapstructure:"max_output_mb"`
+
+	GC *KubernetesGC `mapstructure:"gc"`
+}
+
+type KubernetesResources struct {
+	CPURequest    string `mapstructure:"cpu_request"`
+	CPULimit      string `mapstructure:"cpu_limit"`
+	MemoryRequest string `mapstructure:"memory_request"`
+	MemoryLimit   string `mapstructure:"memory_limit"`
+}
+
+type KubernetesGC struct {
+	TriggerFrequency time.Duration `mapstructure:"trigger_frequency"`
+	PodTTL           time.Duration `mapstructure:"pod_ttl"`
+}
+
+// Validate verifies the runner and sets default values for missed fields. All the problems are reported at once.
+func (r *Runner) Validate() error {
+	if r.Name == "" {
+		return errors.New("runner.name is required")
+	}
+
+	var errs configErrors
+
+	if r.Weight == 0 {
+		r.Weight = coordinator.DefaultWeight
+		zlog.Debug().Str("runner", r.Name).Int("new_value", coordinator.DefaultWeight).Msg("weight has been set")
+	}
+
+	if r.MaxConcurrency != nil && *r.MaxConcurrency < 1 {
+		errs.add(errors.Errorf("[%s] runner.max_concurrency must be > 0, but %d has been found", r.Name, *r.MaxConcurrency))
+	}
+
+	switch r.Type {
+	case RunnerTypeDockerEngine:
+		if r.DockerEngine == nil {
+			errs.add(errors.Errorf("[%s] runner.docker_engine is required", r.Name))
+			break
+		}
+
+		if prewarm := r.DockerEngine.Prewarm; prewarm != nil {
+			if prewarm.MaxPerVersion != 0 && prewarm.MinPerVersion > prewarm.MaxPerVersion {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.prewarm.min_per_version must not exceed max_per_version", r.Name))
+			}
+			for _, p := range prewarm.Pinned {
+				if p.Version == "" {
+					errs.add(errors.Errorf("[%s] runner.docker_engine.prewarm.pinned.version is required", r.Name))
+				}
+			}
+			if prewarm.IdleTTL < 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.prewarm.idle_ttl cannot be negative", r.Name))
+			}
+		}
+
+		if r.DockerEngine.MaxExecutionTime < 0 {
+			errs.add(errors.Errorf("[%s] runner.docker_engine.max_execution_time cannot be negative", r.Name))
+		}
+		if retry := r.DockerEngine.PullRetry; retry != nil {
+			if retry.MaxAttempts < 1 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.pull_retry.max_attempts must be > 0", r.Name))
+			}
+			if retry.InitialDelay < 0 || retry.MaxDelay < 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.pull_retry delays cannot be negative", r.Name))
+			}
+			if retry.MaxDelay != 0 && retry.MaxDelay < retry.InitialDelay {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.pull_retry.max_delay must not be less than initial_delay", r.Name))
+			}
+		}
+		if t := r.DockerEngine.PullTimeout; t != nil && *t < 0 {
+			errs.add(errors.Errorf("[%s] runner.docker_engine.pull_timeout cannot be negative", r.Name))
+		}
+		if p := r.DockerEngine.ReadinessPollInterval; p != nil && *p <= 0 {
+			errs.add(errors.Errorf("[%s] runner.docker_engine.readiness_poll_interval must be positive", r.Name))
+		}
+		if rem := r.DockerEngine.Remediation; rem != nil {
+			if rem.MinInterval != nil && *rem.MinInterval < 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.remediation.min_interval cannot be negative", r.Name))
+			}
+			if rem.MemoryFailureThreshold != nil && *rem.MemoryFailureThreshold < 1 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.remediation.memory_failure_threshold must be > 0", r.Name))
+			}
+			if rem.MemoryFailureWindow != nil && *rem.MemoryFailureWindow <= 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.remediation.memory_failure_window must be positive", r.Name))
+			}
+			if rem.ThrottlePeriod != nil && *rem.ThrottlePeriod <= 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.remediation.throttle_period must be positive", r.Name))
+			}
+		}
+
+		if r.DockerEngine.RestrictedMode && r.DockerEngine.NetworkIsolation == nil &&
+			r.DockerEngine.Egress == nil && r.DockerEngine.Container.NetworkMode == nil {
+			r.DockerEngine.NetworkIsolation = &NetworkIsolation{Mode: dockerengine.IsolationNone}
+			zlog.Debug().Str("runner", r.Name).Msg("network isolation has been enabled for restricted mode")
+		}
+		if iso := r.DockerEngine.NetworkIsolation; iso != nil {
+			switch iso.Mode {
+			case dockerengine.IsolationNone:
+			case dockerengine.IsolationInternal:
+				if iso.Network == "" {
+					iso.Network = dockerengine.DefaultIsolationNetwork
+				}
+			default:
+				errs.add(errors.Errorf("[%s] runner.docker_engine.network_isolation.mode must be %s or %s, but '%s' found",
+					r.Name, dockerengine.IsolationNone, dockerengine.IsolationInternal, iso.Mode))
+			}
+			if r.DockerEngine.Egress != nil || r.DockerEngine.Container.NetworkMode != nil {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.network_isolation cannot be set together with egress or container.network_mode", r.Name))
+			}
+		}
 
-	if r.Weight == 0 {
-		r.Weight = coordinator.DefaultWeight
-		zlog.Debug().Str("runner", r.Name).Int("new_value", coordinator.DefaultWeight).Msg("weight has been set")
-	}
+		daemonURL := r.DockerEngine.DaemonURL
+		if daemonURL != nil && !strings.HasPrefix(*daemonURL, "ssh://") && !strings.HasPrefix(*daemonURL, "tcp://") &&
+			!strings.HasPrefix(*daemonURL, "unix://") && !strings.HasPrefix(*daemonURL, "/") {
+			errs.add(errors.Errorf("[%s] runner.docker_engine.daemon_url must be empty, a socket path or start with 'ssh://', 'tcp://' or 'unix://', but %s found",
+				r.Name, *daemonURL))
+		}
+		if tls := r.DockerEngine.DaemonTLS; tls != nil {
+			if daemonURL == nil || !strings.HasPrefix(*daemonURL, "tcp://") {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.daemon_tls requires a tcp:// daemon_url", r.Name))
+			}
+			if tls.CAPath == "" {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.daemon_tls.ca_path is required", r.Name))
+			}
+			if (tls.CertPath == "") != (tls.KeyPath == "") {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.daemon_tls.cert_path and key_path must be set together", r.Name))
+			}
+		}
 
-	if r.MaxConcurrency != nil && *r.MaxConcurrency < 1 {
-		return errors.Errorf("max_concurrency must be > 0, but %d has been found", *r.MaxConcurrency)
-	}
+		if gc := r.DockerEngine.GC; gc != nil {
+			if gc.TriggerFrequency == 0 {
+				gc.TriggerFrequency = 1 * time.Minute
+			}
+			if gc.TriggerFrequency < 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.gc.trigger_frequency must be positive", r.Name))
+			}
+			if gc.ContainerTTL != nil && *gc.ContainerTTL <= 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.gc.container_ttl must be positive", r.Name))
+			}
+			if gc.ImageGCCountThreshold != nil && *gc.ImageGCCountThreshold == 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.gc.image_count_threshold must be > 0", r.Name))
+			}
+			if gc.ImageSizeBudgetMB != nil && *gc.ImageSizeBudgetMB == 0 {
+				errs.add(errors.Errorf("[%s] runner.docker_engine.gc.image_size_budget_mb must be > 0", r.Name))
+			}
 
-	switch r.Type {
-	case RunnerTypeDockerEngine:
-		gc := r.DockerEngine.GC
-		if gc == nil {
+			if dp := gc.DiskPressure; dp != nil {
+				if dp.HighWatermarkPercent == 0 {
+					dp.HighWatermarkPercent = 85
+				}
+				if dp.LowWatermarkPercent == 0 {
+					dp.LowWatermarkPercent = 70
+				}
+				if dp.HighWatermarkPercent > 100 || dp.LowWatermarkPercent >= dp.HighWatermarkPercent {
+					errs.add(errors.Errorf("[%s] runner.docker_engine.gc.disk_pressure watermarks must satisfy 0 < low < high <= 100", r.Name))
+				}
+				if (dp.DataRoot == "") == (dp.CapacityMB == nil) {
+					errs.add(errors.Errorf("[%s] exactly one of runner.docker_engine.gc.disk_pressure.data_root and capacity_mb must be set", r.Name))
+				}
+				if dp.CapacityMB != nil && *dp.CapacityMB == 0 {
+					errs.add(errors.Errorf("[%s] runner.docker_engine.gc.disk_pressure.capacity_mb must be > 0", r.Name))
+				}
+			}
+		}
+
+	case RunnerTypeKubernetes:
+		k := r.Kubernetes
+		if k == nil {
+			errs.add(errors.Errorf("[%s] runner.kubernetes is required", r.Name))
 			break
 		}
 
-		if gc.TriggerFrequency == 0 {
-			gc.TriggerFrequency = 1 * time.Minute
+		if k.Namespace == "" {
+			errs.add(errors.Errorf("[%s] runner.kubernetes.namespace is required", r.Name))
+		}
+		if k.APIServer == "" && (os.Getenv("KUBERNETES_SERVICE_HOST") == "" || os.Getenv("KUBERNETES_SERVICE_PORT") == "") {
+			errs.add(errors.Errorf("[%s] runner.kubernetes.api_server is required outside of a cluster", r.Name))
+		}
+		if k.ReadinessTimeout != nil && *k.ReadinessTimeout <= 0 {
+			errs.add(errors.Errorf("[%s] runner.kubernetes.readiness_timeout must be positive", r.Name))
+		}
+		if k.MaxExecutionTime < 0 {
+			errs.add(errors.Errorf("[%s] runner.kubernetes.max_execution_time cannot be negative", r.Name))
 		}
 
-		daemonURL := r.DockerEngine.DaemonURL
-		if daemonURL != nil && !strings.HasPrefix(*daemonURL, "ssh://") {
-			return errors.Errorf("[%s] runner.docker_daemon.daemon_url must be empty or start with 'ssh://', but %s found", r.Name, *daemonURL)
+		if gc := k.GC; gc != nil {
+			if gc.TriggerFrequency == 0 {
+				gc.TriggerFrequency = 5 * time.Minute
+			}
+			if gc.PodTTL == 0 {
+				gc.PodTTL = 30 * time.Minute
+			}
+			if gc.TriggerFrequency < 0 {
+				errs.add(errors.Errorf("[%s] runner.kubernetes.gc.trigger_frequency must be positive", r.Name))
+			}
+			if gc.PodTTL < 0 {
+				errs.add(errors.Errorf("[%s] runner.kubernetes.gc.pod_ttl must be positive", r.Name))
+			}
 		}
 
 	case "":
-		return errors.Errorf("[%s] runner.type is required", r.Name)
+		errs.add(errors.Errorf("[%s] runner.type is required", r.Name))
 
 	default:
-		return errors.Errorf("unknown runner %s type %s (supported: %s)", r.Name, r.Type, RunnerTypeDockerEngine)
+		errs.add(errors.Errorf("[%s] unknown runner.type %s (supported: %s, %s)", r.Name, r.Type,
+			RunnerTypeDockerEngine, RunnerTypeKubernetes))
 	}
 
-	return nil
+	return errs.err()
 }
 
-func LoadConfig() (*Config, error) {
-	path := os.Getenv("CONFIG_PATH")
-	if path == "" {
-		path = DefaultConfigPath
+// ConfigPath returns the config location: the flag value is preferred to CONFIG_PATH env.
+func ConfigPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		return path
 	}
 
-	gconfig.WithOptions(
+	return DefaultConfigPath
+}
+
+// LoadConfig loads the config file and validates it. Values can refer to env variables, e.g. ${AWS_REGION}.
+func LoadConfig(path string) (*Config, error) {
+	// A new instance is created on every call, so the config can be reloaded.
+	c := gconfig.NewWithOptions("config",
 		gconfig.ParseEnv,
 		gconfig.Readonly,
 		func(opts *gconfig.Options) {
@@ -183,15 +1182,15 @@ func LoadConfig() (*Config, error) {
 			}
 		},
 	)
-	gconfig.AddDriver(gyaml.Driver)
+	c.AddDriver(gyaml.Driver)
 
-	err := gconfig.LoadFiles(path)
+	err := c.LoadFiles(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to load config")
 	}
 
 	cfg := new(Config)
-	err = gconfig.BindStruct("", cfg)
+	err = c.BindStruct("", cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "config binding failed")
 	}
@@ -205,7 +1204,10 @@ func LoadConfig() (*Config, error) {
 }
 
 // validate verifies the loaded config and sets default values for missed fields.
+// All the problems are reported at once, so they can be fixed in a single pass.
 func (c *Config) validate() error {
+	var errs configErrors
+
 	if c.LogLevel == "" {
 		c.LogLevel = "debug"
 	}
@@ -217,21 +1219,99 @@ func (c *Config) validate() error {
 	case JSONLogFormat, PrettyLogFormat:
 
 	default:
-		return fmt.Errorf("invalid log format (available: %s, %s)", JSONLogFormat, PrettyLogFormat)
+		errs.add(fmt.Errorf("invalid log format (available: %s, %s)", JSONLogFormat, PrettyLogFormat))
 	}
 
 	if len(c.DockerImage.Repositories) == 0 {
-		return errors.New("docker_image.repositories must be non-empty")
+		errs.add(errors.New("docker_image.repositories must be non-empty"))
+	}
+
+	registries := make(map[string]struct{}, len(c.DockerImage.Registries))
+	for i := range c.DockerImage.Registries {
+		r := &c.DockerImage.Registries[i]
+
+		// The host is normalized the same way as hosts of repositories, e.g. aliases of Docker Hub.
+		ref, err := qrunner.ParseRepositoryRef(r.Host + "/registry/probe")
+		if r.Host == "" || err != nil || ref.Namespace != "registry" {
+			errs.add(errors.Errorf("docker_image.registries: invalid host '%s'", r.Host))
+			continue
+		}
+		r.Host = ref.Registry
+
+		if _, exists := registries[r.Host]; exists {
+			errs.add(errors.Errorf("docker_image.registries: '%s' is configured several times", r.Host))
+			continue
+		}
+		registries[r.Host] = struct{}{}
+
+		if r.Token != "" && (r.Username != "" || r.Password != "") {
+			errs.add(errors.Errorf("docker_image.registries: token of '%s' cannot be set together with username and password", r.Host))
+		}
+		if r.URL == "" {
+			r.URL = "https://" + r.Host
+		}
+		if r.MaxRPS < 0 {
+			errs.add(errors.Errorf("docker_image.registries: max_rps of '%s' must be positive", r.Host))
+		}
+	}
+
+	// Repositories are normalized, so tags are fetched and images are pulled by the same name however
+	// they are spelled in the config. Docker Hub repositories are kept as paths the Docker Hub API expects,
+	// repositories of other registries are prefixed with their hosts.
+	repositories := make(map[string]struct{}, len(c.DockerImage.Repositories))
+	for i, repository := range c.DockerImage.Repositories {
+		ref, err := qrunner.ParseRepositoryRef(repository)
+		if err != nil {
+			errs.add(errors.Wrap(err, "invalid docker_image.repositories"))
+			continue
+		}
+
+		normalized := ref.Path()
+		if !ref.IsDockerHub() {
+			normalized = ref.String()
+		}
+		if _, exists := repositories[normalized]; exists {
+			errs.add(errors.Errorf("docker_image.repositories: '%s' is listed several times", normalized))
+			continue
+		}
+
+		repositories[normalized] = struct{}{}
+		c.DockerImage.Repositories[i] = normalized
 	}
 	if c.DockerImage.OS == "" {
-		return errors.New("docker_image.os is required")
+		errs.add(errors.New("docker_image.os is required"))
 	}
 	if c.DockerImage.Architecture == "" {
-		return errors.New("docker_image.architecture is required")
+		errs.add(errors.New("docker_image.architecture is required"))
+	}
+	for _, series := range c.DockerImage.LTS {
+		parsed := chsemver.Parse(series)
+		if len(parsed) != 2 || !chsemver.IsNumeric(parsed) {
+			errs.add(errors.Errorf("docker_image.lts: '%s' is not a major.minor series", series))
+		}
 	}
 	if c.DockerImage.CacheExpirationTime == 0 {
 		c.DockerImage.CacheExpirationTime = dockertag.DefaultExpirationTime
 	}
+	if c.DockerImage.Journal.Size < 0 {
+		errs.add(errors.New("docker_image.journal.size must not be negative"))
+	}
+	if c.DockerImage.DockerHubMaxPages < 0 {
+		errs.add(errors.New("docker_image.dockerhub_max_pages must not be negative"))
+	}
+	if c.DockerImage.DockerHubFetchTimeout < 0 {
+		errs.add(errors.New("docker_image.dockerhub_fetch_timeout must not be negative"))
+	}
+	retry := c.DockerImage.DockerHubRetry
+	if retry.MaxAttempts < 0 || retry.InitialBackoff < 0 || retry.MaxBackoff < 0 {
+		errs.add(errors.New("docker_image.dockerhub_retry must not be negative"))
+	}
+	if retry.InitialBackoff != 0 && retry.MaxBackoff != 0 && retry.InitialBackoff > retry.MaxBackoff {
+		errs.add(errors.New("docker_image.dockerhub_retry.initial_backoff must not exceed max_backoff"))
+	}
+	if c.DockerImage.Rolling.RefreshInterval == 0 {
+		c.DockerImage.Rolling.RefreshInterval = dockertag.DefaultRollingRefreshInterval
+	}
 
 	if c.API.ListeningAddress == "" {
 		c.API.ListeningAddress = ":9000"
@@ -239,6 +1319,24 @@ func (c *Config) validate() error {
 	if c.API.ServerTimeout == 0 {
 		c.API.ServerTimeout = 60 * time.Second
 	}
+	if c.API.LookupTimeout == 0 {
+		c.API.LookupTimeout = 10 * time.Second
+	}
+	if c.API.DrainTimeout == 0 {
+		c.API.DrainTimeout = c.API.ServerTimeout
+	}
+	if c.API.TimingsWindow == 0 {
+		c.API.TimingsWindow = time.Hour
+	}
+	if c.API.TimingsMaxRuns == 0 {
+		c.API.TimingsMaxRuns = 1000
+	}
+	if c.API.RequestLog.SuccessLevel == "" {
+		c.API.RequestLog.SuccessLevel = zerolog.LevelInfoValue
+	}
+	if _, err := zerolog.ParseLevel(c.API.RequestLog.SuccessLevel); err != nil {
+		errs.add(errors.Wrap(err, "api.request_log.success_level"))
+	}
 
 	if c.Limits.MaxQueryLength == 0 {
 		c.Limits.MaxQueryLength = DefaultMaxQueryLength
@@ -246,41 +1344,451 @@ func (c *Config) validate() error {
 	if c.Limits.MaxOutputLength == 0 {
 		c.Limits.MaxOutputLength = DefaultMaxOutputLength
 	}
+	if c.Limits.MaxExpandedBodyLength == 0 {
+		// JSON escaping can double the length of a query, and files are encoded in base64.
+		c.Limits.MaxExpandedBodyLength = 2*c.Limits.MaxQueryLength + (c.Limits.MaxFilesSize+2)/3*4 + 64*1024
+	}
+	if c.Limits.MaxCompressedBodyLength == 0 {
+		c.Limits.MaxCompressedBodyLength = c.Limits.MaxExpandedBodyLength
+	}
+	if c.Limits.MaxExpandedBodyLength < c.Limits.MaxQueryLength {
+		errs.add(errors.New("limits.max_expanded_body_length cannot be less than max_query_length"))
+	}
+
+	if p := c.OutputProcessing; p != nil {
+		if p.MaxStreamLength == 0 {
+			p.MaxStreamLength = c.Limits.MaxOutputLength
+		}
+		if p.Redaction != nil && len(p.Redaction.Patterns) == 0 {
+			errs.add(errors.New("output_processing.redaction.patterns cannot be empty"))
+		} else if _, err := p.toPipeline(); err != nil {
+			errs.add(errors.Wrap(err, "output_processing"))
+		}
+	}
+
+	if c.Deadlines.MaxExecRetries == 0 {
+		c.Deadlines.MaxExecRetries = dockerengine.DefaultConfig.MaxExecRetries
+	}
+	deadlines := c.toDeadlineConfig()
+	err := deadlines.Validate()
+	if err != nil {
+		errs.add(errors.Wrap(err, "invalid deadlines"))
+	}
+
+	if c.ResultCache.TTL == 0 {
+		c.ResultCache.TTL = resultcache.DefaultTTL
+	}
+	if c.ResultCache.MaxSizeBytes == 0 {
+		c.ResultCache.MaxSizeBytes = resultcache.DefaultMaxSizeBytes
+	}
+
+	if c.Import != nil {
+		if c.Import.MaxSizeBytes == 0 {
+			c.Import.MaxSizeBytes = fiddleimport.DefaultMaxSizeBytes
+		}
+		if c.Import.Timeout == 0 {
+			c.Import.Timeout = fiddleimport.DefaultTimeout
+		}
+		if c.Import.MaxRedirects == nil {
+			maxRedirects := fiddleimport.DefaultMaxRedirects
+			c.Import.MaxRedirects = &maxRedirects
+		}
+
+		cfg := c.Import.toFetcherConfig()
+		err := cfg.Validate()
+		if err != nil {
+			errs.add(errors.Wrap(err, "invalid import"))
+		}
+	}
+
+	if c.Bisect != nil {
+		if c.Bisect.MaxRuns == 0 {
+			c.Bisect.MaxRuns = 16
+		}
+		if c.Bisect.Parallelism == 0 {
+			c.Bisect.Parallelism = 2
+		}
+		if c.Bisect.Timeout == 0 {
+			c.Bisect.Timeout = 3 * time.Minute
+		}
+		if c.Bisect.MaxRuns < 2 {
+			errs.add(errors.New("bisect.max_runs must be at least 2"))
+		}
+	}
+
+	if c.Sessions != nil {
+		if c.Sessions.MaxDuration == 0 {
+			c.Sessions.MaxDuration = 5 * time.Minute
+		}
+		if c.Sessions.IdleTimeout == 0 {
+			c.Sessions.IdleTimeout = time.Minute
+		}
+		if c.Sessions.MaxSessions == 0 {
+			c.Sessions.MaxSessions = 10
+		}
+		if c.Sessions.IdleTimeout > c.Sessions.MaxDuration {
+			errs.add(errors.New("sessions.idle_timeout cannot exceed sessions.max_duration"))
+		}
+	}
+
+	if c.Canary != nil {
+		if c.Canary.Timeout == 0 {
+			c.Canary.Timeout = canary.DefaultTimeout
+		}
+		if c.Canary.QueueSize == 0 {
+			c.Canary.QueueSize = canary.DefaultQueueSize
+		}
+		if c.Canary.WebhookTimeout == 0 {
+			c.Canary.WebhookTimeout = canary.DefaultWebhookTimeout
+		}
+		for _, q := range c.Canary.Queries {
+			if strings.TrimSpace(q.Query) == "" {
+				errs.add(errors.New("canary.queries: query cannot be empty"))
+			}
+		}
+		if c.Canary.WebhookURL != "" {
+			u, err := url.Parse(c.Canary.WebhookURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs.add(errors.Errorf("canary.webhook_url: invalid url '%s'", c.Canary.WebhookURL))
+			}
+		}
+	}
+
+	if c.Branding.ContactURL != "" {
+		u, err := url.Parse(c.Branding.ContactURL)
+		if err != nil || u.Scheme == "" {
+			errs.add(errors.Errorf("branding.contact_url: invalid url '%s'", c.Branding.ContactURL))
+		}
+	}
 
 	if c.PrometheusExportAddress == "" {
 		c.PrometheusExportAddress = ":2112"
 	}
+	if c.PrometheusPath == "" {
+		c.PrometheusPath = "/metrics"
+	}
+	if !strings.HasPrefix(c.PrometheusPath, "/") {
+		errs.add(errors.New("prometheus_path must start with /"))
+	}
+
+	if c.Health.Interval == 0 {
+		c.Health.Interval = health.DefaultInterval
+	}
+	if c.Health.Timeout == 0 {
+		c.Health.Timeout = health.DefaultTimeout
+	}
+	if c.Health.ReadinessTimeout == 0 {
+		c.Health.ReadinessTimeout = health.DefaultReadinessTimeout
+	}
+	if c.Health.MaxTagAge == 0 {
+		// The cache is refreshed once it expires, so a single failed update is tolerated.
+		c.Health.MaxTagAge = 2 * c.DockerImage.CacheExpirationTime
+	}
+	for pattern, criticality := range c.Health.Criticality {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs.add(errors.Wrapf(err, "health.criticality: invalid pattern '%s'", pattern))
+		}
+		if criticality != health.CriticalityCritical && criticality != health.CriticalityDegraded {
+			errs.add(errors.Errorf("health.criticality: unknown criticality '%s' of '%s' (supported: %s, %s)",
+				criticality, pattern, health.CriticalityCritical, health.CriticalityDegraded))
+		}
+	}
+
+	switch c.RunStorage.Type {
+	case "":
+		c.RunStorage.Type = RunStorageDynamoDB
+	case RunStorageDynamoDB, RunStorageMemory:
+	case RunStorageNone:
+		if c.Canary != nil {
+			errs.add(errors.New("canary requires run_storage, as canary runs are saved"))
+		}
+		if c.Import != nil {
+			errs.add(errors.New("import requires run_storage, as imported fiddles are saved"))
+		}
+		if c.BlockList != nil {
+			errs.add(errors.New("block_list requires run_storage, as the list is stored with runs"))
+		}
+	default:
+		errs.add(errors.Errorf("run_storage.type: unknown type '%s' (supported: %s, %s, %s)",
+			c.RunStorage.Type, RunStorageDynamoDB, RunStorageMemory, RunStorageNone))
+	}
+	if c.RunStorage.TTL < 0 {
+		errs.add(errors.New("run_storage.ttl cannot be negative"))
+	}
+	if c.RunStorage.MaxRuns < 0 {
+		errs.add(errors.New("run_storage.max_runs cannot be negative"))
+	}
 
-	if c.AWS.Region == "" {
-		return errors.New("aws.region is required")
+	if c.BlockList != nil {
+		if c.BlockList.RefreshInterval < 0 {
+			errs.add(errors.New("block_list.refresh_interval cannot be negative"))
+		}
+		if c.BlockList.RefreshInterval == 0 {
+			c.BlockList.RefreshInterval = blocklist.DefaultRefreshInterval
+		}
 	}
-	if c.AWS.QueryRunsTableName == "" {
-		return errors.New("aws.query_runs_table is required")
+
+	if c.RunStorage.Type == RunStorageDynamoDB {
+		if c.AWS.Region == "" {
+			errs.add(errors.New("aws.region is required"))
+		}
+		if c.AWS.QueryRunsTableName == "" {
+			errs.add(errors.New("aws.query_runs_table is required"))
+		}
+		if c.Limits.MaxFilesSize > maxDynamoDBFilesSize {
+			errs.add(errors.Errorf("limits.max_files_size cannot exceed %d with the dynamodb run_storage, files are saved with runs",
+				maxDynamoDBFilesSize))
+		}
 	}
 
 	if c.Coordinator.HealthCheckRetryDelay == 0 {
 		c.Coordinator.HealthCheckRetryDelay = coordinator.DefaultHealthCheckRetryDelay
 	}
+	switch c.Coordinator.Balancing {
+	case "":
+		c.Coordinator.Balancing = coordinator.BalancingWeightedRandom
+	case coordinator.BalancingWeightedRandom, coordinator.BalancingRoundRobin, coordinator.BalancingLeastOutstanding:
+	default:
+		errs.add(errors.Errorf("coordinator.balancing: unknown strategy '%s' (supported: %s, %s, %s)", c.Coordinator.Balancing,
+			coordinator.BalancingWeightedRandom, coordinator.BalancingRoundRobin, coordinator.BalancingLeastOutstanding))
+	}
+	if wp := c.Coordinator.WarmPool; wp != nil {
+		if wp.ResizeInterval == 0 {
+			wp.ResizeInterval = coordinator.DefaultWarmPoolResizeInterval
+		}
+		if wp.HalfLife == 0 {
+			wp.HalfLife = coordinator.DefaultWarmPoolHalfLife
+		}
+	}
+
+	if q := c.API.Quota; q != nil {
+		if q.RequestsPerMinute == 0 && q.DailyRuns == 0 {
+			errs.add(errors.New("api.quota: requests_per_minute or daily_runs is required"))
+		}
+		if q.Burst > 0 && q.RequestsPerMinute == 0 {
+			errs.add(errors.New("api.quota: burst requires requests_per_minute"))
+		}
+	}
+
+	uniqueKeys := make(map[string]struct{}, len(c.API.Keys))
+	for _, k := range c.API.Keys {
+		if k.Name == "" || k.Key == "" {
+			errs.add(errors.New("api.keys: name and key are required"))
+			continue
+		}
+
+		_, exists := uniqueKeys[k.Key]
+		if exists {
+			errs.add(errors.Errorf("api.keys: key of '%s' is not unique", k.Name))
+		}
+
+		uniqueKeys[k.Key] = struct{}{}
+
+		for _, p := range k.Permissions {
+			if !isPermission(p) {
+				errs.add(errors.Errorf("api.keys: unknown permission '%s' of '%s' (supported: %s)",
+					p, k.Name, strings.Join(api.Permissions, ", ")))
+			}
+		}
+	}
 
 	if len(c.Runners) == 0 {
-		return errors.New("empty runner list")
+		errs.add(errors.New("empty runner list"))
 	}
 
 	uniqueRunners := make(map[string]struct{}, len(c.Runners))
 	for i := range c.Runners {
-		err := c.Runners[i].Validate()
-		if err != nil {
-			return errors.Wrap(err, "runner validation")
-		}
+		errs.add(c.Runners[i].Validate())
 
 		_, exists := uniqueRunners[c.Runners[i].Name]
 		if exists {
-			return errors.Errorf("runner names must be unique, but '%s' is not unique", c.Runners[i].Name)
+			errs.add(errors.Errorf("runner names must be unique, but '%s' is not unique", c.Runners[i].Name))
 		}
 
 		uniqueRunners[c.Runners[i].Name] = struct{}{}
 	}
 
+	if c.Coordinator.Scheduler != nil {
+		err := c.Coordinator.Scheduler.validate(c.Runners)
+		if err != nil {
+			errs.add(errors.Wrap(err, "coordinator.scheduler"))
+		}
+	}
+
+	if c.Coordinator.CircuitBreaker != nil {
+		err := c.Coordinator.CircuitBreaker.validate()
+		if err != nil {
+			errs.add(errors.Wrap(err, "coordinator.circuit_breaker"))
+		}
+	}
+
+	return errs.err()
+}
+
+// redactedValue replaces secrets in the printed config.
+const redactedValue = "<redacted>"
+
+// Print writes the effective config as YAML. Fields tagged with `redact:"true"` are redacted unless they are empty.
+func (c *Config) Print(w io.Writer) error {
+	out, err := yaml.Marshal(printable(reflect.ValueOf(c)))
+	if err != nil {
+		return errors.Wrap(err, "config cannot be marshaled")
+	}
+
+	_, err = w.Write(out)
+	return err
+}
+
+// printable converts the value to YAML maps keyed like the config file, fields keep their order.
+func printable(v reflect.Value) interface{} {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+
+		return printable(v.Elem())
+
+	case reflect.Struct:
+		t := v.Type()
+		out := make(yaml.MapSlice, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			key := f.Tag.Get("mapstructure")
+			if key == "" {
+				key = strings.ToLower(f.Name)
+			}
+
+			var value interface{} = redactedValue
+			if f.Tag.Get("redact") != "true" || v.Field(i).IsZero() {
+				value = printable(v.Field(i))
+			}
+			out = append(out, yaml.MapItem{Key: key, Value: value})
+		}
+
+		return out
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = printable(v.Index(i))
+		}
+
+		return out
+
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+
+		out := make(yaml.MapSlice, 0, len(keys))
+		for _, k := range keys {
+			out = append(out, yaml.MapItem{Key: k.Interface(), Value: printable(v.MapIndex(k))})
+		}
+
+		return out
+	}
+
+	return v.Interface()
+}
+
+// configErrors are all the problems found in the config, one per line.
+type configErrors []error
+
+// add appends the error unless it's nil. Problems of nested sections are flattened.
+func (e *configErrors) add(err error) {
+	if err == nil {
+		return
+	}
+
+	if nested, ok := err.(configErrors); ok {
+		*e = append(*e, nested...)
+		return
+	}
+
+	*e = append(*e, err)
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e configErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "\n  - " + err.Error()
+	}
+
+	return fmt.Sprintf("%d problem(s) found:%s", len(e), strings.Join(lines, ""))
+}
+
+// validate sets defaults of the circuit breaker.
+func (b *CircuitBreaker) validate() error {
+	if b.FailureRate == 0 {
+		b.FailureRate = coordinator.DefaultCircuitFailureRate
+	}
+	if b.MinRequests == 0 {
+		b.MinRequests = coordinator.DefaultCircuitMinRequests
+	}
+	if b.Window == 0 {
+		b.Window = coordinator.DefaultCircuitWindow
+	}
+	if b.OpenDuration == 0 {
+		b.OpenDuration = coordinator.DefaultCircuitOpenDuration
+	}
+
+	if b.FailureRate < 0 || b.FailureRate > 1 {
+		return errors.New("failure_rate must be in (0, 1]")
+	}
+	if b.Window < 0 || b.OpenDuration < 0 {
+		return errors.New("window and open_duration must be positive")
+	}
+
+	return nil
+}
+
+// validate sets defaults of the scheduler. The capacity defaults to the total concurrency of runners.
+func (s *Scheduler) validate(runners []Runner) error {
+	if s.QueueTimeout == 0 {
+		s.QueueTimeout = coordinator.DefaultSchedulerQueueTimeout
+	}
+
+	if s.Capacity == 0 {
+		for _, r := range runners {
+			if r.MaxConcurrency == nil {
+				return errors.Errorf("capacity is required, as runner '%s' has no max_concurrency", r.Name)
+			}
+
+			s.Capacity += uint(*r.MaxConcurrency)
+		}
+	}
+
+	for priority, class := range s.Classes {
+		if !isPriority(priority) {
+			return errors.Errorf("unknown class '%s' (supported: %s)", priority, strings.Join(queryrun.Priorities, ", "))
+		}
+		if class.MaxConcurrency > s.Capacity {
+			return errors.Errorf("max_concurrency of '%s' cannot exceed the capacity (%d)", priority, s.Capacity)
+		}
+	}
+
 	return nil
 }
 
@@ -291,3 +1799,23 @@ func (c *Config) Retrieve(_ context.Context) (aws.Credentials, error) {
 		Source:          "local config",
 	}, nil
 }
+
+func isPermission(p string) bool {
+	for _, permission := range api.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPriority(p string) bool {
+	for _, priority := range queryrun.Priorities {
+		if p == priority {
+			return true
+		}
+	}
+
+	return false
+}
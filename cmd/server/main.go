@@ -2,23 +2,33 @@ package main
 
 import (
 	"context"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"clickhouse-playground/internal/blocklist"
+	"clickhouse-playground/internal/canary"
 	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/fiddleimport"
+	"clickhouse-playground/internal/health"
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/policy"
 	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/qrunner/coordinator"
 	"clickhouse-playground/internal/qrunner/dockerengine"
+	"clickhouse-playground/internal/qrunner/k8s"
 	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/internal/resultcache"
 	"clickhouse-playground/pkg/dockerhub"
+	"clickhouse-playground/pkg/registry"
 	api "clickhouse-playground/pkg/restapi"
 
 	awsconf "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
 )
@@ -31,12 +41,31 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
+	configFlag := flag.String("config", "", "config path, it overrides CONFIG_PATH env (default: "+DefaultConfigPath+")")
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	flag.Parse()
+
 	// Initialize config.
-	config, err := LoadConfig()
+	configPath := ConfigPath(*configFlag)
+	config, err := LoadConfig(configPath)
 	if err != nil {
+		var problems configErrors
+		if errors.As(err, &problems) {
+			zlog.Fatal().Errs("problems", problems).Str("path", configPath).Msg("config is invalid")
+		}
+
 		zlog.Fatal().Err(err).Msg("config cannot be loaded")
 	}
 
+	if *printConfig {
+		err = config.Print(os.Stdout)
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("config cannot be printed")
+		}
+
+		return
+	}
+
 	// Initialize logger.
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
 	if config.LogFormat == PrettyLogFormat {
@@ -51,31 +80,106 @@ func main() {
 	zlog.Logger = zlog.Logger.Level(lvl)
 	logger := zlog.Logger
 
-	// Load AWS credentials.
-	var awsOpts []func(*awsconf.LoadOptions) error
-	if config.AWS.AccessKeyID != "" {
-		// Load AWS config with credentials when AccessKeyID is not empty.
-		// Otherwise, we let SDK to pick credentials from available sources automatically.
-		awsOpts = append(awsOpts, awsconf.WithCredentialsProvider(config))
-	}
+	// Load AWS credentials. AWS is used only by the DynamoDB run storage,
+	// so self-hosted deployments with other storages need no AWS config.
+	var dynamodbClient *dynamodb.Client
+	if config.RunStorage.Type == RunStorageDynamoDB {
+		var awsOpts []func(*awsconf.LoadOptions) error
+		if config.AWS.AccessKeyID != "" {
+			// Load AWS config with credentials when AccessKeyID is not empty.
+			// Otherwise, we let SDK to pick credentials from available sources automatically.
+			awsOpts = append(awsOpts, awsconf.WithCredentialsProvider(config))
+		}
 
-	awsOpts = append(awsOpts, awsconf.WithRegion(config.AWS.Region))
+		awsOpts = append(awsOpts, awsconf.WithRegion(config.AWS.Region))
 
-	awsConfig, err := awsconf.LoadDefaultConfig(ctx, awsOpts...)
-	if err != nil {
-		zlog.Fatal().Err(err).Msg("failed to load AWS config")
+		awsConfig, err := awsconf.LoadDefaultConfig(ctx, awsOpts...)
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("failed to load AWS config")
+		}
+
+		dynamodbClient = dynamodb.NewFromConfig(awsConfig)
 	}
 
 	// Initialize storages.
-	dynamodbClient := dynamodb.NewFromConfig(awsConfig)
-	dockerhubCli := dockerhub.NewClient(dockerhub.DockerHubURL, dockerhub.DefaultMaxRPS)
+	dockerhubCfg := dockerhub.DefaultConfig
+	if config.DockerImage.DockerHubRequestTimeout != 0 {
+		dockerhubCfg.RequestTimeout = config.DockerImage.DockerHubRequestTimeout
+	}
+	if config.DockerImage.DockerHubMaxPages != 0 {
+		dockerhubCfg.MaxPages = config.DockerImage.DockerHubMaxPages
+	}
+	if config.DockerImage.DockerHubFetchTimeout != 0 {
+		dockerhubCfg.FetchTimeout = config.DockerImage.DockerHubFetchTimeout
+	}
+	if config.DockerImage.DockerHubRetry.MaxAttempts != 0 {
+		dockerhubCfg.Retry.MaxAttempts = config.DockerImage.DockerHubRetry.MaxAttempts
+	}
+	if config.DockerImage.DockerHubRetry.InitialBackoff != 0 {
+		dockerhubCfg.Retry.InitialBackoff = config.DockerImage.DockerHubRetry.InitialBackoff
+	}
+	if config.DockerImage.DockerHubRetry.MaxBackoff != 0 {
+		dockerhubCfg.Retry.MaxBackoff = config.DockerImage.DockerHubRetry.MaxBackoff
+	}
+	if config.DockerImage.Validation.MissTTL != 0 {
+		dockerhubCfg.MissTTL = config.DockerImage.Validation.MissTTL
+	}
+	dockerhubCli := dockerhub.NewClient(dockerhubCfg)
+
+	tagRegistries := &dockertag.Registries{DockerHub: dockerhubCli, Hosts: make(map[string]dockertag.RegistryClient)}
+	for _, repository := range config.DockerImage.Repositories {
+		ref, _ := qrunner.ParseRepositoryRef(repository)
+		if ref.IsDockerHub() || tagRegistries.Hosts[ref.Registry] != nil {
+			continue
+		}
+
+		registryCfg := registry.DefaultConfig
+		registryCfg.URL = "https://" + ref.Registry
+		registryCfg.RequestTimeout = dockerhubCfg.RequestTimeout
+		registryCfg.MaxPages = dockerhubCfg.MaxPages
+		registryCfg.FetchTimeout = dockerhubCfg.FetchTimeout
+		for _, r := range config.DockerImage.Registries {
+			if r.Host != ref.Registry {
+				continue
+			}
+
+			registryCfg.URL = r.URL
+			registryCfg.Credentials = registry.Credentials{Username: r.Username, Password: r.Password, Token: r.Token}
+			if r.MaxRPS != 0 {
+				registryCfg.MaxRPS = r.MaxRPS
+			}
+		}
+
+		registryCli, err := registry.NewClient(registryCfg)
+		if err != nil {
+			zlog.Fatal().Err(err).Str("registry", ref.Registry).Msg("failed to create registry client")
+		}
+		tagRegistries.Hosts[ref.Registry] = registryCli
+	}
+
 	tagStorage := dockertag.NewCache(ctx, dockertag.Config{
 		Repositories:   config.DockerImage.Repositories,
 		OS:             config.DockerImage.OS,
 		Architecture:   config.DockerImage.Architecture,
 		ExpirationTime: config.DockerImage.CacheExpirationTime,
-	}, logger, dockerhubCli)
-	tagStorage.RunBackgroundUpdate()
+		LTS:            config.DockerImage.LTS,
+		Validation: dockertag.ValidationConfig{
+			Frequency:  config.DockerImage.Validation.Frequency,
+			SampleSize: config.DockerImage.Validation.SampleSize,
+		},
+		Rolling: dockertag.RollingConfig{
+			Tags:            config.DockerImage.Rolling.Tags,
+			RefreshInterval: config.DockerImage.Rolling.RefreshInterval,
+		},
+		Journal: dockertag.JournalConfig{
+			Size: config.DockerImage.Journal.Size,
+			Path: config.DockerImage.Journal.Path,
+		},
+	}, logger, tagRegistries)
+	err = tagStorage.SetDeprecations(config.DockerImage.Deprecations.toDeprecationConfig())
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid version deprecations")
+	}
 
 	// Create runners and the coordinator.
 	runners := initializeRunners(ctx, config, tagStorage, logger)
@@ -83,6 +187,47 @@ func main() {
 	coordinatorCfg := coordinator.Config{
 		HealthChecksEnabled:   true,
 		HealthCheckRetryDelay: config.Coordinator.HealthCheckRetryDelay,
+		Balancing:             config.Coordinator.Balancing,
+		RetryOnAnotherRunner:  config.Coordinator.RetryOnAnotherRunner,
+	}
+	if wp := config.Coordinator.WarmPool; wp != nil {
+		coordinatorCfg.WarmPool = &coordinator.WarmPoolConfig{
+			ResizeInterval: wp.ResizeInterval,
+			HalfLife:       wp.HalfLife,
+		}
+		if wp.HintsPath != "" {
+			coordinatorCfg.WarmPool.Hints = &coordinator.WarmPoolHintsConfig{
+				Path:   wp.HintsPath,
+				Loaded: tagStorage.Loaded(),
+				Exists: func(version string) bool {
+					_, found := tagStorage.Find(version)
+					return found
+				},
+			}
+		}
+	}
+	if s := config.Coordinator.Scheduler; s != nil {
+		coordinatorCfg.Scheduler = &coordinator.SchedulerConfig{
+			Capacity:     s.Capacity,
+			QueueTimeout: s.QueueTimeout,
+			MaxQueued:    s.MaxQueued,
+			Classes:      make(map[string]coordinator.SchedulerClassConfig, len(s.Classes)),
+		}
+		for priority, class := range s.Classes {
+			coordinatorCfg.Scheduler.Classes[priority] = coordinator.SchedulerClassConfig{
+				Weight:         class.Weight,
+				MaxConcurrency: class.MaxConcurrency,
+				MaxQueued:      class.MaxQueued,
+			}
+		}
+	}
+	if b := config.Coordinator.CircuitBreaker; b != nil {
+		coordinatorCfg.CircuitBreaker = &coordinator.CircuitBreakerConfig{
+			FailureRate:  b.FailureRate,
+			MinRequests:  b.MinRequests,
+			Window:       b.Window,
+			OpenDuration: b.OpenDuration,
+		}
 	}
 	coord := coordinator.New(ctx, logger, runners, coordinatorCfg)
 	go func() {
@@ -93,17 +238,211 @@ func main() {
 	}()
 
 	// Initialize the REST server.
-	runRepo := queryrun.NewRepository(ctx, dynamodbClient, config.AWS.QueryRunsTableName)
+	var runRepo queryrun.Repository
+	var pingStorage func(ctx context.Context) error
+	switch config.RunStorage.Type {
+	case RunStorageDynamoDB:
+		repo := queryrun.NewRepository(dynamodbClient, config.AWS.QueryRunsTableName, config.AWS.RunLabelsTableName, config.AWS.RunStagesIndexName, config.RunStorage.TTL)
+		runRepo, pingStorage = repo, repo.Ping
+	case RunStorageMemory:
+		zlog.Warn().Msg("runs are stored in memory, they will be lost on restart")
+		runRepo = queryrun.NewMemoryRepository(config.RunStorage.TTL, config.RunStorage.MaxRuns)
+	}
+
+	var outputProcessor api.OutputProcessor
+	if config.OutputProcessing != nil {
+		pipeline, err := config.OutputProcessing.toPipeline()
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("output processors cannot be initialized")
+		}
+
+		outputProcessor = pipeline
+	}
+
+	var blockList api.BlockList
+	if config.BlockList != nil {
+		var store blocklist.Store = blocklist.NewMemoryStore()
+		if config.RunStorage.Type == RunStorageDynamoDB {
+			store = blocklist.NewDynamoStore(dynamodbClient, config.AWS.QueryRunsTableName)
+		}
+
+		list := blocklist.New(ctx, logger, blocklist.Config{RefreshInterval: config.BlockList.RefreshInterval}, store)
+		err = list.Load(ctx)
+		if err != nil {
+			zlog.Error().Err(err).Msg("block list cannot be loaded, it will be retried on the next refresh")
+		}
+		list.RunBackgroundRefresh()
+		blockList = list
+	}
+
+	// Canaries check new versions, so the listener is set before the tags are fetched.
+	var canaryChecker *canary.Canary
+	if config.Canary != nil {
+		canaryChecker = canary.New(ctx, logger, config.Canary.toCanaryConfig(), coord, runRepo, tagStorage)
+		tagStorage.OnNewTags(canaryChecker.OnNewTags)
+		canaryChecker.Start()
+	}
+
+	var (
+		resultCache api.ResultCache
+		results     *resultcache.Cache
+	)
+	if config.ResultCache.Enabled {
+		results = resultcache.New(resultcache.Config{
+			TTL:          config.ResultCache.TTL,
+			MaxSizeBytes: config.ResultCache.MaxSizeBytes,
+		})
+		resultCache = results
+	}
+
+	// Results and images of the previous build of a rolling tag are not used anymore once it has moved.
+	tagStorage.OnDigestChange(func(previous, _ dockertag.Image) {
+		if results != nil {
+			results.RemoveDigest(previous.Digest)
+		}
+		coord.RemoveImage(ctx, previous.Repository, previous.Digest)
+	})
+
+	tagStorage.RunBackgroundUpdate()
+	tagStorage.RunBackgroundValidation()
+	tagStorage.RunBackgroundRollingRefresh()
+
+	// Check dependencies for the health document.
+	healthManager := health.NewManager(logger, health.Config{
+		Interval: config.Health.Interval,
+		Timeout:  config.Health.Timeout,
+	})
+	if pingStorage != nil {
+		healthManager.Register("storage", config.Health.criticality("storage", health.CriticalityCritical), pingStorage)
+	}
+	healthManager.Register("dockertag", config.Health.criticality("dockertag", health.CriticalityDegraded),
+		health.MaxAge(tagStorage.UpdatedAt, config.Health.MaxTagAge))
+	healthManager.Register("runners", config.Health.criticality("runners", health.CriticalityCritical), coord.CheckAlive)
+	for _, name := range coord.RunnerNames() {
+		name := name
+		healthManager.Register("runner:"+name, config.Health.criticality("runner:"+name, health.CriticalityDegraded), func(ctx context.Context) error {
+			return coord.PingRunner(ctx, name)
+		})
+	}
+	if config.Coordinator.CircuitBreaker != nil {
+		for _, dependency := range qrunner.Dependencies {
+			name := "circuit:" + string(dependency)
+			healthManager.Register(name, config.Health.criticality(name, health.CriticalityDegraded), coord.CheckCircuit(dependency))
+		}
+	}
+	healthManager.Start(ctx)
+
+	// Runs are served from the result cache only while all runners are down.
+	maintenance := health.NewMaintenance(logger, healthManager, config.Maintenance.toMaintenanceConfig(config.Health.Interval))
+	maintenance.Start(ctx)
+
+	// The instance is ready once a runner responds and the tag cache has been loaded.
+	readiness := health.NewReadiness(config.Health.ReadinessTimeout)
+	readiness.Register("runners", coord.PingAny)
+	readiness.Register("dockertag", health.Loaded(tagStorage.UpdatedAt))
+
+	trustedProxies, err := api.ParseTrustedProxies(config.API.TrustedProxies)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid trusted proxies")
+	}
+
+	queryPolicy, err := policy.New(config.Policy.toPolicyConfig())
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid query policy")
+	}
+
+	metaStore, err := api.NewMetaStore(config.toMeta())
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("deployment description cannot be created")
+	}
+
+	deadlinePolicy, err := queryrun.NewDeadlinePolicy(config.toDeadlineConfig())
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid deadlines")
+	}
+
+	// Reload the policy, version deprecation and deadline rules and the deployment description on SIGHUP.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloadConfig(configPath, config, queryPolicy, tagStorage, deadlinePolicy, metaStore)
+		}
+	}()
+
+	var fetcher api.FiddleFetcher
+	if config.Import != nil {
+		fetcher, err = fiddleimport.NewFetcher(config.Import.toFetcherConfig())
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("fiddle fetcher cannot be created")
+		}
+	}
+
+	drain := api.NewDrain()
+
+	runLimiter := api.NewClientRunLimiter(api.ClientRunLimits{
+		Anonymous:     config.API.MaxInFlightRuns.Anonymous,
+		Authenticated: config.API.MaxInFlightRuns.Authenticated,
+	})
+
+	var quota *api.Quota
+	if q := config.API.Quota; q != nil {
+		quota, err = api.NewQuota(api.QuotaConfig{
+			RequestsPerMinute: q.RequestsPerMinute,
+			Burst:             q.Burst,
+			DailyRuns:         q.DailyRuns,
+			Exempt:            q.Exempt,
+		}, api.NewMemoryQuotaStore())
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("invalid client quota")
+		}
+	}
 
 	lim := config.Limits
 	router := api.NewRouter(api.RouterOpts{
-		Logger:          logger,
-		Runner:          coord,
-		TagStorage:      tagStorage,
-		RunRepo:         runRepo,
-		Timeout:         config.API.ServerTimeout,
-		MaxQueryLength:  lim.MaxOutputLength,
-		MaxOutputLength: lim.MaxOutputLength,
+		Logger:              logger,
+		Runner:              coord,
+		TagStorage:          tagStorage,
+		RunRepo:             runRepo,
+		RequestLog:          config.API.RequestLog.toRequestLogConfig(),
+		TrustedProxies:      trustedProxies,
+		OutputProcessor:     outputProcessor,
+		BlockList:           blockList,
+		BlockedMessage:      blockedMessage(config.BlockList),
+		APIKeys:             config.API.toAPIKeys(),
+		Runners:             coord.RunnerNames(),
+		Policy:              queryPolicy,
+		ResultCache:         resultCache,
+		Images:              coord,
+		Fetcher:             fetcher,
+		Bisect:              config.Bisect.toBisectConfig(),
+		Sessions:            config.Sessions.toSessionConfig(),
+		SessionOpener:       coord,
+		Health:              healthManager,
+		Readiness:           readiness,
+		Meta:                metaStore,
+		Maintenance:         maintenance,
+		Drain:               drain,
+		RunLimiter:          runLimiter,
+		Quota:               quota,
+		PullRateLimits:      dockerhubCli,
+		Canary:              canaryStatus(canaryChecker),
+		TagJournal:          tagStorage,
+		Timeout:             config.API.ServerTimeout,
+		Deadlines:           deadlinePolicy,
+		FinishAbandonedRuns: config.API.FinishAbandonedRuns,
+		ExposeServerLogs:    config.API.ExposeServerLogs,
+		LookupTimeout:       config.API.LookupTimeout,
+		TimingsWindow:       config.API.TimingsWindow,
+		TimingsMaxRuns:      config.API.TimingsMaxRuns,
+		AllowedFormats:      config.Settings.AllowedFormats,
+		MaxQueryLength:      lim.MaxQueryLength,
+		MaxOutputLength:     lim.MaxOutputLength,
+		MaxFilesSize:        lim.MaxFilesSize,
+		BodyLimits: api.BodyLimits{
+			MaxCompressedLength: lim.MaxCompressedBodyLength,
+			MaxExpandedLength:   lim.MaxExpandedBodyLength,
+		},
 	})
 
 	srv := &http.Server{
@@ -122,18 +461,63 @@ func main() {
 		}
 	}()
 
+	var adminSrv *http.Server
+	if config.Admin.ListeningAddress != "" {
+		adminSrv = &http.Server{
+			Addr: config.Admin.ListeningAddress,
+			Handler: api.NewAdminRouter(api.AdminRouterOpts{
+				Logger:          logger,
+				RunRepo:         runRepo,
+				Snapshotter:     coord,
+				WarmPools:       coord,
+				Containers:      coord,
+				Health:          healthManager,
+				RunLimiter:      runLimiter,
+				Canary:          canaryTrigger(canaryChecker),
+				GC:              coord,
+				Scheduler:       coord,
+				Remediations:    coord,
+				CircuitBreakers: circuitBreakers(coord, config.Coordinator.CircuitBreaker != nil),
+				ResultCache:     resultCache,
+				BlockList:       blockList,
+				Maintenance:     maintenance,
+				Timeout:         config.API.LookupTimeout,
+				StatsMaxRuns:    config.API.TimingsMaxRuns,
+			}),
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+		}
+		go func() {
+			zlog.Info().Str("address", config.Admin.ListeningAddress).Msg("starting the admin server")
+
+			err := adminSrv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				zlog.Fatal().Err(err).Msg("admin server listen failed")
+			}
+		}()
+	}
+
 	// Export Prometheus metrics.
+	err = metrics.RegisterRuntimeCollectors()
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("runtime collectors cannot be registered")
+	}
+
 	go func() {
-		zlog.Info().Str("address", config.PrometheusExportAddress).Msg("starting the prometheus exporter")
+		zlog.Info().Str("address", config.PrometheusExportAddress).Str("path", config.PrometheusPath).
+			Msg("starting the prometheus exporter")
+
+		mux := http.NewServeMux()
+		mux.Handle(config.PrometheusPath, metrics.Handler())
 
 		metricSrv := &http.Server{
 			Addr:              config.PrometheusExportAddress,
-			Handler:           http.DefaultServeMux,
+			Handler:           mux,
 			ReadTimeout:       10 * time.Second,
 			ReadHeaderTimeout: 5 * time.Second,
 		}
 
-		http.DefaultServeMux.Handle("/metrics", promhttp.Handler())
 		err := metricSrv.ListenAndServe()
 		if err != nil {
 			zlog.Error().Err(err).Msg("prometheus exporter failed")
@@ -141,7 +525,18 @@ func main() {
 	}()
 
 	<-stop
-	cancel()
+
+	// New runs are rejected, and runs in progress are finished before runners are stopped,
+	// since the root context is used by runners to remove containers.
+	drain.Start()
+	zlog.Info().Dur("timeout", config.API.DrainTimeout).Msg("draining runs in progress")
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), config.API.DrainTimeout)
+	err = srv.Shutdown(drainCtx)
+	cancelDrain()
+	if err != nil {
+		zlog.Error().Err(err).Msg("server shutdown failed, runs in progress are aborted")
+	}
 
 	shutdownCtx, shutdown := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer shutdown()
@@ -150,10 +545,106 @@ func main() {
 	if err != nil {
 		zlog.Err(err).Msg("coordinator cannot be stopped")
 	}
+	cancel()
+
+	healthManager.Wait()
+	if canaryChecker != nil {
+		canaryChecker.Wait()
+	}
+
+	if adminSrv != nil {
+		err = adminSrv.Shutdown(shutdownCtx)
+		if err != nil {
+			zlog.Error().Err(err).Msg("admin server shutdown failed")
+		}
+	}
+}
+
+// canaryStatus and canaryTrigger keep the optional dependencies nil if canaries are disabled.
+func canaryStatus(c *canary.Canary) api.CanaryStatus {
+	if c == nil {
+		return nil
+	}
+
+	return c
+}
+
+func circuitBreakers(coord *coordinator.Coordinator, enabled bool) api.CircuitBreakers {
+	if !enabled {
+		return nil
+	}
 
-	err = srv.Shutdown(shutdownCtx)
+	return coord
+}
+
+func blockedMessage(cfg *BlockList) string {
+	if cfg == nil {
+		return ""
+	}
+
+	return cfg.Message
+}
+
+func canaryTrigger(c *canary.Canary) api.Canary {
+	if c == nil {
+		return nil
+	}
+
+	return c
+}
+
+// reloadConfig applies the parts of the config that can be changed at runtime.
+// The startup config describes the rest of the deployment.
+func reloadConfig(
+	path string,
+	startup *Config,
+	queryPolicy *policy.Policy,
+	tagStorage *dockertag.Cache,
+	deadlinePolicy *queryrun.DeadlinePolicy,
+	metaStore *api.MetaStore,
+) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		zlog.Error().Err(err).Msg("config cannot be reloaded")
+		return
+	}
+
+	err = queryPolicy.Update(config.Policy.toPolicyConfig())
+	if err != nil {
+		zlog.Error().Err(err).Msg("query policy cannot be reloaded")
+	} else {
+		zlog.Info().Msg("query policy has been reloaded")
+	}
+
+	err = tagStorage.SetDeprecations(config.DockerImage.Deprecations.toDeprecationConfig())
 	if err != nil {
-		zlog.Error().Err(err).Msg("server shutdown failed")
+		zlog.Error().Err(err).Msg("version deprecations cannot be reloaded")
+	} else {
+		zlog.Info().Msg("version deprecations have been reloaded")
+	}
+
+	// The run timeout default is not reloaded, it stays equal to the server timeout of the startup config.
+	deadlines := config.toDeadlineConfig()
+	deadlines.Defaults.RunTimeout = startup.API.ServerTimeout
+
+	err = deadlinePolicy.Update(deadlines)
+	if err != nil {
+		zlog.Error().Err(err).Msg("deadlines cannot be reloaded")
+	} else {
+		zlog.Info().Msg("deadlines have been reloaded")
+	}
+
+	meta := startup.toMeta()
+	reloaded := config.toMeta()
+	meta.Branding = reloaded.Branding
+	meta.Versions = reloaded.Versions
+	meta.Limits.MaxStatements = reloaded.Limits.MaxStatements
+
+	err = metaStore.Set(meta)
+	if err != nil {
+		zlog.Error().Err(err).Msg("deployment description cannot be reloaded")
+	} else {
+		zlog.Info().Msg("deployment description has been reloaded")
 	}
 }
 
@@ -165,14 +656,56 @@ func initializeRunners(ctx context.Context, config *Config, tagStorage *dockerta
 		case RunnerTypeDockerEngine:
 			rcfg := dockerengine.DefaultConfig
 			rcfg.DaemonURL = r.DockerEngine.DaemonURL
+			if tls := r.DockerEngine.DaemonTLS; tls != nil {
+				rcfg.DaemonTLS = &dockerengine.DaemonTLSConfig{
+					CACertPath: tls.CAPath,
+					CertPath:   tls.CertPath,
+					KeyPath:    tls.KeyPath,
+				}
+			}
 			rcfg.CustomConfigPath = r.DockerEngine.CustomConfigPath
 			rcfg.QuotasPath = r.DockerEngine.QuotasPath
+			if r.DockerEngine.SnapshotLogsKB != nil {
+				rcfg.SnapshotLogsLength = *r.DockerEngine.SnapshotLogsKB * 1024
+			}
+			if r.DockerEngine.StartupLogsKB != nil {
+				rcfg.StartupLogsLength = *r.DockerEngine.StartupLogsKB * 1024
+			}
 			rcfg.GC = nil
+			rcfg.KeepContainerOnFailure = r.DockerEngine.KeepContainerOnFailure
+			if r.DockerEngine.HoldPeriod != nil {
+				rcfg.HoldPeriod = *r.DockerEngine.HoldPeriod
+			}
 
 			if config.Settings.DefaultFormat != nil {
 				rcfg.DefaultOutputFormat = *config.Settings.DefaultFormat
 			}
 
+			for _, t := range r.DockerEngine.CommandTemplates {
+				rcfg.CommandTemplates = append(rcfg.CommandTemplates, dockerengine.CommandTemplate{
+					MinVersion: t.MinVersion,
+					MaxVersion: t.MaxVersion,
+					Argv:       t.Argv,
+				})
+			}
+
+			for _, t := range r.DockerEngine.Tools {
+				tool := dockerengine.ToolTemplate{
+					Name:       t.Name,
+					Argv:       t.Argv,
+					NativeOnly: t.NativeOnly,
+				}
+				for _, p := range t.Params {
+					tool.Params = append(tool.Params, dockerengine.ToolParam{
+						Name:    p.Name,
+						Pattern: p.Pattern,
+						Default: p.Default,
+					})
+				}
+
+				rcfg.Tools = append(rcfg.Tools, tool)
+			}
+
 			gc := r.DockerEngine.GC
 			if gc != nil {
 				rcfg.GC = &dockerengine.GCConfig{
@@ -180,6 +713,26 @@ func initializeRunners(ctx context.Context, config *Config, tagStorage *dockerta
 					ContainerTTL:          gc.ContainerTTL,
 					ImageGCCountThreshold: gc.ImageGCCountThreshold,
 					ImageBufferSize:       gc.ImageBufferSize,
+					DisableContainers:     gc.DisableContainers,
+					DisableEgressNetworks: gc.DisableEgressNetworks,
+					DisableVolumes:        gc.DisableVolumes,
+					PruneBuildCache:       gc.PruneBuildCache,
+				}
+
+				if gc.ImageSizeBudgetMB != nil {
+					budget := *gc.ImageSizeBudgetMB * 1e6 // mb -> bytes.
+					rcfg.GC.ImageSizeBudget = &budget
+				}
+
+				if dp := gc.DiskPressure; dp != nil {
+					rcfg.GC.DiskPressure = &dockerengine.DiskPressureConfig{
+						DataRoot:      dp.DataRoot,
+						HighWatermark: float64(dp.HighWatermarkPercent) / 100,
+						LowWatermark:  float64(dp.LowWatermarkPercent) / 100,
+					}
+					if dp.CapacityMB != nil {
+						rcfg.GC.DiskPressure.Capacity = *dp.CapacityMB * 1e6 // mb -> bytes.
+					}
 				}
 			}
 
@@ -188,10 +741,119 @@ func initializeRunners(ctx context.Context, config *Config, tagStorage *dockerta
 				CPULimit:    uint64(r.DockerEngine.Container.CPULimit * 1e9), // cpu -> nano cpu.
 				CPUSet:      r.DockerEngine.Container.CPUSet,
 				MemoryLimit: uint64(r.DockerEngine.Container.MemoryLimitMB * 1e6), // mb -> bytes.
+				PidsLimit:   r.DockerEngine.Container.PidsLimit,
+			}
+
+			if r.DockerEngine.RestrictedMode {
+				profile := dockerengine.DefaultRestrictedProfile
+				if p := r.DockerEngine.RestrictedProfile; p != nil {
+					if p.MaxExecutionTime != nil {
+						profile.MaxExecutionTime = *p.MaxExecutionTime
+					}
+					if p.MaxMemoryUsageMB != nil {
+						profile.MaxMemoryUsage = *p.MaxMemoryUsageMB * 1e6 // mb -> bytes.
+					}
+					if p.MaxResultRows != nil {
+						profile.MaxResultRows = *p.MaxResultRows
+					}
+				}
+				rcfg.Restricted = &profile
+			}
+
+			if res := r.DockerEngine.Reservation; res != nil {
+				rcfg.Reservation.MaxReservations = res.MaxReservations
+				rcfg.Reservation.MaxReservationsPerClient = res.MaxPerClient
+				if res.TTL != 0 {
+					rcfg.Reservation.TTL = res.TTL
+				}
+			}
+
+			if egress := r.DockerEngine.Egress; egress != nil {
+				rcfg.Egress = &dockerengine.EgressConfig{
+					ProxyImage: dockerengine.DefaultEgressProxyImage,
+					Allowlist:  egress.Allowlist,
+				}
+				if egress.ProxyImage != "" {
+					rcfg.Egress.ProxyImage = egress.ProxyImage
+				}
 			}
 
-			if r.DockerEngine.Prewarm != nil && r.DockerEngine.Prewarm.MaxWarmContainers != nil {
-				rcfg.MaxWarmContainers = *r.DockerEngine.Prewarm.MaxWarmContainers
+			if iso := r.DockerEngine.NetworkIsolation; iso != nil {
+				rcfg.Isolation = &dockerengine.IsolationConfig{
+					Mode:                   iso.Mode,
+					Network:                iso.Network,
+					DisableRemoteFunctions: iso.DisableRemoteFunctions,
+				}
+			}
+
+			for _, m := range r.DockerEngine.Mirrors {
+				rcfg.Mirrors = append(rcfg.Mirrors, dockerengine.MirrorConfig{
+					Repository: m.Repository,
+					Endpoints:  m.Endpoints,
+				})
+			}
+			if r.DockerEngine.MirrorTimeout != nil {
+				rcfg.MirrorTimeout = *r.DockerEngine.MirrorTimeout
+			}
+			if retry := r.DockerEngine.PullRetry; retry != nil {
+				rcfg.PullRetry = dockerengine.PullRetryConfig{
+					MaxAttempts:  retry.MaxAttempts,
+					InitialDelay: retry.InitialDelay,
+					MaxDelay:     retry.MaxDelay,
+				}
+			}
+			if r.DockerEngine.PullTimeout != nil {
+				rcfg.PullTimeout = *r.DockerEngine.PullTimeout
+			}
+			rcfg.Architecture = r.DockerEngine.Architecture
+			for _, reg := range config.DockerImage.Registries {
+				if reg.Username == "" && reg.Token == "" {
+					continue
+				}
+				if rcfg.Registries == nil {
+					rcfg.Registries = make(map[string]dockerengine.RegistryCredentials)
+				}
+				rcfg.Registries[reg.Host] = dockerengine.RegistryCredentials{
+					Username: reg.Username,
+					Password: reg.Password,
+					Token:    reg.Token,
+				}
+			}
+			rcfg.MaxExecutionTime = r.DockerEngine.MaxExecutionTime
+			rcfg.MaxOutputBytes = r.DockerEngine.MaxOutputMB * 1024 * 1024
+			rcfg.MaxResultRows = r.DockerEngine.MaxResultRows
+			if r.DockerEngine.ReadinessPollInterval != nil {
+				rcfg.ExecRetryDelay = *r.DockerEngine.ReadinessPollInterval
+			}
+			if rem := r.DockerEngine.Remediation; rem != nil {
+				if rem.MinInterval != nil {
+					rcfg.Remediation.MinInterval = *rem.MinInterval
+				}
+				if rem.MemoryFailureThreshold != nil {
+					rcfg.Remediation.MemoryFailureThreshold = *rem.MemoryFailureThreshold
+				}
+				if rem.MemoryFailureWindow != nil {
+					rcfg.Remediation.MemoryFailureWindow = *rem.MemoryFailureWindow
+				}
+				if rem.ThrottlePeriod != nil {
+					rcfg.Remediation.ThrottlePeriod = *rem.ThrottlePeriod
+				}
+			}
+
+			if prewarm := r.DockerEngine.Prewarm; prewarm != nil {
+				if prewarm.MaxWarmContainers != nil {
+					rcfg.MaxWarmContainers = *prewarm.MaxWarmContainers
+				}
+
+				rcfg.WarmPool.MinPerVersion = prewarm.MinPerVersion
+				rcfg.WarmPool.MaxPerVersion = prewarm.MaxPerVersion
+				rcfg.WarmPool.IdleTTL = prewarm.IdleTTL
+				if len(prewarm.Pinned) > 0 {
+					rcfg.WarmPool.Pinned = make(map[string]uint, len(prewarm.Pinned))
+					for _, p := range prewarm.Pinned {
+						rcfg.WarmPool.Pinned[p.Version] = p.Count
+					}
+				}
 			}
 
 			var err error
@@ -200,11 +862,57 @@ func initializeRunners(ctx context.Context, config *Config, tagStorage *dockerta
 				zlog.Fatal().Err(err).Msg("failed to create docker engine runner")
 			}
 
+		case RunnerTypeKubernetes:
+			k := r.Kubernetes
+			rcfg := k8s.DefaultConfig
+			rcfg.APIServer = k.APIServer
+			if k.TokenPath != nil {
+				rcfg.TokenPath = *k.TokenPath
+			}
+			if k.CAPath != nil {
+				rcfg.CAPath = *k.CAPath
+			}
+			rcfg.Namespace = k.Namespace
+			rcfg.ImagePullSecrets = k.ImagePullSecrets
+			rcfg.NodeSelector = k.NodeSelector
+			rcfg.Resources = k8s.Resources{
+				CPURequest:    k.Resources.CPURequest,
+				CPULimit:      k.Resources.CPULimit,
+				MemoryRequest: k.Resources.MemoryRequest,
+				MemoryLimit:   k.Resources.MemoryLimit,
+			}
+			if k.ReadinessTimeout != nil {
+				rcfg.ReadinessTimeout = *k.ReadinessTimeout
+			}
+			rcfg.MaxExecutionTime = k.MaxExecutionTime
+			rcfg.MaxOutputBytes = k.MaxOutputMB * 1024 * 1024
+			if config.Settings.DefaultFormat != nil {
+				rcfg.DefaultOutputFormat = *config.Settings.DefaultFormat
+			}
+
+			rcfg.GC = nil
+			if k.GC != nil {
+				rcfg.GC = &k8s.GCConfig{
+					TriggerFrequency: k.GC.TriggerFrequency,
+					PodTTL:           k.GC.PodTTL,
+				}
+			}
+
+			var err error
+			runner, err = k8s.New(ctx, logger, r.Name, rcfg, tagStorage)
+			if err != nil {
+				zlog.Fatal().Err(err).Msg("failed to create kubernetes runner")
+			}
+
 		default:
 			zlog.Fatal().Msg("invalid runner type")
 		}
 
-		runners = append(runners, coordinator.NewRunner(runner, r.Weight, r.MaxConcurrency))
+		cr := coordinator.NewRunner(runner, r.Weight, r.MaxConcurrency)
+		if r.Fallback {
+			cr.SetFallback()
+		}
+		runners = append(runners, cr)
 	}
 
 	return runners
@@ -18,10 +18,13 @@ require (
 	github.com/docker/cli v20.10.20+incompatible
 	github.com/docker/docker v23.0.3+incompatible
 	github.com/gookit/config/v2 v2.1.0
+	github.com/klauspost/compress v1.16.0
 	github.com/mitchellh/mapstructure v1.4.3
 	github.com/prometheus/client_golang v1.14.0
 	github.com/stretchr/testify v1.8.2
 	go.uber.org/ratelimit v0.2.0
+	golang.org/x/net v0.8.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -63,14 +66,12 @@ require (
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
 	golang.org/x/mod v0.9.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/term v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 	golang.org/x/tools v0.7.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
@@ -0,0 +1,343 @@
+package blocklist
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultRefreshInterval = time.Minute
+
+	// maxSaveAttempts bounds retries of changes conflicting with other instances.
+	maxSaveAttempts = 5
+
+	// removedRetention is how long removed and expired entries are kept for the audit trail.
+	removedRetention = 90 * 24 * time.Hour
+)
+
+type Config struct {
+	// RefreshInterval is how often the list is reloaded, so changes made through other instances take effect.
+	RefreshInterval time.Duration
+}
+
+// List checks clients against the block list. The list is matched against an in-memory copy,
+// which is replaced on every change made through this instance and on every refresh.
+type List struct {
+	ctx    context.Context
+	logger zerolog.Logger
+	cfg    Config
+	store  Store
+
+	matcher atomic.Pointer[matcher]
+
+	// mu serializes changes, so they don't conflict with each other within the instance.
+	mu sync.Mutex
+
+	hitsMu sync.Mutex
+	hits   map[string]Hits
+}
+
+// Hits are blocked attempts matched by an entry since the start of the instance.
+type Hits struct {
+	Count     uint64
+	LastHitAt time.Time
+}
+
+// Status is an entry with its hits.
+type Status struct {
+	Entry
+	Hits
+}
+
+func New(ctx context.Context, logger zerolog.Logger, cfg Config, store Store) *List {
+	l := &List{
+		ctx:    ctx,
+		logger: logger.With().Str("component", "blocklist").Logger(),
+		cfg:    cfg,
+		store:  store,
+		hits:   make(map[string]Hits),
+	}
+	l.matcher.Store(newMatcher(Document{}))
+
+	return l
+}
+
+// Load reads the list from the store. It must be called before the list is used,
+// otherwise no client is blocked until the first refresh.
+func (l *List) Load(ctx context.Context) error {
+	doc, err := l.store.Load(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to load block list")
+	}
+
+	l.apply(doc)
+
+	return nil
+}
+
+// RunBackgroundRefresh runs a background task reloading the list.
+func (l *List) RunBackgroundRefresh() {
+	go l.backgroundRefresh()
+}
+
+func (l *List) backgroundRefresh() {
+	interval := l.cfg.RefreshInterval
+	if interval == 0 {
+		interval = DefaultRefreshInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		err := l.Load(l.ctx)
+		if err != nil && l.ctx.Err() == nil {
+			l.logger.Error().Err(err).Msg("block list cannot be refreshed")
+		}
+	}
+}
+
+// apply replaces the in-memory copy unless it's newer than the document.
+func (l *List) apply(doc Document) {
+	for {
+		current := l.matcher.Load()
+		if current.version > doc.Version {
+			return
+		}
+		if l.matcher.CompareAndSwap(current, newMatcher(doc)) {
+			return
+		}
+	}
+}
+
+// Match returns the active entry blocking the client with the API key hash and the address.
+// keyHash is empty if the client has not presented a key. The attempt is counted as a hit of the entry.
+func (l *List) Match(keyHash string, ip net.IP) (Entry, bool) {
+	now := time.Now()
+
+	entry, found := l.matcher.Load().match(keyHash, ip, now)
+	if !found {
+		return Entry{}, false
+	}
+
+	l.hitsMu.Lock()
+	h := l.hits[entry.ID]
+	h.Count++
+	h.LastHitAt = now
+	l.hits[entry.ID] = h
+	l.hitsMu.Unlock()
+
+	metrics.BlockList.Blocked(string(entry.Kind))
+
+	return entry, true
+}
+
+// Entries returns the entries with their hits, most recent first. Removed and expired entries
+// are returned only if all is set.
+func (l *List) Entries(all bool) []Status {
+	now := time.Now()
+	m := l.matcher.Load()
+
+	l.hitsMu.Lock()
+	defer l.hitsMu.Unlock()
+
+	statuses := make([]Status, 0, len(m.entries))
+	for _, e := range m.entries {
+		if !all && !e.Active(now) {
+			continue
+		}
+
+		statuses = append(statuses, Status{Entry: e, Hits: l.hits[e.ID]})
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].CreatedAt.After(statuses[j].CreatedAt)
+	})
+
+	return statuses
+}
+
+// Add blocks clients matching the entry. The value is validated and normalized, ErrInvalidEntry is returned
+// if it's malformed. The id and the creation time are assigned here.
+func (l *List) Add(ctx context.Context, entry Entry) (Entry, error) {
+	value, err := normalize(entry.Kind, entry.Value)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	now := time.Now()
+	if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+		return Entry{}, errors.Wrap(ErrInvalidEntry, "expires_at must be in the future")
+	}
+
+	entry.ID = newID()
+	entry.Value = value
+	entry.CreatedAt = now.UTC()
+	entry.RemovedAt = nil
+	entry.RemovalReason = ""
+
+	err = l.update(ctx, func(entries []Entry) ([]Entry, error) {
+		return append(entries, entry), nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return entry, nil
+}
+
+// Remove unblocks clients matched by the entry. The entry is kept with the removal reason.
+// It fails with ErrNotFound if there is no active entry with the id.
+func (l *List) Remove(ctx context.Context, id string, reason string) (Entry, error) {
+	var removed Entry
+	err := l.update(ctx, func(entries []Entry) ([]Entry, error) {
+		now := time.Now()
+		for i := range entries {
+			if entries[i].ID != id || entries[i].RemovedAt != nil {
+				continue
+			}
+
+			removedAt := now.UTC()
+			entries[i].RemovedAt = &removedAt
+			entries[i].RemovalReason = reason
+			removed = entries[i]
+
+			return entries, nil
+		}
+
+		return nil, ErrNotFound
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return removed, nil
+}
+
+// update applies the change to the stored list and replaces the in-memory copy.
+// Changes conflicting with other instances are retried on the reloaded list.
+func (l *List) update(ctx context.Context, change func(entries []Entry) ([]Entry, error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		doc, err := l.store.Load(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to load block list")
+		}
+
+		entries, err := change(doc.Entries)
+		if err != nil {
+			return err
+		}
+		doc.Entries = prune(entries, time.Now())
+
+		err = l.store.Save(ctx, doc)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to save block list")
+		}
+
+		doc.Version++
+		l.apply(doc)
+
+		return nil
+	}
+
+	return ErrConflict
+}
+
+// prune drops entries that have been removed or have expired longer than removedRetention ago.
+func prune(entries []Entry, now time.Time) []Entry {
+	kept := entries[:0]
+	for _, e := range entries {
+		inactiveSince := e.RemovedAt
+		if inactiveSince == nil {
+			inactiveSince = e.ExpiresAt
+		}
+		if inactiveSince != nil && now.Sub(*inactiveSince) > removedRetention {
+			continue
+		}
+
+		kept = append(kept, e)
+	}
+
+	return kept
+}
+
+// matcher is an immutable in-memory copy of the list.
+type matcher struct {
+	version  int64
+	entries  []Entry
+	keys     map[string][]Entry
+	networks []network
+}
+
+type network struct {
+	net   *net.IPNet
+	entry Entry
+}
+
+func newMatcher(doc Document) *matcher {
+	m := &matcher{
+		version: doc.Version,
+		entries: doc.Entries,
+		keys:    make(map[string][]Entry),
+	}
+
+	for _, e := range doc.Entries {
+		if e.RemovedAt != nil {
+			continue
+		}
+
+		switch e.Kind {
+		case KindKeyHash:
+			m.keys[e.Value] = append(m.keys[e.Value], e)
+		case KindCIDR:
+			n, err := parseNetwork(e.Value)
+			if err != nil {
+				continue
+			}
+			m.networks = append(m.networks, network{net: n, entry: e})
+		}
+	}
+
+	return m
+}
+
+func (m *matcher) match(keyHash string, ip net.IP, now time.Time) (Entry, bool) {
+	if keyHash != "" {
+		for _, e := range m.keys[keyHash] {
+			if e.Active(now) {
+				return e, true
+			}
+		}
+	}
+
+	if ip != nil {
+		for _, n := range m.networks {
+			if n.entry.Active(now) && n.net.Contains(ip) {
+				return n.entry, true
+			}
+		}
+	}
+
+	return Entry{}, false
+}
@@ -0,0 +1,146 @@
+package blocklist
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	list := New(ctx, zerolog.Nop(), Config{}, NewMemoryStore())
+	require.NoError(t, list.Load(ctx))
+
+	network, err := list.Add(ctx, Entry{Kind: KindCIDR, Value: "10.1.0.0/16", Reason: "scripted abuse"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, network.ID)
+	assert.False(t, network.CreatedAt.IsZero())
+
+	key, err := list.Add(ctx, Entry{Kind: KindKeyHash, Value: HashKey("secret")})
+	require.NoError(t, err)
+
+	matched, found := list.Match("", net.ParseIP("10.1.2.3"))
+	require.True(t, found)
+	assert.Equal(t, network.ID, matched.ID)
+
+	matched, found = list.Match(HashKey("secret"), net.ParseIP("192.168.0.1"))
+	require.True(t, found)
+	assert.Equal(t, key.ID, matched.ID)
+
+	_, found = list.Match(HashKey("other"), net.ParseIP("192.168.0.1"))
+	assert.False(t, found)
+
+	statuses := list.Entries(false)
+	require.Len(t, statuses, 2)
+	assert.Equal(t, key.ID, statuses[0].ID, "recent entries go first")
+	assert.Equal(t, uint64(1), statuses[0].Count)
+	assert.Equal(t, uint64(1), statuses[1].Count)
+
+	removed, err := list.Remove(ctx, network.ID, "false positive")
+	require.NoError(t, err)
+	assert.NotNil(t, removed.RemovedAt)
+
+	_, found = list.Match("", net.ParseIP("10.1.2.3"))
+	assert.False(t, found)
+
+	_, err = list.Remove(ctx, network.ID, "")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.Len(t, list.Entries(false), 1)
+	assert.Len(t, list.Entries(true), 2, "removed entries are kept")
+}
+
+func TestList_Expiry(t *testing.T) {
+	ctx := context.Background()
+	list := New(ctx, zerolog.Nop(), Config{}, NewMemoryStore())
+
+	past := time.Now().Add(-time.Minute)
+	_, err := list.Add(ctx, Entry{Kind: KindCIDR, Value: "10.0.0.1", ExpiresAt: &past})
+	assert.ErrorIs(t, err, ErrInvalidEntry)
+
+	soon := time.Now().Add(time.Hour)
+	_, err = list.Add(ctx, Entry{Kind: KindCIDR, Value: "10.0.0.1", ExpiresAt: &soon})
+	require.NoError(t, err)
+
+	m := list.matcher.Load()
+	_, found := m.match("", net.ParseIP("10.0.0.1"), time.Now())
+	assert.True(t, found)
+	_, found = m.match("", net.ParseIP("10.0.0.1"), soon)
+	assert.False(t, found)
+}
+
+func TestList_ConcurrentInstances(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	first := New(ctx, zerolog.Nop(), Config{}, store)
+	second := New(ctx, zerolog.Nop(), Config{}, store)
+
+	_, err := first.Add(ctx, Entry{Kind: KindCIDR, Value: "10.0.0.1"})
+	require.NoError(t, err)
+	_, err = second.Add(ctx, Entry{Kind: KindCIDR, Value: "10.0.0.2"})
+	require.NoError(t, err)
+
+	assert.Len(t, second.Entries(false), 2, "changes are applied on top of the stored list")
+
+	_, found := first.Match("", net.ParseIP("10.0.0.2"))
+	assert.False(t, found, "changes of other instances are picked up on refresh")
+
+	require.NoError(t, first.Load(ctx))
+	_, found = first.Match("", net.ParseIP("10.0.0.2"))
+	assert.True(t, found)
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		kind  Kind
+		value string
+		want  string
+		err   bool
+	}{
+		{kind: KindCIDR, value: "10.1.2.3", want: "10.1.2.3/32"},
+		{kind: KindCIDR, value: " 10.1.2.3/8", want: "10.0.0.0/8"},
+		{kind: KindCIDR, value: "2001:db8::1", want: "2001:db8::1/128"},
+		{kind: KindCIDR, value: "10.1.2", err: true},
+		{kind: KindKeyHash, value: HashKey("secret"), want: HashKey("secret")},
+		{kind: KindKeyHash, value: "secret", err: true},
+		{kind: "name", value: "secret", err: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.kind)+" "+tt.value, func(t *testing.T) {
+			got, err := normalize(tt.kind, tt.value)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrInvalidEntry)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	longAgo := now.Add(-removedRetention - time.Hour)
+	recently := now.Add(-time.Hour)
+
+	entries := []Entry{
+		{ID: "active"},
+		{ID: "removed long ago", RemovedAt: &longAgo},
+		{ID: "expired long ago", ExpiresAt: &longAgo},
+		{ID: "removed recently", RemovedAt: &recently},
+	}
+
+	var ids []string
+	for _, e := range prune(entries, now) {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []string{"active", "removed recently"}, ids)
+}
@@ -0,0 +1,120 @@
+package blocklist
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kind is what an entry matches clients by.
+type Kind string
+
+const (
+	// KindKeyHash matches clients presenting the API key which SHA-256 hex digest is the entry value.
+	KindKeyHash Kind = "key_hash"
+	// KindCIDR matches clients which address belongs to the network.
+	KindCIDR Kind = "cidr"
+)
+
+// ErrInvalidEntry is returned when an entry has an unknown kind or a malformed value.
+var ErrInvalidEntry = errors.New("invalid block list entry")
+
+// ErrNotFound is returned when there is no active entry with the id.
+var ErrNotFound = errors.New("block list entry not found")
+
+// Entry blocks clients matching it until it expires or is removed. Removed entries are kept
+// for the audit trail and pruned after removedRetention.
+type Entry struct {
+	ID     string `dynamodbav:"Id"`
+	Kind   Kind   `dynamodbav:"Kind"`
+	Value  string `dynamodbav:"Value"`
+	Reason string `dynamodbav:"Reason,omitempty"`
+
+	CreatedAt time.Time `dynamodbav:"CreatedAt"`
+	// ExpiresAt is nil if the entry never expires.
+	ExpiresAt *time.Time `dynamodbav:"ExpiresAt,omitempty"`
+
+	RemovedAt     *time.Time `dynamodbav:"RemovedAt,omitempty"`
+	RemovalReason string     `dynamodbav:"RemovalReason,omitempty"`
+}
+
+// Active reports whether the entry blocks clients at the moment.
+func (e *Entry) Active(now time.Time) bool {
+	return e.RemovedAt == nil && (e.ExpiresAt == nil || now.Before(*e.ExpiresAt))
+}
+
+// HashKey returns the value of entries matching clients that present the API key.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalize validates the value of the entry and brings it to the canonical form, so equal values are compared
+// as strings. Single addresses are accepted as CIDR values.
+func normalize(kind Kind, value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	switch kind {
+	case KindKeyHash:
+		value = strings.ToLower(value)
+		decoded, err := hex.DecodeString(value)
+		if err != nil || len(decoded) != sha256.Size {
+			return "", errors.Wrap(ErrInvalidEntry, "key_hash must be a hex SHA-256 digest")
+		}
+
+		return value, nil
+
+	case KindCIDR:
+		network, err := parseNetwork(value)
+		if err != nil {
+			return "", errors.Wrap(ErrInvalidEntry, err.Error())
+		}
+
+		return network.String(), nil
+	}
+
+	return "", errors.Wrapf(ErrInvalidEntry, "unknown kind '%s'", kind)
+}
+
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, errors.Errorf("invalid address '%s'", value)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, errors.Errorf("invalid network '%s'", value)
+	}
+
+	return network, nil
+}
+
+const idLength = 6
+
+func newID() string {
+	b := make([]byte, idLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(errors.Wrap(err, "failed to generate entry id"))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+package blocklist
+
+import (
+	"context"
+	"sync"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+)
+
+// ErrConflict is returned when the document has been changed by another instance since it was loaded.
+var ErrConflict = errors.New("block list has been changed concurrently")
+
+// Document is the whole block list. It's small, so it's read and written at once.
+type Document struct {
+	Entries []Entry `dynamodbav:"Entries"`
+
+	// Version is incremented on every save, so concurrent changes are detected.
+	Version int64 `dynamodbav:"Version"`
+}
+
+// Store persists the block list.
+type Store interface {
+	// Load returns an empty document if the list has never been saved.
+	Load(ctx context.Context) (Document, error)
+
+	// Save writes the document with the incremented version. It fails with ErrConflict
+	// if the stored version differs from the version of the document.
+	Save(ctx context.Context, doc Document) error
+}
+
+// MemoryStore keeps the block list in memory, so it's lost on restart.
+type MemoryStore struct {
+	mu  sync.Mutex
+	doc Document
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Load(context.Context) (Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc := s.doc
+	doc.Entries = append([]Entry(nil), s.doc.Entries...)
+
+	return doc, nil
+}
+
+func (s *MemoryStore) Save(_ context.Context, doc Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if doc.Version != s.doc.Version {
+		return ErrConflict
+	}
+
+	s.doc = Document{
+		Entries: append([]Entry(nil), doc.Entries...),
+		Version: doc.Version + 1,
+	}
+
+	return nil
+}
+
+// documentID is the key of the block list item in the runs table. It's in the reserved key space,
+// so it cannot collide with a run, and the run routes never serve or delete it.
+const documentID = queryrun.ReservedIDPrefix + "blocklist"
+
+// DynamoStore keeps the block list as a single item of the runs table.
+type DynamoStore struct {
+	client    *dynamodb.Client
+	tableName *string
+}
+
+func NewDynamoStore(client *dynamodb.Client, tableName string) *DynamoStore {
+	return &DynamoStore{
+		client:    client,
+		tableName: aws.String(tableName),
+	}
+}
+
+func (s *DynamoStore) Load(ctx context.Context) (Document, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: s.tableName,
+		Key: map[string]types.AttributeValue{
+			"Id": &types.AttributeValueMemberS{Value: documentID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Document{}, errors.Wrap(err, "get failed")
+	}
+
+	var doc Document
+	if out.Item == nil {
+		return doc, nil
+	}
+
+	err = attributevalue.UnmarshalMap(out.Item, &doc)
+	if err != nil {
+		return Document{}, errors.Wrap(err, "unmarshal failed")
+	}
+
+	return doc, nil
+}
+
+func (s *DynamoStore) Save(ctx context.Context, doc Document) error {
+	item, err := attributevalue.MarshalMap(struct {
+		ID string `dynamodbav:"Id"`
+		Document
+	}{
+		ID: documentID,
+		Document: Document{
+			Entries: doc.Entries,
+			Version: doc.Version + 1,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	version, err := attributevalue.Marshal(doc.Version)
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           s.tableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Id) OR Version = :version"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": version,
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrConflict
+	}
+	if err != nil {
+		return errors.Wrap(err, "put failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,361 @@
+package canary
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultTimeout   = 2 * time.Minute
+	DefaultQueueSize = 64
+
+	// Label is attached to canary runs, so they can be listed by the label.
+	Label = "canary"
+
+	// busyRetryDelay is the wait before the next try if all runners are busy.
+	busyRetryDelay = 5 * time.Second
+
+	database = "clickhouse"
+)
+
+// DefaultQueries check that the server starts and a table can be created, filled and read.
+var DefaultQueries = []Query{
+	{Query: "SELECT version()"},
+	{
+		Query:  "CREATE TABLE canary (id UInt64) ENGINE = Memory; INSERT INTO canary VALUES (1), (2); SELECT sum(id) FROM canary",
+		Expect: "3",
+	},
+}
+
+var (
+	ErrUnknownVersion = errors.New("unknown version")
+	ErrQueueFull      = errors.New("too many canary checks are queued, try again later")
+)
+
+// Query is a canary query. If Expect is set, the output must contain it.
+type Query struct {
+	Query  string
+	Expect string
+}
+
+type Config struct {
+	Queries []Query
+
+	// Timeout limits every canary run.
+	Timeout time.Duration
+
+	// QueueSize bounds versions waiting to be checked.
+	QueueSize int
+
+	// WebhookURL is optional. If it's set, failures are posted to it in addition to the log.
+	WebhookURL     string
+	WebhookTimeout time.Duration
+}
+
+// Runner executes canary runs. Runs are saved to Repository flagged as canary.
+type Runner interface {
+	RunQuery(ctx context.Context, run *queryrun.Run) (qrunner.Result, error)
+}
+
+type Repository interface {
+	Create(ctx context.Context, run *queryrun.Run) error
+}
+
+type TagStorage interface {
+	Find(tag string) (dockertag.Image, bool)
+}
+
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusPassed  Status = "passed"
+	StatusFailed  Status = "failed"
+)
+
+// Result is the latest canary verdict on a version.
+type Result struct {
+	Version string
+	Status  Status
+
+	// Reason and RunID describe the first failed canary run.
+	Reason string
+	RunID  string
+
+	CheckedAt time.Time
+}
+
+// Canary executes canary queries against new versions, so broken images are found before users find them.
+// Versions are checked one by one by a single worker, so canaries take at most one runner slot at a time.
+type Canary struct {
+	ctx    context.Context
+	logger zerolog.Logger
+	cfg    Config
+
+	runner   Runner
+	repo     Repository
+	tags     TagStorage
+	notifier *webhook
+
+	queue   chan string
+	workers sync.WaitGroup
+
+	mu      sync.RWMutex
+	results map[string]Result
+}
+
+func New(ctx context.Context, logger zerolog.Logger, cfg Config, runner Runner, repo Repository, tags TagStorage) *Canary {
+	if len(cfg.Queries) == 0 {
+		cfg.Queries = DefaultQueries
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+
+	c := &Canary{
+		ctx:     ctx,
+		logger:  logger.With().Str("component", "canary").Logger(),
+		cfg:     cfg,
+		runner:  runner,
+		repo:    repo,
+		tags:    tags,
+		queue:   make(chan string, cfg.QueueSize),
+		results: make(map[string]Result),
+	}
+	if cfg.WebhookURL != "" {
+		c.notifier = newWebhook(cfg.WebhookURL, cfg.WebhookTimeout)
+	}
+
+	return c
+}
+
+// Start runs the worker checking queued versions until the context is done.
+func (c *Canary) Start() {
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+
+			case version := <-c.queue:
+				c.check(version)
+			}
+		}
+	}()
+}
+
+// Wait waits for the worker to be stopped.
+func (c *Canary) Wait() {
+	c.workers.Wait()
+}
+
+// Trigger queues the version to be checked. A version that is already queued is not queued twice.
+func (c *Canary) Trigger(version string) error {
+	if _, found := c.tags.Find(version); !found {
+		return ErrUnknownVersion
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results[version].Status == StatusQueued {
+		return nil
+	}
+
+	select {
+	case c.queue <- version:
+	default:
+		return ErrQueueFull
+	}
+
+	c.setStatusUnderLock(version, StatusQueued)
+
+	return nil
+}
+
+// setStatus updates the status of the version. The previous verdict is kept until the version is checked again.
+func (c *Canary) setStatus(version string, status Status) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setStatusUnderLock(version, status)
+}
+
+func (c *Canary) setStatusUnderLock(version string, status Status) {
+	res, found := c.results[version]
+	if !found {
+		res = Result{Version: version}
+	}
+
+	res.Status = status
+	c.results[version] = res
+}
+
+// OnNewTags queues new versions found by the tag storage.
+func (c *Canary) OnNewTags(images []dockertag.Image) {
+	for _, img := range images {
+		err := c.Trigger(img.Tag)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("version", img.Tag).Msg("canary check cannot be queued")
+		}
+	}
+}
+
+// Degraded reports whether the latest canary check of the version has failed and why.
+// Versions keep the failed verdict while they are queued for another check.
+func (c *Canary) Degraded(version string) (reason string, degraded bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	res, found := c.results[version]
+	if !found || res.Reason == "" {
+		return "", false
+	}
+
+	return res.Reason, true
+}
+
+// Verdict returns the latest verdict on the version. It's not found if the version has never been queued.
+func (c *Canary) Verdict(version string) (Result, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	res, found := c.results[version]
+
+	return res, found
+}
+
+// Results returns verdicts of all checked versions ordered by the version.
+func (c *Canary) Results() []Result {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	results := make([]Result, 0, len(c.results))
+	for _, res := range c.results {
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Version < results[j].Version })
+
+	return results
+}
+
+func (c *Canary) check(version string) {
+	c.setStatus(version, StatusRunning)
+
+	res := Result{Version: version, Status: StatusPassed}
+	for _, q := range c.cfg.Queries {
+		runID, reason := c.runQuery(version, q)
+		if reason != "" {
+			res.Status = StatusFailed
+			res.Reason = reason
+			res.RunID = runID
+
+			break
+		}
+	}
+	res.CheckedAt = time.Now()
+
+	c.mu.Lock()
+	c.results[version] = res
+	c.mu.Unlock()
+
+	if res.Status == StatusPassed {
+		c.logger.Info().Str("version", version).Msg("canary check has passed")
+		return
+	}
+
+	c.logger.Error().Str("version", version).Str("run_id", res.RunID).Str("reason", res.Reason).Msg("canary check has failed")
+
+	if c.notifier != nil {
+		err := c.notifier.notify(c.ctx, res)
+		if err != nil {
+			c.logger.Error().Err(err).Str("version", version).Msg("failed to send canary failure notification")
+		}
+	}
+}
+
+// runQuery executes and saves a canary run. It returns the failure reason if the run has failed.
+func (c *Canary) runQuery(version string, q Query) (runID string, reason string) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.Timeout)
+	defer cancel()
+
+	run := queryrun.New(q.Query, database, version, &runsettings.ClickHouseSettings{})
+	run.Labels = []string{Label}
+	run.Canary = true
+	run.ClientID = Label
+	run.Priority = queryrun.PriorityBackground
+
+	startedAt := time.Now()
+	res, err := c.runQueryWhenAvailable(ctx, run)
+	switch {
+	case err != nil:
+		reason = "run failed: " + err.Error()
+		run.Error = err.Error()
+
+	case res.Stderr != "":
+		reason = "query failed: " + firstLine(res.Stderr)
+
+	case !strings.Contains(res.Stdout, q.Expect):
+		reason = "unexpected output: " + firstLine(res.Stdout)
+	}
+
+	// The run has been interrupted by the shutdown, so it tells nothing about the version.
+	if c.ctx.Err() != nil {
+		return run.ID, ""
+	}
+
+	run.Output = res.Output()
+	run.Stderr = res.Stderr
+	run.ExitCode = res.ExitCode
+	run.ExecutionTime = time.Since(startedAt)
+	run.Stages = run.Timeline.Stages()
+	run.SetupTime, run.QueryTime = queryrun.SplitDurations(run.Stages)
+
+	saveErr := c.repo.Create(c.ctx, run)
+	if saveErr != nil {
+		c.logger.Error().Err(saveErr).Str("run_id", run.ID).Msg("canary run cannot be saved")
+	}
+
+	return run.ID, reason
+}
+
+// runQueryWhenAvailable waits for a runner to be available, so canaries yield to user runs.
+func (c *Canary) runQueryWhenAvailable(ctx context.Context, run *queryrun.Run) (qrunner.Result, error) {
+	for {
+		res, err := c.runner.RunQuery(ctx, run)
+		if !errors.Is(err, qrunner.ErrNoAvailableRunners) {
+			return res, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return qrunner.Result{}, errors.Wrap(ctx.Err(), "no runner has been available")
+
+		case <-time.After(busyRetryDelay):
+		}
+	}
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+
+	return line
+}
@@ -0,0 +1,151 @@
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type runnerStub func(run *queryrun.Run) (qrunner.Result, error)
+
+func (s runnerStub) RunQuery(_ context.Context, run *queryrun.Run) (qrunner.Result, error) {
+	return s(run)
+}
+
+type repoStub struct {
+	mu   sync.Mutex
+	runs []*queryrun.Run
+}
+
+func (r *repoStub) Create(_ context.Context, run *queryrun.Run) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.runs = append(r.runs, run)
+
+	return nil
+}
+
+type tagsStub map[string]bool
+
+func (t tagsStub) Find(tag string) (dockertag.Image, bool) {
+	return dockertag.Image{Tag: tag}, t[tag]
+}
+
+func newTestCanary(cfg Config, runner runnerStub, repo *repoStub) *Canary {
+	return New(context.Background(), zlog.Logger, cfg, runner, repo, tagsStub{"23.3": true, "23.4": true})
+}
+
+func TestCanary_check(t *testing.T) {
+	repo := &repoStub{}
+	c := newTestCanary(Config{}, func(run *queryrun.Run) (qrunner.Result, error) {
+		switch {
+		case run.Version == "23.4" && run.Input == DefaultQueries[0].Query:
+			return qrunner.Result{}, errors.New("container run failed: exec format error")
+
+		case run.Input == DefaultQueries[0].Query:
+			return qrunner.Result{Stdout: run.Version + "\n"}, nil
+
+		default:
+			return qrunner.Result{Stdout: "3\n"}, nil
+		}
+	}, repo)
+
+	c.check("23.3")
+	_, degraded := c.Degraded("23.3")
+	assert.False(t, degraded)
+	require.Len(t, repo.runs, len(DefaultQueries))
+	for _, run := range repo.runs {
+		assert.True(t, run.Canary)
+		assert.Equal(t, []string{Label}, run.Labels)
+	}
+
+	// The check stops at the first failed query.
+	c.check("23.4")
+	reason, degraded := c.Degraded("23.4")
+	assert.True(t, degraded)
+	assert.Contains(t, reason, "exec format error")
+	require.Len(t, repo.runs, len(DefaultQueries)+1)
+
+	results := c.Results()
+	require.Len(t, results, 2)
+	assert.Equal(t, StatusPassed, results[0].Status)
+	assert.Equal(t, StatusFailed, results[1].Status)
+	assert.Equal(t, repo.runs[len(repo.runs)-1].ID, results[1].RunID)
+}
+
+func TestCanary_check_Output(t *testing.T) {
+	queries := []Query{{Query: "SELECT 1", Expect: "1"}}
+
+	c := newTestCanary(Config{Queries: queries}, func(run *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stderr: "Code: 62. DB::Exception: Syntax error\nStack trace", ExitCode: 62}, nil
+	}, &repoStub{})
+	c.check("23.3")
+	reason, degraded := c.Degraded("23.3")
+	assert.True(t, degraded)
+	assert.Equal(t, "query failed: Code: 62. DB::Exception: Syntax error", reason)
+
+	c = newTestCanary(Config{Queries: queries}, func(run *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stdout: "2\n"}, nil
+	}, &repoStub{})
+	c.check("23.3")
+	reason, degraded = c.Degraded("23.3")
+	assert.True(t, degraded)
+	assert.Equal(t, "unexpected output: 2", reason)
+}
+
+func TestCanary_Trigger(t *testing.T) {
+	c := newTestCanary(Config{QueueSize: 1}, func(run *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{}, errors.New("broken")
+	}, &repoStub{})
+
+	assert.ErrorIs(t, c.Trigger("1.1"), ErrUnknownVersion)
+
+	require.NoError(t, c.Trigger("23.3"))
+	// Queued versions are not queued twice.
+	require.NoError(t, c.Trigger("23.3"))
+	assert.ErrorIs(t, c.Trigger("23.4"), ErrQueueFull)
+
+	c.check(<-c.queue)
+	_, degraded := c.Degraded("23.3")
+	assert.True(t, degraded)
+
+	// The failed verdict is kept while the version is checked again.
+	require.NoError(t, c.Trigger("23.3"))
+	assert.Equal(t, StatusQueued, c.Results()[0].Status)
+	_, degraded = c.Degraded("23.3")
+	assert.True(t, degraded)
+}
+
+func TestCanary_Webhook(t *testing.T) {
+	payloads := make(chan failurePayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p failurePayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		payloads <- p
+	}))
+	defer srv.Close()
+
+	c := newTestCanary(Config{WebhookURL: srv.URL}, func(run *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{}, errors.New("broken")
+	}, &repoStub{})
+	c.check("23.3")
+
+	p := <-payloads
+	assert.Equal(t, "canary_failed", p.Event)
+	assert.Equal(t, "23.3", p.Version)
+	assert.Equal(t, "run failed: broken", p.Reason)
+	assert.NotEmpty(t, p.RunID)
+}
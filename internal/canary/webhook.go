@@ -0,0 +1,69 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultWebhookTimeout = 10 * time.Second
+
+// webhook posts canary failures to the configured url.
+type webhook struct {
+	url string
+	cli *http.Client
+}
+
+func newWebhook(url string, timeout time.Duration) *webhook {
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+
+	return &webhook{
+		url: url,
+		cli: &http.Client{Timeout: timeout},
+	}
+}
+
+type failurePayload struct {
+	Event     string    `json:"event"`
+	Version   string    `json:"version"`
+	Reason    string    `json:"reason"`
+	RunID     string    `json:"run_id,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (w *webhook) notify(ctx context.Context, res Result) error {
+	body, err := json.Marshal(failurePayload{
+		Event:     "canary_failed",
+		Version:   res.Version,
+		Reason:    res.Reason,
+		RunID:     res.RunID,
+		CheckedAt: res.CheckedAt,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.cli.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
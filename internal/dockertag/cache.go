@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"clickhouse-playground/internal/metrics"
 	"clickhouse-playground/pkg/chsemver"
 	"clickhouse-playground/pkg/dockerhub"
 
@@ -16,8 +17,13 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-type DockerHubClient interface {
-	GetTags(repository string) ([]dockerhub.ImageTag, error)
+// RegistryClient lists tags of image repositories. It's implemented by the Docker Hub client,
+// and Registries routes repositories of other registries to their clients.
+type RegistryClient interface {
+	GetTags(ctx context.Context, repository string) ([]dockerhub.ImageTag, error)
+	TagExists(ctx context.Context, repository, tag string) (bool, error)
+	GetTag(ctx context.Context, repository, tag string) (*dockerhub.ImageTag, error)
+	ImageConfig(ctx context.Context, repository, digest string) (*dockerhub.ImageConfig, error)
 }
 
 // Cache is a cache for the list of docker image's tags.
@@ -25,24 +31,72 @@ type Cache struct {
 	ctx    context.Context
 	config Config
 	logger zerolog.Logger
-	cli    DockerHubClient
+	cli    RegistryClient
 
 	updating int32
 
+	deprecations atomic.Pointer[DeprecationConfig]
+
+	// newTagsListener is optional. It's called with tags that have appeared since the previous update.
+	newTagsListener func(images []Image)
+
+	// digestChangeListener is optional. It's called when a rolling tag has moved to a new digest.
+	digestChangeListener func(previous, current Image)
+
+	rollingTags map[string]struct{}
+
+	// ltsSeries are the LTS series of the config.
+	ltsSeries map[string]struct{}
+
+	// journal keeps recent changes of the tag list, so clients can tell what has changed since their last visit.
+	journal *journal
+
+	// buildDates keeps build dates of rolling images by digest, so they are fetched once.
+	buildDatesMu sync.Mutex
+	buildDates   map[string]time.Time
+
+	// loaded is closed by the first successful update.
+	loaded     chan struct{}
+	loadedOnce sync.Once
+
 	mu         sync.RWMutex
 	updatedAt  time.Time
 	imageByTag map[string]Image
 	images     []Image
+
+	// unavailable keeps images whose tags have disappeared from the registry.
+	unavailable map[string]Image
+	// validationCursor points to the next image to validate.
+	validationCursor int
 }
 
-func NewCache(ctx context.Context, config Config, logger zerolog.Logger, cli DockerHubClient) *Cache {
-	return &Cache{
-		ctx:        ctx,
-		config:     config,
-		logger:     logger,
-		cli:        cli,
-		imageByTag: make(map[string]Image),
+func NewCache(ctx context.Context, config Config, logger zerolog.Logger, cli RegistryClient) *Cache {
+	c := &Cache{
+		ctx:         ctx,
+		config:      config,
+		logger:      logger,
+		cli:         cli,
+		imageByTag:  make(map[string]Image),
+		unavailable: make(map[string]Image),
+		rollingTags: make(map[string]struct{}, len(config.Rolling.Tags)),
+		ltsSeries:   make(map[string]struct{}, len(config.LTS)),
+		buildDates:  make(map[string]time.Time),
+		loaded:      make(chan struct{}),
+		journal:     newJournal(config.Journal),
+	}
+	for _, tag := range config.Rolling.Tags {
+		c.rollingTags[c.normalizeTag(tag)] = struct{}{}
+	}
+	for _, series := range config.LTS {
+		c.ltsSeries[series] = struct{}{}
+	}
+
+	err := c.journal.load()
+	if err != nil {
+		logger.Error().Err(err).Str("path", config.Journal.Path).Msg("tag journal cannot be restored, it's started over")
 	}
+
+	return c
 }
 
 // RunBackgroundUpdate runs a background task that keeps data actual.
@@ -81,6 +135,25 @@ func (c *Cache) normalizeTag(tag string) string {
 	return strings.ToLower(tag)
 }
 
+// OnNewTags sets the listener of tags that appear in the registry. Tags fetched by the first update
+// are not reported. It must be called before the background update is started.
+func (c *Cache) OnNewTags(listener func(images []Image)) {
+	c.newTagsListener = listener
+}
+
+// UpdatedAt returns when the tags have been fetched last time. It's zero until the first successful update.
+func (c *Cache) UpdatedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.updatedAt
+}
+
+// Loaded returns a channel that is closed once the tags have been fetched for the first time.
+func (c *Cache) Loaded() <-chan struct{} {
+	return c.loaded
+}
+
 // GetAll returns all known tags for the given image.
 func (c *Cache) GetAll() []Image {
 	c.mu.RLock()
@@ -91,6 +164,35 @@ func (c *Cache) GetAll() []Image {
 	return c.images
 }
 
+// Snapshot is a copy of the cached images taken at once.
+type Snapshot struct {
+	Images []Image
+
+	// UpdatedAt is when the images have been fetched. It's zero until the first successful update.
+	UpdatedAt time.Time
+
+	// Generation is the generation of the tag list journal, changes after it can be requested later.
+	Generation uint64
+}
+
+// Snapshot returns a copy of the cached images. It's consistent even if the cache is being updated,
+// and it's not affected by the following updates.
+func (c *Cache) Snapshot() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	c.updateIfExpired()
+
+	images := make([]Image, len(c.images))
+	copy(images, c.images)
+
+	return Snapshot{
+		Images:     images,
+		UpdatedAt:  c.updatedAt,
+		Generation: c.journal.currentGeneration(),
+	}
+}
+
 // Exists checks whether the image has the given tag.
 func (c *Cache) Exists(tag string) bool {
 	c.mu.RLock()
@@ -115,6 +217,51 @@ func (c *Cache) Find(tag string) (img Image, found bool) {
 	return img, found
 }
 
+// Resolve searches an image by the requested version.
+//
+// If strict is false, the latest and lts aliases are resolved to the newest stable releases, and a partial
+// numeric version is resolved to the newest concrete tag of that series. For example, "21.8" may be resolved
+// to "21.8.15.7". Other versions must be existing tags.
+func (c *Cache) Resolve(version string, strict bool) (img Image, found bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	defer c.updateIfExpired()
+
+	r := resolver{images: c.images, imageByTag: c.imageByTag, lts: c.ltsSeries}
+
+	return r.resolve(c.normalizeTag(version), strict)
+}
+
+// Suggest returns at most limit tags that are the closest to the given version.
+// The closest tags share the longest common prefix with the version.
+func (c *Cache) Suggest(version string, limit int) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	requested := chsemver.Parse(version)
+
+	var suggestions []string
+	bestLen := 0
+	for _, img := range c.images {
+		prefixLen := chsemver.CommonPrefixLen(chsemver.Parse(img.Tag), requested)
+		if prefixLen == 0 || prefixLen < bestLen {
+			continue
+		}
+
+		if prefixLen > bestLen {
+			bestLen = prefixLen
+			suggestions = suggestions[:0]
+		}
+
+		if len(suggestions) < limit {
+			suggestions = append(suggestions, img.Tag)
+		}
+	}
+
+	return suggestions
+}
+
 // updateIfExpired asynchronously updates cache if the cache has expired.
 // The function should be called under the acquired mu lock.
 func (c *Cache) updateIfExpired() {
@@ -143,19 +290,90 @@ func (c *Cache) asyncUpdate() {
 
 	images, imgByTag, err := c.getImagesFromSeveralRepositories(c.config.Repositories)
 	if err != nil {
+		metrics.DockerTag.Refreshed("failed", time.Since(startedAt))
+		c.reportStale(err)
+
 		return
 	}
+	metrics.DockerTag.Refreshed("ok", time.Since(startedAt))
+	metrics.DockerTag.SnapshotAge(0)
 
+	c.annotateRolling(images, imgByTag)
+
+	var (
+		added []Image
+		moved []digestChange
+	)
 	func() {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 
+		previous := c.imageByTag
+		firstUpdate := c.updatedAt.IsZero()
+
 		c.updatedAt = time.Now()
-		c.images = images
-		c.imageByTag = imgByTag
+		c.images, c.imageByTag = c.excludeUnavailable(images, imgByTag)
+
+		c.loadedOnce.Do(func() {
+			close(c.loaded)
+		})
+		if !firstUpdate {
+			added = c.newImages(previous, c.images)
+			moved = c.movedImages(previous, c.imageByTag)
+		}
 	}()
 
 	c.logger.Debug().Dur("elapsed", time.Since(startedAt)).Int("tag_count", len(imgByTag)).Msg("docker image cache has been updated")
+
+	c.recordChanges()
+
+	if len(added) > 0 && c.newTagsListener != nil {
+		c.logger.Info().Int("count", len(added)).Msg("new tags have been found")
+		c.newTagsListener(added)
+	}
+
+	c.notifyDigestChanges(moved)
+}
+
+// reportStale tells that the last good tag list is served, since it cannot be refreshed.
+func (c *Cache) reportStale(err error) {
+	c.mu.RLock()
+	updatedAt := c.updatedAt
+	count := len(c.images)
+	c.mu.RUnlock()
+
+	var throttled *dockerhub.ThrottledError
+	if errors.As(err, &throttled) {
+		c.logger.Warn().Time("until", throttled.Until).Msg("docker hub is throttling tag refreshes")
+	}
+
+	select {
+	case <-c.loaded:
+	default:
+		c.logger.Warn().Err(err).Msg("tags have never been fetched, no version can be resolved yet")
+		return
+	}
+
+	// The time of the last refresh is reset to refresh the list sooner once a removed tag is available again.
+	if updatedAt.IsZero() {
+		return
+	}
+
+	age := time.Since(updatedAt)
+	metrics.DockerTag.SnapshotAge(age)
+	c.logger.Warn().Dur("age", age).Int("tag_count", count).Msg("tags cannot be refreshed, the last fetched ones are served")
+}
+
+// newImages returns images which tags are not in previous.
+func (c *Cache) newImages(previous map[string]Image, images []Image) []Image {
+	var added []Image
+	for _, img := range images {
+		if _, found := previous[c.normalizeTag(img.Tag)]; !found {
+			added = append(added, img)
+		}
+	}
+
+	return added
 }
 
 // getImagesFromSeveralRepositories fetches images from the given list of repositories.
@@ -166,13 +384,13 @@ func (c *Cache) asyncUpdate() {
 //
 // It returns a list of images and a map that links an image to its tag.
 func (c *Cache) getImagesFromSeveralRepositories(repositories []string) ([]Image, map[string]Image, error) {
-	g, _ := errgroup.WithContext(c.ctx)
+	g, gctx := errgroup.WithContext(c.ctx)
 	imagesByRepo := make([][]Image, len(repositories))
 	for i := range repositories {
 		i := i
 
 		g.Go(func() error {
-			images, err := c.getImages(repositories[i])
+			images, err := c.getImages(gctx, repositories[i])
 			if err != nil {
 				return err
 			}
@@ -209,8 +427,8 @@ func (c *Cache) getImagesFromSeveralRepositories(repositories []string) ([]Image
 
 // getImages returns a list of images from the given dockerhub repository.
 // It fetches all images and filters them by the supported OS and architecture.
-func (c *Cache) getImages(repository string) ([]Image, error) {
-	tags, err := c.cli.GetTags(repository)
+func (c *Cache) getImages(ctx context.Context, repository string) ([]Image, error) {
+	tags, err := c.cli.GetTags(ctx, repository)
 	if err != nil {
 		c.logger.Error().Err(err).Str("repository", repository).Msg("failed to get dockerhub tags")
 		return nil, errors.Wrap(err, "failed to get tags from dockerhub")
@@ -221,22 +439,7 @@ func (c *Cache) getImages(repository string) ([]Image, error) {
 	var images []Image
 
 	for _, t := range tags {
-		for _, i := range t.Images {
-			if !strings.EqualFold(i.OS, c.config.OS) || !strings.EqualFold(i.Architecture, c.config.Architecture) {
-				continue
-			}
-
-			converted := Image{
-				Repository:   repository,
-				Tag:          t.Name,
-				OS:           i.OS,
-				Architecture: i.Architecture,
-				Digest:       i.Digest,
-				PushedAt:     i.LastPushed,
-			}
-
-			images = append(images, converted)
-		}
+		images = append(images, c.convertTag(repository, t)...)
 	}
 
 	c.logger.Debug().Str("repository", repository).Int("count", len(images)).Msg("images have been fetched")
@@ -248,6 +451,56 @@ func (c *Cache) getImages(repository string) ([]Image, error) {
 	return images, nil
 }
 
+// convertTag returns the image of the tag built for the supported OS. The build of the configured architecture
+// is preferred, builds of other architectures are kept as platforms of the image, so runners of other architectures
+// can pull their own builds. Tags without builds for the OS are skipped.
+func (c *Cache) convertTag(repository string, t dockerhub.ImageTag) []Image {
+	var platforms []Platform
+	seen := make(map[string]struct{}, len(t.Images))
+	preferred := -1
+	for _, i := range t.Images {
+		if !strings.EqualFold(i.OS, c.config.OS) {
+			continue
+		}
+
+		// Variants of an architecture (e.g. arm/v6 and arm/v7) are not told apart, the first one is used.
+		arch := strings.ToLower(i.Architecture)
+		if _, found := seen[arch]; found {
+			continue
+		}
+		seen[arch] = struct{}{}
+
+		if arch == strings.ToLower(c.config.Architecture) {
+			preferred = len(platforms)
+		}
+		platforms = append(platforms, Platform{
+			Architecture: i.Architecture,
+			Digest:       i.Digest,
+			Size:         int64(i.Size),
+			PushedAt:     i.LastPushed,
+		})
+	}
+	if len(platforms) == 0 {
+		return nil
+	}
+	if preferred == -1 {
+		preferred = 0
+	}
+
+	p := platforms[preferred]
+
+	return []Image{{
+		Repository:   repository,
+		Tag:          t.Name,
+		OS:           c.config.OS,
+		Architecture: p.Architecture,
+		Digest:       p.Digest,
+		Size:         p.Size,
+		PushedAt:     p.PushedAt,
+		Platforms:    platforms,
+	}}
+}
+
 var headOfListTags = []string{
 	"head-alpine",
 	"head",
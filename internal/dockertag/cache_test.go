@@ -14,9 +14,15 @@ import (
 
 type DockerHubClientMock struct {
 	images map[string][]dockerhub.ImageTag
+
+	// missingTags are reported as unavailable by TagExists.
+	missingTags map[string]bool
+
+	// configs are image configs by digest.
+	configs map[string]*dockerhub.ImageConfig
 }
 
-func (c *DockerHubClientMock) GetTags(repository string) ([]dockerhub.ImageTag, error) {
+func (c *DockerHubClientMock) GetTags(_ context.Context, repository string) ([]dockerhub.ImageTag, error) {
 	images, exists := c.images[repository]
 	if !exists {
 		return nil, errors.New("not found")
@@ -25,6 +31,29 @@ func (c *DockerHubClientMock) GetTags(repository string) ([]dockerhub.ImageTag,
 	return images, nil
 }
 
+func (c *DockerHubClientMock) TagExists(_ context.Context, _ string, tag string) (bool, error) {
+	return !c.missingTags[tag], nil
+}
+
+func (c *DockerHubClientMock) GetTag(_ context.Context, repository, tag string) (*dockerhub.ImageTag, error) {
+	for _, t := range c.images[repository] {
+		if t.Name == tag {
+			return &t, nil
+		}
+	}
+
+	return nil, dockerhub.ErrTagNotFound
+}
+
+func (c *DockerHubClientMock) ImageConfig(_ context.Context, _, digest string) (*dockerhub.ImageConfig, error) {
+	cfg, found := c.configs[digest]
+	if !found {
+		return nil, errors.New("not found")
+	}
+
+	return cfg, nil
+}
+
 func TestGetImagesFromSeveralRepositories(t *testing.T) {
 	config := Config{
 		Repositories: []string{
@@ -165,3 +194,284 @@ func TestSortImages(t *testing.T) {
 		})
 	}
 }
+
+func TestResolve(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"a/clickhouse"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+	}
+	cache := NewCache(context.Background(), config, zlog.Logger, &DockerHubClientMock{})
+
+	imgByTag := make(map[string]Image)
+	for _, tag := range []string{"head", "latest", "22.3", "22.3.3.44", "22.3.12.19", "22.3.12.19-alpine", "21.8.15.7", "21.8.3", "21.80.1"} {
+		imgByTag[tag] = Image{Tag: tag}
+	}
+	cache.images = cache.sortImages(imgByTag)
+	cache.imageByTag = imgByTag
+	cache.updatedAt = time.Now()
+
+	cases := []struct {
+		version string
+		strict  bool
+		want    string
+		found   bool
+	}{
+		{version: "22.3", want: "22.3", found: true},
+		{version: "22.3.12", want: "22.3.12.19", found: true},
+		{version: "21.8", want: "21.8.15.7", found: true},
+		{version: "21", want: "21.80.1", found: true},
+		{version: "21.8", strict: true, found: false},
+		{version: "21.8.3", strict: true, want: "21.8.3", found: true},
+		{version: "21.9", found: false},
+		{version: "head", want: "head", found: true},
+		{version: "22.3-alpine", found: false},
+	}
+
+	for _, tc := range cases {
+		img, found := cache.Resolve(tc.version, tc.strict)
+		assert.Equal(t, tc.found, found, tc.version)
+		assert.Equal(t, tc.want, img.Tag, tc.version)
+	}
+
+	assert.Equal(t, []string{"21.80.1", "21.8.15.7"}, cache.Suggest("21.9", 2))
+	assert.Empty(t, cache.Suggest("unknown", 2))
+}
+
+func TestResolve_Aliases(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"a/clickhouse"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+		LTS:            []string{"21.8", "22.3"},
+	}
+	cache := NewCache(context.Background(), config, zlog.Logger, &DockerHubClientMock{})
+
+	imgByTag := make(map[string]Image)
+	for _, tag := range []string{"head", "latest", "22.6.1.1-alpine", "22.5.1.2079", "22.3.12.19", "22.3.3.44", "21.8.15.7"} {
+		imgByTag[tag] = Image{Tag: tag}
+	}
+	cache.images = cache.sortImages(imgByTag)
+	cache.imageByTag = imgByTag
+	cache.updatedAt = time.Now()
+
+	cases := []struct {
+		version string
+		strict  bool
+		want    string
+	}{
+		{version: "latest", want: "22.5.1.2079"},
+		{version: "LATEST", want: "22.5.1.2079"},
+		{version: "latest", strict: true, want: "latest"},
+		{version: "lts", want: "22.3.12.19"},
+		{version: "head", want: "head"},
+	}
+
+	for _, tc := range cases {
+		img, found := cache.Resolve(tc.version, tc.strict)
+		assert.True(t, found, tc.version)
+		assert.Equal(t, tc.want, img.Tag, tc.version)
+	}
+
+	// Without LTS series, the alias is an ordinary tag.
+	cache.ltsSeries = nil
+	_, found := cache.Resolve("lts", false)
+	assert.False(t, found)
+}
+
+func TestOnNewTags(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"clickhouse/clickhouse-server"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+	}
+	tag := func(name string) dockerhub.ImageTag {
+		return dockerhub.ImageTag{
+			Name: name,
+			Images: []dockerhub.Image{
+				{OS: config.OS, Architecture: config.Architecture, Digest: "sha256:" + name, LastPushed: time.Now()},
+			},
+		}
+	}
+
+	cli := &DockerHubClientMock{
+		images: map[string][]dockerhub.ImageTag{
+			"clickhouse/clickhouse-server": {tag("23.3"), tag("23.4")},
+		},
+	}
+
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+
+	var added []string
+	cache.OnNewTags(func(images []Image) {
+		for _, img := range images {
+			added = append(added, img.Tag)
+		}
+	})
+
+	// Tags of the first update are not new.
+	cache.asyncUpdate()
+	assert.Empty(t, added)
+
+	cli.images["clickhouse/clickhouse-server"] = append(cli.images["clickhouse/clickhouse-server"], tag("23.5"))
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"23.5"}, added)
+
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"23.5"}, added)
+}
+
+func TestSnapshot(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"clickhouse/clickhouse-server"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+	}
+	tag := func(name string) dockerhub.ImageTag {
+		return dockerhub.ImageTag{
+			Name: name,
+			Images: []dockerhub.Image{
+				{OS: config.OS, Architecture: config.Architecture, Digest: "sha256:" + name, LastPushed: time.Now()},
+			},
+		}
+	}
+
+	cli := &DockerHubClientMock{
+		images: map[string][]dockerhub.ImageTag{
+			"clickhouse/clickhouse-server": {tag("23.3"), tag("23.4")},
+		},
+	}
+
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+	assert.Empty(t, cache.Snapshot().Images)
+	assert.True(t, cache.Snapshot().UpdatedAt.IsZero())
+
+	cache.asyncUpdate()
+	snapshot := cache.Snapshot()
+	assert.Len(t, snapshot.Images, 2)
+	assert.False(t, snapshot.UpdatedAt.IsZero())
+
+	// The snapshot is a copy, it's not changed by updates and does not change the cache.
+	snapshot.Images[0].Tag = "changed"
+	cli.images["clickhouse/clickhouse-server"] = append(cli.images["clickhouse/clickhouse-server"], tag("23.5"))
+	cache.asyncUpdate()
+
+	assert.Len(t, snapshot.Images, 2)
+	assert.Len(t, cache.Snapshot().Images, 3)
+	assert.NotContains(t, cache.GetAll(), Image{Tag: "changed"})
+}
+
+func TestFailedUpdate(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"clickhouse/clickhouse-server"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+	}
+	tag := func(name string) dockerhub.ImageTag {
+		return dockerhub.ImageTag{
+			Name: name,
+			Images: []dockerhub.Image{
+				{OS: config.OS, Architecture: config.Architecture, Digest: "sha256:" + name, LastPushed: time.Now()},
+			},
+		}
+	}
+
+	tags := []dockerhub.ImageTag{tag("20.3"), tag("23.3")}
+	cli := &DockerHubClientMock{
+		images: map[string][]dockerhub.ImageTag{"clickhouse/clickhouse-server": tags},
+	}
+
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+	cache.asyncUpdate()
+	updatedAt := cache.UpdatedAt()
+
+	// The tags cannot be listed completely, so the previous list is kept.
+	delete(cli.images, "clickhouse/clickhouse-server")
+	cache.asyncUpdate()
+
+	assert.Len(t, cache.GetAll(), 2)
+	assert.True(t, cache.Exists("20.3"))
+	assert.Equal(t, updatedAt, cache.UpdatedAt())
+}
+
+func TestFailedFirstUpdate(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"clickhouse/clickhouse-server"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+	}
+
+	cli := &DockerHubClientMock{images: map[string][]dockerhub.ImageTag{}}
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+
+	cache.asyncUpdate()
+	assert.Empty(t, cache.Snapshot().Images)
+	select {
+	case <-cache.Loaded():
+		t.Fatal("the cache must not be loaded by a failed update")
+	default:
+	}
+
+	// The registry has stopped throttling.
+	cli.images["clickhouse/clickhouse-server"] = []dockerhub.ImageTag{{
+		Name:   "23.3",
+		Images: []dockerhub.Image{{OS: config.OS, Architecture: config.Architecture, Digest: "sha256:a", LastPushed: time.Now()}},
+	}}
+	cache.asyncUpdate()
+
+	assert.True(t, cache.Exists("23.3"))
+	<-cache.Loaded()
+}
+
+func TestConvertTag_Platforms(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"clickhouse/clickhouse-server"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+	}
+	cache := NewCache(context.Background(), config, zlog.Logger, &DockerHubClientMock{})
+
+	images := cache.convertTag("clickhouse/clickhouse-server", dockerhub.ImageTag{
+		Name: "23.3",
+		Images: []dockerhub.Image{
+			{OS: "linux", Architecture: "arm64", Digest: "sha256:arm", Size: 2},
+			{OS: "windows", Architecture: "amd64", Digest: "sha256:windows"},
+			{OS: "linux", Architecture: "amd64", Digest: "sha256:amd", Size: 1},
+		},
+	})
+	assert.Len(t, images, 1)
+
+	img := images[0]
+	assert.Equal(t, "amd64", img.Architecture)
+	assert.Equal(t, "sha256:amd", img.Digest)
+	assert.Equal(t, []string{"arm64", "amd64"}, img.Architectures())
+
+	arm, found := img.ForArchitecture("ARM64")
+	assert.True(t, found)
+	assert.Equal(t, "sha256:arm", arm.Digest)
+	assert.Equal(t, int64(2), arm.Size)
+	assert.Equal(t, "23.3", arm.Tag)
+
+	_, found = img.ForArchitecture("s390x")
+	assert.False(t, found)
+
+	// Tags without a build of the configured architecture are kept for runners of other architectures.
+	images = cache.convertTag("clickhouse/clickhouse-server", dockerhub.ImageTag{
+		Name:   "head",
+		Images: []dockerhub.Image{{OS: "linux", Architecture: "arm64", Digest: "sha256:arm"}},
+	})
+	assert.Len(t, images, 1)
+	assert.Equal(t, "arm64", images[0].Architecture)
+
+	// Pinned images have no platforms, they are run as is.
+	pinned, found := Image{Digest: "sha256:pinned"}.ForArchitecture("arm64")
+	assert.True(t, found)
+	assert.Equal(t, "sha256:pinned", pinned.Digest)
+}
@@ -3,6 +3,8 @@ package dockertag
 import "time"
 
 const DefaultExpirationTime = 5 * time.Minute
+const DefaultValidationSampleSize = 10
+const DefaultRollingRefreshInterval = time.Minute
 
 type Config struct {
 	Repositories []string
@@ -10,4 +12,32 @@ type Config struct {
 	Architecture string
 
 	ExpirationTime time.Duration
+
+	// LTS are the long-term support series the lts alias is resolved within, e.g. 22.8 and 23.3.
+	LTS []string
+
+	Validation ValidationConfig
+
+	Rolling RollingConfig
+
+	Journal JournalConfig
+}
+
+// ValidationConfig configures periodic checks that cached tags are still available in the registry.
+// Unavailable tags are hidden until they are pushed again.
+type ValidationConfig struct {
+	// How often a sample of tags is checked. If 0, the validation is disabled.
+	Frequency time.Duration
+
+	// How many tags are checked per cycle. Tags are checked in rotation.
+	SampleSize int
+}
+
+// RollingConfig configures tags that are re-pushed with every new build, e.g. head and its nightly builds of master.
+// Their digests are refreshed more often than the whole list, and their build dates are fetched.
+type RollingConfig struct {
+	Tags []string
+
+	// How often digests of rolling tags are refreshed. If 0, DefaultRollingRefreshInterval is used.
+	RefreshInterval time.Duration
 }
@@ -0,0 +1,89 @@
+package dockertag
+
+import (
+	"fmt"
+
+	"clickhouse-playground/pkg/chsemver"
+
+	"github.com/pkg/errors"
+)
+
+// DeprecationRule marks versions in the [MinVersion, MaxVersion] range as deprecated.
+// Both bounds are optional and inclusive; MaxVersion is compared by prefix ("21.7" includes "21.7.11").
+type DeprecationRule struct {
+	MinVersion string
+	MaxVersion string
+
+	// Message is shown to users, e.g. "versions before 21.8 are EOL".
+	Message string
+}
+
+type DeprecationConfig struct {
+	// Rules are checked in order, the first matching one is used.
+	Rules []DeprecationRule
+
+	// If RejectDeprecated is true, deprecated versions cannot be run.
+	RejectDeprecated bool
+}
+
+// Deprecation describes why a version is deprecated.
+type Deprecation struct {
+	Message string
+
+	// Rejected is true if the version cannot be run.
+	Rejected bool
+}
+
+func (r *DeprecationRule) validate() error {
+	if r.MinVersion == "" && r.MaxVersion == "" {
+		return errors.New("at least one of min and max versions is required")
+	}
+
+	if r.MinVersion != "" && r.MaxVersion != "" && chsemver.IsGreater(chsemver.Parse(r.MinVersion), chsemver.Parse(r.MaxVersion)) {
+		return errors.Errorf("min version %s is greater than max version %s", r.MinVersion, r.MaxVersion)
+	}
+
+	return nil
+}
+
+func (r *DeprecationRule) message(tag string) string {
+	if r.Message != "" {
+		return r.Message
+	}
+
+	return fmt.Sprintf("version %s is deprecated", tag)
+}
+
+// SetDeprecations replaces deprecation rules. The previous rules are kept if the new ones are invalid.
+func (c *Cache) SetDeprecations(cfg DeprecationConfig) error {
+	for i := range cfg.Rules {
+		err := cfg.Rules[i].validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid deprecation rule #%d", i+1)
+		}
+	}
+
+	c.deprecations.Store(&cfg)
+
+	return nil
+}
+
+// Deprecation checks whether the tag is deprecated.
+func (c *Cache) Deprecation(tag string) (Deprecation, bool) {
+	cfg := c.deprecations.Load()
+	if cfg == nil {
+		return Deprecation{}, false
+	}
+
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if chsemver.InRange(tag, rule.MinVersion, rule.MaxVersion) {
+			return Deprecation{
+				Message:  rule.message(tag),
+				Rejected: cfg.RejectDeprecated,
+			}, true
+		}
+	}
+
+	return Deprecation{}, false
+}
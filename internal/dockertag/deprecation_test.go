@@ -0,0 +1,70 @@
+package dockertag
+
+import (
+	"context"
+	"testing"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeprecation(t *testing.T) {
+	cache := NewCache(context.Background(), Config{}, zlog.Logger, &DockerHubClientMock{})
+
+	_, deprecated := cache.Deprecation("1.1.54")
+	assert.False(t, deprecated, "no rules")
+
+	err := cache.SetDeprecations(DeprecationConfig{
+		Rules: []DeprecationRule{
+			{MaxVersion: "21.7", Message: "versions before 21.8 are EOL"},
+			{MinVersion: "22.1", MaxVersion: "22.2"},
+		},
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		tag        string
+		deprecated bool
+		message    string
+	}{
+		{tag: "1.1.54", deprecated: true, message: "versions before 21.8 are EOL"},
+		{tag: "21.7", deprecated: true, message: "versions before 21.8 are EOL"},
+		{tag: "21.7.11.3", deprecated: true, message: "versions before 21.8 are EOL"},
+		{tag: "21.8", deprecated: false},
+		{tag: "21.8.1.1", deprecated: false},
+		{tag: "21.10.1", deprecated: false},
+		{tag: "22.1.3", deprecated: true, message: "version 22.1.3 is deprecated"},
+		{tag: "22.2", deprecated: true, message: "version 22.2 is deprecated"},
+		{tag: "22.3", deprecated: false},
+		{tag: "head", deprecated: false},
+		{tag: "latest", deprecated: false},
+	}
+
+	for _, tc := range cases {
+		d, deprecated := cache.Deprecation(tc.tag)
+		assert.Equal(t, tc.deprecated, deprecated, tc.tag)
+		assert.Equal(t, tc.message, d.Message, tc.tag)
+		assert.False(t, d.Rejected, tc.tag)
+	}
+}
+
+func TestSetDeprecations(t *testing.T) {
+	cache := NewCache(context.Background(), Config{}, zlog.Logger, &DockerHubClientMock{})
+
+	require.NoError(t, cache.SetDeprecations(DeprecationConfig{
+		Rules:            []DeprecationRule{{MaxVersion: "20"}},
+		RejectDeprecated: true,
+	}))
+
+	d, deprecated := cache.Deprecation("20.3")
+	assert.True(t, deprecated)
+	assert.True(t, d.Rejected)
+
+	// Invalid rules are rejected and the previous ones are kept.
+	assert.Error(t, cache.SetDeprecations(DeprecationConfig{Rules: []DeprecationRule{{}}}))
+	assert.Error(t, cache.SetDeprecations(DeprecationConfig{Rules: []DeprecationRule{{MinVersion: "22", MaxVersion: "21"}}}))
+
+	_, deprecated = cache.Deprecation("20.3")
+	assert.True(t, deprecated)
+}
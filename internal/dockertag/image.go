@@ -1,6 +1,9 @@
 package dockertag
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Image struct {
 	Repository string
@@ -10,5 +13,62 @@ type Image struct {
 	Architecture string
 	Digest       string
 
+	// Size is the compressed size of the image in bytes. It's 0 if Docker Hub has not reported it.
+	Size int64
+
 	PushedAt time.Time
+
+	// Rolling tags are re-pushed with every new build, see RollingConfig.
+	// BuildDate is when the image has been built. It's known for rolling tags only.
+	Rolling   bool
+	BuildDate time.Time
+
+	// Platforms are the builds of the tag for every architecture of the supported OS, the image is one of them.
+	// Runners pull the build of their own architecture.
+	Platforms []Platform
+}
+
+// Platform is the build of a tag for an architecture.
+type Platform struct {
+	Architecture string
+	Digest       string
+	Size         int64
+	PushedAt     time.Time
+}
+
+// Architectures returns the architectures the tag is built for.
+func (i Image) Architectures() []string {
+	if len(i.Platforms) == 0 {
+		return []string{i.Architecture}
+	}
+
+	archs := make([]string, 0, len(i.Platforms))
+	for _, p := range i.Platforms {
+		archs = append(archs, p.Architecture)
+	}
+
+	return archs
+}
+
+// ForArchitecture returns the build of the tag for the architecture. It returns false if the tag has no such build.
+// Images with unknown platforms (e.g. pinned by digest) are returned as is.
+func (i Image) ForArchitecture(arch string) (Image, bool) {
+	if len(i.Platforms) == 0 {
+		return i, true
+	}
+
+	for _, p := range i.Platforms {
+		if !strings.EqualFold(p.Architecture, arch) {
+			continue
+		}
+
+		i.Architecture = p.Architecture
+		i.Digest = p.Digest
+		i.Size = p.Size
+		i.PushedAt = p.PushedAt
+
+		return i, true
+	}
+
+	return Image{}, false
 }
@@ -0,0 +1,287 @@
+package dockertag
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultJournalSize = 100
+
+// JournalConfig configures the journal of tag list changes.
+type JournalConfig struct {
+	// Size is the max number of kept entries, the oldest ones are dropped. If 0, DefaultJournalSize is used.
+	Size int
+
+	// Path is optional. If it's set, the journal and the last known tags are saved to the file after every change,
+	// so changes made while the service was down are journaled by the first refresh after a restart.
+	Path string
+}
+
+type ChangeKind string
+
+const (
+	ChangeAdded         ChangeKind = "added"
+	ChangeRemoved       ChangeKind = "removed"
+	ChangeDigestChanged ChangeKind = "digest_changed"
+)
+
+// Change is a change of a single tag. PreviousDigest is set for digest changes and removals.
+type Change struct {
+	Kind           ChangeKind `json:"kind"`
+	Tag            string     `json:"tag"`
+	Digest         string     `json:"digest,omitempty"`
+	PreviousDigest string     `json:"previous_digest,omitempty"`
+}
+
+// JournalEntry is the changes of the tag list made by a single refresh.
+// Generations of entries grow by one, so clients can ask for changes after the generation they have seen.
+type JournalEntry struct {
+	Generation uint64    `json:"generation"`
+	At         time.Time `json:"at"`
+	Changes    []Change  `json:"changes"`
+}
+
+// Changelog is the entries of the journal after a point.
+type Changelog struct {
+	// Generation is the current generation of the tag list.
+	Generation uint64
+
+	Entries []JournalEntry
+
+	// Complete is false if some entries after the point have been dropped from the journal,
+	// so the client must reload the whole list.
+	Complete bool
+}
+
+// journalFile is the persisted journal. Known are the digests of the journaled tags by tag.
+type journalFile struct {
+	Generation uint64            `json:"generation"`
+	Entries    []JournalEntry    `json:"entries"`
+	Known      map[string]string `json:"known"`
+}
+
+type journal struct {
+	size int
+	path string
+
+	mu         sync.RWMutex
+	generation uint64
+	entries    []JournalEntry
+
+	// known is nil until the first list is recorded, the first list is not journaled as added.
+	known map[string]string
+}
+
+func newJournal(cfg JournalConfig) *journal {
+	j := &journal{size: cfg.Size, path: cfg.Path}
+	if j.size <= 0 {
+		j.size = DefaultJournalSize
+	}
+
+	return j
+}
+
+// load reads the journal saved by the previous process. A missing file is not an error.
+func (j *journal) load() error {
+	if j.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read journal")
+	}
+
+	var f journalFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse journal")
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.generation = f.Generation
+	j.entries = f.Entries
+	j.known = f.Known
+	j.trim()
+
+	return nil
+}
+
+// save writes the journal to a temporary file and renames it, so a crash never leaves a truncated journal.
+func (j *journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+
+	j.mu.RLock()
+	data, err := json.Marshal(journalFile{Generation: j.generation, Entries: j.entries, Known: j.known})
+	j.mu.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize journal")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create journal file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write journal")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), j.path), "failed to replace journal")
+}
+
+// record compares the digests of the current tags with the known ones and journals the differences.
+// It reports whether the journal has changed and must be saved.
+func (j *journal) record(at time.Time, current map[string]string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.known == nil {
+		j.known = current
+		return true
+	}
+
+	var changes []Change
+	for tag, digest := range current {
+		previous, found := j.known[tag]
+		switch {
+		case !found:
+			changes = append(changes, Change{Kind: ChangeAdded, Tag: tag, Digest: digest})
+		case previous != digest:
+			changes = append(changes, Change{Kind: ChangeDigestChanged, Tag: tag, Digest: digest, PreviousDigest: previous})
+		}
+	}
+	for tag, digest := range j.known {
+		if _, found := current[tag]; !found {
+			changes = append(changes, Change{Kind: ChangeRemoved, Tag: tag, PreviousDigest: digest})
+		}
+	}
+
+	j.known = current
+	if len(changes) == 0 {
+		return false
+	}
+
+	sort.Slice(changes, func(a, b int) bool {
+		return changes[a].Tag < changes[b].Tag
+	})
+
+	j.generation++
+	j.entries = append(j.entries, JournalEntry{Generation: j.generation, At: at, Changes: changes})
+	j.trim()
+
+	return true
+}
+
+// trim drops the oldest entries over the size. It must be called under the acquired mu lock.
+func (j *journal) trim() {
+	if len(j.entries) > j.size {
+		j.entries = append([]JournalEntry(nil), j.entries[len(j.entries)-j.size:]...)
+	}
+}
+
+func (j *journal) currentGeneration() uint64 {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.generation
+}
+
+// since returns the entries after the generation.
+func (j *journal) since(generation uint64) Changelog {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	changelog := Changelog{Generation: j.generation, Complete: true}
+	for i, e := range j.entries {
+		if e.Generation > generation {
+			changelog.Entries = append([]JournalEntry(nil), j.entries[i:]...)
+			// Entries between the generation and the oldest kept one have been dropped otherwise.
+			changelog.Complete = e.Generation == generation+1
+
+			break
+		}
+	}
+
+	return changelog
+}
+
+// after returns the entries made after t.
+func (j *journal) after(t time.Time) Changelog {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	changelog := Changelog{Generation: j.generation, Complete: true}
+	for i, e := range j.entries {
+		if e.At.After(t) {
+			changelog.Entries = append([]JournalEntry(nil), j.entries[i:]...)
+			// Dropped entries are older than the kept ones, but they may have been made after t as well.
+			changelog.Complete = i > 0 || e.Generation == 1
+
+			break
+		}
+	}
+
+	return changelog
+}
+
+// Generation returns the current generation of the tag list, it grows with every journaled change.
+func (c *Cache) Generation() uint64 {
+	return c.journal.currentGeneration()
+}
+
+// ChangesSince returns the changes of the tag list after the given generation.
+func (c *Cache) ChangesSince(generation uint64) Changelog {
+	return c.journal.since(generation)
+}
+
+// ChangesAfter returns the changes of the tag list made after the given time.
+func (c *Cache) ChangesAfter(t time.Time) Changelog {
+	return c.journal.after(t)
+}
+
+// recordChanges journals the differences of the current tag list from the previously journaled one.
+// Nothing is recorded until the list is fetched for the first time.
+func (c *Cache) recordChanges() {
+	select {
+	case <-c.loaded:
+	default:
+		return
+	}
+
+	// The list cannot be changed while it's recorded, so concurrent refreshes are journaled in order.
+	c.mu.RLock()
+	current := make(map[string]string, len(c.imageByTag))
+	for tag, img := range c.imageByTag {
+		current[tag] = img.Digest
+	}
+	changed := c.journal.record(time.Now(), current)
+	c.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	err := c.journal.save()
+	if err != nil {
+		c.logger.Error().Err(err).Str("path", c.journal.path).Msg("failed to save tag journal")
+	}
+}
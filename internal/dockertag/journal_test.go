@@ -0,0 +1,79 @@
+package dockertag
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal_Record(t *testing.T) {
+	j := newJournal(JournalConfig{})
+	now := time.Now()
+
+	assert.True(t, j.record(now, map[string]string{"23.3": "sha256:a", "head": "sha256:b"}))
+	assert.Equal(t, uint64(0), j.currentGeneration(), "the first list is not journaled")
+
+	assert.False(t, j.record(now, map[string]string{"23.3": "sha256:a", "head": "sha256:b"}))
+
+	assert.True(t, j.record(now, map[string]string{"23.4": "sha256:c", "head": "sha256:d"}))
+	changelog := j.since(0)
+	assert.True(t, changelog.Complete)
+	assert.Equal(t, uint64(1), changelog.Generation)
+	require.Len(t, changelog.Entries, 1)
+	assert.Equal(t, []Change{
+		{Kind: ChangeRemoved, Tag: "23.3", PreviousDigest: "sha256:a"},
+		{Kind: ChangeAdded, Tag: "23.4", Digest: "sha256:c"},
+		{Kind: ChangeDigestChanged, Tag: "head", Digest: "sha256:d", PreviousDigest: "sha256:b"},
+	}, changelog.Entries[0].Changes)
+
+	assert.Empty(t, j.since(1).Entries)
+}
+
+func TestJournal_Bounded(t *testing.T) {
+	j := newJournal(JournalConfig{Size: 2})
+	startedAt := time.Now()
+
+	j.record(startedAt, map[string]string{})
+	for i, tag := range []string{"23.1", "23.2", "23.3"} {
+		j.record(startedAt.Add(time.Duration(i+1)*time.Minute), map[string]string{tag: "sha256:" + tag})
+	}
+
+	changelog := j.since(0)
+	assert.False(t, changelog.Complete, "the first entry has been dropped")
+	require.Len(t, changelog.Entries, 2)
+	assert.Equal(t, uint64(2), changelog.Entries[0].Generation)
+
+	changelog = j.since(1)
+	assert.True(t, changelog.Complete)
+	assert.Len(t, changelog.Entries, 2)
+
+	changelog = j.after(startedAt.Add(150 * time.Second))
+	assert.True(t, changelog.Complete)
+	require.Len(t, changelog.Entries, 1)
+	assert.Equal(t, uint64(3), changelog.Entries[0].Generation)
+
+	assert.False(t, j.after(startedAt).Complete)
+}
+
+func TestJournal_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j := newJournal(JournalConfig{Path: path})
+	require.NoError(t, j.load(), "a missing journal is started over")
+	j.record(time.Now(), map[string]string{"23.3": "sha256:a"})
+	j.record(time.Now(), map[string]string{"23.3": "sha256:a", "23.4": "sha256:b"})
+	require.NoError(t, j.save())
+
+	// Tags added while the service was down are journaled by the first refresh.
+	restored := newJournal(JournalConfig{Path: path})
+	require.NoError(t, restored.load())
+	assert.Equal(t, uint64(1), restored.currentGeneration())
+	assert.True(t, restored.record(time.Now(), map[string]string{"23.3": "sha256:a", "23.4": "sha256:b", "23.5": "sha256:c"}))
+
+	changelog := restored.since(1)
+	require.Len(t, changelog.Entries, 1)
+	assert.Equal(t, []Change{{Kind: ChangeAdded, Tag: "23.5", Digest: "sha256:c"}}, changelog.Entries[0].Changes)
+}
@@ -0,0 +1,73 @@
+package dockertag
+
+import (
+	"context"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/pkg/errors"
+)
+
+// Registries routes requests to the client of the registry hosting the repository. Docker Hub repositories
+// are spelled by their paths (e.g. clickhouse/clickhouse-server), repositories of other registries start
+// with the registry host (e.g. ghcr.io/clickhouse/clickhouse-server), and their clients get the path only.
+type Registries struct {
+	DockerHub RegistryClient
+
+	// Hosts are clients of other registries by their hosts.
+	Hosts map[string]RegistryClient
+}
+
+func (r *Registries) route(repository string) (RegistryClient, string, error) {
+	ref, err := qrunner.ParseRepositoryRef(repository)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "invalid repository")
+	}
+	if ref.IsDockerHub() {
+		return r.DockerHub, ref.Path(), nil
+	}
+
+	cli, found := r.Hosts[ref.Registry]
+	if !found {
+		return nil, "", errors.Errorf("registry %s of repository %s is not configured", ref.Registry, repository)
+	}
+
+	return cli, ref.Path(), nil
+}
+
+func (r *Registries) GetTags(ctx context.Context, repository string) ([]dockerhub.ImageTag, error) {
+	cli, path, err := r.route(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.GetTags(ctx, path)
+}
+
+func (r *Registries) TagExists(ctx context.Context, repository, tag string) (bool, error) {
+	cli, path, err := r.route(repository)
+	if err != nil {
+		return false, err
+	}
+
+	return cli.TagExists(ctx, path, tag)
+}
+
+func (r *Registries) GetTag(ctx context.Context, repository, tag string) (*dockerhub.ImageTag, error) {
+	cli, path, err := r.route(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.GetTag(ctx, path, tag)
+}
+
+func (r *Registries) ImageConfig(ctx context.Context, repository, digest string) (*dockerhub.ImageConfig, error) {
+	cli, path, err := r.route(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.ImageConfig(ctx, path, digest)
+}
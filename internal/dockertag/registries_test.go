@@ -0,0 +1,36 @@
+package dockertag
+
+import (
+	"context"
+	"testing"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistries_Route(t *testing.T) {
+	hub := &DockerHubClientMock{images: map[string][]dockerhub.ImageTag{
+		"clickhouse/clickhouse-server": {{Name: "hub"}},
+	}}
+	ghcr := &DockerHubClientMock{images: map[string][]dockerhub.ImageTag{
+		"clickhouse/clickhouse-server": {{Name: "ghcr"}},
+	}}
+	registries := &Registries{DockerHub: hub, Hosts: map[string]RegistryClient{"ghcr.io": ghcr}}
+
+	tags, err := registries.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	require.NoError(t, err)
+	assert.Equal(t, "hub", tags[0].Name)
+
+	tags, err = registries.GetTags(context.Background(), "ghcr.io/clickhouse/clickhouse-server")
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr", tags[0].Name)
+
+	tag, err := registries.GetTag(context.Background(), "ghcr.io/clickhouse/clickhouse-server", "ghcr")
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr", tag.Name)
+
+	_, err = registries.GetTags(context.Background(), "quay.io/clickhouse/clickhouse-server")
+	require.Error(t, err)
+}
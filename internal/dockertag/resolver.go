@@ -0,0 +1,85 @@
+package dockertag
+
+import (
+	"clickhouse-playground/pkg/chsemver"
+)
+
+// Aliases of versions. They are resolved to concrete tags unless the resolution is strict,
+// then they are looked up as tags like any other version.
+const (
+	// AliasLatest is resolved to the newest stable release.
+	AliasLatest = "latest"
+
+	// AliasLTS is resolved to the newest release of the newest LTS series, see Config.LTS.
+	AliasLTS = "lts"
+)
+
+// resolver resolves requested versions to tags of a list of images sorted from the newest one.
+// Resolution depends on the list only, so the same version is resolved to the same tag until the list is updated.
+type resolver struct {
+	images     []Image
+	imageByTag map[string]Image
+
+	// lts are the LTS series, e.g. 22.8 and 23.3.
+	lts map[string]struct{}
+}
+
+// resolve searches an image by the requested version, which must be normalized.
+//
+// The exact tag is used if it exists and strict is set. Otherwise, aliases are resolved first, then the exact tag
+// is looked up, and a partial numeric version (e.g. 21.8) is resolved to the newest release of that series.
+// Only numeric tags (e.g. 21.8.15.7) are stable releases, other tags (e.g. head-alpine) match exactly.
+func (r resolver) resolve(version string, strict bool) (Image, bool) {
+	if strict {
+		img, found := r.imageByTag[version]
+		return img, found
+	}
+
+	switch version {
+	case AliasLatest:
+		if img, found := r.newestRelease(func(chsemver.Semver) bool { return true }); found {
+			return img, true
+		}
+
+	case AliasLTS:
+		if img, found := r.newestRelease(r.isLTS); found {
+			return img, true
+		}
+	}
+
+	if img, found := r.imageByTag[version]; found {
+		return img, true
+	}
+
+	requested := chsemver.Parse(version)
+	if !chsemver.IsNumeric(requested) {
+		return Image{}, false
+	}
+
+	return r.newestRelease(func(parsed chsemver.Semver) bool {
+		return chsemver.HasPrefix(parsed, requested)
+	})
+}
+
+// newestRelease returns the newest stable release matched by the filter.
+// Images are sorted in descending order, so the first matched one is the newest.
+func (r resolver) newestRelease(match func(chsemver.Semver) bool) (Image, bool) {
+	for _, candidate := range r.images {
+		parsed := chsemver.Parse(candidate.Tag)
+		if chsemver.IsNumeric(parsed) && match(parsed) {
+			return candidate, true
+		}
+	}
+
+	return Image{}, false
+}
+
+func (r resolver) isLTS(parsed chsemver.Semver) bool {
+	if len(parsed) < 2 {
+		return false
+	}
+
+	_, found := r.lts[parsed[0]+"."+parsed[1]]
+
+	return found
+}
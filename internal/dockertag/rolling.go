@@ -0,0 +1,256 @@
+package dockertag
+
+import (
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/pkg/errors"
+)
+
+// buildDateLabels are image labels that may hold the build date, in the order of preference.
+// If none is set, the creation time of the image config is used.
+var buildDateLabels = []string{
+	"org.opencontainers.image.created",
+	"org.label-schema.build-date",
+	"build-date",
+}
+
+// digestChange is a rolling tag that has moved to a new digest.
+type digestChange struct {
+	previous Image
+	current  Image
+}
+
+// OnDigestChange sets the listener of rolling tags that have moved to a new digest, e.g. a new nightly build
+// has been pushed as head. It must be called before the background tasks are started.
+func (c *Cache) OnDigestChange(listener func(previous, current Image)) {
+	c.digestChangeListener = listener
+}
+
+// IsRolling reports whether the tag is re-pushed with every new build.
+func (c *Cache) IsRolling(tag string) bool {
+	_, found := c.rollingTags[c.normalizeTag(tag)]
+	return found
+}
+
+// RunBackgroundRollingRefresh runs a background task that refreshes digests of rolling tags
+// more often than the whole list is refreshed. It does nothing if there are no rolling tags.
+func (c *Cache) RunBackgroundRollingRefresh() {
+	if len(c.rollingTags) == 0 {
+		return
+	}
+
+	go c.backgroundRollingRefresh()
+}
+
+func (c *Cache) backgroundRollingRefresh() {
+	interval := c.config.Rolling.RefreshInterval
+	if interval == 0 {
+		interval = DefaultRollingRefreshInterval
+	}
+
+	c.logger.Info().Strs("tags", c.config.Rolling.Tags).Msg("rolling tag refresh background task has been started")
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.logger.Info().Msg("rolling tag refresh background task has been finished")
+			return
+
+		case <-t.C:
+		}
+
+		c.refreshRolling()
+	}
+}
+
+// refreshRolling fetches the rolling tags one by one. A tag is taken from the first repository that has it,
+// the same way the whole list is merged. Tags that have not been fetched by the list refresh yet are skipped.
+func (c *Cache) refreshRolling() {
+	var moved []digestChange
+	for _, tag := range c.config.Rolling.Tags {
+		img, found, err := c.fetchTag(tag)
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.logger.Warn().Err(err).Str("tag", tag).Msg("rolling tag cannot be refreshed")
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		if change, changed := c.replaceRolling(img); changed {
+			moved = append(moved, change)
+		}
+	}
+
+	c.notifyDigestChanges(moved)
+	if len(moved) > 0 {
+		c.recordChanges()
+	}
+}
+
+func (c *Cache) fetchTag(tag string) (Image, bool, error) {
+	for _, repository := range c.config.Repositories {
+		t, err := c.cli.GetTag(c.ctx, repository, tag)
+		if errors.Is(err, dockerhub.ErrTagNotFound) {
+			continue
+		}
+		if err != nil {
+			return Image{}, false, errors.Wrapf(err, "failed to get tag from %s", repository)
+		}
+
+		images := c.convertTag(repository, *t)
+		if len(images) == 0 {
+			continue
+		}
+
+		img := images[0]
+		img.Rolling = true
+		img.BuildDate = c.buildDate(img)
+
+		return img, true, nil
+	}
+
+	return Image{}, false, nil
+}
+
+// replaceRolling updates the cached image of the rolling tag. It reports whether the digest has changed.
+func (c *Cache) replaceRolling(img Image) (digestChange, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tag := c.normalizeTag(img.Tag)
+	previous, found := c.imageByTag[tag]
+	if !found {
+		return digestChange{}, false
+	}
+
+	if previous.Digest == img.Digest {
+		// The build date may have failed to be fetched before.
+		if previous.BuildDate.IsZero() && !img.BuildDate.IsZero() {
+			c.replaceImage(tag, img)
+		}
+
+		return digestChange{}, false
+	}
+
+	c.replaceImage(tag, img)
+
+	return digestChange{previous: previous, current: img}, true
+}
+
+// replaceImage must be called under the acquired mu lock. The list may be held by callers,
+// so it's copied instead of being modified in place.
+func (c *Cache) replaceImage(tag string, img Image) {
+	images := make([]Image, len(c.images))
+	copy(images, c.images)
+	for i := range images {
+		if c.normalizeTag(images[i].Tag) == tag {
+			images[i] = img
+		}
+	}
+
+	c.images = images
+	c.imageByTag[tag] = img
+}
+
+// annotateRolling marks images of rolling tags and sets their build dates.
+func (c *Cache) annotateRolling(images []Image, imgByTag map[string]Image) {
+	for i, img := range images {
+		tag := c.normalizeTag(img.Tag)
+		if !c.IsRolling(tag) {
+			continue
+		}
+
+		img.Rolling = true
+		img.BuildDate = c.buildDate(img)
+
+		images[i] = img
+		imgByTag[tag] = img
+	}
+}
+
+// movedImages returns rolling tags which digests differ from the previous ones.
+// The function should be called under the acquired mu lock.
+func (c *Cache) movedImages(previous map[string]Image, imgByTag map[string]Image) []digestChange {
+	var moved []digestChange
+	for tag := range c.rollingTags {
+		current, found := imgByTag[tag]
+		if !found {
+			continue
+		}
+
+		old, found := previous[tag]
+		if found && old.Digest != current.Digest {
+			moved = append(moved, digestChange{previous: old, current: current})
+		}
+	}
+
+	return moved
+}
+
+func (c *Cache) notifyDigestChanges(moved []digestChange) {
+	for _, change := range moved {
+		metrics.DockerTag.DigestChanged(change.current.Tag)
+		c.logger.Info().
+			Str("tag", change.current.Tag).
+			Str("previous_digest", change.previous.Digest).
+			Str("digest", change.current.Digest).
+			Time("build_date", change.current.BuildDate).
+			Msg("rolling tag has moved to a new digest")
+
+		if c.digestChangeListener != nil {
+			c.digestChangeListener(change.previous, change.current)
+		}
+	}
+}
+
+// buildDate returns the build date of the image. It's zero if it cannot be fetched, and it's retried next time then.
+func (c *Cache) buildDate(img Image) time.Time {
+	c.buildDatesMu.Lock()
+	date, found := c.buildDates[img.Digest]
+	c.buildDatesMu.Unlock()
+	if found {
+		return date
+	}
+
+	cfg, err := c.cli.ImageConfig(c.ctx, img.Repository, img.Digest)
+	if err != nil {
+		c.logger.Warn().Err(err).Str("tag", img.Tag).Str("digest", img.Digest).Msg("build date cannot be fetched")
+		return time.Time{}
+	}
+
+	date = parseBuildDate(cfg)
+
+	c.buildDatesMu.Lock()
+	c.buildDates[img.Digest] = date
+	c.buildDatesMu.Unlock()
+
+	return date
+}
+
+// parseBuildDate reads the build date from the image labels. If there is no such label,
+// the creation time of the image is returned.
+func parseBuildDate(cfg *dockerhub.ImageConfig) time.Time {
+	for _, label := range buildDateLabels {
+		value, found := cfg.Labels[label]
+		if !found {
+			continue
+		}
+
+		date, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			return date.UTC()
+		}
+	}
+
+	return cfg.Created.UTC()
+}
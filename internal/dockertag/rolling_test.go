@@ -0,0 +1,81 @@
+package dockertag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingTags(t *testing.T) {
+	config := Config{
+		Repositories:   []string{"clickhouse/clickhouse-server"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: DefaultExpirationTime,
+		Rolling:        RollingConfig{Tags: []string{"head"}},
+	}
+	tag := func(name, digest string) dockerhub.ImageTag {
+		return dockerhub.ImageTag{
+			Name: name,
+			Images: []dockerhub.Image{
+				{OS: config.OS, Architecture: config.Architecture, Digest: digest, LastPushed: time.Now()},
+			},
+		}
+	}
+	firstBuild := time.Date(2023, 4, 1, 3, 0, 0, 0, time.UTC)
+	secondBuild := time.Date(2023, 4, 2, 3, 0, 0, 0, time.UTC)
+
+	cli := &DockerHubClientMock{
+		images: map[string][]dockerhub.ImageTag{
+			"clickhouse/clickhouse-server": {tag("23.3", "sha256:23.3"), tag("head", "sha256:1")},
+		},
+		configs: map[string]*dockerhub.ImageConfig{
+			"sha256:1": {Created: firstBuild},
+			"sha256:2": {Labels: map[string]string{"org.opencontainers.image.created": secondBuild.Format(time.RFC3339)}},
+			"sha256:3": {Created: secondBuild.Add(24 * time.Hour)},
+		},
+	}
+
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+
+	var moved [][2]string
+	cache.OnDigestChange(func(previous, current Image) {
+		moved = append(moved, [2]string{previous.Digest, current.Digest})
+	})
+
+	cache.asyncUpdate()
+
+	head, found := cache.Find("head")
+	require.True(t, found)
+	assert.True(t, head.Rolling)
+	assert.Equal(t, firstBuild, head.BuildDate)
+
+	release, found := cache.Find("23.3")
+	require.True(t, found)
+	assert.False(t, release.Rolling)
+	assert.True(t, release.BuildDate.IsZero(), "build dates of releases are not fetched")
+
+	// The digest is refreshed without fetching the whole list.
+	cli.images["clickhouse/clickhouse-server"][1] = tag("head", "sha256:2")
+	cache.refreshRolling()
+	assert.Equal(t, [][2]string{{"sha256:1", "sha256:2"}}, moved)
+
+	head, _ = cache.Find("head")
+	assert.Equal(t, "sha256:2", head.Digest)
+	assert.Equal(t, secondBuild, head.BuildDate)
+	assert.Equal(t, "sha256:2", cache.GetAll()[0].Digest)
+
+	cache.refreshRolling()
+	assert.Len(t, moved, 1, "the same digest is not reported twice")
+
+	// The list refresh reports moved digests as well.
+	cli.images["clickhouse/clickhouse-server"][1] = tag("head", "sha256:3")
+	cache.asyncUpdate()
+	assert.Equal(t, [][2]string{{"sha256:1", "sha256:2"}, {"sha256:2", "sha256:3"}}, moved)
+}
@@ -0,0 +1,192 @@
+package dockertag
+
+import (
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+)
+
+// RunBackgroundValidation runs a background task that checks cached tags are still available
+// in the registry. It does nothing if the validation is disabled.
+func (c *Cache) RunBackgroundValidation() {
+	if c.config.Validation.Frequency == 0 {
+		return
+	}
+
+	go c.backgroundValidation()
+}
+
+func (c *Cache) backgroundValidation() {
+	c.logger.Info().Msg("docker tag validation background task has been started")
+
+	t := time.NewTicker(c.config.Validation.Frequency)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.logger.Info().Msg("docker tag validation background task has been finished")
+			return
+
+		case <-t.C:
+		}
+
+		c.validate()
+		c.recordChanges()
+	}
+}
+
+// validate checks the next sample of cached tags and all unavailable ones.
+// Unavailable tags are removed from the cache. If an unavailable tag is found again,
+// the cache is refreshed to reinstate it.
+func (c *Cache) validate() {
+	sample, unavailable := c.validationSample()
+
+	var removed, revived []Image
+	for _, img := range append(sample, unavailable...) {
+		exists, err := c.cli.TagExists(c.ctx, img.Repository, img.Tag)
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			metrics.DockerTag.TagValidated("failed")
+			c.logger.Warn().Err(err).Str("repository", img.Repository).Str("tag", img.Tag).Msg("tag availability cannot be checked")
+
+			continue
+		}
+
+		_, wasUnavailable := c.unavailableImage(img.Tag)
+
+		switch {
+		case exists && wasUnavailable:
+			revived = append(revived, img)
+		case !exists && !wasUnavailable:
+			removed = append(removed, img)
+		}
+
+		if exists {
+			metrics.DockerTag.TagValidated("available")
+		} else {
+			metrics.DockerTag.TagValidated("unavailable")
+		}
+	}
+
+	if len(removed) == 0 && len(revived) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, img := range removed {
+		tag := c.normalizeTag(img.Tag)
+		if cached, found := c.imageByTag[tag]; !found || cached.Digest != img.Digest {
+			// The tag has been updated meanwhile.
+			continue
+		}
+
+		c.unavailable[tag] = img
+
+		metrics.DockerTag.TagRemoved()
+		c.logger.Warn().Str("repository", img.Repository).Str("tag", img.Tag).Msg("tag is not available anymore, it has been removed")
+	}
+
+	for _, img := range revived {
+		delete(c.unavailable, c.normalizeTag(img.Tag))
+
+		metrics.DockerTag.TagReinstated()
+		c.logger.Info().Str("repository", img.Repository).Str("tag", img.Tag).Msg("tag is available again")
+	}
+
+	c.images, c.imageByTag = c.withoutUnavailable(c.images, c.imageByTag)
+
+	// Revived tags are returned by the next refresh.
+	if len(revived) > 0 {
+		c.updatedAt = time.Time{}
+	}
+}
+
+// validationSample returns the next images to validate in rotation and all unavailable images.
+func (c *Cache) validationSample() (sample []Image, unavailable []Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := c.config.Validation.SampleSize
+	if size <= 0 {
+		size = DefaultValidationSampleSize
+	}
+	if size > len(c.images) {
+		size = len(c.images)
+	}
+
+	for i := 0; i < size; i++ {
+		if c.validationCursor >= len(c.images) {
+			c.validationCursor = 0
+		}
+
+		sample = append(sample, c.images[c.validationCursor])
+		c.validationCursor++
+	}
+
+	for _, img := range c.unavailable {
+		unavailable = append(unavailable, img)
+	}
+
+	return sample, unavailable
+}
+
+func (c *Cache) unavailableImage(tag string) (Image, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	img, found := c.unavailable[c.normalizeTag(tag)]
+
+	return img, found
+}
+
+// excludeUnavailable drops unavailable images from the freshly fetched lists. If an unavailable tag
+// has been pushed again (its digest has changed), it's reinstated.
+// The function should be called under the acquired mu lock.
+func (c *Cache) excludeUnavailable(images []Image, imgByTag map[string]Image) ([]Image, map[string]Image) {
+	if len(c.unavailable) == 0 {
+		return images, imgByTag
+	}
+
+	for tag, dead := range c.unavailable {
+		img, found := imgByTag[tag]
+		if !found {
+			// The tag is not listed anymore, there is nothing to hide.
+			delete(c.unavailable, tag)
+			continue
+		}
+
+		if img.Digest != dead.Digest {
+			delete(c.unavailable, tag)
+
+			metrics.DockerTag.TagReinstated()
+			c.logger.Info().Str("repository", img.Repository).Str("tag", img.Tag).Msg("tag has been pushed again, it has been reinstated")
+		}
+	}
+
+	return c.withoutUnavailable(images, imgByTag)
+}
+
+// withoutUnavailable returns copies of the lists without unavailable images.
+// The function should be called under the acquired mu lock.
+func (c *Cache) withoutUnavailable(images []Image, imgByTag map[string]Image) ([]Image, map[string]Image) {
+	filteredByTag := make(map[string]Image, len(imgByTag))
+	for tag, img := range imgByTag {
+		if _, dead := c.unavailable[tag]; !dead {
+			filteredByTag[tag] = img
+		}
+	}
+
+	filtered := make([]Image, 0, len(images))
+	for _, img := range images {
+		if _, dead := c.unavailable[c.normalizeTag(img.Tag)]; !dead {
+			filtered = append(filtered, img)
+		}
+	}
+
+	return filtered, filteredByTag
+}
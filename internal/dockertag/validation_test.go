@@ -0,0 +1,99 @@
+package dockertag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func imageTag(name, digest string) dockerhub.ImageTag {
+	return dockerhub.ImageTag{
+		Name: name,
+		Images: []dockerhub.Image{
+			{OS: "linux", Architecture: "amd64", Digest: digest},
+		},
+	}
+}
+
+func tagNames(images []Image) []string {
+	names := make([]string, 0, len(images))
+	for _, img := range images {
+		names = append(names, img.Tag)
+	}
+
+	return names
+}
+
+func TestValidate(t *testing.T) {
+	cli := &DockerHubClientMock{
+		images: map[string][]dockerhub.ImageTag{
+			"a/clickhouse": {imageTag("22.3", "d1"), imageTag("21.8", "d2"), imageTag("21.3", "d3")},
+		},
+		missingTags: map[string]bool{},
+	}
+	config := Config{
+		Repositories:   []string{"a/clickhouse"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: time.Hour,
+		Validation:     ValidationConfig{Frequency: time.Minute, SampleSize: 2},
+	}
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"22.3", "21.8", "21.3"}, tagNames(cache.GetAll()))
+
+	// 21.3 is not in the first sample.
+	cli.missingTags["21.3"] = true
+	cache.validate()
+	assert.Equal(t, []string{"22.3", "21.8", "21.3"}, tagNames(cache.GetAll()))
+
+	cache.validate()
+	assert.Equal(t, []string{"22.3", "21.8"}, tagNames(cache.GetAll()))
+	assert.False(t, cache.Exists("21.3"))
+
+	// The tag is still listed with the same digest, so it stays hidden after a refresh.
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"22.3", "21.8"}, tagNames(cache.GetAll()))
+
+	// Another cycle does not forget unavailable tags.
+	cache.validate()
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"22.3", "21.8"}, tagNames(cache.GetAll()))
+
+	// The tag is available again, it's reinstated by the next refresh.
+	delete(cli.missingTags, "21.3")
+	cache.validate()
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"22.3", "21.8", "21.3"}, tagNames(cache.GetAll()))
+}
+
+func TestValidateReinstatesPushedTag(t *testing.T) {
+	cli := &DockerHubClientMock{
+		images: map[string][]dockerhub.ImageTag{
+			"a/clickhouse": {imageTag("22.3", "d1"), imageTag("21.8", "d2")},
+		},
+		missingTags: map[string]bool{"21.8": true},
+	}
+	config := Config{
+		Repositories:   []string{"a/clickhouse"},
+		OS:             "linux",
+		Architecture:   "amd64",
+		ExpirationTime: time.Hour,
+		Validation:     ValidationConfig{Frequency: time.Minute, SampleSize: 10},
+	}
+	cache := NewCache(context.Background(), config, zlog.Logger, cli)
+	cache.asyncUpdate()
+
+	cache.validate()
+	assert.Equal(t, []string{"22.3"}, tagNames(cache.GetAll()))
+
+	// The tag has been pushed again with another digest.
+	cli.images["a/clickhouse"][1] = imageTag("21.8", "d3")
+	cache.asyncUpdate()
+	assert.Equal(t, []string{"22.3", "21.8"}, tagNames(cache.GetAll()))
+}
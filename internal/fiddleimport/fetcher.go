@@ -0,0 +1,212 @@
+package fiddleimport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultMaxSizeBytes = 64 * 1024
+	DefaultTimeout      = 10 * time.Second
+	DefaultMaxRedirects = 3
+)
+
+var (
+	ErrInvalidURL     = errors.New("invalid url")
+	ErrHostNotAllowed = errors.New("host is not allowed")
+	ErrNotPublic      = errors.New("address is not public")
+	ErrTooLarge       = errors.New("content is too large")
+	ErrBadContent     = errors.New("content is not text")
+)
+
+// Config describes where fiddles can be imported from.
+type Config struct {
+	// AllowedHosts are hosts that can serve imported content. An entry with the leading dot matches subdomains.
+	AllowedHosts []string
+
+	MaxSizeBytes int64
+	Timeout      time.Duration
+	MaxRedirects int
+}
+
+func (c *Config) Validate() error {
+	if len(c.AllowedHosts) == 0 {
+		return errors.New("allowed_hosts must be non-empty")
+	}
+	for _, host := range c.AllowedHosts {
+		err := validateHost(host)
+		if err != nil {
+			return errors.Wrap(err, "invalid allowed_hosts")
+		}
+	}
+
+	if c.MaxSizeBytes <= 0 {
+		return errors.New("max_size_bytes must be > 0")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be > 0")
+	}
+	if c.MaxRedirects < 0 {
+		return errors.New("max_redirects must be >= 0")
+	}
+
+	return nil
+}
+
+// StatusError is returned if the remote host responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d", e.StatusCode)
+}
+
+// Fetcher downloads content of shared snippets, e.g. raw gists.
+// Only allowlisted hosts resolved to public addresses are contacted, redirects included.
+type Fetcher struct {
+	cfg Config
+	cli *http.Client
+}
+
+func NewFetcher(cfg Config) (*Fetcher, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: dialControl,
+	}
+
+	f := &Fetcher{cfg: cfg}
+	f.cli = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &instrumentedTransport{
+			next: &http.Transport{
+				// Proxies from the environment are not used, they would connect to the target instead of the dialer.
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				ForceAttemptHTTP2:     true,
+				TLSHandshakeTimeout:   cfg.Timeout,
+				ResponseHeaderTimeout: cfg.Timeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		CheckRedirect: f.checkRedirect,
+	}
+
+	return f, nil
+}
+
+// Fetch downloads the content of the URL. It must be UTF-8 text no longer than the configured size.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (string, error) {
+	u, err := f.checkURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidURL, err.Error())
+	}
+	req.Header.Set("Accept", "text/plain, */*;q=0.5")
+
+	resp, err := f.cli.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	if resp.ContentLength > f.cfg.MaxSizeBytes {
+		return "", errors.Wrapf(ErrTooLarge, "%d bytes, at most %d are allowed", resp.ContentLength, f.cfg.MaxSizeBytes)
+	}
+
+	// One byte more is read to tell whether the content exceeds the limit.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxSizeBytes+1))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read response")
+	}
+	if int64(len(body)) > f.cfg.MaxSizeBytes {
+		return "", errors.Wrapf(ErrTooLarge, "at most %d bytes are allowed", f.cfg.MaxSizeBytes)
+	}
+
+	if !utf8.Valid(body) {
+		return "", errors.Wrap(ErrBadContent, "invalid utf-8")
+	}
+
+	return string(body), nil
+}
+
+// checkURL verifies the scheme and the host of the URL before it's requested.
+func (f *Fetcher) checkURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidURL, err.Error())
+	}
+
+	if u.Scheme != "https" {
+		return nil, errors.Wrap(ErrInvalidURL, "only https urls are supported")
+	}
+	if u.User != nil {
+		return nil, errors.Wrap(ErrInvalidURL, "credentials are not allowed")
+	}
+	if u.Port() != "" && u.Port() != "443" {
+		return nil, errors.Wrap(ErrInvalidURL, "only the default port is allowed")
+	}
+
+	if !hostAllowed(f.cfg.AllowedHosts, u.Hostname()) {
+		return nil, errors.Wrapf(ErrHostNotAllowed, "%s", u.Hostname())
+	}
+
+	return u, nil
+}
+
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.cfg.MaxRedirects {
+		return errors.Errorf("stopped after %d redirects", f.cfg.MaxRedirects)
+	}
+
+	_, err := f.checkURL(req.URL.String())
+	if err != nil {
+		return errors.Wrap(err, "redirect rejected")
+	}
+
+	return nil
+}
+
+// instrumentedTransport exports metrics of every outbound request, redirects included.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.FiddleImport.OutboundRequest(req.URL.Hostname(), status, time.Since(start))
+
+	return resp, err
+}
@@ -0,0 +1,95 @@
+package fiddleimport
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// nonPublicPrefixes are special-purpose ranges that are not covered by the net.IP classification methods.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// isPublicAddr reports whether the address is routable in the internet.
+// IPv4-mapped IPv6 addresses are checked as IPv4 ones.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialControl rejects connections to non-public addresses. It's called with the resolved address right before
+// connecting, so the check cannot be bypassed by DNS records that change between the resolution and the connection.
+func dialControl(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return errors.Wrap(err, "invalid address")
+	}
+
+	if !isPublicAddr(addrPort.Addr()) {
+		return errors.Wrapf(ErrNotPublic, "%s", addrPort.Addr())
+	}
+
+	return nil
+}
+
+// hostAllowed reports whether the host matches the allowlist. An entry with the leading dot matches subdomains.
+func hostAllowed(allowlist []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, allowed := range allowlist {
+		if strings.HasPrefix(allowed, ".") {
+			if strings.HasSuffix(host, allowed) {
+				return true
+			}
+
+			continue
+		}
+
+		if host == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateHost verifies an allowlist entry: it must be a hostname optionally starting with a dot.
+func validateHost(host string) error {
+	name := strings.TrimPrefix(host, ".")
+	if name == "" || strings.ContainsAny(name, ":/*@ ") || strings.HasPrefix(name, ".") {
+		return errors.Errorf("'%s' is not a hostname", host)
+	}
+	if host != strings.ToLower(host) {
+		return errors.Errorf("'%s' must be lowercase", host)
+	}
+	if net.ParseIP(name) != nil {
+		return errors.Errorf("'%s' is an IP address, hostnames are required", host)
+	}
+
+	return nil
+}
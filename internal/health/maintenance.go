@@ -0,0 +1,211 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultMaintenanceMessage is reported while runners are down if operators have not set their own message.
+const DefaultMaintenanceMessage = "queries cannot be run right now, cached results are still served"
+
+// MaintenanceConfig configures the maintenance mode.
+type MaintenanceConfig struct {
+	// Dependency is the name of the check that enters the mode while it's failing.
+	// If it's empty, the mode is entered by operators only.
+	Dependency string
+
+	// Interval is the period of polling the verdict on the dependency.
+	Interval time.Duration
+
+	// Message is reported while the mode is entered automatically.
+	// If it's empty, DefaultMaintenanceMessage is used.
+	Message string
+}
+
+// MaintenanceState is the current state of the maintenance mode.
+type MaintenanceState struct {
+	Active bool
+
+	// Forced is true if operators have entered the mode. Otherwise, it's entered because the dependency is failing.
+	Forced bool
+
+	Since   time.Time
+	Message string
+
+	// EstimatedRecovery is set by operators. It's nil if it's unknown.
+	EstimatedRecovery *time.Time
+
+	// Revision grows with every change of the state.
+	Revision uint64
+}
+
+// Maintenance tells whether runs cannot be executed, so the service only serves stored and cached results.
+// The mode is entered when the dependency is failing or when operators force it, and it's left once
+// the dependency has recovered and the mode is not forced.
+type Maintenance struct {
+	cfg    MaintenanceConfig
+	logger zerolog.Logger
+
+	// result returns the cached verdict on the dependency.
+	result func(name string) (Result, bool)
+
+	mu       sync.RWMutex
+	state    MaintenanceState
+	forced   bool
+	failing  bool
+	message  string
+	recovery *time.Time
+}
+
+func NewMaintenance(logger zerolog.Logger, manager *Manager, cfg MaintenanceConfig) *Maintenance {
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Message == "" {
+		cfg.Message = DefaultMaintenanceMessage
+	}
+
+	m := &Maintenance{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "maintenance").Logger(),
+		result: manager.Result,
+	}
+	metrics.Maintenance.Active(false)
+
+	return m
+}
+
+// Start polls the verdict on the dependency in the background until the context is done.
+func (m *Maintenance) Start(ctx context.Context) {
+	if m.cfg.Dependency == "" {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(m.cfg.Interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-t.C:
+			}
+
+			m.poll()
+		}
+	}()
+}
+
+// poll follows the verdict on the dependency. Unknown verdicts do not change the mode,
+// so it's not entered before the first check is finished.
+func (m *Maintenance) poll() {
+	res, ok := m.result(m.cfg.Dependency)
+	if !ok || res.Status == StatusUnknown {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.failing = res.Status == StatusFailing
+	m.update()
+}
+
+// State returns the current state of the mode.
+func (m *Maintenance) State() MaintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state := m.state
+	if state.EstimatedRecovery != nil {
+		recovery := *state.EstimatedRecovery
+		state.EstimatedRecovery = &recovery
+	}
+
+	return state
+}
+
+// Force enters the mode regardless of the dependency. The message and the estimated recovery are optional.
+// Forcing the mode again replaces them.
+func (m *Maintenance) Force(message string, recovery *time.Time) MaintenanceState {
+	m.mu.Lock()
+	m.forced = true
+	m.message = message
+	m.recovery = recovery
+	m.update()
+	m.mu.Unlock()
+
+	return m.State()
+}
+
+// Clear stops forcing the mode. It stays active while the dependency is failing.
+func (m *Maintenance) Clear() MaintenanceState {
+	m.mu.Lock()
+	m.forced = false
+	m.message = ""
+	m.recovery = nil
+	m.update()
+	m.mu.Unlock()
+
+	return m.State()
+}
+
+// update derives the state, logs and exports transitions. It must be called under the acquired mu lock.
+func (m *Maintenance) update() {
+	next := MaintenanceState{
+		Active:            m.forced || m.failing,
+		Forced:            m.forced,
+		Since:             m.state.Since,
+		EstimatedRecovery: m.recovery,
+		Revision:          m.state.Revision,
+	}
+	if next.Active {
+		next.Message = m.message
+		if next.Message == "" {
+			next.Message = m.cfg.Message
+		}
+	} else {
+		next.EstimatedRecovery = nil
+	}
+
+	prev := m.state
+	if next.Active == prev.Active && next.Forced == prev.Forced && next.Message == prev.Message &&
+		sameTime(next.EstimatedRecovery, prev.EstimatedRecovery) {
+		return
+	}
+
+	if next.Active != prev.Active {
+		next.Since = time.Now()
+
+		// The trigger of leaving the mode is the one it has been entered by.
+		trigger := "automatic"
+		if next.Forced || prev.Forced {
+			trigger = "forced"
+		}
+		if next.Active {
+			m.logger.Warn().Str("trigger", trigger).Str("message", next.Message).Msg("maintenance mode has been entered")
+		} else {
+			m.logger.Info().Str("trigger", trigger).Msg("maintenance mode has been left")
+		}
+
+		metrics.Maintenance.Transitioned(next.Active, trigger)
+	}
+
+	next.Revision++
+	m.state = next
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	manager := NewManager(zerolog.Nop(), Config{Interval: time.Hour, Timeout: time.Second})
+
+	var runnersErr error
+	manager.Register("runners", CriticalityCritical, func(context.Context) error { return runnersErr })
+
+	m := NewMaintenance(zerolog.Nop(), manager, MaintenanceConfig{Dependency: "runners"})
+	check := func() {
+		for _, c := range manager.checks {
+			manager.run(context.Background(), c)
+		}
+		m.poll()
+	}
+
+	m.poll()
+	assert.False(t, m.State().Active, "the mode must not be entered before the first check")
+
+	runnersErr = errors.New("no runner is alive")
+	check()
+	state := m.State()
+	assert.True(t, state.Active)
+	assert.False(t, state.Forced)
+	assert.Equal(t, DefaultMaintenanceMessage, state.Message)
+	assert.Nil(t, state.EstimatedRecovery)
+	revision := state.Revision
+
+	check()
+	assert.Equal(t, revision, m.State().Revision, "the state must not change while runners are down")
+
+	recovery := time.Now().Add(time.Hour)
+	state = m.Force("upgrade", &recovery)
+	assert.True(t, state.Active)
+	assert.True(t, state.Forced)
+	assert.Equal(t, "upgrade", state.Message)
+	require.NotNil(t, state.EstimatedRecovery)
+	assert.Greater(t, state.Revision, revision)
+
+	runnersErr = nil
+	check()
+	assert.True(t, m.State().Active, "the forced mode must stay active after runners have recovered")
+
+	state = m.Clear()
+	assert.False(t, state.Active)
+	assert.False(t, state.Forced)
+	assert.Empty(t, state.Message)
+	assert.Nil(t, state.EstimatedRecovery)
+}
+
+func TestMaintenance_ClearWhileFailing(t *testing.T) {
+	manager := NewManager(zerolog.Nop(), Config{Interval: time.Hour, Timeout: time.Second})
+	manager.Register("runners", CriticalityCritical, func(context.Context) error { return errors.New("no runner is alive") })
+	for _, c := range manager.checks {
+		manager.run(context.Background(), c)
+	}
+
+	m := NewMaintenance(zerolog.Nop(), manager, MaintenanceConfig{Dependency: "runners", Message: "runners are down"})
+	m.Force("upgrade", nil)
+	m.poll()
+
+	state := m.Clear()
+	assert.True(t, state.Active, "the mode must stay active while runners are down")
+	assert.False(t, state.Forced)
+	assert.Equal(t, "runners are down", state.Message)
+}
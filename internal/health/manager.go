@@ -0,0 +1,244 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultInterval = 15 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+// Criticality tells how a failing dependency affects the overall status.
+type Criticality string
+
+const (
+	// CriticalityCritical dependencies make the service unhealthy when they fail.
+	CriticalityCritical Criticality = "critical"
+	// CriticalityDegraded dependencies make the service degraded, but it still serves requests.
+	CriticalityDegraded Criticality = "degraded"
+)
+
+// Status is a verdict on a dependency or on the whole service.
+type Status string
+
+const (
+	StatusOK        Status = "ok"
+	StatusDegraded  Status = "degraded"
+	StatusUnhealthy Status = "unhealthy"
+
+	// StatusFailing and StatusUnknown are verdicts on dependencies only.
+	// A dependency is unknown until its first check is finished.
+	StatusFailing Status = "failing"
+	StatusUnknown Status = "unknown"
+)
+
+// Probe checks a dependency. It must honor the context deadline.
+type Probe func(ctx context.Context) error
+
+type Config struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Result is the latest verdict on a dependency.
+type Result struct {
+	Name        string
+	Criticality Criticality
+	Status      Status
+
+	// Latency is the duration of the latest check.
+	Latency   time.Duration
+	CheckedAt time.Time
+
+	// LastError is the error of the latest failed check. It's kept after the dependency recovers.
+	LastError   string
+	LastSuccess *time.Time
+}
+
+// Report is the verdict on the service and its dependencies.
+type Report struct {
+	Status       Status
+	Dependencies []Result
+}
+
+type check struct {
+	name        string
+	criticality Criticality
+	probe       Probe
+}
+
+// Manager checks dependencies on its own schedule and caches the results, so health requests stay cheap.
+type Manager struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	checks []check
+
+	mu      sync.RWMutex
+	results map[string]Result
+
+	workers sync.WaitGroup
+}
+
+func NewManager(logger zerolog.Logger, cfg Config) *Manager {
+	return &Manager{
+		cfg:     cfg,
+		logger:  logger.With().Str("component", "health").Logger(),
+		results: make(map[string]Result),
+	}
+}
+
+// Register adds the dependency check. It must be called before Start.
+func (m *Manager) Register(name string, criticality Criticality, probe Probe) {
+	m.checks = append(m.checks, check{name: name, criticality: criticality, probe: probe})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.results[name] = Result{Name: name, Criticality: criticality, Status: StatusUnknown}
+}
+
+// Start runs the checks in the background until the context is done.
+func (m *Manager) Start(ctx context.Context) {
+	for _, c := range m.checks {
+		m.workers.Add(1)
+		go m.loop(ctx, c)
+	}
+}
+
+// Wait blocks until the background checks are stopped.
+func (m *Manager) Wait() {
+	m.workers.Wait()
+}
+
+func (m *Manager) loop(ctx context.Context, c check) {
+	defer m.workers.Done()
+
+	m.run(ctx, c)
+
+	t := time.NewTicker(m.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-t.C:
+		}
+
+		m.run(ctx, c)
+	}
+}
+
+func (m *Manager) run(ctx context.Context, c check) {
+	withTimeout, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+
+	startedAt := time.Now()
+	err := c.probe(withTimeout)
+	checkedAt := time.Now()
+
+	// Checks interrupted by the shutdown say nothing about the dependency.
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := m.results[c.name]
+	res.Latency = checkedAt.Sub(startedAt)
+	res.CheckedAt = checkedAt
+
+	if err != nil {
+		if res.Status != StatusFailing {
+			m.logger.Warn().Err(err).Str("dependency", c.name).Msg("dependency check has failed")
+		}
+
+		res.Status = StatusFailing
+		res.LastError = err.Error()
+	} else {
+		if res.Status == StatusFailing {
+			m.logger.Info().Str("dependency", c.name).Msg("dependency has recovered")
+		}
+
+		res.Status = StatusOK
+		res.LastSuccess = &checkedAt
+	}
+
+	m.results[c.name] = res
+}
+
+// Report returns the cached verdicts sorted by the dependency name.
+func (m *Manager) Report() Report {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	report := Report{
+		Status:       StatusOK,
+		Dependencies: make([]Result, 0, len(m.results)),
+	}
+	for _, res := range m.results {
+		report.Dependencies = append(report.Dependencies, res)
+	}
+	sort.Slice(report.Dependencies, func(i, j int) bool {
+		return report.Dependencies[i].Name < report.Dependencies[j].Name
+	})
+
+	report.Status = overallStatus(report.Dependencies)
+
+	return report
+}
+
+// overallStatus derives the service verdict from dependencies: a failing critical dependency makes it unhealthy,
+// other failing dependencies make it degraded. Unknown dependencies are treated as failing ones.
+func overallStatus(results []Result) Status {
+	status := StatusOK
+	for _, res := range results {
+		if res.Status == StatusOK {
+			continue
+		}
+
+		if res.Criticality == CriticalityCritical {
+			return StatusUnhealthy
+		}
+
+		status = StatusDegraded
+	}
+
+	return status
+}
+
+// MaxAge returns a probe that fails if the data has not been updated for longer than maxAge.
+func MaxAge(updatedAt func() time.Time, maxAge time.Duration) Probe {
+	return func(context.Context) error {
+		last := updatedAt()
+		if last.IsZero() {
+			return errors.New("has never been updated")
+		}
+
+		if age := time.Since(last); age > maxAge {
+			return errors.Errorf("has not been updated for %s (max age: %s)", age.Round(time.Second), maxAge)
+		}
+
+		return nil
+	}
+}
+
+// Result returns the cached verdict on the dependency. It returns false if the dependency is not registered.
+func (m *Manager) Result(name string) (Result, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res, ok := m.results[name]
+
+	return res, ok
+}
@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerReport(t *testing.T) {
+	m := NewManager(zerolog.Nop(), Config{Interval: time.Hour, Timeout: time.Second})
+
+	storageErr := errors.New("connection refused")
+	m.Register("storage", CriticalityDegraded, func(context.Context) error { return storageErr })
+	m.Register("runners", CriticalityCritical, func(context.Context) error { return nil })
+
+	report := m.Report()
+	assert.Equal(t, StatusUnhealthy, report.Status, "unknown dependencies must be treated as failing")
+
+	for _, c := range m.checks {
+		m.run(context.Background(), c)
+	}
+
+	report = m.Report()
+	assert.Equal(t, StatusDegraded, report.Status)
+	require.Len(t, report.Dependencies, 2)
+
+	runners, storage := report.Dependencies[0], report.Dependencies[1]
+	assert.Equal(t, "runners", runners.Name)
+	assert.Equal(t, StatusOK, runners.Status)
+	assert.NotNil(t, runners.LastSuccess)
+
+	assert.Equal(t, "storage", storage.Name)
+	assert.Equal(t, StatusFailing, storage.Status)
+	assert.Equal(t, "connection refused", storage.LastError)
+	assert.Nil(t, storage.LastSuccess)
+
+	// The last error is kept after the recovery.
+	storageErr = nil
+	m.run(context.Background(), m.checks[0])
+
+	report = m.Report()
+	assert.Equal(t, StatusOK, report.Status)
+	assert.Equal(t, "connection refused", report.Dependencies[1].LastError)
+	assert.NotNil(t, report.Dependencies[1].LastSuccess)
+}
+
+func TestOverallStatus(t *testing.T) {
+	assert.Equal(t, StatusOK, overallStatus(nil))
+	assert.Equal(t, StatusUnhealthy, overallStatus([]Result{
+		{Criticality: CriticalityDegraded, Status: StatusFailing},
+		{Criticality: CriticalityCritical, Status: StatusFailing},
+	}))
+	assert.Equal(t, StatusDegraded, overallStatus([]Result{
+		{Criticality: CriticalityDegraded, Status: StatusUnknown},
+		{Criticality: CriticalityCritical, Status: StatusOK},
+	}))
+}
+
+func TestMaxAge(t *testing.T) {
+	var updatedAt time.Time
+	probe := MaxAge(func() time.Time { return updatedAt }, time.Minute)
+
+	assert.Error(t, probe(context.Background()))
+
+	updatedAt = time.Now().Add(-time.Second)
+	assert.NoError(t, probe(context.Background()))
+
+	updatedAt = time.Now().Add(-2 * time.Minute)
+	assert.Error(t, probe(context.Background()))
+}
@@ -0,0 +1,99 @@
+package health
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultReadinessTimeout = 2 * time.Second
+
+// Readiness checks the dependencies the service cannot serve requests without. Unlike Manager, it probes them
+// on every call, so an instance is not considered ready until its dependencies respond.
+type Readiness struct {
+	timeout time.Duration
+	checks  []check
+}
+
+func NewReadiness(timeout time.Duration) *Readiness {
+	return &Readiness{timeout: timeout}
+}
+
+// Register adds the dependency check. It must be called before Check.
+func (r *Readiness) Register(name string, probe Probe) {
+	r.checks = append(r.checks, check{name: name, criticality: CriticalityCritical, probe: probe})
+}
+
+// Check runs the probes concurrently and returns their verdicts in the order of registration.
+// It returns within the timeout even if a probe ignores the context, such a probe is reported as failing.
+func (r *Readiness) Check(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	type verdict struct {
+		idx     int
+		err     error
+		latency time.Duration
+	}
+
+	// The channel is buffered, so probes that outlive the check don't block.
+	verdicts := make(chan verdict, len(r.checks))
+	startedAt := time.Now()
+	for i, c := range r.checks {
+		i, c := i, c
+		go func() {
+			err := c.probe(ctx)
+			verdicts <- verdict{idx: i, err: err, latency: time.Since(startedAt)}
+		}()
+	}
+
+	results := make([]Result, len(r.checks))
+	for i, c := range r.checks {
+		results[i] = Result{
+			Name:        c.name,
+			Criticality: c.criticality,
+			Status:      StatusFailing,
+			Latency:     r.timeout,
+			LastError:   errors.Wrap(context.DeadlineExceeded, "check has not finished in time").Error(),
+		}
+	}
+
+wait:
+	for pending := len(r.checks); pending > 0; pending-- {
+		select {
+		case v := <-verdicts:
+			res := &results[v.idx]
+			res.Latency = v.latency
+			res.CheckedAt = startedAt.Add(v.latency)
+			if v.err != nil {
+				res.LastError = v.err.Error()
+				continue
+			}
+
+			checkedAt := res.CheckedAt
+			res.Status = StatusOK
+			res.LastError = ""
+			res.LastSuccess = &checkedAt
+
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	return Report{
+		Status:       overallStatus(results),
+		Dependencies: results,
+	}
+}
+
+// Loaded returns a probe that fails until the data has been updated at least once.
+func Loaded(updatedAt func() time.Time) Probe {
+	return func(context.Context) error {
+		if updatedAt().IsZero() {
+			return errors.New("has never been updated")
+		}
+
+		return nil
+	}
+}
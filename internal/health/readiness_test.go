@@ -0,0 +1,53 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	r := NewReadiness(50 * time.Millisecond)
+
+	var loadedAt time.Time
+	r.Register("dockertag", Loaded(func() time.Time { return loadedAt }))
+	r.Register("runners", func(context.Context) error { return nil })
+
+	report := r.Check(context.Background())
+	assert.Equal(t, StatusUnhealthy, report.Status)
+	require.Len(t, report.Dependencies, 2)
+	assert.Equal(t, StatusFailing, report.Dependencies[0].Status)
+	assert.Equal(t, "has never been updated", report.Dependencies[0].LastError)
+	assert.Equal(t, StatusOK, report.Dependencies[1].Status)
+	assert.NotNil(t, report.Dependencies[1].LastSuccess)
+
+	loadedAt = time.Now()
+	report = r.Check(context.Background())
+	assert.Equal(t, StatusOK, report.Status)
+}
+
+func TestReadiness_HungProbe(t *testing.T) {
+	r := NewReadiness(50 * time.Millisecond)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	r.Register("runners", func(context.Context) error {
+		// The probe ignores the context like a hung Docker client.
+		<-release
+		return errors.New("released")
+	})
+
+	startedAt := time.Now()
+	report := r.Check(context.Background())
+	assert.Less(t, time.Since(startedAt), time.Second)
+
+	assert.Equal(t, StatusUnhealthy, report.Status)
+	require.Len(t, report.Dependencies, 1)
+	assert.Equal(t, StatusFailing, report.Dependencies[0].Status)
+	assert.Contains(t, report.Dependencies[0].LastError, "has not finished in time")
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Balancer = BalancerExporter{
+	selections: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coordinator",
+			Name:      "runner_selections_total",
+			Help:      "How many runs were dispatched to the runner by the reason of the selection.",
+		},
+		[]string{"runner", "reason"},
+	),
+	inFlight: factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "coordinator",
+			Name:      "runner_inflight_runs",
+			Help:      "How many dispatched runs the runner is executing.",
+		},
+		[]string{"runner"},
+	),
+	retries: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coordinator",
+			Name:      "run_retries_total",
+			Help:      "How many runs failed by the Docker daemon were retried on another runner, or surfaced the error if there was none.",
+		},
+		[]string{"result"},
+	),
+}
+
+type BalancerExporter struct {
+	selections *prometheus.CounterVec
+	inFlight   *prometheus.GaugeVec
+	retries    *prometheus.CounterVec
+}
+
+// Selected counts a run dispatched to the runner and returns the gauge of its in-flight runs.
+func (e *BalancerExporter) Selected(runner string, reason string) prometheus.Gauge {
+	e.selections.With(prometheus.Labels{"runner": runner, "reason": reason}).Inc()
+	return e.inFlight.With(prometheus.Labels{"runner": runner})
+}
+
+// Retried counts a run retried on another runner.
+func (e *BalancerExporter) Retried() {
+	e.retries.With(prometheus.Labels{"result": "retried"}).Inc()
+}
+
+// RetrySurfaced counts a failed run that no other runner could take.
+func (e *BalancerExporter) RetrySurfaced() {
+	e.retries.With(prometheus.Labels{"result": "surfaced"}).Inc()
+}
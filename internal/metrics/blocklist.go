@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var BlockList = BlockListExporter{
+	blocked: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "http",
+			Name:      "blocked_requests_total",
+			Help:      "How many requests of blocked clients have been rejected, by the kind of the matched entry.",
+		},
+		[]string{"kind"},
+	),
+}
+
+type BlockListExporter struct {
+	blocked *prometheus.CounterVec
+}
+
+// Blocked counts a rejected request of a blocked client.
+func (e *BlockListExporter) Blocked(kind string) {
+	e.blocked.With(prometheus.Labels{"kind": kind}).Inc()
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var CircuitBreaker = CircuitBreakerExporter{
+	state: factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "coordinator",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker of a dependency: 0 is closed, 1 is half-open, 2 is open.",
+		},
+		[]string{"dependency", "runner"},
+	),
+	transitions: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coordinator",
+			Name:      "circuit_breaker_transitions_total",
+			Help:      "How many times the circuit breaker of a dependency has changed its state.",
+		},
+		[]string{"dependency", "runner", "state"},
+	),
+	rejected: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coordinator",
+			Name:      "circuit_breaker_rejected_runs_total",
+			Help:      "How many runs have been rejected because the circuit of a dependency is open.",
+		},
+		[]string{"dependency", "runner"},
+	),
+}
+
+type CircuitBreakerExporter struct {
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+	rejected    *prometheus.CounterVec
+}
+
+var circuitStateValues = map[string]float64{
+	"closed":    0,
+	"half_open": 1,
+	"open":      2,
+}
+
+// Transitioned exports the new state of the circuit breaker. The runner is empty for circuits shared by runners.
+func (e *CircuitBreakerExporter) Transitioned(dependency, runner, state string) {
+	e.state.With(prometheus.Labels{"dependency": dependency, "runner": runner}).Set(circuitStateValues[state])
+	e.transitions.With(prometheus.Labels{"dependency": dependency, "runner": runner, "state": state}).Inc()
+}
+
+// Rejected counts a run rejected by the open circuit.
+func (e *CircuitBreakerExporter) Rejected(dependency, runner string) {
+	e.rejected.With(prometheus.Labels{"dependency": dependency, "runner": runner}).Inc()
+}
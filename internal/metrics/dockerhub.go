@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var DockerHub = DockerHubExporter{
+	responses: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dockerhub",
+			Name:      "responses_total",
+			Help:      "How many requests were sent to Docker Hub and the registry, by endpoint and status class.",
+		},
+		[]string{"endpoint", "status"},
+	),
+	duration: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dockerhub",
+			Name:      "request_duration_seconds",
+			Help:      "How long it took to receive response headers from Docker Hub and the registry.",
+			Buckets:   defaultPipelineBuckets,
+		},
+		[]string{"endpoint"},
+	),
+	throttled: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dockerhub",
+			Name:      "throttled_requests_total",
+			Help:      "How many Docker Hub API requests were throttled, by the action taken: retried, given_up or rejected.",
+		},
+		[]string{"action"},
+	),
+	inflight: factory.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dockerhub",
+			Name:      "inflight_requests",
+			Help:      "How many requests to Docker Hub and the registry are awaiting response headers.",
+		},
+	),
+}
+
+type DockerHubExporter struct {
+	responses *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+	throttled *prometheus.CounterVec
+	inflight  prometheus.Gauge
+}
+
+// RequestStarted must be followed by RequestFinished.
+func (e *DockerHubExporter) RequestStarted() {
+	e.inflight.Inc()
+}
+
+// RequestFinished records a request. Endpoint is one of "auth", "tags_page", "tag", "manifest", "blob", "other".
+// Status is the status class ("2xx", "4xx", etc.) or "error" if no response has been received.
+func (e *DockerHubExporter) RequestFinished(endpoint string, status string, duration time.Duration) {
+	e.inflight.Dec()
+	e.responses.With(prometheus.Labels{"endpoint": endpoint, "status": status}).Inc()
+	e.duration.With(prometheus.Labels{"endpoint": endpoint}).Observe(duration.Seconds())
+}
+
+// Throttled counts a request answered with 429. Action is "retried", "given_up" if the retries are exhausted,
+// or "rejected" if the request has not been sent because the client is throttled.
+func (e *DockerHubExporter) Throttled(action string) {
+	e.throttled.With(prometheus.Labels{"action": action}).Inc()
+}
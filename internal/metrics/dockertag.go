@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var DockerTag = DockerTagExporter{
+	validations: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dockertag",
+			Name:      "validations_total",
+			Help:      "How many cached tags were checked for availability.",
+		},
+		[]string{"status"},
+	),
+	availabilityChanges: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dockertag",
+			Name:      "availability_changes_total",
+			Help:      "How many tags were marked unavailable or reinstated.",
+		},
+		[]string{"action"},
+	),
+	refreshes: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dockertag",
+			Name:      "refresh_duration_seconds",
+			Help:      "How long it took to fetch tags of all repositories. See dockerhub_* metrics for its requests.",
+			Buckets:   defaultPipelineBuckets,
+		},
+		[]string{"status"},
+	),
+	snapshotAge: factory.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dockertag",
+			Name:      "snapshot_age_seconds",
+			Help:      "Age of the served tag list as of the latest refresh. It grows while refreshes fail, e.g. Docker Hub is throttling.",
+		},
+	),
+	digestChanges: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dockertag",
+			Name:      "rolling_digest_changes_total",
+			Help:      "How many times rolling tags (e.g. head) have moved to a new digest.",
+		},
+		[]string{"tag"},
+	),
+}
+
+type DockerTagExporter struct {
+	validations         *prometheus.CounterVec
+	availabilityChanges *prometheus.CounterVec
+	refreshes           *prometheus.HistogramVec
+	snapshotAge         prometheus.Gauge
+	digestChanges       *prometheus.CounterVec
+}
+
+// TagValidated counts an availability check. Status is one of "available", "unavailable", "failed".
+func (e *DockerTagExporter) TagValidated(status string) {
+	e.validations.With(prometheus.Labels{"status": status}).Inc()
+}
+
+func (e *DockerTagExporter) TagRemoved() {
+	e.availabilityChanges.With(prometheus.Labels{"action": "remove"}).Inc()
+}
+
+func (e *DockerTagExporter) TagReinstated() {
+	e.availabilityChanges.With(prometheus.Labels{"action": "reinstate"}).Inc()
+}
+
+// Refreshed records a tag list refresh. Status is one of "ok", "failed".
+func (e *DockerTagExporter) Refreshed(status string, duration time.Duration) {
+	e.refreshes.With(prometheus.Labels{"status": status}).Observe(duration.Seconds())
+}
+
+// SnapshotAge records how old the served tag list is. It's 0 after a successful refresh.
+func (e *DockerTagExporter) SnapshotAge(age time.Duration) {
+	e.snapshotAge.Set(age.Seconds())
+}
+
+// DigestChanged counts a rolling tag that has moved to a new digest.
+func (e *DockerTagExporter) DigestChanged(tag string) {
+	e.digestChanges.With(prometheus.Labels{"tag": tag}).Inc()
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var FiddleImport = FiddleImportExporter{
+	requests: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "fiddle_import",
+			Name:      "outbound_requests_total",
+			Help:      "How many outbound requests were sent to fetch imported fiddles, including redirects.",
+		},
+		[]string{"host", "status"},
+	),
+	duration: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "fiddle_import",
+			Name:      "outbound_request_duration_seconds",
+			Help:      "How long it took to receive response headers of the outbound request.",
+			Buckets:   defaultPipelineBuckets,
+		},
+		[]string{"host"},
+	),
+	imports: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "fiddle_import",
+			Name:      "imports_total",
+			Help:      "How many fiddles were requested to be imported.",
+		},
+		[]string{"result"},
+	),
+}
+
+type FiddleImportExporter struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	imports  *prometheus.CounterVec
+}
+
+// OutboundRequest records a request sent by the outbound client.
+// Status is the HTTP status code or "error" if no response has been received.
+func (e *FiddleImportExporter) OutboundRequest(host string, status string, duration time.Duration) {
+	e.requests.With(prometheus.Labels{"host": host, "status": status}).Inc()
+	e.duration.With(prometheus.Labels{"host": host}).Observe(duration.Seconds())
+}
+
+// Imported counts an import request. Result is one of "imported", "rejected", "failed".
+func (e *FiddleImportExporter) Imported(result string) {
+	e.imports.With(prometheus.Labels{"result": result}).Inc()
+}
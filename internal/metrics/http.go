@@ -4,11 +4,16 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// responseSizeBuckets cover responses from empty bodies to the output length limit.
+var responseSizeBuckets = prometheus.ExponentialBuckets(100, 4, 10)
+
+// longRequestBuckets cover requests that wait for containers, up to the run timeout.
+var longRequestBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300}
+
 var RestAPI = RestAPIExporter{
-	total: promauto.NewCounterVec(
+	total: factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "http",
 			Name:      "requests_total",
@@ -16,23 +21,54 @@ var RestAPI = RestAPIExporter{
 		},
 		[]string{"method", "path", "status"},
 	),
-	duration: promauto.NewHistogramVec(
+	duration: factory.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "http",
 			Name:      "request_duration_seconds",
-			Help:      "How long it took to handle the request.",
+			Help:      "How long it took to handle the request. Long-running routes are excluded.",
 			Buckets:   defaultPipelineBuckets,
 		},
 		[]string{"method", "path", "status"},
 	),
+	longDuration: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "http",
+			Name:      "long_request_duration_seconds",
+			Help:      "How long it took to handle the request to a long-running route, e.g. a query run.",
+			Buckets:   longRequestBuckets,
+		},
+		[]string{"method", "path", "status"},
+	),
+	inFlight: factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "http",
+			Name:      "requests_in_flight",
+			Help:      "How many HTTP requests are being handled.",
+		},
+		[]string{"method", "path"},
+	),
+	responseSize: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "http",
+			Name:      "response_size_bytes",
+			Help:      "How many bytes were written to the response body.",
+			Buckets:   responseSizeBuckets,
+		},
+		[]string{"method", "path"},
+	),
 }
 
 type RestAPIExporter struct {
-	total    *prometheus.CounterVec
-	duration *prometheus.HistogramVec
+	total        *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	longDuration *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+	responseSize *prometheus.HistogramVec
 }
 
-func (r *RestAPIExporter) NewRequest(method string, path string, status string, duration time.Duration) {
+// NewRequest records a handled request. Durations of long-running routes are kept apart,
+// so they do not distort the latency of other routes.
+func (r *RestAPIExporter) NewRequest(method string, path string, status string, duration time.Duration, size int, longRunning bool) {
 	labels := prometheus.Labels{
 		"method": method,
 		"path":   path,
@@ -40,5 +76,17 @@ func (r *RestAPIExporter) NewRequest(method string, path string, status string,
 	}
 
 	r.total.With(labels).Inc()
-	r.duration.With(labels).Observe(duration.Seconds())
+	if longRunning {
+		r.longDuration.With(labels).Observe(duration.Seconds())
+	} else {
+		r.duration.With(labels).Observe(duration.Seconds())
+	}
+
+	r.responseSize.With(prometheus.Labels{"method": method, "path": path}).Observe(float64(size))
+}
+
+// InFlight returns the gauge of requests being handled by the route.
+// The route is unknown until the request is routed, so it's tracked by the router middleware.
+func (r *RestAPIExporter) InFlight(method string, path string) prometheus.Gauge {
+	return r.inFlight.With(prometheus.Labels{"method": method, "path": path})
 }
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Maintenance = MaintenanceExporter{
+	active: factory.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "maintenance",
+			Name:      "active",
+			Help:      "Whether the maintenance mode is active: runs are not executed, only cached results are served.",
+		},
+	),
+	transitions: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maintenance",
+			Name:      "transitions_total",
+			Help:      "How many times the maintenance mode has been entered or left, by the trigger.",
+		},
+		[]string{"state", "trigger"},
+	),
+}
+
+type MaintenanceExporter struct {
+	active      prometheus.Gauge
+	transitions *prometheus.CounterVec
+}
+
+// Active exports the current mode.
+func (e *MaintenanceExporter) Active(active bool) {
+	if active {
+		e.active.Set(1)
+	} else {
+		e.active.Set(0)
+	}
+}
+
+// Transitioned exports the new mode and counts the transition. The trigger is "forced" or "automatic".
+func (e *MaintenanceExporter) Transitioned(active bool, trigger string) {
+	e.Active(active)
+
+	state := "left"
+	if active {
+		state = "entered"
+	}
+	e.transitions.With(prometheus.Labels{"state": state, "trigger": trigger}).Inc()
+}
@@ -2,14 +2,15 @@ package metrics
 
 import (
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type PrewarmerExporter struct {
 	fetchesTotal         *prometheus.CounterVec
 	containersSetUpdates *prometheus.CounterVec
+	timeToWarm           *prometheus.GaugeVec
 }
 
 var prewarmerInit sync.Once
@@ -18,7 +19,7 @@ var prewarmerExporter *PrewarmerExporter
 func NewPrewarmerExporter() *PrewarmerExporter {
 	prewarmerInit.Do(func() {
 		prewarmerExporter = &PrewarmerExporter{
-			fetchesTotal: promauto.NewCounterVec(
+			fetchesTotal: factory.NewCounterVec(
 				prometheus.CounterOpts{
 					Namespace: "prewarmer",
 					Name:      "fetch_requests_total",
@@ -26,7 +27,7 @@ func NewPrewarmerExporter() *PrewarmerExporter {
 				},
 				[]string{"status"},
 			),
-			containersSetUpdates: promauto.NewCounterVec(
+			containersSetUpdates: factory.NewCounterVec(
 				prometheus.CounterOpts{
 					Namespace: "prewarmer",
 					Name:      "containers_set_updates_total",
@@ -34,6 +35,14 @@ func NewPrewarmerExporter() *PrewarmerExporter {
 				},
 				[]string{"action"},
 			),
+			timeToWarm: factory.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: "prewarmer",
+					Name:      "time_to_warm_seconds",
+					Help:      "How long it took to fill the first warm pool allocation of the runner since the start.",
+				},
+				[]string{"runner"},
+			),
 		}
 	})
 
@@ -68,6 +77,10 @@ func (r *PrewarmerExporter) EjectContainer() {
 	r.observeUpdate("eject")
 }
 
+func (r *PrewarmerExporter) ExpireContainer() {
+	r.observeUpdate("expire")
+}
+
 func (r *PrewarmerExporter) observeUpdate(action string) {
 	r.containersSetUpdates.
 		With(prometheus.Labels{
@@ -75,3 +88,8 @@ func (r *PrewarmerExporter) observeUpdate(action string) {
 		}).
 		Inc()
 }
+
+// Warmed exports the time it took to fill the first allocation of the runner.
+func (r *PrewarmerExporter) Warmed(runner string, elapsed time.Duration) {
+	r.timeToWarm.With(prometheus.Labels{"runner": runner}).Set(elapsed.Seconds())
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var PullRateLimit = PullRateLimitExporter{
+	incidents: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coordinator",
+			Name:      "pull_rate_limit_incidents_total",
+			Help:      "How many runs failed to pull the image because of the registry rate limit.",
+		},
+		[]string{"runner"},
+	),
+	failovers: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coordinator",
+			Name:      "pull_rate_limit_failovers_total",
+			Help:      "How many rate limited runs were retried on a runner having the image, or surfaced the error if there was none.",
+		},
+		[]string{"result"},
+	),
+}
+
+type PullRateLimitExporter struct {
+	incidents *prometheus.CounterVec
+	failovers *prometheus.CounterVec
+}
+
+// Incident counts a run which image pull has been rejected by the registry on the runner.
+func (e *PullRateLimitExporter) Incident(runner string) {
+	e.incidents.With(prometheus.Labels{"runner": runner}).Inc()
+}
+
+// FailedOver counts a rate limited run retried on another runner.
+func (e *PullRateLimitExporter) FailedOver() {
+	e.failovers.With(prometheus.Labels{"result": "failed_over"}).Inc()
+}
+
+// Surfaced counts a rate limited run that no runner could serve.
+func (e *PullRateLimitExporter) Surfaced() {
+	e.failovers.With(prometheus.Labels{"result": "surfaced"}).Inc()
+}
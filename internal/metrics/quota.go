@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Quota = QuotaExporter{
+	throttled: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "http",
+			Name:      "throttled_requests_total",
+			Help:      "How many requests have been rejected because their clients have exceeded a quota, by the quota (requests or daily_runs).",
+		},
+		[]string{"quota"},
+	),
+}
+
+type QuotaExporter struct {
+	throttled *prometheus.CounterVec
+}
+
+// Throttled counts a request rejected because of the quota.
+func (e *QuotaExporter) Throttled(quota string) {
+	e.throttled.With(prometheus.Labels{"quota": quota}).Inc()
+}
@@ -0,0 +1,57 @@
+// Package metrics exports Prometheus metrics of the service. All metrics are registered on Registry,
+// not on the global default registry, so only the service metrics are exported.
+//
+// Metric families by file:
+//   - http.go: http_requests_total, http_request_duration_seconds, http_long_request_duration_seconds,
+//     http_requests_in_flight, http_response_size_bytes.
+//   - blocklist.go: http_blocked_requests_total.
+//   - quota.go: http_throttled_requests_total.
+//   - runner_pipeline.go: runner_pipeline_step_duration_seconds, runner_tool_run_duration_seconds,
+//     runner_readiness_wait_seconds, runner_readiness_attempts, runner_image_pulls_total,
+//     runner_image_pull_retries_total, runner_retried_image_pulls_total,
+//     runner_server_version_mismatches_total, runner_emulated_runs_total, runner_truncated_outputs_total,
+//     runner_container_failures_total, runner_remediations_total, runner_orphaned_containers_avoided_total.
+//   - runner_gc.go: runner_gc_duration_seconds, runner_gc_objects_collected_total, runner_gc_space_reclaimed_bytes,
+//     runner_paused_containers, runner_gc_image_budget_bytes, runner_gc_disk_usage_bytes,
+//     runner_gc_disk_pressure_evicted_images.
+//   - runner_status.go: runner_status_existing_objects_count, runner_status_space_consumption_bytes,
+//     runner_daemon_connection_events_total.
+//   - circuit_breaker.go: coordinator_circuit_breaker_state, coordinator_circuit_breaker_transitions_total,
+//     coordinator_circuit_breaker_rejected_runs_total.
+//   - scheduler.go: coordinator_scheduler_queued_runs, coordinator_scheduler_inflight_runs,
+//     coordinator_scheduler_wait_seconds.
+//   - balancer.go: coordinator_runner_selections_total, coordinator_runner_inflight_runs,
+//     coordinator_run_retries_total.
+//   - pull_rate_limit.go: coordinator_pull_rate_limit_incidents_total, coordinator_pull_rate_limit_failovers_total.
+//   - prewarmer.go: prewarmer_fetch_requests_total, prewarmer_containers_set_updates_total,
+//     prewarmer_time_to_warm_seconds.
+//   - dockerhub.go: dockerhub_responses_total, dockerhub_request_duration_seconds, dockerhub_throttled_requests_total,
+//     dockerhub_inflight_requests.
+//   - dockertag.go: dockertag_validations_total, dockertag_availability_changes_total,
+//     dockertag_refresh_duration_seconds, dockertag_snapshot_age_seconds, dockertag_rolling_digest_changes_total.
+//   - fiddle_import.go: fiddle_import_outbound_requests_total, fiddle_import_outbound_request_duration_seconds,
+//     fiddle_import_imports_total.
+//   - tasks.go: background_tasks, background_task_panics_total.
+//   - maintenance.go: maintenance_active, maintenance_transitions_total.
+//   - session.go: session_active, session_duration_seconds, session_queries_total, session_rejected_total.
+//   - runtime.go: go_* and process_* of the Go runtime and the process.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds all metrics of the service.
+var Registry = prometheus.NewRegistry()
+
+// factory registers metrics on Registry. Exporters panic if a metric is registered twice, e.g. runners share a name.
+var factory = promauto.With(Registry)
+
+// Handler serves the metrics of Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
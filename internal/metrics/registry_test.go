@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	pipeline := NewPipelineExporter("fake", "scrape-test")
+
+	// A fake run goes through the pipeline steps.
+	startedAt := time.Now().Add(-time.Second)
+	pipeline.PullExistedImage(true, "23.3", startedAt)
+	pipeline.CreateContainer(true, "23.3", startedAt)
+	pipeline.Readiness("23.3", 2, startedAt)
+	pipeline.RunQuery(true, "23.3", startedAt)
+	pipeline.RemoveContainer(true, "23.3", startedAt)
+
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `runner_pipeline_step_duration_seconds_count{runner_name="scrape-test",runner_type="fake",status="success",step="run_query",version="23.3"} 1`)
+	assert.Contains(t, string(body), `runner_readiness_attempts_count{runner_name="scrape-test",runner_type="fake",series="23.3"} 1`)
+}
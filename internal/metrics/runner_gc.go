@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type RunnerGCExporter struct {
@@ -12,6 +11,9 @@ type RunnerGCExporter struct {
 	objCollected     *prometheus.CounterVec
 	spaceReclaimed   *prometheus.CounterVec
 	pausedContainers prometheus.Gauge
+	imageBudget      *prometheus.GaugeVec
+	diskUsage        *prometheus.GaugeVec
+	diskEvictions    prometheus.Gauge
 }
 
 func NewRunnerGCExporter(runnerType, runnerName string) *RunnerGCExporter {
@@ -21,17 +23,17 @@ func NewRunnerGCExporter(runnerType, runnerName string) *RunnerGCExporter {
 	}
 
 	return &RunnerGCExporter{
-		duration: promauto.NewHistogramVec(
+		duration: factory.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Namespace:   "runner",
 				Name:        "gc_duration_seconds",
-				Help:        "How long it took to collect containers and images.",
+				Help:        "How long it took to collect containers, images, volumes and build cache.",
 				ConstLabels: runnerLabels,
 				Buckets:     prometheus.DefBuckets,
 			},
 			[]string{"object"},
 		),
-		objCollected: promauto.NewCounterVec(
+		objCollected: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace:   "runner",
 				Name:        "gc_objects_collected_total",
@@ -40,7 +42,7 @@ func NewRunnerGCExporter(runnerType, runnerName string) *RunnerGCExporter {
 			},
 			[]string{"object"},
 		),
-		spaceReclaimed: promauto.NewCounterVec(
+		spaceReclaimed: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace:   "runner",
 				Name:        "gc_space_reclaimed_bytes",
@@ -49,7 +51,7 @@ func NewRunnerGCExporter(runnerType, runnerName string) *RunnerGCExporter {
 			},
 			[]string{"object"},
 		),
-		pausedContainers: promauto.NewGauge(
+		pausedContainers: factory.NewGauge(
 			prometheus.GaugeOpts{
 				Namespace:   "runner",
 				Name:        "paused_containers",
@@ -57,6 +59,32 @@ func NewRunnerGCExporter(runnerType, runnerName string) *RunnerGCExporter {
 				ConstLabels: runnerLabels,
 			},
 		),
+		imageBudget: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "runner",
+				Name:        "gc_image_budget_bytes",
+				Help:        "Image size budget, its current usage and headroom.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"kind"},
+		),
+		diskUsage: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "runner",
+				Name:        "gc_disk_usage_bytes",
+				Help:        "Disk usage and capacity measured by the disk pressure gc.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"kind"},
+		),
+		diskEvictions: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   "runner",
+				Name:        "gc_disk_pressure_evicted_images",
+				Help:        "Number of images evicted by the last disk pressure gc pass.",
+				ConstLabels: runnerLabels,
+			},
+		),
 	}
 }
 
@@ -76,6 +104,34 @@ func (r *RunnerGCExporter) ImagesCollected(count uint, spaceReclaimed uint64, st
 	r.objectsCollected("image", count, spaceReclaimed, startedAt)
 }
 
+func (r *RunnerGCExporter) VolumesCollected(count uint, spaceReclaimed uint64, startedAt time.Time) {
+	r.objectsCollected("volume", count, spaceReclaimed, startedAt)
+}
+
+func (r *RunnerGCExporter) BuildCacheCollected(count uint, spaceReclaimed uint64, startedAt time.Time) {
+	r.objectsCollected("build_cache", count, spaceReclaimed, startedAt)
+}
+
 func (r *RunnerGCExporter) ReportPausedContainers(count uint) {
 	r.pausedContainers.Set(float64(count))
 }
+
+func (r *RunnerGCExporter) ReportDiskUsage(used, capacity uint64) {
+	r.diskUsage.With(prometheus.Labels{"kind": "used"}).Set(float64(used))
+	r.diskUsage.With(prometheus.Labels{"kind": "capacity"}).Set(float64(capacity))
+}
+
+func (r *RunnerGCExporter) ReportDiskPressureEvictions(count uint) {
+	r.diskEvictions.Set(float64(count))
+}
+
+func (r *RunnerGCExporter) ReportImageBudget(budget, usage uint64) {
+	var headroom float64
+	if budget > usage {
+		headroom = float64(budget - usage)
+	}
+
+	r.imageBudget.With(prometheus.Labels{"kind": "budget"}).Set(float64(budget))
+	r.imageBudget.With(prometheus.Labels{"kind": "usage"}).Set(float64(usage))
+	r.imageBudget.With(prometheus.Labels{"kind": "headroom"}).Set(headroom)
+}
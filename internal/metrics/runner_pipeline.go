@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 func NewPipelineExporter(runnerType, runnerName string) *PipelineExporter {
@@ -14,38 +13,170 @@ func NewPipelineExporter(runnerType, runnerName string) *PipelineExporter {
 	}
 
 	return &PipelineExporter{
-		duration: promauto.NewHistogramVec(
+		duration: factory.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Namespace:   "runner",
 				Name:        "pipeline_step_duration_seconds",
-				Help:        "How long it took to process a runner pipeline step, partitioned by step name, database version and status (success or failure).",
+				Help:        "How long it took to process a runner pipeline step, partitioned by step name, database version and status (success, failure or canceled).",
 				ConstLabels: runnerLabels,
 				Buckets:     defaultPipelineBuckets,
 			},
 			[]string{"step", "version", "status"},
 		),
+		toolRuns: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   "runner",
+				Name:        "tool_run_duration_seconds",
+				Help:        "How long it took to run an auxiliary tool instead of a query, partitioned by tool name, database version and status (success or failure).",
+				ConstLabels: runnerLabels,
+				Buckets:     defaultPipelineBuckets,
+			},
+			[]string{"tool", "version", "status"},
+		),
+		readinessWait: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   "runner",
+				Name:        "readiness_wait_seconds",
+				Help:        "How long it took for a database server to accept queries, partitioned by version series.",
+				ConstLabels: runnerLabels,
+				Buckets:     defaultPipelineBuckets,
+			},
+			[]string{"series"},
+		),
+		readinessAttempts: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   "runner",
+				Name:        "readiness_attempts",
+				Help:        "How many probes were made until a database server accepted queries, partitioned by version series.",
+				ConstLabels: runnerLabels,
+				Buckets:     []float64{1, 2, 3, 5, 10, 20, 50},
+			},
+			[]string{"series"},
+		),
+		pullSources: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "image_pulls_total",
+				Help:        "How many images were pulled, partitioned by source (a mirror endpoint or upstream) and status (success or failure).",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"source", "status"},
+		),
+		pullRetries: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "image_pull_retries_total",
+				Help:        "How many times a pull from the upstream registry was retried after a transient failure, partitioned by database version.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"version"},
+		),
+		retriedPulls: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "retried_image_pulls_total",
+				Help:        "How many pulls from the upstream registry needed retries, partitioned by database version and final status (success or failure).",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"version", "status"},
+		),
+		versionMismatches: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "server_version_mismatches_total",
+				Help:        "How many times the version reported by a database server did not match the image tag.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"version"},
+		),
+		emulatedRuns: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "emulated_runs_total",
+				Help:        "How many runs have been executed by an image of a foreign architecture under emulation.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"version"},
+		),
+		truncatedOutputs: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "truncated_outputs_total",
+				Help:        "How many runs have had their output truncated by the output limit of the runner.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"version"},
+		),
+		containerFailures: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "container_failures_total",
+				Help:        "How many times a container could not be created or started, partitioned by step (create or start) and failure class (disk, memory, too_many_containers, name_conflict or other).",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"step", "class"},
+		),
+		remediations: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "remediations_total",
+				Help:        "How many remediations of container failures were applied, partitioned by action (gc, rename or throttle).",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"action"},
+		),
+		orphansAvoided: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "orphaned_containers_avoided_total",
+				Help:        "How many containers created by failed container setups were removed at once instead of being left to the GC, partitioned by status of the removal.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"status"},
+		),
 	}
 }
 
 type PipelineExporter struct {
-	duration *prometheus.HistogramVec
+	duration          *prometheus.HistogramVec
+	toolRuns          *prometheus.HistogramVec
+	readinessWait     *prometheus.HistogramVec
+	readinessAttempts *prometheus.HistogramVec
+	pullSources       *prometheus.CounterVec
+	pullRetries       *prometheus.CounterVec
+	retriedPulls      *prometheus.CounterVec
+	versionMismatches *prometheus.CounterVec
+	emulatedRuns      *prometheus.CounterVec
+	truncatedOutputs  *prometheus.CounterVec
+	containerFailures *prometheus.CounterVec
+	remediations      *prometheus.CounterVec
+	orphansAvoided    *prometheus.CounterVec
 }
 
 func (r *PipelineExporter) observe(step string, succeed bool, version string, startedAt time.Time) {
-	status := "success"
-	if !succeed {
-		status = "failure"
-	}
-
 	r.duration.
 		With(prometheus.Labels{
 			"step":    step,
 			"version": version,
-			"status":  status,
+			"status":  pipelineStatus(succeed),
 		}).
 		Observe(time.Since(startedAt).Seconds())
 }
 
+// pipelineStatusCanceled marks steps interrupted by clients, so they are not counted as failures.
+const pipelineStatusCanceled = "canceled"
+
+// pipelineStatusTimedOut marks queries killed by the runner execution limit.
+const pipelineStatusTimedOut = "timed_out"
+
+func pipelineStatus(succeed bool) string {
+	if !succeed {
+		return "failure"
+	}
+
+	return "success"
+}
+
 func (r *PipelineExporter) PullExistedImage(succeed bool, version string, startedAt time.Time) {
 	r.observe("pull_existed_image", succeed, version, startedAt)
 }
@@ -54,6 +185,21 @@ func (r *PipelineExporter) PullNewImage(succeed bool, version string, startedAt
 	r.observe("pull_new_image", succeed, version, startedAt)
 }
 
+// PullSource counts a pull attempt from a mirror or the upstream registry.
+func (r *PipelineExporter) PullSource(source string, succeed bool) {
+	r.pullSources.With(prometheus.Labels{"source": source, "status": pipelineStatus(succeed)}).Inc()
+}
+
+// PullRetry counts a retry of a pull failed because of a transient registry error.
+func (r *PipelineExporter) PullRetry(version string) {
+	r.pullRetries.With(prometheus.Labels{"version": version}).Inc()
+}
+
+// RetriedPull counts the outcome of a pull which has been retried at least once.
+func (r *PipelineExporter) RetriedPull(version string, succeed bool) {
+	r.retriedPulls.With(prometheus.Labels{"version": version, "status": pipelineStatus(succeed)}).Inc()
+}
+
 func (r *PipelineExporter) CreateContainer(succeed bool, version string, startedAt time.Time) {
 	r.observe("create_container", succeed, version, startedAt)
 }
@@ -66,6 +212,72 @@ func (r *PipelineExporter) RunQuery(succeed bool, version string, startedAt time
 	r.observe("run_query", succeed, version, startedAt)
 }
 
+// RunQueryCanceled records a query run cancelled because the client has disconnected.
+func (r *PipelineExporter) RunQueryCanceled(version string, startedAt time.Time) {
+	r.duration.
+		With(prometheus.Labels{
+			"step":    "run_query",
+			"version": version,
+			"status":  pipelineStatusCanceled,
+		}).
+		Observe(time.Since(startedAt).Seconds())
+}
+
+// RunQueryTimedOut records a query run killed because it exceeded the runner execution limit.
+func (r *PipelineExporter) RunQueryTimedOut(version string, startedAt time.Time) {
+	r.duration.
+		With(prometheus.Labels{
+			"step":    "run_query",
+			"version": version,
+			"status":  pipelineStatusTimedOut,
+		}).
+		Observe(time.Since(startedAt).Seconds())
+}
+
+func (r *PipelineExporter) RunTool(succeed bool, tool, version string, startedAt time.Time) {
+	r.toolRuns.
+		With(prometheus.Labels{
+			"tool":    tool,
+			"version": version,
+			"status":  pipelineStatus(succeed),
+		}).
+		Observe(time.Since(startedAt).Seconds())
+}
+
+func (r *PipelineExporter) Readiness(series string, attempts int, startedAt time.Time) {
+	labels := prometheus.Labels{"series": series}
+	r.readinessWait.With(labels).Observe(time.Since(startedAt).Seconds())
+	r.readinessAttempts.With(labels).Observe(float64(attempts))
+}
+
 func (r *PipelineExporter) RemoveContainer(succeed bool, version string, startedAt time.Time) {
 	r.observe("remove_container", succeed, version, startedAt)
 }
+
+func (r *PipelineExporter) ServerVersionMismatch(version string) {
+	r.versionMismatches.With(prometheus.Labels{"version": version}).Inc()
+}
+
+// EmulatedRun counts a run executed by an image which architecture differs from the host one.
+func (r *PipelineExporter) EmulatedRun(version string) {
+	r.emulatedRuns.With(prometheus.Labels{"version": version}).Inc()
+}
+
+// TruncatedOutput counts a run which output has exceeded the limit of the runner.
+func (r *PipelineExporter) TruncatedOutput(version string) {
+	r.truncatedOutputs.With(prometheus.Labels{"version": version}).Inc()
+}
+
+// ContainerFailure counts a container that could not be created or started, by the class of the Docker error.
+func (r *PipelineExporter) ContainerFailure(step, class string) {
+	r.containerFailures.With(prometheus.Labels{"step": step, "class": class}).Inc()
+}
+
+// OrphanAvoided counts a removal of the container of a failed setup.
+func (r *PipelineExporter) OrphanAvoided(succeed bool) {
+	r.orphansAvoided.With(prometheus.Labels{"status": pipelineStatus(succeed)}).Inc()
+}
+
+func (r *PipelineExporter) Remediation(action string) {
+	r.remediations.With(prometheus.Labels{"action": action}).Inc()
+}
@@ -2,7 +2,6 @@ package metrics
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 func NewRunnerStatusExporter(runnerType, runnerName string) *RunnerStatusExporter {
@@ -12,7 +11,7 @@ func NewRunnerStatusExporter(runnerType, runnerName string) *RunnerStatusExporte
 	}
 
 	return &RunnerStatusExporter{
-		objects: promauto.NewGaugeVec(
+		objects: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace:   "runner",
 				Name:        "status_existing_objects_count",
@@ -21,7 +20,7 @@ func NewRunnerStatusExporter(runnerType, runnerName string) *RunnerStatusExporte
 			},
 			[]string{"object"},
 		),
-		spaceConsumption: promauto.NewGaugeVec(
+		spaceConsumption: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace:   "runner",
 				Name:        "status_space_consumption_bytes",
@@ -30,12 +29,22 @@ func NewRunnerStatusExporter(runnerType, runnerName string) *RunnerStatusExporte
 			},
 			[]string{"object"},
 		),
+		daemonConnection: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "runner",
+				Name:        "daemon_connection_events_total",
+				Help:        "How many times the connection to the daemon has been lost or restored.",
+				ConstLabels: runnerLabels,
+			},
+			[]string{"event"},
+		),
 	}
 }
 
 type RunnerStatusExporter struct {
 	objects          *prometheus.GaugeVec
 	spaceConsumption *prometheus.GaugeVec
+	daemonConnection *prometheus.CounterVec
 }
 
 func (r *RunnerStatusExporter) set(object string, count uint, spaceConsumption uint64) {
@@ -52,3 +61,11 @@ func (r *RunnerStatusExporter) UpdateContainerStatus(count uint, spaceConsumptio
 func (r *RunnerStatusExporter) UpdateImageStatus(count uint, spaceConsumption uint64) {
 	r.set("image", count, spaceConsumption)
 }
+
+func (r *RunnerStatusExporter) DaemonDisconnected() {
+	r.daemonConnection.With(prometheus.Labels{"event": "disconnect"}).Inc()
+}
+
+func (r *RunnerStatusExporter) DaemonReconnected() {
+	r.daemonConnection.With(prometheus.Labels{"event": "reconnect"}).Inc()
+}
@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// RegisterRuntimeCollectors registers the Go collector, which also exports GC, memory and scheduler metrics
+// from runtime/metrics (e.g. GC pause and goroutine latency histograms), and the process collector
+// (CPU, RSS, file descriptors).
+func RegisterRuntimeCollectors() error {
+	err := Registry.Register(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler),
+	))
+	if err != nil {
+		return err
+	}
+
+	return Registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
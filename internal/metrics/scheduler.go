@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Scheduler = SchedulerExporter{
+	queued: factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "coordinator",
+			Name:      "scheduler_queued_runs",
+			Help:      "How many runs are waiting for dispatch.",
+		},
+		[]string{"priority"},
+	),
+	inFlight: factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "coordinator",
+			Name:      "scheduler_inflight_runs",
+			Help:      "How many dispatched runs are in progress.",
+		},
+		[]string{"priority"},
+	),
+	wait: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "coordinator",
+			Name:      "scheduler_wait_seconds",
+			Help:      "How long runs waited for dispatch.",
+			Buckets:   defaultPipelineBuckets,
+		},
+		[]string{"priority", "result"},
+	),
+}
+
+type SchedulerExporter struct {
+	queued   *prometheus.GaugeVec
+	inFlight *prometheus.GaugeVec
+	wait     *prometheus.HistogramVec
+}
+
+// SetQueue exports the number of waiting and in-flight runs of the priority class.
+func (e *SchedulerExporter) SetQueue(priority string, queued, inFlight uint) {
+	e.queued.With(prometheus.Labels{"priority": priority}).Set(float64(queued))
+	e.inFlight.With(prometheus.Labels{"priority": priority}).Set(float64(inFlight))
+}
+
+// Dispatched observes the wait of a run that has been dispatched.
+func (e *SchedulerExporter) Dispatched(priority string, waitedSince time.Time) {
+	e.observeWait(priority, "dispatched", waitedSince)
+}
+
+// Rejected observes the wait of a run that has been rejected because the queue is full or the wait has timed out.
+func (e *SchedulerExporter) Rejected(priority string, waitedSince time.Time) {
+	e.observeWait(priority, "rejected", waitedSince)
+}
+
+// Canceled observes the wait of a run which context has been done before the dispatch.
+func (e *SchedulerExporter) Canceled(priority string, waitedSince time.Time) {
+	e.observeWait(priority, "canceled", waitedSince)
+}
+
+func (e *SchedulerExporter) observeWait(priority, result string, waitedSince time.Time) {
+	e.wait.With(prometheus.Labels{"priority": priority, "result": result}).Observe(time.Since(waitedSince).Seconds())
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Session = SessionExporter{
+	active: factory.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "session",
+			Name:      "active",
+			Help:      "Number of open interactive sessions, every session keeps a container.",
+		},
+	),
+	duration: factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "session",
+			Name:      "duration_seconds",
+			Help:      "Durations of interactive sessions, by the reason they have ended.",
+			Buckets:   []float64{5, 15, 30, 60, 120, 300, 600, 1800},
+		},
+		[]string{"reason"},
+	),
+	queries: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "session",
+			Name:      "queries_total",
+			Help:      "How many queries have been executed in interactive sessions, by the status.",
+		},
+		[]string{"status"},
+	),
+	rejected: factory.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "session",
+			Name:      "rejected_total",
+			Help:      "How many sessions have been rejected because the limit of open sessions has been reached.",
+		},
+	),
+}
+
+type SessionExporter struct {
+	active   prometheus.Gauge
+	duration *prometheus.HistogramVec
+	queries  *prometheus.CounterVec
+	rejected prometheus.Counter
+}
+
+// Opened counts an open session.
+func (e *SessionExporter) Opened() {
+	e.active.Inc()
+}
+
+// Closed exports the duration of an ended session. The reason is "closed", "idle", "expired" or "error".
+func (e *SessionExporter) Closed(reason string, startedAt time.Time) {
+	e.active.Dec()
+	e.duration.With(prometheus.Labels{"reason": reason}).Observe(time.Since(startedAt).Seconds())
+}
+
+// Query counts a query executed in a session.
+func (e *SessionExporter) Query(success bool) {
+	e.queries.With(prometheus.Labels{"status": pipelineStatus(success)}).Inc()
+}
+
+// Rejected counts a session rejected by the limit.
+func (e *SessionExporter) Rejected() {
+	e.rejected.Inc()
+}
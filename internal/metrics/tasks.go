@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Tasks = TasksExporter{
+	live: factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "background",
+			Name:      "tasks",
+			Help:      "How many background tasks are running, by the owner and the task name.",
+		},
+		[]string{"owner", "task"},
+	),
+	panics: factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "background",
+			Name:      "task_panics_total",
+			Help:      "How many background tasks have panicked, by the owner and the task name.",
+		},
+		[]string{"owner", "task"},
+	),
+}
+
+type TasksExporter struct {
+	live   *prometheus.GaugeVec
+	panics *prometheus.CounterVec
+}
+
+// Started counts a started task.
+func (e *TasksExporter) Started(owner, task string) {
+	e.live.With(prometheus.Labels{"owner": owner, "task": task}).Inc()
+}
+
+// Finished counts a finished task, including a panicked one.
+func (e *TasksExporter) Finished(owner, task string) {
+	e.live.With(prometheus.Labels{"owner": owner, "task": task}).Dec()
+}
+
+// Panicked counts a task that has panicked.
+func (e *TasksExporter) Panicked(owner, task string) {
+	e.panics.With(prometheus.Labels{"owner": owner, "task": task}).Inc()
+}
@@ -0,0 +1,120 @@
+// Package outputproc post-processes outputs of runs before they are stored and returned, e.g. redacts credentials.
+package outputproc
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Processor transforms an output stream. Processors work on chunks written one by one,
+// so they can be applied to outputs streamed to clients as well as to complete ones.
+type Processor interface {
+	// Name identifies the processor in reports.
+	Name() string
+
+	// NewStream returns a writer that writes the processed output to w.
+	// Close must be called once the output has been written, as streams may buffer data.
+	NewStream(w io.Writer) Stream
+}
+
+// Stream is a processing writer returned by Processor.NewStream.
+type Stream interface {
+	io.WriteCloser
+
+	// Summary describes what the stream has changed, e.g. "3 values redacted".
+	// It's empty if nothing has been changed. It's complete only after Close.
+	Summary() string
+}
+
+// Change is what a processor has changed in an output.
+type Change struct {
+	Processor string
+	Summary   string
+}
+
+// Pipeline applies processors in order: each processor gets the output of the previous one.
+type Pipeline struct {
+	processors []Processor
+}
+
+func NewPipeline(processors ...Processor) *Pipeline {
+	return &Pipeline{processors: processors}
+}
+
+// Wrap returns a writer passing the output through the processors to w.
+func (p *Pipeline) Wrap(w io.Writer) *PipelineStream {
+	streams := make([]Stream, len(p.processors))
+	next := w
+	for i := len(p.processors) - 1; i >= 0; i-- {
+		streams[i] = p.processors[i].NewStream(next)
+		next = streams[i]
+	}
+
+	return &PipelineStream{
+		head:       next,
+		processors: p.processors,
+		streams:    streams,
+	}
+}
+
+// Process passes the complete output through the processors.
+func (p *Pipeline) Process(output string) (string, []Change, error) {
+	if output == "" {
+		return "", nil, nil
+	}
+
+	var buf bytes.Buffer
+	s := p.Wrap(&buf)
+
+	_, err := io.WriteString(s, output)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to process output")
+	}
+
+	err = s.Close()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to process output")
+	}
+
+	return buf.String(), s.Changes(), nil
+}
+
+// PipelineStream is a writer passing the output through the processors of the pipeline.
+type PipelineStream struct {
+	head       io.Writer
+	processors []Processor
+	streams    []Stream
+}
+
+func (s *PipelineStream) Write(p []byte) (int, error) {
+	return s.head.Write(p)
+}
+
+// Close flushes the streams in order, so data buffered by a stream reaches the next one before it's closed.
+func (s *PipelineStream) Close() error {
+	for i, stream := range s.streams {
+		err := stream.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to close %s", s.processors[i].Name())
+		}
+	}
+
+	return nil
+}
+
+// Changes returns what the processors have changed. It's complete only after Close.
+func (s *PipelineStream) Changes() []Change {
+	var changes []Change
+	for i, stream := range s.streams {
+		summary := stream.Summary()
+		if summary == "" {
+			continue
+		}
+
+		changes = append(changes, Change{Processor: s.processors[i].Name(), Summary: summary})
+	}
+
+	return changes
+}
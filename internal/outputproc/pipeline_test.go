@@ -0,0 +1,74 @@
+package outputproc
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_Process(t *testing.T) {
+	redactor, err := NewRedactor([]string{`password=\S+`, `[a-z0-9-]+\.internal\.example\.com`}, "")
+	require.NoError(t, err)
+	p := NewPipeline(redactor, NewSizeGuard(64))
+
+	output, changes, err := p.Process("password=hunter2\nhost db-1.internal.example.com and db-2.internal.example.com\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[REDACTED]\nhost [REDACTED] and [REDACTED]\n", output)
+	assert.Equal(t, []Change{{Processor: "redactor", Summary: "3 values redacted"}}, changes)
+
+	output, changes, err = p.Process(strings.Repeat("x", 100))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", 64), output)
+	assert.Equal(t, []Change{{Processor: "size_guard", Summary: "output has been truncated to 64 bytes, 36 bytes dropped"}}, changes)
+
+	output, changes, err = p.Process("1\n")
+	require.NoError(t, err)
+	assert.Equal(t, "1\n", output)
+	assert.Empty(t, changes)
+}
+
+func TestPipeline_Wrap(t *testing.T) {
+	redactor, err := NewRedactor([]string{`secret-\d+`}, "***")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	s := NewPipeline(redactor).Wrap(&buf)
+
+	// The value is split across writes, it's redacted once the line is complete.
+	_, err = io.WriteString(s, "token: secr")
+	require.NoError(t, err)
+	assert.Empty(t, buf.String())
+
+	_, err = io.WriteString(s, "et-42\nnext: secret-7")
+	require.NoError(t, err)
+	assert.Equal(t, "token: ***\n", buf.String())
+
+	require.NoError(t, s.Close())
+	assert.Equal(t, "token: ***\nnext: ***", buf.String())
+	assert.Equal(t, []Change{{Processor: "redactor", Summary: "2 values redacted"}}, s.Changes())
+}
+
+func TestSizeGuard_RuneBoundary(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSizeGuard(4).NewStream(&buf)
+
+	_, err := io.WriteString(s, "ab")
+	require.NoError(t, err)
+	_, err = io.WriteString(s, "вг")
+	require.NoError(t, err)
+	_, err = io.WriteString(s, "d")
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	assert.Equal(t, "abв", buf.String())
+	assert.Equal(t, "output has been truncated to 4 bytes, 3 bytes dropped", s.Summary())
+}
+
+func TestNewRedactor_InvalidPattern(t *testing.T) {
+	_, err := NewRedactor([]string{`(`}, "")
+	assert.Error(t, err)
+}
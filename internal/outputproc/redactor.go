@@ -0,0 +1,123 @@
+package outputproc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultReplacement replaces redacted values if the replacement is not set.
+const DefaultReplacement = "[REDACTED]"
+
+// maxBufferedLine bounds the data the redactor holds while waiting for the end of a line.
+// Longer lines are redacted in parts, so values crossing the part boundary are not matched.
+const maxBufferedLine = 64 * 1024
+
+// Redactor replaces values matching the patterns, e.g. credentials or internal hostnames.
+// Outputs are redacted line by line, so a pattern cannot match across lines.
+type Redactor struct {
+	patterns    []*regexp.Regexp
+	replacement []byte
+}
+
+func NewRedactor(patterns []string, replacement string) (*Redactor, error) {
+	if replacement == "" {
+		replacement = DefaultReplacement
+	}
+
+	r := &Redactor{replacement: []byte(replacement)}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid redaction pattern '%s'", p)
+		}
+
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+func (r *Redactor) Name() string {
+	return "redactor"
+}
+
+func (r *Redactor) NewStream(w io.Writer) Stream {
+	return &redactorStream{redactor: r, w: w}
+}
+
+// redact replaces matches of all patterns and returns the number of replaced values.
+func (r *Redactor) redact(data []byte) ([]byte, int) {
+	var redacted int
+	for _, re := range r.patterns {
+		data = re.ReplaceAllFunc(data, func([]byte) []byte {
+			redacted++
+			return r.replacement
+		})
+	}
+
+	return data, redacted
+}
+
+type redactorStream struct {
+	redactor *Redactor
+	w        io.Writer
+
+	// buf holds the incomplete last line.
+	buf      []byte
+	redacted int
+}
+
+func (s *redactorStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+
+	end := bytes.LastIndexByte(s.buf, '\n') + 1
+	if end == 0 && len(s.buf) > maxBufferedLine {
+		end = len(s.buf)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+
+	err := s.flush(s.buf[:end])
+	s.buf = append(s.buf[:0], s.buf[end:]...)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *redactorStream) flush(data []byte) error {
+	data, redacted := s.redactor.redact(data)
+	s.redacted += redacted
+
+	_, err := s.w.Write(data)
+
+	return err
+}
+
+func (s *redactorStream) Close() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	err := s.flush(s.buf)
+	s.buf = nil
+
+	return err
+}
+
+func (s *redactorStream) Summary() string {
+	switch s.redacted {
+	case 0:
+		return ""
+	case 1:
+		return "1 value redacted"
+	}
+
+	return fmt.Sprintf("%d values redacted", s.redacted)
+}
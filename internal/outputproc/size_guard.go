@@ -0,0 +1,73 @@
+package outputproc
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// SizeGuard truncates outputs exceeding the limit. It's meant to be the last processor,
+// so the limit applies to the output that is stored and returned.
+type SizeGuard struct {
+	limit uint64
+}
+
+func NewSizeGuard(limit uint64) *SizeGuard {
+	return &SizeGuard{limit: limit}
+}
+
+func (g *SizeGuard) Name() string {
+	return "size_guard"
+}
+
+func (g *SizeGuard) NewStream(w io.Writer) Stream {
+	return &sizeGuardStream{limit: g.limit, w: w}
+}
+
+type sizeGuardStream struct {
+	limit uint64
+	w     io.Writer
+
+	written uint64
+	dropped uint64
+}
+
+// Write passes data until the limit is reached and drops the rest. The output is cut at a rune boundary,
+// and nothing is written after the cut.
+func (s *sizeGuardStream) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.dropped > 0 {
+		s.dropped += uint64(n)
+		return n, nil
+	}
+
+	if remaining := s.limit - s.written; uint64(len(p)) > remaining {
+		cut := int(remaining)
+		for cut > 0 && !utf8.RuneStart(p[cut]) {
+			cut--
+		}
+
+		s.dropped = uint64(len(p) - cut)
+		p = p[:cut]
+	}
+
+	_, err := s.w.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	s.written += uint64(len(p))
+
+	return n, nil
+}
+
+func (s *sizeGuardStream) Close() error {
+	return nil
+}
+
+func (s *sizeGuardStream) Summary() string {
+	if s.dropped == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("output has been truncated to %d bytes, %d bytes dropped", s.written, s.dropped)
+}
@@ -0,0 +1,20 @@
+package policy
+
+// Config describes queries that are not allowed to run. Empty config allows everything.
+type Config struct {
+	// DeniedStatements are statement prefixes like "SYSTEM", "KILL" or "SYSTEM SHUTDOWN".
+	DeniedStatements []string
+
+	// DeniedClauses are keyword sequences that are not allowed anywhere in a statement, e.g. "INTO OUTFILE".
+	DeniedClauses []string
+
+	// DeniedTables are patterns of referenced tables like "system.users" or "system.*".
+	// The pattern syntax is the one of path.Match.
+	DeniedTables []string
+
+	// DeniedFunctions are names of functions and table functions, e.g. "sleep" or "url".
+	DeniedFunctions []string
+
+	// MaxStatements limits the number of statements in a query. Zero means no limit.
+	MaxStatements int
+}
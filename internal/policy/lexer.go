@@ -0,0 +1,204 @@
+package policy
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	// tokenWord is an unquoted identifier, keyword or number.
+	tokenWord tokenKind = iota
+	// tokenQuotedIdent is an identifier in backticks or double quotes.
+	tokenQuotedIdent
+	tokenString
+	tokenPunct
+	tokenSemicolon
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+func (t token) isWord(word string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.value, word)
+}
+
+func (t token) isIdent() bool {
+	return t.kind == tokenWord || t.kind == tokenQuotedIdent
+}
+
+func (t token) isPunct(p string) bool {
+	return t.kind == tokenPunct && t.value == p
+}
+
+// ErrUnterminated is returned by the strict lexer if a literal or a comment is not closed.
+var ErrUnterminated = errors.New("unterminated literal or comment")
+
+// tokenize splits a query into tokens. Comments are dropped, so they cannot hide or fake anything.
+// The lexer is lenient: unterminated literals and comments last until the end of the query,
+// such queries are rejected by the server anyway.
+func tokenize(query string) []token {
+	tokens, _ := lex(query)
+	return tokens
+}
+
+// lex splits a query into tokens like tokenize, but it also reports unterminated literals and comments.
+func lex(query string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+
+		case strings.HasPrefix(query[i:], "--") || c == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end == -1 {
+				return tokens, nil
+			}
+			i += end + 1
+
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end == -1 {
+				return tokens, errors.Wrap(ErrUnterminated, "comment")
+			}
+			i += 2 + end + 2
+
+		case c == '\'':
+			value, n, terminated := readQuoted(query[i:])
+			tokens = append(tokens, token{kind: tokenString, value: value})
+			if !terminated {
+				return tokens, errors.Wrap(ErrUnterminated, "string literal")
+			}
+			i += n
+
+		case c == '"' || c == '`':
+			value, n, terminated := readQuoted(query[i:])
+			tokens = append(tokens, token{kind: tokenQuotedIdent, value: value})
+			if !terminated {
+				return tokens, errors.Wrap(ErrUnterminated, "quoted identifier")
+			}
+			i += n
+
+		case c == ';':
+			tokens = append(tokens, token{kind: tokenSemicolon, value: ";"})
+			i++
+
+		case isWordByte(c):
+			start := i
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, value: query[start:i]})
+
+		default:
+			r, n := utf8.DecodeRuneInString(query[i:])
+			if unicode.IsLetter(r) {
+				// Non-ASCII identifiers.
+				start := i
+				for i < len(query) {
+					r, n = utf8.DecodeRuneInString(query[i:])
+					if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !(r < utf8.RuneSelf && isWordByte(byte(r))) {
+						break
+					}
+					i += n
+				}
+				tokens = append(tokens, token{kind: tokenWord, value: query[start:i]})
+
+				continue
+			}
+
+			tokens = append(tokens, token{kind: tokenPunct, value: query[i : i+n]})
+			i += n
+		}
+	}
+
+	return tokens, nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// readQuoted reads a literal that starts with a quote character.
+// Backslash escapes and doubled quotes are supported.
+// It returns the unescaped value, the number of consumed bytes and whether the closing quote has been found.
+func readQuoted(s string) (string, int, bool) {
+	quote := s[0]
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+
+		case s[i] == quote && i+1 < len(s) && s[i+1] == quote:
+			i++
+			b.WriteByte(quote)
+
+		case s[i] == quote:
+			return b.String(), i + 1, true
+
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), len(s), false
+}
+
+// splitStatements splits tokens by semicolons. Empty statements are dropped.
+func splitStatements(tokens []token) [][]token {
+	var (
+		statements [][]token
+		current    []token
+	)
+
+	for _, t := range tokens {
+		if t.kind == tokenSemicolon {
+			if len(current) > 0 {
+				statements = append(statements, current)
+			}
+			current = nil
+
+			continue
+		}
+
+		current = append(current, t)
+	}
+
+	if len(current) > 0 {
+		statements = append(statements, current)
+	}
+
+	return statements
+}
+
+// ErrNoStatements is returned by CountStatements if the query contains only whitespaces and comments.
+var ErrNoStatements = errors.New("no statements")
+
+// CountStatements splits the query into statements strictly: it fails if a literal or a comment is not closed,
+// or if there are no statements at all.
+func CountStatements(query string) (int, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return 0, err
+	}
+
+	statements := splitStatements(tokens)
+	if len(statements) == 0 {
+		return 0, ErrNoStatements
+	}
+
+	return len(statements), nil
+}
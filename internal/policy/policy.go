@@ -0,0 +1,322 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RuleDeniedStatements = "denied_statements"
+	RuleDeniedClauses    = "denied_clauses"
+	RuleDeniedTables     = "denied_tables"
+	RuleDeniedFunctions  = "denied_functions"
+	RuleMaxStatements    = "max_statements"
+)
+
+// tableKeywords are keywords followed by a table name.
+var tableKeywords = []string{"FROM", "JOIN", "TABLE", "INTO", "DESCRIBE", "UPDATE"}
+
+// tableListKeywords are table keywords followed by a comma-separated list of tables.
+var tableListKeywords = []string{"FROM", "JOIN"}
+
+// tableListEnds are keywords that end a list of tables: the next clause may be a comma-separated list too.
+var tableListEnds = []string{
+	"ON", "USING", "WHERE", "PREWHERE", "GROUP", "HAVING", "WINDOW", "QUALIFY", "ORDER", "LIMIT", "OFFSET",
+	"SETTINGS", "FORMAT", "UNION", "INTERSECT", "EXCEPT", "SELECT", "WITH", "ARRAY", "INTO",
+}
+
+// Violation describes the rule that a query has broken.
+type Violation struct {
+	Rule string
+
+	// Statement is a 1-based index of the statement that has broken the rule.
+	// It is zero if the rule is checked against the whole query.
+	Statement int
+
+	Detail string
+}
+
+func (v *Violation) Error() string {
+	if v.Statement == 0 {
+		return fmt.Sprintf("query violates the %s rule: %s", v.Rule, v.Detail)
+	}
+
+	return fmt.Sprintf("statement %d violates the %s rule: %s", v.Statement, v.Rule, v.Detail)
+}
+
+type rules struct {
+	statements [][]string
+	clauses    [][]string
+	tables     []string
+	functions  map[string]struct{}
+
+	maxStatements int
+}
+
+func compile(cfg Config) (*rules, error) {
+	rs := &rules{
+		functions:     make(map[string]struct{}, len(cfg.DeniedFunctions)),
+		maxStatements: cfg.MaxStatements,
+	}
+
+	if cfg.MaxStatements < 0 {
+		return nil, errors.New("max statements cannot be negative")
+	}
+
+	for _, s := range cfg.DeniedStatements {
+		words := strings.Fields(s)
+		if len(words) == 0 {
+			return nil, errors.New("denied statement cannot be empty")
+		}
+		rs.statements = append(rs.statements, words)
+	}
+
+	for _, c := range cfg.DeniedClauses {
+		words := strings.Fields(c)
+		if len(words) == 0 {
+			return nil, errors.New("denied clause cannot be empty")
+		}
+		rs.clauses = append(rs.clauses, words)
+	}
+
+	for _, t := range cfg.DeniedTables {
+		pattern := strings.ToLower(strings.TrimSpace(t))
+		if pattern == "" {
+			return nil, errors.New("denied table pattern cannot be empty")
+		}
+
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid table pattern '%s'", t)
+		}
+		rs.tables = append(rs.tables, pattern)
+	}
+
+	for _, f := range cfg.DeniedFunctions {
+		name := strings.ToLower(strings.TrimSpace(f))
+		if name == "" {
+			return nil, errors.New("denied function cannot be empty")
+		}
+		rs.functions[name] = struct{}{}
+	}
+
+	return rs, nil
+}
+
+// Policy checks queries against the configured rules before they are executed.
+// Rules can be replaced at runtime with Update.
+type Policy struct {
+	rules atomic.Pointer[rules]
+}
+
+func New(cfg Config) (*Policy, error) {
+	p := new(Policy)
+
+	err := p.Update(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Update replaces the rules. The previous rules are kept if the config is invalid.
+func (p *Policy) Update(cfg Config) error {
+	rs, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.rules.Store(rs)
+
+	return nil
+}
+
+// Check returns *Violation if the query breaks any rule.
+func (p *Policy) Check(query string) error {
+	rs := p.rules.Load()
+	statements := splitStatements(tokenize(query))
+
+	if rs.maxStatements > 0 && len(statements) > rs.maxStatements {
+		return &Violation{
+			Rule:   RuleMaxStatements,
+			Detail: fmt.Sprintf("%d statements are given, at most %d are allowed", len(statements), rs.maxStatements),
+		}
+	}
+
+	for i, s := range statements {
+		err := rs.checkStatement(s)
+		if err != nil {
+			err.Statement = i + 1
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rs *rules) checkStatement(tokens []token) *Violation {
+	for _, words := range rs.statements {
+		if hasWordsAt(tokens, 0, words) {
+			return &Violation{
+				Rule:   RuleDeniedStatements,
+				Detail: fmt.Sprintf("%s statements are not allowed", strings.ToUpper(strings.Join(words, " "))),
+			}
+		}
+	}
+
+	for i := range tokens {
+		for _, words := range rs.clauses {
+			if hasWordsAt(tokens, i, words) {
+				return &Violation{
+					Rule:   RuleDeniedClauses,
+					Detail: fmt.Sprintf("%s is not allowed", strings.ToUpper(strings.Join(words, " "))),
+				}
+			}
+		}
+
+		if v := rs.checkFunction(tokens, i); v != nil {
+			return v
+		}
+
+		if v := rs.checkTable(tokens, i); v != nil {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// checkFunction checks the function called at the position.
+func (rs *rules) checkFunction(tokens []token, i int) *Violation {
+	if len(rs.functions) == 0 || !tokens[i].isIdent() || i+1 >= len(tokens) || !tokens[i+1].isPunct("(") {
+		return nil
+	}
+
+	if _, denied := rs.functions[strings.ToLower(tokens[i].value)]; denied {
+		return &Violation{
+			Rule:   RuleDeniedFunctions,
+			Detail: fmt.Sprintf("function '%s' is not allowed", tokens[i].value),
+		}
+	}
+
+	return nil
+}
+
+// checkTable checks the tables referenced after a keyword at the position.
+// Tables of subqueries are checked at their own keywords.
+func (rs *rules) checkTable(tokens []token, i int) *Violation {
+	if len(rs.tables) == 0 || !isWordOf(tokens[i], tableKeywords) {
+		return nil
+	}
+	// ARRAY JOIN joins arrays, not tables.
+	if i > 0 && tokens[i].isWord("JOIN") && tokens[i-1].isWord("ARRAY") {
+		return nil
+	}
+
+	var names []string
+	if isWordOf(tokens[i], tableListKeywords) {
+		names = readTableNames(tokens[i+1:])
+	} else if name, ok := readTableName(tokens[i+1:]); ok {
+		names = []string{name}
+	}
+
+	for _, name := range names {
+		lowered := strings.ToLower(name)
+		for _, pattern := range rs.tables {
+			if matched, _ := path.Match(pattern, lowered); matched {
+				return &Violation{
+					Rule:   RuleDeniedTables,
+					Detail: fmt.Sprintf("access to table '%s' is not allowed", name),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func isWordOf(t token, words []string) bool {
+	for _, w := range words {
+		if t.isWord(w) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readTableNames reads a comma-separated list of tables from the beginning of tokens, e.g. "t1 AS a, db.t2 b".
+// The list ends at a keyword of the next clause or at the end of the enclosing subquery.
+func readTableNames(tokens []token) []string {
+	var names []string
+
+	depth := 0
+	expectTable := true
+	for i, t := range tokens {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			if depth == 0 {
+				return names
+			}
+			depth--
+		case depth > 0:
+		case t.isPunct(","):
+			expectTable = true
+			continue
+		case isWordOf(t, tableListEnds):
+			return names
+		case expectTable:
+			if name, ok := readTableName(tokens[i:]); ok {
+				names = append(names, name)
+			}
+		}
+
+		expectTable = false
+	}
+
+	return names
+}
+
+// readTableName reads [database.]table from the beginning of tokens.
+// Table functions and subqueries are not table names.
+func readTableName(tokens []token) (string, bool) {
+	if len(tokens) == 0 || !tokens[0].isIdent() {
+		return "", false
+	}
+
+	name := tokens[0].value
+	rest := tokens[1:]
+
+	if len(rest) >= 2 && rest[0].isPunct(".") && rest[1].isIdent() {
+		name += "." + rest[1].value
+		rest = rest[2:]
+	}
+
+	if len(rest) > 0 && rest[0].isPunct("(") {
+		return "", false
+	}
+
+	return name, true
+}
+
+// hasWordsAt reports whether unquoted words start at the position.
+func hasWordsAt(tokens []token, i int, words []string) bool {
+	if i+len(words) > len(tokens) {
+		return false
+	}
+
+	for j, w := range words {
+		if !tokens[i+j].isWord(w) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,178 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = Config{
+	DeniedStatements: []string{"SYSTEM", "KILL", "GRANT"},
+	DeniedClauses:    []string{"INTO OUTFILE"},
+	DeniedTables:     []string{"system.users", "system.quota*", "secrets"},
+	DeniedFunctions:  []string{"sleep", "sleepEachRow", "url"},
+	MaxStatements:    3,
+}
+
+func TestSplitStatements(t *testing.T) {
+	cases := []struct {
+		Query    string
+		Expected int
+	}{
+		{Query: "SELECT 1", Expected: 1},
+		{Query: "SELECT 1;", Expected: 1},
+		{Query: "SELECT 1; SELECT 2", Expected: 2},
+		{Query: ";;SELECT 1;;", Expected: 1},
+		{Query: "SELECT ';'; SELECT 2", Expected: 2},
+		{Query: "SELECT `a;b` FROM t", Expected: 1},
+		{Query: "SELECT 1 -- ; SELECT 2", Expected: 1},
+		{Query: "SELECT 1 /* ; */", Expected: 1},
+		{Query: "SELECT 'it''s; ok'", Expected: 1},
+		{Query: `SELECT 'it\'s; ok'`, Expected: 1},
+		{Query: "", Expected: 0},
+		{Query: "-- only a comment", Expected: 0},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Query, func(t *testing.T) {
+			assert.Len(t, splitStatements(tokenize(test.Query)), test.Expected)
+		})
+	}
+}
+
+func TestCountStatements(t *testing.T) {
+	n, err := CountStatements("CREATE TABLE t (s String) ENGINE = Memory; INSERT INTO t VALUES ('a;b'); SELECT * FROM t -- done")
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	for _, query := range []string{"SELECT 'a", "SELECT `a", "SELECT 1 /* comment", "SELECT 'it''s"} {
+		_, err = CountStatements(query)
+		assert.ErrorIs(t, err, ErrUnterminated, query)
+	}
+
+	for _, query := range []string{"", " ;; ", "-- only a comment"} {
+		_, err = CountStatements(query)
+		assert.ErrorIs(t, err, ErrNoStatements, query)
+	}
+}
+
+func TestCheckAllowed(t *testing.T) {
+	p, err := New(testConfig)
+	require.NoError(t, err)
+
+	queries := []string{
+		"SELECT 1",
+		"SELECT * FROM system.numbers LIMIT 10",
+		"SELECT * FROM system.tables",
+		"SELECT 'SYSTEM SHUTDOWN'",
+		"SELECT 'INTO OUTFILE'",
+		"SELECT sleep FROM t",
+		"SELECT t.sleep FROM t",
+		"SELECT `sleep` AS x",
+		"SELECT 1 -- sleep(100)",
+		"SELECT 1 /* FROM system.users */",
+		"SELECT * FROM users",
+		"SELECT * FROM other.secrets",
+		"SELECT 1 AS system",
+		"CREATE TABLE t (sleep UInt8) ENGINE = Memory; INSERT INTO t VALUES (1); SELECT * FROM t",
+		"WITH x AS (SELECT 1) SELECT * FROM x",
+		"SELECT killed FROM t",
+		"SELECT name FROM system.settings WHERE name = 'system.users'",
+		"SELECT * FROM numbers(10) ORDER BY number DESC",
+		"SELECT урок FROM таблица",
+		"SELECT * FROM t1, t2 AS secrets",
+		"SELECT a, secrets FROM t ORDER BY a, secrets",
+		"SELECT * FROM t1 JOIN t2 USING a, secrets",
+		"SELECT * FROM t ARRAY JOIN secrets",
+		"INSERT INTO t (a, b) SELECT a, secrets FROM t2",
+	}
+
+	for _, q := range queries {
+		t.Run(q, func(t *testing.T) {
+			assert.NoError(t, p.Check(q))
+		})
+	}
+}
+
+func TestCheckDenied(t *testing.T) {
+	p, err := New(testConfig)
+	require.NoError(t, err)
+
+	cases := []struct {
+		Query     string
+		Rule      string
+		Statement int
+	}{
+		{Query: "SYSTEM SHUTDOWN", Rule: RuleDeniedStatements, Statement: 1},
+		{Query: "system drop dns cache", Rule: RuleDeniedStatements, Statement: 1},
+		{Query: "SELECT 1; KILL QUERY WHERE 1", Rule: RuleDeniedStatements, Statement: 2},
+		{Query: "/* hidden */ GRANT ALL ON *.* TO u", Rule: RuleDeniedStatements, Statement: 1},
+		{Query: "SELECT 1 INTO OUTFILE 'out.csv'", Rule: RuleDeniedClauses, Statement: 1},
+		{Query: "SELECT 1 into   outfile 'out.csv'", Rule: RuleDeniedClauses, Statement: 1},
+		{Query: "SELECT * FROM system.users", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM `system`.`users`", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM SYSTEM.USERS", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM system . quotas", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM t JOIN system.users u ON 1", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT 1 WHERE 1 IN (SELECT 1 FROM system.users)", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SHOW CREATE TABLE system.users", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM secrets", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM numbers(1), system.users", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM t AS a, other.t b, secrets", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM (SELECT 1) AS s, `system`.`users`", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM t CROSS JOIN numbers(1) n, system.users", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT * FROM (SELECT * FROM numbers(1), system.quotas)", Rule: RuleDeniedTables, Statement: 1},
+		{Query: "SELECT sleep(3)", Rule: RuleDeniedFunctions, Statement: 1},
+		{Query: "SELECT SLEEP (3)", Rule: RuleDeniedFunctions, Statement: 1},
+		{Query: "SELECT sleepEachRow(1) FROM numbers(100)", Rule: RuleDeniedFunctions, Statement: 1},
+		{Query: "SELECT * FROM url('http://example.com', CSV)", Rule: RuleDeniedFunctions, Statement: 1},
+		{Query: "SELECT 1; SELECT 2; SELECT 3; SELECT 4", Rule: RuleMaxStatements, Statement: 0},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Query, func(t *testing.T) {
+			err := p.Check(test.Query)
+			require.Error(t, err)
+
+			var v *Violation
+			require.ErrorAs(t, err, &v)
+			assert.Equal(t, test.Rule, v.Rule)
+			assert.Equal(t, test.Statement, v.Statement)
+		})
+	}
+}
+
+func TestEmptyConfigIsPermissive(t *testing.T) {
+	p, err := New(Config{})
+	require.NoError(t, err)
+
+	assert.NoError(t, p.Check("SYSTEM SHUTDOWN; SELECT sleep(3) FROM system.users INTO OUTFILE 'x'"))
+}
+
+func TestUpdate(t *testing.T) {
+	p, err := New(Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Update(Config{DeniedFunctions: []string{"sleep"}}))
+	assert.Error(t, p.Check("SELECT sleep(1)"))
+
+	// Invalid rules are rejected and the previous ones are kept.
+	assert.Error(t, p.Update(Config{DeniedTables: []string{"system.[users"}}))
+	assert.Error(t, p.Check("SELECT sleep(1)"))
+}
+
+func TestInvalidConfig(t *testing.T) {
+	configs := []Config{
+		{DeniedStatements: []string{" "}},
+		{DeniedClauses: []string{""}},
+		{DeniedTables: []string{"[a"}},
+		{DeniedFunctions: []string{""}},
+		{MaxStatements: -1},
+	}
+
+	for _, cfg := range configs {
+		_, err := New(cfg)
+		assert.Error(t, err)
+	}
+}
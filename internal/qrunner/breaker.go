@@ -0,0 +1,100 @@
+package qrunner
+
+import (
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// Dependency is a class of external dependencies the runs are guarded from by circuit breakers.
+type Dependency string
+
+const (
+	// DependencyDaemon is the Docker daemon API: container creation, exec and removal.
+	DependencyDaemon Dependency = "daemon"
+	// DependencyRegistry is image pulls from registries and their mirrors.
+	DependencyRegistry Dependency = "registry"
+)
+
+// Dependencies are all dependency classes in the order they are reported.
+var Dependencies = []Dependency{DependencyDaemon, DependencyRegistry}
+
+// ErrUnknownDependency is returned when a circuit breaker of an unknown dependency is requested.
+var ErrUnknownDependency = errors.New("unknown dependency")
+
+// PullSourceLocal is the source of the image pull stage if the image has been pulled before.
+const PullSourceLocal = "local"
+
+// DependencyError is returned when the run has failed because of a dependency rather than the query.
+type DependencyError struct {
+	Dependency Dependency
+	Err        error
+}
+
+func (e *DependencyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DependencyError) Unwrap() error {
+	return e.Err
+}
+
+// CircuitOpenError is returned when the run is rejected without an attempt because the circuit
+// of a failing dependency is open. It wraps ErrNoAvailableRunners.
+type CircuitOpenError struct {
+	Dependency Dependency
+
+	// RetryAfter is when a probe run is let through next time.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return string(e.Dependency) + " circuit is open: " + ErrNoAvailableRunners.Error()
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrNoAvailableRunners
+}
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// CircuitBreakerStatus is the state of the circuit breaker of a dependency class.
+type CircuitBreakerStatus struct {
+	Dependency Dependency
+
+	// Runner is set for daemon circuit breakers, which are kept per runner.
+	Runner string
+
+	State string
+
+	// Requests and Failures are counted over the current window.
+	Requests uint
+	Failures uint
+
+	// OpenedAt is zero if the circuit has not been opened since the start or the latest reset.
+	OpenedAt time.Time
+
+	// LastError is the latest failure that has been counted.
+	LastError string
+
+	// Rejected counts runs rejected by the circuit since the start.
+	Rejected uint64
+}
+
+// PulledFromRegistry reports whether the image of the run has been pulled from a registry or a mirror.
+func PulledFromRegistry(run *queryrun.Run) bool {
+	for _, s := range run.Timeline.Stages() {
+		if s.Name == queryrun.StageImagePull && s.Source != "" && s.Source != PullSourceLocal {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,12 +2,12 @@ package qrunner
 
 import "strings"
 
-// CheckIfClickHouseIsReady checks whether a ClickHouse instance has accepted a query.
+// CheckIfClickHouseIsReady checks whether a ClickHouse instance has accepted a readiness probe.
 // There are no mechanism to be signaled when a clickhouse instance is ready to accept queries,
-// so we try to send them continuously until the instance accepts them.
+// so a cheap probe query is sent until the instance accepts it. The user query is executed only after that.
 // When the instance is not ready, we received the 'Connection refused' exception.
 //
-// The function accepts stderr for clickhouse client and determines whether a query has been accepted or not.
-func CheckIfClickHouseIsReady(stderr string) bool {
-	return !strings.Contains(stderr, "DB::NetException: Connection refused")
+// The function accepts the result of the probe and determines whether it has been accepted or not.
+func CheckIfClickHouseIsReady(res Result) bool {
+	return res.ExitCode == 0 && !strings.Contains(res.Stderr, "DB::NetException: Connection refused")
 }
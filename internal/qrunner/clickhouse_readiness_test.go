@@ -7,6 +7,11 @@ import (
 )
 
 func TestCheckIfClickHouseIsReady(t *testing.T) {
-	assert.True(t, CheckIfClickHouseIsReady("Returned:\n1 1 2 Helen"))
-	assert.False(t, CheckIfClickHouseIsReady("FAILURE: DB::NetException: Connection refused localhost:9000"))
+	assert.True(t, CheckIfClickHouseIsReady(Result{Stdout: "23.3.1.2823\n"}))
+	assert.False(t, CheckIfClickHouseIsReady(Result{
+		Stderr:   "FAILURE: DB::NetException: Connection refused localhost:9000",
+		ExitCode: 210,
+	}))
+	assert.False(t, CheckIfClickHouseIsReady(Result{Stderr: "Code: 210. DB::NetException: Connection refused"}))
+	assert.False(t, CheckIfClickHouseIsReady(Result{Stderr: "Code: 209. DB::NetException: Timeout exceeded", ExitCode: 209}))
 }
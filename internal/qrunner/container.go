@@ -0,0 +1,34 @@
+package qrunner
+
+import (
+	"context"
+	"time"
+)
+
+// Container describes a container created by a runner.
+type Container struct {
+	ID     string
+	Runner string
+
+	// RunID is empty for warm containers.
+	RunID   string
+	Version string
+	State   string
+
+	CreatedAt time.Time
+
+	// HeldUntil is set if the container of a failed run is kept for inspection.
+	// It's removed by the garbage collector after that time.
+	HeldUntil *time.Time
+}
+
+// ContainerLister is implemented by runners that can list their containers.
+type ContainerLister interface {
+	Containers(ctx context.Context) ([]Container, error)
+}
+
+// ContainerHolder is implemented by runners that keep containers of failed runs for inspection.
+// Held containers occupy the runner like in-flight runs.
+type ContainerHolder interface {
+	HeldContainers() uint32
+}
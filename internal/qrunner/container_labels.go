@@ -4,14 +4,27 @@ package qrunner
 // Use it to find hanged up containers for garbage collection.
 const LabelOwnership = "clickhouse.playground.ownership"
 
+// Labels describing the container.
+const (
+	LabelRun     = "clickhouse.playground.run"
+	LabelVersion = "clickhouse.playground.version"
+	LabelRunner  = "clickhouse.playground.runner"
+	LabelClient  = "clickhouse.playground.client"
+
+	// LabelSessionExpiresAt is the unix time the interactive session of the container ends at.
+	// The garbage collector keeps running session containers until then.
+	LabelSessionExpiresAt = "clickhouse.playground.session-expires-at"
+)
+
 // CreateContainerLabels returns default labels for created containers.
 // Use labels to find containers created for ch query running purposes
 // and to get some basic information what the image was used to run the container.
-func CreateContainerLabels(runnerName string, runID string, version string) map[string]string {
+func CreateContainerLabels(runnerName string, runID string, version string, clientID string) map[string]string {
 	return map[string]string{
-		LabelOwnership:                  "1",
-		"clickhouse.playground.run":     runID,
-		"clickhouse.playground.version": version,
-		"clickhouse.playground.runner":  runnerName,
+		LabelOwnership: "1",
+		LabelRun:       runID,
+		LabelVersion:   version,
+		LabelRunner:    runnerName,
+		LabelClient:    clientID,
 	}
 }
@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,22 +10,32 @@ import (
 )
 
 type balancer struct {
-	logger zerolog.Logger
+	logger   zerolog.Logger
+	strategy Balancing
 
 	lock    sync.Mutex
 	runners map[string]*Runner
 
 	random *rand.Rand
+
+	// turns are current weights of the smooth weighted round-robin by runner names.
+	turns map[string]int64
 }
 
-func newBalancer(logger zerolog.Logger) *balancer {
+func newBalancer(logger zerolog.Logger, strategy Balancing) *balancer {
 	// It's okay to initialize by setting time, because it's just for load balancing among runners.
 	random := rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec
 
+	if strategy == "" {
+		strategy = BalancingWeightedRandom
+	}
+
 	return &balancer{
-		logger:  logger,
-		runners: make(map[string]*Runner),
-		random:  random,
+		logger:   logger,
+		strategy: strategy,
+		runners:  make(map[string]*Runner),
+		random:   random,
+		turns:    make(map[string]int64),
 	}
 }
 
@@ -69,22 +80,49 @@ type runnerJob = func(r *Runner)
 
 // processJob select an available runner and executes the given job.
 // It returns true if a runner has been found.
-// There are no available runners when all of them are dead or have concurrency limit exhausted.
+// There are no available runners when all of them are dead, have concurrency limit exhausted
+// or have their daemon circuits open.
 func (b *balancer) processJob(job runnerJob) bool {
+	return b.processJobOn("", job)
+}
+
+// processJobOn works like processJob, but it selects the preferred runner if it's available.
+func (b *balancer) processJobOn(preferred string, job runnerJob) bool {
+	return b.process(preferred, true, "", job)
+}
+
+// processJobOnly works like processJob, but only the given runner can execute the job.
+// It returns false if the runner is dead, has concurrency limit exhausted or its daemon circuit is open.
+func (b *balancer) processJobOnly(name string, job runnerJob) bool {
+	return b.process(name, false, "", job)
+}
+
+// processJobExcept works like processJob, but the given runner is not selected, e.g. when a run is retried.
+func (b *balancer) processJobExcept(skipped string, job runnerJob) bool {
+	return b.process("", true, skipped, job)
+}
+
+func (b *balancer) process(preferred string, fallback bool, skipped string, job runnerJob) bool {
 	var runner *Runner
 	var excluded bool
 	func() {
 		b.lock.Lock()
 		defer b.lock.Unlock()
 
-		runner = b.selectRunner()
+		runner = b.runners[preferred]
+		if runner != nil && (runner.saturated() || !runner.daemonAvailable(time.Now())) {
+			runner = nil
+		}
+		if runner == nil && fallback {
+			runner = b.selectRunner(skipped)
+		}
 		if runner == nil {
 			return
 		}
 
 		// Check if concurrency limit has not been exhausted.
 		concurrency := runner.addConcurrency(1)
-		if runner.maxConcurrency != nil && concurrency >= *runner.maxConcurrency {
+		if limit, limited := runner.concurrencyLimit(); limited && concurrency >= limit {
 			b.removeUnderLock(runner)
 			excluded = true
 		}
@@ -104,22 +142,57 @@ func (b *balancer) processJob(job runnerJob) bool {
 	return true
 }
 
-// selectRunner implements a weighted random choice algorithm and returns a runner.
-// If the weight of r1 is 10 times the weight of r2, r1 is selected ~10 times more often.
+// selectRunner selects a runner by the strategy among runners that are not saturated and whose daemon circuit
+// is not open, except the skipped one.
+// Fallback runners are candidates only if there are no primary ones. It returns nil if there is no such runner.
 //
 // selectRunner must be called under the taken lock.
-func (b *balancer) selectRunner() *Runner {
-	var totalWeight uint64
-	for _, r := range b.runners {
-		totalWeight += uint64(r.weight)
-	}
+func (b *balancer) selectRunner(skipped string) *Runner {
+	now := time.Now()
+	var candidates, fallbacks []*Runner
+	for name, r := range b.runners {
+		if name == skipped || r.weight == 0 || r.saturated() || !r.daemonAvailable(now) {
+			continue
+		}
 
-	if totalWeight == 0 {
+		if r.fallback {
+			fallbacks = append(fallbacks, r)
+		} else {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallbacks
+	}
+	if len(candidates) == 0 {
 		return nil
 	}
 
+	// The order of candidates is fixed, so round-robin turns and ties don't depend on the map order.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].underlying.Name() < candidates[j].underlying.Name()
+	})
+
+	switch b.strategy {
+	case BalancingRoundRobin:
+		return b.nextTurn(candidates)
+	case BalancingLeastOutstanding:
+		return b.weightedRandom(leastOutstanding(candidates))
+	default:
+		return b.weightedRandom(candidates)
+	}
+}
+
+// weightedRandom implements a weighted random choice algorithm and returns a runner.
+// If the weight of r1 is 10 times the weight of r2, r1 is selected ~10 times more often.
+func (b *balancer) weightedRandom(candidates []*Runner) *Runner {
+	var totalWeight uint64
+	for _, r := range candidates {
+		totalWeight += uint64(r.weight)
+	}
+
 	rnd := b.random.Uint64() % totalWeight
-	for _, r := range b.runners {
+	for _, r := range candidates {
 		if rnd < uint64(r.weight) {
 			return r
 		}
@@ -129,3 +202,42 @@ func (b *balancer) selectRunner() *Runner {
 
 	return nil
 }
+
+// nextTurn implements the smooth weighted round-robin: every candidate gains its weight, and the one
+// with the greatest current weight is selected and loses the total weight. Runners take turns in proportion
+// to their weights, and turns of a heavy runner are interleaved with turns of others.
+func (b *balancer) nextTurn(candidates []*Runner) *Runner {
+	var totalWeight int64
+	var selected *Runner
+	for _, r := range candidates {
+		name := r.underlying.Name()
+		b.turns[name] += int64(r.weight)
+		totalWeight += int64(r.weight)
+
+		if selected == nil || b.turns[name] > b.turns[selected.underlying.Name()] {
+			selected = r
+		}
+	}
+
+	b.turns[selected.underlying.Name()] -= totalWeight
+
+	return selected
+}
+
+// leastOutstanding returns the candidates with the fewest runs in flight relative to their weights.
+func leastOutstanding(candidates []*Runner) []*Runner {
+	var least []*Runner
+	var leastLoad float64
+	for _, r := range candidates {
+		load := float64(r.outstanding()) / float64(r.weight)
+		switch {
+		case least == nil || load < leastLoad:
+			least = []*Runner{r}
+			leastLoad = load
+		case load == leastLoad:
+			least = append(least, r)
+		}
+	}
+
+	return least
+}
@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"testing"
 
+	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/qrunner/stubrunner"
 
 	"github.com/rs/zerolog"
@@ -22,7 +23,7 @@ func TestBalancer_processJob_ConcurrencyLimitExhausted(t *testing.T) {
 	r1 := NewRunner(stubrunner.New(ctx, "runner_1", stubrunner.StubRun), 100, &maxConcurrency)
 	r2 := NewRunner(stubrunner.New(ctx, "runner_2", stubrunner.StubRun), 300, &maxConcurrency)
 
-	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel))
+	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel), "")
 	assert.True(t, b.add(r1))
 	assert.True(t, b.add(r2))
 
@@ -84,7 +85,7 @@ func TestBalancer_selectRunner_EqualWeights(t *testing.T) {
 	// Each runner should be selected samples / runnerCount times roughly.
 
 	ctx := context.Background()
-	b := newBalancer(zlog.Logger)
+	b := newBalancer(zlog.Logger, "")
 
 	var runners []*Runner
 	for i := 0; i < runnerCount; i++ {
@@ -96,7 +97,7 @@ func TestBalancer_selectRunner_EqualWeights(t *testing.T) {
 
 	timesSelected := make(map[*Runner]uint, len(runners))
 	for i := 0; i < samples; i++ {
-		r := b.selectRunner()
+		r := b.selectRunner("")
 		timesSelected[r]++
 	}
 
@@ -117,7 +118,7 @@ func TestBalancer_selectRunner_DifferentWeights(t *testing.T) {
 	var totalWeight float64
 
 	ctx := context.Background()
-	b := newBalancer(zlog.Logger)
+	b := newBalancer(zlog.Logger, "")
 
 	// The weight of the i-th runner is (i + 1) * 100.
 	for i := 0; i < runnerCount; i++ {
@@ -129,7 +130,7 @@ func TestBalancer_selectRunner_DifferentWeights(t *testing.T) {
 
 	timesSelected := make(map[*Runner]uint, len(runners))
 	for i := 0; i < samples; i++ {
-		r := b.selectRunner()
+		r := b.selectRunner("")
 		timesSelected[r]++
 	}
 
@@ -141,3 +142,169 @@ func TestBalancer_selectRunner_DifferentWeights(t *testing.T) {
 		assert.LessOrEqual(t, deviation, maxDeviation)
 	}
 }
+
+func TestBalancer_selectRunner_RoundRobin(t *testing.T) {
+	ctx := context.Background()
+	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel), BalancingRoundRobin)
+
+	r1 := NewRunner(stubrunner.New(ctx, "r1", stubrunner.StubRun), 200, nil)
+	r2 := NewRunner(stubrunner.New(ctx, "r2", stubrunner.StubRun), 100, nil)
+	r3 := NewRunner(stubrunner.New(ctx, "r3", stubrunner.StubRun), 100, nil)
+	assert.True(t, b.add(r1))
+	assert.True(t, b.add(r2))
+	assert.True(t, b.add(r3))
+
+	var selected []string
+	for i := 0; i < 8; i++ {
+		selected = append(selected, b.selectRunner("").underlying.Name())
+	}
+	assert.Equal(t, []string{"r1", "r2", "r3", "r1", "r1", "r2", "r3", "r1"}, selected)
+
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, r1, b.selectRunner("r1"), "the skipped runner must not be selected")
+	}
+}
+
+func TestBalancer_selectRunner_LeastOutstanding(t *testing.T) {
+	ctx := context.Background()
+	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel), BalancingLeastOutstanding)
+
+	r1 := NewRunner(stubrunner.New(ctx, "r1", stubrunner.StubRun), 200, nil)
+	r2 := NewRunner(stubrunner.New(ctx, "r2", stubrunner.StubRun), 100, nil)
+	assert.True(t, b.add(r1))
+	assert.True(t, b.add(r2))
+
+	r1.addConcurrency(3)
+	r2.addConcurrency(1)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, r2, b.selectRunner(""), "r2 has fewer runs in flight relative to its weight")
+	}
+
+	r2.addConcurrency(1)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, r1, b.selectRunner(""))
+	}
+}
+
+func TestBalancer_processJobOn_Preferred(t *testing.T) {
+	ctx := context.Background()
+	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel), "")
+
+	r1 := NewRunner(stubrunner.New(ctx, "r1", stubrunner.StubRun), 1, nil)
+	r2 := NewRunner(stubrunner.New(ctx, "r2", stubrunner.StubRun), 1000, nil)
+	assert.True(t, b.add(r1))
+	assert.True(t, b.add(r2))
+
+	for i := 0; i < 100; i++ {
+		var selected *Runner
+		processed := b.processJobOn("r1", func(r *Runner) {
+			selected = r
+		})
+
+		assert.True(t, processed)
+		assert.Equal(t, r1, selected)
+	}
+
+	// Unknown preferred runner falls back to the weighted choice.
+	processed := b.processJobOn("unknown", func(r *Runner) {})
+	assert.True(t, processed)
+}
+
+func TestBalancer_processJobOnly(t *testing.T) {
+	ctx := context.Background()
+	maxConcurrency := uint32(1)
+
+	r1 := NewRunner(stubrunner.New(ctx, "runner_1", stubrunner.StubRun), 100, &maxConcurrency)
+	r2 := NewRunner(stubrunner.New(ctx, "runner_2", stubrunner.StubRun), 100, nil)
+
+	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel), "")
+	assert.True(t, b.add(r1))
+	assert.True(t, b.add(r2))
+
+	for i := 0; i < 100; i++ {
+		processed := b.processJobOnly("runner_1", func(r *Runner) {
+			assert.Equal(t, r1, r)
+
+			// The concurrency limit is exhausted, another runner cannot be picked instead.
+			assert.False(t, b.processJobOnly("runner_1", func(r *Runner) {}))
+			assert.True(t, b.processJobOn("runner_1", func(r *Runner) {
+				assert.Equal(t, r2, r)
+			}))
+		})
+		assert.True(t, processed)
+	}
+
+	assert.False(t, b.processJobOnly("runner_3", func(r *Runner) {}))
+}
+
+type holdingRunner struct {
+	*stubrunner.Runner
+	held uint32
+}
+
+func (r *holdingRunner) HeldContainers() uint32 {
+	return atomic.LoadUint32(&r.held)
+}
+
+func TestBalancer_processJob_HeldContainers(t *testing.T) {
+	ctx := context.Background()
+	maxConcurrency := uint32(2)
+
+	holder := &holdingRunner{Runner: stubrunner.New(ctx, "runner_1", stubrunner.StubRun), held: 2}
+	r1 := NewRunner(holder, 100, &maxConcurrency)
+	r2 := NewRunner(stubrunner.New(ctx, "runner_2", stubrunner.StubRun), 100, nil)
+
+	b := newBalancer(zlog.Logger.Level(zerolog.ErrorLevel), "")
+	assert.True(t, b.add(r1))
+	assert.True(t, b.add(r2))
+
+	// Held containers exhaust the limit, so the runner is skipped.
+	for i := 0; i < 100; i++ {
+		assert.True(t, b.processJob(func(r *Runner) {
+			assert.Equal(t, r2, r)
+		}))
+	}
+	assert.False(t, b.processJobOnly("runner_1", func(r *Runner) {}))
+
+	// One more run fits when a hold expires.
+	atomic.StoreUint32(&holder.held, 1)
+	assert.True(t, b.processJobOnly("runner_1", func(r *Runner) {
+		assert.False(t, b.processJobOnly("runner_1", func(r *Runner) {}))
+	}))
+}
+
+type throttledRunner struct {
+	*stubrunner.Runner
+	factor float64
+}
+
+func (r *throttledRunner) ConcurrencyFactor() float64 {
+	return r.factor
+}
+
+func (r *throttledRunner) RemediationStatus() qrunner.RemediationStatus {
+	return qrunner.RemediationStatus{Runner: r.Name(), ConcurrencyFactor: r.factor}
+}
+
+func TestRunner_concurrencyLimit(t *testing.T) {
+	ctx := context.Background()
+	maxConcurrency := uint32(5)
+
+	_, limited := NewRunner(stubrunner.New(ctx, "unlimited", stubrunner.StubRun), 100, nil).concurrencyLimit()
+	assert.False(t, limited)
+
+	throttled := &throttledRunner{Runner: stubrunner.New(ctx, "throttled", stubrunner.StubRun), factor: 1}
+	r := NewRunner(throttled, 100, &maxConcurrency)
+
+	limit, limited := r.concurrencyLimit()
+	assert.True(t, limited)
+	assert.Equal(t, uint32(5), limit)
+
+	throttled.factor = 0.5
+	limit, _ = r.concurrencyLimit()
+	assert.Equal(t, uint32(2), limit)
+
+	throttled.factor = 0.01
+	limit, _ = r.concurrencyLimit()
+	assert.Equal(t, uint32(1), limit, "throttled runners keep taking runs")
+}
@@ -0,0 +1,484 @@
+package coordinator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// outcome is what a run tells about the dependency.
+type outcome int
+
+const (
+	// outcomeIgnored runs have not used the dependency or have been canceled by clients.
+	outcomeIgnored outcome = iota
+	outcomeSuccess
+	outcomeFailure
+)
+
+// circuitBreaker tracks failures of a dependency class and rejects runs while the dependency is failing.
+type circuitBreaker struct {
+	dependency qrunner.Dependency
+	// runner is set for daemon circuit breakers, which are kept per runner.
+	runner string
+	cfg    CircuitBreakerConfig
+	logger zerolog.Logger
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    uint
+	failures    uint
+	openedAt    time.Time
+	probing     bool
+	lastError   string
+	rejected    uint64
+}
+
+// newCircuitBreaker creates the circuit breaker of the dependency. The runner is empty
+// unless the dependency is a part of the runner, like its Docker daemon.
+func newCircuitBreaker(logger zerolog.Logger, dependency qrunner.Dependency, runner string, cfg CircuitBreakerConfig) *circuitBreaker {
+	metrics.CircuitBreaker.Transitioned(string(dependency), runner, qrunner.CircuitClosed)
+
+	logCtx := logger.With().Str("dependency", string(dependency))
+	if runner != "" {
+		logCtx = logCtx.Str("runner", runner)
+	}
+
+	return &circuitBreaker{
+		dependency: dependency,
+		runner:     runner,
+		cfg:        cfg,
+		logger:     logCtx.Logger(),
+		state:      qrunner.CircuitClosed,
+	}
+}
+
+// available reports whether allow would let a run through, without taking the probe slot.
+// If it would not, it returns when a probe run is let through next time.
+func (b *circuitBreaker) available(now time.Time) (retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case qrunner.CircuitOpen:
+		retryAt := b.openedAt.Add(b.cfg.OpenDuration)
+		if now.Before(retryAt) {
+			return retryAt.Sub(now), false
+		}
+
+	case qrunner.CircuitHalfOpen:
+		if b.probing {
+			return b.cfg.OpenDuration, false
+		}
+	}
+
+	return 0, true
+}
+
+// allow checks whether a run can use the dependency. If the circuit has been open for OpenDuration,
+// the run is let through as a probe, and its outcome must be recorded with probe set.
+// It fails with qrunner.CircuitOpenError if the run must be rejected.
+func (b *circuitBreaker) allow(now time.Time) (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case qrunner.CircuitOpen:
+		retryAt := b.openedAt.Add(b.cfg.OpenDuration)
+		if now.Before(retryAt) {
+			return false, b.reject(retryAt.Sub(now))
+		}
+
+		b.transition(qrunner.CircuitHalfOpen, nil)
+		b.probing = true
+
+		return true, nil
+
+	case qrunner.CircuitHalfOpen:
+		if b.probing {
+			return false, b.reject(b.cfg.OpenDuration)
+		}
+
+		b.probing = true
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// reject must be called under the taken lock.
+func (b *circuitBreaker) reject(retryAfter time.Duration) error {
+	return &qrunner.CircuitOpenError{Dependency: b.dependency, RetryAfter: retryAfter}
+}
+
+// countRejected counts the run that has been rejected because of the open circuit.
+func (b *circuitBreaker) countRejected() {
+	b.mu.Lock()
+	b.rejected++
+	b.mu.Unlock()
+
+	metrics.CircuitBreaker.Rejected(string(b.dependency), b.runner)
+}
+
+// record counts the outcome of a run. A failed probe opens the circuit again, a successful one closes it.
+// If the probe has not used the dependency, the next run becomes the probe.
+func (b *circuitBreaker) record(now time.Time, probe bool, o outcome, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if o == outcomeFailure && err != nil {
+		b.lastError = err.Error()
+	}
+
+	if probe {
+		b.probing = false
+
+		switch o {
+		case outcomeSuccess:
+			b.transition(qrunner.CircuitClosed, nil)
+			b.resetWindow(now)
+		case outcomeFailure:
+			b.open(now, err)
+		}
+
+		return
+	}
+
+	// Outcomes of runs dispatched before the circuit has been opened are not counted.
+	if b.state != qrunner.CircuitClosed || o == outcomeIgnored {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.resetWindow(now)
+	}
+
+	b.requests++
+	if o == outcomeFailure {
+		b.failures++
+	}
+
+	if b.requests >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.FailureRate*float64(b.requests) {
+		b.open(now, err)
+	}
+}
+
+// open must be called under the taken lock.
+func (b *circuitBreaker) open(now time.Time, err error) {
+	b.openedAt = now
+	b.transition(qrunner.CircuitOpen, err)
+}
+
+// resetWindow must be called under the taken lock.
+func (b *circuitBreaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// transition must be called under the taken lock.
+func (b *circuitBreaker) transition(state string, err error) {
+	if b.state == state {
+		return
+	}
+
+	b.logger.Warn().
+		Err(err).
+		Str("from", b.state).
+		Str("to", state).
+		Uint("requests", b.requests).
+		Uint("failures", b.failures).
+		Msg("circuit breaker state has been changed")
+
+	b.state = state
+	metrics.CircuitBreaker.Transitioned(string(b.dependency), b.runner, state)
+}
+
+// reset closes the circuit and drops the counters.
+func (b *circuitBreaker) reset(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.transition(qrunner.CircuitClosed, nil)
+	b.resetWindow(now)
+	b.openedAt = time.Time{}
+	b.probing = false
+}
+
+func (b *circuitBreaker) status() qrunner.CircuitBreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return qrunner.CircuitBreakerStatus{
+		Dependency: b.dependency,
+		Runner:     b.runner,
+		State:      b.state,
+		Requests:   b.requests,
+		Failures:   b.failures,
+		OpenedAt:   b.openedAt,
+		LastError:  b.lastError,
+		Rejected:   b.rejected,
+	}
+}
+
+// dependencyOutcome classifies the result of the run for the dependency.
+// Runs canceled by clients tell nothing about dependencies. A run that has hit its deadline is counted
+// only as a failure of the dependency it has been waiting for, e.g. a daemon call that has not returned.
+func dependencyOutcome(ctx context.Context, dependency qrunner.Dependency, run *queryrun.Run, err error) outcome {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return outcomeIgnored
+	}
+	deadlineHit := ctx.Err() != nil
+
+	var depErr *qrunner.DependencyError
+	if errors.As(err, &depErr) {
+		var timeoutErr *qrunner.QueryTimeoutError
+		if depErr.Dependency == dependency && !errors.As(err, &timeoutErr) {
+			return outcomeFailure
+		}
+
+		// The run has not reached the daemon if the registry has failed.
+		if dependency == qrunner.DependencyDaemon {
+			return outcomeIgnored
+		}
+	}
+
+	// A lost daemon connection and a daemon call that has timed out before the run deadline are daemon failures
+	// even if the runner has not marked them.
+	if dependency == qrunner.DependencyDaemon &&
+		(errors.Is(err, qrunner.ErrRunnerDisconnected) || (!deadlineHit && errors.Is(err, context.DeadlineExceeded))) {
+		return outcomeFailure
+	}
+
+	if deadlineHit {
+		return outcomeIgnored
+	}
+
+	if dependency == qrunner.DependencyRegistry && !qrunner.PulledFromRegistry(run) {
+		return outcomeIgnored
+	}
+
+	return outcomeSuccess
+}
+
+// admission is the permission of circuit breakers to dispatch the run.
+type admission struct {
+	probes map[qrunner.Dependency]bool
+
+	// runner is set if only this runner can execute the run, because the registry circuit is open
+	// and the runner has already pulled the image.
+	runner string
+}
+
+// admit checks the circuit breakers before the run is dispatched. Runs are rejected while the daemon circuits
+// of all runners that could execute them are open. While the registry circuit is open, runs are dispatched
+// only to runners that don't need to pull the image.
+func (c *Coordinator) admit(ctx context.Context, run *queryrun.Run) (admission, error) {
+	a := admission{probes: make(map[qrunner.Dependency]bool, len(c.breakers))}
+	now := time.Now()
+
+	err := c.checkDaemons(run, now)
+	if err != nil {
+		return a, err
+	}
+
+	registryProbe, err := c.breakers[qrunner.DependencyRegistry].allow(now)
+	if err != nil {
+		holder := c.findImageHolder(ctx, run)
+		if holder == "" {
+			c.breakers[qrunner.DependencyRegistry].countRejected()
+			c.release(a)
+
+			return a, err
+		}
+
+		a.runner = holder
+	}
+	a.probes[qrunner.DependencyRegistry] = registryProbe
+
+	return a, nil
+}
+
+// checkDaemons rejects the run if the daemon circuits of all alive runners that could execute it are open.
+// Otherwise, the balancer selects one of the runners whose daemon circuit lets the run through.
+func (c *Coordinator) checkDaemons(run *queryrun.Run, now time.Time) error {
+	var open []*circuitBreaker
+	var retryAfter time.Duration
+	for _, r := range c.runners {
+		if r.weight == 0 || !r.IsAlive() || (run.TargetRunner != "" && r.underlying.Name() != run.TargetRunner) {
+			continue
+		}
+
+		wait, ok := r.daemon.available(now)
+		if ok {
+			return nil
+		}
+		if len(open) == 0 || wait < retryAfter {
+			retryAfter = wait
+		}
+		open = append(open, r.daemon)
+	}
+
+	// If no runner is alive, the balancer reports that there are no available runners.
+	if len(open) == 0 {
+		return nil
+	}
+
+	for _, b := range open {
+		b.countRejected()
+	}
+
+	return &qrunner.CircuitOpenError{Dependency: qrunner.DependencyDaemon, RetryAfter: retryAfter}
+}
+
+// runDaemonGuarded executes the run on the runner if its daemon circuit lets the run through,
+// and counts the outcome by the circuit.
+func runDaemonGuarded(ctx context.Context, r *Runner, run *queryrun.Run) (qrunner.Result, error) {
+	if r.daemon == nil {
+		return r.underlying.RunQuery(ctx, run)
+	}
+
+	probe, err := r.daemon.allow(time.Now())
+	if err != nil {
+		// Another run has taken the probe slot since the runner has been selected.
+		r.daemon.countRejected()
+		return qrunner.Result{}, err
+	}
+
+	res, err := r.underlying.RunQuery(ctx, run)
+	r.daemon.record(time.Now(), probe, dependencyOutcome(ctx, qrunner.DependencyDaemon, run, err), err)
+
+	return res, err
+}
+
+// release returns probe slots of the run that has not been dispatched.
+func (c *Coordinator) release(a admission) {
+	now := time.Now()
+	for dependency, probe := range a.probes {
+		if probe {
+			c.breakers[dependency].record(now, true, outcomeIgnored, nil)
+		}
+	}
+}
+
+// recordOutcome counts the result of the dispatched run by the circuit breakers.
+func (c *Coordinator) recordOutcome(ctx context.Context, a admission, run *queryrun.Run, err error) {
+	now := time.Now()
+	for dependency, b := range c.breakers {
+		o := dependencyOutcome(ctx, dependency, run, err)
+		b.record(now, a.probes[dependency], o, err)
+	}
+}
+
+// findImageHolder returns an alive runner that has already pulled the image of the run.
+// It returns an empty string if there is no such runner.
+func (c *Coordinator) findImageHolder(ctx context.Context, run *queryrun.Run) string {
+	for _, r := range c.runners {
+		name := r.underlying.Name()
+		if r.weight == 0 || !r.IsAlive() || !r.daemonAvailable(time.Now()) || (run.TargetRunner != "" && name != run.TargetRunner) {
+			continue
+		}
+
+		holder, ok := r.underlying.(qrunner.ImageHolder)
+		if !ok {
+			continue
+		}
+
+		present, err := holder.HasImage(ctx, run.Version)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("runner", name).Str("version", run.Version).Msg("failed to check image presence")
+			continue
+		}
+		if present {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// dependencyBreakers returns the circuit breakers of the dependency: the daemon has one per runner.
+// It returns nil if circuit breakers are disabled or the dependency is unknown.
+func (c *Coordinator) dependencyBreakers(dependency qrunner.Dependency) []*circuitBreaker {
+	if c.breakers == nil {
+		return nil
+	}
+
+	if dependency == qrunner.DependencyDaemon {
+		breakers := make([]*circuitBreaker, 0, len(c.runners))
+		for _, r := range c.runners {
+			breakers = append(breakers, r.daemon)
+		}
+
+		return breakers
+	}
+
+	if b, found := c.breakers[dependency]; found {
+		return []*circuitBreaker{b}
+	}
+
+	return nil
+}
+
+// CircuitBreakers returns the state of the circuit breakers. It returns nil if they are disabled.
+func (c *Coordinator) CircuitBreakers() []qrunner.CircuitBreakerStatus {
+	if c.breakers == nil {
+		return nil
+	}
+
+	statuses := make([]qrunner.CircuitBreakerStatus, 0, len(c.breakers)+len(c.runners))
+	for _, dependency := range qrunner.Dependencies {
+		for _, b := range c.dependencyBreakers(dependency) {
+			statuses = append(statuses, b.status())
+		}
+	}
+
+	return statuses
+}
+
+// ResetCircuitBreaker closes the circuits of the dependency, so runs are dispatched right away.
+// Daemon circuits of all runners are reset at once.
+// It fails with qrunner.ErrUnknownDependency if there is no such circuit breaker.
+func (c *Coordinator) ResetCircuitBreaker(dependency string) error {
+	breakers := c.dependencyBreakers(qrunner.Dependency(dependency))
+	if len(breakers) == 0 {
+		return errors.Wrap(qrunner.ErrUnknownDependency, dependency)
+	}
+
+	now := time.Now()
+	for _, b := range breakers {
+		b.reset(now)
+	}
+	c.logger.Info().Str("dependency", dependency).Msg("circuit breaker has been reset")
+
+	return nil
+}
+
+// CheckCircuit returns a health probe that fails while a circuit of the dependency is not closed.
+func (c *Coordinator) CheckCircuit(dependency qrunner.Dependency) func(ctx context.Context) error {
+	return func(context.Context) error {
+		for _, b := range c.dependencyBreakers(dependency) {
+			status := b.status()
+			if status.State == qrunner.CircuitClosed {
+				continue
+			}
+
+			if status.Runner != "" {
+				return errors.Errorf("circuit of runner %s is %s: %s", status.Runner, status.State, status.LastError)
+			}
+
+			return errors.Errorf("circuit is %s: %s", status.State, status.LastError)
+		}
+
+		return nil
+	}
+}
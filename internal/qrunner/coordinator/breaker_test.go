@@ -0,0 +1,212 @@
+package coordinator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/qrunner/stubrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(zerolog.Nop(), qrunner.DependencyDaemon, "runner", CircuitBreakerConfig{
+		FailureRate:  0.5,
+		MinRequests:  4,
+		Window:       time.Minute,
+		OpenDuration: 10 * time.Second,
+	})
+	failure := errors.New("container run failed")
+	now := time.Now()
+
+	b.record(now, false, outcomeSuccess, nil)
+	b.record(now, false, outcomeFailure, failure)
+	b.record(now, false, outcomeIgnored, nil)
+	b.record(now, false, outcomeFailure, failure)
+	assert.Equal(t, qrunner.CircuitClosed, b.status().State, "too few runs to open the circuit")
+
+	b.record(now, false, outcomeSuccess, nil)
+	assert.Equal(t, qrunner.CircuitOpen, b.status().State)
+
+	_, err := b.allow(now.Add(time.Second))
+	var circuitErr *qrunner.CircuitOpenError
+	require.ErrorAs(t, err, &circuitErr)
+	assert.Equal(t, 9*time.Second, circuitErr.RetryAfter)
+	assert.ErrorIs(t, err, qrunner.ErrNoAvailableRunners)
+
+	// A single probe is let through after the open duration.
+	probe, err := b.allow(now.Add(10 * time.Second))
+	require.NoError(t, err)
+	assert.True(t, probe)
+	assert.Equal(t, qrunner.CircuitHalfOpen, b.status().State)
+
+	_, err = b.allow(now.Add(10 * time.Second))
+	assert.Error(t, err, "only one probe is in flight")
+
+	b.record(now.Add(11*time.Second), true, outcomeFailure, failure)
+	assert.Equal(t, qrunner.CircuitOpen, b.status().State)
+
+	probe, err = b.allow(now.Add(21 * time.Second))
+	require.NoError(t, err)
+	require.True(t, probe)
+	b.record(now.Add(22*time.Second), true, outcomeSuccess, nil)
+
+	status := b.status()
+	assert.Equal(t, qrunner.CircuitClosed, status.State)
+	assert.Zero(t, status.Requests)
+	assert.Equal(t, failure.Error(), status.LastError)
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	b := newCircuitBreaker(zerolog.Nop(), qrunner.DependencyRegistry, "", CircuitBreakerConfig{
+		FailureRate:  0.5,
+		MinRequests:  2,
+		Window:       time.Minute,
+		OpenDuration: time.Minute,
+	})
+	now := time.Now()
+
+	b.record(now, false, outcomeFailure, errors.New("docker pull failed"))
+	b.record(now.Add(2*time.Minute), false, outcomeSuccess, nil)
+	assert.Equal(t, qrunner.CircuitClosed, b.status().State, "failures of past windows are not counted")
+
+	b.record(now.Add(2*time.Minute), false, outcomeFailure, errors.New("docker pull failed"))
+	assert.Equal(t, qrunner.CircuitOpen, b.status().State)
+
+	b.reset(now.Add(3 * time.Minute))
+	probe, err := b.allow(now.Add(3 * time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, probe)
+}
+
+func TestDependencyOutcome(t *testing.T) {
+	pulled := &queryrun.Run{Timeline: queryrun.NewTimeline()}
+	pulled.Timeline.RecordSource(queryrun.StageImagePull, time.Now(), "upstream")
+
+	local := &queryrun.Run{Timeline: queryrun.NewTimeline()}
+	local.Timeline.RecordSource(queryrun.StageImagePull, time.Now(), qrunner.PullSourceLocal)
+
+	registryErr := &qrunner.DependencyError{Dependency: qrunner.DependencyRegistry, Err: errors.New("docker pull failed")}
+	daemonErr := errors.Wrap(&qrunner.DependencyError{Dependency: qrunner.DependencyDaemon, Err: errors.New("exec failed")}, "failed")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	callTimedOut := errors.Wrap(context.DeadlineExceeded, "container inspect failed")
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		dependency qrunner.Dependency
+		run        *queryrun.Run
+		err        error
+		outcome    outcome
+	}{
+		{name: "daemon ok", dependency: qrunner.DependencyDaemon, run: local, outcome: outcomeSuccess},
+		{name: "daemon failed", dependency: qrunner.DependencyDaemon, run: local, err: daemonErr, outcome: outcomeFailure},
+		{name: "query failed", dependency: qrunner.DependencyDaemon, run: local, err: errors.New("syntax error"), outcome: outcomeSuccess},
+		{name: "registry failed before daemon", dependency: qrunner.DependencyDaemon, run: pulled, err: registryErr, outcome: outcomeIgnored},
+		{name: "registry failed", dependency: qrunner.DependencyRegistry, run: pulled, err: registryErr, outcome: outcomeFailure},
+		{name: "pulled", dependency: qrunner.DependencyRegistry, run: pulled, outcome: outcomeSuccess},
+		{name: "not pulled", dependency: qrunner.DependencyRegistry, run: local, outcome: outcomeIgnored},
+		{name: "canceled", ctx: canceled, dependency: qrunner.DependencyDaemon, run: local, err: daemonErr, outcome: outcomeIgnored},
+		{name: "daemon hung until deadline", ctx: expired, dependency: qrunner.DependencyDaemon, run: local, err: daemonErr, outcome: outcomeFailure},
+		{name: "registry hung until deadline", ctx: expired, dependency: qrunner.DependencyRegistry, run: pulled, err: registryErr, outcome: outcomeFailure},
+		{name: "query hit deadline", ctx: expired, dependency: qrunner.DependencyDaemon, run: local, err: errors.New("query timed out"), outcome: outcomeIgnored},
+		{name: "daemon call timed out", dependency: qrunner.DependencyDaemon, run: local, err: callTimedOut, outcome: outcomeFailure},
+		{name: "disconnected", dependency: qrunner.DependencyDaemon, run: local, err: qrunner.ErrRunnerDisconnected, outcome: outcomeFailure},
+		{name: "disconnected before registry", dependency: qrunner.DependencyRegistry, run: local, err: qrunner.ErrRunnerDisconnected, outcome: outcomeIgnored},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			assert.Equal(t, tt.outcome, dependencyOutcome(ctx, tt.dependency, tt.run, tt.err))
+		})
+	}
+}
+
+func TestCoordinator_DaemonCircuitPerRunner(t *testing.T) {
+	ctx := context.Background()
+	daemonErr := &qrunner.DependencyError{Dependency: qrunner.DependencyDaemon, Err: errors.New("container run failed")}
+
+	var healthyErr error
+	failing := stubrunner.New(ctx, "failing", func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{}, daemonErr
+	})
+	healthy := stubrunner.New(ctx, "healthy", func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stdout: "1"}, healthyErr
+	})
+
+	runners := []*Runner{NewRunner(failing, DefaultWeight, nil), NewRunner(healthy, DefaultWeight, nil)}
+	c := New(ctx, zerolog.Nop(), runners, Config{CircuitBreaker: &CircuitBreakerConfig{
+		FailureRate:  0.5,
+		MinRequests:  1,
+		Window:       time.Minute,
+		OpenDuration: time.Minute,
+	}})
+	for _, r := range runners {
+		r.setAlive(true)
+		c.balancer.add(r)
+	}
+
+	newRun := func(target string) *queryrun.Run {
+		return &queryrun.Run{ID: "run", Version: "23.3", TargetRunner: target, Timeline: queryrun.NewTimeline()}
+	}
+
+	_, err := c.RunQuery(ctx, newRun("failing"))
+	require.ErrorIs(t, err, daemonErr)
+
+	_, err = c.RunQuery(ctx, newRun("failing"))
+	var circuitErr *qrunner.CircuitOpenError
+	require.ErrorAs(t, err, &circuitErr, "the daemon circuit of the runner is open")
+	assert.Equal(t, qrunner.DependencyDaemon, circuitErr.Dependency)
+
+	// Other runners are not affected by the failing daemon.
+	for i := 0; i < 5; i++ {
+		run := newRun("")
+		res, err := c.RunQuery(ctx, run)
+		require.NoError(t, err)
+		assert.Equal(t, "1", res.Stdout)
+		assert.Equal(t, "healthy", run.Runner)
+	}
+
+	statuses := c.CircuitBreakers()
+	require.Len(t, statuses, 3)
+	assert.Equal(t, "failing", statuses[0].Runner)
+	assert.Equal(t, qrunner.CircuitOpen, statuses[0].State)
+	assert.Equal(t, "healthy", statuses[1].Runner)
+	assert.Equal(t, qrunner.CircuitClosed, statuses[1].State)
+	assert.Equal(t, qrunner.DependencyRegistry, statuses[2].Dependency)
+	assert.Error(t, c.CheckCircuit(qrunner.DependencyDaemon)(ctx))
+
+	// Runs are rejected once daemons of all runners are failing.
+	// The daemon calls time out now. The runner has served 5 runs, so 5 failures open its circuit at 0.5.
+	healthyErr = errors.Wrap(context.DeadlineExceeded, "exec failed")
+	for i := 0; i < 5; i++ {
+		_, err = c.RunQuery(ctx, newRun(""))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+
+	_, err = c.RunQuery(ctx, newRun(""))
+	require.ErrorAs(t, err, &circuitErr)
+	assert.ErrorIs(t, err, qrunner.ErrNoAvailableRunners)
+
+	require.NoError(t, c.ResetCircuitBreaker(string(qrunner.DependencyDaemon)))
+	for _, s := range c.CircuitBreakers() {
+		assert.Equal(t, qrunner.CircuitClosed, s.State)
+	}
+}
@@ -1,12 +1,142 @@
 package coordinator
 
-import "time"
+import (
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+)
 
 type Config struct {
 	HealthChecksEnabled bool
 
 	// Delay between two health checks to a runner.
 	HealthCheckRetryDelay time.Duration
+
+	// Balancing is the strategy runs are distributed among runners by.
+	// If it's empty, BalancingWeightedRandom is used.
+	Balancing Balancing
+
+	// RetryOnAnotherRunner executes a run once more on another runner if the Docker daemon
+	// of the selected runner has failed it. Runs targeting a runner are never retried.
+	RetryOnAnotherRunner bool
+
+	// WarmPool enables sizing of runners' warm pools by version popularity. If it's nil, warm containers
+	// are started only after runs of their versions.
+	WarmPool *WarmPoolConfig
+
+	// Scheduler queues runs by priority while runners are busy. If it's nil, runs are dispatched right away
+	// and rejected with qrunner.ErrNoAvailableRunners if all runners are busy.
+	Scheduler *SchedulerConfig
+
+	// CircuitBreaker rejects runs right away while the Docker daemon or the registries are failing.
+	// If it's nil, every run makes a full attempt.
+	CircuitBreaker *CircuitBreakerConfig
+}
+
+// Balancing is a strategy of selecting runners. Every strategy honors weights of runners
+// and skips runners that are dead or have their concurrency limits exhausted.
+type Balancing string
+
+const (
+	// BalancingWeightedRandom selects runners randomly in proportion to their weights.
+	BalancingWeightedRandom Balancing = "weighted_random"
+	// BalancingRoundRobin selects runners in turn, a runner takes turns in proportion to its weight.
+	BalancingRoundRobin Balancing = "round_robin"
+	// BalancingLeastOutstanding selects the runner with the fewest runs in flight relative to its weight.
+	BalancingLeastOutstanding Balancing = "least_outstanding"
+)
+
+// CircuitBreakerConfig configures the circuit breakers of the dependency classes.
+// A circuit is opened when the share of runs failed because of the dependency over the window reaches FailureRate.
+// While it's open, new runs are rejected, and a single probe run is let through every OpenDuration.
+// The circuit is closed after a successful probe.
+type CircuitBreakerConfig struct {
+	// FailureRate is the share of failed runs in (0, 1] that opens the circuit.
+	FailureRate float64
+
+	// MinRequests is how many runs the window must have before the failure rate is considered.
+	MinRequests uint
+
+	// Window is the period the runs are counted over. Counters are reset when it's over.
+	Window time.Duration
+
+	// OpenDuration is how long runs are rejected before a probe run is let through.
+	OpenDuration time.Duration
 }
 
-const DefaultHealthCheckRetryDelay = 10 * time.Second
+// WarmPoolConfig configures the feedback loop between runs and warm pools of runners.
+type WarmPoolConfig struct {
+	// How often warm pools are resized.
+	ResizeInterval time.Duration
+
+	// Runs counted by version popularity weigh half as much after every HalfLife.
+	HalfLife time.Duration
+
+	// Hints is optional. If it's set, the popularity is saved on stop and restored on start,
+	// so warm pools are refilled right after a restart. Otherwise, warm pools start empty.
+	Hints *WarmPoolHintsConfig
+}
+
+// WarmPoolHintsConfig configures the popularity saved across restarts.
+type WarmPoolHintsConfig struct {
+	// Path is the file the hints are saved to.
+	Path string
+
+	// Loaded is optional. If it's set, hints are restored once it's closed, e.g. when the tags have been loaded.
+	Loaded <-chan struct{}
+
+	// Exists is optional. If it's set, hints of versions it doesn't know are dropped.
+	Exists func(version string) bool
+}
+
+// SchedulerConfig configures dispatching of runs by priority classes.
+// While runs of several classes are waiting, every class gets a share of dispatches proportional to its weight,
+// so lower classes are slowed down, but never starved.
+type SchedulerConfig struct {
+	// Capacity is how many runs can be dispatched to runners at once.
+	// It should not exceed the total concurrency of runners.
+	Capacity uint
+
+	// QueueTimeout limits the time a run waits for dispatch. Runs waiting longer are rejected
+	// with qrunner.ErrNoAvailableRunners.
+	QueueTimeout time.Duration
+
+	// MaxQueued limits runs of all classes waiting for dispatch. If it's 0, the queue is not limited.
+	MaxQueued uint
+
+	// Classes are keyed by queryrun priorities. Missing classes get the default weight and no limits.
+	Classes map[string]SchedulerClassConfig
+}
+
+type SchedulerClassConfig struct {
+	// Weight is the share of dispatches the class gets while other classes are waiting too.
+	Weight uint
+
+	// MaxConcurrency limits runs of the class in flight, so the rest of the capacity stays for other classes.
+	// If it's 0, only the capacity limits the class.
+	MaxConcurrency uint
+
+	// MaxQueued limits runs of the class waiting for dispatch. If it's 0, the queue is not limited.
+	MaxQueued uint
+}
+
+// DefaultSchedulerWeights are weights of the priority classes that are not configured explicitly.
+var DefaultSchedulerWeights = map[string]uint{
+	queryrun.PriorityInteractive: 8,
+	queryrun.PriorityAsync:       3,
+	queryrun.PriorityBackground:  1,
+}
+
+const (
+	DefaultHealthCheckRetryDelay = 10 * time.Second
+
+	DefaultWarmPoolResizeInterval = time.Minute
+	DefaultWarmPoolHalfLife       = time.Hour
+
+	DefaultSchedulerQueueTimeout = 10 * time.Second
+
+	DefaultCircuitFailureRate  = 0.5
+	DefaultCircuitMinRequests  = 10
+	DefaultCircuitWindow       = time.Minute
+	DefaultCircuitOpenDuration = 30 * time.Second
+)
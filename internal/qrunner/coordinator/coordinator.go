@@ -2,10 +2,12 @@ package coordinator
 
 import (
 	"context"
-	"sync"
+	"os"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"clickhouse-playground/internal/metrics"
 	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/queryrun"
 
@@ -18,33 +20,65 @@ const DefaultLivenessCheckTimeout = 5 * time.Second
 // Coordinator is a runner that does load balancing among other runners.
 // It keeps list of existing runners and dispatches incoming queries to one of them.
 //
-// At the moment, the coordinator just picks a random runner. There are plans to improve load balancing
-// mechanisms in the future: use P2C, send health checks and monitor liveness.
+// Runners are selected by the configured balancing strategy among alive runners which concurrency limits
+// have not been exhausted. Fallback runners are selected only if there is no such primary runner.
 type Coordinator struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	config             Config
-	livenessCheckLoops sync.WaitGroup
+	config Config
+
+	// tasks are the liveness check loops and the warm pool sizing.
+	tasks *qrunner.TaskGroup
 
 	logger  zerolog.Logger
 	started int32
 
 	runners  []*Runner
 	balancer *balancer
+
+	// popularity is nil if warm pool sizing is disabled.
+	popularity *qrunner.Popularity
+	// hintsRestored is set once the saved popularity has been restored or there has been nothing to restore.
+	hintsRestored atomic.Bool
+
+	// scheduler is nil if runs are dispatched right away.
+	scheduler *scheduler
+
+	// breakers are nil if circuit breakers are disabled. Daemon circuit breakers are kept by the runners.
+	breakers map[qrunner.Dependency]*circuitBreaker
 }
 
 func New(ctx context.Context, logger zerolog.Logger, runners []*Runner, cfg Config) *Coordinator {
 	ctx, cancel := context.WithCancel(ctx)
 
-	return &Coordinator{
+	c := &Coordinator{
 		ctx:      ctx,
 		cancel:   cancel,
 		config:   cfg,
 		logger:   logger.With().Str("runner", "coordinator").Logger(),
 		runners:  runners,
-		balancer: newBalancer(logger),
+		balancer: newBalancer(logger, cfg.Balancing),
+	}
+	c.tasks = qrunner.NewTaskGroup(c.logger, c.Name())
+	if cfg.WarmPool != nil {
+		c.popularity = qrunner.NewPopularity(cfg.WarmPool.HalfLife)
+	}
+	if cfg.Scheduler != nil {
+		c.scheduler = newScheduler(*cfg.Scheduler)
+	}
+	if cfg.CircuitBreaker != nil {
+		c.breakers = map[qrunner.Dependency]*circuitBreaker{
+			qrunner.DependencyRegistry: newCircuitBreaker(c.logger, qrunner.DependencyRegistry, "", *cfg.CircuitBreaker),
+		}
+
+		// Daemons of runners fail independently, so a failing one must not stop runs on the others.
+		for _, r := range runners {
+			r.daemon = newCircuitBreaker(c.logger, qrunner.DependencyDaemon, r.underlying.Name(), *cfg.CircuitBreaker)
+		}
 	}
+
+	return c
 }
 
 func (c *Coordinator) Type() qrunner.Type {
@@ -79,8 +113,10 @@ func (c *Coordinator) Start() error {
 		count++
 
 		if c.config.HealthChecksEnabled {
-			c.livenessCheckLoops.Add(1)
-			go c.loopCheckLiveness(r)
+			r := r
+			c.tasks.Go("liveness-check", func() {
+				c.loopCheckLiveness(r)
+			})
 		}
 	}
 
@@ -90,15 +126,164 @@ func (c *Coordinator) Start() error {
 
 	c.logger.Info().Uint("count", count).Msg("underlying runners have been started")
 
+	if c.popularity != nil {
+		c.tasks.Go("warm-pool-resize", c.loopResizeWarmPools)
+		if c.config.WarmPool.Hints != nil {
+			c.tasks.Go("warm-pool-restore", c.restoreWarmPools)
+		}
+	}
+
 	return nil
 }
 
+// loopResizeWarmPools periodically distributes warm containers of alive runners by version popularity.
+func (c *Coordinator) loopResizeWarmPools() {
+	t := time.NewTicker(c.config.WarmPool.ResizeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-t.C:
+		}
+
+		c.resizeWarmPools(true)
+	}
+}
+
+// resizeWarmPools distributes warm containers of the runners by the current popularity.
+func (c *Coordinator) resizeWarmPools(aliveOnly bool) {
+	popularity := c.popularity.Snapshot(time.Now())
+	for _, r := range c.runners {
+		resizer, ok := r.underlying.(qrunner.WarmPoolResizer)
+		if !ok || r.weight == 0 || (aliveOnly && !r.IsAlive()) {
+			continue
+		}
+
+		resizer.ResizeWarmPool(popularity)
+	}
+}
+
+// restoreWarmPools restores the popularity saved by the previous process and resizes warm pools right away,
+// so they are refilled before the popularity of new runs is counted. Hints of versions that don't resolve
+// anymore are dropped. Runners that have not passed a liveness probe yet are resized as well:
+// they have been started, and the daemon of a dead runner just fails to start containers.
+func (c *Coordinator) restoreWarmPools() {
+	hintsCfg := c.config.WarmPool.Hints
+
+	hints, err := qrunner.LoadWarmPoolHints(hintsCfg.Path)
+	if err != nil {
+		c.hintsRestored.Store(true)
+		if errors.Is(err, os.ErrNotExist) {
+			c.logger.Info().Str("path", hintsCfg.Path).Msg("there are no warm pool hints to restore")
+		} else {
+			c.logger.Warn().Err(err).Str("path", hintsCfg.Path).Msg("warm pool hints cannot be restored")
+		}
+
+		return
+	}
+
+	// Versions are resolved by the tag storage, so hints are checked once it has been loaded.
+	if hintsCfg.Loaded != nil {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-hintsCfg.Loaded:
+		}
+	}
+
+	for version := range hints.Popularity {
+		if hintsCfg.Exists != nil && !hintsCfg.Exists(version) {
+			c.logger.Info().Str("version", version).Msg("stale warm pool hint has been dropped")
+			delete(hints.Popularity, version)
+		}
+	}
+
+	c.popularity.Restore(hints.Popularity, hints.SavedAt, time.Now())
+	c.hintsRestored.Store(true)
+	c.resizeWarmPools(false)
+
+	c.logger.Info().Int("versions", len(hints.Popularity)).Time("saved_at", hints.SavedAt).
+		Msg("warm pools have been restored from hints")
+}
+
+// saveWarmPoolHints saves the popularity, so the next process restores warm pools right after the start.
+// If the hints have not been restored yet, they are kept as is, since the process has not served enough runs
+// to replace them.
+func (c *Coordinator) saveWarmPoolHints() {
+	if !c.hintsRestored.Load() {
+		c.logger.Info().Msg("warm pool hints have not been restored yet, they are kept")
+		return
+	}
+
+	hints := qrunner.WarmPoolHints{
+		SavedAt:    time.Now(),
+		Popularity: c.popularity.Snapshot(time.Now()),
+	}
+
+	err := qrunner.SaveWarmPoolHints(c.config.WarmPool.Hints.Path, hints)
+	if err != nil {
+		c.logger.Err(err).Msg("warm pool hints cannot be saved")
+		return
+	}
+
+	c.logger.Info().Int("versions", len(hints.Popularity)).Msg("warm pool hints have been saved")
+}
+
+// WarmPools returns the latest warm pool allocations of the underlying runners.
+func (c *Coordinator) WarmPools() []qrunner.WarmPoolAllocation {
+	var allocations []qrunner.WarmPoolAllocation
+	for _, r := range c.runners {
+		if resizer, ok := r.underlying.(qrunner.WarmPoolResizer); ok {
+			allocations = append(allocations, resizer.WarmPoolAllocation())
+		}
+	}
+
+	return allocations
+}
+
+// SchedulerClasses returns the state of the priority classes of the scheduler.
+// It returns nil if the scheduler is disabled.
+func (c *Coordinator) SchedulerClasses() []qrunner.SchedulerClass {
+	if c.scheduler == nil {
+		return nil
+	}
+
+	return c.scheduler.status()
+}
+
+// GCReports returns reports of recent garbage collection passes of the underlying runners.
+// Reports of every runner are ordered from the latest one.
+func (c *Coordinator) GCReports() []qrunner.GCReport {
+	var reports []qrunner.GCReport
+	for _, r := range c.runners {
+		if reporter, ok := r.underlying.(qrunner.GCReporter); ok {
+			reports = append(reports, reporter.GCReports()...)
+		}
+	}
+
+	return reports
+}
+
+// Remediations returns remediations of container failures applied by the underlying runners.
+func (c *Coordinator) Remediations() []qrunner.RemediationStatus {
+	var statuses []qrunner.RemediationStatus
+	for _, r := range c.runners {
+		if remediator, ok := r.underlying.(qrunner.Remediator); ok {
+			statuses = append(statuses, remediator.RemediationStatus())
+		}
+	}
+
+	return statuses
+}
+
 // loopCheckLiveness periodically sends liveness probes to the provided runner.
 // If the runner does not respond, it's marked as dead and excluded from load balancing.
 // When the runner passes a liveness probe, it's included in load balancing.
 func (c *Coordinator) loopCheckLiveness(r *Runner) {
-	defer c.livenessCheckLoops.Done()
-
 	rlogger := c.logger.With().Str("underlying_runner", r.underlying.Name()).Logger()
 	rlogger.Debug().Dur("retry_delay_ms", c.config.HealthCheckRetryDelay).Msg("liveness loop has been started")
 
@@ -145,12 +330,66 @@ func (c *Coordinator) loopCheckLiveness(r *Runner) {
 	}
 }
 
+// PingRunner checks that the daemon of the runner responds.
+func (c *Coordinator) PingRunner(ctx context.Context, name string) error {
+	for _, r := range c.runners {
+		if r.underlying.Name() != name {
+			continue
+		}
+
+		status := r.underlying.Status(ctx)
+		if !status.Alive {
+			return errors.Wrap(status.LivenessProbeErr, "runner is not alive")
+		}
+
+		return nil
+	}
+
+	return errors.Errorf("unknown runner %s", name)
+}
+
+// CheckAlive fails if no runner is alive, so no query can be executed.
+// It relies on the results of liveness probes.
+func (c *Coordinator) CheckAlive(context.Context) error {
+	for _, r := range c.runners {
+		if r.weight > 0 && r.IsAlive() {
+			return nil
+		}
+	}
+
+	return errors.New("no runner is alive")
+}
+
+// PingAny fails if no runner responds. Unlike CheckAlive, it probes the runners instead of relying
+// on the results of liveness probes.
+func (c *Coordinator) PingAny(ctx context.Context) error {
+	err := errors.New("no runner is enabled")
+	for _, r := range c.runners {
+		if r.weight == 0 {
+			continue
+		}
+
+		status := r.underlying.Status(ctx)
+		if status.Alive {
+			return nil
+		}
+
+		err = errors.Wrapf(status.LivenessProbeErr, "runner %s is not alive", r.underlying.Name())
+	}
+
+	return err
+}
+
 // Stop stops underlying runners and waits for the health checks to be finished.
 func (c *Coordinator) Stop(shutdownCtx context.Context) error {
 	c.cancel()
 
 	c.logger.Info().Msg("stopping coordinator")
 
+	if c.popularity != nil && c.config.WarmPool.Hints != nil {
+		c.saveWarmPoolHints()
+	}
+
 	for _, r := range c.runners {
 		if r.weight == 0 {
 			continue
@@ -164,7 +403,10 @@ func (c *Coordinator) Stop(shutdownCtx context.Context) error {
 
 	c.logger.Info().Msg("runners have been stopped")
 
-	c.livenessCheckLoops.Wait()
+	err := c.tasks.Wait(shutdownCtx)
+	if err != nil {
+		return err
+	}
 
 	c.logger.Info().Msg("coordinator has been stopped")
 
@@ -172,13 +414,337 @@ func (c *Coordinator) Stop(shutdownCtx context.Context) error {
 }
 
 // RunQuery proxies queries to one of the underlying runners.
-func (c *Coordinator) RunQuery(ctx context.Context, run *queryrun.Run) (output string, err error) {
+// If the run targets a runner, only that runner can execute it.
+// Otherwise, if the run has a preparation token, the runner holding the reserved container is preferred.
+// If the scheduler is enabled, the run waits for its turn by priority first.
+// If circuit breakers are enabled, runs are rejected right away while their dependencies are failing.
+// If retries are enabled, a run failed by the Docker daemon is executed once more on another runner.
+func (c *Coordinator) RunQuery(ctx context.Context, run *queryrun.Run) (res qrunner.Result, err error) {
+	preferred, token := splitPreparationToken(run.PreparationToken)
+
+	if c.popularity != nil {
+		c.popularity.Record(run.Version, time.Now())
+	}
+
+	if run.TargetRunner != "" && !c.hasRunner(run.TargetRunner) {
+		return qrunner.Result{}, errors.Wrap(qrunner.ErrUnknownRunner, run.TargetRunner)
+	}
+
+	var a admission
+	if c.breakers != nil {
+		a, err = c.admit(ctx, run)
+		if err != nil {
+			return qrunner.Result{}, err
+		}
+	}
+
+	if c.scheduler != nil {
+		release, err := c.scheduler.acquire(ctx, run.Priority)
+		if err != nil {
+			c.release(a)
+			return qrunner.Result{}, err
+		}
+		defer release()
+	}
+
+	reason := selectionBalanced
+	job := func(r *Runner) {
+		run.Timeline.Record(queryrun.StageQueue, run.CreatedAt)
+		run.Runner = r.underlying.Name()
+
+		run.PreparationToken = ""
+		selected := reason
+		if r.underlying.Name() == preferred {
+			run.PreparationToken = token
+			selected = selectionReserved
+		}
+		if r.fallback && selected == selectionBalanced {
+			selected = selectionFallback
+		}
+
+		c.logger.Debug().Str("run_id", run.ID).Str("runner", run.Runner).Str("reason", selected).
+			Msg("runner has been selected")
+		inFlight := metrics.Balancer.Selected(run.Runner, selected)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		res, err = runDaemonGuarded(ctx, r, run)
+	}
+
+	var processed bool
+	switch {
+	case a.runner != "":
+		reason = selectionProbe
+		processed = c.balancer.processJobOnly(a.runner, job)
+	case run.TargetRunner != "":
+		reason = selectionTargeted
+		processed = c.balancer.processJobOnly(run.TargetRunner, job)
+	default:
+		processed = c.balancer.processJobOn(preferred, job)
+	}
+	if !processed {
+		c.release(a)
+		return qrunner.Result{}, qrunner.ErrNoAvailableRunners
+	}
+
+	// The run may be retried on another runner, so the runner that has finished it is checked.
+	defer func() {
+		c.annotateFallback(run)
+	}()
+
+	if c.breakers != nil {
+		defer func() {
+			c.recordOutcome(ctx, a, run, err)
+		}()
+	}
+
+	// Runs targeting a runner cannot be moved to another one, neither can probe runs of circuit breakers.
+	if c.config.RetryOnAnotherRunner && run.TargetRunner == "" && a.runner == "" && failedByDaemon(ctx, err) {
+		failed := run.Runner
+		reason = selectionRetry
+		if c.balancer.processJobExcept(failed, job) {
+			metrics.Balancer.Retried()
+			c.logger.Info().Err(err).Str("run_id", run.ID).Str("from", failed).Str("to", run.Runner).
+				Msg("run failed by the Docker daemon has been retried on another runner")
+		} else {
+			metrics.Balancer.RetrySurfaced()
+		}
+	}
+
+	if run.TargetRunner == "" && errors.Is(err, qrunner.ErrPullRateLimited) {
+		metrics.PullRateLimit.Incident(run.Runner)
+
+		reason = selectionFailover
+		if c.failOver(ctx, run, job) {
+			metrics.PullRateLimit.FailedOver()
+			return res, err
+		}
+
+		metrics.PullRateLimit.Surfaced()
+	}
+
+	return res, err
+}
+
+// Reasons of runner selections the runs are counted by.
+const (
+	selectionBalanced = "balanced"
+	selectionReserved = "reserved"
+	selectionTargeted = "targeted"
+	selectionProbe    = "probe"
+	selectionRetry    = "retry"
+	selectionFailover = "failover"
+	selectionFallback = "fallback"
+)
+
+// annotateFallback warns that the run has been executed by a fallback runner, so users know why it may be slower.
+func (c *Coordinator) annotateFallback(run *queryrun.Run) {
+	for _, r := range c.runners {
+		if r.fallback && r.underlying.Name() == run.Runner {
+			run.Warn(queryrun.WarningFallbackRunner, "the run has been executed by the fallback runner "+run.Runner,
+				map[string]string{"runner": run.Runner})
+			return
+		}
+	}
+}
+
+// failedByDaemon reports whether the run has failed because of the Docker daemon of the runner rather than
+// the query, so another runner may execute it. Runs canceled by clients are not retried.
+func failedByDaemon(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+
+	var depErr *qrunner.DependencyError
+	if errors.As(err, &depErr) {
+		return depErr.Dependency == qrunner.DependencyDaemon
+	}
+
+	return errors.Is(err, qrunner.ErrRunnerDisconnected)
+}
+
+// failOver executes the job, which has failed to pull the image, on an alive runner that has already pulled it.
+// It returns false if no such runner is available.
+func (c *Coordinator) failOver(ctx context.Context, run *queryrun.Run, job runnerJob) bool {
+	failed := run.Runner
+
+	for _, r := range c.runners {
+		name := r.underlying.Name()
+		if name == failed || r.weight == 0 || !r.IsAlive() {
+			continue
+		}
+
+		holder, ok := r.underlying.(qrunner.ImageHolder)
+		if !ok {
+			continue
+		}
+
+		present, err := holder.HasImage(ctx, run.Version)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("runner", name).Str("version", run.Version).Msg("failed to check image presence")
+			continue
+		}
+		if !present {
+			continue
+		}
+
+		if c.balancer.processJobOnly(name, job) {
+			c.logger.Info().Str("run_id", run.ID).Str("from", failed).Str("to", name).
+				Msg("rate limited run has been moved to the runner having the image")
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Containers lists containers of alive runners.
+func (c *Coordinator) Containers(ctx context.Context) ([]qrunner.Container, error) {
+	var containers []qrunner.Container
+	for _, r := range c.runners {
+		lister, ok := r.underlying.(qrunner.ContainerLister)
+		if !ok || !r.IsAlive() {
+			continue
+		}
+
+		listed, err := lister.Containers(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list containers of runner %s", r.underlying.Name())
+		}
+
+		containers = append(containers, listed...)
+	}
+
+	return containers, nil
+}
+
+// Snapshot captures the container of an in-flight run on the runner that is processing it.
+func (c *Coordinator) Snapshot(ctx context.Context, runID string) (*queryrun.ContainerSnapshot, error) {
+	for _, r := range c.runners {
+		snapshotter, ok := r.underlying.(qrunner.Snapshotter)
+		if !ok {
+			continue
+		}
+
+		snapshot, err := snapshotter.Snapshot(ctx, runID)
+		if errors.Is(err, qrunner.ErrRunNotInProgress) {
+			continue
+		}
+
+		return snapshot, err
+	}
+
+	return nil, qrunner.ErrRunNotInProgress
+}
+
+// ImageState reports whether any alive runner has pulled the image of the version
+// and the range of recent pull throughputs among them. Runners that fail to tell are skipped.
+func (c *Coordinator) ImageState(ctx context.Context, version string) (qrunner.ImageState, error) {
+	var state qrunner.ImageState
+	for _, r := range c.runners {
+		inspector, ok := r.underlying.(qrunner.ImageInspector)
+		if !ok || !r.IsAlive() {
+			continue
+		}
+
+		runnerState, err := inspector.ImageState(ctx, version)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("runner", r.underlying.Name()).Str("version", version).Msg("failed to get image state")
+			continue
+		}
+
+		state.Present = state.Present || runnerState.Present
+		switch {
+		case runnerState.Throughput == nil:
+		case state.Throughput == nil:
+			state.Throughput = runnerState.Throughput
+		default:
+			merged := state.Throughput.Merge(*runnerState.Throughput)
+			state.Throughput = &merged
+		}
+	}
+
+	return state, nil
+}
+
+// RemoveImage removes the image of the digest from all runners that can do it. Failures are logged only,
+// as the image is collected by the garbage collector of the runner anyway.
+func (c *Coordinator) RemoveImage(ctx context.Context, repository, digest string) {
+	for _, r := range c.runners {
+		remover, ok := r.underlying.(qrunner.ImageRemover)
+		if !ok {
+			continue
+		}
+
+		err := remover.RemoveImage(ctx, repository, digest)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("runner", r.underlying.Name()).Str("digest", digest).Msg("failed to remove image")
+		}
+	}
+}
+
+// RunnerNames returns names of the underlying runners.
+func (c *Coordinator) RunnerNames() []string {
+	names := make([]string, 0, len(c.runners))
+	for _, r := range c.runners {
+		names = append(names, r.underlying.Name())
+	}
+
+	return names
+}
+
+func (c *Coordinator) hasRunner(name string) bool {
+	for _, r := range c.runners {
+		if r.underlying.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Prepare reserves a container on one of the underlying runners.
+// The returned token is prefixed with the runner name to route the following run to the same runner.
+func (c *Coordinator) Prepare(ctx context.Context, run *queryrun.Run) (res qrunner.Reservation, err error) {
 	processed := c.balancer.processJob(func(r *Runner) {
-		output, err = r.underlying.RunQuery(ctx, run)
+		res, err = r.underlying.Prepare(ctx, run)
+		if err == nil {
+			res.Token = r.underlying.Name() + preparationTokenSeparator + res.Token
+		}
 	})
 	if !processed {
-		return "", qrunner.ErrNoAvailableRunners
+		return qrunner.Reservation{}, qrunner.ErrNoAvailableRunners
+	}
+
+	return res, err
+}
+
+// OpenSession opens an interactive session on an available runner. The session stays on that runner.
+func (c *Coordinator) OpenSession(ctx context.Context, run *queryrun.Run, expiresAt time.Time) (s qrunner.Session, err error) {
+	processed := c.balancer.processJob(func(r *Runner) {
+		opener, ok := r.underlying.(qrunner.SessionOpener)
+		if !ok {
+			err = qrunner.ErrSessionsUnsupported
+			return
+		}
+
+		s, err = opener.OpenSession(ctx, run, expiresAt)
+	})
+	if !processed {
+		return nil, qrunner.ErrNoAvailableRunners
+	}
+
+	return s, err
+}
+
+const preparationTokenSeparator = "/"
+
+func splitPreparationToken(token string) (runnerName, underlyingToken string) {
+	runnerName, underlyingToken, found := strings.Cut(token, preparationTokenSeparator)
+	if !found {
+		return "", ""
 	}
 
-	return output, err
+	return runnerName, underlyingToken
 }
@@ -0,0 +1,315 @@
+package coordinator
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/qrunner/stubrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type imageHoldingRunner struct {
+	*stubrunner.Runner
+	present bool
+}
+
+func (r *imageHoldingRunner) HasImage(context.Context, string) (bool, error) {
+	return r.present, nil
+}
+
+func rateLimitedRun(context.Context, *queryrun.Run) (qrunner.Result, error) {
+	return qrunner.Result{}, errors.Wrap(qrunner.ErrPullRateLimited, "toomanyrequests")
+}
+
+func newTestCoordinator(runners ...qrunner.Runner) *Coordinator {
+	wrapped := make([]*Runner, 0, len(runners))
+	for _, r := range runners {
+		wrapped = append(wrapped, NewRunner(r, DefaultWeight, nil))
+	}
+
+	c := New(context.Background(), zlog.Logger.Level(zerolog.ErrorLevel), wrapped, Config{})
+	for _, r := range wrapped {
+		r.setAlive(true)
+		c.balancer.add(r)
+	}
+
+	return c
+}
+
+func TestCoordinator_RunQuery_PullRateLimitFailover(t *testing.T) {
+	ctx := context.Background()
+	served := func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stdout: "1"}, nil
+	}
+
+	c := newTestCoordinator(
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "limited", rateLimitedRun)},
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "empty", rateLimitedRun)},
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "holder", served), present: true},
+	)
+
+	run := &queryrun.Run{ID: "run", Version: "23.3", PreparationToken: "limited/token"}
+	res, err := c.RunQuery(ctx, run)
+	require.NoError(t, err)
+	assert.Equal(t, "1", res.Stdout)
+	assert.Equal(t, "holder", run.Runner)
+	assert.Empty(t, run.PreparationToken)
+}
+
+func TestCoordinator_RunQuery_PullRateLimitSurfaced(t *testing.T) {
+	ctx := context.Background()
+
+	c := newTestCoordinator(
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "limited", rateLimitedRun)},
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "empty", rateLimitedRun)},
+	)
+
+	_, err := c.RunQuery(ctx, &queryrun.Run{ID: "run", Version: "23.3", PreparationToken: "limited/token"})
+	assert.ErrorIs(t, err, qrunner.ErrPullRateLimited)
+
+	// Runs targeting a runner are never moved.
+	c = newTestCoordinator(
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "limited", rateLimitedRun)},
+		&imageHoldingRunner{Runner: stubrunner.New(ctx, "holder", stubrunner.StubRun), present: true},
+	)
+
+	_, err = c.RunQuery(ctx, &queryrun.Run{ID: "run", Version: "23.3", TargetRunner: "limited"})
+	assert.ErrorIs(t, err, qrunner.ErrPullRateLimited)
+}
+
+func TestCoordinator_RunQuery_RetryOnAnotherRunner(t *testing.T) {
+	ctx := context.Background()
+	daemonFailed := func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{}, &qrunner.DependencyError{Dependency: qrunner.DependencyDaemon, Err: errors.New("connection reset")}
+	}
+	served := func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stdout: "1"}, nil
+	}
+
+	c := newTestCoordinator(stubrunner.New(ctx, "failing", daemonFailed), stubrunner.New(ctx, "healthy", served))
+	c.config.RetryOnAnotherRunner = true
+
+	run := &queryrun.Run{ID: "run", Version: "23.3", PreparationToken: "failing/token"}
+	res, err := c.RunQuery(ctx, run)
+	require.NoError(t, err)
+	assert.Equal(t, "1", res.Stdout)
+	assert.Equal(t, "healthy", run.Runner)
+
+	// A run is retried once, and errors of queries are never retried.
+	c = newTestCoordinator(stubrunner.New(ctx, "a", daemonFailed), stubrunner.New(ctx, "b", daemonFailed))
+	c.config.RetryOnAnotherRunner = true
+
+	_, err = c.RunQuery(ctx, &queryrun.Run{ID: "run", Version: "23.3"})
+	assert.ErrorContains(t, err, "connection reset")
+
+	queryFailed := func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{}, errors.New("syntax error")
+	}
+	c = newTestCoordinator(stubrunner.New(ctx, "failing", queryFailed), stubrunner.New(ctx, "healthy", served))
+	c.config.RetryOnAnotherRunner = true
+
+	run = &queryrun.Run{ID: "run", Version: "23.3", PreparationToken: "failing/token"}
+	_, err = c.RunQuery(ctx, run)
+	assert.ErrorContains(t, err, "syntax error")
+	assert.Equal(t, "failing", run.Runner)
+}
+
+func TestCoordinator_RunQuery_Fallback(t *testing.T) {
+	ctx := context.Background()
+	served := func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stdout: "1"}, nil
+	}
+	one := uint32(1)
+
+	newCoordinator := func(primaryRun stubrunner.Run) (*Coordinator, *Runner) {
+		primary := NewRunner(stubrunner.New(ctx, "primary", primaryRun), DefaultWeight, &one)
+		fallback := NewRunner(stubrunner.New(ctx, "fallback", served), DefaultWeight, nil)
+		fallback.SetFallback()
+
+		c := New(ctx, zlog.Logger.Level(zerolog.ErrorLevel), []*Runner{primary, fallback}, Config{RetryOnAnotherRunner: true})
+		for _, r := range []*Runner{primary, fallback} {
+			r.setAlive(true)
+			c.balancer.add(r)
+		}
+
+		return c, primary
+	}
+
+	t.Run("primary is preferred", func(t *testing.T) {
+		c, _ := newCoordinator(served)
+		for i := 0; i < 10; i++ {
+			run := &queryrun.Run{ID: "run", Version: "23.3"}
+			_, err := c.RunQuery(ctx, run)
+			require.NoError(t, err)
+			assert.Equal(t, "primary", run.Runner)
+			assert.Empty(t, run.Warnings)
+		}
+	})
+
+	t.Run("primary is dead", func(t *testing.T) {
+		c, primary := newCoordinator(served)
+		c.balancer.remove(primary)
+
+		run := &queryrun.Run{ID: "run", Version: "23.3"}
+		_, err := c.RunQuery(ctx, run)
+		require.NoError(t, err)
+		assert.Equal(t, "fallback", run.Runner)
+		require.Len(t, run.Warnings, 1)
+		assert.Equal(t, queryrun.WarningFallbackRunner, run.Warnings[0].Code)
+	})
+
+	t.Run("primary is saturated", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		c, _ := newCoordinator(func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+			close(started)
+			<-release
+			return qrunner.Result{}, nil
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _ = c.RunQuery(ctx, &queryrun.Run{ID: "blocking", Version: "23.3"})
+		}()
+		<-started
+
+		run := &queryrun.Run{ID: "run", Version: "23.3"}
+		_, err := c.RunQuery(ctx, run)
+		require.NoError(t, err)
+		assert.Equal(t, "fallback", run.Runner)
+
+		close(release)
+		<-done
+	})
+
+	failures := map[string]error{
+		"daemon unreachable": errors.Wrap(qrunner.ErrRunnerDisconnected, "connection refused"),
+		"resource exhausted": &qrunner.DependencyError{Dependency: qrunner.DependencyDaemon, Err: errors.New("no space left on device")},
+	}
+	for name, failure := range failures {
+		failure := failure
+		t.Run(name, func(t *testing.T) {
+			c, _ := newCoordinator(func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+				return qrunner.Result{}, failure
+			})
+
+			run := &queryrun.Run{ID: "run", Version: "23.3"}
+			res, err := c.RunQuery(ctx, run)
+			require.NoError(t, err)
+			assert.Equal(t, "1", res.Stdout)
+			assert.Equal(t, "fallback", run.Runner)
+			require.Len(t, run.Warnings, 1)
+			assert.Equal(t, "fallback", run.Warnings[0].Details["runner"])
+		})
+	}
+}
+
+type resizingRunner struct {
+	*stubrunner.Runner
+	resized chan map[string]float64
+}
+
+func (r *resizingRunner) ResizeWarmPool(popularity map[string]float64) qrunner.WarmPoolAllocation {
+	r.resized <- popularity
+	return qrunner.WarmPoolAllocation{}
+}
+
+func (r *resizingRunner) WarmPoolAllocation() qrunner.WarmPoolAllocation {
+	return qrunner.WarmPoolAllocation{}
+}
+
+func TestCoordinator_WarmPoolHints(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "hints.json")
+	require.NoError(t, qrunner.SaveWarmPoolHints(path, qrunner.WarmPoolHints{
+		SavedAt:    time.Now(),
+		Popularity: map[string]float64{"23.3": 4, "removed": 2},
+	}))
+
+	loaded := make(chan struct{})
+	runner := &resizingRunner{Runner: stubrunner.New(ctx, "a", stubrunner.StubRun), resized: make(chan map[string]float64, 1)}
+	c := New(ctx, zlog.Logger.Level(zerolog.ErrorLevel), []*Runner{NewRunner(runner, DefaultWeight, nil)}, Config{
+		WarmPool: &WarmPoolConfig{
+			ResizeInterval: time.Hour,
+			HalfLife:       time.Hour,
+			Hints: &WarmPoolHintsConfig{
+				Path:   path,
+				Loaded: loaded,
+				Exists: func(version string) bool { return version != "removed" },
+			},
+		},
+	})
+	require.NoError(t, c.Start())
+
+	// Hints are restored once the versions can be resolved.
+	select {
+	case <-runner.resized:
+		t.Fatal("warm pools must not be resized before the tags are loaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(loaded)
+
+	popularity := <-runner.resized
+	assert.Len(t, popularity, 1, "stale hints must be dropped")
+	assert.InDelta(t, 4, popularity["23.3"], 0.01)
+
+	c.popularity.Record("22.8", time.Now())
+	require.NoError(t, c.Stop(ctx))
+
+	hints, err := qrunner.LoadWarmPoolHints(path)
+	require.NoError(t, err)
+	assert.Len(t, hints.Popularity, 2)
+	assert.InDelta(t, 1, hints.Popularity["22.8"], 0.01)
+}
+
+// assertNoLeakedGoroutines checks that the number of goroutines gets back to the one before the test.
+// It polls in the test goroutine, as assert.Eventually starts goroutines of its own.
+func assertNoLeakedGoroutines(t *testing.T, before int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines have leaked")
+}
+
+func TestCoordinator_StopWaitsForTasks(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx := context.Background()
+
+	served := func(context.Context, *queryrun.Run) (qrunner.Result, error) {
+		return qrunner.Result{Stdout: "1"}, nil
+	}
+	runners := []*Runner{
+		NewRunner(stubrunner.New(ctx, "a", served), DefaultWeight, nil),
+		NewRunner(stubrunner.New(ctx, "b", served), DefaultWeight, nil),
+	}
+
+	c := New(ctx, zerolog.Nop(), runners, Config{
+		HealthChecksEnabled:   true,
+		HealthCheckRetryDelay: time.Millisecond,
+		WarmPool:              &WarmPoolConfig{ResizeInterval: time.Millisecond, HalfLife: time.Minute},
+	})
+	require.NoError(t, c.Start())
+	assert.Equal(t, map[string]int{"liveness-check": 2, "warm-pool-resize": 1}, c.tasks.Live())
+
+	require.Eventually(t, func() bool {
+		_, err := c.RunQuery(ctx, &queryrun.Run{ID: "run", Version: "23.3"})
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, c.Stop(ctx))
+	assert.Empty(t, c.tasks.Live())
+	assertNoLeakedGoroutines(t, before)
+}
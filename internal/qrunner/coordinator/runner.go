@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"sync/atomic"
+	"time"
 
 	"clickhouse-playground/internal/qrunner"
 )
@@ -17,8 +18,14 @@ type Runner struct {
 	// Weight is for load balancing.
 	weight uint
 
+	// A fallback runner is selected only if no primary runner is available.
+	fallback bool
+
 	maxConcurrency *uint32
 	concurrency    int32
+
+	// daemon is the circuit breaker of the Docker daemon of the runner. It's nil if circuit breakers are disabled.
+	daemon *circuitBreaker
 }
 
 func NewRunner(underlying qrunner.Runner, weight uint, maxConcurrency *uint32) *Runner {
@@ -30,10 +37,27 @@ func NewRunner(underlying qrunner.Runner, weight uint, maxConcurrency *uint32) *
 	}
 }
 
+// SetFallback makes the runner a fallback one: runs are balanced to it only while all primary runners are dead
+// or have their concurrency limits exhausted, or when a run failed by the daemon of a primary runner is retried.
+func (r *Runner) SetFallback() {
+	r.fallback = true
+}
+
 func (r *Runner) IsAlive() bool {
 	return atomic.LoadUint32(&r.alive) == 1
 }
 
+// daemonAvailable reports whether the daemon circuit of the runner lets runs through.
+func (r *Runner) daemonAvailable(now time.Time) bool {
+	if r.daemon == nil {
+		return true
+	}
+
+	_, ok := r.daemon.available(now)
+
+	return ok
+}
+
 func (r *Runner) setAlive(alive bool) {
 	var converted uint32
 	if alive {
@@ -44,6 +68,44 @@ func (r *Runner) setAlive(alive bool) {
 }
 
 // addConcurrency atomically adds delta to the current concurrency and returns the new value.
+// Containers held by the runner for inspection are counted as well.
 func (r *Runner) addConcurrency(delta int32) uint32 {
-	return uint32(atomic.AddInt32(&r.concurrency, delta))
+	return uint32(atomic.AddInt32(&r.concurrency, delta)) + r.heldContainers()
+}
+
+// outstanding returns the number of runs in flight and containers held by the runner.
+func (r *Runner) outstanding() uint32 {
+	return uint32(atomic.LoadInt32(&r.concurrency)) + r.heldContainers()
+}
+
+// saturated reports whether held containers exhaust the concurrency limit, so the runner cannot take new runs.
+func (r *Runner) saturated() bool {
+	limit, limited := r.concurrencyLimit()
+	return limited && r.heldContainers() >= limit
+}
+
+// concurrencyLimit returns the limit reduced while the underlying runner is throttled, but not below 1.
+func (r *Runner) concurrencyLimit() (uint32, bool) {
+	if r.maxConcurrency == nil {
+		return 0, false
+	}
+
+	limit := *r.maxConcurrency
+	if remediator, ok := r.underlying.(qrunner.Remediator); ok {
+		limit = uint32(float64(limit) * remediator.ConcurrencyFactor())
+		if limit < 1 {
+			limit = 1
+		}
+	}
+
+	return limit, true
+}
+
+func (r *Runner) heldContainers() uint32 {
+	holder, ok := r.underlying.(qrunner.ContainerHolder)
+	if !ok {
+		return 0
+	}
+
+	return holder.HeldContainers()
 }
@@ -0,0 +1,267 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// scheduler limits the number of runs dispatched to runners and decides which waiting run goes next.
+//
+// Classes share the capacity by stride scheduling: every dispatch advances the pass of the class by 1/weight,
+// and the waiting class with the lowest pass goes next. A class that has been idle starts from the pass
+// of the latest dispatch, so it cannot save up dispatches while it's idle.
+type scheduler struct {
+	mu sync.Mutex
+
+	capacity     uint
+	queueTimeout time.Duration
+	maxQueued    uint
+
+	inFlight uint
+	queued   uint
+	pass     float64
+
+	// classes are ordered by priority, so the higher class wins if passes are equal.
+	classes []*schedulerClass
+}
+
+type schedulerClass struct {
+	priority string
+	cfg      SchedulerClassConfig
+
+	inFlight uint
+	queue    []*schedulerTicket
+	pass     float64
+
+	dispatched uint64
+	rejected   uint64
+}
+
+type schedulerTicket struct {
+	ready      chan struct{}
+	dispatched bool
+}
+
+func newScheduler(cfg SchedulerConfig) *scheduler {
+	s := &scheduler{
+		capacity:     cfg.Capacity,
+		queueTimeout: cfg.QueueTimeout,
+		maxQueued:    cfg.MaxQueued,
+	}
+
+	for _, priority := range queryrun.Priorities {
+		classCfg, ok := cfg.Classes[priority]
+		if !ok || classCfg.Weight == 0 {
+			classCfg.Weight = DefaultSchedulerWeights[priority]
+		}
+
+		s.classes = append(s.classes, &schedulerClass{
+			priority: priority,
+			cfg:      classCfg,
+		})
+	}
+
+	return s
+}
+
+// class returns the class of the priority. Runs without a known priority are interactive.
+func (s *scheduler) class(priority string) *schedulerClass {
+	for _, c := range s.classes {
+		if c.priority == priority {
+			return c
+		}
+	}
+
+	return s.classes[0]
+}
+
+// acquire waits until the run can be dispatched. The returned function must be called when the run is finished.
+// It fails with qrunner.QueueRejectedError if the queue is full or the wait has timed out.
+func (s *scheduler) acquire(ctx context.Context, priority string) (release func(), err error) {
+	queuedAt := time.Now()
+
+	s.mu.Lock()
+	class := s.class(priority)
+
+	var full string
+	switch {
+	case class.cfg.MaxQueued > 0 && uint(len(class.queue)) >= class.cfg.MaxQueued:
+		full = fmt.Sprintf("%s queue is full", class.priority)
+
+	case s.maxQueued > 0 && s.queued >= s.maxQueued:
+		full = "queue is full"
+	}
+	if full != "" {
+		class.rejected++
+		s.mu.Unlock()
+
+		metrics.Scheduler.Rejected(class.priority, queuedAt)
+
+		return nil, s.rejection(full)
+	}
+
+	ticket := &schedulerTicket{ready: make(chan struct{})}
+	if len(class.queue) == 0 && class.pass < s.pass {
+		class.pass = s.pass
+	}
+	class.queue = append(class.queue, ticket)
+	s.queued++
+
+	s.dispatch()
+	s.export(class)
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if s.queueTimeout > 0 {
+		timer := time.NewTimer(s.queueTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-ticket.ready:
+		metrics.Scheduler.Dispatched(class.priority, queuedAt)
+		return s.releaser(class), nil
+
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "run has not been dispatched")
+
+	case <-timeout:
+		err = s.rejection(fmt.Sprintf("%s run has not been dispatched in %s", class.priority, s.queueTimeout))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ticket.dispatched {
+		// The run has been dispatched while the wait was being given up.
+		s.releaseLocked(class)
+	} else {
+		class.remove(ticket)
+		s.queued--
+		s.export(class)
+	}
+
+	if errors.Is(err, qrunner.ErrNoAvailableRunners) {
+		class.rejected++
+		metrics.Scheduler.Rejected(class.priority, queuedAt)
+	} else {
+		metrics.Scheduler.Canceled(class.priority, queuedAt)
+	}
+
+	return nil, err
+}
+
+// rejection returns the error of a run that has not been dispatched. Every queued run is either dispatched
+// or rejected within the queue timeout, so the queue is expected to have room by then.
+func (s *scheduler) rejection(reason string) error {
+	return &qrunner.QueueRejectedError{Reason: reason, RetryAfter: s.queueTimeout}
+}
+
+func (s *scheduler) releaser(class *schedulerClass) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.releaseLocked(class)
+		})
+	}
+}
+
+func (s *scheduler) releaseLocked(class *schedulerClass) {
+	class.inFlight--
+	s.inFlight--
+
+	s.dispatch()
+	s.export(class)
+}
+
+// dispatch hands free capacity to the waiting runs. It must be called under the lock.
+func (s *scheduler) dispatch() {
+	for s.inFlight < s.capacity {
+		var next *schedulerClass
+		for _, c := range s.classes {
+			if !c.eligible() {
+				continue
+			}
+			if next == nil || c.pass < next.pass {
+				next = c
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		ticket := next.queue[0]
+		next.queue = next.queue[1:]
+		s.queued--
+
+		ticket.dispatched = true
+		close(ticket.ready)
+
+		next.inFlight++
+		next.dispatched++
+		s.inFlight++
+
+		s.pass = next.pass
+		next.pass += 1 / float64(next.cfg.Weight)
+
+		s.export(next)
+	}
+}
+
+func (s *scheduler) export(class *schedulerClass) {
+	metrics.Scheduler.SetQueue(class.priority, uint(len(class.queue)), class.inFlight)
+}
+
+// status returns the state of the classes ordered by priority.
+func (s *scheduler) status() []qrunner.SchedulerClass {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	classes := make([]qrunner.SchedulerClass, 0, len(s.classes))
+	for _, c := range s.classes {
+		classes = append(classes, qrunner.SchedulerClass{
+			Priority:       c.priority,
+			Weight:         c.cfg.Weight,
+			MaxConcurrency: c.cfg.MaxConcurrency,
+			MaxQueued:      c.cfg.MaxQueued,
+			InFlight:       c.inFlight,
+			Queued:         uint(len(c.queue)),
+			Dispatched:     c.dispatched,
+			Rejected:       c.rejected,
+		})
+	}
+
+	return classes
+}
+
+// eligible reports whether the class has a waiting run that its concurrency limit allows to dispatch.
+func (c *schedulerClass) eligible() bool {
+	if len(c.queue) == 0 {
+		return false
+	}
+
+	return c.cfg.MaxConcurrency == 0 || c.inFlight < c.cfg.MaxConcurrency
+}
+
+func (c *schedulerClass) remove(ticket *schedulerTicket) {
+	for i, t := range c.queue {
+		if t == ticket {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return
+		}
+	}
+}
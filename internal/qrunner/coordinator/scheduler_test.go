@@ -0,0 +1,250 @@
+package coordinator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dispatchedRun struct {
+	priority string
+	release  func()
+}
+
+func schedulerClassOf(s *scheduler, priority string) qrunner.SchedulerClass {
+	for _, c := range s.status() {
+		if c.Priority == priority {
+			return c
+		}
+	}
+
+	return qrunner.SchedulerClass{}
+}
+
+// enqueue starts waiting for dispatch and returns when the run is in the queue.
+func enqueue(t *testing.T, s *scheduler, priority string, dispatched chan<- dispatchedRun) {
+	queued := schedulerClassOf(s, priority).Queued
+
+	go func() {
+		release, err := s.acquire(context.Background(), priority)
+		if err == nil {
+			dispatched <- dispatchedRun{priority: priority, release: release}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return schedulerClassOf(s, priority).Queued == queued+1
+	}, time.Second, time.Millisecond)
+}
+
+func TestScheduler_WeightedShares(t *testing.T) {
+	s := newScheduler(SchedulerConfig{Capacity: 1})
+
+	release, err := s.acquire(context.Background(), queryrun.PriorityInteractive)
+	require.NoError(t, err)
+
+	dispatched := make(chan dispatchedRun)
+	for i := 0; i < 10; i++ {
+		enqueue(t, s, queryrun.PriorityInteractive, dispatched)
+		enqueue(t, s, queryrun.PriorityBackground, dispatched)
+	}
+
+	release()
+
+	var order []string
+	for i := 0; i < 20; i++ {
+		run := <-dispatched
+		order = append(order, run.priority)
+		run.release()
+	}
+
+	// With weights 8 and 1, background runs get a dispatch in every 9, but they are not starved.
+	background := 0
+	for _, p := range order[:10] {
+		if p == queryrun.PriorityBackground {
+			background++
+		}
+	}
+	assert.GreaterOrEqual(t, background, 1)
+	assert.LessOrEqual(t, background, 2)
+
+	assert.Equal(t, uint64(11), schedulerClassOf(s, queryrun.PriorityInteractive).Dispatched)
+	assert.Equal(t, uint64(10), schedulerClassOf(s, queryrun.PriorityBackground).Dispatched)
+}
+
+func TestScheduler_ClassLimits(t *testing.T) {
+	s := newScheduler(SchedulerConfig{
+		Capacity:     2,
+		QueueTimeout: 20 * time.Millisecond,
+		Classes: map[string]SchedulerClassConfig{
+			queryrun.PriorityBackground: {MaxConcurrency: 1},
+		},
+	})
+
+	releaseBackground, err := s.acquire(context.Background(), queryrun.PriorityBackground)
+	require.NoError(t, err)
+
+	// The rest of the capacity is kept for other classes.
+	_, err = s.acquire(context.Background(), queryrun.PriorityBackground)
+	assert.ErrorIs(t, err, qrunner.ErrNoAvailableRunners)
+
+	releaseInteractive, err := s.acquire(context.Background(), "")
+	require.NoError(t, err)
+
+	class := schedulerClassOf(s, queryrun.PriorityBackground)
+	assert.Equal(t, uint(1), class.InFlight)
+	assert.Equal(t, uint(0), class.Queued)
+	assert.Equal(t, uint64(1), class.Rejected)
+	assert.Equal(t, uint(1), schedulerClassOf(s, queryrun.PriorityInteractive).InFlight)
+
+	releaseBackground()
+	releaseBackground()
+	releaseInteractive()
+
+	for _, c := range s.status() {
+		assert.Zero(t, c.InFlight, c.Priority)
+	}
+}
+
+func TestScheduler_MaxQueued(t *testing.T) {
+	s := newScheduler(SchedulerConfig{
+		Capacity: 1,
+		Classes: map[string]SchedulerClassConfig{
+			queryrun.PriorityAsync: {MaxQueued: 1},
+		},
+	})
+
+	release, err := s.acquire(context.Background(), queryrun.PriorityAsync)
+	require.NoError(t, err)
+
+	dispatched := make(chan dispatchedRun)
+	enqueue(t, s, queryrun.PriorityAsync, dispatched)
+
+	_, err = s.acquire(context.Background(), queryrun.PriorityAsync)
+	assert.ErrorIs(t, err, qrunner.ErrNoAvailableRunners)
+
+	release()
+	(<-dispatched).release()
+}
+
+func TestScheduler_Canceled(t *testing.T) {
+	s := newScheduler(SchedulerConfig{Capacity: 1})
+
+	release, err := s.acquire(context.Background(), queryrun.PriorityInteractive)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = s.acquire(ctx, queryrun.PriorityInteractive)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	class := schedulerClassOf(s, queryrun.PriorityInteractive)
+	assert.Equal(t, uint(0), class.Queued)
+	assert.Equal(t, uint64(0), class.Rejected)
+
+	release()
+	assert.Equal(t, uint(0), schedulerClassOf(s, queryrun.PriorityInteractive).InFlight)
+}
+
+// TestScheduler_BackgroundFlood checks that interactive runs wait for about one free slot
+// while background runs keep the scheduler saturated.
+func TestScheduler_BackgroundFlood(t *testing.T) {
+	const (
+		capacity = 4
+		flood    = 40
+		hold     = 10 * time.Millisecond
+
+		// In FIFO order, an interactive run would wait for the whole flood: flood / capacity * hold = 100ms.
+		maxP95Wait = 3 * hold
+	)
+
+	s := newScheduler(SchedulerConfig{Capacity: capacity})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < flood; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				release, err := s.acquire(ctx, queryrun.PriorityBackground)
+				if err != nil {
+					return
+				}
+
+				time.Sleep(hold)
+				release()
+			}
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return schedulerClassOf(s, queryrun.PriorityBackground).Queued == flood-capacity
+	}, time.Second, time.Millisecond)
+
+	waits := make([]time.Duration, 0, 40)
+	for i := 0; i < cap(waits); i++ {
+		startedAt := time.Now()
+		release, err := s.acquire(ctx, queryrun.PriorityInteractive)
+		require.NoError(t, err)
+
+		waits = append(waits, time.Since(startedAt))
+
+		time.Sleep(hold)
+		release()
+	}
+
+	backgroundDispatched := schedulerClassOf(s, queryrun.PriorityBackground).Dispatched
+
+	cancel()
+	wg.Wait()
+
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	p95 := waits[len(waits)*95/100]
+	assert.Less(t, p95, maxP95Wait, "interactive p95 wait")
+
+	// Background runs are slowed down, but keep being dispatched.
+	assert.Greater(t, backgroundDispatched, uint64(flood))
+}
+
+func TestScheduler_TotalMaxQueued(t *testing.T) {
+	s := newScheduler(SchedulerConfig{Capacity: 1, QueueTimeout: 5 * time.Second, MaxQueued: 2})
+
+	release, err := s.acquire(context.Background(), queryrun.PriorityInteractive)
+	require.NoError(t, err)
+
+	dispatched := make(chan dispatchedRun)
+	enqueue(t, s, queryrun.PriorityInteractive, dispatched)
+	enqueue(t, s, queryrun.PriorityBackground, dispatched)
+
+	_, err = s.acquire(context.Background(), queryrun.PriorityAsync)
+	require.ErrorIs(t, err, qrunner.ErrNoAvailableRunners)
+
+	var rejected *qrunner.QueueRejectedError
+	require.ErrorAs(t, err, &rejected)
+	assert.Equal(t, 5*time.Second, rejected.RetryAfter)
+	assert.Equal(t, uint64(1), schedulerClassOf(s, queryrun.PriorityAsync).Rejected)
+
+	// Dispatched runs leave the queue, so it has room again.
+	release()
+	(<-dispatched).release()
+	enqueue(t, s, queryrun.PriorityAsync, dispatched)
+
+	(<-dispatched).release()
+	(<-dispatched).release()
+}
@@ -5,14 +5,61 @@ import (
 	"strings"
 )
 
-func FullImageName(repository, version string) string {
+const playgroundImagePrefix = "chp-"
+
+// maxTagLength is the max length of an image tag accepted by Docker.
+const maxTagLength = 128
+
+// FullImageName returns the name the image of the given version is pulled by.
+func FullImageName(repository RepositoryRef, version string) string {
 	return fmt.Sprintf("%s:%s", repository, version)
 }
 
-func PlaygroundImageName(repository, digest string) string {
-	return fmt.Sprintf("chp-%s:%s", repository, strings.TrimPrefix(digest, "sha256:"))
+// DigestImageName returns the name the image with the given digest is pulled by.
+// Unlike tags, digests cannot be re-pushed, so the name always refers to the same image.
+func DigestImageName(repository RepositoryRef, digest string) string {
+	return fmt.Sprintf("%s@%s", repository, digest)
+}
+
+// PlaygroundImageName returns the local name of the image built from the given digest.
+// The namespace is always kept, so official images are named like chp-library/clickhouse.
+// Images of other registries are prefixed with the host, e.g. chp-ghcr-io/clickhouse/clickhouse-server,
+// so they never share names with Docker Hub images of the same path.
+func PlaygroundImageName(repository RepositoryRef, digest string) string {
+	path := repository.Path()
+	if !repository.IsDockerHub() {
+		path = strings.NewReplacer(".", "-", ":", "-").Replace(repository.Registry) + "/" + path
+	}
+
+	return fmt.Sprintf("%s%s:%s", playgroundImagePrefix, path, digestTag(digest))
 }
 
+// digestTag turns the digest into a tag. The algorithm of sha256 digests is omitted, other algorithms are kept,
+// since the same hex could be produced by different ones. Long digests (e.g. sha512) are truncated to fit a tag.
+func digestTag(digest string) string {
+	tag := strings.TrimPrefix(digest, "sha256:")
+	tag = strings.ReplaceAll(tag, ":", "-")
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+
+	return tag
+}
+
+// IsPlaygroundImageName reports whether the image name has been built by PlaygroundImageName.
+// Names reported by the engine may be spelled in any form, e.g. docker.io/chp-library/clickhouse:<digest>.
 func IsPlaygroundImageName(name string) bool {
-	return strings.HasPrefix(name, "chp-")
+	repository, _ := splitImageName(name)
+
+	ref, err := ParseRepositoryRef(repository)
+	if err != nil || !ref.IsDockerHub() {
+		return false
+	}
+
+	// Images named before the namespace of official images was kept (e.g. chp-clickhouse) are matched as well.
+	if ref.Namespace == officialNamespace {
+		return strings.HasPrefix(ref.Name, playgroundImagePrefix)
+	}
+
+	return strings.HasPrefix(ref.Path(), playgroundImagePrefix)
 }
@@ -1,9 +1,11 @@
 package qrunner
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFullImageName(t *testing.T) {
@@ -27,25 +29,88 @@ func TestFullImageName(t *testing.T) {
 			version:    "1.4-alpine",
 			want:       "lodthe/clickhouse-playground:1.4-alpine",
 		},
+		{
+			repository: "library/clickhouse",
+			version:    "23.3",
+			want:       "clickhouse:23.3",
+		},
+		{
+			repository: "docker.io/clickhouse/clickhouse-server",
+			version:    "23.3",
+			want:       "clickhouse/clickhouse-server:23.3",
+		},
 	}
 
 	for _, tc := range cases {
-		got := FullImageName(tc.repository, tc.version)
+		ref, err := ParseRepositoryRef(tc.repository)
+		require.NoError(t, err, tc.repository)
+
+		got := FullImageName(ref, tc.version)
 		assert.Equal(t, tc.want, got, tc.version)
 	}
 }
 
 func TestPlaygroundImageName(t *testing.T) {
-	actual := PlaygroundImageName("clickhouse/clickhouse-playground", "sha256:f321ba3999901412bc2616216a631f")
+	ref, err := ParseRepositoryRef("clickhouse/clickhouse-playground")
+	require.NoError(t, err)
+
+	actual := PlaygroundImageName(ref, "sha256:f321ba3999901412bc2616216a631f")
 	expected := "chp-clickhouse/clickhouse-playground:f321ba3999901412bc2616216a631f"
 
 	assert.Equal(t, expected, actual)
+
+	// Official images keep the namespace, so all spellings produce the same name.
+	for _, repository := range []string{"clickhouse", "library/clickhouse", "docker.io/library/clickhouse"} {
+		ref, err := ParseRepositoryRef(repository)
+		require.NoError(t, err)
+
+		assert.Equal(t, "chp-library/clickhouse:f321ba", PlaygroundImageName(ref, "sha256:f321ba"), repository)
+	}
+
+	// Other registries are kept in the namespace, so the name does not clash with the Docker Hub repository.
+	ghcr, err := ParseRepositoryRef("ghcr.io/clickhouse/clickhouse-playground")
+	require.NoError(t, err)
+	assert.Equal(t, "chp-ghcr-io/clickhouse/clickhouse-playground:f321ba", PlaygroundImageName(ghcr, "sha256:f321ba"))
+	assert.True(t, IsPlaygroundImageName(PlaygroundImageName(ghcr, "sha256:f321ba")))
+
+	private, err := ParseRepositoryRef("registry.local:5000/clickhouse")
+	require.NoError(t, err)
+	assert.Equal(t, "chp-registry-local-5000/clickhouse:sha512-f321ba", PlaygroundImageName(private, "sha512:f321ba"))
+
+	long := PlaygroundImageName(private, "sha512:"+strings.Repeat("a", 128))
+	assert.Equal(t, "chp-registry-local-5000/clickhouse:sha512-"+strings.Repeat("a", 121), long)
+}
+
+func TestDigestImageName(t *testing.T) {
+	ref, err := ParseRepositoryRef("docker.io/library/clickhouse")
+	require.NoError(t, err)
+
+	assert.Equal(t, "clickhouse@sha256:f321ba", DigestImageName(ref, "sha256:f321ba"))
 }
 
 func TestIsPlaygroundImageName(t *testing.T) {
-	chp := PlaygroundImageName("clickhouse/clickhouse-playground", "sha256:f321ba3999901412bc2616216a631f")
-	notChp := "clickhouse/clickhouse-playground:21.2.2"
+	ref, err := ParseRepositoryRef("clickhouse/clickhouse-playground")
+	require.NoError(t, err)
+
+	official, err := ParseRepositoryRef("clickhouse")
+	require.NoError(t, err)
 
-	assert.True(t, IsPlaygroundImageName(chp))
-	assert.False(t, IsPlaygroundImageName(notChp))
+	cases := []struct {
+		name string
+		want bool
+	}{
+		{name: PlaygroundImageName(ref, "sha256:f321ba3999901412bc2616216a631f"), want: true},
+		{name: PlaygroundImageName(official, "sha256:f321ba3999901412bc2616216a631f"), want: true},
+		{name: "docker.io/chp-library/clickhouse:f321ba", want: true},
+		{name: "docker.io/library/chp-clickhouse:f321ba", want: true},
+		{name: "chp-clickhouse:f321ba", want: true},
+		{name: "clickhouse/clickhouse-playground:21.2.2", want: false},
+		{name: "clickhouse:23.3", want: false},
+		{name: "ghcr.io/chp-clickhouse/clickhouse:23.3", want: false},
+		{name: "<none>:<none>", want: false},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, IsPlaygroundImageName(tc.name), tc.name)
+	}
 }
@@ -0,0 +1,132 @@
+package dockerengine
+
+import (
+	"regexp"
+	"strings"
+
+	"clickhouse-playground/pkg/chsemver"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PlaceholderQuery is replaced with the user's query.
+	PlaceholderQuery = "{query}"
+
+	// PlaceholderFormat is replaced with the requested output format name.
+	PlaceholderFormat = "{format}"
+
+	// PlaceholderFormatArgs must be a standalone argument. It's expanded into
+	// version-dependent output formatting flags (or removed if the version does not support them).
+	PlaceholderFormatArgs = "{format_args}"
+)
+
+var knownPlaceholders = map[string]struct{}{
+	PlaceholderQuery:      {},
+	PlaceholderFormat:     {},
+	PlaceholderFormatArgs: {},
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// CommandTemplate describes how clickhouse-client is invoked for versions in the [MinVersion, MaxVersion] range.
+type CommandTemplate struct {
+	// Inclusive lower bound. If empty, the range is not bounded from below.
+	MinVersion string
+
+	// Inclusive upper bound compared by prefix: "21.8" includes "21.8.3".
+	// If empty, the range is not bounded from above.
+	MaxVersion string
+
+	// Argv may contain placeholders: {query}, {format} and {format_args}.
+	Argv []string
+}
+
+// DefaultCommandTemplate is used when no configured template matches the requested version.
+var DefaultCommandTemplate = CommandTemplate{
+	Argv: []string{
+		"clickhouse", "client",
+		"-n",
+		"-m",
+		"--query", PlaceholderQuery,
+		PlaceholderFormatArgs,
+	},
+}
+
+// validate checks that the template is not empty and uses only known placeholders.
+func (t *CommandTemplate) validate() error {
+	if len(t.Argv) == 0 {
+		return errors.New("argv cannot be empty")
+	}
+
+	hasQuery := false
+	for _, arg := range t.Argv {
+		for _, p := range placeholderRegexp.FindAllString(arg, -1) {
+			if _, known := knownPlaceholders[p]; !known {
+				return errors.Errorf("unknown placeholder %s in '%s'", p, arg)
+			}
+
+			if p == PlaceholderFormatArgs && arg != PlaceholderFormatArgs {
+				return errors.Errorf("%s must be a standalone argument, but '%s' found", PlaceholderFormatArgs, arg)
+			}
+
+			if p == PlaceholderQuery {
+				hasQuery = true
+			}
+		}
+	}
+
+	if !hasQuery {
+		return errors.Errorf("%s placeholder is required", PlaceholderQuery)
+	}
+
+	if t.MinVersion != "" && t.MaxVersion != "" && chsemver.IsGreater(chsemver.Parse(t.MinVersion), chsemver.Parse(t.MaxVersion)) {
+		return errors.Errorf("min version %s is greater than max version %s", t.MinVersion, t.MaxVersion)
+	}
+
+	return nil
+}
+
+// matches checks whether the version belongs to the template version range.
+// Floating versions (head, latest) are considered to be greater than any other version.
+func (t *CommandTemplate) matches(version string) bool {
+	return chsemver.InRange(version, t.MinVersion, t.MaxVersion)
+}
+
+// build substitutes placeholders and returns the command arguments.
+func (t *CommandTemplate) build(query, format string, formatArgs []string) []string {
+	args := make([]string, 0, len(t.Argv)+len(formatArgs))
+	for _, arg := range t.Argv {
+		if arg == PlaceholderFormatArgs {
+			args = append(args, formatArgs...)
+			continue
+		}
+
+		args = append(args, strings.NewReplacer(PlaceholderQuery, query, PlaceholderFormat, format).Replace(arg))
+	}
+
+	return args
+}
+
+func validateCommandTemplates(templates []CommandTemplate) error {
+	for i := range templates {
+		err := templates[i].validate()
+		if err != nil {
+			return errors.Wrapf(err, "command template #%d", i)
+		}
+	}
+
+	return nil
+}
+
+// selectCommandTemplate returns the first template that matches the version and its index.
+// If there is no such a template, DefaultCommandTemplate and -1 are returned.
+func selectCommandTemplate(templates []CommandTemplate, version string) (CommandTemplate, int) {
+	for i := range templates {
+		if templates[i].matches(version) {
+			return templates[i], i
+		}
+	}
+
+	return DefaultCommandTemplate, -1
+}
@@ -0,0 +1,73 @@
+package dockerengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectCommandTemplate(t *testing.T) {
+	templates := []CommandTemplate{
+		{
+			MaxVersion: "19",
+			Argv:       []string{"/usr/bin/clickhouse-client", "-n", "--query", "{query}"},
+		},
+		{
+			MinVersion: "20.1",
+			MaxVersion: "21.8",
+			Argv:       []string{"clickhouse-client", "-n", "-m", "--query", "{query}", "{format_args}"},
+		},
+		{
+			MinVersion: "23",
+			Argv:       []string{"clickhouse", "client", "--multiquery", "--query", "{query}", "{format_args}"},
+		},
+	}
+
+	cases := []struct {
+		version string
+		want    int
+	}{
+		{version: "18.16.1", want: 0},
+		{version: "19.17.4.11", want: 0},
+		{version: "20", want: -1},
+		{version: "20.1", want: 1},
+		{version: "20.3.21-alpine", want: 1},
+		{version: "21.8.3", want: 1},
+		{version: "21.9", want: -1},
+		{version: "22.3", want: -1},
+		{version: "23.1", want: 2},
+		{version: "head", want: 2},
+		{version: "latest-alpine", want: 2},
+	}
+
+	for _, tc := range cases {
+		tmpl, idx := selectCommandTemplate(templates, tc.version)
+		assert.Equal(t, tc.want, idx, tc.version)
+
+		if tc.want == -1 {
+			assert.Equal(t, DefaultCommandTemplate, tmpl, tc.version)
+		}
+	}
+}
+
+func TestCommandTemplate_build(t *testing.T) {
+	tmpl := CommandTemplate{
+		Argv: []string{"clickhouse-client", "--query", "{query}", "--format={format}", "{format_args}"},
+	}
+
+	args := tmpl.build("SELECT 1", "JSON", []string{"--format", "JSON"})
+	assert.Equal(t, []string{"clickhouse-client", "--query", "SELECT 1", "--format=JSON", "--format", "JSON"}, args)
+
+	args = tmpl.build("SELECT 1", "JSON", nil)
+	assert.Equal(t, []string{"clickhouse-client", "--query", "SELECT 1", "--format=JSON"}, args)
+}
+
+func TestValidateCommandTemplates(t *testing.T) {
+	assert.NoError(t, validateCommandTemplates([]CommandTemplate{DefaultCommandTemplate}))
+
+	assert.Error(t, validateCommandTemplates([]CommandTemplate{{Argv: nil}}))
+	assert.Error(t, validateCommandTemplates([]CommandTemplate{{Argv: []string{"clickhouse-client"}}}))
+	assert.Error(t, validateCommandTemplates([]CommandTemplate{{Argv: []string{"--query", "{query}", "{unknown}"}}}))
+	assert.Error(t, validateCommandTemplates([]CommandTemplate{{Argv: []string{"--query", "{query}", "--x={format_args}"}}}))
+	assert.Error(t, validateCommandTemplates([]CommandTemplate{{MinVersion: "22", MaxVersion: "21", Argv: []string{"{query}"}}}))
+}
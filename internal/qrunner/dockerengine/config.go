@@ -3,13 +3,27 @@ package dockerengine
 import "time"
 
 type Config struct {
+	// DaemonURL is ssh://user@host, tcp://host:port or unix:///path of the Docker daemon or of a compatible one,
+	// e.g. the Podman socket. If nil, the default local socket is used. DOCKER_HOST is not applied.
 	DaemonURL *string
 
+	// DaemonTLS secures the connection to a tcp:// daemon.
+	DaemonTLS *DaemonTLSConfig
+
+	// ExecRetryDelay is the interval between readiness probes of the database server.
 	ExecRetryDelay time.Duration
 	MaxExecRetries int
 
 	DefaultOutputFormat string
 
+	// An ordered list of clickhouse-client invocation rules. The first rule matching the requested version is used.
+	// If there is no such a rule, DefaultCommandTemplate is used.
+	CommandTemplates []CommandTemplate
+
+	// Tools are auxiliary binaries that can be run instead of the database server.
+	// Runs cannot invoke anything that is not listed here.
+	Tools []ToolTemplate
+
 	// Path to the xml or yaml config which will be mounted to the ../config.d/ directory.
 	CustomConfigPath *string
 
@@ -17,12 +31,124 @@ type Config struct {
 	// https://clickhouse.com/docs/en/operations/quotas/
 	QuotasPath *string
 
+	// If Restricted is set, the generated restricted profile is applied to every container.
+	// It cannot be disabled by runs.
+	Restricted *RestrictedProfile
+
+	// If Egress is set, database containers can reach allowlisted hosts through a proxy.
+	// Otherwise, Container.NetworkMode is used. Runs can opt out to the none network mode.
+	Egress *EgressConfig
+
+	// If Isolation is set, containers have no network or share an internal one without external access.
+	// It cannot be used together with Egress and Container.NetworkMode.
+	Isolation *IsolationConfig
+
+	// Mirrors are registries serving images of a repository, e.g. a pull-through cache.
+	// They are tried in order before the upstream registry.
+	Mirrors []MirrorConfig
+
+	// MirrorTimeout bounds the wait for a mirror to start serving the image before the next source is tried.
+	MirrorTimeout time.Duration
+
+	// PullRetry retries pulls from the upstream registry failed because of transient errors,
+	// e.g. TLS handshake timeouts or 5xx responses. Permanent errors are returned at once.
+	PullRetry PullRetryConfig
+
+	// PullTimeout bounds every attempt to pull an image from the upstream registry, separately from
+	// the run deadline. A timed-out attempt is retried. If 0, attempts are bounded by the run context only.
+	PullTimeout time.Duration
+
+	// Architecture is the architecture of images the runner pulls, e.g. arm64. Versions without a build
+	// for it are refused. If it's empty, the architecture of the daemon host is used.
+	Architecture string
+
+	// Registries are credentials of private registries by their hosts, docker.io for Docker Hub.
+	// They are passed to the daemon with pulls from the registry, mirrors are registries as well.
+	Registries map[string]RegistryCredentials
+
+	// MaxExecutionTime bounds the query execution, regardless of the caller's deadline. It's passed to the client
+	// as max_execution_time, and the container is killed if the exec is still running after execTimeoutGrace.
+	// If 0, the query is bounded by the caller's context only.
+	MaxExecutionTime time.Duration
+
+	// MaxOutputBytes bounds the output of a run kept in memory. Once it's reached, the client is stopped,
+	// and the result is marked as truncated. If 0, the output is unlimited.
+	MaxOutputBytes uint64
+
+	// MaxResultRows is passed to the client as max_result_rows with result_overflow_mode=break, so the server
+	// stops producing huge results before MaxOutputBytes is reached. If 0, the number of rows is unlimited.
+	MaxResultRows uint64
+
 	GC *GCConfig
 
+	// SnapshotLogsLength is the max length of the logs tail kept in container snapshots (in bytes).
+	SnapshotLogsLength uint
+
+	// StartupLogsLength is the max length of the sanitized logs tail attached to errors of database servers
+	// that have not started (in bytes). The full tail is logged anyway. If 0, logs are not attached.
+	StartupLogsLength uint
+
+	// If KeepContainerOnFailure is set, containers of runs failed because of the infrastructure are not removed
+	// immediately, but held for inspection for HoldPeriod. Runs can override it. Holding requires GC.
+	KeepContainerOnFailure bool
+	HoldPeriod             time.Duration
+
 	MaxWarmContainers         uint
 	StatusCollectionFrequency time.Duration
 
+	// WarmPool bounds the distribution of MaxWarmContainers across versions by their popularity.
+	WarmPool WarmPoolConfig
+
 	Container ContainerSettings
+
+	Reservation ReservationConfig
+
+	Remediation RemediationConfig
+}
+
+// WarmPoolConfig bounds the warm pool allocation. The total budget is Config.MaxWarmContainers.
+type WarmPoolConfig struct {
+	// MinPerVersion containers are allocated to every popular version while the budget allows.
+	MinPerVersion uint
+
+	// MaxPerVersion bounds containers allocated to a version by popularity. If 0, only the budget bounds it.
+	MaxPerVersion uint
+
+	// Pinned versions get the given number of containers regardless of their popularity.
+	Pinned map[string]uint
+
+	// IdleTTL is how long a warm container can stay unused. Expired containers are removed,
+	// allocated pools are refilled by the next resize. If 0, warm containers are kept until they are evicted.
+	IdleTTL time.Duration
+}
+
+// MirrorConfig lists mirrors of the repository. Images are pulled from mirrors by digest,
+// so a stale mirror cannot serve other content than the tag had when it was cached.
+type MirrorConfig struct {
+	Repository string
+
+	// Endpoints are registry hosts with an optional port and path prefix, e.g. mirror.local:5000/hub.
+	Endpoints []string
+}
+
+// PullRetryConfig configures retries of pulls. The delay doubles with every retry up to MaxDelay.
+type PullRetryConfig struct {
+	// MaxAttempts includes the first attempt. If it's 0 or 1, pulls are not retried.
+	MaxAttempts  uint
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// ReservationConfig configures containers that are started in advance by clients' requests.
+type ReservationConfig struct {
+	// Unused reserved containers are removed after TTL.
+	TTL time.Duration
+
+	// Upper bound of reserved containers on the runner. If 0, reservations are disabled.
+	MaxReservations uint
+
+	// Upper bound of reserved containers per client. If 0, only MaxReservations is applied.
+	MaxReservationsPerClient uint
 }
 
 type ContainerSettings struct {
@@ -31,6 +157,7 @@ type ContainerSettings struct {
 	CPULimit    uint64 // In nano cpus (1 core = 1e9 nano cpus). If 0, then unlimited.
 	CPUSet      string // A comma-separated list or hyphen-separated range of CPUs a container can use. If "", then any cores can be used.
 	MemoryLimit uint64 // In bytes. If 0, then unlimited.
+	PidsLimit   int64  // Max number of processes and threads. If 0, then unlimited.
 }
 
 type GCConfig struct {
@@ -39,14 +166,46 @@ type GCConfig struct {
 
 	// During the container garbage collection, all containers created
 	// before (time.Now() - ContainerTTL) will be removed.
-	// If ContainerTTL is nil, containers are not force removed.
+	// If ContainerTTL is nil, containers are not force removed. Containers of in-flight runs are kept
+	// until 2*ContainerTTL has passed since the run has taken them.
 	ContainerTTL *time.Duration
 
 	// Image gc triggers when there are at least ImageGCCountThreshold downloaded chp images.
-	// After the garbage collection, at most ImageBufferSize least recently tagged images will be left.
+	// After the garbage collection, at most ImageBufferSize most recently used images will be left.
 	// If ImageGCCountThreshold is missed, images are not pruned.
 	ImageGCCountThreshold *uint
 	ImageBufferSize       uint
+
+	// If ImageSizeBudget is set, least recently tagged chp images are removed until their total size
+	// is under the budget (in bytes). Images of existing containers are never removed.
+	// It can be used together with the count-based mode.
+	ImageSizeBudget *uint64
+
+	// If DiskPressure is set, least recently used chp images are removed once the disk usage exceeds
+	// the high watermark, until it's under the low watermark.
+	DiskPressure *DiskPressureConfig
+
+	// Containers, restricted egress networks and dangling volumes of playground containers are collected
+	// unless their phases are disabled.
+	DisableContainers     bool
+	DisableEgressNetworks bool
+	DisableVolumes        bool
+
+	// If PruneBuildCache is set, dangling build cache is pruned as well. It's shared with other users of the daemon.
+	PruneBuildCache bool
+}
+
+// DiskPressureConfig defines how the disk usage is measured and when images are evicted.
+type DiskPressureConfig struct {
+	// If DataRoot is set, the usage and the capacity of its filesystem are measured. It's the Docker data-root
+	// as seen by the server, so it requires a local daemon. Otherwise, the usage is the total size of images,
+	// containers, volumes and build cache reported by the daemon, and Capacity bounds it (in bytes).
+	DataRoot string
+	Capacity uint64
+
+	// HighWatermark and LowWatermark are fractions of the capacity, 0 < low < high <= 1.
+	HighWatermark float64
+	LowWatermark  float64
 }
 
 var defaultContainerTTL = 60 * time.Second
@@ -69,6 +228,13 @@ var DefaultConfig = Config{
 		ImageBufferSize:       defaultImageBufferSize,
 	},
 
+	SnapshotLogsLength: DefaultSnapshotLogsLength,
+	StartupLogsLength:  DefaultStartupLogsLength,
+	HoldPeriod:         DefaultHoldPeriod,
+	MirrorTimeout:      DefaultMirrorTimeout,
+	PullRetry:          DefaultPullRetry,
+	PullTimeout:        DefaultPullTimeout,
+
 	MaxWarmContainers:         5,
 	StatusCollectionFrequency: 30 * time.Second,
 
@@ -78,4 +244,17 @@ var DefaultConfig = Config{
 		CPUSet:      "",
 		MemoryLimit: 1 * 1e9,
 	},
+
+	Reservation: ReservationConfig{
+		TTL:                      30 * time.Second,
+		MaxReservations:          0,
+		MaxReservationsPerClient: 1,
+	},
+
+	Remediation: RemediationConfig{
+		MinInterval:            time.Minute,
+		MemoryFailureThreshold: 3,
+		MemoryFailureWindow:    time.Minute,
+		ThrottlePeriod:         5 * time.Minute,
+	},
 }
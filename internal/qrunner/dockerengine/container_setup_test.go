@@ -0,0 +1,178 @@
+package dockerengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon serves the Docker API calls of a container setup. Failures are injected by the step,
+// and the client can be cancelled once the step is reached.
+type fakeDaemon struct {
+	fail     string
+	cancelAt string
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	created bool
+	removed []string
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	step := ""
+	switch {
+	case strings.HasSuffix(path, "/containers/create"):
+		step = "create"
+	case strings.HasSuffix(path, "/archive"):
+		step = "copy"
+	case strings.HasSuffix(path, "/start"):
+		step = "start"
+	}
+	if step != "" && step == d.cancelAt {
+		d.cancel()
+	}
+
+	switch {
+	case r.Method == http.MethodGet && strings.Contains(path, "/images/"):
+		_, _ = w.Write([]byte(`{"Id": "sha256:image"}`))
+
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/containers/json"):
+		d.mu.Lock()
+		created := d.created
+		d.mu.Unlock()
+		if !created {
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"Id": "container-1", "Labels": {"clickhouse.playground.run": "run", "clickhouse.playground.runner": "test"}}]`))
+
+	case step == "create":
+		if d.fail == "create" {
+			http.Error(w, `{"message": "create failed"}`, http.StatusInternalServerError)
+			return
+		}
+		d.mu.Lock()
+		d.created = true
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"Id": "container-1"}`))
+
+	case step == "copy":
+		if d.fail == "copy" {
+			http.Error(w, `{"message": "copy failed"}`, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case step == "start":
+		if d.fail == "start" {
+			http.Error(w, `{"message": "start failed"}`, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/json"):
+		_, _ = w.Write([]byte(`{"Id": "container-1", "Config": {"Labels": {}}}`))
+
+	case r.Method == http.MethodDelete && strings.Contains(path, "/containers/"):
+		d.mu.Lock()
+		d.removed = append(d.removed, path[strings.LastIndex(path, "/")+1:])
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+	}
+}
+
+func (d *fakeDaemon) removedContainers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string(nil), d.removed...)
+}
+
+func newFakeDaemonRunner(t *testing.T, daemon *fakeDaemon) *Runner {
+	srv := httptest.NewServer(daemon)
+	t.Cleanup(srv.Close)
+
+	cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+	require.NoError(t, err)
+
+	metr := metrics.NewPipelineExporter(string(qrunner.TypeDockerEngine), "TestContainerSetup"+time.Now().Format(time.RFC3339Nano))
+
+	return &Runner{
+		ctx:          context.Background(),
+		cleanupCtx:   context.Background(),
+		logger:       zerolog.Nop(),
+		name:         "test",
+		cfg:          Config{Restricted: &DefaultRestrictedProfile},
+		engine:       &engineProvider{mainCtx: context.Background(), cli: cli},
+		pipelineMetr: metr,
+		imageUsage:   newImageUsage(),
+		remediator:   newRemediator(zerolog.Nop(), "test", RemediationConfig{}, nil, metr),
+	}
+}
+
+func TestCreateContainer_RemovesOrphans(t *testing.T) {
+	tests := []struct {
+		fail    string
+		removed []string
+	}{
+		{fail: "create"},
+		{fail: "copy", removed: []string{"container-1"}},
+		{fail: "start", removed: []string{"container-1"}},
+		{fail: "", removed: nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run("fail "+tt.fail, func(t *testing.T) {
+			daemon := &fakeDaemon{fail: tt.fail}
+			r := newFakeDaemonRunner(t, daemon)
+
+			state := &requestState{runID: "run", version: "23.3", imageTag: "23.3", imageFQN: "clickhouse/clickhouse-server:23.3"}
+			err := r.createContainer(context.Background(), state)
+			if tt.fail == "" {
+				require.NoError(t, err)
+				assert.Equal(t, "container-1", state.containerID, "the caller removes the container")
+			} else {
+				require.Error(t, err)
+				assert.Empty(t, state.containerID)
+			}
+			assert.Equal(t, tt.removed, daemon.removedContainers())
+		})
+	}
+
+	// The run is cancelled while the step is in progress. The container is removed on the cleanup context,
+	// even if its creation has been cancelled and the id is unknown.
+	for _, step := range []string{"create", "copy", "start"} {
+		step := step
+		t.Run("cancelled at "+step, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			daemon := &fakeDaemon{cancelAt: step, cancel: cancel}
+			r := newFakeDaemonRunner(t, daemon)
+
+			state := &requestState{runID: "run", version: "23.3", imageTag: "23.3", imageFQN: "clickhouse/clickhouse-server:23.3"}
+			err := r.createContainer(ctx, state)
+			require.Error(t, err)
+			assert.Empty(t, state.containerID)
+			assert.Equal(t, []string{"container-1"}, daemon.removedContainers())
+		})
+	}
+}
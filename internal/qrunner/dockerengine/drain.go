@@ -0,0 +1,64 @@
+package dockerengine
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// runDrain tracks runs in progress, so the runner is stopped once they are finished. New runs are refused
+// as soon as the drain has started.
+type runDrain struct {
+	mu       sync.Mutex
+	draining bool
+	running  int
+	done     chan struct{}
+}
+
+func newRunDrain() *runDrain {
+	return &runDrain{done: make(chan struct{})}
+}
+
+// enter registers a run. It returns false if the runner is draining.
+func (d *runDrain) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.running++
+
+	return true
+}
+
+func (d *runDrain) leave() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.running--
+	if d.draining && d.running == 0 {
+		close(d.done)
+	}
+}
+
+// wait refuses new runs and waits for the ones in progress until the context is done.
+func (d *runDrain) wait(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.draining {
+		d.draining = true
+		if d.running == 0 {
+			close(d.done)
+		}
+	}
+	running := d.running
+	d.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return errors.Errorf("%d runs have not finished in time", running)
+	}
+}
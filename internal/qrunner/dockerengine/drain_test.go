@@ -0,0 +1,44 @@
+package dockerengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDrain(t *testing.T) {
+	d := newRunDrain()
+	require.True(t, d.enter())
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- d.wait(context.Background())
+	}()
+
+	// The run started before the drain is finished, new runs are refused meanwhile.
+	assert.Eventually(t, func() bool { return !d.enter() }, time.Second, time.Millisecond)
+	select {
+	case <-drained:
+		t.Fatal("drain has finished before the run")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	d.leave()
+	require.NoError(t, <-drained)
+
+	t.Run("timeout", func(t *testing.T) {
+		d := newRunDrain()
+		require.True(t, d.enter())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Error(t, d.wait(ctx))
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		assert.NoError(t, newRunDrain().wait(context.Background()))
+	})
+}
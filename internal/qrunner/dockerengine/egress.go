@@ -0,0 +1,271 @@
+package dockerengine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// DefaultEgressProxyImage is a Squid image. The runner generates the Squid config, so other proxies are not supported.
+const DefaultEgressProxyImage = "ubuntu/squid:latest"
+
+const (
+	// labelEgressNetwork is set for database and proxy containers attached to a restricted egress network.
+	labelEgressNetwork = "clickhouse.playground.egress.network"
+	labelEgressProxy   = "clickhouse.playground.egress.proxy"
+
+	egressNetworkPrefix = "chp-egress-"
+	egressProxySuffix   = "-proxy"
+
+	// The proxy is reachable by the alias from the internal network.
+	egressProxyAlias = "egress-proxy"
+	egressProxyPort  = 3128
+
+	egressProxyConfigDir  = "/etc/squid"
+	egressProxyConfigFile = "squid.conf"
+
+	egressClientConfigDir  = "/etc/clickhouse-server/config.d"
+	egressClientConfigFile = "egress-proxy.xml"
+)
+
+var egressDestinationRegexp = regexp.MustCompile(`^\.?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// EgressConfig enables the restricted egress network mode. Every database container gets its own internal network
+// where the only reachable host is a forward proxy that allows destinations from the allowlist.
+type EgressConfig struct {
+	// ProxyImage is a Squid image used for proxy containers.
+	ProxyImage string
+
+	// Allowlist contains allowed destination hosts, e.g. datasets.clickhouse.com.
+	// A leading dot allows the domain and all its subdomains, e.g. .s3.amazonaws.com.
+	Allowlist []string
+}
+
+func validateEgress(cfg *EgressConfig) error {
+	if cfg == nil {
+		return nil
+	}
+
+	if cfg.ProxyImage == "" {
+		return errors.New("proxy image is required")
+	}
+	if len(cfg.Allowlist) == 0 {
+		return errors.New("allowlist cannot be empty")
+	}
+
+	for _, dst := range cfg.Allowlist {
+		if !egressDestinationRegexp.MatchString(dst) {
+			return errors.Errorf("invalid destination '%s': only host names are allowed", dst)
+		}
+	}
+
+	return nil
+}
+
+// renderProxyConfig generates the Squid config: allowlisted destinations are forwarded, others are denied.
+// Access logs are written to stdout, so denied destinations can be found in the container logs.
+func (c EgressConfig) renderProxyConfig() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "http_port %d\n", egressProxyPort)
+	b.WriteString("acl allowlist dstdomain " + strings.Join(c.Allowlist, " ") + "\n")
+	b.WriteString("acl SSL_ports port 443\n")
+	b.WriteString("acl CONNECT method CONNECT\n")
+	b.WriteString("http_access deny CONNECT !SSL_ports\n")
+	b.WriteString("http_access allow allowlist\n")
+	b.WriteString("http_access deny all\n")
+	b.WriteString("cache deny all\n")
+	b.WriteString("access_log stdio:/dev/stdout squid\n")
+	b.WriteString("cache_log stdio:/dev/stderr\n")
+
+	return []byte(b.String())
+}
+
+func egressProxyURL() string {
+	return fmt.Sprintf("http://%s:%d", egressProxyAlias, egressProxyPort)
+}
+
+// renderEgressClientConfig generates the config.d file that makes ClickHouse send url() and s3() requests through the proxy.
+func renderEgressClientConfig() []byte {
+	proxy := egressProxyURL()
+
+	var b strings.Builder
+	b.WriteString("<clickhouse>\n")
+	b.WriteString("    <proxy>\n")
+	fmt.Fprintf(&b, "        <http>\n            <uri>%s</uri>\n        </http>\n", proxy)
+	fmt.Fprintf(&b, "        <https>\n            <uri>%s</uri>\n        </https>\n", proxy)
+	b.WriteString("    </proxy>\n")
+	b.WriteString("</clickhouse>\n")
+
+	return []byte(b.String())
+}
+
+// egressEnv sets proxy variables for versions and tools that read them instead of the server config.
+func egressEnv() []string {
+	proxy := egressProxyURL()
+
+	return []string{
+		"http_proxy=" + proxy,
+		"https_proxy=" + proxy,
+		"HTTP_PROXY=" + proxy,
+		"HTTPS_PROXY=" + proxy,
+	}
+}
+
+func egressProxyName(network string) string {
+	return network + egressProxySuffix
+}
+
+// parseDeniedDestinations extracts hosts of denied requests from Squid access logs in the native format:
+// time elapsed client TCP_DENIED/403 size method URL ...
+func parseDeniedDestinations(logs io.Reader) ([]string, error) {
+	var denied []string
+	seen := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 || !strings.HasPrefix(fields[3], "TCP_DENIED/") {
+			continue
+		}
+
+		host := destinationHost(fields[5], fields[6])
+		if _, found := seen[host]; found {
+			continue
+		}
+
+		seen[host] = struct{}{}
+		denied = append(denied, host)
+	}
+
+	return denied, scanner.Err()
+}
+
+// destinationHost returns the host of the logged request. CONNECT requests are logged as host:port,
+// others as absolute URLs.
+func destinationHost(method, target string) string {
+	if method == "CONNECT" {
+		if i := strings.LastIndex(target, ":"); i != -1 {
+			return target[:i]
+		}
+
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Hostname() == "" {
+		return target
+	}
+
+	return u.Hostname()
+}
+
+// setupEgress creates the internal network of a database container and starts the proxy attached to it.
+// The database container can reach only the proxy, while the proxy also has the default network to reach destinations.
+// The proxy is named after the network, so both are created again with another name if the name is taken.
+func (r *Runner) setupEgress(ctx context.Context, state *requestState) (string, error) {
+	network, err := r.createEgress(ctx, state, egressNetworkPrefix+uuid.NewString())
+	if isContainerFailure(err, failureNameConflict) &&
+		r.remediator.apply(qrunner.RemediationRename, failureNameConflict, "egress proxy has been created with another name", time.Now(), nil) {
+		network, err = r.createEgress(ctx, state, egressNetworkPrefix+uuid.NewString())
+	}
+
+	return network, err
+}
+
+func (r *Runner) createEgress(ctx context.Context, state *requestState, network string) (_ string, err error) {
+	labels := qrunner.CreateContainerLabels(r.name, state.runID, state.version, state.clientID)
+	labels[labelEgressNetwork] = network
+
+	_, err = r.engine.createNetwork(ctx, network, labels)
+	if err != nil {
+		return "", errors.Wrap(err, "network cannot be created")
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		rmErr := r.engine.removeEgress(r.cleanupCtx, network)
+		if rmErr != nil {
+			r.logger.Error().Err(rmErr).Str("network", network).Msg("failed to remove egress network")
+		}
+	}()
+
+	err = r.engine.ensureImage(ctx, r.cfg.Egress.ProxyImage)
+	if err != nil {
+		return "", errors.Wrap(err, "proxy image cannot be pulled")
+	}
+
+	proxyLabels := qrunner.CreateContainerLabels(r.name, state.runID, state.version, state.clientID)
+	proxyLabels[labelEgressNetwork] = network
+	proxyLabels[labelEgressProxy] = "1"
+
+	proxy, err := r.engine.createNamedContainer(ctx, egressProxyName(network), &container.Config{
+		Image:  r.cfg.Egress.ProxyImage,
+		Labels: proxyLabels,
+	}, &container.HostConfig{})
+	if err != nil {
+		return "", errors.Wrap(r.remediator.failed(containerStepCreate, err), "proxy container cannot be created")
+	}
+
+	archive, err := fileArchive(egressProxyConfigFile, r.cfg.Egress.renderProxyConfig())
+	if err != nil {
+		return "", errors.Wrap(err, "proxy config cannot be generated")
+	}
+
+	err = r.engine.copyToContainer(ctx, proxy.ID, egressProxyConfigDir, archive)
+	if err != nil {
+		return "", errors.Wrap(err, "proxy config cannot be copied to the container")
+	}
+
+	err = r.engine.connectNetwork(ctx, network, proxy.ID, egressProxyAlias)
+	if err != nil {
+		return "", errors.Wrap(err, "proxy cannot be connected to the network")
+	}
+
+	err = r.engine.startContainer(ctx, proxy.ID)
+	if err != nil {
+		return "", errors.Wrap(r.remediator.failed(containerStepStart, err), "proxy container cannot be started")
+	}
+
+	r.logger.Debug().Str("run_id", state.runID).Str("network", network).Str("proxy_id", proxy.ID).
+		Msg("egress proxy has been started")
+
+	return network, nil
+}
+
+// egressDenials returns destinations the proxy of the database container has denied.
+// It's empty if the container has no restricted egress network.
+func (r *Runner) egressDenials(ctx context.Context, containerID string) ([]string, error) {
+	network, err := r.engine.egressNetwork(ctx, containerID)
+	if err != nil || network == "" {
+		return nil, err
+	}
+
+	logs, err := r.engine.containerLogs(ctx, egressProxyName(network), "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get proxy logs")
+	}
+	defer logs.Close()
+
+	stdout := &cappedBuffer{limit: maxLogsLength}
+	_, err = stdcopy.StdCopy(stdout, io.Discard, logs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read proxy logs")
+	}
+
+	return parseDeniedDestinations(stdout)
+}
@@ -0,0 +1,62 @@
+package dockerengine
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateEgress(t *testing.T) {
+	assert.NoError(t, validateEgress(nil))
+	assert.NoError(t, validateEgress(&EgressConfig{
+		ProxyImage: DefaultEgressProxyImage,
+		Allowlist:  []string{"datasets.clickhouse.com", ".s3.amazonaws.com"},
+	}))
+
+	assert.Error(t, validateEgress(&EgressConfig{ProxyImage: DefaultEgressProxyImage}))
+	assert.Error(t, validateEgress(&EgressConfig{Allowlist: []string{"datasets.clickhouse.com"}}))
+
+	for _, dst := range []string{"https://datasets.clickhouse.com", "datasets.clickhouse.com:443", "s3.amazonaws.com/bucket", "*.example.com", ""} {
+		err := validateEgress(&EgressConfig{ProxyImage: DefaultEgressProxyImage, Allowlist: []string{dst}})
+		assert.Error(t, err, dst)
+	}
+}
+
+func TestEgressProxyConfig(t *testing.T) {
+	cfg := EgressConfig{Allowlist: []string{"datasets.clickhouse.com", ".s3.amazonaws.com"}}
+
+	rendered := string(cfg.renderProxyConfig())
+
+	assert.Contains(t, rendered, "acl allowlist dstdomain datasets.clickhouse.com .s3.amazonaws.com\n")
+	assert.Less(t, strings.Index(rendered, "http_access allow allowlist"), strings.Index(rendered, "http_access deny all"))
+}
+
+func TestEgressClientConfig(t *testing.T) {
+	var parsed struct {
+		HTTP  string `xml:"proxy>http>uri"`
+		HTTPS string `xml:"proxy>https>uri"`
+	}
+	err := xml.Unmarshal(renderEgressClientConfig(), &parsed)
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://egress-proxy:3128", parsed.HTTP)
+	assert.Equal(t, "http://egress-proxy:3128", parsed.HTTPS)
+}
+
+func TestParseDeniedDestinations(t *testing.T) {
+	logs := strings.Join([]string{
+		"1680000000.100      5 172.18.0.3 TCP_TUNNEL/200 5123 CONNECT datasets.clickhouse.com:443 - HIER_DIRECT/1.2.3.4 -",
+		"1680000000.200      0 172.18.0.3 TCP_DENIED/403 3990 CONNECT example.com:443 - HIER_NONE/- text/html",
+		"1680000000.300      0 172.18.0.3 TCP_DENIED/403 3990 GET http://files.example.org/data.csv - HIER_NONE/- text/html",
+		"1680000000.400      0 172.18.0.3 TCP_DENIED/403 3990 CONNECT example.com:443 - HIER_NONE/- text/html",
+		"2023/04/01 12:00:00| Accepting HTTP Socket connections at conn3 local=[::]:3128",
+	}, "\n")
+
+	denied, err := parseDeniedDestinations(strings.NewReader(logs))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"example.com", "files.example.org"}, denied)
+}
@@ -0,0 +1,131 @@
+package dockerengine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// architectureAliases map names reported by kernels and some images to the ones used by Docker.
+var architectureAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"armv8":   "arm64",
+}
+
+func normalizeArchitecture(arch string) string {
+	arch = strings.ToLower(strings.TrimSpace(arch))
+	if alias, ok := architectureAliases[arch]; ok {
+		return alias
+	}
+
+	return arch
+}
+
+// hostArchitecture caches the architecture of the daemon host, it does not change while the runner is connected.
+type hostArchitecture struct {
+	mu   sync.Mutex
+	arch string
+}
+
+func (h *hostArchitecture) get(ctx context.Context, engine *engineProvider) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.arch != "" {
+		return h.arch, nil
+	}
+
+	arch, err := engine.architecture(ctx)
+	if err != nil {
+		return "", err
+	}
+	h.arch = normalizeArchitecture(arch)
+
+	return h.arch, nil
+}
+
+// architecture returns the architecture of images the runner pulls: the configured one or the host one.
+func (r *Runner) architecture(ctx context.Context) (string, error) {
+	if r.cfg.Architecture != "" {
+		return normalizeArchitecture(r.cfg.Architecture), nil
+	}
+
+	return r.hostArch.get(ctx, r.engine)
+}
+
+// findBuild returns the image of the version built for the architecture of the runner.
+func (r *Runner) findBuild(ctx context.Context, version string) (dockertag.Image, error) {
+	img, found := r.tagStorage.Find(version)
+	if !found {
+		return dockertag.Image{}, errors.New("version not found")
+	}
+
+	arch, err := r.architecture(ctx)
+	if err != nil {
+		return dockertag.Image{}, errors.Wrap(err, "failed to get the host architecture")
+	}
+
+	build, found := img.ForArchitecture(arch)
+	if !found {
+		return dockertag.Image{}, errors.Wrapf(qrunner.ErrArchitectureUnavailable, "%s has no %s build", version, arch)
+	}
+
+	return build, nil
+}
+
+// detectEmulation returns the architecture of the image if it differs from the host one. Otherwise, it's empty.
+// The image must be pulled. If either architecture cannot be told, the run is considered native.
+func (r *Runner) detectEmulation(ctx context.Context, state *requestState) string {
+	host, err := r.hostArch.get(ctx, r.engine)
+	if err != nil {
+		r.logger.Warn().Err(err).Str("run_id", state.runID).Msg("failed to get the host architecture")
+		return ""
+	}
+
+	// Images are inspected every time, since rolling tags may be re-pulled for another platform.
+	inspect, err := r.engine.getImageByID(ctx, state.imageFQN)
+	if err != nil {
+		r.logger.Warn().Err(err).Str("run_id", state.runID).Str("image", state.imageFQN).
+			Msg("failed to get the image architecture")
+
+		return ""
+	}
+
+	image := normalizeArchitecture(inspect.Architecture)
+	if image == "" || image == host {
+		return ""
+	}
+
+	state.hostArch = host
+
+	return image
+}
+
+// reportEmulation warns the user that the run has been executed under emulation.
+func (r *Runner) reportEmulation(run *queryrun.Run, state *requestState) {
+	if state.emulatedArch == "" {
+		return
+	}
+
+	run.EmulatedArchitecture = state.emulatedArch
+	run.Warn(queryrun.WarningEmulatedArchitecture,
+		fmt.Sprintf("the %s image has been run under emulation on a %s host, so it's much slower than a native run "+
+			"and its timings must not be compared", state.emulatedArch, state.hostArch),
+		map[string]string{"image_architecture": state.emulatedArch, "host_architecture": state.hostArch})
+	r.pipelineMetr.EmulatedRun(state.version)
+	r.logger.Warn().
+		Str("run_id", state.runID).
+		Str("version", state.version).
+		Str("image_architecture", state.emulatedArch).
+		Str("host_architecture", state.hostArch).
+		Msg("run has been executed under emulation")
+}
@@ -0,0 +1,28 @@
+package dockerengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeArchitecture(t *testing.T) {
+	tests := []struct {
+		arch string
+		want string
+	}{
+		{arch: "amd64", want: "amd64"},
+		{arch: "x86_64", want: "amd64"},
+		{arch: "aarch64", want: "arm64"},
+		{arch: " ARM64 ", want: "arm64"},
+		{arch: "s390x", want: "s390x"},
+		{arch: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.arch, func(t *testing.T) {
+			assert.Equal(t, tt.want, normalizeArchitecture(tt.arch))
+		})
+	}
+}
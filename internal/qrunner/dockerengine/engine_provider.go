@@ -2,8 +2,10 @@ package dockerengine
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"clickhouse-playground/internal/qrunner"
@@ -12,20 +14,37 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/versions"
 	dockercli "github.com/docker/docker/client"
 	"github.com/pkg/errors"
 )
 
 const DefaultDockerTimeout = 5 * time.Minute
 
+// MinAPIVersion is the oldest Engine API version the runner works with. It's served by Docker 19.03+
+// and by the Docker-compatible socket of Podman 3+.
+const MinAPIVersion = "1.40"
+
+// DaemonTLSConfig secures connections to tcp:// daemons. Paths refer to PEM files.
+// If CertPath and KeyPath are empty, the daemon is verified, but the client is not authenticated.
+type DaemonTLSConfig struct {
+	CACertPath string
+	CertPath   string
+	KeyPath    string
+}
+
 // engineProvider simplifies communication with Docker Engine API.
 type engineProvider struct {
 	mainCtx context.Context
 	cli     *dockercli.Client
+
+	// auth keeps the encoded credentials of registries by their hosts.
+	auth map[string]string
 }
 
-func newProvider(ctx context.Context, daemonURL *string) (*engineProvider, error) {
-	opts, err := getDockerEngineOpts(daemonURL)
+func newProvider(ctx context.Context, daemonURL *string, daemonTLS *DaemonTLSConfig) (*engineProvider, error) {
+	opts, err := getDockerEngineOpts(daemonURL, daemonTLS)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build options for Docker client")
 	}
@@ -41,18 +60,45 @@ func newProvider(ctx context.Context, daemonURL *string) (*engineProvider, error
 	}, nil
 }
 
-func getDockerEngineOpts(daemonURL *string) ([]dockercli.Opt, error) {
+// getDockerEngineOpts builds the client options from the config only, DOCKER_HOST and other env variables
+// of the process are not applied. The daemon url is ssh://user@host, tcp://host:port or unix:///path,
+// a bare socket path is accepted as well. If the url is nil, the default local socket is used.
+func getDockerEngineOpts(daemonURL *string, daemonTLS *DaemonTLSConfig) ([]dockercli.Opt, error) {
 	opts := []dockercli.Opt{
 		dockercli.WithAPIVersionNegotiation(),
 		dockercli.WithTimeout(DefaultDockerTimeout),
 	}
 
-	if daemonURL == nil {
+	host := dockercli.DefaultDockerHost
+	if daemonURL != nil {
+		host = *daemonURL
+	}
+	if strings.HasPrefix(host, "/") {
+		host = "unix://" + host
+	}
+
+	scheme, _, _ := strings.Cut(host, "://")
+	if daemonTLS != nil && scheme != "tcp" {
+		return nil, errors.Errorf("tls is supported by tcp daemon urls only, but %s has been found", scheme)
+	}
+
+	switch scheme {
+	case "ssh":
+	case "tcp":
+		opts = append(opts, dockercli.WithHost(host))
+		if daemonTLS != nil {
+			opts = append(opts, dockercli.WithTLSClientConfig(daemonTLS.CACertPath, daemonTLS.CertPath, daemonTLS.KeyPath))
+		}
+
 		return opts, nil
+	case "unix":
+		return append(opts, dockercli.WithHost(host)), nil
+	default:
+		return nil, errors.Errorf("unsupported daemon url %s (supported schemes: ssh, tcp, unix)", host)
 	}
 
 	// Set 'StrictHostKeyChecking=no' to simplify startup in Docker containers.
-	helper, err := connhelper.GetConnectionHelperWithSSHOpts(*daemonURL, []string{"-o", "StrictHostKeyChecking=no"})
+	helper, err := connhelper.GetConnectionHelperWithSSHOpts(host, []string{"-o", "StrictHostKeyChecking=no"})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create ssh connection")
 	}
@@ -81,12 +127,38 @@ func (p *engineProvider) ping(ctx context.Context) error {
 	return err
 }
 
+// checkAPIVersion negotiates the API version with the daemon and fails if the daemon is older than MinAPIVersion.
+func (p *engineProvider) checkAPIVersion(ctx context.Context) error {
+	p.cli.NegotiateAPIVersion(ctx)
+
+	version := p.cli.ClientVersion()
+	if versions.LessThan(version, MinAPIVersion) {
+		return errors.Errorf("daemon %s serves Engine API %s, but %s at least is required: "+
+			"upgrade Docker to 19.03+ or Podman to 3.0+", p.cli.DaemonHost(), version, MinAPIVersion)
+	}
+
+	return nil
+}
+
+// architecture returns the architecture of the daemon host, e.g. amd64.
+func (p *engineProvider) architecture(ctx context.Context) (string, error) {
+	version, err := p.cli.ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return version.Arch, nil
+}
+
 func (p *engineProvider) ownershipLabelFilter() (key, value string) {
 	return "label", qrunner.LabelOwnership
 }
 
-func (p *engineProvider) pullImage(ctx context.Context, imageTag string) (io.ReadCloser, error) {
-	return p.cli.ImagePull(ctx, imageTag, types.ImagePullOptions{})
+func (p *engineProvider) pullImage(ctx context.Context, imageTag, platform string) (io.ReadCloser, error) {
+	return p.cli.ImagePull(ctx, imageTag, types.ImagePullOptions{
+		RegistryAuth: p.registryAuth(imageTag),
+		Platform:     platform,
+	})
 }
 
 func (p *engineProvider) addImageTag(ctx context.Context, existingImageTag, newImageTag string) error {
@@ -137,13 +209,75 @@ func (p *engineProvider) removeImage(ctx context.Context, tag string, pruneChild
 }
 
 func (p *engineProvider) createContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig) (container.CreateResponse, error) {
-	return p.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	return p.createNamedContainer(ctx, "", config, hostConfig)
+}
+
+// createNamedContainer creates a container that can be referred by the name. If the name is empty, it's generated.
+func (p *engineProvider) createNamedContainer(ctx context.Context, name string, config *container.Config, hostConfig *container.HostConfig) (container.CreateResponse, error) {
+	return p.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, name)
+}
+
+// copyToContainer extracts the tar archive to the directory of the container.
+func (p *engineProvider) copyToContainer(ctx context.Context, id string, dir string, archive io.Reader) error {
+	return p.cli.CopyToContainer(ctx, id, dir, archive, types.CopyToContainerOptions{})
 }
 
 func (p *engineProvider) startContainer(ctx context.Context, id string) error {
 	return p.cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
 }
 
+// waitContainer blocks until the container stops and returns its exit code.
+func (p *engineProvider) waitContainer(ctx context.Context, id string) (int64, error) {
+	statusCh, errCh := p.cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case status := <-statusCh:
+		if status.Error != nil {
+			return 0, errors.New(status.Error.Message)
+		}
+
+		return status.StatusCode, nil
+
+	case err := <-errCh:
+		return 0, err
+	}
+}
+
+// containerLogs returns multiplexed stdout and stderr of the container.
+// If tail is set, only the given number of last lines is returned.
+// Keep in mind that you have to close the returned reader.
+func (p *engineProvider) containerLogs(ctx context.Context, id string, tail string) (io.ReadCloser, error) {
+	return p.cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       tail,
+	})
+}
+
+func (p *engineProvider) inspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	return p.cli.ContainerInspect(ctx, id)
+}
+
+// containerStats returns the current resource usage of the container.
+func (p *engineProvider) containerStats(ctx context.Context, id string) (types.StatsJSON, error) {
+	resp, err := p.cli.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		return types.StatsJSON{}, err
+	}
+	defer resp.Body.Close()
+
+	var stats types.StatsJSON
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return types.StatsJSON{}, errors.Wrap(err, "failed to decode stats")
+	}
+
+	return stats, nil
+}
+
+func (p *engineProvider) renameContainer(ctx context.Context, id string, name string) error {
+	return p.cli.ContainerRename(ctx, id, name)
+}
+
 func (p *engineProvider) pauseContainer(ctx context.Context, id string) error {
 	return p.cli.ContainerPause(ctx, id)
 }
@@ -154,22 +288,33 @@ func (p *engineProvider) unpauseContainer(ctx context.Context, id string) error
 
 // exec executes the given command in the container and attaches to it.
 // Keep in mind that you have to close the returned response.
-func (p *engineProvider) exec(ctx context.Context, containerID string, cmd []string) (types.HijackedResponse, error) {
+// exec starts the command in the container. It returns the attached streams and the exec id,
+// which is used to get the exit code after the streams are drained.
+func (p *engineProvider) exec(ctx context.Context, containerID string, cmd []string) (types.HijackedResponse, string, error) {
 	exec, err := p.cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
 		AttachStderr: true,
 		AttachStdout: true,
 		Cmd:          cmd,
 	})
 	if err != nil {
-		return types.HijackedResponse{}, errors.Wrap(err, "exec create failed")
+		return types.HijackedResponse{}, "", errors.Wrap(err, "exec create failed")
 	}
 
 	resp, err := p.cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
 	if err != nil {
-		return types.HijackedResponse{}, errors.Wrap(err, "exec attach failed")
+		return types.HijackedResponse{}, "", errors.Wrap(err, "exec attach failed")
 	}
 
-	return resp, nil
+	return resp, exec.ID, nil
+}
+
+func (p *engineProvider) execExitCode(ctx context.Context, execID string) (int, error) {
+	inspect, err := p.cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return 0, errors.Wrap(err, "exec inspect failed")
+	}
+
+	return inspect.ExitCode, nil
 }
 
 func (p *engineProvider) getContainers(ctx context.Context) ([]types.Container, error) {
@@ -181,13 +326,141 @@ func (p *engineProvider) getContainers(ctx context.Context) ([]types.Container,
 	})
 }
 
+// diskUsage returns the total size of images, containers, volumes and build cache.
+func (p *engineProvider) diskUsage(ctx context.Context) (uint64, error) {
+	du, err := p.cli.DiskUsage(ctx, types.DiskUsageOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	usage := du.LayersSize
+	for _, c := range du.Containers {
+		usage += c.SizeRw
+	}
+	for _, v := range du.Volumes {
+		if v.UsageData != nil && v.UsageData.Size > 0 {
+			usage += v.UsageData.Size
+		}
+	}
+	for _, b := range du.BuildCache {
+		usage += b.Size
+	}
+
+	return uint64(usage), nil
+}
+
+// pruneVolumes removes volumes of playground containers that are not used by any container anymore.
+// Volumes are left behind if containers are removed without their volumes, e.g. by hand or a crashed daemon.
+func (p *engineProvider) pruneVolumes(ctx context.Context) (types.VolumesPruneReport, error) {
+	return p.cli.VolumesPrune(ctx, filters.NewArgs(filters.Arg(p.ownershipLabelFilter())))
+}
+
+// pruneBuildCache removes dangling build cache. It's not labeled, so it's pruned regardless of its origin.
+func (p *engineProvider) pruneBuildCache(ctx context.Context) (*types.BuildCachePruneReport, error) {
+	return p.cli.BuildCachePrune(ctx, types.BuildCachePruneOptions{})
+}
+
+// killContainer sends SIGKILL to the main process of the container, so its execs are terminated as well.
+func (p *engineProvider) killContainer(ctx context.Context, id string) error {
+	return p.cli.ContainerKill(ctx, id, "SIGKILL")
+}
+
+// removeContainer force removes the container. If it's a database container attached to a restricted egress network,
+// the proxy and the network are removed as well, so they never outlive the database container.
 func (p *engineProvider) removeContainer(ctx context.Context, id string) error {
-	return p.cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+	// If the container cannot be inspected, the removal reports the error.
+	network, _ := p.egressNetwork(ctx, id)
+
+	err := p.cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
 		RemoveVolumes: true,
 		Force:         true,
 	})
+	if err != nil {
+		return err
+	}
+
+	if network != "" {
+		err = p.removeEgress(ctx, network)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove egress network")
+		}
+	}
+
+	return nil
 }
 
-func (p *engineProvider) pruneContainers(ctx context.Context) (types.ContainersPruneReport, error) {
-	return p.cli.ContainersPrune(ctx, filters.NewArgs(filters.Arg(p.ownershipLabelFilter())))
+// ensureImage pulls the image if it does not exist.
+func (p *engineProvider) ensureImage(ctx context.Context, image string) error {
+	_, _, err := p.cli.ImageInspectWithRaw(ctx, image)
+	if err == nil || !dockercli.IsErrNotFound(err) {
+		return err
+	}
+
+	out, err := p.cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: p.registryAuth(image)})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// The image is pulled once the output is read.
+	_, err = io.Copy(io.Discard, out)
+
+	return err
+}
+
+// createNetwork creates an internal network: its containers can reach each other, but not the outside world.
+func (p *engineProvider) createNetwork(ctx context.Context, name string, labels map[string]string) (string, error) {
+	resp, err := p.cli.NetworkCreate(ctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Internal:       true,
+		Labels:         labels,
+	})
+
+	return resp.ID, err
+}
+
+// connectNetwork attaches the container to the network, other containers of the network reach it by the alias.
+func (p *engineProvider) connectNetwork(ctx context.Context, networkID, containerID string, alias string) error {
+	return p.cli.NetworkConnect(ctx, networkID, containerID, &network.EndpointSettings{
+		Aliases: []string{alias},
+	})
+}
+
+// getEgressNetworks returns restricted egress networks created by the playground.
+func (p *engineProvider) getEgressNetworks(ctx context.Context) ([]types.NetworkResource, error) {
+	return p.cli.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg(p.ownershipLabelFilter()), filters.Arg("label", labelEgressNetwork)),
+	})
+}
+
+// egressNetwork returns the restricted egress network of the database container.
+// It's empty if the container is not attached to such a network or if it's the proxy.
+func (p *engineProvider) egressNetwork(ctx context.Context, containerID string) (string, error) {
+	inspect, err := p.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	if inspect.Config == nil || inspect.Config.Labels[labelEgressProxy] != "" {
+		return "", nil
+	}
+
+	return inspect.Config.Labels[labelEgressNetwork], nil
+}
+
+// removeEgress removes the proxy and the restricted egress network. Missing ones are skipped.
+func (p *engineProvider) removeEgress(ctx context.Context, network string) error {
+	err := p.cli.ContainerRemove(ctx, egressProxyName(network), types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+	if err != nil && !dockercli.IsErrNotFound(err) {
+		return errors.Wrap(err, "failed to remove proxy")
+	}
+
+	err = p.cli.NetworkRemove(ctx, network)
+	if err != nil && !dockercli.IsErrNotFound(err) {
+		return errors.Wrap(err, "failed to remove network")
+	}
+
+	return nil
 }
@@ -0,0 +1,84 @@
+package dockerengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDockerEngineOpts(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tlsCfg := &DaemonTLSConfig{CACertPath: "ca.pem", CertPath: "cert.pem", KeyPath: "key.pem"}
+
+	tests := []struct {
+		name         string
+		daemonURL    *string
+		tls          *DaemonTLSConfig
+		expectedHost string
+		errPart      string
+	}{
+		{name: "default", expectedHost: dockercli.DefaultDockerHost},
+		{name: "unix", daemonURL: str("unix:///run/podman/podman.sock"), expectedHost: "unix:///run/podman/podman.sock"},
+		{name: "socket path", daemonURL: str("/run/user/1000/podman/podman.sock"), expectedHost: "unix:///run/user/1000/podman/podman.sock"},
+		{name: "tcp", daemonURL: str("tcp://10.0.0.1:2375"), expectedHost: "tcp://10.0.0.1:2375"},
+		{name: "tls on unix", daemonURL: str("unix:///var/run/docker.sock"), tls: tlsCfg, errPart: "tls is supported by tcp"},
+		{name: "unknown scheme", daemonURL: str("http://10.0.0.1:2375"), errPart: "unsupported daemon url"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := getDockerEngineOpts(tt.daemonURL, tt.tls)
+			if tt.errPart != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errPart)
+				return
+			}
+			require.NoError(t, err)
+
+			cli, err := dockercli.NewClientWithOpts(opts...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedHost, cli.DaemonHost())
+		})
+	}
+}
+
+func TestCheckAPIVersion(t *testing.T) {
+	tests := []struct {
+		apiVersion string
+		expectErr  bool
+	}{
+		{apiVersion: "1.41"},
+		{apiVersion: MinAPIVersion},
+		{apiVersion: "1.39", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.apiVersion, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("API-Version", tt.apiVersion)
+				_, _ = w.Write([]byte("OK"))
+			}))
+			defer srv.Close()
+
+			daemonURL := "tcp://" + strings.TrimPrefix(srv.URL, "http://")
+			engine, err := newProvider(context.Background(), &daemonURL, nil)
+			require.NoError(t, err)
+
+			err = engine.checkAPIVersion(context.Background())
+			if tt.expectErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "Podman")
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
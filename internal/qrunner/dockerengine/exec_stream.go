@@ -0,0 +1,42 @@
+package dockerengine
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// stdHeaderLen is the length of the frame header of multiplexed streams.
+const stdHeaderLen = 8
+
+// copyExecOutput copies the output of an exec to stdout and stderr. Docker multiplexes the streams of execs
+// without a TTY, but the compatible socket of Podman may send the raw output, so the framing is detected
+// by the first header rather than assumed. The raw output is copied to stdout.
+func copyExecOutput(stdout, stderr io.Writer, src *bufio.Reader) error {
+	header, err := src.Peek(stdHeaderLen)
+	if len(header) == 0 {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		return err
+	}
+
+	if isMultiplexedHeader(header) {
+		_, err = stdcopy.StdCopy(stdout, stderr, src)
+		return err
+	}
+
+	_, err = io.Copy(stdout, src)
+
+	return err
+}
+
+// isMultiplexedHeader reports whether the bytes are a frame header: the stream type, three zero bytes and the size.
+// Output of the client never starts like that.
+func isMultiplexedHeader(header []byte) bool {
+	return len(header) == stdHeaderLen && header[0] <= byte(stdcopy.Systemerr) &&
+		header[1] == 0 && header[2] == 0 && header[3] == 0
+}
@@ -0,0 +1,42 @@
+package dockerengine
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyExecOutput(t *testing.T) {
+	var multiplexed bytes.Buffer
+	_, err := stdcopy.NewStdWriter(&multiplexed, stdcopy.Stdout).Write([]byte("1\n"))
+	require.NoError(t, err)
+	_, err = stdcopy.NewStdWriter(&multiplexed, stdcopy.Stderr).Write([]byte("warning\n"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		input          []byte
+		expectedStdout string
+		expectedStderr string
+	}{
+		{name: "multiplexed", input: multiplexed.Bytes(), expectedStdout: "1\n", expectedStderr: "warning\n"},
+		{name: "raw", input: []byte("1\t2\n3\t4\n"), expectedStdout: "1\t2\n3\t4\n"},
+		{name: "raw shorter than header", input: []byte("1\n"), expectedStdout: "1\n"},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := copyExecOutput(&stdout, &stderr, bufio.NewReader(bytes.NewReader(tt.input)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStdout, stdout.String())
+			assert.Equal(t, tt.expectedStderr, stderr.String())
+		})
+	}
+}
@@ -3,9 +3,12 @@ package dockerengine
 import (
 	"context"
 	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
 
 	"github.com/docker/docker/api/types"
 	"github.com/pkg/errors"
@@ -14,27 +17,82 @@ import (
 
 const PausedContainersMaxTTL = 24 * time.Hour
 
+// EgressSetupGrace protects restricted egress networks that are being set up: the database container
+// is created after the network and the proxy.
+const EgressSetupGrace = 5 * time.Minute
+
+// gcReportsKept is the number of recent pass reports kept in memory.
+const gcReportsKept = 5
+
 type garbageCollector struct {
 	ctx context.Context
 
 	logger zerolog.Logger
+	runner string
 
 	cfg *GCConfig
 
-	engine *engineProvider
-	metr   *metrics.RunnerGCExporter
+	engine     *engineProvider
+	held       *heldContainers
+	active     *activeContainers
+	imageUsage *imageUsage
+	metr       *metrics.RunnerGCExporter
+
+	reports gcReports
+
+	// kick requests a pass before the next tick, e.g. when the disk is full.
+	kick chan struct{}
 }
 
-func newGarbageCollector(ctx context.Context, logger zerolog.Logger, cfg *GCConfig, engine *engineProvider, metr *metrics.RunnerGCExporter) *garbageCollector {
+func newGarbageCollector(
+	ctx context.Context,
+	logger zerolog.Logger,
+	runner string,
+	cfg *GCConfig,
+	engine *engineProvider,
+	held *heldContainers,
+	active *activeContainers,
+	imageUsage *imageUsage,
+	metr *metrics.RunnerGCExporter,
+) *garbageCollector {
 	return &garbageCollector{
-		ctx:    ctx,
-		logger: logger,
-		cfg:    cfg,
-		engine: engine,
-		metr:   metr,
+		ctx:        ctx,
+		logger:     logger,
+		runner:     runner,
+		cfg:        cfg,
+		engine:     engine,
+		held:       held,
+		active:     active,
+		imageUsage: imageUsage,
+		metr:       metr,
+		kick:       make(chan struct{}, 1),
+	}
+}
+
+// gcReports keeps reports of recent passes, so it can be told why items have been kept.
+type gcReports struct {
+	mu      sync.Mutex
+	reports []qrunner.GCReport
+}
+
+func (r *gcReports) add(report qrunner.GCReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reports = append([]qrunner.GCReport{report}, r.reports...)
+	if len(r.reports) > gcReportsKept {
+		r.reports = r.reports[:gcReportsKept]
 	}
 }
 
+// list returns the reports, the latest one goes first.
+func (r *gcReports) list() []qrunner.GCReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]qrunner.GCReport(nil), r.reports...)
+}
+
 func (g *garbageCollector) isStopped() bool {
 	select {
 	case <-g.ctx.Done():
@@ -71,29 +129,126 @@ func (g *garbageCollector) start() {
 			return
 
 		case <-t.C:
+		case <-g.kick:
 		}
 
 		trigger()
 	}
 }
 
+func (g *garbageCollector) enabled() bool {
+	return g.cfg != nil
+}
+
+// requestPass asks for a pass right away. Requests made while a pass is pending are merged.
+func (g *garbageCollector) requestPass() {
+	select {
+	case g.kick <- struct{}{}:
+	default:
+	}
+}
+
 func (g *garbageCollector) trigger() (err error) {
 	if g.isStopped() {
 		return nil
 	}
 
-	_, _, err = g.collectContainers()
-	if err != nil {
-		return errors.Wrap(err, "containers gc failed")
+	report := &qrunner.GCReport{
+		Runner:    g.runner,
+		StartedAt: time.Now(),
+		Inputs: qrunner.GCInputs{
+			ContainerTTL:        g.cfg.ContainerTTL,
+			PausedContainerTTL:  PausedContainersMaxTTL,
+			ImageCountThreshold: g.cfg.ImageGCCountThreshold,
+			ImageBufferSize:     g.cfg.ImageBufferSize,
+			ImageSizeBudget:     g.cfg.ImageSizeBudget,
+		},
+	}
+	if dp := g.cfg.DiskPressure; dp != nil {
+		report.Inputs.DiskHighWatermark = dp.HighWatermark
+		report.Inputs.DiskLowWatermark = dp.LowWatermark
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+		if err != nil {
+			report.Error = err.Error()
+		}
+
+		g.reports.add(*report)
+	}()
+
+	if !g.cfg.DisableContainers {
+		_, _, err = g.collectContainers(report)
+		if err != nil {
+			return errors.Wrap(err, "containers gc failed")
+		}
 	}
 
 	if g.isStopped() {
 		return nil
 	}
 
-	_, _, err = g.collectImages()
-	if err != nil {
-		return errors.Wrap(err, "images gc failed")
+	if !g.cfg.DisableEgressNetworks {
+		err = g.collectEgressNetworks()
+		if err != nil {
+			return errors.Wrap(err, "egress networks gc failed")
+		}
+	}
+
+	// Volumes are collected after containers, so volumes of just removed containers are pruned in the same pass.
+	if g.isStopped() {
+		return nil
+	}
+
+	if !g.cfg.DisableVolumes {
+		_, _, err = g.collectVolumes(report)
+		if err != nil {
+			return errors.Wrap(err, "volumes gc failed")
+		}
+	}
+
+	if g.isStopped() {
+		return nil
+	}
+
+	if g.cfg.ImageGCCountThreshold != nil {
+		_, _, err = g.collectImages(report)
+		if err != nil {
+			return errors.Wrap(err, "images gc failed")
+		}
+	}
+
+	if g.isStopped() {
+		return nil
+	}
+
+	if g.cfg.ImageSizeBudget != nil {
+		_, _, err = g.collectImagesBySize(report)
+		if err != nil {
+			return errors.Wrap(err, "images size-based gc failed")
+		}
+	}
+
+	if g.isStopped() {
+		return nil
+	}
+
+	if g.cfg.DiskPressure != nil {
+		_, _, err = g.collectImagesByDiskPressure(report)
+		if err != nil {
+			return errors.Wrap(err, "images disk pressure gc failed")
+		}
+	}
+
+	if g.isStopped() {
+		return nil
+	}
+
+	if g.cfg.PruneBuildCache {
+		_, err = g.collectBuildCache(report)
+		if err != nil {
+			return errors.Wrap(err, "build cache gc failed")
+		}
 	}
 
 	g.logger.Debug().Msg("gc finished")
@@ -101,71 +256,214 @@ func (g *garbageCollector) trigger() (err error) {
 	return nil
 }
 
-// collectContainers prunes exited containers and force removes hanged up containers.
+// collectContainers removes stopped containers and force removes hanged up containers.
 // A container is hanged up if it has been alive at least for GCConfig.ContainerTTL.
-func (g *garbageCollector) collectContainers() (count uint, spaceReclaimed uint64, err error) {
+// Containers held for inspection are removed only when their hold expires.
+func (g *garbageCollector) collectContainers(report *qrunner.GCReport) (count uint, spaceReclaimed uint64, err error) {
 	startedAt := time.Now()
 	defer func() {
 		g.metr.ContainersCollected(count, spaceReclaimed, startedAt)
 	}()
 
-	out, err := g.engine.pruneContainers(g.ctx)
+	containers, err := g.engine.getContainers(g.ctx)
 	if err != nil {
-		return 0, 0, errors.Wrap(err, "failed to prune stopped containers")
+		return 0, 0, errors.Wrap(err, "failed to list containers")
 	}
 
-	count += uint(len(out.ContainersDeleted))
-	spaceReclaimed += out.SpaceReclaimed
+	var pausedContainers uint
+	for _, c := range containers {
+		now := time.Now()
+		activeSince, _ := g.active.since(c.ID)
+		remove, reason := containerVerdict(c, now, g.cfg.ContainerTTL, activeSince)
+
+		decision := qrunner.GCDecision{
+			ID:        c.ID,
+			Names:     c.Names,
+			Removed:   remove,
+			Reason:    reason,
+			SizeBytes: uint64(c.SizeRw),
+			Age:       now.Sub(time.Unix(c.Created, 0)),
+		}
+
+		switch reason {
+		case qrunner.GCReasonHeld:
+			until, _ := heldUntil(c)
+			g.held.add(c.ID, until)
+
+		case qrunner.GCReasonHoldExpired:
+			g.held.remove(c.ID)
+
+		case qrunner.GCReasonPaused, qrunner.GCReasonTTLExpired:
+			if c.State == "paused" {
+				pausedContainers++
+			}
+		}
+
+		if remove {
+			err = g.engine.removeContainer(g.ctx, c.ID)
+			if err != nil {
+				g.logger.Error().Err(err).Str("container_id", c.ID).Msg("containers gc failed to remove container")
+
+				decision.Removed = false
+				decision.Error = err.Error()
+			} else {
+				g.logger.Debug().Str("container_id", c.ID).Msg("container has been force removed")
+
+				count++
+				spaceReclaimed += uint64(c.SizeRw)
+			}
+		}
+
+		report.Containers = append(report.Containers, decision)
+	}
+
+	g.metr.ReportPausedContainers(pausedContainers)
+
+	return count, spaceReclaimed, nil
+}
 
-	if g.cfg.ContainerTTL == nil {
-		return count, spaceReclaimed, nil
+// containerVerdict decides whether the container must be removed and tells why. If the container serves
+// an in-flight run, activeSince is when the run has taken it: such containers outlive the TTL, since a long query
+// may take longer than the TTL, but not twice the TTL.
+func containerVerdict(c types.Container, now time.Time, ttl *time.Duration, activeSince time.Time) (remove bool, reason string) {
+	until, held := heldUntil(c)
+
+	switch {
+	case held && now.Before(until):
+		return false, qrunner.GCReasonHeld
+
+	case held:
+		return true, qrunner.GCReasonHoldExpired
+
+	case isStoppedContainer(c):
+		return true, qrunner.GCReasonStopped
+
+	case isSessionActive(c, now):
+		return false, qrunner.GCReasonSession
+
+	case ttl == nil:
+		return false, qrunner.GCReasonNoTTL
+	}
+
+	createdAt := time.Unix(c.Created, 0)
+	if now.Before(createdAt.Add(*ttl)) {
+		return false, qrunner.GCReasonWithinTTL
+	}
+
+	// Prewarmed containers may be older than the run, so the kill switch counts from the start of the run.
+	if !activeSince.IsZero() && now.Before(activeSince.Add(2**ttl)) {
+		return false, qrunner.GCReasonInFlight
+	}
+
+	if c.State == "paused" && now.Sub(createdAt) < PausedContainersMaxTTL {
+		return false, qrunner.GCReasonPaused
+	}
+
+	return true, qrunner.GCReasonTTLExpired
+}
+
+// isStoppedContainer reports whether the container is not running, as docker container prune decides it.
+func isStoppedContainer(c types.Container) bool {
+	return c.State == "created" || c.State == "exited" || c.State == "dead"
+}
+
+// collectEgressNetworks removes restricted egress networks and their proxies left without a database container,
+// e.g. if the runner has been stopped in the middle of the removal.
+func (g *garbageCollector) collectEgressNetworks() error {
+	networks, err := g.engine.getEgressNetworks(g.ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list networks")
+	}
+	if len(networks) == 0 {
+		return nil
 	}
 
-	// Find hanged up containers and force remove them.
 	containers, err := g.engine.getContainers(g.ctx)
 	if err != nil {
-		return count, spaceReclaimed, errors.Wrap(err, "failed to list containers")
+		return errors.Wrap(err, "failed to list containers")
 	}
 
-	var pausedContainers uint
+	inUse := make(map[string]struct{}, len(containers))
 	for _, c := range containers {
-		createdAt := time.Unix(c.Created, 0)
-		deadline := createdAt.Add(*g.cfg.ContainerTTL)
-		if time.Now().Before(deadline) {
-			continue
+		if network := c.Labels[labelEgressNetwork]; network != "" && c.Labels[labelEgressProxy] == "" {
+			inUse[network] = struct{}{}
 		}
+	}
 
-		if c.State == "paused" {
-			pausedContainers++
-			if time.Since(createdAt) < PausedContainersMaxTTL {
-				continue
-			}
+	for _, n := range networks {
+		if _, used := inUse[n.Name]; used || time.Since(n.Created) < EgressSetupGrace {
+			continue
 		}
 
-		err = g.engine.removeContainer(g.ctx, c.ID)
+		err = g.engine.removeEgress(g.ctx, n.Name)
 		if err != nil {
-			g.logger.Error().Err(err).Str("container_id", c.ID).Msg("containers gc failed to remove container")
+			g.logger.Error().Err(err).Str("network", n.Name).Msg("egress gc failed to remove network")
 			continue
 		}
 
-		g.logger.Debug().Str("container_id", c.ID).Msg("container has been force removed")
+		g.logger.Debug().Str("network", n.Name).Msg("egress network has been removed")
+	}
 
-		count++
-		spaceReclaimed += uint64(c.SizeRw)
+	return nil
+}
+
+// collectVolumes prunes volumes of playground containers that are not used anymore. Containers are removed
+// with their volumes, but volumes outlive containers removed otherwise, e.g. if the daemon has crashed.
+func (g *garbageCollector) collectVolumes(report *qrunner.GCReport) (count uint, spaceReclaimed uint64, err error) {
+	startedAt := time.Now()
+	defer func() {
+		g.metr.VolumesCollected(count, spaceReclaimed, startedAt)
+	}()
+
+	pruned, err := g.engine.pruneVolumes(g.ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to prune volumes")
 	}
 
-	g.metr.ReportPausedContainers(pausedContainers)
+	for _, name := range pruned.VolumesDeleted {
+		report.Volumes = append(report.Volumes, qrunner.GCDecision{
+			ID:      name,
+			Removed: true,
+			Reason:  qrunner.GCReasonDangling,
+		})
+	}
+	report.VolumesReclaimed = pruned.SpaceReclaimed
 
-	return count, spaceReclaimed, nil
+	if len(pruned.VolumesDeleted) > 0 {
+		g.logger.Debug().Int("count", len(pruned.VolumesDeleted)).Uint64("space_reclaimed", pruned.SpaceReclaimed).
+			Msg("dangling volumes have been removed")
+	}
+
+	return uint(len(pruned.VolumesDeleted)), pruned.SpaceReclaimed, nil
 }
 
-// collectImages frees the disk by removing most recently tagged images.
+// collectBuildCache prunes dangling build cache.
+func (g *garbageCollector) collectBuildCache(report *qrunner.GCReport) (spaceReclaimed uint64, err error) {
+	startedAt := time.Now()
+	var count uint
+	defer func() {
+		g.metr.BuildCacheCollected(count, spaceReclaimed, startedAt)
+	}()
+
+	pruned, err := g.engine.pruneBuildCache(g.ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune build cache")
+	}
+
+	count = uint(len(pruned.CachesDeleted))
+	report.BuildCacheReclaimed = pruned.SpaceReclaimed
+
+	return pruned.SpaceReclaimed, nil
+}
+
+// collectImages frees the disk by removing least recently used images.
 // If there are at least GCConfig.ImageGCCountThreshold downloaded chp images, it leaves GCConfig.ImageBufferSize
-// least recently tagged images and removes the others.
-func (g *garbageCollector) collectImages() (count uint, spaceReclaimed uint64, err error) {
+// most recently used images and removes the others. Images of existing containers are never removed,
+// they take places in the buffer.
+func (g *garbageCollector) collectImages(report *qrunner.GCReport) (count uint, spaceReclaimed uint64, err error) {
 	startedAt := time.Now()
 	defer func() {
-		g.metr.ContainersCollected(count, spaceReclaimed, startedAt)
+		g.metr.ImagesCollected(count, spaceReclaimed, startedAt)
 	}()
 
 	images, err := g.engine.getImages(g.ctx, true)
@@ -173,56 +471,381 @@ func (g *garbageCollector) collectImages() (count uint, spaceReclaimed uint64, e
 		return 0, 0, errors.Wrap(err, "failed to list images")
 	}
 
+	measureImages(report, images)
+
 	if len(images) < int(*g.cfg.ImageGCCountThreshold) {
+		for _, img := range images {
+			report.ImagesByCount = append(report.ImagesByCount, imageSummaryDecision(img, qrunner.GCReasonUnderCount))
+		}
+
 		return 0, 0, nil
 	}
 
+	containers, err := g.engine.getContainers(g.ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	inUse := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		inUse[c.ImageID] = struct{}{}
+	}
+
+	buffer := int(g.cfg.ImageBufferSize)
 	detailed := make([]types.ImageInspect, 0, len(images))
-	for _, c := range images {
-		inspect, err := g.engine.getImageByID(g.ctx, c.ID)
+	for _, img := range images {
+		if _, used := inUse[img.ID]; used {
+			report.ImagesByCount = append(report.ImagesByCount, imageSummaryDecision(img, qrunner.GCReasonInUse))
+			buffer--
+			continue
+		}
+
+		inspect, err := g.engine.getImageByID(g.ctx, img.ID)
 		if err != nil {
-			g.logger.Err(err).Str("image_id", c.ID).Msg("docker image inspect failed")
+			g.logger.Err(err).Str("image_id", img.ID).Msg("docker image inspect failed")
 			continue
 		}
 
 		detailed = append(detailed, inspect)
 	}
+	if buffer < 0 {
+		buffer = 0
+	}
 
-	// Drop N least recently tagged images.
-	sort.Slice(detailed, func(i, j int) bool {
-		return detailed[i].Metadata.LastTagTime.Before(detailed[j].Metadata.LastTagTime)
+	// Keep N most recently used images.
+	sort.SliceStable(detailed, func(i, j int) bool {
+		return g.imageLastUsed(detailed[i]).After(g.imageLastUsed(detailed[j]))
 	})
 
-	if len(detailed) > int(g.cfg.ImageBufferSize) {
-		count, spaceReclaimed = g.removeImages(detailed[int(g.cfg.ImageBufferSize):])
+	kept := detailed
+	if len(detailed) > buffer {
+		kept = detailed[:buffer]
+
+		var decisions []qrunner.GCDecision
+		decisions, count, spaceReclaimed = g.removeImages(detailed[buffer:], qrunner.GCReasonOverBuffer)
+		report.ImagesByCount = append(report.ImagesByCount, decisions...)
+	}
+
+	for _, img := range kept {
+		report.ImagesByCount = append(report.ImagesByCount, imageDecision(img, qrunner.GCReasonInBuffer))
+	}
+
+	return count, spaceReclaimed, nil
+}
+
+// collectImagesBySize removes least recently tagged chp images until their total size is under GCConfig.ImageSizeBudget.
+// Images used by existing containers (running, paused or prewarmed) are not evictable.
+func (g *garbageCollector) collectImagesBySize(report *qrunner.GCReport) (count uint, spaceReclaimed uint64, err error) {
+	startedAt := time.Now()
+	defer func() {
+		g.metr.ImagesCollected(count, spaceReclaimed, startedAt)
+	}()
+
+	images, err := g.engine.getImages(g.ctx, true)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list images")
+	}
+
+	containers, err := g.engine.getContainers(g.ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	measureImages(report, images)
+
+	inUse := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		inUse[c.ImageID] = struct{}{}
+	}
+
+	var usage uint64
+	candidates := make([]types.ImageInspect, 0, len(images))
+	for _, img := range images {
+		usage += uint64(img.Size)
+
+		if _, used := inUse[img.ID]; used {
+			report.ImagesBySize = append(report.ImagesBySize, imageSummaryDecision(img, qrunner.GCReasonInUse))
+			continue
+		}
+
+		inspect, err := g.engine.getImageByID(g.ctx, img.ID)
+		if err != nil {
+			g.logger.Err(err).Str("image_id", img.ID).Msg("docker image inspect failed")
+			continue
+		}
+
+		candidates = append(candidates, inspect)
+	}
+
+	budget := *g.cfg.ImageSizeBudget
+	evicted := selectImagesOverBudget(candidates, usage, budget)
+	if len(evicted) > 0 {
+		var decisions []qrunner.GCDecision
+		decisions, count, spaceReclaimed = g.removeImages(evicted, qrunner.GCReasonOverBudget)
+		report.ImagesBySize = append(report.ImagesBySize, decisions...)
+	}
+
+	evictedIDs := make(map[string]struct{}, len(evicted))
+	for _, img := range evicted {
+		evictedIDs[img.ID] = struct{}{}
+	}
+	for _, img := range candidates {
+		if _, removed := evictedIDs[img.ID]; !removed {
+			report.ImagesBySize = append(report.ImagesBySize, imageDecision(img, qrunner.GCReasonUnderBudget))
+		}
+	}
+
+	g.metr.ReportImageBudget(budget, usage-spaceReclaimed)
+
+	return count, spaceReclaimed, nil
+}
+
+// collectImagesByDiskPressure removes least recently used chp images once the disk usage exceeds
+// the high watermark, until the usage is under the low watermark. Images used by existing containers
+// are not evictable.
+func (g *garbageCollector) collectImagesByDiskPressure(report *qrunner.GCReport) (count uint, spaceReclaimed uint64, err error) {
+	startedAt := time.Now()
+	defer func() {
+		g.metr.ImagesCollected(count, spaceReclaimed, startedAt)
+	}()
+
+	cfg := g.cfg.DiskPressure
+	used, capacity, err := g.measureDisk(cfg)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to measure disk usage")
+	}
+
+	report.Inputs.DiskUsage = used
+	report.Inputs.DiskCapacity = capacity
+	g.metr.ReportDiskUsage(used, capacity)
+
+	high := uint64(float64(capacity) * cfg.HighWatermark)
+	if used <= high {
+		g.metr.ReportDiskPressureEvictions(0)
+		return 0, 0, nil
+	}
+
+	images, err := g.engine.getImages(g.ctx, true)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list images")
+	}
+
+	containers, err := g.engine.getContainers(g.ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list containers")
+	}
+
+	measureImages(report, images)
+
+	inUse := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		inUse[c.ImageID] = struct{}{}
 	}
 
+	candidates := make([]types.ImageInspect, 0, len(images))
+	for _, img := range images {
+		if _, used := inUse[img.ID]; used {
+			report.ImagesByDiskPressure = append(report.ImagesByDiskPressure, imageSummaryDecision(img, qrunner.GCReasonInUse))
+			continue
+		}
+
+		inspect, err := g.engine.getImageByID(g.ctx, img.ID)
+		if err != nil {
+			g.logger.Err(err).Str("image_id", img.ID).Msg("docker image inspect failed")
+			continue
+		}
+
+		candidates = append(candidates, inspect)
+	}
+
+	low := uint64(float64(capacity) * cfg.LowWatermark)
+	evicted := selectLeastRecentlyUsed(candidates, used-low, g.imageLastUsed)
+	if len(evicted) > 0 {
+		var decisions []qrunner.GCDecision
+		decisions, count, spaceReclaimed = g.removeImages(evicted, qrunner.GCReasonDiskPressure)
+		report.ImagesByDiskPressure = append(report.ImagesByDiskPressure, decisions...)
+	}
+
+	evictedIDs := make(map[string]struct{}, len(evicted))
+	for _, img := range evicted {
+		evictedIDs[img.ID] = struct{}{}
+	}
+	for _, img := range candidates {
+		if _, removed := evictedIDs[img.ID]; !removed {
+			report.ImagesByDiskPressure = append(report.ImagesByDiskPressure, imageDecision(img, qrunner.GCReasonRecentlyUsed))
+		}
+	}
+
+	g.metr.ReportDiskPressureEvictions(count)
+	g.logger.Info().Uint64("disk_usage", used).Uint64("disk_capacity", capacity).Uint("evicted", count).
+		Uint64("space_reclaimed", spaceReclaimed).Msg("images have been evicted due to disk pressure")
+
 	return count, spaceReclaimed, nil
 }
 
-// removeImages deletes all tags of the provided images.
-func (g *garbageCollector) removeImages(images []types.ImageInspect) (count uint, spaceReclaimed uint64) {
+// measureDisk returns the disk usage and the capacity the watermarks are relative to.
+func (g *garbageCollector) measureDisk(cfg *DiskPressureConfig) (used, capacity uint64, err error) {
+	if cfg.DataRoot != "" {
+		return filesystemUsage(cfg.DataRoot)
+	}
+
+	used, err = g.engine.diskUsage(g.ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return used, cfg.Capacity, nil
+}
+
+// filesystemUsage returns the used and the total space of the filesystem the path belongs to.
+func filesystemUsage(path string) (used, capacity uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "statfs %s failed", path)
+	}
+
+	bsize := uint64(st.Bsize)
+
+	return (st.Blocks - st.Bfree) * bsize, st.Blocks * bsize, nil
+}
+
+// imageLastUsed returns the last time the image has been used for a run. Images that have not been used
+// since the runner has started fall back to the last tagging, which is their pull time.
+func (g *garbageCollector) imageLastUsed(img types.ImageInspect) time.Time {
+	if at, found := g.imageUsage.lastUsed(img.RepoTags); found {
+		return at
+	}
+
+	return img.Metadata.LastTagTime
+}
+
+// selectLeastRecentlyUsed returns least recently used images that must be removed to free the excess.
+// If it's impossible, all the candidates are returned.
+func selectLeastRecentlyUsed(candidates []types.ImageInspect, excess uint64, lastUsed func(types.ImageInspect) time.Time) []types.ImageInspect {
+	sorted := make([]types.ImageInspect, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return lastUsed(sorted[i]).Before(lastUsed(sorted[j]))
+	})
+
+	var freed uint64
+	for i, img := range sorted {
+		if freed >= excess {
+			return sorted[:i]
+		}
+
+		freed += uint64(img.Size)
+	}
+
+	return sorted
+}
+
+// measureImages records the number and the total size of images before the pass.
+func measureImages(report *qrunner.GCReport, images []types.ImageSummary) {
+	if report.Inputs.ImageCount != 0 {
+		return
+	}
+
+	report.Inputs.ImageCount = len(images)
+	for _, img := range images {
+		report.Inputs.ImageUsage += uint64(img.Size)
+	}
+}
+
+// imageDecision records a decision on an inspected image. The age is measured since the last tagging,
+// or since the creation if the image has never been tagged locally.
+func imageDecision(img types.ImageInspect, reason string) qrunner.GCDecision {
+	taggedAt := img.Metadata.LastTagTime
+	if taggedAt.IsZero() {
+		taggedAt, _ = time.Parse(time.RFC3339Nano, img.Created)
+	}
+
+	return qrunner.GCDecision{
+		ID:        img.ID,
+		Names:     img.RepoTags,
+		Reason:    reason,
+		SizeBytes: uint64(img.Size),
+		Age:       time.Since(taggedAt),
+	}
+}
+
+// imageSummaryDecision records a decision on an image that has not been inspected, so its age
+// is measured since the creation.
+func imageSummaryDecision(img types.ImageSummary, reason string) qrunner.GCDecision {
+	return qrunner.GCDecision{
+		ID:        img.ID,
+		Names:     img.RepoTags,
+		Reason:    reason,
+		SizeBytes: uint64(img.Size),
+		Age:       time.Since(time.Unix(img.Created, 0)),
+	}
+}
+
+// selectImagesOverBudget returns least recently tagged images that must be removed
+// to reduce the usage to the budget. If it's impossible, all the candidates are returned.
+func selectImagesOverBudget(candidates []types.ImageInspect, usage, budget uint64) []types.ImageInspect {
+	if usage <= budget {
+		return nil
+	}
+
+	sorted := make([]types.ImageInspect, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Metadata.LastTagTime.Before(sorted[j].Metadata.LastTagTime)
+	})
+
+	excess := usage - budget
+
+	var freed uint64
+	for i, img := range sorted {
+		if freed >= excess {
+			return sorted[:i]
+		}
+
+		freed += uint64(img.Size)
+	}
+
+	return sorted
+}
+
+// removeImages deletes all tags of the provided images and records the decisions.
+func (g *garbageCollector) removeImages(images []types.ImageInspect, reason string) (decisions []qrunner.GCDecision, count uint, spaceReclaimed uint64) {
 	for _, img := range images {
-		ok := true
+		decision := imageDecision(img, reason)
+
+		var failed error
 		for _, tag := range img.RepoTags {
 			_, err := g.engine.removeImage(g.ctx, tag, true)
 			if err != nil {
 				g.logger.Err(err).Str("image_id", img.ID).Msg("failed to delete image tag")
-				ok = false
+				failed = err
 
 				continue
 			}
 		}
 
-		if !ok {
+		if failed != nil {
+			decision.Error = failed.Error()
+			decisions = append(decisions, decision)
+
 			continue
 		}
 
 		g.logger.Debug().Str("id", img.ID).Strs("tags", img.RepoTags).Msg("image has been removed")
+		g.imageUsage.forget(img.RepoTags)
+
+		decision.Removed = true
+		decisions = append(decisions, decision)
 
 		count++
 		spaceReclaimed += uint64(img.Size)
 	}
 
-	return count, spaceReclaimed
+	return decisions, count, spaceReclaimed
+}
+
+// GCReports returns reports of recent garbage collection passes, the latest one goes first.
+func (r *Runner) GCReports() []qrunner.GCReport {
+	return r.gc.reports.list()
 }
@@ -0,0 +1,382 @@
+package dockerengine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/api/types"
+	dockercli "github.com/docker/docker/client"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectImagesOverBudget(t *testing.T) {
+	now := time.Now()
+	image := func(id string, size int64, taggedAgo time.Duration) types.ImageInspect {
+		return types.ImageInspect{
+			ID:       id,
+			Size:     size,
+			Metadata: types.ImageMetadata{LastTagTime: now.Add(-taggedAgo)},
+		}
+	}
+
+	candidates := []types.ImageInspect{
+		image("new", 300, time.Minute),
+		image("old", 500, time.Hour),
+		image("middle", 400, 10*time.Minute),
+	}
+
+	ids := func(images []types.ImageInspect) []string {
+		var result []string
+		for _, img := range images {
+			result = append(result, img.ID)
+		}
+
+		return result
+	}
+
+	assert.Empty(t, selectImagesOverBudget(candidates, 1200, 1200))
+	assert.Equal(t, []string{"old"}, ids(selectImagesOverBudget(candidates, 1200, 1000)))
+	assert.Equal(t, []string{"old", "middle"}, ids(selectImagesOverBudget(candidates, 1200, 500)))
+
+	// Images of running containers are not candidates, so the budget may be unreachable.
+	assert.Equal(t, []string{"old", "middle", "new"}, ids(selectImagesOverBudget(candidates, 5000, 100)))
+}
+
+func TestSelectLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	image := func(tag string, size int64, taggedAgo time.Duration) types.ImageInspect {
+		return types.ImageInspect{
+			ID:       tag,
+			RepoTags: []string{tag},
+			Size:     size,
+			Metadata: types.ImageMetadata{LastTagTime: now.Add(-taggedAgo)},
+		}
+	}
+
+	// The old image has been re-pulled recently, but it has not been used since.
+	candidates := []types.ImageInspect{
+		image("popular", 300, 48*time.Hour),
+		image("repulled", 500, time.Minute),
+		image("unused", 400, time.Hour),
+	}
+
+	usage := newImageUsage()
+	usage.touch("popular", now.Add(-time.Second))
+	usage.touch("repulled", now.Add(-2*time.Hour))
+	gc := &garbageCollector{imageUsage: usage}
+
+	ids := func(images []types.ImageInspect) []string {
+		var result []string
+		for _, img := range images {
+			result = append(result, img.ID)
+		}
+
+		return result
+	}
+
+	assert.Empty(t, selectLeastRecentlyUsed(candidates, 0, gc.imageLastUsed))
+	assert.Equal(t, []string{"repulled"}, ids(selectLeastRecentlyUsed(candidates, 100, gc.imageLastUsed)))
+	assert.Equal(t, []string{"repulled", "unused"}, ids(selectLeastRecentlyUsed(candidates, 600, gc.imageLastUsed)))
+	assert.Equal(t, []string{"repulled", "unused", "popular"}, ids(selectLeastRecentlyUsed(candidates, 5000, gc.imageLastUsed)))
+
+	usage.forget([]string{"popular"})
+	assert.Equal(t, []string{"popular"}, ids(selectLeastRecentlyUsed(candidates, 100, gc.imageLastUsed)))
+}
+
+func TestContainerVerdict(t *testing.T) {
+	now := time.Now()
+	ttl := time.Hour
+
+	container := func(state string, age time.Duration, names ...string) types.Container {
+		return types.Container{
+			State:   state,
+			Created: now.Add(-age).Unix(),
+			Names:   names,
+		}
+	}
+
+	sessionContainer := func(state string, age time.Duration, expiresAt time.Time) types.Container {
+		c := container(state, age)
+		c.Labels = map[string]string{qrunner.LabelSessionExpiresAt: strconv.FormatInt(expiresAt.Unix(), 10)}
+
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		container types.Container
+		ttl       *time.Duration
+		remove    bool
+		reason    string
+
+		activeSince time.Time
+	}{
+		{"held", container("exited", time.Minute, "/"+heldContainerName("run", now.Add(time.Minute))), &ttl, false, qrunner.GCReasonHeld, time.Time{}},
+		{"hold expired", container("running", time.Minute, "/"+heldContainerName("run", now.Add(-time.Minute))), &ttl, true, qrunner.GCReasonHoldExpired, time.Time{}},
+		{"stopped", container("exited", time.Minute), nil, true, qrunner.GCReasonStopped, time.Time{}},
+		{"no ttl", container("running", 48*time.Hour), nil, false, qrunner.GCReasonNoTTL, time.Time{}},
+		{"within ttl", container("running", time.Minute), &ttl, false, qrunner.GCReasonWithinTTL, time.Time{}},
+		{"ttl expired", container("running", 2*time.Hour), &ttl, true, qrunner.GCReasonTTLExpired, time.Time{}},
+		{"paused", container("paused", 2*time.Hour), &ttl, false, qrunner.GCReasonPaused, time.Time{}},
+		{"paused too long", container("paused", 2*PausedContainersMaxTTL), &ttl, true, qrunner.GCReasonTTLExpired, time.Time{}},
+		{"session", sessionContainer("running", 2*time.Hour, now.Add(time.Minute)), &ttl, false, qrunner.GCReasonSession, time.Time{}},
+		{"session ended", sessionContainer("running", 2*time.Hour, now.Add(-time.Minute)), &ttl, true, qrunner.GCReasonTTLExpired, time.Time{}},
+		{"stopped session", sessionContainer("exited", time.Minute, now.Add(time.Minute)), &ttl, true, qrunner.GCReasonStopped, time.Time{}},
+		{"in flight", container("running", 90*time.Minute), &ttl, false, qrunner.GCReasonInFlight, now.Add(-90 * time.Minute)},
+		{"prewarmed in flight", container("running", 10*time.Hour), &ttl, false, qrunner.GCReasonInFlight, now.Add(-time.Minute)},
+		{"in flight too long", container("running", 3*time.Hour), &ttl, true, qrunner.GCReasonTTLExpired, now.Add(-150 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			remove, reason := containerVerdict(tt.container, now, tt.ttl, tt.activeSince)
+			assert.Equal(t, tt.remove, remove)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+func TestGCReports(t *testing.T) {
+	var reports gcReports
+	assert.Empty(t, reports.list())
+
+	for i := 0; i < gcReportsKept+2; i++ {
+		reports.add(qrunner.GCReport{Runner: fmt.Sprintf("pass-%d", i)})
+	}
+
+	list := reports.list()
+	require.Len(t, list, gcReportsKept)
+	assert.Equal(t, fmt.Sprintf("pass-%d", gcReportsKept+1), list[0].Runner)
+	assert.Equal(t, "pass-2", list[len(list)-1].Runner)
+}
+
+func TestGarbageCollector_Phases(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        GCConfig
+		calls      []string
+		volumes    int
+		buildCache uint64
+	}{
+		{
+			name:    "default",
+			cfg:     GCConfig{},
+			calls:   []string{"/containers/json", "/networks", "/volumes/prune"},
+			volumes: 2,
+		},
+		{
+			name:       "build cache only",
+			cfg:        GCConfig{DisableContainers: true, DisableEgressNetworks: true, DisableVolumes: true, PruneBuildCache: true},
+			calls:      []string{"/build/prune"},
+			buildCache: 2048,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu          sync.Mutex
+				calls       []string
+				pruneFilter string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:] // drops the api version.
+
+				mu.Lock()
+				calls = append(calls, path)
+				mu.Unlock()
+
+				switch path {
+				case "/containers/json", "/networks":
+					_, _ = w.Write([]byte(`[]`))
+				case "/volumes/prune":
+					pruneFilter = r.URL.Query().Get("filters")
+					_, _ = w.Write([]byte(`{"VolumesDeleted": ["vol-1", "vol-2"], "SpaceReclaimed": 1024}`))
+				case "/build/prune":
+					_, _ = w.Write([]byte(`{"CachesDeleted": ["cache-1"], "SpaceReclaimed": 2048}`))
+				default:
+					http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+				}
+			}))
+			defer srv.Close()
+
+			cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+			require.NoError(t, err)
+
+			cfg := tt.cfg
+			metr := metrics.NewRunnerGCExporter(string(qrunner.TypeDockerEngine), "TestGCPhases"+time.Now().Format(time.RFC3339Nano))
+			gc := newGarbageCollector(context.Background(), zerolog.Nop(), "test", &cfg,
+				&engineProvider{mainCtx: context.Background(), cli: cli}, nil, newActiveContainers(), newImageUsage(), metr)
+
+			require.NoError(t, gc.trigger())
+			assert.Equal(t, tt.calls, calls)
+
+			report := gc.reports.list()[0]
+			assert.Len(t, report.Volumes, tt.volumes)
+			assert.Equal(t, tt.buildCache, report.BuildCacheReclaimed)
+			if tt.volumes > 0 {
+				assert.Contains(t, pruneFilter, qrunner.LabelOwnership)
+				assert.Equal(t, uint64(1024), report.VolumesReclaimed)
+				assert.Equal(t, qrunner.GCReasonDangling, report.Volumes[0].Reason)
+			}
+		})
+	}
+}
+
+func TestCollectImages_KeepsMostRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	taggedAgo := map[string]time.Duration{
+		"img-1": 5 * time.Hour,
+		"img-2": 4 * time.Hour,
+		"img-3": 3 * time.Hour,
+		"img-4": 2 * time.Hour,
+		"img-5": time.Hour,
+	}
+	tag := func(id string) string {
+		return "chp-clickhouse/clickhouse-server:" + id
+	}
+
+	var (
+		mu      sync.Mutex
+		removed []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:] // drops the api version.
+
+		switch {
+		case path == "/images/json":
+			var list []string
+			for id := range taggedAgo {
+				list = append(list, fmt.Sprintf(`{"Id": %q, "RepoTags": [%q], "Size": 100}`, id, tag(id)))
+			}
+			_, _ = w.Write([]byte("[" + strings.Join(list, ",") + "]"))
+
+		case path == "/containers/json":
+			// The oldest image backs a running query.
+			_, _ = w.Write([]byte(`[{"Id": "container-1", "ImageID": "img-1", "State": "running"}]`))
+
+		case r.Method == http.MethodGet && strings.HasPrefix(path, "/images/"):
+			id := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+			_, _ = fmt.Fprintf(w, `{"Id": %q, "RepoTags": [%q], "Size": 100, "Metadata": {"LastTagTime": %q}}`,
+				id, tag(id), now.Add(-taggedAgo[id]).Format(time.RFC3339Nano))
+
+		case r.Method == http.MethodDelete && strings.HasPrefix(path, "/images/"):
+			name := strings.TrimPrefix(path, "/images/")
+			mu.Lock()
+			removed = append(removed, name[strings.LastIndex(name, ":")+1:])
+			mu.Unlock()
+			_, _ = w.Write([]byte(`[]`))
+
+		default:
+			http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+		}
+	}))
+	defer srv.Close()
+
+	cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+	require.NoError(t, err)
+
+	threshold := uint(1)
+	cfg := &GCConfig{ImageGCCountThreshold: &threshold, ImageBufferSize: 3}
+	metr := metrics.NewRunnerGCExporter(string(qrunner.TypeDockerEngine), "TestCollectImages"+time.Now().Format(time.RFC3339Nano))
+	gc := newGarbageCollector(context.Background(), zerolog.Nop(), "test", cfg,
+		&engineProvider{mainCtx: context.Background(), cli: cli}, nil, newActiveContainers(), newImageUsage(), metr)
+
+	report := &qrunner.GCReport{}
+	count, space, err := gc.collectImages(report)
+	require.NoError(t, err)
+
+	// The image in use takes a place in the buffer, so two most recently tagged images are kept.
+	assert.ElementsMatch(t, []string{"img-2", "img-3"}, removed)
+	assert.Equal(t, uint(2), count)
+	assert.Equal(t, uint64(200), space)
+
+	reasons := make(map[string]string)
+	for _, d := range report.ImagesByCount {
+		reasons[d.ID] = d.Reason
+	}
+	assert.Equal(t, map[string]string{
+		"img-1": qrunner.GCReasonInUse,
+		"img-2": qrunner.GCReasonOverBuffer,
+		"img-3": qrunner.GCReasonOverBuffer,
+		"img-4": qrunner.GCReasonInBuffer,
+		"img-5": qrunner.GCReasonInBuffer,
+	}, reasons)
+
+	// A recent run makes an old image the most recently used one.
+	removed = nil
+	gc.imageUsage.touch(tag("img-2"), now)
+	_, _, err = gc.collectImages(&qrunner.GCReport{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"img-3", "img-4"}, removed)
+}
+
+func TestCollectContainers_SlowQuerySurvives(t *testing.T) {
+	createdAt := time.Now().Add(-2 * time.Hour)
+
+	var (
+		mu      sync.Mutex
+		removed []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:] // drops the api version.
+
+		switch {
+		case path == "/containers/json":
+			_, _ = fmt.Fprintf(w, `[{"Id": "container-1", "State": "running", "Created": %d}]`, createdAt.Unix())
+
+		case r.Method == http.MethodGet && strings.HasSuffix(path, "/json"):
+			_, _ = w.Write([]byte(`{"Id": "container-1", "Config": {"Labels": {}}}`))
+
+		case r.Method == http.MethodDelete && strings.HasPrefix(path, "/containers/"):
+			mu.Lock()
+			removed = append(removed, strings.TrimPrefix(path, "/containers/"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+		}
+	}))
+	defer srv.Close()
+
+	cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+	require.NoError(t, err)
+
+	ttl := time.Hour
+	active := newActiveContainers()
+	metr := metrics.NewRunnerGCExporter(string(qrunner.TypeDockerEngine), "TestSlowQuery"+time.Now().Format(time.RFC3339Nano))
+	gc := newGarbageCollector(context.Background(), zerolog.Nop(), "test", &GCConfig{ContainerTTL: &ttl},
+		&engineProvider{mainCtx: context.Background(), cli: cli}, newHeldContainers(), active, newImageUsage(), metr)
+
+	// The query has been running for longer than the TTL.
+	active.add("run", "container-1")
+	report := &qrunner.GCReport{}
+	count, _, err := gc.collectContainers(report)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.Empty(t, removed)
+	require.Len(t, report.Containers, 1)
+	assert.Equal(t, qrunner.GCReasonInFlight, report.Containers[0].Reason)
+
+	// Once the run is finished, the container is collected by the TTL.
+	active.remove("run")
+	count, _, err = gc.collectContainers(&qrunner.GCReport{})
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), count)
+	assert.Equal(t, []string{"container-1"}, removed)
+}
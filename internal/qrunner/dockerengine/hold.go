@@ -0,0 +1,173 @@
+package dockerengine
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// DefaultHoldPeriod is how long a container of a failed run is kept for inspection.
+const DefaultHoldPeriod = 30 * time.Minute
+
+// Docker does not allow changing labels of existing containers, so held containers are renamed
+// to chp-held-<expiry unix time>-<run id>. The name survives restarts of the server and the daemon.
+const heldContainerPrefix = "chp-held-"
+
+func heldContainerName(runID string, until time.Time) string {
+	return fmt.Sprintf("%s%d-%s", heldContainerPrefix, until.Unix(), runID)
+}
+
+// parseHeldContainerName returns the expiry of the held container.
+// Docker reports names with the leading slash.
+func parseHeldContainerName(name string) (until time.Time, held bool) {
+	rest, found := strings.CutPrefix(strings.TrimPrefix(name, "/"), heldContainerPrefix)
+	if !found {
+		return time.Time{}, false
+	}
+
+	expiry, _, _ := strings.Cut(rest, "-")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(unix, 0), true
+}
+
+// heldUntil returns the expiry of the container if it's held.
+func heldUntil(c types.Container) (time.Time, bool) {
+	for _, name := range c.Names {
+		if until, held := parseHeldContainerName(name); held {
+			return until, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// heldContainers tracks held containers, so they can be counted against the concurrency limit
+// without listing containers. The garbage collector removes them and refreshes the registry.
+type heldContainers struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newHeldContainers() *heldContainers {
+	return &heldContainers{
+		until: make(map[string]time.Time),
+	}
+}
+
+func (h *heldContainers) add(containerID string, until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.until[containerID] = until
+}
+
+func (h *heldContainers) remove(containerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.until, containerID)
+}
+
+// count returns the number of containers that are still held at the moment.
+func (h *heldContainers) count(now time.Time) uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var count uint32
+	for id, until := range h.until {
+		if now.After(until) {
+			delete(h.until, id)
+			continue
+		}
+
+		count++
+	}
+
+	return count
+}
+
+// shouldHold reports whether the container of the failed run must be kept for inspection.
+// The run can override the deployment setting. Containers are never held for failures caused by users.
+func (r *Runner) shouldHold(run *queryrun.Run, err error) bool {
+	if !isInfrastructureFailure(err) {
+		return false
+	}
+
+	keep := r.cfg.KeepContainerOnFailure
+	if run.KeepContainerOnFailure != nil {
+		keep = *run.KeepContainerOnFailure
+	}
+
+	// Held containers are removed only by the garbage collector.
+	if keep && r.cfg.GC == nil {
+		r.logger.Warn().Str("run_id", run.ID).Msg("container cannot be held without gc")
+		return false
+	}
+
+	return keep
+}
+
+// holdContainer keeps the container instead of removing it. It's renamed to carry the expiry.
+func (r *Runner) holdContainer(ctx context.Context, state *requestState) error {
+	until := time.Now().Add(r.cfg.HoldPeriod)
+
+	err := r.engine.renameContainer(ctx, state.containerID, heldContainerName(state.runID, until))
+	if err != nil {
+		return errors.Wrap(err, "failed to rename container")
+	}
+
+	r.held.add(state.containerID, until)
+	r.logger.Info().Str("run_id", state.runID).Str("container_id", state.containerID).Time("held_until", until).
+		Msg("container of the failed run is held for inspection")
+
+	return nil
+}
+
+// HeldContainers returns the number of containers held for inspection.
+func (r *Runner) HeldContainers() uint32 {
+	return r.held.count(time.Now())
+}
+
+// Containers lists containers created by the runner, including warm, reserved and held ones.
+func (r *Runner) Containers(ctx context.Context) ([]qrunner.Container, error) {
+	containers, err := r.engine.getContainers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	result := make([]qrunner.Container, 0, len(containers))
+	for _, c := range containers {
+		if c.Labels[qrunner.LabelRunner] != r.name {
+			continue
+		}
+
+		container := qrunner.Container{
+			ID:        c.ID,
+			Runner:    r.name,
+			RunID:     c.Labels[qrunner.LabelRun],
+			Version:   c.Labels[qrunner.LabelVersion],
+			State:     c.State,
+			CreatedAt: time.Unix(c.Created, 0),
+		}
+		if until, held := heldUntil(c); held {
+			container.HeldUntil = &until
+		}
+
+		result = append(result, container)
+	}
+
+	return result, nil
+}
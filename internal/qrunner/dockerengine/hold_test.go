@@ -0,0 +1,58 @@
+package dockerengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeldContainerName(t *testing.T) {
+	until := time.Unix(1680350400, 0)
+
+	name := heldContainerName("1bcb005d-f466-4036-a5e3-81c723096913", until)
+	assert.Equal(t, "chp-held-1680350400-1bcb005d-f466-4036-a5e3-81c723096913", name)
+
+	parsed, held := heldUntil(types.Container{Names: []string{"/" + name}})
+	assert.True(t, held)
+	assert.True(t, until.Equal(parsed))
+
+	_, held = heldUntil(types.Container{Names: []string{"/elegant_turing"}})
+	assert.False(t, held)
+
+	_, held = parseHeldContainerName("chp-held-soon-1bcb005d")
+	assert.False(t, held)
+}
+
+func TestHeldContainersCount(t *testing.T) {
+	now := time.Now()
+
+	held := newHeldContainers()
+	held.add("c1", now.Add(time.Minute))
+	held.add("c2", now.Add(-time.Second))
+	held.add("c3", now.Add(time.Hour))
+	held.remove("c3")
+
+	assert.Equal(t, uint32(1), held.count(now))
+	assert.Equal(t, uint32(0), held.count(now.Add(2*time.Minute)))
+}
+
+func TestIsInfrastructureFailure(t *testing.T) {
+	assert.False(t, isInfrastructureFailure(nil))
+	assert.False(t, isInfrastructureFailure(errors.Wrap(context.Canceled, "failed to run query")))
+	assert.False(t, isInfrastructureFailure(errors.Wrap(qrunner.ErrInvalidToolRun, "unknown tool")))
+	assert.False(t, isInfrastructureFailure(&qrunner.MemoryLimitError{Limit: 1e9}))
+	assert.False(t, isInfrastructureFailure(&qrunner.QueryTimeoutError{Timeout: time.Second}))
+	assert.False(t, isInfrastructureFailure(errors.New("input archive cannot be built")))
+
+	assert.True(t, isInfrastructureFailure(errors.Wrap(context.DeadlineExceeded, "failed to run query")))
+	assert.True(t, isInfrastructureFailure(errors.Wrap(qrunner.ErrServerNotReady, "database server has exited with code 1")))
+	assert.True(t, isInfrastructureFailure(daemonFailure(errors.Wrap(qrunner.ErrRunnerDisconnected, "EOF"))))
+	assert.True(t, isInfrastructureFailure(errors.Wrap(errdefs.System(errors.New("OCI runtime create failed")), "container cannot be started")))
+}
@@ -0,0 +1,58 @@
+package dockerengine
+
+import (
+	"sync"
+	"time"
+)
+
+// imageUsage tracks when images have been used for runs last time, so the disk pressure gc evicts
+// least recently used images. The tag time is wrong for that: re-pulled images are tagged again,
+// while images used every minute keep the time of their first pull.
+type imageUsage struct {
+	mu     sync.Mutex
+	usedAt map[string]time.Time
+}
+
+func newImageUsage() *imageUsage {
+	return &imageUsage{
+		usedAt: make(map[string]time.Time),
+	}
+}
+
+// touch records a use of the image by its playground name.
+func (u *imageUsage) touch(image string, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.usedAt[image] = at
+}
+
+// lastUsed returns the latest use of the image by any of its tags.
+// It's not found if the image has not been used since the runner has started.
+func (u *imageUsage) lastUsed(tags []string) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var last time.Time
+	var found bool
+	for _, tag := range tags {
+		if at, ok := u.usedAt[tag]; ok {
+			found = true
+			if at.After(last) {
+				last = at
+			}
+		}
+	}
+
+	return last, found
+}
+
+// forget drops the tags of a removed image.
+func (u *imageUsage) forget(tags []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, tag := range tags {
+		delete(u.usedAt, tag)
+	}
+}
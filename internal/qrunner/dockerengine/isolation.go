@@ -0,0 +1,150 @@
+package dockerengine
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/api/types"
+	dockercli "github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+// Network isolation modes of database containers.
+const (
+	// IsolationNone creates containers without any network, only the loopback interface is available.
+	IsolationNone = "none"
+	// IsolationInternal attaches containers to a dedicated internal network. It has no route to other hosts,
+	// and containers attached to it cannot reach each other.
+	IsolationInternal = "internal"
+)
+
+// DefaultIsolationNetwork is the name of the internal network if it's not configured.
+const DefaultIsolationNetwork = "chp-isolated"
+
+const (
+	// labelIsolationNetwork marks the internal network, so it's not mistaken for a restricted egress one.
+	labelIsolationNetwork = "clickhouse.playground.isolation.network"
+
+	isolationConfigDir  = "/etc/clickhouse-server/config.d"
+	isolationConfigFile = "network-isolation.xml"
+)
+
+// IsolationConfig cuts database and tool containers off the network, so url(), remote() and similar table functions
+// cannot be used to scan hosts reachable from the daemon. The readiness probe and queries are executed
+// inside containers, so they do not need a network.
+type IsolationConfig struct {
+	// Mode is either IsolationNone or IsolationInternal.
+	Mode string
+
+	// Network is the name of the internal network used in IsolationInternal mode. It's created if it does not exist.
+	Network string
+
+	// DisableRemoteFunctions adds a config that restricts table functions and engines reaching other hosts,
+	// e.g. url(), s3() and remote(), to the local server. Queries using them fail immediately
+	// instead of waiting for connection timeouts.
+	DisableRemoteFunctions bool
+}
+
+func validateIsolation(cfg Config) error {
+	isolation := cfg.Isolation
+	if isolation == nil {
+		return nil
+	}
+
+	switch isolation.Mode {
+	case IsolationNone:
+	case IsolationInternal:
+		if isolation.Network == "" {
+			return errors.New("network is required in internal mode")
+		}
+	default:
+		return errors.Errorf("unknown mode '%s' (supported: %s, %s)", isolation.Mode, IsolationNone, IsolationInternal)
+	}
+
+	if cfg.Egress != nil {
+		return errors.New("isolation cannot be used together with restricted egress")
+	}
+	if cfg.Container.NetworkMode != nil {
+		return errors.New("isolation cannot be used together with a container network mode")
+	}
+
+	return nil
+}
+
+// networkMode returns the network mode of containers in the isolation mode.
+func (c IsolationConfig) networkMode() string {
+	if c.Mode == IsolationInternal {
+		return c.Network
+	}
+
+	return networkModeNone
+}
+
+// renderConfig generates a config.d file allowing URL-related and remote functions to reach the local server only.
+func (c IsolationConfig) renderConfig() []byte {
+	var b strings.Builder
+	b.WriteString("<clickhouse>\n")
+	b.WriteString("    <remote_url_allow_hosts>\n")
+	b.WriteString("        <host_regexp>^(localhost|127\\.0\\.0\\.[0-9]+|::1)$</host_regexp>\n")
+	b.WriteString("    </remote_url_allow_hosts>\n")
+	b.WriteString("</clickhouse>\n")
+
+	return []byte(b.String())
+}
+
+// isolationNetwork creates the internal network once it's needed for the first time.
+// If creation fails, the next container tries again.
+type isolationNetwork struct {
+	mu    sync.Mutex
+	ready bool
+}
+
+// ensure creates the network unless it exists. Networks are identified by names, so a network
+// created by another runner of the same daemon is reused.
+func (n *isolationNetwork) ensure(ctx context.Context, engine *engineProvider, name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ready {
+		return nil
+	}
+
+	err := engine.ensureIsolationNetwork(ctx, name)
+	if err != nil {
+		return err
+	}
+	n.ready = true
+
+	return nil
+}
+
+// ensureIsolationNetwork creates an internal network without inter-container communication unless it exists.
+func (p *engineProvider) ensureIsolationNetwork(ctx context.Context, name string) error {
+	_, err := p.cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !dockercli.IsErrNotFound(err) {
+		return errors.Wrap(err, "failed to inspect network")
+	}
+
+	_, err = p.cli.NetworkCreate(ctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Internal:       true,
+		Options:        map[string]string{"com.docker.network.bridge.enable_icc": "false"},
+		Labels: map[string]string{
+			qrunner.LabelOwnership: "1",
+			labelIsolationNetwork:  "1",
+		},
+	})
+	// The network has been created by another runner meanwhile.
+	if errdefs.IsConflict(err) {
+		return nil
+	}
+
+	return errors.Wrap(err, "failed to create network")
+}
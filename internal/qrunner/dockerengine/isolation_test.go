@@ -0,0 +1,121 @@
+package dockerengine
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	dockercli "github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIsolation(t *testing.T) {
+	networkMode := "bridge"
+
+	assert.NoError(t, validateIsolation(Config{}))
+	assert.NoError(t, validateIsolation(Config{Isolation: &IsolationConfig{Mode: IsolationNone}}))
+	assert.NoError(t, validateIsolation(Config{Isolation: &IsolationConfig{Mode: IsolationInternal, Network: DefaultIsolationNetwork}}))
+
+	assert.Error(t, validateIsolation(Config{Isolation: &IsolationConfig{Mode: "bridge"}}))
+	assert.Error(t, validateIsolation(Config{Isolation: &IsolationConfig{Mode: IsolationInternal}}))
+	assert.Error(t, validateIsolation(Config{
+		Isolation: &IsolationConfig{Mode: IsolationNone},
+		Egress:    &EgressConfig{ProxyImage: DefaultEgressProxyImage, Allowlist: []string{"datasets.clickhouse.com"}},
+	}))
+	assert.Error(t, validateIsolation(Config{
+		Isolation: &IsolationConfig{Mode: IsolationNone},
+		Container: ContainerSettings{NetworkMode: &networkMode},
+	}))
+}
+
+func TestIsolationConfig(t *testing.T) {
+	var parsed struct {
+		HostRegexp string `xml:"remote_url_allow_hosts>host_regexp"`
+	}
+	err := xml.Unmarshal(IsolationConfig{}.renderConfig(), &parsed)
+	require.NoError(t, err)
+
+	re := regexp.MustCompile(parsed.HostRegexp)
+	for _, host := range []string{"localhost", "127.0.0.1", "127.0.0.2", "::1"} {
+		assert.True(t, re.MatchString(host), host)
+	}
+	for _, host := range []string{"10.0.0.1", "169.254.169.254", "example.com", "localhost.example.com"} {
+		assert.False(t, re.MatchString(host), host)
+	}
+}
+
+func TestEnsureIsolationNetwork(t *testing.T) {
+	tests := []struct {
+		name          string
+		exists        bool
+		createStatus  int
+		expectCreated bool
+		expectErr     bool
+	}{
+		{name: "missing", createStatus: http.StatusCreated, expectCreated: true},
+		{name: "exists", exists: true},
+		{name: "created concurrently", createStatus: http.StatusConflict, expectCreated: true},
+		{name: "create failed", createStatus: http.StatusInternalServerError, expectCreated: true, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var created *types.NetworkCreateRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:]
+				switch {
+				case r.Method == http.MethodGet && path == "/networks/"+DefaultIsolationNetwork:
+					if !tt.exists {
+						http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+						return
+					}
+					_, _ = w.Write([]byte(`{"Name": "chp-isolated"}`))
+
+				case r.Method == http.MethodPost && path == "/networks/create":
+					created = new(types.NetworkCreateRequest)
+					_ = json.NewDecoder(r.Body).Decode(created)
+					if tt.createStatus != http.StatusCreated {
+						http.Error(w, `{"message": "failed"}`, tt.createStatus)
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(`{"Id": "network-1"}`))
+
+				default:
+					http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+				}
+			}))
+			defer srv.Close()
+
+			cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+			require.NoError(t, err)
+
+			var network isolationNetwork
+			err = network.ensure(context.Background(), &engineProvider{cli: cli}, DefaultIsolationNetwork)
+			if tt.expectErr {
+				assert.Error(t, err)
+				assert.False(t, network.ready)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, network.ready)
+
+			if !tt.expectCreated {
+				assert.Nil(t, created)
+				return
+			}
+			require.NotNil(t, created)
+			assert.Equal(t, DefaultIsolationNetwork, created.Name)
+			assert.True(t, created.Internal)
+			assert.Equal(t, "false", created.Options["com.docker.network.bridge.enable_icc"])
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package dockerengine
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// DefaultMirrorTimeout is the default wait for a mirror to start serving the image.
+const DefaultMirrorTimeout = 10 * time.Second
+
+// Sources of image pulls. Mirrors are reported by their endpoints.
+const (
+	pullSourceLocal    = qrunner.PullSourceLocal
+	pullSourceUpstream = "upstream"
+)
+
+// mirrors maps repositories to their mirror endpoints in the order they are tried.
+type mirrors map[qrunner.RepositoryRef][]string
+
+func newMirrors(configs []MirrorConfig) (mirrors, error) {
+	m := make(mirrors, len(configs))
+	for _, cfg := range configs {
+		repository, err := qrunner.ParseRepositoryRef(cfg.Repository)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid repository")
+		}
+		if _, found := m[repository]; found {
+			return nil, errors.Errorf("mirrors of repository '%s' are configured twice", cfg.Repository)
+		}
+		if len(cfg.Endpoints) == 0 {
+			return nil, errors.Errorf("mirrors of repository '%s' have no endpoints", cfg.Repository)
+		}
+
+		for _, endpoint := range cfg.Endpoints {
+			err = validateMirrorEndpoint(endpoint, repository)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		m[repository] = cfg.Endpoints
+	}
+
+	return m, nil
+}
+
+// validateMirrorEndpoint checks that Docker reads the endpoint as the registry host of the mirrored reference.
+func validateMirrorEndpoint(endpoint string, repository qrunner.RepositoryRef) error {
+	if strings.Contains(endpoint, "://") {
+		return errors.Errorf("mirror endpoint '%s' cannot have a scheme", endpoint)
+	}
+
+	host, _, _ := strings.Cut(endpoint, "/")
+	ref, err := qrunner.ParseRepositoryRef(endpoint + "/" + repository.Path())
+	if err != nil {
+		return errors.Wrapf(err, "invalid mirror endpoint '%s'", endpoint)
+	}
+	if ref.Registry != strings.ToLower(host) || ref.IsDockerHub() {
+		return errors.Errorf("mirror endpoint '%s' must start with a registry host", endpoint)
+	}
+
+	return nil
+}
+
+// mirrorReference returns the digest-qualified reference of the image in the mirror.
+func mirrorReference(endpoint string, repository qrunner.RepositoryRef, digest string) string {
+	return strings.TrimSuffix(endpoint, "/") + "/" + repository.Path() + "@" + digest
+}
+
+// pullFromMirrors tries the mirrors of the image repository in order. It returns the pulled reference
+// and the endpoint which served it, or false if no mirror could serve the image.
+func (r *Runner) pullFromMirrors(ctx context.Context, state *requestState) (ref string, endpoint string, ok bool) {
+	var img dockertag.Image
+	if state.pinned != nil {
+		img = *state.pinned
+	} else {
+		var err error
+		img, err = r.findBuild(ctx, state.version)
+		if err != nil {
+			return "", "", false
+		}
+	}
+	if img.Digest == "" {
+		return "", "", false
+	}
+
+	repository, err := qrunner.ParseRepositoryRef(img.Repository)
+	if err != nil {
+		return "", "", false
+	}
+
+	for _, endpoint := range r.mirrors[repository] {
+		ref := mirrorReference(endpoint, repository, img.Digest)
+
+		err := r.pullImage(ctx, ref, "", r.cfg.MirrorTimeout)
+		if err == nil {
+			err = r.verifyDigest(ctx, ref, img.Digest)
+			if err != nil {
+				r.removeMirrorImage(ctx, state.runID, ref)
+			}
+		}
+		r.pipelineMetr.PullSource(endpoint, err == nil)
+
+		if err == nil {
+			return ref, endpoint, true
+		}
+
+		// The run is cancelled, the upstream must not be tried either.
+		if ctx.Err() != nil {
+			return "", "", false
+		}
+
+		r.logger.Warn().Err(err).Str("run_id", state.runID).Str("mirror", endpoint).Str("image", ref).
+			Msg("failed to pull image from mirror, trying the next source")
+	}
+
+	return "", "", false
+}
+
+// removeMirrorImage removes the image pulled from a mirror that failed the digest check,
+// so it's neither used by later runs nor kept until the garbage collector finds it.
+func (r *Runner) removeMirrorImage(ctx context.Context, runID string, ref string) {
+	_, err := r.engine.removeImage(ctx, ref, true)
+	if err != nil && !dockercli.IsErrNotFound(err) {
+		r.logger.Warn().Err(err).Str("run_id", runID).Str("image", ref).Msg("failed to remove image pulled from mirror")
+	}
+}
+
+// pullImage pulls the image for the platform (e.g. linux/arm64) and waits for the pull to be finished.
+// If the platform is empty, the daemon picks it. If startTimeout is set, the pull is aborted
+// unless the daemon starts it (reports the first progress message) within the timeout.
+func (r *Runner) pullImage(ctx context.Context, ref, platform string, startTimeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var started, timedOut int32
+	if startTimeout > 0 {
+		timer := time.AfterFunc(startTimeout, func() {
+			if atomic.CompareAndSwapInt32(&started, 0, 1) {
+				atomic.StoreInt32(&timedOut, 1)
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	out, err := r.engine.pullImage(ctx, ref, platform)
+	if err == nil {
+		// We should read the output to be sure that the image has been pulled.
+		err = readPullOutput(out, func() {
+			atomic.CompareAndSwapInt32(&started, 0, 1)
+		})
+		out.Close()
+	}
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		return errors.Errorf("pull has not started within %s", startTimeout)
+	}
+
+	return err
+}
+
+// verifyDigest checks that the pulled image has the digest reported by the tag storage.
+func (r *Runner) verifyDigest(ctx context.Context, ref string, digest string) error {
+	inspect, err := r.engine.getImageByID(ctx, ref)
+	if err != nil {
+		return errors.Wrap(err, "docker inspect failed")
+	}
+
+	for _, repoDigest := range inspect.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("pulled image doesn't have digest %s", digest)
+}
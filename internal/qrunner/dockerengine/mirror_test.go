@@ -0,0 +1,83 @@
+package dockerengine
+
+import (
+	"strings"
+	"testing"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMirrors(t *testing.T) {
+	m, err := newMirrors([]MirrorConfig{
+		{Repository: "clickhouse/clickhouse-server", Endpoints: []string{"mirror.local:5000", "cache.internal/hub"}},
+		{Repository: "yandex/clickhouse-server", Endpoints: []string{"localhost:5000"}},
+	})
+	require.NoError(t, err)
+
+	repository, err := qrunner.ParseRepositoryRef("docker.io/clickhouse/clickhouse-server")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mirror.local:5000", "cache.internal/hub"}, m[repository])
+
+	tests := []struct {
+		name    string
+		configs []MirrorConfig
+	}{
+		{
+			name:    "Invalid repository",
+			configs: []MirrorConfig{{Repository: "clickhouse:latest", Endpoints: []string{"mirror.local"}}},
+		},
+		{
+			name:    "No endpoints",
+			configs: []MirrorConfig{{Repository: "clickhouse/clickhouse-server"}},
+		},
+		{
+			name: "Duplicate repository",
+			configs: []MirrorConfig{
+				{Repository: "clickhouse/clickhouse-server", Endpoints: []string{"mirror.local"}},
+				{Repository: "docker.io/clickhouse/clickhouse-server", Endpoints: []string{"mirror.local"}},
+			},
+		},
+		{
+			name:    "Scheme",
+			configs: []MirrorConfig{{Repository: "clickhouse/clickhouse-server", Endpoints: []string{"https://mirror.local"}}},
+		},
+		{
+			name:    "Not a registry host",
+			configs: []MirrorConfig{{Repository: "clickhouse/clickhouse-server", Endpoints: []string{"mirror"}}},
+		},
+		{
+			name:    "Docker Hub",
+			configs: []MirrorConfig{{Repository: "clickhouse/clickhouse-server", Endpoints: []string{"registry-1.docker.io"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newMirrors(tt.configs)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMirrorReference(t *testing.T) {
+	official, err := qrunner.ParseRepositoryRef("clickhouse")
+	require.NoError(t, err)
+	server, err := qrunner.ParseRepositoryRef("clickhouse/clickhouse-server")
+	require.NoError(t, err)
+
+	assert.Equal(t, "mirror.local:5000/library/clickhouse@sha256:abc", mirrorReference("mirror.local:5000", official, "sha256:abc"))
+	assert.Equal(t, "cache.internal/hub/clickhouse/clickhouse-server@sha256:abc", mirrorReference("cache.internal/hub/", server, "sha256:abc"))
+}
+
+func TestReadPullOutput_Progress(t *testing.T) {
+	var messages int
+	err := readPullOutput(strings.NewReader(`{"status":"Pulling from clickhouse/clickhouse-server"}{"status":"Downloading"}`), func() {
+		messages++
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, messages)
+}
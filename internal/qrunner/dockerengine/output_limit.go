@@ -0,0 +1,66 @@
+package dockerengine
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// errOutputLimitReached stops copying the exec output once the limit of the run is reached.
+var errOutputLimitReached = errors.New("output limit reached")
+
+// outputLimit bounds the output of a run across its streams and execs, so a huge result is not buffered in memory.
+// Writes past the limit are cut and fail with errOutputLimitReached, so the rest of the output is not read.
+// The limit is not safe for concurrent use, the streams of an exec are copied by a single goroutine.
+type outputLimit struct {
+	// max is the number of bytes kept. If 0, the output is unlimited.
+	max uint64
+
+	written uint64
+
+	// dropped is the number of bytes that have been cut. The output is not read after the limit,
+	// so the client may have produced more.
+	dropped uint64
+}
+
+func newOutputLimit(max uint64) *outputLimit {
+	return &outputLimit{max: max}
+}
+
+// writer returns dst limited by the shared budget.
+func (l *outputLimit) writer(dst io.Writer) io.Writer {
+	return &limitedWriter{dst: dst, limit: l}
+}
+
+func (l *outputLimit) truncated() bool {
+	return l.dropped > 0
+}
+
+type limitedWriter struct {
+	dst   io.Writer
+	limit *outputLimit
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	l := w.limit
+	if l.max == 0 {
+		return w.dst.Write(p)
+	}
+
+	remaining := l.max - l.written
+	if uint64(len(p)) <= remaining {
+		n, err := w.dst.Write(p)
+		l.written += uint64(n)
+
+		return n, err
+	}
+
+	n, err := w.dst.Write(p[:remaining])
+	l.written += uint64(n)
+	l.dropped += uint64(len(p) - n)
+	if err != nil {
+		return n, err
+	}
+
+	return n, errOutputLimitReached
+}
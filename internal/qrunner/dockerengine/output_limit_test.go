@@ -0,0 +1,43 @@
+package dockerengine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputLimit(t *testing.T) {
+	var stream bytes.Buffer
+	_, err := stdcopy.NewStdWriter(&stream, stdcopy.Stdout).Write([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = stdcopy.NewStdWriter(&stream, stdcopy.Stderr).Write([]byte("error"))
+	require.NoError(t, err)
+
+	// The budget is shared by the streams.
+	limit := newOutputLimit(12)
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(limit.writer(&stdout), limit.writer(&stderr), bytes.NewReader(stream.Bytes()))
+	require.ErrorIs(t, err, errOutputLimitReached)
+
+	assert.Equal(t, "0123456789", stdout.String())
+	assert.Equal(t, "er", stderr.String())
+	assert.True(t, limit.truncated())
+	assert.Equal(t, uint64(3), limit.dropped)
+
+	// Nothing is written once the limit is reached.
+	n, err := limit.writer(&stdout).Write([]byte("more"))
+	assert.ErrorIs(t, err, errOutputLimitReached)
+	assert.Zero(t, n)
+	assert.Equal(t, uint64(7), limit.dropped)
+
+	unlimited := newOutputLimit(0)
+	stdout.Reset()
+	stderr.Reset()
+	_, err = stdcopy.StdCopy(unlimited.writer(&stdout), unlimited.writer(&stderr), bytes.NewReader(stream.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", stdout.String())
+	assert.False(t, unlimited.truncated())
+}
@@ -0,0 +1,70 @@
+//go:build podman
+
+package dockerengine
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPodman runs a query against the Docker-compatible socket of Podman:
+//
+//	systemctl --user start podman.socket
+//	PODMAN_SOCKET=unix:///run/user/$(id -u)/podman/podman.sock go test -tags podman -run TestPodman ./internal/qrunner/dockerengine
+func TestPodman(t *testing.T) {
+	socket := os.Getenv("PODMAN_SOCKET")
+	if socket == "" {
+		t.Skip("PODMAN_SOCKET is not set")
+	}
+
+	ctx := context.Background()
+	logger := zlog.Logger.Level(zerolog.ErrorLevel)
+
+	tagStorage := tagStorageMock{
+		images: map[string]dockertag.Image{
+			"23.3": {
+				Repository:   "clickhouse/clickhouse-server",
+				Tag:          "23.3",
+				OS:           "linux",
+				Architecture: "amd64",
+				// The digest only names the local image, the image is pulled by the tag.
+				Digest:   "sha256:podman-test",
+				PushedAt: time.Now(),
+			},
+		},
+	}
+
+	cfg := DefaultConfig
+	cfg.DaemonURL = &socket
+	cfg.GC = nil
+	cfg.MaxWarmContainers = 0
+
+	runner, err := New(ctx, logger, "TestPodman", cfg, tagStorage)
+	require.NoError(t, err)
+	require.NoError(t, runner.engine.checkAPIVersion(ctx))
+	t.Cleanup(func() {
+		removeTestContainers(t, runner)
+	})
+
+	res, err := runner.RunQuery(ctx, &queryrun.Run{
+		ID:       "podman",
+		Input:    "SELECT 1",
+		Version:  "23.3",
+		Database: "clickhouse",
+		Settings: &runsettings.ClickHouseSettings{OutputFormat: "TabSeparated"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1\n", res.Stdout)
+	assert.Equal(t, 0, res.ExitCode)
+}
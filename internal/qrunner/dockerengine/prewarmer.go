@@ -1,12 +1,14 @@
 package dockerengine
 
 import (
-	"clickhouse-playground/internal/metrics"
 	"context"
 	"fmt"
 	"sync"
 	"time"
 
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
@@ -22,20 +24,43 @@ type prewarmer struct {
 	cancel context.CancelFunc
 	logger zerolog.Logger
 	metr   *metrics.PrewarmerExporter
+	name   string
 
 	runner containerRunner
 	engine *engineProvider
+	tasks  *qrunner.TaskGroup
 
 	lock sync.Mutex
 
-	containers          map[string]*containerState
+	// containers are pools of warm containers by image FQN.
+	containers          map[string][]*containerState
 	latestRequestsQueue []requestState
 	signals             chan struct{}
 
+	// targets are numbers of warm containers allocated to images by the warm pool sizing.
+	// If it's nil, every image keeps at most one container.
+	targets map[string]uint
+
 	maxWarmContainers uint
+
+	// idleTTL is how long a warm container can stay unused. If 0, containers do not expire.
+	idleTTL time.Duration
+
+	// warmedAt is when the first allocation has been filled. The time since startedAt is exported once.
+	startedAt time.Time
+	warmedAt  time.Time
 }
 
-func newPrewarmer(ctx context.Context, logger zerolog.Logger, runner containerRunner, engine *engineProvider, maxWarmContainers uint) *prewarmer {
+func newPrewarmer(
+	ctx context.Context,
+	logger zerolog.Logger,
+	name string,
+	runner containerRunner,
+	engine *engineProvider,
+	tasks *qrunner.TaskGroup,
+	maxWarmContainers uint,
+	idleTTL time.Duration,
+) *prewarmer {
 	ctx, cancel := context.WithCancel(ctx)
 
 	return &prewarmer{
@@ -43,11 +68,15 @@ func newPrewarmer(ctx context.Context, logger zerolog.Logger, runner containerRu
 		cancel:            cancel,
 		logger:            logger,
 		metr:              metrics.NewPrewarmerExporter(),
+		name:              name,
 		runner:            runner,
 		engine:            engine,
-		containers:        make(map[string]*containerState),
+		tasks:             tasks,
+		containers:        make(map[string][]*containerState),
 		signals:           make(chan struct{}, 1),
 		maxWarmContainers: maxWarmContainers,
+		idleTTL:           idleTTL,
+		startedAt:         time.Now(),
 	}
 }
 
@@ -61,11 +90,26 @@ func (p *prewarmer) notify() {
 func (p *prewarmer) Start() error {
 	p.logger.Info().Msg("prewarmer has been started")
 
+	// Expired containers are checked twice per TTL, so they are removed at most half of the TTL late.
+	var expirations <-chan time.Time
+	if p.idleTTL > 0 {
+		t := time.NewTicker(p.idleTTL / 2)
+		defer t.Stop()
+
+		expirations = t.C
+	}
+
 	for {
 		select {
 		case <-p.ctx.Done():
 			return nil
 
+		case now := <-expirations:
+			for _, c := range p.expire(now) {
+				p.removeAsync(c.id)
+			}
+			continue
+
 		case <-p.signals:
 		}
 
@@ -95,18 +139,20 @@ func (p *prewarmer) Stop(shutdownCtx context.Context) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	p.logger.Info().Int("count", len(p.containers)).Msg("start removing prewarmed containers")
+	p.logger.Info().Int("count", p.count()).Msg("start removing prewarmed containers")
 
-	for _, c := range p.containers {
-		err := p.engine.removeContainer(shutdownCtx, c.id)
-		if err != nil {
-			p.logger.Err(err).Str("container_id", c.id).Msg("failed to remove container")
-		} else {
-			p.metr.EjectContainer()
+	for _, pool := range p.containers {
+		for _, c := range pool {
+			err := p.engine.removeContainer(shutdownCtx, c.id)
+			if err != nil {
+				p.logger.Err(err).Str("container_id", c.id).Msg("failed to remove container")
+			} else {
+				p.metr.EjectContainer()
+			}
 		}
 	}
 
-	p.containers = make(map[string]*containerState)
+	p.containers = make(map[string][]*containerState)
 
 	p.logger.Info().Msg("prewarmer has been stopped")
 }
@@ -144,9 +190,9 @@ func (p *prewarmer) runContainer(request *requestState) error {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	_, found := p.containers[request.imageFQN]
-	if found {
-		return errors.New("container for that image already exists")
+	if uint(len(p.containers[request.imageFQN])) >= p.limit(request.imageFQN) {
+		p.removeAsync(state.containerID)
+		return errors.New("the pool of that image is full")
 	}
 
 	container := &containerState{
@@ -155,18 +201,24 @@ func (p *prewarmer) runContainer(request *requestState) error {
 		createdAt: time.Now(),
 		status:    statusRunning,
 	}
-	p.containers[request.imageFQN] = container
+	p.containers[request.imageFQN] = append(p.containers[request.imageFQN], container)
+	p.checkWarmed()
 
 	// If the number of prewarmed containers exceeds the limit,
 	// delete the oldest.
-	if len(p.containers) > int(p.maxWarmContainers) {
+	if p.count() > int(p.maxWarmContainers) {
 		p.ejectContainer()
 	}
 
 	// Pause container after some time to allow its bootstrap.
-	go func() {
+	p.tasks.Go("prewarm-pause", func() {
 		// Sleep is necessary for database server bootstrap to be finished.
-		time.Sleep(DatabaseInitializationTime)
+		select {
+		case <-p.ctx.Done():
+			return
+
+		case <-time.After(DatabaseInitializationTime):
+		}
 
 		release := container.acquireLock()
 		defer release()
@@ -184,7 +236,7 @@ func (p *prewarmer) runContainer(request *requestState) error {
 		container.setStatus(statusPaused)
 
 		p.logger.Debug().Str("id", container.id).Str("image", container.imageFQN).Msg("container has been paused")
-	}()
+	})
 
 	p.metr.AddContainer()
 	p.logger.Debug().Str("id", container.id).Str("image", container.imageFQN).
@@ -193,30 +245,182 @@ func (p *prewarmer) runContainer(request *requestState) error {
 	return nil
 }
 
+// checkWarmed exports the time it has taken to fill the first allocation of the warm pool since the start.
+// It must be called under the taken lock.
+func (p *prewarmer) checkWarmed() {
+	if !p.warmedAt.IsZero() || len(p.targets) == 0 {
+		return
+	}
+
+	for fqn, target := range p.targets {
+		if uint(len(p.containers[fqn])) < target {
+			return
+		}
+	}
+
+	p.warmedAt = time.Now()
+	p.metr.Warmed(p.name, p.warmedAt.Sub(p.startedAt))
+	p.logger.Info().Dur("elapsed", p.warmedAt.Sub(p.startedAt)).Msg("warm pool has been filled")
+}
+
+// reconcile drops prewarmed containers that do not exist anymore.
+func (p *prewarmer) reconcile(existing map[string]struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for fqn, pool := range p.containers {
+		kept := pool[:0]
+		for _, c := range pool {
+			if _, found := existing[c.id]; found {
+				kept = append(kept, c)
+				continue
+			}
+
+			p.metr.EjectContainer()
+			p.logger.Debug().Str("id", c.id).Str("image", c.imageFQN).Msg("a lost container has been dropped from the prewarmed set")
+		}
+
+		p.setPool(fqn, kept)
+	}
+}
+
+// expire drops containers created more than idleTTL ago from the prewarmed set and returns them.
+// Warm containers are never reused, so their age is their idle time.
+func (p *prewarmer) expire(now time.Time) []*containerState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var expired []*containerState
+	for fqn, pool := range p.containers {
+		kept := pool[:0]
+		for _, c := range pool {
+			if now.Sub(c.createdAt) < p.idleTTL {
+				kept = append(kept, c)
+				continue
+			}
+
+			expired = append(expired, c)
+
+			p.metr.ExpireContainer()
+			p.logger.Debug().Str("id", c.id).Str("image", c.imageFQN).
+				Msg("an idle container has expired from the prewarmed set")
+		}
+
+		p.setPool(fqn, kept)
+	}
+
+	return expired
+}
+
+// count returns the number of warm containers. The lock must be held.
+func (p *prewarmer) count() int {
+	var count int
+	for _, pool := range p.containers {
+		count += len(pool)
+	}
+
+	return count
+}
+
+// limit returns the max number of warm containers of the image. The lock must be held.
+// Images without an allocation keep one container started after their last run.
+func (p *prewarmer) limit(imageFQN string) uint {
+	if target := p.targets[imageFQN]; target > 0 {
+		return target
+	}
+
+	return 1
+}
+
+// setPool replaces the pool of the image, empty pools are dropped. The lock must be held.
+func (p *prewarmer) setPool(imageFQN string, pool []*containerState) {
+	if len(pool) == 0 {
+		delete(p.containers, imageFQN)
+		return
+	}
+
+	p.containers[imageFQN] = pool
+}
+
 // ejectContainer removes the oldest container to allow a new container to be created.
+// Containers of images exceeding their allocation are ejected first. The lock must be held.
 func (p *prewarmer) ejectContainer() {
-	var oldestImage string
-	oldestDate := time.Now()
-	for fqn, c := range p.containers {
-		if c.createdAt.Before(oldestDate) {
-			oldestImage = fqn
-			oldestDate = c.createdAt
+	var (
+		found       bool
+		victimImage string
+		victimIdx   int
+		victimOver  bool
+		victimDate  time.Time
+	)
+	for fqn, pool := range p.containers {
+		over := p.targets != nil && uint(len(pool)) > p.targets[fqn]
+		for i, c := range pool {
+			if found && (victimOver && !over || victimOver == over && !c.createdAt.Before(victimDate)) {
+				continue
+			}
+
+			found = true
+			victimImage, victimIdx, victimOver, victimDate = fqn, i, over, c.createdAt
 		}
 	}
+	if !found {
+		return
+	}
 
-	container := p.containers[oldestImage]
-	delete(p.containers, oldestImage)
+	pool := p.containers[victimImage]
+	container := pool[victimIdx]
+	p.setPool(victimImage, append(pool[:victimIdx:victimIdx], pool[victimIdx+1:]...))
 
 	p.metr.EjectContainer()
 	p.logger.Debug().Str("id", container.id).Str("image", container.imageFQN).
 		Msg("a container has been ejected from the prewarmed set")
 
-	go func() {
-		err := p.engine.removeContainer(p.ctx, container.id)
+	p.removeAsync(container.id)
+}
+
+func (p *prewarmer) removeAsync(containerID string) {
+	p.tasks.Go("prewarm-removal", func() {
+		err := p.engine.removeContainer(p.ctx, containerID)
 		if err != nil {
-			p.logger.Err(err).Str("container_id", container.id).Msg("failed to remove container")
+			p.logger.Err(err).Str("container_id", containerID).Msg("failed to remove container")
 		}
-	}()
+	})
+}
+
+// resize applies the warm pool allocation: pools exceeding their targets are shrunk,
+// and containers are requested for pools below their targets.
+// Requests must have the image tag and FQN set, targets are taken by their FQNs.
+func (p *prewarmer) resize(requests []requestState, targets map[string]uint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.targets = targets
+
+	for fqn, pool := range p.containers {
+		limit := p.limit(fqn)
+		for uint(len(pool)) > limit {
+			container := pool[0]
+			pool = pool[1:]
+
+			p.metr.EjectContainer()
+			p.logger.Debug().Str("id", container.id).Str("image", container.imageFQN).
+				Msg("a container has been ejected from the prewarmed set due to the allocation")
+
+			p.removeAsync(container.id)
+		}
+
+		p.setPool(fqn, pool)
+	}
+
+	for _, request := range requests {
+		for i := uint(0); i < p.limit(request.imageFQN); i++ {
+			if !p.enqueue(request) {
+				break
+			}
+		}
+	}
+
+	p.notify()
 }
 
 // PushNewRequest should be called when a new request comes.
@@ -225,20 +429,31 @@ func (p *prewarmer) PushNewRequest(request requestState) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	// If there is such an image in the waiting queue, skip it.
+	if p.enqueue(request) {
+		p.notify()
+	}
+}
+
+// enqueue adds the request to the queue unless the pool of the image with queued requests
+// reaches its limit. It reports whether the request has been added. The lock must be held.
+func (p *prewarmer) enqueue(request requestState) bool {
+	pending := uint(len(p.containers[request.imageFQN]))
 	for _, r := range p.latestRequestsQueue {
 		if r.imageFQN == request.imageFQN {
-			return
+			pending++
 		}
 	}
+	if pending >= p.limit(request.imageFQN) {
+		return false
+	}
 
 	// Add a new item to the queue and trim the prefix if necessary.
 	p.latestRequestsQueue = append(p.latestRequestsQueue, request)
-	if len(p.latestRequestsQueue) >= int(p.maxWarmContainers) && len(p.latestRequestsQueue) > 0 {
+	if len(p.latestRequestsQueue) > int(p.maxWarmContainers) {
 		p.latestRequestsQueue = p.latestRequestsQueue[1:]
 	}
 
-	p.notify()
+	return true
 }
 
 // Fetch returns id of a warm container if it exists.
@@ -268,12 +483,14 @@ func (p *prewarmer) extractContainer(imageFQN string) (container *containerState
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	container, found := p.containers[imageFQN]
-	if !found {
+	pool := p.containers[imageFQN]
+	if len(pool) == 0 {
 		return nil
 	}
 
-	delete(p.containers, imageFQN)
+	// The oldest container has had the most time to bootstrap.
+	container = pool[0]
+	p.setPool(imageFQN, pool[1:])
 
 	p.metr.FetchContainer()
 	p.logger.Debug().Str("id", container.id).Str("image", container.imageFQN).
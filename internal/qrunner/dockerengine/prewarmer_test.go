@@ -0,0 +1,38 @@
+package dockerengine
+
+import (
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrewarmerExpire(t *testing.T) {
+	now := time.Now()
+	warm := func(id string, age time.Duration) *containerState {
+		return &containerState{id: id, imageFQN: "clickhouse/clickhouse-server:" + id, createdAt: now.Add(-age)}
+	}
+
+	p := &prewarmer{
+		logger:  zerolog.Nop(),
+		metr:    metrics.NewPrewarmerExporter(),
+		idleTTL: time.Hour,
+		containers: map[string][]*containerState{
+			"23.3": {warm("a", 2*time.Hour), warm("b", time.Minute)},
+			"22.8": {warm("c", time.Hour)},
+		},
+	}
+
+	var expired []string
+	for _, c := range p.expire(now) {
+		expired = append(expired, c.id)
+	}
+
+	assert.ElementsMatch(t, []string{"a", "c"}, expired)
+	assert.Len(t, p.containers, 1, "empty pools are dropped")
+	assert.Len(t, p.containers["23.3"], 1)
+	assert.Equal(t, "b", p.containers["23.3"][0].id)
+}
@@ -0,0 +1,202 @@
+package dockerengine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// DefaultPullTimeout is the default bound of an attempt to pull an image from the upstream registry.
+const DefaultPullTimeout = 3 * time.Minute
+
+// DefaultPullRetry retries transient pull failures twice, after 1s and 2s.
+var DefaultPullRetry = PullRetryConfig{
+	MaxAttempts:  3,
+	InitialDelay: time.Second,
+	MaxDelay:     10 * time.Second,
+}
+
+var errPullTimedOut = errors.New("pull timed out")
+
+// pullUpstream pulls the image from the upstream registry. Attempts failed because of transient errors
+// are retried with an exponential backoff, and every attempt is bounded by the pull timeout,
+// so a stuck pull is restarted instead of consuming the whole deadline of the run.
+func (r *Runner) pullUpstream(ctx context.Context, ref, platform, version string) (err error) {
+	retry := r.cfg.PullRetry
+	delay := retry.InitialDelay
+
+	for attempt := uint(1); ; attempt++ {
+		err = r.pullAttempt(ctx, ref, platform)
+		r.pipelineMetr.PullSource(pullSourceUpstream, err == nil)
+		if err == nil || attempt >= retry.MaxAttempts || ctx.Err() != nil || !isTransientPullError(err) {
+			if attempt > 1 {
+				r.pipelineMetr.RetriedPull(version, err == nil)
+			}
+
+			return err
+		}
+
+		r.logger.Warn().Err(err).
+			Str("image", ref).
+			Uint("attempt", attempt).
+			Dur("delay", delay).
+			Msg("image pull has failed, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if attempt > 1 {
+				r.pipelineMetr.RetriedPull(version, false)
+			}
+
+			return err
+		case <-timer.C:
+		}
+
+		r.pipelineMetr.PullRetry(version)
+		delay *= 2
+		if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+}
+
+// pullAttempt pulls the image once within the pull timeout.
+func (r *Runner) pullAttempt(ctx context.Context, ref, platform string) error {
+	if r.cfg.PullTimeout <= 0 {
+		return r.pullImage(ctx, ref, platform, 0)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, r.cfg.PullTimeout)
+	defer cancel()
+
+	err := r.pullImage(attemptCtx, ref, platform, 0)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return errors.Wrapf(errPullTimedOut, "pull has not finished within %s", r.cfg.PullTimeout)
+	}
+
+	return err
+}
+
+// pullMessage is a message of the pull progress stream.
+type pullMessage struct {
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// readPullOutput drains the pull progress stream. Once the pull has started,
+// the daemon reports its failure inside the stream, e.g. when the registry rejects a layer request.
+// The progress callback is called on every message.
+func readPullOutput(out io.Reader, progress func()) error {
+	dec := json.NewDecoder(out)
+	for {
+		var msg pullMessage
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read pull output")
+		}
+		if progress != nil {
+			progress()
+		}
+
+		switch {
+		case msg.ErrorDetail != nil && msg.ErrorDetail.Message != "":
+			return errors.New(msg.ErrorDetail.Message)
+
+		case msg.Error != "":
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// isPullRateLimited reports whether the pull has been rejected by the registry because of its rate limit.
+// The daemon doesn't expose the registry response, so the error message is matched,
+// e.g. "toomanyrequests: You have reached your pull rate limit".
+func isPullRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	return strings.Contains(msg, "toomanyrequests") ||
+		strings.Contains(msg, "429 too many requests") ||
+		strings.Contains(msg, "pull rate limit")
+}
+
+// isPullUnauthorized reports whether the registry has refused the credentials of the pull or has none,
+// e.g. "unauthorized: authentication required" or "pull access denied for ...".
+func isPullUnauthorized(err error) bool {
+	if err == nil {
+		return false
+	}
+	if dockercli.IsErrUnauthorized(err) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	return strings.Contains(msg, "unauthorized") ||
+		strings.Contains(msg, "access denied") ||
+		strings.Contains(msg, "authentication required")
+}
+
+// isTransientPullError reports whether a retry of the pull can succeed. Timeouts, dropped connections
+// and 5xx responses of the registry are transient. Rate limits, unknown manifests and refused credentials
+// are permanent, as well as errors that are not known to be transient, e.g. an invalid reference.
+func isTransientPullError(err error) bool {
+	if err == nil || isPullRateLimited(err) || isManifestUnknown(err) || isPullUnauthorized(err) {
+		return false
+	}
+	if errors.Is(err, errPullTimedOut) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, part := range []string{
+		"tls handshake timeout",
+		"i/o timeout",
+		"timeout exceeded",
+		"connection reset",
+		"connection refused",
+		"unexpected eof",
+		"temporary failure in name resolution",
+		"500 internal server error",
+		"502 bad gateway",
+		"503 service unavailable",
+		"504 gateway timeout",
+		"unexpected http status: 5",
+	} {
+		if strings.Contains(msg, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isManifestUnknown reports whether the pull has failed because the registry has no such image,
+// e.g. "manifest for clickhouse/clickhouse-server@sha256:... not found: manifest unknown".
+func isManifestUnknown(err error) bool {
+	if err == nil {
+		return false
+	}
+	if dockercli.IsErrNotFound(err) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	return strings.Contains(msg, "manifest unknown") || strings.Contains(msg, "not found")
+}
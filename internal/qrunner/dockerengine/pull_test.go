@@ -0,0 +1,234 @@
+package dockerengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPullOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		errMsg string
+	}{
+		{
+			name: "Pulled",
+			output: `{"status":"Pulling from clickhouse/clickhouse-server","id":"23.3"}
+{"status":"Download complete","progressDetail":{},"id":"a1b2"}
+{"status":"Status: Downloaded newer image for clickhouse/clickhouse-server:23.3"}`,
+		},
+		{
+			name: "Rate limited in the middle of the pull",
+			output: `{"status":"Pulling from clickhouse/clickhouse-server","id":"23.3"}
+{"errorDetail":{"message":"toomanyrequests: You have reached your pull rate limit."},"error":"toomanyrequests: You have reached your pull rate limit."}`,
+			errMsg: "toomanyrequests: You have reached your pull rate limit.",
+		},
+		{
+			name:   "Error without details",
+			output: `{"error":"manifest unknown"}`,
+			errMsg: "manifest unknown",
+		},
+		{
+			name:   "Malformed output",
+			output: `{"status":`,
+			errMsg: "failed to read pull output",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := readPullOutput(strings.NewReader(tt.output), nil)
+			if tt.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestIsPullRateLimited(t *testing.T) {
+	assert.True(t, isPullRateLimited(errors.New("Error response from daemon: toomanyrequests: You have reached your pull rate limit.")))
+	assert.True(t, isPullRateLimited(errors.New("unexpected status: 429 Too Many Requests")))
+	assert.False(t, isPullRateLimited(errors.New("manifest for clickhouse/clickhouse-server:1.1 not found")))
+	assert.False(t, isPullRateLimited(nil))
+}
+
+func TestIsManifestUnknown(t *testing.T) {
+	assert.True(t, isManifestUnknown(errors.New("Error response from daemon: manifest for clickhouse/clickhouse-server@sha256:f321ba not found: manifest unknown: manifest unknown")))
+	assert.True(t, isManifestUnknown(errors.New("manifest unknown")))
+	assert.False(t, isManifestUnknown(errors.New("Error response from daemon: toomanyrequests: You have reached your pull rate limit.")))
+	assert.False(t, isManifestUnknown(errors.New("dial tcp: lookup registry-1.docker.io: i/o timeout")))
+	assert.False(t, isManifestUnknown(nil))
+}
+
+func TestIsTransientPullError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{err: errors.New("Error response from daemon: Get \"https://registry-1.docker.io/v2/\": net/http: TLS handshake timeout"), transient: true},
+		{err: errors.New("Error response from daemon: received unexpected HTTP status: 503 Service Unavailable"), transient: true},
+		{err: errors.New("failed to read pull output: unexpected EOF"), transient: true},
+		{err: errors.Wrap(errPullTimedOut, "pull has not finished within 3m0s"), transient: true},
+		{err: errors.New("Error response from daemon: manifest for clickhouse/clickhouse-server:1.1 not found: manifest unknown")},
+		{err: errors.New("Error response from daemon: pull access denied for private/image, repository does not exist")},
+		{err: errors.New("unauthorized: authentication required")},
+		{err: errors.New("toomanyrequests: You have reached your pull rate limit.")},
+		{err: errors.New("invalid reference format")},
+		{err: nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		name := "nil"
+		if tt.err != nil {
+			name = tt.err.Error()
+		}
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.transient, isTransientPullError(tt.err))
+		})
+	}
+}
+
+// pullDaemon answers image pulls with the queued responses, the last one is repeated.
+type pullDaemon struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter)
+	pulls     int
+}
+
+func (d *pullDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/images/create") {
+		http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+		return
+	}
+
+	d.mu.Lock()
+	respond := d.responses[min(d.pulls, len(d.responses)-1)]
+	d.pulls++
+	d.mu.Unlock()
+
+	respond(w)
+}
+
+func pullFailure(status int, msg string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		http.Error(w, `{"message": "`+msg+`"}`, status)
+	}
+}
+
+func pullOutput(output string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		_, _ = w.Write([]byte(output))
+	}
+}
+
+// newTestDaemonRunner creates a runner which engine is served by the handler.
+func newTestDaemonRunner(t *testing.T, daemon http.Handler, cfg Config) *Runner {
+	srv := httptest.NewServer(daemon)
+	t.Cleanup(srv.Close)
+
+	cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+	require.NoError(t, err)
+
+	return &Runner{
+		logger:       zerolog.Nop(),
+		name:         "test",
+		cfg:          cfg,
+		engine:       &engineProvider{mainCtx: context.Background(), cli: cli},
+		pipelineMetr: metrics.NewPipelineExporter(string(qrunner.TypeDockerEngine), "TestDaemon"+time.Now().Format(time.RFC3339Nano)),
+	}
+}
+
+func TestRunner_PullUpstream(t *testing.T) {
+	const pulled = `{"status":"Status: Downloaded newer image for clickhouse/clickhouse-server:23.3"}`
+	retry := PullRetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	tests := []struct {
+		name          string
+		responses     []func(w http.ResponseWriter)
+		expectedPulls int
+		errMsg        string
+	}{
+		{
+			name:          "Pulled at once",
+			responses:     []func(w http.ResponseWriter){pullOutput(pulled)},
+			expectedPulls: 1,
+		},
+		{
+			name: "Pulled after transient failures",
+			responses: []func(w http.ResponseWriter){
+				pullFailure(http.StatusInternalServerError, "received unexpected HTTP status: 503 Service Unavailable"),
+				pullOutput(`{"errorDetail":{"message":"net/http: TLS handshake timeout"},"error":"net/http: TLS handshake timeout"}`),
+				pullOutput(pulled),
+			},
+			expectedPulls: 3,
+		},
+		{
+			name:          "Attempts exhausted",
+			responses:     []func(w http.ResponseWriter){pullFailure(http.StatusInternalServerError, "502 Bad Gateway")},
+			expectedPulls: 3,
+			errMsg:        "502 Bad Gateway",
+		},
+		{
+			name:          "Permanent failure",
+			responses:     []func(w http.ResponseWriter){pullFailure(http.StatusNotFound, "manifest unknown")},
+			expectedPulls: 1,
+			errMsg:        "manifest unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			daemon := &pullDaemon{responses: tt.responses}
+			r := newTestDaemonRunner(t, daemon, Config{PullRetry: retry})
+
+			err := r.pullUpstream(context.Background(), "clickhouse/clickhouse-server:23.3", "linux/amd64", "23.3")
+			assert.Equal(t, tt.expectedPulls, daemon.pulls)
+			if tt.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestRunner_PullUpstream_Timeout(t *testing.T) {
+	daemon := &pullDaemon{responses: []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			// The pull is stuck until the attempt is cancelled.
+			time.Sleep(200 * time.Millisecond)
+		},
+		pullOutput(`{"status":"Status: Image is up to date for clickhouse/clickhouse-server:23.3"}`),
+	}}
+	r := newTestDaemonRunner(t, daemon, Config{
+		PullRetry:   PullRetryConfig{MaxAttempts: 2, InitialDelay: time.Millisecond},
+		PullTimeout: 50 * time.Millisecond,
+	})
+
+	err := r.pullUpstream(context.Background(), "clickhouse/clickhouse-server:23.3", "", "23.3")
+	require.NoError(t, err)
+	assert.Equal(t, 2, daemon.pulls)
+}
@@ -0,0 +1,51 @@
+package dockerengine
+
+import (
+	"sync"
+
+	"clickhouse-playground/internal/qrunner"
+)
+
+// pullThroughputSamples is the number of recent pulls the throughput is measured by.
+const pullThroughputSamples = 10
+
+// pullThroughput keeps throughputs of recent image pulls in bytes per second.
+type pullThroughput struct {
+	mu      sync.Mutex
+	samples []float64
+	next    int
+}
+
+func (p *pullThroughput) add(bytesPerSecond float64) {
+	if bytesPerSecond <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.samples) < pullThroughputSamples {
+		p.samples = append(p.samples, bytesPerSecond)
+		return
+	}
+
+	p.samples[p.next] = bytesPerSecond
+	p.next = (p.next + 1) % pullThroughputSamples
+}
+
+// get returns the range of recent throughputs. It's nil if no pulls have been measured.
+func (p *pullThroughput) get() *qrunner.PullThroughput {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.samples) == 0 {
+		return nil
+	}
+
+	result := &qrunner.PullThroughput{Min: p.samples[0], Max: p.samples[0]}
+	for _, s := range p.samples[1:] {
+		*result = result.Merge(qrunner.PullThroughput{Min: s, Max: s})
+	}
+
+	return result
+}
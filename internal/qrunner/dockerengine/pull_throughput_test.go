@@ -0,0 +1,29 @@
+package dockerengine
+
+import (
+	"testing"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullThroughput(t *testing.T) {
+	var p pullThroughput
+	assert.Nil(t, p.get())
+
+	p.add(0)
+	assert.Nil(t, p.get())
+
+	p.add(100)
+	p.add(50)
+	require.NotNil(t, p.get())
+	assert.Equal(t, qrunner.PullThroughput{Min: 50, Max: 100}, *p.get())
+
+	// Old samples are evicted.
+	for i := 0; i < pullThroughputSamples; i++ {
+		p.add(200)
+	}
+	assert.Equal(t, qrunner.PullThroughput{Min: 200, Max: 200}, *p.get())
+}
@@ -0,0 +1,64 @@
+package dockerengine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// RegistryCredentials authenticate pulls from a private registry.
+type RegistryCredentials struct {
+	Username string
+	Password string
+
+	// Token is a bearer token sent to the registry. It's used instead of the username and the password.
+	Token string
+}
+
+// encodeRegistryAuth encodes the credentials of every registry as the daemon expects them in ImagePullOptions.
+// Hosts are normalized, so docker.io credentials are used for every spelling of Docker Hub.
+func encodeRegistryAuth(registries map[string]RegistryCredentials) (map[string]string, error) {
+	auth := make(map[string]string, len(registries))
+	for host, creds := range registries {
+		// The host is parsed as a part of a repository, so aliases of Docker Hub are normalized
+		// and a name that is not a host is left in the namespace.
+		ref, err := qrunner.ParseRepositoryRef(host + "/auth/probe")
+		if err != nil || ref.Namespace != "auth" {
+			return nil, errors.Errorf("invalid registry host '%s'", host)
+		}
+
+		config := types.AuthConfig{
+			Username:      creds.Username,
+			Password:      creds.Password,
+			RegistryToken: creds.Token,
+			ServerAddress: ref.Registry,
+		}
+		serialized, err := json.Marshal(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to serialize credentials")
+		}
+
+		auth[ref.Registry] = base64.URLEncoding.EncodeToString(serialized)
+	}
+
+	return auth, nil
+}
+
+// registryAuth returns the encoded credentials of the registry the image is pulled from.
+// It's empty if the registry has no credentials, so the image is pulled anonymously.
+func (p *engineProvider) registryAuth(image string) string {
+	if len(p.auth) == 0 {
+		return ""
+	}
+
+	ref, err := qrunner.ParseImageRepository(image)
+	if err != nil {
+		return ""
+	}
+
+	return p.auth[ref.Registry]
+}
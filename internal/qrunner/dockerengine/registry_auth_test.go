@@ -0,0 +1,42 @@
+package dockerengine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeRegistryAuth(t *testing.T) {
+	auth, err := encodeRegistryAuth(map[string]RegistryCredentials{
+		"GHCR.io":              {Token: "t0ken"},
+		"registry-1.docker.io": {Username: "user", Password: "pass"},
+	})
+	require.NoError(t, err)
+	require.Len(t, auth, 2)
+
+	decode := func(s string) types.AuthConfig {
+		raw, err := base64.URLEncoding.DecodeString(s)
+		require.NoError(t, err)
+
+		var config types.AuthConfig
+		require.NoError(t, json.Unmarshal(raw, &config))
+
+		return config
+	}
+
+	require.Equal(t, types.AuthConfig{RegistryToken: "t0ken", ServerAddress: "ghcr.io"}, decode(auth["ghcr.io"]))
+	require.Equal(t, types.AuthConfig{Username: "user", Password: "pass", ServerAddress: "docker.io"}, decode(auth["docker.io"]))
+
+	p := &engineProvider{auth: auth}
+	require.Equal(t, auth["ghcr.io"], p.registryAuth("ghcr.io/clickhouse/clickhouse-server:23.3"))
+	require.Equal(t, auth["docker.io"], p.registryAuth("clickhouse/clickhouse-server@sha256:abc"))
+	require.Empty(t, p.registryAuth("quay.io/clickhouse/clickhouse-server:23.3"))
+}
+
+func TestEncodeRegistryAuth_InvalidHost(t *testing.T) {
+	_, err := encodeRegistryAuth(map[string]RegistryCredentials{"myregistry": {Token: "t0ken"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,248 @@
+package dockerengine
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// containerFailureClass is the cause of a failure to create or start a container, told by the Docker error.
+type containerFailureClass string
+
+const (
+	failureDisk              containerFailureClass = "disk"
+	failureMemory            containerFailureClass = "memory"
+	failureTooManyContainers containerFailureClass = "too_many_containers"
+	failureNameConflict      containerFailureClass = "name_conflict"
+	failureOther             containerFailureClass = "other"
+)
+
+// Steps of the container startup the failures are counted by.
+const (
+	containerStepCreate = "create"
+	containerStepStart  = "start"
+)
+
+// failureMarkers are parts of Docker error messages, the daemon passes errors of the host as text.
+var failureMarkers = []struct {
+	class   containerFailureClass
+	markers []string
+}{
+	{class: failureDisk, markers: []string{"no space left on device", "disk quota exceeded"}},
+	{class: failureMemory, markers: []string{"cannot allocate memory", "out of memory"}},
+	{class: failureTooManyContainers, markers: []string{
+		"too many open files",
+		"resource temporarily unavailable",
+		"could not find an available, non-overlapping ipv4 address pool",
+	}},
+	{class: failureNameConflict, markers: []string{"is already in use"}},
+}
+
+func classifyContainerFailure(err error) containerFailureClass {
+	msg := strings.ToLower(err.Error())
+	for _, m := range failureMarkers {
+		for _, marker := range m.markers {
+			if strings.Contains(msg, marker) {
+				return m.class
+			}
+		}
+	}
+
+	if errdefs.IsConflict(err) {
+		return failureNameConflict
+	}
+
+	return failureOther
+}
+
+// containerFailure is an error of the daemon to create or start a container, classified by its cause.
+type containerFailure struct {
+	class containerFailureClass
+	err   error
+}
+
+func (e *containerFailure) Error() string {
+	return e.err.Error()
+}
+
+func (e *containerFailure) Unwrap() error {
+	return e.err
+}
+
+func isContainerFailure(err error, class containerFailureClass) bool {
+	var failure *containerFailure
+	return errors.As(err, &failure) && failure.class == class
+}
+
+// RemediationConfig tunes remediations of container failures. Every action is rate-limited by MinInterval.
+type RemediationConfig struct {
+	// MinInterval is the minimum interval between two applications of an action.
+	MinInterval time.Duration
+
+	// The concurrency limit is reduced for ThrottlePeriod once MemoryFailureThreshold memory failures
+	// happen within MemoryFailureWindow. Runners without a concurrency limit are not throttled.
+	MemoryFailureThreshold uint
+	MemoryFailureWindow    time.Duration
+	ThrottlePeriod         time.Duration
+}
+
+// throttledConcurrencyFactor is applied to the concurrency limit of a throttled runner.
+const throttledConcurrencyFactor = 0.5
+
+// remediationsKept is the number of recent remediations reported in the status.
+const remediationsKept = 20
+
+// remediator counts container failures and applies the remediations known for their classes:
+// disk failures trigger the garbage collection, repeated memory failures throttle the runner.
+// Name conflicts are remediated by callers that can choose another name, see apply.
+type remediator struct {
+	logger zerolog.Logger
+	runner string
+	cfg    RemediationConfig
+
+	gc   *garbageCollector
+	metr *metrics.PipelineExporter
+
+	mu             sync.Mutex
+	appliedAt      map[string]time.Time
+	memoryFailures []time.Time
+	throttledUntil time.Time
+	recent         []qrunner.Remediation
+}
+
+func newRemediator(logger zerolog.Logger, runner string, cfg RemediationConfig, gc *garbageCollector, metr *metrics.PipelineExporter) *remediator {
+	return &remediator{
+		logger:    logger,
+		runner:    runner,
+		cfg:       cfg,
+		gc:        gc,
+		metr:      metr,
+		appliedAt: make(map[string]time.Time),
+	}
+}
+
+// failed classifies and counts the failure of the step, remediates it if possible and returns the classified error.
+func (m *remediator) failed(step string, err error) error {
+	class := classifyContainerFailure(err)
+	m.metr.ContainerFailure(step, string(class))
+
+	now := time.Now()
+	switch class {
+	case failureDisk:
+		if m.gc.enabled() {
+			m.apply(qrunner.RemediationGC, class, "garbage collection has been triggered", now, func() {
+				m.gc.requestPass()
+			})
+		}
+
+	case failureMemory:
+		if m.memoryFailed(now) {
+			until := now.Add(m.cfg.ThrottlePeriod)
+			m.apply(qrunner.RemediationThrottle, class, "concurrency limit has been halved until "+until.Format(time.RFC3339), now, func() {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+
+				m.throttledUntil = until
+				m.memoryFailures = nil
+			})
+		}
+	}
+
+	return &containerFailure{class: class, err: err}
+}
+
+// memoryFailed records a memory failure and reports whether the threshold has been reached within the window.
+func (m *remediator) memoryFailed(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recent := m.memoryFailures[:0]
+	for _, at := range m.memoryFailures {
+		if now.Sub(at) < m.cfg.MemoryFailureWindow {
+			recent = append(recent, at)
+		}
+	}
+	m.memoryFailures = append(recent, now)
+
+	return uint(len(m.memoryFailures)) >= m.cfg.MemoryFailureThreshold
+}
+
+// apply runs the action unless it has been applied within MinInterval, and reports whether it has been run.
+// do may be nil if the caller applies the action itself, e.g. retries with another name.
+func (m *remediator) apply(action string, class containerFailureClass, details string, now time.Time, do func()) bool {
+	m.mu.Lock()
+	if last, ok := m.appliedAt[action]; ok && now.Sub(last) < m.cfg.MinInterval {
+		m.mu.Unlock()
+		m.logger.Debug().Str("action", action).Str("class", string(class)).Msg("remediation is rate-limited")
+
+		return false
+	}
+
+	m.appliedAt[action] = now
+	m.recent = append([]qrunner.Remediation{{
+		Action:  action,
+		Class:   string(class),
+		Details: details,
+		At:      now,
+	}}, m.recent...)
+	if len(m.recent) > remediationsKept {
+		m.recent = m.recent[:remediationsKept]
+	}
+	m.mu.Unlock()
+
+	if do != nil {
+		do()
+	}
+
+	m.metr.Remediation(action)
+	m.logger.Warn().Str("action", action).Str("class", string(class)).Str("details", details).
+		Msg("container failure has been remediated")
+
+	return true
+}
+
+func (m *remediator) concurrencyFactor(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Before(m.throttledUntil) {
+		return throttledConcurrencyFactor
+	}
+
+	return 1
+}
+
+func (m *remediator) status(now time.Time) qrunner.RemediationStatus {
+	factor := m.concurrencyFactor(now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := qrunner.RemediationStatus{
+		Runner:            m.runner,
+		ConcurrencyFactor: factor,
+		Recent:            append([]qrunner.Remediation(nil), m.recent...),
+	}
+	if factor < 1 {
+		status.ThrottledUntil = m.throttledUntil
+	}
+
+	return status
+}
+
+// ConcurrencyFactor scales the concurrency limit of the runner, it's reduced after repeated memory failures.
+func (r *Runner) ConcurrencyFactor() float64 {
+	return r.remediator.concurrencyFactor(time.Now())
+}
+
+// RemediationStatus returns recent remediations of container failures.
+func (r *Runner) RemediationStatus() qrunner.RemediationStatus {
+	return r.remediator.status(time.Now())
+}
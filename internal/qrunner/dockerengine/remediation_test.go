@@ -0,0 +1,105 @@
+package dockerengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyContainerFailure(t *testing.T) {
+	tests := []struct {
+		err  string
+		want containerFailureClass
+	}{
+		{
+			err:  "Error response from daemon: mkdir /var/lib/docker/overlay2/1f2e: no space left on device",
+			want: failureDisk,
+		},
+		{
+			err:  "Error response from daemon: failed to create shim task: OCI runtime create failed: fork/exec /usr/bin/runc: cannot allocate memory",
+			want: failureMemory,
+		},
+		{
+			err:  "Error response from daemon: could not find an available, non-overlapping IPv4 address pool among the defaults to assign to the network",
+			want: failureTooManyContainers,
+		},
+		{
+			err:  `Error response from daemon: Conflict. The container name "/chp-egress-1-proxy" is already in use by container "3f1c"`,
+			want: failureNameConflict,
+		},
+		{
+			err:  "Error response from daemon: No such image: chp:23.3",
+			want: failureOther,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.want), func(t *testing.T) {
+			assert.Equal(t, tt.want, classifyContainerFailure(errors.New(tt.err)))
+		})
+	}
+}
+
+func newTestRemediator(cfg RemediationConfig, gc *GCConfig) *remediator {
+	metr := metrics.NewPipelineExporter(string(qrunner.TypeDockerEngine), "TestRemediator"+time.Now().Format(time.RFC3339Nano))
+	collector := newGarbageCollector(context.Background(), zerolog.Nop(), "test", gc, nil, nil, nil, nil, nil)
+
+	return newRemediator(zerolog.Nop(), "test", cfg, collector, metr)
+}
+
+func TestRemediator_DiskFailure(t *testing.T) {
+	m := newTestRemediator(RemediationConfig{MinInterval: time.Minute}, &GCConfig{})
+
+	err := m.failed(containerStepCreate, errors.New("no space left on device"))
+	assert.True(t, isContainerFailure(errors.Wrap(err, "container cannot be created"), failureDisk))
+	assert.Len(t, m.gc.kick, 1, "gc pass must be requested")
+
+	<-m.gc.kick
+	_ = m.failed(containerStepCreate, errors.New("no space left on device"))
+	assert.Len(t, m.gc.kick, 0, "remediations are rate-limited")
+
+	status := m.status(time.Now())
+	require.Len(t, status.Recent, 1)
+	assert.Equal(t, qrunner.RemediationGC, status.Recent[0].Action)
+	assert.Equal(t, string(failureDisk), status.Recent[0].Class)
+}
+
+func TestRemediator_MemoryFailures(t *testing.T) {
+	m := newTestRemediator(RemediationConfig{
+		MinInterval:            time.Minute,
+		MemoryFailureThreshold: 2,
+		MemoryFailureWindow:    time.Minute,
+		ThrottlePeriod:         time.Hour,
+	}, nil)
+
+	now := time.Now()
+	_ = m.failed(containerStepStart, errors.New("cannot allocate memory"))
+	assert.Equal(t, float64(1), m.concurrencyFactor(now), "a single failure does not throttle the runner")
+
+	_ = m.failed(containerStepStart, errors.New("cannot allocate memory"))
+	assert.Equal(t, throttledConcurrencyFactor, m.concurrencyFactor(now))
+	assert.Equal(t, float64(1), m.concurrencyFactor(now.Add(2*time.Hour)), "throttling expires")
+
+	status := m.status(now)
+	assert.False(t, status.ThrottledUntil.IsZero())
+	require.Len(t, status.Recent, 1)
+	assert.Equal(t, qrunner.RemediationThrottle, status.Recent[0].Action)
+}
+
+func TestRemediator_MemoryFailureWindow(t *testing.T) {
+	m := newTestRemediator(RemediationConfig{MemoryFailureThreshold: 2, MemoryFailureWindow: time.Minute}, nil)
+
+	now := time.Now()
+	assert.False(t, m.memoryFailed(now.Add(-2*time.Minute)))
+	assert.False(t, m.memoryFailed(now), "failures out of the window are not counted")
+	assert.True(t, m.memoryFailed(now.Add(time.Second)))
+}
@@ -0,0 +1,199 @@
+package dockerengine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type reservation struct {
+	token       string
+	clientID    string
+	imageFQN    string
+	containerID string
+	expiresAt   time.Time
+}
+
+// reservations keeps containers started in advance for specific clients.
+// Unused reservations are removed after the TTL.
+type reservations struct {
+	ctx    context.Context
+	logger zerolog.Logger
+	cfg    ReservationConfig
+	engine *engineProvider
+
+	lock     sync.Mutex
+	byToken  map[string]*reservation
+	byClient map[string]uint
+	// pending is the number of reservations that are being prepared at the moment.
+	pending uint
+}
+
+func newReservations(ctx context.Context, logger zerolog.Logger, cfg ReservationConfig, engine *engineProvider) *reservations {
+	return &reservations{
+		ctx:      ctx,
+		logger:   logger,
+		cfg:      cfg,
+		engine:   engine,
+		byToken:  make(map[string]*reservation),
+		byClient: make(map[string]uint),
+	}
+}
+
+func (r *reservations) enabled() bool {
+	return r.cfg.MaxReservations > 0 && r.cfg.TTL > 0
+}
+
+// acquireSlot checks the limits and takes a reservation slot for the client.
+// The slot must be released with releaseSlot if the container cannot be prepared.
+func (r *reservations) acquireSlot(clientID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if uint(len(r.byToken))+r.pending >= r.cfg.MaxReservations {
+		return qrunner.ErrReservationLimitExceeded
+	}
+	if r.cfg.MaxReservationsPerClient > 0 && r.byClient[clientID] >= r.cfg.MaxReservationsPerClient {
+		return qrunner.ErrReservationLimitExceeded
+	}
+
+	r.pending++
+	r.byClient[clientID]++
+
+	return nil
+}
+
+func (r *reservations) releaseSlot(clientID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pending--
+	r.decClientUnderLock(clientID)
+}
+
+// add saves a prepared container. The slot must be acquired in advance.
+func (r *reservations) add(clientID, imageFQN, containerID string) qrunner.Reservation {
+	res := &reservation{
+		token:       uuid.New().String(),
+		clientID:    clientID,
+		imageFQN:    imageFQN,
+		containerID: containerID,
+		expiresAt:   time.Now().Add(r.cfg.TTL),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pending--
+	r.byToken[res.token] = res
+
+	return qrunner.Reservation{
+		Token:     res.token,
+		ExpiresAt: res.expiresAt,
+	}
+}
+
+// claim extracts a reserved container for the image.
+// The reservation is consumed only if it has been made by the same client for the same image,
+// so a leaked token cannot be used to take a container prepared for another client.
+func (r *reservations) claim(token, clientID, imageFQN string) (containerID string, found bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res, found := r.byToken[token]
+	if !found || res.clientID != clientID || res.imageFQN != imageFQN || time.Now().After(res.expiresAt) {
+		return "", false
+	}
+
+	r.removeUnderLock(res)
+
+	return res.containerID, true
+}
+
+func (r *reservations) removeUnderLock(res *reservation) {
+	delete(r.byToken, res.token)
+	r.decClientUnderLock(res.clientID)
+}
+
+func (r *reservations) decClientUnderLock(clientID string) {
+	r.byClient[clientID]--
+	if r.byClient[clientID] == 0 {
+		delete(r.byClient, clientID)
+	}
+}
+
+// extractExpired removes expired reservations from the set and returns them.
+// If all is true, every reservation is extracted.
+func (r *reservations) extractExpired(all bool) []*reservation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var expired []*reservation
+	for _, res := range r.byToken {
+		if all || time.Now().After(res.expiresAt) {
+			expired = append(expired, res)
+		}
+	}
+
+	for _, res := range expired {
+		r.removeUnderLock(res)
+	}
+
+	return expired
+}
+
+// reconcile drops reservations whose containers do not exist anymore.
+func (r *reservations) reconcile(existing map[string]struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, res := range r.byToken {
+		if _, found := existing[res.containerID]; !found {
+			r.removeUnderLock(res)
+		}
+	}
+}
+
+func (r *reservations) removeContainers(ctx context.Context, list []*reservation) {
+	for _, res := range list {
+		err := r.engine.removeContainer(ctx, res.containerID)
+		if err != nil {
+			r.logger.Err(err).Str("container_id", res.containerID).Msg("failed to remove reserved container")
+			continue
+		}
+
+		r.logger.Debug().Str("container_id", res.containerID).Msg("reserved container has been removed")
+	}
+}
+
+// start reaps expired reservations until the context is cancelled.
+func (r *reservations) start() {
+	if !r.enabled() {
+		r.logger.Info().Msg("container reservations are disabled")
+		return
+	}
+
+	t := time.NewTicker(r.cfg.TTL / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+
+		case <-t.C:
+		}
+
+		r.removeContainers(r.ctx, r.extractExpired(false))
+	}
+}
+
+// stop removes all reserved containers.
+func (r *reservations) stop(shutdownCtx context.Context) {
+	r.removeContainers(shutdownCtx, r.extractExpired(true))
+}
@@ -0,0 +1,32 @@
+package dockerengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservations_Claim(t *testing.T) {
+	r := newReservations(context.Background(), zerolog.Nop(), ReservationConfig{TTL: time.Minute, MaxReservations: 2}, nil)
+
+	require.NoError(t, r.acquireSlot("203.0.113.7"))
+	res := r.add("203.0.113.7", "chp-clickhouse:23.3", "container-1")
+
+	_, found := r.claim(res.Token, "203.0.113.8", "chp-clickhouse:23.3")
+	assert.False(t, found, "another client cannot claim the reservation")
+
+	_, found = r.claim(res.Token, "203.0.113.7", "chp-clickhouse:23.8")
+	assert.False(t, found, "the reservation is made for another image")
+
+	containerID, found := r.claim(res.Token, "203.0.113.7", "chp-clickhouse:23.3")
+	require.True(t, found)
+	assert.Equal(t, "container-1", containerID)
+
+	_, found = r.claim(res.Token, "203.0.113.7", "chp-clickhouse:23.3")
+	assert.False(t, found, "the reservation is consumed")
+	assert.Empty(t, r.byClient)
+}
@@ -0,0 +1,116 @@
+package dockerengine
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RestrictedProfileName is the name of the ClickHouse settings profile applied in restricted mode.
+const RestrictedProfileName = "restricted"
+
+const (
+	restrictedProfileDir  = "/etc/clickhouse-server/users.d"
+	restrictedProfileFile = "restricted-profile.xml"
+)
+
+// RestrictedProfile makes ClickHouse itself reject modifications and limit resources of queries.
+// The profile is generated by the runner and assigned to the default user of every container.
+type RestrictedProfile struct {
+	// If 0, the execution time is unlimited.
+	MaxExecutionTime time.Duration
+
+	// In bytes. If 0, the memory usage is limited only by the container.
+	MaxMemoryUsage uint64
+
+	// If 0, the number of result rows is unlimited.
+	MaxResultRows uint64
+}
+
+var DefaultRestrictedProfile = RestrictedProfile{
+	MaxExecutionTime: 30 * time.Second,
+	MaxMemoryUsage:   512 * 1024 * 1024,
+	MaxResultRows:    100000,
+}
+
+// render generates a users.d config. readonly=2 allows changing settings but not data,
+// so the limits are additionally protected by constraints.
+func (p RestrictedProfile) render() []byte {
+	limits := []struct {
+		name  string
+		value uint64
+	}{
+		{name: "max_execution_time", value: uint64(math.Ceil(p.MaxExecutionTime.Seconds()))},
+		{name: "max_memory_usage", value: p.MaxMemoryUsage},
+		{name: "max_result_rows", value: p.MaxResultRows},
+	}
+
+	var settings, constraints strings.Builder
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&settings, "            <%s>%d</%s>\n", l.name, l.value, l.name)
+		fmt.Fprintf(&constraints, "                <%s>\n                    <max>%d</max>\n                </%s>\n", l.name, l.value, l.name)
+	}
+
+	var b strings.Builder
+	b.WriteString("<clickhouse>\n")
+	b.WriteString("    <profiles>\n")
+	fmt.Fprintf(&b, "        <%s>\n", RestrictedProfileName)
+	b.WriteString("            <readonly>2</readonly>\n")
+	b.WriteString(settings.String())
+	b.WriteString("            <constraints>\n")
+	b.WriteString("                <readonly>\n                    <readonly/>\n                </readonly>\n")
+	b.WriteString(constraints.String())
+	b.WriteString("            </constraints>\n")
+	fmt.Fprintf(&b, "        </%s>\n", RestrictedProfileName)
+	b.WriteString("    </profiles>\n")
+	b.WriteString("    <users>\n")
+	b.WriteString("        <default>\n")
+	fmt.Fprintf(&b, "            <profile replace=\"replace\">%s</profile>\n", RestrictedProfileName)
+	b.WriteString("        </default>\n")
+	b.WriteString("    </users>\n")
+	b.WriteString("</clickhouse>\n")
+
+	return []byte(b.String())
+}
+
+// archive packs the rendered profile into a tar archive to copy it to a container.
+// Copying works for remote daemons as well, unlike bind mounts of local files.
+func (p RestrictedProfile) archive() (*bytes.Buffer, error) {
+	return fileArchive(restrictedProfileFile, p.render())
+}
+
+// fileArchive packs a single file into a tar archive, so it can be copied to a container.
+func fileArchive(name string, content []byte) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0o644,
+		Size: int64(len(content)),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write tar header")
+	}
+
+	_, err = tw.Write(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write file")
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to close tar")
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,58 @@
+package dockerengine
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestrictedProfileRender(t *testing.T) {
+	profile := RestrictedProfile{
+		MaxExecutionTime: 1500 * time.Millisecond,
+		MaxMemoryUsage:   1024,
+	}
+
+	rendered := profile.render()
+
+	var parsed struct {
+		Profile struct {
+			Readonly         int    `xml:"readonly"`
+			MaxExecutionTime uint64 `xml:"max_execution_time"`
+			MaxMemoryUsage   uint64 `xml:"max_memory_usage"`
+			MaxResultRows    *int   `xml:"max_result_rows"`
+			Constraints      struct {
+				MaxExecutionTime uint64 `xml:"max_execution_time>max"`
+				MaxMemoryUsage   uint64 `xml:"max_memory_usage>max"`
+			} `xml:"constraints"`
+		} `xml:"profiles>restricted"`
+		DefaultProfile string `xml:"users>default>profile"`
+	}
+	require.NoError(t, xml.Unmarshal(rendered, &parsed))
+
+	assert.Equal(t, 2, parsed.Profile.Readonly)
+	assert.EqualValues(t, 2, parsed.Profile.MaxExecutionTime)
+	assert.EqualValues(t, 1024, parsed.Profile.MaxMemoryUsage)
+	assert.Nil(t, parsed.Profile.MaxResultRows)
+	assert.EqualValues(t, 2, parsed.Profile.Constraints.MaxExecutionTime)
+	assert.EqualValues(t, 1024, parsed.Profile.Constraints.MaxMemoryUsage)
+	assert.Equal(t, RestrictedProfileName, parsed.DefaultProfile)
+}
+
+func TestRestrictedProfileArchive(t *testing.T) {
+	buf, err := DefaultRestrictedProfile.archive()
+	require.NoError(t, err)
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, restrictedProfileFile, hdr.Name)
+
+	content, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRestrictedProfile.render(), content)
+}
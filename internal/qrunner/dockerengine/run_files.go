@@ -0,0 +1,72 @@
+package dockerengine
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"path"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// userFilesDir is the directory file() and INFILE read files from, relative to the data directory.
+const userFilesDir = "user_files"
+
+// copyRunFiles places the files of the run into the user files directory of the server. They are copied
+// instead of being bind-mounted, so it works for remote daemons and prewarmed containers as well,
+// and the files are removed together with the container.
+func (r *Runner) copyRunFiles(ctx context.Context, containerID string, files []queryrun.File) error {
+	archive, err := runFilesArchive(files)
+	if err != nil {
+		return errors.Wrap(err, "files archive cannot be built")
+	}
+
+	return r.engine.copyToContainer(ctx, containerID, clickhouseDataDir, archive)
+}
+
+// runFilesArchive packs the files into the user files directory. The files are owned by root and read-only,
+// while the server runs as a non-root user, so queries cannot modify them.
+func runFilesArchive(files []queryrun.File) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     userFilesDir + "/",
+		Mode:     0o755,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write tar header")
+	}
+
+	for _, f := range files {
+		// Names are checked by the API already, it's the last line of defence against path traversal.
+		err = queryrun.CheckFileName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name: path.Join(userFilesDir, f.Name),
+			Mode: 0o444,
+			Size: int64(len(f.Content)),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to write tar header")
+		}
+
+		_, err = tw.Write(f.Content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to write file %s", f.Name)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to close tar")
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,44 @@
+package dockerengine
+
+import (
+	"archive/tar"
+	"io"
+	"testing"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunFilesArchive(t *testing.T) {
+	buf, err := runFilesArchive([]queryrun.File{
+		{Name: "data.csv", Content: []byte("1,a\n2,b\n")},
+		{Name: "empty.tsv"},
+	})
+	require.NoError(t, err)
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "user_files/", hdr.Name)
+	assert.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+
+	contents := make(map[string]string)
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.EqualValues(t, 0o444, hdr.Mode)
+
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(content)
+	}
+	assert.Equal(t, map[string]string{"user_files/data.csv": "1,a\n2,b\n", "user_files/empty.tsv": ""}, contents)
+
+	_, err = runFilesArchive([]queryrun.File{{Name: "../config.xml"}})
+	assert.Error(t, err)
+}
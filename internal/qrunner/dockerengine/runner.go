@@ -5,8 +5,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"path"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"clickhouse-playground/internal/database"
@@ -15,7 +17,9 @@ import (
 	"clickhouse-playground/internal/metrics"
 	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/pkg/chsemver"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	dockercli "github.com/docker/docker/client"
@@ -28,6 +32,12 @@ type ImageStorage interface {
 	Find(version string) (dockertag.Image, bool)
 }
 
+// startupPingTimeout bounds the check of the daemon connection on start.
+const startupPingTimeout = 10 * time.Second
+
+// removalGrace is how long the container of a run is kept after the run context is done, while the run is finishing.
+const removalGrace = 5 * time.Second
+
 // Runner is a runner that creates database instances using Docker Engine API.
 //
 // This runner can start instances on arbitrary type of server, even on the same server where the coordinator
@@ -36,6 +46,9 @@ type Runner struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// cleanupCtx survives the stop of the runner, so containers of finished runs are removed during shutdown.
+	cleanupCtx context.Context
+
 	logger zerolog.Logger
 
 	name string
@@ -45,17 +58,60 @@ type Runner struct {
 	tagStorage   ImageStorage
 	pipelineMetr *metrics.PipelineExporter
 
-	workers   sync.WaitGroup
-	gc        *garbageCollector
-	status    *statusCollector
-	prewarmer *prewarmer
+	tasks        *qrunner.TaskGroup
+	gc           *garbageCollector
+	status       *statusCollector
+	prewarmer    *prewarmer
+	reservations *reservations
+	sessions     *openSessions
+	drain        *runDrain
+	supervisor   *connectionSupervisor
+	active       *activeContainers
+	pulls        *pullThroughput
+	held         *heldContainers
+	imageUsage   *imageUsage
+	mirrors      mirrors
+	warmPool     warmPoolState
+	remediator   *remediator
+	hostArch     hostArchitecture
+
+	isolationNetwork isolationNetwork
 }
 
 func New(ctx context.Context, logger zerolog.Logger, name string, cfg Config, tagStorage ImageStorage) (*Runner, error) {
-	engine, err := newProvider(ctx, cfg.DaemonURL)
+	err := validateCommandTemplates(cfg.CommandTemplates)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid command templates")
+	}
+
+	err = validateToolTemplates(cfg.Tools)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tools")
+	}
+
+	err = validateEgress(cfg.Egress)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid egress config")
+	}
+
+	err = validateIsolation(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid isolation config")
+	}
+
+	mirrors, err := newMirrors(cfg.Mirrors)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid mirrors")
+	}
+
+	engine, err := newProvider(ctx, cfg.DaemonURL, cfg.DaemonTLS)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create Docker engine provider")
 	}
+	engine.auth, err = encodeRegistryAuth(cfg.Registries)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid registry credentials")
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -64,17 +120,30 @@ func New(ctx context.Context, logger zerolog.Logger, name string, cfg Config, ta
 	runner := &Runner{
 		ctx:          ctx,
 		cancel:       cancel,
+		cleanupCtx:   context.WithoutCancel(ctx),
 		logger:       logger,
 		name:         name,
 		cfg:          cfg,
 		engine:       engine,
 		tagStorage:   tagStorage,
 		pipelineMetr: metrics.NewPipelineExporter(string(qrunner.TypeDockerEngine), name),
+		active:       newActiveContainers(),
+		pulls:        &pullThroughput{},
+		held:         newHeldContainers(),
+		imageUsage:   newImageUsage(),
+		sessions:     newOpenSessions(),
+		drain:        newRunDrain(),
+		mirrors:      mirrors,
+		tasks:        qrunner.NewTaskGroup(logger, name),
 	}
 
-	runner.gc = newGarbageCollector(ctx, logger, cfg.GC, engine, metrics.NewRunnerGCExporter(string(qrunner.TypeDockerEngine), name))
-	runner.status = newStatusCollector(ctx, logger, cfg.StatusCollectionFrequency, engine, metrics.NewRunnerStatusExporter(string(qrunner.TypeDockerEngine), name))
-	runner.prewarmer = newPrewarmer(ctx, logger, runner, runner.engine, cfg.MaxWarmContainers)
+	runner.gc = newGarbageCollector(ctx, logger, name, cfg.GC, engine, runner.held, runner.active, runner.imageUsage, metrics.NewRunnerGCExporter(string(qrunner.TypeDockerEngine), name))
+	runner.remediator = newRemediator(logger, name, cfg.Remediation, runner.gc, runner.pipelineMetr)
+	statusMetr := metrics.NewRunnerStatusExporter(string(qrunner.TypeDockerEngine), name)
+	runner.status = newStatusCollector(ctx, logger, cfg.StatusCollectionFrequency, engine, statusMetr)
+	runner.supervisor = newConnectionSupervisor(ctx, logger, engine, statusMetr, runner.reconcile)
+	runner.prewarmer = newPrewarmer(ctx, logger, name, runner, runner.engine, runner.tasks, cfg.MaxWarmContainers, cfg.WarmPool.IdleTTL)
+	runner.reservations = newReservations(ctx, logger, cfg.Reservation, engine)
 
 	return runner, nil
 }
@@ -88,7 +157,15 @@ func (r *Runner) Name() string {
 }
 
 func (r *Runner) Status(ctx context.Context) qrunner.RunnerStatus {
+	if !r.supervisor.isConnected() {
+		return qrunner.RunnerStatus{
+			Alive:            false,
+			LivenessProbeErr: qrunner.ErrRunnerDisconnected,
+		}
+	}
+
 	err := r.engine.ping(ctx)
+	r.supervisor.report(err)
 
 	return qrunner.RunnerStatus{
 		Alive:            err == nil,
@@ -98,25 +175,36 @@ func (r *Runner) Status(ctx context.Context) qrunner.RunnerStatus {
 
 // Start runs the following background tasks:
 // 1) gc -- prunes containers and images;
-// 2) status exporter -- exports information about current state of the runner.
+// 2) status exporter -- exports information about current state of the runner;
+// 3) prewarmer, reservations and the connection supervisor.
+// The daemon is pinged right away, so an unavailable daemon is reported at startup rather than by the first run.
+// A reachable daemon older than MinAPIVersion fails the start.
+// All background work of the runner, including removals of containers of finished runs, is tracked by its tasks.
 func (r *Runner) Start() error {
-	r.workers.Add(1)
-	go func() {
-		defer r.workers.Done()
-		r.gc.start()
-	}()
+	pingCtx, cancel := context.WithTimeout(r.ctx, startupPingTimeout)
+	defer cancel()
 
-	r.workers.Add(1)
-	go func() {
-		defer r.workers.Done()
-		r.status.start()
-	}()
+	err := r.engine.ping(pingCtx)
+	if err == nil {
+		err = r.engine.checkAPIVersion(pingCtx)
+		if err != nil {
+			return err
+		}
+	}
 
-	r.workers.Add(1)
-	go func() {
-		defer r.workers.Done()
+	r.tasks.Go("gc", r.gc.start)
+	r.tasks.Go("status", r.status.start)
+	r.tasks.Go("prewarmer", func() {
 		r.prewarmer.Start()
-	}()
+	})
+	r.tasks.Go("reservations", r.reservations.start)
+	r.tasks.Go("supervisor", r.supervisor.start)
+
+	if err != nil {
+		// The runner stays disconnected until the supervisor reconnects, so runs are not routed to it.
+		r.logger.Error().Err(err).Msg("Docker daemon is not available")
+		r.supervisor.report(err)
+	}
 
 	logCtx := r.logger.Info()
 	if r.cfg.DaemonURL != nil {
@@ -130,74 +218,291 @@ func (r *Runner) Start() error {
 func (r *Runner) Stop(shutdownCtx context.Context) error {
 	r.logger.Info().Msg("stopping")
 
+	// Runs in progress are finished first, so their containers are removed as usual.
+	err := r.drain.wait(shutdownCtx)
+	if err != nil {
+		r.logger.Error().Err(err).Msg("runs in progress have not been drained")
+	}
+
 	r.prewarmer.Stop(shutdownCtx)
+	r.reservations.stop(shutdownCtx)
+	r.sessions.closeAll(shutdownCtx)
 
 	r.cancel()
-	r.workers.Wait()
+	err = r.tasks.Wait(shutdownCtx)
+	if err != nil {
+		return err
+	}
 
 	r.logger.Info().Msg("runner has been stopped")
 
 	return nil
 }
 
-func (r *Runner) RunQuery(ctx context.Context, run *queryrun.Run) (output string, err error) {
+func (r *Runner) RunQuery(ctx context.Context, run *queryrun.Run) (res qrunner.Result, err error) {
+	if !r.supervisor.isConnected() {
+		return qrunner.Result{}, qrunner.ErrRunnerDisconnected
+	}
+	if !r.drain.enter() {
+		return qrunner.Result{}, errors.Wrap(qrunner.ErrRunnerDisconnected, "runner is stopping")
+	}
+	defer r.drain.leave()
+
+	defer func() {
+		err = r.classifyError(err)
+	}()
+
+	if run.Tool != "" {
+		return r.runTool(ctx, run)
+	}
+
 	state := &requestState{
-		runID:    run.ID,
-		database: run.Database,
-		version:  run.Version,
-		query:    run.Input,
-		settings: run.Settings,
+		runID:           run.ID,
+		database:        run.Database,
+		version:         run.Version,
+		query:           run.Input,
+		statements:      run.Statements,
+		continueOnError: run.ContinueOnError,
+		outputStream:    run.OutputStream,
+		settings:        run.Settings,
+		networkDisabled: run.Network == queryrun.NetworkNone,
+		clientID:        run.ClientID,
+		timeline:        run.Timeline,
+		deadlines:       run.Deadlines,
+		resources:       run.Resources,
 	}
 
-	state.imageTag, state.imageFQN, err = r.constructImageFQN(state.version)
+	err = r.resolveImage(ctx, run, state)
 	if err != nil {
-		return "", fmt.Errorf("failed to construct FQN: %w", err)
+		return qrunner.Result{}, fmt.Errorf("failed to construct FQN: %w", err)
 	}
 
-	containerID, found, err := r.prewarmer.Fetch(state.imageFQN)
-	if err != nil {
-		r.logger.Err(err).Str("run_id", state.runID).Msg("failed to fetch a prewarmed container")
+	// Warm and reserved containers have the network and the limits of the deployment,
+	// so they cannot be used by isolated runs and runs overriding the limits.
+	shared := (!state.networkDisabled || r.networkMode() == networkModeNone) && state.resources == nil
+
+	var containerID string
+	var found bool
+	if shared && run.PreparationToken != "" {
+		containerID, found = r.reservations.claim(run.PreparationToken, run.ClientID, state.imageFQN)
+		r.logger.Debug().Str("run_id", state.runID).Bool("found", found).Msg("reserved container has been requested")
+	}
+	if shared && !found {
+		containerID, found, err = r.prewarmer.Fetch(state.imageFQN)
+		if err != nil {
+			r.logger.Err(err).Str("run_id", state.runID).Msg("failed to fetch a prewarmed container")
+		}
 	}
 	if found {
 		state.containerID = containerID
 	} else {
 		err := r.createContainer(ctx, state)
 		if err != nil {
-			return "", fmt.Errorf("failed to create container: %w", err)
+			return qrunner.Result{}, fmt.Errorf("failed to create container: %w", err)
 		}
 	}
+	state.emulatedArch = r.detectEmulation(ctx, state)
+
+	r.active.add(state.runID, state.containerID)
+	defer r.active.remove(state.runID)
 
 	r.prewarmer.PushNewRequest(*state)
 
 	done := make(chan struct{})
-	defer close(done)
+	defer func() {
+		r.captureOnFailure(run, state, err)
+		state.held = r.shouldHold(run, err)
+		close(done)
+	}()
 
-	go func() {
+	// The container is removed when the run is finished or its context is done. A failed run is given
+	// removalGrace after the deadline to finish, so it can be captured or held before the removal.
+	// A run stuck in an engine call does not keep the container longer.
+	r.tasks.Go("container-removal", func() {
+		finished := true
 		select {
-		case <-ctx.Done():
 		case <-done:
+		case <-ctx.Done():
+			select {
+			case <-done:
+			case <-time.After(removalGrace):
+				finished = false
+				r.logger.Warn().Str("run_id", state.runID).Msg("run has not finished after the deadline, its container is removed")
+			}
 		}
 
-		startedAt := time.Now()
-		defer func() {
-			r.pipelineMetr.RemoveContainer(err == nil, "", startedAt)
-		}()
+		// state.held is set only when the run has finished.
+		if finished && state.held {
+			err := r.holdContainer(r.cleanupCtx, state)
+			if err == nil {
+				return
+			}
 
-		err := r.engine.removeContainer(r.ctx, state.containerID)
-		if err != nil {
-			r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to kill container")
+			r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to hold container, it will be removed")
+		}
+
+		startedAt := time.Now()
+		removeErr := r.engine.removeContainer(r.cleanupCtx, state.containerID)
+		r.pipelineMetr.RemoveContainer(removeErr == nil, "", startedAt)
+		state.timeline.Record(queryrun.StageCleanup, startedAt)
+		if removeErr != nil {
+			r.logger.Error().Err(removeErr).Str("run_id", state.runID).Msg("failed to kill container")
 			return
 		}
 
 		r.logger.Debug().Str("container_id", state.containerID).Msg("container has been force removed")
+	})
+
+	if len(run.Files) > 0 {
+		err = r.copyRunFiles(ctx, state.containerID, run.Files)
+		if err != nil {
+			return qrunner.Result{}, daemonFailure(errors.Wrap(err, "files cannot be copied to the container"))
+		}
+	}
+
+	res, err = r.runQuery(ctx, state)
+
+	// A query exceeding the memory limit gets the server killed, so the client fails with a connection error.
+	if (err != nil || res.Stderr != "") && ctx.Err() == nil {
+		oomErr := r.checkMemoryLimit(state)
+		if oomErr != nil {
+			return qrunner.Result{}, oomErr
+		}
+	}
+	if err != nil {
+		// Neither a timed-out query nor a server that has not started tells anything about the daemon.
+		var timeoutErr *qrunner.QueryTimeoutError
+		if errors.As(err, &timeoutErr) || errors.Is(err, qrunner.ErrServerNotReady) {
+			return qrunner.Result{}, errors.Wrap(err, "failed to run query")
+		}
+
+		return qrunner.Result{}, daemonFailure(errors.Wrap(err, "failed to run query"))
+	}
+
+	// Denied requests make the query fail, so the proxy logs are checked only if there are errors.
+	if r.cfg.Egress != nil && !state.networkDisabled && state.stderr != "" {
+		run.EgressDenied, err = r.egressDenials(ctx, state.containerID)
+		if err != nil {
+			r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to collect denied egress destinations")
+		}
+		if len(run.EgressDenied) > 0 {
+			run.Warn(queryrun.WarningEgressDenied, fmt.Sprintf("egress to %s is not allowed by the deployment",
+				strings.Join(run.EgressDenied, ", ")), nil)
+		}
+	}
+
+	if r.cfg.Restricted != nil {
+		run.ExecutionProfile = RestrictedProfileName
+	}
+
+	run.ServerVersion = state.serverVersion
+	run.VersionMismatch = qrunner.IsServerVersionMismatch(state.version, state.serverVersion)
+	if run.VersionMismatch {
+		run.Warn(queryrun.WarningVersionMismatch,
+			fmt.Sprintf("the server reports version %s, which does not match the image tag %s", state.serverVersion, state.version),
+			map[string]string{"server_version": state.serverVersion})
+		r.pipelineMetr.ServerVersionMismatch(state.version)
+		r.logger.Warn().
+			Str("run_id", state.runID).
+			Str("version", state.version).
+			Str("server_version", state.serverVersion).
+			Msg("server version does not match the image tag")
+	}
+	r.reportEmulation(run, state)
+
+	return res, nil
+}
+
+// classifyError reports the error to the connection supervisor.
+// Errors caused by a lost connection to the daemon are converted into qrunner.ErrRunnerDisconnected.
+func (r *Runner) classifyError(err error) error {
+	if err == nil || !r.supervisor.report(err) {
+		return err
+	}
+
+	return daemonFailure(errors.Wrap(qrunner.ErrRunnerDisconnected, err.Error()))
+}
+
+// daemonFailure marks the error as caused by the Docker daemon, so it's counted by the daemon circuit breaker.
+func daemonFailure(err error) error {
+	var depErr *qrunner.DependencyError
+	if errors.As(err, &depErr) {
+		return err
+	}
+
+	return &qrunner.DependencyError{Dependency: qrunner.DependencyDaemon, Err: err}
+}
+
+// reconcile synchronizes the runner state with containers that exist after the daemon reconnection.
+// Containers could have been lost or left running across the daemon restart.
+func (r *Runner) reconcile() {
+	containers, err := r.engine.getContainers(r.ctx)
+	if err != nil {
+		r.logger.Err(err).Msg("failed to list containers for reconciliation")
+		return
+	}
+
+	existing := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		if c.State == "running" || c.State == "paused" {
+			existing[c.ID] = struct{}{}
+		}
+	}
+
+	r.prewarmer.reconcile(existing)
+	r.reservations.reconcile(existing)
+
+	if r.gc.enabled() {
+		// The pass is run by the gc loop, so it never overlaps with a periodic one.
+		r.gc.requestPass()
+	}
+
+	r.logger.Info().Int("containers", len(existing)).Msg("runner state has been reconciled")
+}
+
+// Prepare pulls the image if necessary and starts a container reserved for the run's client.
+func (r *Runner) Prepare(ctx context.Context, run *queryrun.Run) (res qrunner.Reservation, err error) {
+	if !r.reservations.enabled() {
+		return qrunner.Reservation{}, qrunner.ErrPreparationDisabled
+	}
+	if !r.supervisor.isConnected() {
+		return qrunner.Reservation{}, qrunner.ErrRunnerDisconnected
+	}
+	if !r.drain.enter() {
+		return qrunner.Reservation{}, errors.Wrap(qrunner.ErrRunnerDisconnected, "runner is stopping")
+	}
+	defer r.drain.leave()
+
+	defer func() {
+		err = r.classifyError(err)
 	}()
 
-	output, err = r.runQuery(ctx, state)
+	err = r.reservations.acquireSlot(run.ClientID)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to run query")
+		return qrunner.Reservation{}, err
 	}
 
-	return output, nil
+	state := &requestState{
+		runID:    run.ID,
+		database: run.Database,
+		version:  run.Version,
+		settings: run.Settings,
+		clientID: run.ClientID,
+		timeline: run.Timeline,
+	}
+
+	err = r.createContainer(ctx, state)
+	if err != nil {
+		r.reservations.releaseSlot(run.ClientID)
+		return qrunner.Reservation{}, fmt.Errorf("failed to create container: %w", err)
+	}
+
+	res = r.reservations.add(run.ClientID, state.imageFQN, state.containerID)
+
+	r.logger.Debug().Str("run_id", run.ID).Str("container_id", state.containerID).Time("expires_at", res.ExpiresAt).
+		Msg("container has been reserved")
+
+	return res, nil
 }
 
 // constructImageFQN builds image tag and FQN from version.
@@ -206,69 +511,131 @@ func (r *Runner) RunQuery(ctx context.Context, run *queryrun.Run) (output string
 // Otherwise, an image is fetched and the following names are built:
 // - image tag: image name in format <repository>:<version>
 // - image FQN: a unique fully qualified name that includes the exact version of the image
-func (r *Runner) constructImageFQN(version string) (imageTag string, imageFQN string, err error) {
-	img, found := r.tagStorage.Find(version)
-	if !found {
-		return "", "", errors.New("version not found")
+//
+// The image is the build of the version for the architecture of the runner.
+func (r *Runner) constructImageFQN(ctx context.Context, version string) (imageTag string, imageFQN string, err error) {
+	img, err := r.findBuild(ctx, version)
+	if err != nil {
+		return "", "", err
 	}
 
-	imageTag = qrunner.FullImageName(img.Repository, version)
-	imageFQN = qrunner.PlaygroundImageName(img.Repository, img.Digest)
+	repository, err := qrunner.ParseRepositoryRef(img.Repository)
+	if err != nil {
+		return "", "", errors.Wrap(err, "invalid repository")
+	}
+
+	imageTag = qrunner.FullImageName(repository, version)
+	imageFQN = qrunner.PlaygroundImageName(repository, img.Digest)
 
 	return imageTag, imageFQN, nil
 }
 
+// resolveImage sets the image names of the run. The image is resolved by the version
+// unless the run is pinned to the image it has been executed on before.
+func (r *Runner) resolveImage(ctx context.Context, run *queryrun.Run, state *requestState) (err error) {
+	if !run.PinnedImage {
+		state.imageTag, state.imageFQN, err = r.constructImageFQN(ctx, state.version)
+		return err
+	}
+
+	repository, err := qrunner.ParseRepositoryRef(run.ImageRepository)
+	if err != nil {
+		return errors.Wrap(err, "invalid repository")
+	}
+
+	state.pinned = &dockertag.Image{Repository: run.ImageRepository, Tag: run.Version, Digest: run.ImageDigest}
+	state.imageTag = qrunner.DigestImageName(repository, run.ImageDigest)
+	state.imageFQN = qrunner.PlaygroundImageName(repository, run.ImageDigest)
+
+	return nil
+}
+
 // createContainer pulls image if necessary and runs a container with a database.
-func (r *Runner) createContainer(ctx context.Context, state *requestState) error {
+func (r *Runner) createContainer(ctx context.Context, state *requestState) (err error) {
+	// Callers remove containers of successful setups only, so a container created by a failed setup
+	// is removed here. Otherwise, it would be left to the GC.
+	defer func() {
+		if err != nil && state.containerID != "" {
+			r.removeOrphan(state)
+		}
+	}()
+
 	if state.imageFQN == "" || state.imageTag == "" {
-		var err error
-		state.imageTag, state.imageFQN, err = r.constructImageFQN(state.version)
+		state.imageTag, state.imageFQN, err = r.constructImageFQN(ctx, state.version)
 		if err != nil {
 			return fmt.Errorf("failed to construct FQN: %w", err)
 		}
 	}
 
-	err := r.pull(ctx, state)
+	err = r.pull(ctx, state)
 	if err != nil {
 		return fmt.Errorf("pull failed: %w", err)
 	}
 
 	err = r.runContainer(ctx, state)
 	if err != nil {
-		return fmt.Errorf("container run failed: %w", err)
+		return daemonFailure(fmt.Errorf("container run failed: %w", err))
 	}
 
 	return err
 }
 
 // pull checks whether the requested image exists. If no, it will be downloaded and renamed to hashed-name.
+// Mirrors of the image repository are tried before the upstream registry.
 func (r *Runner) pull(ctx context.Context, state *requestState) (err error) {
 	startedAt := time.Now()
+	source := pullSourceLocal
+	defer func() {
+		state.timeline.RecordSource(queryrun.StageImagePull, startedAt, source)
+		if err == nil {
+			r.imageUsage.touch(state.imageFQN, time.Now())
+		}
+	}()
 
 	if r.checkIfImageExists(ctx, state) {
 		return nil
 	}
 
-	out, err := r.engine.pullImage(ctx, state.imageTag)
-	if err != nil {
-		r.pipelineMetr.PullNewImage(false, state.version, startedAt)
-		return errors.Wrap(err, "docker pull failed")
+	// Tags are pulled for the architecture of the runner, pinned digests refer to a single platform already.
+	var platform string
+	if state.pinned == nil {
+		img, err := r.findBuild(ctx, state.version)
+		if err != nil {
+			return err
+		}
+		platform = img.OS + "/" + img.Architecture
 	}
 
-	// We should read the output to be sure that the image has been pulled.
-	_, err = io.ReadAll(out)
+	pulledRef, mirror, fromMirror := r.pullFromMirrors(ctx, state)
+	if fromMirror {
+		source = mirror
+	} else {
+		source = pullSourceUpstream
+		pulledRef = state.imageTag
+		err = r.pullUpstream(ctx, state.imageTag, platform, state.version)
+	}
 	if err != nil {
-		r.logger.Error().Err(err).Str("image", state.imageTag).Msg("failed to read pull output")
+		r.pipelineMetr.PullNewImage(false, state.version, startedAt)
+
+		if isPullRateLimited(err) {
+			r.logger.Warn().Err(err).Str("run_id", state.runID).Str("image", state.imageTag).Msg("image pull has been rate limited")
+			return errors.Wrapf(qrunner.ErrPullRateLimited, "docker pull failed: %s", err)
+		}
+		if state.pinned != nil && isManifestUnknown(err) {
+			return errors.Wrapf(qrunner.ErrImageDigestUnavailable, "docker pull failed: %s", err)
+		}
+
+		return &qrunner.DependencyError{Dependency: qrunner.DependencyRegistry, Err: errors.Wrap(err, "docker pull failed")}
 	}
 
-	r.logger.Debug().Str("image", state.imageTag).Msg("base image has been pulled")
+	r.logger.Debug().Str("image", pulledRef).Str("source", source).Msg("base image has been pulled")
 
-	err = r.engine.addImageTag(ctx, state.imageTag, state.imageFQN)
+	err = r.engine.addImageTag(ctx, pulledRef, state.imageFQN)
 	if err != nil {
 		r.pipelineMetr.PullNewImage(false, state.version, startedAt)
 		r.logger.Error().Err(err).
 			Str("run_id", state.runID).
-			Str("source", state.imageTag).
+			Str("source", pulledRef).
 			Str("target", state.imageFQN).
 			Msg("failed to rename image")
 
@@ -276,6 +643,10 @@ func (r *Runner) pull(ctx context.Context, state *requestState) (err error) {
 	}
 
 	r.pipelineMetr.PullNewImage(true, state.version, startedAt)
+	if img, err := r.findBuild(ctx, state.version); err == nil && img.Size > 0 {
+		r.pulls.add(float64(img.Size) / time.Since(startedAt).Seconds())
+	}
+
 	r.logger.Debug().
 		Str("run_id", state.runID).
 		Dur("elapsed_ms", time.Since(startedAt)).
@@ -306,6 +677,58 @@ func (r *Runner) checkIfImageExists(ctx context.Context, state *requestState) bo
 	return false
 }
 
+// ImageState reports whether the image of the version has been pulled and the recent pull throughput.
+func (r *Runner) ImageState(ctx context.Context, version string) (qrunner.ImageState, error) {
+	present, err := r.HasImage(ctx, version)
+	if err != nil {
+		return qrunner.ImageState{}, err
+	}
+
+	return qrunner.ImageState{Present: present, Throughput: r.pulls.get()}, nil
+}
+
+// HasImage reports whether the image of the version has been pulled. It inspects the image only.
+func (r *Runner) HasImage(ctx context.Context, version string) (bool, error) {
+	_, imageFQN, err := r.constructImageFQN(ctx, version)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = r.engine.getImageByID(ctx, imageFQN)
+	switch {
+	case err == nil:
+		return true, nil
+
+	case dockercli.IsErrNotFound(err):
+		return false, nil
+
+	default:
+		return false, errors.Wrap(err, "docker inspect failed")
+	}
+}
+
+// RemoveImage removes the image pulled by the digest, e.g. when a rolling tag has moved to a new build.
+// Images used by containers cannot be removed, they are left to the garbage collector.
+func (r *Runner) RemoveImage(ctx context.Context, repository, digest string) error {
+	ref, err := qrunner.ParseRepositoryRef(repository)
+	if err != nil {
+		return errors.Wrap(err, "invalid repository")
+	}
+
+	imageFQN := qrunner.PlaygroundImageName(ref, digest)
+	_, err = r.engine.removeImage(ctx, imageFQN, true)
+	if dockercli.IsErrNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "docker image remove failed")
+	}
+
+	r.logger.Info().Str("image", imageFQN).Msg("superseded image has been removed")
+
+	return nil
+}
+
 // runContainer starts a container and returns its id.
 func (r *Runner) runContainer(ctx context.Context, state *requestState) (err error) {
 	invokedAt := time.Now()
@@ -315,22 +738,32 @@ func (r *Runner) runContainer(ctx context.Context, state *requestState) (err err
 
 	contConfig := &container.Config{
 		Image:  state.imageFQN,
-		Labels: qrunner.CreateContainerLabels(r.name, state.runID, state.version),
+		Labels: qrunner.CreateContainerLabels(r.name, state.runID, state.version, state.clientID),
+	}
+	if !state.sessionExpiresAt.IsZero() {
+		contConfig.Labels[qrunner.LabelSessionExpiresAt] = strconv.FormatInt(state.sessionExpiresAt.Unix(), 10)
 	}
 
-	var networkMode string
-	if r.cfg.Container.NetworkMode != nil {
-		networkMode = *r.cfg.Container.NetworkMode
+	hostConfig := r.hostConfig(state.resources)
+	if state.networkDisabled {
+		hostConfig.NetworkMode = networkModeNone
 	}
 
-	// Network is disabled to prevent malicious attacks and to optimize container start up.
-	hostConfig := &container.HostConfig{
-		NetworkMode: container.NetworkMode(networkMode),
-		Resources: container.Resources{
-			NanoCPUs:   int64(r.cfg.Container.CPULimit),
-			CpusetCpus: r.cfg.Container.CPUSet,
-			Memory:     int64(r.cfg.Container.MemoryLimit),
-		},
+	useEgress := r.cfg.Egress != nil && !state.networkDisabled
+	if useEgress {
+		network, err := r.setupEgress(ctx, state)
+		if err != nil {
+			return errors.Wrap(err, "egress cannot be set up")
+		}
+
+		hostConfig.NetworkMode = container.NetworkMode(network)
+		contConfig.Env = egressEnv()
+		contConfig.Labels[labelEgressNetwork] = network
+	}
+
+	err = r.prepareNetwork(ctx, hostConfig)
+	if err != nil {
+		return err
 	}
 
 	// A custom config is used to disable some ClickHouse features to speed up the startup.
@@ -355,9 +788,59 @@ func (r *Runner) runContainer(ctx context.Context, state *requestState) (err err
 
 	cont, err := r.engine.createContainer(ctx, contConfig, hostConfig)
 	if err != nil {
-		return errors.Wrap(err, "container cannot be created")
+		// The daemon creates the container even if the request has been cancelled meanwhile.
+		if ctx.Err() != nil {
+			r.removeCancelledCreation(state)
+		}
+		if useEgress {
+			rmErr := r.engine.removeEgress(r.cleanupCtx, string(hostConfig.NetworkMode))
+			if rmErr != nil {
+				r.logger.Error().Err(rmErr).Str("run_id", state.runID).Msg("failed to remove egress network")
+			}
+		}
+
+		return errors.Wrap(r.remediator.failed(containerStepCreate, err), "container cannot be created")
+	}
+	state.containerID = cont.ID
+
+	if useEgress {
+		archive, err := fileArchive(egressClientConfigFile, renderEgressClientConfig())
+		if err != nil {
+			return errors.Wrap(err, "egress proxy config cannot be generated")
+		}
+
+		err = r.engine.copyToContainer(ctx, cont.ID, egressClientConfigDir, archive)
+		if err != nil {
+			return errors.Wrap(err, "egress proxy config cannot be copied to the container")
+		}
+	}
+
+	if r.cfg.Isolation != nil && r.cfg.Isolation.DisableRemoteFunctions {
+		archive, err := fileArchive(isolationConfigFile, r.cfg.Isolation.renderConfig())
+		if err != nil {
+			return errors.Wrap(err, "isolation config cannot be generated")
+		}
+
+		err = r.engine.copyToContainer(ctx, cont.ID, isolationConfigDir, archive)
+		if err != nil {
+			return errors.Wrap(err, "isolation config cannot be copied to the container")
+		}
+	}
+
+	if r.cfg.Restricted != nil {
+		archive, err := r.cfg.Restricted.archive()
+		if err != nil {
+			return errors.Wrap(err, "restricted profile cannot be generated")
+		}
+
+		err = r.engine.copyToContainer(ctx, cont.ID, restrictedProfileDir, archive)
+		if err != nil {
+			return errors.Wrap(err, "restricted profile cannot be copied to the container")
+		}
 	}
 
+	state.timeline.Record(queryrun.StageContainerCreate, invokedAt)
+
 	createdAt := time.Now()
 	debugLogger := r.logger.Debug().
 		Str("run_id", state.runID).
@@ -367,17 +850,172 @@ func (r *Runner) runContainer(ctx context.Context, state *requestState) (err err
 
 	err = r.engine.startContainer(ctx, cont.ID)
 	if err != nil {
-		return errors.Wrap(err, "container cannot be started")
+		return errors.Wrap(r.remediator.failed(containerStepStart, err), "container cannot be started")
 	}
 
 	debugLogger.Dur("elapsed_ms", time.Since(createdAt)).Msg("container has been started")
-
-	state.containerID = cont.ID
+	state.timeline.Record(queryrun.StageContainerStart, createdAt)
 
 	return nil
 }
 
-func (r *Runner) execQuery(ctx context.Context, state *requestState) (stdout string, stderr string, err error) {
+// removeOrphan removes the container of a failed setup. The cleanup context is used,
+// since the setup may have failed because the run has been cancelled.
+func (r *Runner) removeOrphan(state *requestState) {
+	err := r.engine.removeContainer(r.cleanupCtx, state.containerID)
+	r.pipelineMetr.OrphanAvoided(err == nil)
+	if err != nil {
+		r.logger.Error().Err(err).Str("run_id", state.runID).Str("container_id", state.containerID).
+			Msg("failed to remove container of the failed setup")
+	} else {
+		r.logger.Debug().Str("run_id", state.runID).Str("container_id", state.containerID).
+			Msg("container of the failed setup has been removed")
+	}
+
+	state.containerID = ""
+}
+
+// removeCancelledCreation looks up the container of the run which creation has been cancelled, its id is unknown then.
+// The container may have not been created yet, the GC removes it in this case.
+func (r *Runner) removeCancelledCreation(state *requestState) {
+	containers, err := r.engine.getContainers(r.cleanupCtx)
+	if err != nil {
+		r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to look up container of the cancelled creation")
+		return
+	}
+
+	for _, c := range containers {
+		if c.Labels[qrunner.LabelRun] == state.runID && c.Labels[qrunner.LabelRunner] == r.name {
+			state.containerID = c.ID
+			r.removeOrphan(state)
+
+			return
+		}
+	}
+}
+
+const networkModeNone = "none"
+
+// clickhouseDataDir is the volume ClickHouse images declare for the data.
+const clickhouseDataDir = "/var/lib/clickhouse"
+
+// networkMode returns the network mode of the deployment. Restricted egress networks are created per container,
+// so they are not reported here.
+func (r *Runner) networkMode() container.NetworkMode {
+	if r.cfg.Isolation != nil {
+		return container.NetworkMode(r.cfg.Isolation.networkMode())
+	}
+	if r.cfg.Egress != nil || r.cfg.Container.NetworkMode == nil {
+		return ""
+	}
+
+	return container.NetworkMode(*r.cfg.Container.NetworkMode)
+}
+
+// prepareNetwork creates the internal network of the isolation mode if the container is going to be attached to it.
+func (r *Runner) prepareNetwork(ctx context.Context, hostConfig *container.HostConfig) error {
+	if r.cfg.Isolation == nil || r.cfg.Isolation.Mode != IsolationInternal ||
+		string(hostConfig.NetworkMode) != r.cfg.Isolation.Network {
+		return nil
+	}
+
+	err := r.isolationNetwork.ensure(ctx, r.engine, r.cfg.Isolation.Network)
+
+	return errors.Wrap(err, "isolation network cannot be set up")
+}
+
+// hostConfig returns the container settings shared by database and tool containers.
+// Overrides of the run are applied to the limits of the runner.
+func (r *Runner) hostConfig(overrides *queryrun.Resources) *container.HostConfig {
+	var networkMode string
+	if r.cfg.Container.NetworkMode != nil {
+		networkMode = *r.cfg.Container.NetworkMode
+	}
+	if r.cfg.Isolation != nil {
+		networkMode = r.cfg.Isolation.networkMode()
+	}
+
+	// Network is disabled to prevent malicious attacks and to optimize container start up.
+	return &container.HostConfig{
+		NetworkMode: container.NetworkMode(networkMode),
+		Resources:   containerResources(r.cfg.Container, overrides),
+		Mounts:      []mount.Mount{dataVolumeMount()},
+	}
+}
+
+// dataVolumeMount replaces the anonymous volume declared by ClickHouse images with a labeled one,
+// so the volume gc can find it if the container is removed without its volumes.
+func dataVolumeMount() mount.Mount {
+	return mount.Mount{
+		Type:   mount.TypeVolume,
+		Target: clickhouseDataDir,
+		VolumeOptions: &mount.VolumeOptions{
+			Labels: map[string]string{qrunner.LabelOwnership: "1"},
+		},
+	}
+}
+
+// containerResources returns the limits of the container settings with non-zero overrides applied.
+func containerResources(settings ContainerSettings, overrides *queryrun.Resources) container.Resources {
+	resources := container.Resources{
+		NanoCPUs:   int64(settings.CPULimit),
+		CpusetCpus: settings.CPUSet,
+		Memory:     int64(settings.MemoryLimit),
+	}
+
+	pidsLimit := settings.PidsLimit
+	if overrides != nil {
+		if overrides.CPULimit > 0 {
+			resources.NanoCPUs = int64(overrides.CPULimit)
+		}
+		if overrides.MemoryLimit > 0 {
+			resources.Memory = int64(overrides.MemoryLimit)
+		}
+		if overrides.PidsLimit > 0 {
+			pidsLimit = overrides.PidsLimit
+		}
+	}
+	if pidsLimit > 0 {
+		resources.PidsLimit = &pidsLimit
+	}
+
+	return resources
+}
+
+// checkMemoryLimit returns qrunner.MemoryLimitError if the container of the run has been killed
+// by the out-of-memory killer.
+func (r *Runner) checkMemoryLimit(state *requestState) error {
+	info, err := r.engine.inspectContainer(r.ctx, state.containerID)
+	if err != nil {
+		r.logger.Warn().Err(err).Str("run_id", state.runID).Msg("failed to inspect container after the failed query")
+		return nil
+	}
+
+	oomErr := memoryLimitError(info)
+	if oomErr != nil {
+		r.logger.Info().Str("run_id", state.runID).Str("container_id", state.containerID).
+			Msg("container has been killed by the out-of-memory killer")
+	}
+
+	return oomErr
+}
+
+// memoryLimitError translates the out-of-memory kill of the container into qrunner.MemoryLimitError.
+// It returns nil if the container has not been killed.
+func memoryLimitError(info types.ContainerJSON) error {
+	if info.ContainerJSONBase == nil || info.State == nil || !info.State.OOMKilled {
+		return nil
+	}
+
+	var limit uint64
+	if info.HostConfig != nil && info.HostConfig.Memory > 0 {
+		limit = uint64(info.HostConfig.Memory)
+	}
+
+	return &qrunner.MemoryLimitError{Limit: limit}
+}
+
+func (r *Runner) execQuery(ctx context.Context, state *requestState) (res qrunner.Result, err error) {
 	invokedAt := time.Now()
 	defer func() {
 		r.pipelineMetr.ExecCommand(err == nil, state.version, invokedAt)
@@ -387,80 +1025,439 @@ func (r *Runner) execQuery(ctx context.Context, state *requestState) (stdout str
 
 	switch state.settings.Type() {
 	case database.TypeClickHouse:
-		args = []string{
-			"clickhouse", "client",
-			"-n",
-			"-m",
-			"--query", state.query,
-		}
-
 		settings, ok := state.settings.(*runsettings.ClickHouseSettings)
 		if !ok {
-			return "", "", errors.Errorf("invalid settings for type %s", state.settings.Type())
+			return qrunner.Result{}, errors.Errorf("invalid settings for type %s", state.settings.Type())
 		}
 
+		format := r.cfg.DefaultOutputFormat
+		if settings.OutputFormat != "" {
+			format = settings.OutputFormat
+		}
+
+		tmpl, idx := selectCommandTemplate(r.cfg.CommandTemplates, state.version)
+		r.logger.Debug().Str("run_id", state.runID).Str("version", state.version).Int("template", idx).
+			Msg("command template has been selected")
+
 		formatArgs := settings.FormatArgs(state.version, r.cfg.DefaultOutputFormat)
-		args = append(args, formatArgs...)
+		args = tmpl.build(state.query, format, formatArgs)
+
+		if limit := r.clientMaxExecutionTime(); limit > 0 {
+			args = append(args, "--max_execution_time", strconv.FormatInt(int64(math.Ceil(limit.Seconds())), 10))
+		}
+		if limit := r.clientMaxResultRows(); limit > 0 {
+			args = append(args, "--max_result_rows", strconv.FormatUint(limit, 10), "--result_overflow_mode", "break")
+		}
 	default:
-		return "", "", errors.Errorf("unknown settings type %s", state.settings.Type())
+		return qrunner.Result{}, errors.Errorf("unknown settings type %s", state.settings.Type())
 	}
 
-	resp, err := r.engine.exec(ctx, state.containerID, args)
+	resp, execID, err := r.engine.exec(ctx, state.containerID, args)
 	if err != nil {
-		return "", "", errors.Wrap(err, "exec failed")
+		return qrunner.Result{}, errors.Wrap(err, "exec failed")
 	}
 	defer resp.Close()
 
 	// https://github.com/moby/moby/blob/8e610b2b55bfd1bfa9436ab110d311f5e8a74dcb/integration/internal/container/exec.go#L38
 	var outBuf, errBuf bytes.Buffer
-	outputDone := make(chan error)
+	// The channel is buffered, so the copy doesn't block forever if the run is canceled.
+	outputDone := make(chan error, 1)
+
+	limit := state.outputLimit
+	if limit == nil {
+		limit = newOutputLimit(0)
+	}
 
-	go func() {
-		_, err = stdcopy.StdCopy(&outBuf, &errBuf, resp.Reader)
+	// Only the kept output is streamed, so the client gets the same output as the result has.
+	var stdout io.Writer = &outBuf
+	if state.outputStream != nil {
+		stdout = io.MultiWriter(&outBuf, state.outputStream)
+	}
+
+	r.tasks.Go("exec-output", func() {
+		err := copyExecOutput(limit.writer(stdout), limit.writer(&errBuf), resp.Reader)
 		outputDone <- err
-	}()
+	})
 
 	select {
 	case err := <-outputDone:
+		if errors.Is(err, errOutputLimitReached) {
+			// Docker cannot kill an exec, so its streams are closed, and the client dies of the broken pipe
+			// on the next write. The server cancels the query once the client is disconnected.
+			// The exit code is not known yet, the truncated output is reported as a successful one.
+			resp.Close()
+			r.logger.Info().Str("run_id", state.runID).Uint64("limit", limit.max).
+				Msg("exec output has exceeded the limit and has been truncated")
+
+			return qrunner.Result{Stdout: outBuf.String(), Stderr: errBuf.String(), Truncated: true}, nil
+		}
 		if err != nil {
-			return "", "", errors.Wrap(err, "failed to get output")
+			return qrunner.Result{}, errors.Wrap(err, "failed to get output")
 		}
 
 	case <-ctx.Done():
-		return "", "", ctx.Err()
+		return qrunner.Result{}, ctx.Err()
+	}
+
+	exitCode, err := r.engine.execExitCode(ctx, execID)
+	if err != nil {
+		return qrunner.Result{}, err
 	}
 
-	r.logger.Debug().Str("run_id", state.runID).Dur("elapsed_ms", time.Since(invokedAt)).Msg("exec finished")
+	r.logger.Debug().Str("run_id", state.runID).Int("exit_code", exitCode).Dur("elapsed_ms", time.Since(invokedAt)).
+		Msg("exec finished")
 
-	return outBuf.String(), errBuf.String(), nil
+	return qrunner.Result{Stdout: outBuf.String(), Stderr: errBuf.String(), ExitCode: exitCode}, nil
 }
 
-func (r *Runner) runQuery(ctx context.Context, state *requestState) (output string, err error) {
+// waitForServer waits until the database server accepts queries and returns the version reported by the server
+// and the number of probes made. It fails with qrunner.ErrServerNotReady if the server is not ready
+// after all retries or by the readiness timeout.
+func (r *Runner) waitForServer(ctx context.Context, state *requestState) (serverVersion string, attempts int, err error) {
+	probe := *state
+	probe.query = qrunner.ServerVersionQuery
+	probe.settings = &runsettings.ClickHouseSettings{OutputFormat: "TabSeparated"}
+	probe.outputStream = nil
+
+	maxRetries := r.cfg.MaxExecRetries
+	var timeout time.Duration
+	if state.deadlines != nil {
+		if state.deadlines.MaxExecRetries > 0 {
+			maxRetries = state.deadlines.MaxExecRetries
+		}
+		timeout = state.deadlines.ReadinessTimeout
+	}
+
+	startedAt := time.Now()
+	for attempts < maxRetries {
+		attempts++
+
+		res, err := r.execQuery(ctx, &probe)
+		if err != nil {
+			return "", attempts, err
+		}
+
+		if qrunner.CheckIfClickHouseIsReady(res) {
+			return strings.TrimSpace(res.Stdout), attempts, nil
+		}
+
+		if timeout > 0 && time.Since(startedAt)+r.cfg.ExecRetryDelay > timeout {
+			r.logger.Warn().Str("run_id", state.runID).Int("attempts", attempts).Dur("timeout", timeout).
+				Msg("database server is not ready by the readiness timeout")
+
+			return "", attempts, qrunner.ErrServerNotReady
+		}
+
+		time.Sleep(r.cfg.ExecRetryDelay)
+	}
+
+	r.logger.Warn().Str("run_id", state.runID).Int("attempts", attempts).Msg("database server is not ready after all retries")
+
+	return "", attempts, qrunner.ErrServerNotReady
+}
+
+func (r *Runner) runQuery(ctx context.Context, state *requestState) (res qrunner.Result, err error) {
 	invokedAt := time.Now()
 	defer func() {
+		if errors.Is(err, context.Canceled) {
+			r.pipelineMetr.RunQueryCanceled(state.version, invokedAt)
+			return
+		}
+
+		var timeoutErr *qrunner.QueryTimeoutError
+		if errors.As(err, &timeoutErr) {
+			r.pipelineMetr.RunQueryTimedOut(state.version, invokedAt)
+			return
+		}
+
 		r.pipelineMetr.RunQuery(err == nil, state.version, invokedAt)
 	}()
 
-	var stdout string
-	var stderr string
+	if state.settings.Type() == database.TypeClickHouse {
+		startedAt := time.Now()
+
+		var attempts int
+		state.serverVersion, attempts, err = r.waitForServer(ctx, state)
+		if err != nil {
+			err = r.startupFailure(ctx, state, err)
+		}
+		if err == nil || errors.Is(err, qrunner.ErrServerNotReady) {
+			state.timeline.RecordAttempts(queryrun.StageReadiness, startedAt, attempts)
+			r.pipelineMetr.Readiness(chsemver.Series(state.version), attempts, startedAt)
+		}
+		if err != nil {
+			return qrunner.Result{}, err
+		}
+	}
+
+	execCtx := ctx
+	if r.cfg.MaxExecutionTime > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, r.cfg.MaxExecutionTime+execTimeoutGrace)
+		defer cancel()
+	}
+
+	state.outputLimit = newOutputLimit(r.cfg.MaxOutputBytes)
+
+	startedAt := time.Now()
+	if len(state.statements) > 0 {
+		res, err = r.execStatements(execCtx, state)
+	} else {
+		res, err = r.execQuery(execCtx, state)
+	}
+	if err != nil {
+		// Only the runner limit is reported as the timeout, the caller's deadline is handled by the caller.
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			r.killHungContainer(state)
+			return qrunner.Result{}, &qrunner.QueryTimeoutError{Timeout: r.cfg.MaxExecutionTime}
+		}
+
+		return qrunner.Result{}, err
+	}
+	state.timeline.Record(queryrun.StageExec, startedAt)
+
+	r.logger.Debug().Str("run_id", state.runID).Str("server_version", state.serverVersion).Msg("query has been executed")
+
+	state.stderr = res.Stderr
 
-	for retry := 0; retry < r.cfg.MaxExecRetries; retry++ {
-		stdout, stderr, err = r.execQuery(ctx, state)
+	if res.Truncated {
+		res.DroppedBytes = state.outputLimit.dropped
+		r.pipelineMetr.TruncatedOutput(state.version)
+	}
+
+	return res, nil
+}
+
+// execStatements executes the statements one by one in the container of the run, so they share the server
+// and its tables. The run is stopped at the first failed statement unless it continues on errors.
+// The combined result has the exit code of the first failed statement.
+func (r *Runner) execStatements(ctx context.Context, state *requestState) (qrunner.Result, error) {
+	var stdout, stderr strings.Builder
+	var exitCode int
+	var truncated bool
+	for i := range state.statements {
+		if exitCode != 0 && !state.continueOnError {
+			break
+		}
+
+		statement := &state.statements[i]
+		step := *state
+		step.query = statement.Query
+
+		startedAt := time.Now()
+		res, err := r.execQuery(ctx, &step)
 		if err != nil {
-			return "", err
+			return qrunner.Result{}, errors.Wrapf(err, "statement %d failed", i+1)
 		}
 
-		if qrunner.CheckIfClickHouseIsReady(stderr) {
-			r.logger.Debug().Str("run_id", state.runID).Msg("query has been executed")
+		statement.Executed = true
+		statement.Stdout = res.Stdout
+		statement.Stderr = res.Stderr
+		statement.ExitCode = res.ExitCode
+		statement.Elapsed = time.Since(startedAt)
+
+		stdout.WriteString(res.Stdout)
+		stderr.WriteString(res.Stderr)
+		if exitCode == 0 {
+			exitCode = res.ExitCode
+		}
+
+		r.logger.Debug().Str("run_id", state.runID).Int("statement", i+1).Int("exit_code", res.ExitCode).
+			Msg("statement has been executed")
+
+		// The output of the run is exhausted, so the remaining statements are not executed.
+		if res.Truncated {
+			truncated = true
 			break
 		}
+	}
 
-		time.Sleep(r.cfg.ExecRetryDelay)
+	return qrunner.Result{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: exitCode, Truncated: truncated}, nil
+}
+
+// execTimeoutGrace is the time the server is given to abort the query by max_execution_time
+// before the container is killed.
+const execTimeoutGrace = 2 * time.Second
+
+// clientMaxExecutionTime returns the max_execution_time passed to the client. It cannot exceed the restricted
+// profile limit, as the profile constraints reject greater values.
+func (r *Runner) clientMaxExecutionTime() time.Duration {
+	limit := r.cfg.MaxExecutionTime
+	if p := r.cfg.Restricted; p != nil && p.MaxExecutionTime > 0 && p.MaxExecutionTime < limit {
+		limit = p.MaxExecutionTime
 	}
 
-	if stderr == "" {
-		return stdout, nil
+	return limit
+}
+
+// clientMaxResultRows returns the max_result_rows passed to the client. It cannot exceed the restricted
+// profile limit, as the profile constraints reject greater values.
+func (r *Runner) clientMaxResultRows() uint64 {
+	limit := r.cfg.MaxResultRows
+	if p := r.cfg.Restricted; p != nil && p.MaxResultRows > 0 && (limit == 0 || p.MaxResultRows < limit) {
+		limit = p.MaxResultRows
 	}
 
-	return stdout + "\n" + stderr, nil
+	return limit
+}
+
+// killHungContainer kills the container of the timed-out query, so the exec does not keep running
+// until the container is removed.
+func (r *Runner) killHungContainer(state *requestState) {
+	err := r.engine.killContainer(r.cleanupCtx, state.containerID)
+	if err != nil {
+		r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to kill container of the timed-out query")
+		return
+	}
+
+	r.logger.Info().Str("run_id", state.runID).Dur("timeout", r.cfg.MaxExecutionTime).
+		Msg("container of the timed-out query has been killed")
+}
+
+// maxLogsLength bounds the collected container logs, e.g. the tool output.
+// Longer tool outputs are truncated and then rejected by the output length limit.
+const maxLogsLength = 16 * 1024 * 1024
+
+// runTool runs an allowlisted tool as the container command. The database server is not started,
+// and the output is collected from the container logs after the tool exits.
+func (r *Runner) runTool(ctx context.Context, run *queryrun.Run) (res qrunner.Result, err error) {
+	tmpl, found := findToolTemplate(r.cfg.Tools, run.Tool)
+	if !found {
+		return qrunner.Result{}, errors.Wrapf(qrunner.ErrInvalidToolRun, "unknown tool %s", run.Tool)
+	}
+
+	args, err := tmpl.build(run.Input, run.ToolParams)
+	if err != nil {
+		return qrunner.Result{}, err
+	}
+
+	state := &requestState{
+		runID:    run.ID,
+		database: run.Database,
+		version:  run.Version,
+		query:    run.Input,
+		clientID: run.ClientID,
+		timeline: run.Timeline,
+	}
+
+	invokedAt := time.Now()
+	defer func() {
+		r.pipelineMetr.RunTool(err == nil, run.Tool, state.version, invokedAt)
+	}()
+
+	err = r.resolveImage(ctx, run, state)
+	if err != nil {
+		return qrunner.Result{}, fmt.Errorf("failed to construct FQN: %w", err)
+	}
+
+	err = r.pull(ctx, state)
+	if err != nil {
+		return qrunner.Result{}, fmt.Errorf("pull failed: %w", err)
+	}
+
+	state.emulatedArch = r.detectEmulation(ctx, state)
+	if state.emulatedArch != "" && tmpl.NativeOnly && !run.AllowEmulation {
+		return qrunner.Result{}, errors.Wrapf(qrunner.ErrEmulationRefused,
+			"tool %s needs native execution, but the %s image would be run under emulation on a %s host",
+			run.Tool, state.emulatedArch, state.hostArch)
+	}
+
+	// Tools never get a restricted egress network, they use the deployment network mode.
+	hostConfig := r.hostConfig(run.Resources)
+	if run.Network == queryrun.NetworkNone {
+		hostConfig.NetworkMode = networkModeNone
+	}
+
+	err = r.prepareNetwork(ctx, hostConfig)
+	if err != nil {
+		return qrunner.Result{}, err
+	}
+
+	createdAt := time.Now()
+	cont, err := r.engine.createContainer(ctx, &container.Config{
+		Image:      state.imageFQN,
+		Entrypoint: args[:1],
+		Cmd:        args[1:],
+		Labels:     qrunner.CreateContainerLabels(r.name, state.runID, state.version, state.clientID),
+	}, hostConfig)
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "container cannot be created")
+	}
+	state.containerID = cont.ID
+
+	defer func() {
+		if state.held {
+			err := r.holdContainer(r.cleanupCtx, state)
+			if err == nil {
+				return
+			}
+
+			r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to hold tool container, it will be removed")
+		}
+
+		startedAt := time.Now()
+		err := r.engine.removeContainer(r.cleanupCtx, state.containerID)
+		r.pipelineMetr.RemoveContainer(err == nil, "", startedAt)
+		state.timeline.Record(queryrun.StageCleanup, startedAt)
+		if err != nil {
+			r.logger.Error().Err(err).Str("run_id", state.runID).Msg("failed to remove tool container")
+		}
+	}()
+
+	r.active.add(state.runID, state.containerID)
+	defer r.active.remove(state.runID)
+
+	defer func() {
+		r.captureOnFailure(run, state, err)
+		state.held = r.shouldHold(run, err)
+	}()
+
+	archive, err := fileArchive(toolInputName, []byte(run.Input))
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "input archive cannot be built")
+	}
+
+	err = r.engine.copyToContainer(ctx, cont.ID, toolInputDir, archive)
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "input cannot be copied to the container")
+	}
+	state.timeline.Record(queryrun.StageContainerCreate, createdAt)
+
+	startedAt := time.Now()
+	err = r.engine.startContainer(ctx, cont.ID)
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "container cannot be started")
+	}
+	state.timeline.Record(queryrun.StageContainerStart, startedAt)
+
+	startedAt = time.Now()
+	exitCode, err := r.engine.waitContainer(ctx, cont.ID)
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "failed to wait for the tool")
+	}
+
+	logs, err := r.engine.containerLogs(ctx, cont.ID, "")
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "failed to get logs")
+	}
+	defer logs.Close()
+
+	outBuf := &cappedBuffer{limit: maxLogsLength}
+	errBuf := &cappedBuffer{limit: maxLogsLength}
+	_, err = stdcopy.StdCopy(outBuf, errBuf, logs)
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "failed to read logs")
+	}
+	state.timeline.Record(queryrun.StageExec, startedAt)
+
+	r.logger.Debug().
+		Str("run_id", state.runID).
+		Str("tool", run.Tool).
+		Int64("exit_code", exitCode).
+		Dur("elapsed_ms", time.Since(invokedAt)).
+		Msg("tool has been run")
+
+	r.reportEmulation(run, state)
+
+	return qrunner.Result{Stdout: outBuf.String(), Stderr: errBuf.String(), ExitCode: int(exitCode)}, nil
 }
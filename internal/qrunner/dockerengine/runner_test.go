@@ -2,19 +2,25 @@ package dockerengine
 
 import (
 	"context"
+	"encoding/json"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
 	"clickhouse-playground/internal/database/runsettings"
 	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/queryrun"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type tagStorageMock struct {
@@ -88,30 +94,171 @@ func TestCustomSettings(t *testing.T) {
 	runner, _ := New(ctx, logger, "Test", rcfg, tagStorage)
 
 	for _, tc := range cases {
-		output, err := runner.RunQuery(ctx, &queryrun.Run{Input: tc.query, Version: tc.version, Database: tc.database, Settings: tc.runSettings})
+		res, err := runner.RunQuery(ctx, &queryrun.Run{Input: tc.query, Version: tc.version, Database: tc.database, Settings: tc.runSettings})
 		if err != nil {
 			t.Log(err.Error())
 		}
-		assert.Equal(t, tc.expectedOutput, output)
+		assert.Equal(t, tc.expectedOutput, res.Stdout)
 	}
 
 	t.Cleanup(func() {
-		//Fetch all remaining test containers
-		containers, err := runner.engine.cli.ContainerList(ctx, types.ContainerListOptions{
-			Filters: filters.NewArgs(filters.Arg("label", "clickhouse.playground.runner=Test")),
+		removeTestContainers(t, runner)
+	})
+}
+
+func TestJSONOutputFormat(t *testing.T) {
+	ctx := context.Background()
+	logger := zlog.Logger.Level(zerolog.ErrorLevel)
+
+	tagStorage := tagStorageMock{
+		images: map[string]dockertag.Image{
+			"21": {
+				Repository:   "yandex/clickhouse-server",
+				Tag:          "21",
+				OS:           "linux",
+				Architecture: "amd64",
+				Digest:       "sha256:edfee043e4f909dd471c6e282ce3cfd0ce90a4cad3fc234cb27633debe26ea05",
+				PushedAt:     time.Now(),
+			},
+		},
+	}
+
+	runner, err := New(ctx, logger, "TestJSON", DefaultConfig, tagStorage)
+	if err != nil || !runner.Status(ctx).Alive {
+		t.Skip("docker daemon is not available")
+	}
+	t.Cleanup(func() {
+		removeTestContainers(t, runner)
+	})
+
+	res, err := runner.RunQuery(ctx, &queryrun.Run{
+		Input:    "SELECT 1 AS one",
+		Version:  "21",
+		Database: "clickhouse",
+		Settings: &runsettings.ClickHouseSettings{OutputFormat: "JSON"},
+	})
+	require.NoError(t, err)
+
+	var result struct {
+		Data []map[string]interface{} `json:"data"`
+		Rows int                      `json:"rows"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(res.Stdout), &result), res.Stdout)
+	assert.Equal(t, 1, result.Rows)
+	require.Len(t, result.Data, 1)
+	assert.EqualValues(t, 1, result.Data[0]["one"])
+}
+
+// removeTestContainers removes containers left by the test runner.
+func removeTestContainers(t *testing.T, runner *Runner) {
+	ctx := context.Background()
+
+	containers, err := runner.engine.cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", qrunner.LabelRunner+"="+runner.name)),
+	})
+	assert.NoError(t, err)
+
+	for _, container := range containers {
+		err = runner.engine.cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
 		})
+		if err != nil && strings.Contains(err.Error(), "is already in progress") {
+			continue
+		}
 		assert.NoError(t, err)
+	}
+}
 
-		//Remove all remaining test containers
-		for _, container := range containers {
-			err = runner.engine.cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{
-				RemoveVolumes: true,
-				Force:         true,
-			})
-			if err != nil && strings.Contains(err.Error(), "is already in progress") {
-				continue
-			}
-			assert.NoError(t, err)
-		}
-	})
+func TestContainerResources(t *testing.T) {
+	settings := ContainerSettings{CPULimit: 2e9, CPUSet: "0-3", MemoryLimit: 1e9}
+
+	res := containerResources(settings, nil)
+	assert.Equal(t, int64(2e9), res.NanoCPUs)
+	assert.Equal(t, "0-3", res.CpusetCpus)
+	assert.Equal(t, int64(1e9), res.Memory)
+	assert.Nil(t, res.PidsLimit, "pids are not limited by default")
+
+	settings.PidsLimit = 512
+	res = containerResources(settings, &queryrun.Resources{MemoryLimit: 4e9})
+	assert.Equal(t, int64(2e9), res.NanoCPUs, "zero overrides keep the runner limits")
+	assert.Equal(t, int64(4e9), res.Memory)
+	require.NotNil(t, res.PidsLimit)
+	assert.Equal(t, int64(512), *res.PidsLimit)
+
+	res = containerResources(settings, &queryrun.Resources{CPULimit: 5e8, PidsLimit: 64})
+	assert.Equal(t, int64(5e8), res.NanoCPUs)
+	assert.Equal(t, int64(1e9), res.Memory)
+	assert.Equal(t, int64(64), *res.PidsLimit)
+}
+
+func TestMemoryLimitError(t *testing.T) {
+	inspected := func(oomKilled bool, memory int64) types.ContainerJSON {
+		return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+			State:      &types.ContainerState{OOMKilled: oomKilled},
+			HostConfig: &container.HostConfig{Resources: container.Resources{Memory: memory}},
+		}}
+	}
+
+	assert.NoError(t, memoryLimitError(types.ContainerJSON{}))
+	assert.NoError(t, memoryLimitError(inspected(false, 1e9)))
+
+	err := memoryLimitError(inspected(true, 1e9))
+	var oomErr *qrunner.MemoryLimitError
+	require.ErrorAs(t, err, &oomErr)
+	assert.Equal(t, "query exceeded the memory limit (1000 MB)", err.Error())
+	assert.False(t, isInfrastructureFailure(err), "the query is the cause")
+
+	assert.EqualError(t, memoryLimitError(inspected(true, 0)), "query exceeded the available memory")
+}
+
+func TestClientMaxExecutionTime(t *testing.T) {
+	r := &Runner{cfg: Config{MaxExecutionTime: time.Minute}}
+	assert.Equal(t, time.Minute, r.clientMaxExecutionTime())
+
+	r.cfg.Restricted = &RestrictedProfile{MaxExecutionTime: 30 * time.Second}
+	assert.Equal(t, 30*time.Second, r.clientMaxExecutionTime(), "the profile constraint is not exceeded")
+
+	r.cfg.Restricted.MaxExecutionTime = 0
+	assert.Equal(t, time.Minute, r.clientMaxExecutionTime())
+
+	r.cfg.MaxExecutionTime = 0
+	assert.Zero(t, r.clientMaxExecutionTime())
+}
+
+func TestQueryTimeoutError(t *testing.T) {
+	err := errors.Wrap(&qrunner.QueryTimeoutError{Timeout: 30 * time.Second}, "failed to run query")
+
+	assert.EqualError(t, err, "failed to run query: query timed out after 30s")
+	assert.False(t, isInfrastructureFailure(err), "the query is the cause")
+}
+
+func TestRunner_StopWaitsForTasks(t *testing.T) {
+	// The daemon is not available, so the runner starts disconnected and keeps reconnecting until it's stopped.
+	t.Setenv("DOCKER_HOST", "unix:///nonexistent/docker.sock")
+
+	ctx := context.Background()
+	before := runtime.NumGoroutine()
+
+	name := "TestRunner_StopWaitsForTasks" + time.Now().Format(time.RFC3339Nano)
+	r, err := New(ctx, zerolog.Nop(), name, DefaultConfig, tagStorageMock{})
+	require.NoError(t, err)
+	require.NoError(t, r.Start())
+	assert.Contains(t, r.tasks.Live(), "supervisor")
+
+	_, err = r.RunQuery(ctx, &queryrun.Run{ID: "run", Version: "23.3"})
+	assert.ErrorIs(t, err, qrunner.ErrRunnerDisconnected)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, r.Stop(shutdownCtx))
+	assert.Empty(t, r.tasks.Live())
+
+	// Goroutines are polled in the test goroutine, as assert.Eventually starts goroutines of its own.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines have leaked")
 }
@@ -0,0 +1,215 @@
+package dockerengine
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// isSessionActive reports whether the container serves an interactive session that has not ended yet.
+func isSessionActive(c types.Container, now time.Time) bool {
+	value, found := c.Labels[qrunner.LabelSessionExpiresAt]
+	if !found {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return now.Before(time.Unix(unix, 0))
+}
+
+// session keeps the container of an interactive session. Queries are executed one by one,
+// and closing does not wait for the query in progress, so the container is removed promptly.
+type session struct {
+	runner *Runner
+	state  *requestState
+
+	execMu sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    atomic.Bool
+}
+
+// OpenSession starts a container for the session and waits for the server, so the first query is not slowed down.
+// The container is removed by Close, by the runner stop, or by the GC once the session has expired.
+func (r *Runner) OpenSession(ctx context.Context, run *queryrun.Run, expiresAt time.Time) (s qrunner.Session, err error) {
+	if !r.supervisor.isConnected() {
+		return nil, qrunner.ErrRunnerDisconnected
+	}
+	if !r.drain.enter() {
+		return nil, errors.Wrap(qrunner.ErrRunnerDisconnected, "runner is stopping")
+	}
+	defer r.drain.leave()
+
+	defer func() {
+		err = r.classifyError(err)
+	}()
+
+	state := &requestState{
+		runID:            run.ID,
+		database:         run.Database,
+		version:          run.Version,
+		settings:         run.Settings,
+		clientID:         run.ClientID,
+		timeline:         run.Timeline,
+		deadlines:        run.Deadlines,
+		sessionExpiresAt: expiresAt,
+	}
+
+	err = r.resolveImage(ctx, run, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct FQN: %w", err)
+	}
+
+	err = r.createContainer(ctx, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container: %w", err)
+	}
+
+	sess := &session{runner: r, state: state}
+
+	state.serverVersion, _, err = r.waitForServer(ctx, state)
+	if err != nil {
+		closeErr := sess.Close(r.cleanupCtx)
+		if closeErr != nil {
+			r.logger.Error().Err(closeErr).Str("run_id", run.ID).Msg("failed to remove container of the session")
+		}
+
+		return nil, err
+	}
+
+	run.ServerVersion = state.serverVersion
+	r.sessions.add(sess)
+
+	r.logger.Debug().Str("run_id", run.ID).Str("container_id", state.containerID).Time("expires_at", expiresAt).
+		Msg("session has been opened")
+
+	return sess, nil
+}
+
+// Exec executes the query bounded by the execution time limit of the runner. A timed-out query gets
+// the container killed, so the session is closed then.
+func (s *session) Exec(ctx context.Context, query string) (res qrunner.Result, err error) {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+
+	if s.closed.Load() {
+		return qrunner.Result{}, qrunner.ErrSessionClosed
+	}
+
+	r := s.runner
+	defer func() {
+		err = r.classifyError(err)
+	}()
+
+	step := *s.state
+	step.query = query
+	step.outputLimit = newOutputLimit(r.cfg.MaxOutputBytes)
+
+	execCtx := ctx
+	if r.cfg.MaxExecutionTime > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, r.cfg.MaxExecutionTime+execTimeoutGrace)
+		defer cancel()
+	}
+
+	res, err = r.execQuery(execCtx, &step)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			closeErr := s.Close(r.cleanupCtx)
+			if closeErr != nil {
+				r.logger.Error().Err(closeErr).Str("run_id", step.runID).Msg("failed to remove container of the timed-out session")
+			}
+
+			return qrunner.Result{}, &qrunner.QueryTimeoutError{Timeout: r.cfg.MaxExecutionTime}
+		}
+		if s.closed.Load() {
+			return qrunner.Result{}, qrunner.ErrSessionClosed
+		}
+
+		return qrunner.Result{}, err
+	}
+
+	if res.Truncated {
+		res.DroppedBytes = step.outputLimit.dropped
+		r.pipelineMetr.TruncatedOutput(step.version)
+	}
+
+	return res, nil
+}
+
+// Close removes the container of the session once, the query in progress fails then.
+func (s *session) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.closed.Store(true)
+
+		r := s.runner
+		r.sessions.remove(s)
+
+		startedAt := time.Now()
+		err := r.engine.removeContainer(ctx, s.state.containerID)
+		r.pipelineMetr.RemoveContainer(err == nil, "", startedAt)
+		if err != nil {
+			s.closeErr = errors.Wrap(err, "failed to remove container")
+			return
+		}
+
+		r.logger.Debug().Str("run_id", s.state.runID).Str("container_id", s.state.containerID).Msg("session has been closed")
+	})
+
+	return s.closeErr
+}
+
+// openSessions tracks sessions of the runner, so their containers are removed when the runner is stopped.
+type openSessions struct {
+	mu   sync.Mutex
+	list map[*session]struct{}
+}
+
+func newOpenSessions() *openSessions {
+	return &openSessions{list: make(map[*session]struct{})}
+}
+
+func (o *openSessions) add(s *session) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.list[s] = struct{}{}
+}
+
+func (o *openSessions) remove(s *session) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.list, s)
+}
+
+// closeAll removes containers of all open sessions. Queries in progress fail as the containers are gone.
+func (o *openSessions) closeAll(ctx context.Context) {
+	o.mu.Lock()
+	list := make([]*session, 0, len(o.list))
+	for s := range o.list {
+		list = append(list, s)
+	}
+	o.mu.Unlock()
+
+	for _, s := range list {
+		err := s.Close(ctx)
+		if err != nil {
+			s.runner.logger.Error().Err(err).Str("run_id", s.state.runID).Msg("failed to remove container of the session")
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package dockerengine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSnapshotLogsLength is the max length of the logs tail kept in a snapshot.
+	DefaultSnapshotLogsLength = 32 * 1024
+
+	// snapshotLogsLines bounds the number of log lines fetched from the daemon.
+	snapshotLogsLines = "1000"
+
+	// snapshotTimeout limits the capture, as it may happen after the run deadline.
+	snapshotTimeout = 10 * time.Second
+)
+
+// Reasons of snapshot captures.
+const (
+	SnapshotReasonRequested = "requested"
+	SnapshotReasonFailure   = "failure"
+)
+
+// activeContainers keeps containers of in-flight runs, so they can be inspected while the run is processed,
+// and the garbage collector does not remove them from under the run.
+type activeContainers struct {
+	mu         sync.Mutex
+	containers map[string]activeContainer
+}
+
+type activeContainer struct {
+	id    string
+	since time.Time
+}
+
+func newActiveContainers() *activeContainers {
+	return &activeContainers{
+		containers: make(map[string]activeContainer),
+	}
+}
+
+func (a *activeContainers) add(runID, containerID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.containers[runID] = activeContainer{id: containerID, since: time.Now()}
+}
+
+func (a *activeContainers) remove(runID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.containers, runID)
+}
+
+func (a *activeContainers) get(runID string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, found := a.containers[runID]
+
+	return c.id, found
+}
+
+// since returns when the container has been taken by an in-flight run.
+func (a *activeContainers) since(containerID string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, c := range a.containers {
+		if c.id == containerID {
+			return c.since, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// captureSnapshot collects the container state, resource limits, mounts, current stats and the logs tail.
+// Stats are skipped if the container is not running.
+func (r *Runner) captureSnapshot(ctx context.Context, containerID string, reason string) (*queryrun.ContainerSnapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	info, err := r.engine.inspectContainer(ctx, containerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "inspect failed")
+	}
+
+	snapshot := &queryrun.ContainerSnapshot{
+		ContainerID: containerID,
+		CapturedAt:  time.Now(),
+		Reason:      reason,
+	}
+
+	if info.Config != nil {
+		snapshot.Image = info.Config.Image
+	}
+
+	if info.State != nil {
+		snapshot.State = queryrun.ContainerState{
+			Status:     info.State.Status,
+			OOMKilled:  info.State.OOMKilled,
+			ExitCode:   info.State.ExitCode,
+			Error:      info.State.Error,
+			StartedAt:  info.State.StartedAt,
+			FinishedAt: info.State.FinishedAt,
+		}
+	}
+
+	if info.HostConfig != nil {
+		snapshot.Resources = queryrun.ContainerResources{
+			NanoCPUs: info.HostConfig.NanoCPUs,
+			CPUSet:   info.HostConfig.CpusetCpus,
+			Memory:   info.HostConfig.Memory,
+		}
+	}
+
+	for _, m := range info.Mounts {
+		mode := "rw"
+		if !m.RW {
+			mode = "ro"
+		}
+
+		snapshot.Mounts = append(snapshot.Mounts, fmt.Sprintf("%s %s -> %s (%s)", m.Type, m.Source, m.Destination, mode))
+	}
+
+	if info.State != nil && info.State.Running {
+		stats, err := r.engine.containerStats(ctx, containerID)
+		if err != nil {
+			r.logger.Warn().Err(err).Str("container_id", containerID).Msg("failed to get container stats")
+		} else {
+			snapshot.Stats = &queryrun.ContainerStats{
+				CPUUsage:    stats.CPUStats.CPUUsage.TotalUsage,
+				MemoryUsage: stats.MemoryStats.Usage,
+				MemoryLimit: stats.MemoryStats.Limit,
+				PIDs:        stats.PidsStats.Current,
+			}
+		}
+	}
+
+	snapshot.Logs, snapshot.LogsTruncated, err = r.logsTail(ctx, containerID, int(r.cfg.SnapshotLogsLength))
+	if err != nil {
+		r.logger.Warn().Err(err).Str("container_id", containerID).Msg("failed to get container logs")
+	}
+
+	return snapshot, nil
+}
+
+// logsTail returns at most limit last bytes of the container logs.
+func (r *Runner) logsTail(ctx context.Context, containerID string, limit int) (string, bool, error) {
+	logs, err := r.engine.containerLogs(ctx, containerID, snapshotLogsLines)
+	if err != nil {
+		return "", false, err
+	}
+	defer logs.Close()
+
+	// Both streams are merged, as the order of messages matters more than their origin.
+	buf := &cappedBuffer{limit: maxLogsLength}
+	_, err = stdcopy.StdCopy(buf, buf, logs)
+	if err != nil {
+		return "", false, errors.Wrap(err, "failed to read logs")
+	}
+
+	tail := buf.Bytes()
+	if len(tail) <= limit {
+		return string(tail), false, nil
+	}
+
+	return string(tail[len(tail)-limit:]), true, nil
+}
+
+// Snapshot captures the container of an in-flight run.
+func (r *Runner) Snapshot(ctx context.Context, runID string) (*queryrun.ContainerSnapshot, error) {
+	containerID, found := r.active.get(runID)
+	if !found {
+		return nil, qrunner.ErrRunNotInProgress
+	}
+
+	return r.captureSnapshot(ctx, containerID, SnapshotReasonRequested)
+}
+
+// isInfrastructureFailure reports whether the run has failed because of the infrastructure rather than
+// because of the client. The cause is told by the error type: the run deadline, a database server that has not
+// become ready, a lost daemon, or a failure reported by the daemon itself (e.g. the container cannot be started).
+func isInfrastructureFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var depErr *qrunner.DependencyError
+
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, qrunner.ErrServerNotReady) ||
+		errors.Is(err, qrunner.ErrRunnerDisconnected) ||
+		errors.As(err, &depErr) ||
+		errdefs.IsSystem(err) ||
+		errdefs.IsUnavailable(err)
+}
+
+// captureOnFailure saves a snapshot of the run container if the run has failed because of the infrastructure.
+// Runs cancelled by clients are not captured. It must be called before the container is removed.
+func (r *Runner) captureOnFailure(run *queryrun.Run, state *requestState, err error) {
+	if !isInfrastructureFailure(err) || state.containerID == "" {
+		return
+	}
+
+	// The run context may have already expired.
+	snapshot, captureErr := r.captureSnapshot(r.ctx, state.containerID, SnapshotReasonFailure)
+	if captureErr != nil {
+		r.logger.Error().Err(captureErr).Str("run_id", state.runID).Msg("failed to capture container snapshot")
+		return
+	}
+
+	run.ContainerSnapshot = snapshot
+	r.logger.Info().Str("run_id", state.runID).Str("container_id", state.containerID).Msg("container snapshot has been captured")
+}
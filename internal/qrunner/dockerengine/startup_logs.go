@@ -0,0 +1,93 @@
+package dockerengine
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultStartupLogsLength is the default max length of the logs tail attached to startup errors.
+const DefaultStartupLogsLength = 4 * 1024
+
+var (
+	ansiEscapeRegexp = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+	ipv4Regexp       = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+	secretRegexp     = regexp.MustCompile(`(?i)(password|secret|token|access_key_id|secret_access_key)(\s*[:=]\s*|>)[^\s<]+`)
+)
+
+// startupFailure handles a database server that has not become ready. If the container has exited,
+// e.g. because of an invalid custom config or CPU instructions unsupported by an old image,
+// the failure is not caused by the daemon, although probes fail with daemon errors.
+// The logs tail of the container is logged, and its sanitized excerpt is attached to the error.
+func (r *Runner) startupFailure(ctx context.Context, state *requestState, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+
+	info, inspectErr := r.engine.inspectContainer(ctx, state.containerID)
+	if inspectErr != nil {
+		r.logger.Error().Err(inspectErr).Str("run_id", state.runID).Msg("failed to inspect container of a server that has not started")
+		return err
+	}
+	if info.State != nil && !info.State.Running {
+		r.logger.Debug().Err(err).Str("run_id", state.runID).Msg("readiness probe has failed, the container has exited")
+		err = errors.Wrapf(qrunner.ErrServerNotReady, "database server has exited with code %d", info.State.ExitCode)
+	}
+	if !errors.Is(err, qrunner.ErrServerNotReady) {
+		return err
+	}
+
+	limit := r.cfg.SnapshotLogsLength
+	if r.cfg.StartupLogsLength > limit {
+		limit = r.cfg.StartupLogsLength
+	}
+	logs, _, logsErr := r.logsTail(ctx, state.containerID, int(limit))
+	if logsErr != nil {
+		r.logger.Error().Err(logsErr).Str("run_id", state.runID).Msg("failed to get logs of a server that has not started")
+		return err
+	}
+
+	r.logger.Warn().Err(err).
+		Str("run_id", state.runID).
+		Str("container_id", state.containerID).
+		Str("logs", logs).
+		Msg("database server has not started")
+
+	if r.cfg.StartupLogsLength == 0 {
+		return err
+	}
+
+	excerpt := sanitizeLogs(logs, state.containerID)
+	if len(excerpt) > int(r.cfg.StartupLogsLength) {
+		excerpt = excerpt[len(excerpt)-int(r.cfg.StartupLogsLength):]
+	}
+
+	return &qrunner.ServerStartupError{Err: err, Logs: excerpt}
+}
+
+// sanitizeLogs prepares server logs to be shown to users. Control sequences are removed, and the container id
+// (the hostname of the server), IP addresses and values of secret-looking settings are redacted.
+func sanitizeLogs(logs string, containerID string) string {
+	logs = ansiEscapeRegexp.ReplaceAllString(logs, "")
+	logs = strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' && r != '\t' || r == 0x7f {
+			return -1
+		}
+
+		return r
+	}, logs)
+
+	if containerID != "" {
+		logs = strings.ReplaceAll(logs, containerID, "<container>")
+		if len(containerID) > 12 {
+			logs = strings.ReplaceAll(logs, containerID[:12], "<container>")
+		}
+	}
+	logs = ipv4Regexp.ReplaceAllString(logs, "<ip>")
+
+	return secretRegexp.ReplaceAllString(logs, "$1$2<redacted>")
+}
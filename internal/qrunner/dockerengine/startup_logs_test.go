@@ -0,0 +1,103 @@
+package dockerengine
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const crashedContainerID = "f3a9c2b1d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f"
+
+// crashedDaemon serves a container which server has crashed on startup.
+type crashedDaemon struct {
+	running bool
+	logs    string
+}
+
+func (d *crashedDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/containers/"+crashedContainerID+"/json"):
+		if d.running {
+			_, _ = w.Write([]byte(`{"Id": "` + crashedContainerID + `", "State": {"Status": "running", "Running": true}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Id": "` + crashedContainerID + `", "State": {"Status": "exited", "Running": false, "ExitCode": 132}}`))
+
+	case strings.HasSuffix(r.URL.Path, "/containers/"+crashedContainerID+"/logs"):
+		_, _ = stdcopy.NewStdWriter(w, stdcopy.Stderr).Write([]byte(d.logs))
+
+	default:
+		http.Error(w, `{"message": "unexpected call"}`, http.StatusNotImplemented)
+	}
+}
+
+func TestRunner_StartupFailure(t *testing.T) {
+	const logs = "Processing configuration file '/etc/clickhouse-server/config.xml'.\n" +
+		"Logging errors to /var/log/clickhouse-server/clickhouse-server.err.log\n" +
+		"Illegal instruction (core dumped)\n"
+	probeErr := errors.New("Error response from daemon: Container " + crashedContainerID + " is not running")
+
+	t.Run("exited", func(t *testing.T) {
+		r := newTestDaemonRunner(t, &crashedDaemon{logs: logs}, Config{SnapshotLogsLength: 1024, StartupLogsLength: 64})
+
+		err := r.startupFailure(context.Background(), &requestState{runID: "run", containerID: crashedContainerID}, probeErr)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, qrunner.ErrServerNotReady)
+		assert.Contains(t, err.Error(), "exited with code 132")
+
+		var startupErr *qrunner.ServerStartupError
+		require.True(t, errors.As(err, &startupErr))
+		assert.Len(t, startupErr.Logs, 64)
+		assert.True(t, strings.HasSuffix(startupErr.Logs, "Illegal instruction (core dumped)\n"))
+	})
+
+	t.Run("logs are not attached", func(t *testing.T) {
+		r := newTestDaemonRunner(t, &crashedDaemon{logs: logs}, Config{SnapshotLogsLength: 1024})
+
+		err := r.startupFailure(context.Background(), &requestState{runID: "run", containerID: crashedContainerID}, probeErr)
+		assert.ErrorIs(t, err, qrunner.ErrServerNotReady)
+
+		var startupErr *qrunner.ServerStartupError
+		assert.False(t, errors.As(err, &startupErr))
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		r := newTestDaemonRunner(t, &crashedDaemon{running: true, logs: logs}, Config{SnapshotLogsLength: 1024, StartupLogsLength: 1024})
+
+		err := r.startupFailure(context.Background(), &requestState{runID: "run", containerID: crashedContainerID}, qrunner.ErrServerNotReady)
+
+		var startupErr *qrunner.ServerStartupError
+		require.True(t, errors.As(err, &startupErr))
+		assert.Equal(t, logs, startupErr.Logs)
+	})
+
+	t.Run("daemon failure", func(t *testing.T) {
+		r := newTestDaemonRunner(t, &crashedDaemon{running: true, logs: logs}, Config{SnapshotLogsLength: 1024, StartupLogsLength: 1024})
+
+		daemonErr := errors.New("Error response from daemon: exec failed")
+		err := r.startupFailure(context.Background(), &requestState{runID: "run", containerID: crashedContainerID}, daemonErr)
+		assert.Equal(t, daemonErr, err)
+	})
+}
+
+func TestSanitizeLogs(t *testing.T) {
+	logs := "\x1b[1;31m<Error> Application: Listen [0.0.0.0]:8123 failed\x1b[0m\r\n" +
+		"2023.04.01 18:00:00.000 [ 1 ] {} <Information> f3a9c2b1d4e5: Starting ClickHouse 23.3.1.2823\n" +
+		"<password>hunter2</password>\n" +
+		"s3: access_key_id = AKIA123, secret_access_key: abc\n"
+
+	expected := "<Error> Application: Listen [<ip>]:8123 failed\n" +
+		"2023.04.01 18:00:00.000 [ 1 ] {} <Information> <container>: Starting ClickHouse 23.3.1.2823\n" +
+		"<password><redacted></password>\n" +
+		"s3: access_key_id = <redacted> secret_access_key: <redacted>\n"
+
+	assert.Equal(t, expected, sanitizeLogs(logs, crashedContainerID))
+}
@@ -1,24 +1,74 @@
 package dockerengine
 
 import (
+	"io"
+	"time"
+
 	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/queryrun"
 )
 
 // requestState holds information about a processing query execution request.
 type requestState struct {
 	runID string
 
+	// clientID identifies the client for audit purposes.
+	clientID string
+
 	database string
 	version  string
 	query    string
 
+	// statements are executed one by one instead of the query if they are set. They are the statements
+	// of the run, so their results are written to the run.
+	statements      []queryrun.Statement
+	continueOnError bool
+
 	settings runsettings.RunSettings
 
-	// <repository>:<version>
+	// networkDisabled is set if the run has opted out to the none network mode.
+	networkDisabled bool
+
+	// <repository>:<version>, or <repository>@<digest> if the run is pinned to the image.
 	imageTag string
 
+	// pinned is the image the run is pinned to. If it's nil, the image is resolved by the version.
+	pinned *dockertag.Image
+
 	// a unique name that refers the image
 	imageFQN string
 
 	containerID string
+
+	// held is set if the container of the failed run is kept for inspection instead of removal.
+	held bool
+
+	// The version reported by the database server.
+	serverVersion string
+
+	// emulatedArch is the architecture of the image if the host runs it under emulation, hostArch is the host one.
+	emulatedArch string
+	hostArch     string
+
+	// stderr is the error stream of the executed command.
+	stderr string
+
+	// outputLimit bounds the output of the query execs. It's nil for readiness probes, so they are not limited.
+	outputLimit *outputLimit
+
+	// sessionExpiresAt is set if the container serves an interactive session. It's kept by the GC until then.
+	sessionExpiresAt time.Time
+
+	// outputStream receives stdout of the query execs as it's produced. It's nil if the output is not streamed.
+	outputStream io.Writer
+
+	// timeline collects completed pipeline stages of the run. It's nil for prewarming.
+	timeline *queryrun.Timeline
+
+	// deadlines override the readiness limits of the runner config. They are nil if the run has none.
+	deadlines *queryrun.Deadlines
+
+	// resources override the container limits of the runner config. They are nil if the run has none.
+	resources *queryrun.Resources
 }
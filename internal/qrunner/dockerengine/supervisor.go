@@ -0,0 +1,153 @@
+package dockerengine
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	reconnectInitialDelay = 500 * time.Millisecond
+	reconnectMaxDelay     = 30 * time.Second
+
+	// confirmPingTimeout limits the ping that checks whether a broken stream was caused by the daemon.
+	confirmPingTimeout = 2 * time.Second
+)
+
+// connectionSupervisor watches the connection to the Docker daemon.
+//
+// When a connection error is reported, the runner is marked as disconnected, and the supervisor
+// pings the daemon with an exponential backoff until it answers. After the reconnection, onReconnect is called
+// to reconcile the runner state with containers that survived the daemon restart.
+type connectionSupervisor struct {
+	ctx    context.Context
+	logger zerolog.Logger
+	engine *engineProvider
+	metr   *metrics.RunnerStatusExporter
+
+	disconnected int32
+	signals      chan struct{}
+
+	onReconnect func()
+}
+
+func newConnectionSupervisor(ctx context.Context, logger zerolog.Logger, engine *engineProvider, metr *metrics.RunnerStatusExporter, onReconnect func()) *connectionSupervisor {
+	return &connectionSupervisor{
+		ctx:         ctx,
+		logger:      logger,
+		engine:      engine,
+		metr:        metr,
+		signals:     make(chan struct{}, 1),
+		onReconnect: onReconnect,
+	}
+}
+
+// isConnectionError checks whether the error is caused by an unavailable Docker daemon.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return dockercli.IsErrConnectionFailed(err) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		strings.Contains(err.Error(), "Cannot connect to the Docker daemon")
+}
+
+// isBrokenStreamError checks whether the error is caused by a connection closed midway.
+// Such errors are returned both by the daemon and by database servers in containers,
+// so they do not tell by themselves that the daemon is unavailable.
+func isBrokenStreamError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *connectionSupervisor) isConnected() bool {
+	return atomic.LoadInt32(&s.disconnected) == 0
+}
+
+// report checks the error returned by the Docker API. If it's a connection error,
+// the runner is marked as disconnected and the reconnect loop is started.
+// A broken stream is counted only if the daemon does not answer a ping either.
+// It returns true if the error is a connection error.
+func (s *connectionSupervisor) report(err error) bool {
+	if !isConnectionError(err) && !(isBrokenStreamError(err) && !s.daemonAnswers()) {
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&s.disconnected, 0, 1) {
+		s.metr.DaemonDisconnected()
+		s.logger.Warn().Err(err).Msg("connection to the Docker daemon has been lost")
+
+		select {
+		case s.signals <- struct{}{}:
+		default:
+		}
+	}
+
+	return true
+}
+
+// daemonAnswers pings the daemon to check whether the connection to it is alive.
+func (s *connectionSupervisor) daemonAnswers() bool {
+	ctx, cancel := context.WithTimeout(s.ctx, confirmPingTimeout)
+	defer cancel()
+
+	return s.engine.ping(ctx) == nil
+}
+
+func (s *connectionSupervisor) start() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case <-s.signals:
+		}
+
+		if !s.reconnect() {
+			return
+		}
+
+		atomic.StoreInt32(&s.disconnected, 0)
+		s.metr.DaemonReconnected()
+		s.logger.Info().Msg("connection to the Docker daemon has been restored")
+
+		s.onReconnect()
+	}
+}
+
+// reconnect pings the daemon with backoff until it answers.
+// It returns false if the supervisor has been stopped.
+func (s *connectionSupervisor) reconnect() bool {
+	delay := reconnectInitialDelay
+	for {
+		err := s.engine.ping(s.ctx)
+		if err == nil {
+			return true
+		}
+
+		s.logger.Debug().Err(err).Dur("retry_delay", delay).Msg("Docker daemon is not available")
+
+		select {
+		case <-s.ctx.Done():
+			return false
+
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
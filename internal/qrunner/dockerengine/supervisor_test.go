@@ -0,0 +1,97 @@
+package dockerengine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	assert.False(t, isConnectionError(nil))
+	assert.False(t, isConnectionError(errors.New("No such container: 4f2a")))
+	assert.False(t, isConnectionError(fmt.Errorf("failed to run query: %w", io.EOF)))
+
+	assert.True(t, isConnectionError(errors.Wrap(syscall.ECONNREFUSED, "exec create failed")))
+	assert.True(t, isConnectionError(errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")))
+}
+
+func TestConnectionSupervisor_Report(t *testing.T) {
+	tests := []struct {
+		name           string
+		daemonAlive    bool
+		err            error
+		expectedReport bool
+	}{
+		{
+			name:           "Unrelated error",
+			daemonAlive:    false,
+			err:            errors.New("No such container: 4f2a"),
+			expectedReport: false,
+		},
+		{
+			name:           "Refused connection",
+			daemonAlive:    true,
+			err:            errors.Wrap(syscall.ECONNREFUSED, "exec create failed"),
+			expectedReport: true,
+		},
+		{
+			name:           "Broken stream with alive daemon",
+			daemonAlive:    true,
+			err:            fmt.Errorf("failed to run query: %w", io.EOF),
+			expectedReport: false,
+		},
+		{
+			name:           "Broken stream with unavailable daemon",
+			daemonAlive:    false,
+			err:            fmt.Errorf("failed to run query: %w", io.ErrUnexpectedEOF),
+			expectedReport: true,
+		},
+	}
+
+	for i, tt := range tests {
+		tt := tt
+		i := i
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("API-Version", "1.41")
+				w.WriteHeader(http.StatusOK)
+			}))
+			if !tt.daemonAlive {
+				srv.Close()
+			}
+			t.Cleanup(srv.Close)
+
+			cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), dockercli.WithVersion("1.41"))
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			s := newConnectionSupervisor(
+				ctx,
+				zerolog.Nop(),
+				&engineProvider{mainCtx: ctx, cli: cli},
+				metrics.NewRunnerStatusExporter(string(qrunner.TypeDockerEngine), fmt.Sprintf("TestReport%d%s", i, time.Now().Format(time.RFC3339Nano))),
+				func() {},
+			)
+
+			assert.Equal(t, tt.expectedReport, s.report(tt.err))
+			assert.Equal(t, !tt.expectedReport, s.isConnected())
+		})
+	}
+}
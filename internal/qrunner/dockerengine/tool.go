@@ -0,0 +1,192 @@
+package dockerengine
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PlaceholderInputFile is replaced with the path of the file containing the run input.
+	PlaceholderInputFile = "{input_file}"
+
+	// The input is copied to /tmp which exists in all images.
+	toolInputDir  = "/tmp"
+	toolInputName = "playground-input"
+
+	// maxToolParamLength bounds values of tool parameters regardless of their patterns.
+	maxToolParamLength = 256
+)
+
+var toolParamNameRegexp = regexp.MustCompile(`^[a-z_]+$`)
+
+// ToolTemplate describes an auxiliary binary (e.g. clickhouse-benchmark) that can be run instead of the server.
+// The container is started with Argv as its command, so only allowlisted binaries can be invoked.
+type ToolTemplate struct {
+	// Name is used by clients to select the tool.
+	Name string
+
+	// Argv may contain {query}, {input_file} and {<param>} placeholders of the declared params.
+	// Placeholders are substituted within their arguments, no shell is involved.
+	Argv []string
+
+	Params []ToolParam
+
+	// NativeOnly makes the tool refuse to run images under emulation unless the run allows it,
+	// e.g. benchmarks, which timings are misleading then.
+	NativeOnly bool
+}
+
+// ToolParam is a parameter that can be passed by clients.
+type ToolParam struct {
+	Name string
+
+	// Pattern must match the whole value.
+	Pattern string
+
+	// Default is used if the parameter is not passed. If it's empty, the parameter is required.
+	Default string
+
+	pattern *regexp.Regexp
+}
+
+// validate checks the template and compiles param patterns.
+func (t *ToolTemplate) validate() error {
+	if t.Name == "" {
+		return errors.New("name cannot be empty")
+	}
+	if len(t.Argv) == 0 {
+		return errors.New("argv cannot be empty")
+	}
+	if strings.Contains(t.Argv[0], "{") {
+		return errors.New("the binary cannot be a placeholder")
+	}
+
+	known := map[string]struct{}{
+		PlaceholderQuery:     {},
+		PlaceholderInputFile: {},
+	}
+	for i := range t.Params {
+		p := &t.Params[i]
+		if !toolParamNameRegexp.MatchString(p.Name) {
+			return errors.Errorf("invalid param name '%s'", p.Name)
+		}
+		if p.Pattern == "" {
+			return errors.Errorf("param %s: pattern is required", p.Name)
+		}
+
+		pattern, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "param %s: invalid pattern", p.Name)
+		}
+		if p.Default != "" && !pattern.MatchString(p.Default) {
+			return errors.Errorf("param %s: default value does not match the pattern", p.Name)
+		}
+
+		p.pattern = pattern
+		known["{"+p.Name+"}"] = struct{}{}
+	}
+
+	for _, arg := range t.Argv {
+		for _, p := range placeholderRegexp.FindAllString(arg, -1) {
+			if _, found := known[p]; !found {
+				return errors.Errorf("unknown placeholder %s in '%s'", p, arg)
+			}
+		}
+	}
+
+	return nil
+}
+
+// build validates the passed params and returns the command arguments.
+func (t *ToolTemplate) build(query string, params map[string]string) ([]string, error) {
+	replacements := []string{
+		PlaceholderQuery, query,
+		PlaceholderInputFile, toolInputDir + "/" + toolInputName,
+	}
+
+	declared := make(map[string]struct{}, len(t.Params))
+	for _, p := range t.Params {
+		declared[p.Name] = struct{}{}
+
+		value, passed := params[p.Name]
+		if !passed || value == "" {
+			value = p.Default
+		}
+		if value == "" {
+			return nil, errors.Wrapf(qrunner.ErrInvalidToolRun, "param %s is required", p.Name)
+		}
+		if len(value) > maxToolParamLength || !p.pattern.MatchString(value) {
+			return nil, errors.Wrapf(qrunner.ErrInvalidToolRun, "invalid value of param %s", p.Name)
+		}
+
+		replacements = append(replacements, "{"+p.Name+"}", value)
+	}
+
+	for name := range params {
+		if _, found := declared[name]; !found {
+			return nil, errors.Wrapf(qrunner.ErrInvalidToolRun, "unknown param %s", name)
+		}
+	}
+
+	// All placeholders are replaced in a single pass, so values cannot introduce new placeholders.
+	replacer := strings.NewReplacer(replacements...)
+
+	args := make([]string, 0, len(t.Argv))
+	for _, arg := range t.Argv {
+		args = append(args, replacer.Replace(arg))
+	}
+
+	return args, nil
+}
+
+func validateToolTemplates(tools []ToolTemplate) error {
+	names := make(map[string]struct{}, len(tools))
+	for i := range tools {
+		err := tools[i].validate()
+		if err != nil {
+			return errors.Wrapf(err, "tool #%d", i)
+		}
+
+		if _, exists := names[tools[i].Name]; exists {
+			return errors.Errorf("tool names must be unique, but '%s' is not unique", tools[i].Name)
+		}
+
+		names[tools[i].Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// findToolTemplate returns the tool template by name.
+func findToolTemplate(tools []ToolTemplate, name string) (*ToolTemplate, bool) {
+	for i := range tools {
+		if tools[i].Name == name {
+			return &tools[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// cappedBuffer keeps at most limit bytes and silently discards the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if rest := b.limit - b.Len(); rest < len(p) {
+		if rest > 0 {
+			b.Buffer.Write(p[:rest])
+		}
+
+		return len(p), nil
+	}
+
+	return b.Buffer.Write(p)
+}
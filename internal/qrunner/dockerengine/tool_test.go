@@ -0,0 +1,103 @@
+package dockerengine
+
+import (
+	"testing"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolTemplate_Validate(t *testing.T) {
+	cases := []struct {
+		name  string
+		tool  ToolTemplate
+		valid bool
+	}{
+		{
+			name:  "valid",
+			tool:  ToolTemplate{Name: "format", Argv: []string{"clickhouse-format", "--query", "{query}"}},
+			valid: true,
+		},
+		{
+			name:  "empty argv",
+			tool:  ToolTemplate{Name: "format"},
+			valid: false,
+		},
+		{
+			name:  "placeholder binary",
+			tool:  ToolTemplate{Name: "format", Argv: []string{"{query}"}},
+			valid: false,
+		},
+		{
+			name:  "undeclared param",
+			tool:  ToolTemplate{Name: "benchmark", Argv: []string{"clickhouse-benchmark", "-i", "{iterations}"}},
+			valid: false,
+		},
+		{
+			name: "default does not match",
+			tool: ToolTemplate{
+				Name:   "benchmark",
+				Argv:   []string{"clickhouse-benchmark", "-i", "{iterations}"},
+				Params: []ToolParam{{Name: "iterations", Pattern: `[0-9]{1,3}`, Default: "10000"}},
+			},
+			valid: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.tool.validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestToolTemplate_Build(t *testing.T) {
+	tool := ToolTemplate{
+		Name: "benchmark",
+		Argv: []string{"clickhouse-benchmark", "--iterations={iterations}", "--concurrency", "{concurrency}", "--query", "{query}"},
+		Params: []ToolParam{
+			{Name: "iterations", Pattern: `[0-9]{1,3}`, Default: "10"},
+			{Name: "concurrency", Pattern: `[1-4]`},
+		},
+	}
+	require.NoError(t, tool.validate())
+
+	args, err := tool.build("SELECT '{iterations}'", map[string]string{"concurrency": "2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"clickhouse-benchmark", "--iterations=10", "--concurrency", "2", "--query", "SELECT '{iterations}'",
+	}, args)
+
+	invalid := []map[string]string{
+		// The required param is missed.
+		{"iterations": "5"},
+		// Patterns match the whole value.
+		{"concurrency": "2; rm -rf /"},
+		{"concurrency": "2", "iterations": "1000"},
+		{"concurrency": "2", "config": "/etc/passwd"},
+	}
+	for _, params := range invalid {
+		_, err := tool.build("SELECT 1", params)
+		assert.ErrorIs(t, err, qrunner.ErrInvalidToolRun, params)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{limit: 5}
+
+	n, err := b.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = b.Write([]byte("defgh"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "abcde", b.String())
+}
@@ -0,0 +1,162 @@
+package dockerengine
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+)
+
+// allocateWarmPool distributes the budget of warm containers across versions.
+// Pinned versions are served first, then every popular version gets MinPerVersion containers
+// in the order of popularity, and the rest is distributed proportionally to popularity within MaxPerVersion.
+func allocateWarmPool(popularity map[string]float64, budget uint, cfg WarmPoolConfig) map[string]uint {
+	allocation := make(map[string]uint)
+	remaining := budget
+
+	pinned := make([]string, 0, len(cfg.Pinned))
+	for version := range cfg.Pinned {
+		pinned = append(pinned, version)
+	}
+	sort.Strings(pinned)
+
+	for _, version := range pinned {
+		count := minUint(cfg.Pinned[version], remaining)
+		if count == 0 {
+			continue
+		}
+
+		allocation[version] = count
+		remaining -= count
+	}
+
+	candidates := make([]string, 0, len(popularity))
+	for version, p := range popularity {
+		if _, isPinned := cfg.Pinned[version]; isPinned || p <= 0 {
+			continue
+		}
+
+		candidates = append(candidates, version)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		pi, pj := popularity[candidates[i]], popularity[candidates[j]]
+		if pi != pj {
+			return pi > pj
+		}
+
+		return candidates[i] < candidates[j]
+	})
+
+	maxPerVersion := cfg.MaxPerVersion
+	if maxPerVersion == 0 {
+		maxPerVersion = budget
+	}
+
+	for _, version := range candidates {
+		count := minUint(minUint(cfg.MinPerVersion, maxPerVersion), remaining)
+		if count == 0 {
+			break
+		}
+
+		allocation[version] = count
+		remaining -= count
+	}
+
+	// Containers are given one by one to the version with the highest popularity per allocated container,
+	// which keeps the allocation proportional.
+	for ; remaining > 0; remaining-- {
+		var best string
+		var bestScore float64
+		for _, version := range candidates {
+			if allocation[version] >= maxPerVersion {
+				continue
+			}
+
+			score := popularity[version] / float64(allocation[version]+1)
+			if score > bestScore {
+				best, bestScore = version, score
+			}
+		}
+		if best == "" {
+			break
+		}
+
+		allocation[best]++
+	}
+
+	return allocation
+}
+
+func minUint(a, b uint) uint {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// warmPoolState keeps the latest warm pool allocation for the status view.
+type warmPoolState struct {
+	mu         sync.Mutex
+	allocation qrunner.WarmPoolAllocation
+}
+
+// ResizeWarmPool distributes warm containers across versions by their popularity and applies the allocation.
+// Versions that are not known by the tag storage are skipped.
+func (r *Runner) ResizeWarmPool(popularity map[string]float64) qrunner.WarmPoolAllocation {
+	versions := allocateWarmPool(popularity, r.cfg.MaxWarmContainers, r.cfg.WarmPool)
+
+	requests := make([]requestState, 0, len(versions))
+	targets := make(map[string]uint, len(versions))
+	for version, count := range versions {
+		imageTag, imageFQN, err := r.constructImageFQN(r.ctx, version)
+		if err != nil {
+			r.logger.Warn().Err(err).Str("version", version).Msg("warm pool version is skipped")
+			delete(versions, version)
+
+			continue
+		}
+
+		requests = append(requests, requestState{
+			version:  version,
+			imageTag: imageTag,
+			imageFQN: imageFQN,
+		})
+		targets[imageFQN] = count
+	}
+
+	r.prewarmer.resize(requests, targets)
+
+	allocation := qrunner.WarmPoolAllocation{
+		Runner:     r.name,
+		Budget:     r.cfg.MaxWarmContainers,
+		Versions:   versions,
+		Popularity: popularity,
+		ResizedAt:  time.Now(),
+	}
+
+	r.warmPool.mu.Lock()
+	r.warmPool.allocation = allocation
+	r.warmPool.mu.Unlock()
+
+	r.logger.Info().
+		Interface("popularity", popularity).
+		Interface("allocation", versions).
+		Uint("budget", allocation.Budget).
+		Msg("warm pool has been resized")
+
+	return allocation
+}
+
+// WarmPoolAllocation returns the latest warm pool allocation.
+func (r *Runner) WarmPoolAllocation() qrunner.WarmPoolAllocation {
+	r.warmPool.mu.Lock()
+	defer r.warmPool.mu.Unlock()
+
+	allocation := r.warmPool.allocation
+	allocation.Runner = r.name
+	allocation.Budget = r.cfg.MaxWarmContainers
+
+	return allocation
+}
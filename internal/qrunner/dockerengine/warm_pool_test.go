@@ -0,0 +1,70 @@
+package dockerengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocateWarmPool(t *testing.T) {
+	popularity := map[string]float64{
+		"23.3": 60,
+		"22.8": 30,
+		"21.8": 10,
+	}
+
+	cases := []struct {
+		name   string
+		budget uint
+		cfg    WarmPoolConfig
+		want   map[string]uint
+	}{
+		{
+			name:   "proportional",
+			budget: 10,
+			want:   map[string]uint{"23.3": 6, "22.8": 3, "21.8": 1},
+		},
+		{
+			name:   "max per version",
+			budget: 10,
+			cfg:    WarmPoolConfig{MaxPerVersion: 4},
+			want:   map[string]uint{"23.3": 4, "22.8": 4, "21.8": 2},
+		},
+		{
+			name:   "min per version",
+			budget: 4,
+			cfg:    WarmPoolConfig{MinPerVersion: 1},
+			want:   map[string]uint{"23.3": 2, "22.8": 1, "21.8": 1},
+		},
+		{
+			name:   "min per version exceeds budget",
+			budget: 3,
+			cfg:    WarmPoolConfig{MinPerVersion: 2},
+			want:   map[string]uint{"23.3": 2, "22.8": 1},
+		},
+		{
+			name:   "pinned",
+			budget: 5,
+			cfg:    WarmPoolConfig{Pinned: map[string]uint{"head": 2, "22.8": 1}},
+			want:   map[string]uint{"head": 2, "22.8": 1, "23.3": 2},
+		},
+		{
+			name:   "pinned exceeds budget",
+			budget: 2,
+			cfg:    WarmPoolConfig{Pinned: map[string]uint{"head": 3}},
+			want:   map[string]uint{"head": 2},
+		},
+		{
+			name:   "no budget",
+			budget: 0,
+			want:   map[string]uint{},
+		},
+	}
+
+	for _, tc := range cases {
+		got := allocateWarmPool(popularity, tc.budget, tc.cfg)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+
+	assert.Empty(t, allocateWarmPool(nil, 5, WarmPoolConfig{}))
+}
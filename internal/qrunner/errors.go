@@ -1,5 +1,109 @@
 package qrunner
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 var ErrNoAvailableRunners = errors.New("no available runners, try again later")
+
+// QueueRejectedError is returned when the run has not been dispatched because the queue is full
+// or the wait has timed out. It wraps ErrNoAvailableRunners.
+type QueueRejectedError struct {
+	Reason string
+
+	// RetryAfter is when the queue is expected to have room. It's 0 if it cannot be estimated.
+	RetryAfter time.Duration
+}
+
+func (e *QueueRejectedError) Error() string {
+	return e.Reason + ": " + ErrNoAvailableRunners.Error()
+}
+
+func (e *QueueRejectedError) Unwrap() error {
+	return ErrNoAvailableRunners
+}
+
+var ErrPreparationDisabled = errors.New("container preparation is disabled")
+var ErrReservationLimitExceeded = errors.New("too many prepared containers, try again later")
+
+// ErrRunnerDisconnected is returned when a runner has lost connection to its daemon.
+// The run can be safely retried later.
+var ErrRunnerDisconnected = errors.New("runner is temporarily unavailable, try again later")
+
+// ErrServerNotReady is returned when the database server has not accepted the readiness probes in time.
+// The user query is not executed then, so the run can be safely retried.
+var ErrServerNotReady = errors.New("database server has not become ready, try again later")
+
+// ServerStartupError is returned when the database server has exited or has not become ready.
+// It wraps ErrServerNotReady. Logs is a sanitized tail of the server logs which may explain the failure,
+// e.g. an invalid custom config or CPU instructions unsupported by an old image.
+type ServerStartupError struct {
+	Err  error
+	Logs string
+}
+
+func (e *ServerStartupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ServerStartupError) Unwrap() error {
+	return e.Err
+}
+
+// ErrUnknownRunner is returned when a run targets a runner that is not configured.
+var ErrUnknownRunner = errors.New("unknown runner")
+
+// ErrInvalidToolRun is returned when a tool run refers to an unknown tool or has invalid params.
+var ErrInvalidToolRun = errors.New("invalid tool run")
+
+// ErrEmulationRefused is returned when a tool that needs native execution would run under emulation,
+// and the run has not acknowledged it.
+var ErrEmulationRefused = errors.New("run under emulation has not been allowed")
+
+// ErrArchitectureUnavailable is returned when the version has no build for the architecture of the runner.
+var ErrArchitectureUnavailable = errors.New("version is not built for the architecture of the runner")
+
+// ErrSessionsUnsupported is returned when no runner can keep containers for interactive sessions.
+var ErrSessionsUnsupported = errors.New("interactive sessions are not supported")
+
+// ErrSessionClosed is returned when a query is sent to a session which container has been removed.
+var ErrSessionClosed = errors.New("session has been closed")
+
+// ErrRunNotInProgress is returned when a run is not being processed by a runner.
+var ErrRunNotInProgress = errors.New("run is not in progress")
+
+// ErrPullRateLimited is returned when the registry rejects the image pull because of its pull rate limit.
+// The run can be retried on a runner that has already pulled the image.
+var ErrPullRateLimited = errors.New("docker hub pull rate limit has been reached")
+
+// ErrImageDigestUnavailable is returned when the image a run is pinned to is neither pulled by the runner
+// nor available in the registry anymore.
+var ErrImageDigestUnavailable = errors.New("pinned image digest is not available")
+
+// MemoryLimitError is returned when the container of the run has been killed by the out-of-memory killer.
+// It's caused by the query, so the run must not be retried.
+type MemoryLimitError struct {
+	// Limit is the memory limit of the container in bytes. It's 0 if the container has no limit.
+	Limit uint64
+}
+
+func (e *MemoryLimitError) Error() string {
+	if e.Limit == 0 {
+		return "query exceeded the available memory"
+	}
+
+	return fmt.Sprintf("query exceeded the memory limit (%d MB)", e.Limit/1e6)
+}
+
+// QueryTimeoutError is returned when the query has been executed longer than the runner allows.
+// The container of the run is killed, the run must not be retried.
+type QueryTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *QueryTimeoutError) Error() string {
+	return fmt.Sprintf("query timed out after %gs", e.Timeout.Seconds())
+}
@@ -0,0 +1,101 @@
+package qrunner
+
+import "time"
+
+// Reasons of garbage collection decisions.
+const (
+	GCReasonHeld         = "held"          // the container of a failed run is held for inspection
+	GCReasonHoldExpired  = "hold_expired"  // the hold of the container has expired
+	GCReasonStopped      = "stopped"       // the container is not running
+	GCReasonNoTTL        = "no_ttl"        // running containers are not force removed
+	GCReasonWithinTTL    = "within_ttl"    // the container is younger than the TTL
+	GCReasonTTLExpired   = "ttl_expired"   // the container has outlived the TTL
+	GCReasonPaused       = "paused"        // paused containers live up to PausedContainersMaxTTL
+	GCReasonSession      = "session"       // the container serves an interactive session that has not ended yet
+	GCReasonInFlight     = "in_flight"     // the container serves a run in progress, it's removed after twice the TTL
+	GCReasonUnderCount   = "under_count"   // there are fewer images than the count threshold
+	GCReasonInBuffer     = "within_buffer" // the image is among the images kept by the count-based mode
+	GCReasonOverBuffer   = "over_buffer"   // the image exceeds the buffer of the count-based mode
+	GCReasonInUse        = "in_use"        // the image backs an existing container
+	GCReasonUnderBudget  = "under_budget"  // the size budget is met without removing the image
+	GCReasonOverBudget   = "over_budget"   // the image is removed to meet the size budget
+	GCReasonDangling     = "dangling"      // the volume is not used by any container
+	GCReasonDiskPressure = "disk_pressure" // the image is removed to bring the disk usage under the low watermark
+	GCReasonRecentlyUsed = "recently_used" // the low watermark is reached without removing the image
+)
+
+// GCReport describes a garbage collection pass of a runner: what has been removed and why the rest has been kept.
+type GCReport struct {
+	Runner     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	Inputs GCInputs
+
+	Containers []GCDecision
+
+	// ImagesByCount, ImagesBySize and ImagesByDiskPressure are decisions of image collection modes. They are empty
+	// if a mode is disabled or has not been reached in the pass. The disk pressure mode decides only once
+	// the disk usage exceeds the high watermark.
+	ImagesByCount        []GCDecision
+	ImagesBySize         []GCDecision
+	ImagesByDiskPressure []GCDecision
+
+	// Volumes are dangling volumes pruned in the pass, VolumesReclaimed is their total size (in bytes).
+	// BuildCacheReclaimed is the size of the pruned build cache. They are empty if the phases are disabled.
+	Volumes             []GCDecision
+	VolumesReclaimed    uint64
+	BuildCacheReclaimed uint64
+
+	// Error is set if the pass has failed.
+	Error string
+}
+
+// GCInputs are the thresholds the decisions are based on and the state measured during the pass.
+type GCInputs struct {
+	ContainerTTL       *time.Duration
+	PausedContainerTTL time.Duration
+
+	ImageCountThreshold *uint
+	ImageBufferSize     uint
+	ImageSizeBudget     *uint64
+
+	// ImageCount and ImageUsage are the number and the total size (in bytes) of playground images
+	// before the pass.
+	ImageCount int
+	ImageUsage uint64
+
+	// DiskHighWatermark and DiskLowWatermark are fractions of DiskCapacity, they are 0 if the disk pressure mode
+	// is disabled. DiskUsage and DiskCapacity are measured before the mode (in bytes).
+	DiskHighWatermark float64
+	DiskLowWatermark  float64
+	DiskUsage         uint64
+	DiskCapacity      uint64
+}
+
+// GCDecision tells whether a container, an image or a volume has been removed and why.
+type GCDecision struct {
+	ID string
+
+	// Names are tags of images and names of containers.
+	Names []string
+
+	Removed bool
+	Reason  string
+
+	// SizeBytes is the image size or the size of files written by the container.
+	SizeBytes uint64
+
+	// Age is measured since the creation for containers and since the last tagging for images,
+	// which is the order images are evicted in.
+	Age time.Duration
+
+	// Error is set if the removal has failed.
+	Error string
+}
+
+// GCReporter is implemented by runners that collect garbage.
+type GCReporter interface {
+	// GCReports returns reports of recent passes, the latest one goes first.
+	GCReports() []GCReport
+}
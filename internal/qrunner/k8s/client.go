@@ -0,0 +1,395 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// execProtocol is the subprotocol of exec streams: every message is prefixed with the channel byte.
+const execProtocol = "v4.channel.k8s.io"
+
+// Exec stream channels.
+const (
+	channelStdout = 1
+	channelStderr = 2
+	channelStatus = 3
+)
+
+// dialTimeout bounds establishing connections to the API server.
+const dialTimeout = 10 * time.Second
+
+// apiError is returned when the API server rejects a request.
+type apiError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("kubernetes api error %d (%s): %s", e.Code, e.Reason, e.Message)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// client is a minimal client of the core API, it manages pods of a single namespace.
+type client struct {
+	baseURL   *url.URL
+	namespace string
+	tokenPath string
+	tlsConfig *tls.Config
+	http      *http.Client
+}
+
+func newClient(cfg Config) (*client, error) {
+	server := cfg.APIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("api server is not set, and the runner is not in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	baseURL, err := url.Parse(server)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid api server url")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAPath != "" && baseURL.Scheme == "https" {
+		ca, err := os.ReadFile(cfg.CAPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA bundle")
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("CA bundle has no certificates")
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &client{
+		baseURL:   baseURL,
+		namespace: cfg.Namespace,
+		tokenPath: cfg.TokenPath,
+		tlsConfig: tlsConfig,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// podsURL returns the url of the pods collection or of the pod if the name is set.
+func (c *client) podsURL(name string, subresource string, query url.Values) *url.URL {
+	path := "/api/v1/namespaces/" + url.PathEscape(c.namespace) + "/pods"
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	if subresource != "" {
+		path += "/" + subresource
+	}
+
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	return u
+}
+
+// token reads the token every time, since service account tokens are rotated.
+func (c *client) token() (string, error) {
+	if c.tokenPath == "" {
+		return "", nil
+	}
+
+	token, err := os.ReadFile(c.tokenPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read token")
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
+
+// send makes the request and returns the response of a successful one. The body of a failed one is decoded
+// into apiError.
+func (c *client) send(ctx context.Context, method string, u *url.URL, body interface{}) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode request")
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	token, err := c.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+
+		apiErr := &apiError{Code: resp.StatusCode}
+		var status apiStatus
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, &status) == nil && status.Message != "" {
+			apiErr.Reason, apiErr.Message = status.Reason, status.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+func (c *client) do(ctx context.Context, method string, u *url.URL, body, out interface{}) error {
+	resp, err := c.send(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "failed to decode response")
+}
+
+// ping checks that the namespace is reachable with the granted permissions.
+func (c *client) ping(ctx context.Context) error {
+	var list podList
+	return c.do(ctx, http.MethodGet, c.podsURL("", "", url.Values{"limit": {"1"}}), nil, &list)
+}
+
+func (c *client) createPod(ctx context.Context, p *pod) error {
+	return c.do(ctx, http.MethodPost, c.podsURL("", "", nil), p, nil)
+}
+
+// deletePod removes the pod without a grace period. A missing pod is not an error.
+func (c *client) deletePod(ctx context.Context, name string) error {
+	err := c.do(ctx, http.MethodDelete, c.podsURL(name, "", url.Values{"gracePeriodSeconds": {"0"}}), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (c *client) listPods(ctx context.Context, labelSelector string) ([]pod, error) {
+	var list podList
+	err := c.do(ctx, http.MethodGet, c.podsURL("", "", url.Values{"labelSelector": {labelSelector}}), nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// watchPod watches the pod until check reports it's done or fails. A watch without a resource version
+// starts with the current state of the pod, so a change made before the watch is not missed.
+func (c *client) watchPod(ctx context.Context, name string, check func(p *pod) (bool, error)) error {
+	query := url.Values{
+		"watch":         {"1"},
+		"fieldSelector": {"metadata.name=" + name},
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		query.Set("timeoutSeconds", strconv.Itoa(int(time.Until(deadline).Seconds())+1))
+	}
+
+	resp, err := c.send(ctx, http.MethodGet, c.podsURL("", "", query), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		err := decoder.Decode(&event)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return errors.New("watch has been closed by the api server")
+			}
+
+			return errors.Wrap(err, "failed to read watch event")
+		}
+
+		switch event.Type {
+		case watchEventError:
+			var status apiStatus
+			_ = json.Unmarshal(event.Object, &status)
+			return &apiError{Code: status.Code, Reason: status.Reason, Message: status.Message}
+
+		case watchEventDeleted:
+			return errors.New("pod has been deleted")
+		}
+
+		var p pod
+		err = json.Unmarshal(event.Object, &p)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode pod")
+		}
+
+		done, err := check(&p)
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// exec runs the command in the container of the pod and copies its streams. Once a write fails,
+// the stream is closed, so the command dies of the broken pipe, and the write error is returned.
+func (c *client) exec(ctx context.Context, name string, cmd []string, stdout, stderr io.Writer) (exitCode int, err error) {
+	query := url.Values{
+		"container": {containerName},
+		"stdout":    {"true"},
+		"stderr":    {"true"},
+		"command":   cmd,
+	}
+	u := c.podsURL(name, "exec", query)
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+
+	config, err := websocket.NewConfig(u.String(), c.baseURL.String())
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid exec url")
+	}
+	config.Protocol = []string{execProtocol}
+	config.TlsConfig = c.tlsConfig
+	config.Dialer = &net.Dialer{Timeout: dialTimeout}
+
+	token, err := c.token()
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		config.Header = http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open exec stream")
+	}
+	defer conn.Close()
+
+	// The connection is closed once the context is done, so the read below is interrupted.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(conn, &msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return 0, errors.New("exec stream has been closed without a status")
+			}
+
+			return 0, errors.Wrap(err, "failed to read exec stream")
+		}
+		if len(msg) == 0 {
+			continue
+		}
+
+		data := msg[1:]
+		switch msg[0] {
+		case channelStdout:
+			_, err = stdout.Write(data)
+		case channelStderr:
+			_, err = stderr.Write(data)
+		case channelStatus:
+			return execExitCode(data)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// execExitCode returns the exit code reported by the status channel.
+func execExitCode(data []byte) (int, error) {
+	var status apiStatus
+	err := json.Unmarshal(data, &status)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to decode exec status")
+	}
+
+	if status.Status != statusFailure {
+		return 0, nil
+	}
+	if status.Reason != statusReasonNonZeroExit || status.Details == nil {
+		return 0, errors.Errorf("exec failed: %s", status.Message)
+	}
+
+	for _, cause := range status.Details.Causes {
+		if cause.Reason == statusCauseExitCode {
+			code, err := strconv.Atoi(cause.Message)
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid exit code %s", cause.Message)
+			}
+
+			return code, nil
+		}
+	}
+
+	return 0, errors.Errorf("exec failed without an exit code: %s", status.Message)
+}
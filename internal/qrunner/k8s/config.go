@@ -0,0 +1,78 @@
+package k8s
+
+import (
+	"time"
+)
+
+// serviceAccountDir keeps the credentials mounted into pods with a service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type Config struct {
+	// APIServer is the base url of the Kubernetes API, e.g. https://10.0.0.1:443. If it's empty,
+	// the in-cluster address from KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT is used.
+	APIServer string
+
+	// TokenPath is the file with the bearer token. It's read before every request, so a rotated token is picked up.
+	// If it's empty, requests are not authenticated.
+	TokenPath string
+
+	// CAPath is the CA bundle the API server certificate is verified with. If it's empty, system roots are used.
+	CAPath string
+
+	// Namespace the pods of runs are created in.
+	Namespace string
+
+	// ImagePullSecrets are names of secrets in Namespace used to pull images.
+	ImagePullSecrets []string
+
+	// NodeSelector constrains nodes the pods can be scheduled on.
+	NodeSelector map[string]string
+
+	Resources Resources
+
+	DefaultOutputFormat string
+
+	// MaxExecutionTime bounds the query execution. If 0, the query is bounded by the run deadline only.
+	MaxExecutionTime time.Duration
+
+	// MaxOutputBytes bounds the output of a run kept in memory. Once it's reached, the exec stream is closed,
+	// and the result is marked as truncated. If 0, the output is unlimited.
+	MaxOutputBytes uint64
+
+	// ReadinessTimeout bounds the time the pod is scheduled, the image is pulled and the server becomes ready in.
+	ReadinessTimeout time.Duration
+
+	GC *GCConfig
+}
+
+// Resources are the requests and limits of the database container in Kubernetes quantities, e.g. 500m or 2Gi.
+// Empty values are not set.
+type Resources struct {
+	CPURequest    string
+	CPULimit      string
+	MemoryRequest string
+	MemoryLimit   string
+}
+
+type GCConfig struct {
+	// How often GC will be triggered.
+	TriggerFrequency time.Duration
+
+	// PodTTL is the age pods are considered leaked at, unless their runs are still in progress.
+	// It also bounds the lifetime of pods by activeDeadlineSeconds, so pods are stopped even if the runner is gone.
+	PodTTL time.Duration
+}
+
+var DefaultConfig = Config{
+	TokenPath: serviceAccountDir + "/token",
+	CAPath:    serviceAccountDir + "/ca.crt",
+
+	DefaultOutputFormat: "TabSeparated",
+
+	ReadinessTimeout: 3 * time.Minute,
+
+	GC: &GCConfig{
+		TriggerFrequency: 5 * time.Minute,
+		PodTTL:           30 * time.Minute,
+	},
+}
@@ -0,0 +1,121 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/rs/zerolog"
+)
+
+// garbageCollector removes pods leaked by the runner, e.g. if it has been restarted in the middle of a run.
+// Pods are found by the labels of the runner, so pods of other runners sharing the namespace are kept.
+type garbageCollector struct {
+	ctx context.Context
+
+	logger zerolog.Logger
+	runner string
+
+	cfg    *GCConfig
+	client *client
+	active *activePods
+	metr   *metrics.RunnerGCExporter
+
+	now func() time.Time
+}
+
+func newGarbageCollector(
+	ctx context.Context,
+	logger zerolog.Logger,
+	runner string,
+	cfg *GCConfig,
+	client *client,
+	active *activePods,
+) *garbageCollector {
+	return &garbageCollector{
+		ctx:    ctx,
+		logger: logger,
+		runner: runner,
+		cfg:    cfg,
+		client: client,
+		active: active,
+		metr:   metrics.NewRunnerGCExporter(string(qrunner.TypeKubernetes), runner),
+		now:    time.Now,
+	}
+}
+
+func (g *garbageCollector) start() {
+	if g.cfg == nil {
+		g.logger.Info().Msg("garbage collector is disabled due to a missed configuration")
+		return
+	}
+
+	g.logger.Info().Dur("trigger_frequency", g.cfg.TriggerFrequency).Msg("gc has been started")
+	defer g.logger.Info().Msg("gc has been finished")
+
+	trigger := func() {
+		count, err := g.collectPods()
+		if err != nil {
+			g.logger.Err(err).Msg("gc trigger failed")
+		}
+		if count > 0 {
+			g.logger.Info().Uint("count", count).Msg("leaked pods have been collected")
+		}
+	}
+
+	trigger()
+
+	t := time.NewTicker(g.cfg.TriggerFrequency)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+
+		case <-t.C:
+		}
+
+		trigger()
+	}
+}
+
+// labelSelector matches pods created by the runner.
+func (g *garbageCollector) labelSelector() string {
+	return qrunner.LabelOwnership + "=1," + qrunner.LabelRunner + "=" + labelValue(g.runner)
+}
+
+// collectPods deletes pods older than the TTL unless their runs are in progress.
+// A failed deletion doesn't stop the pass, the pod is tried again by the next one.
+func (g *garbageCollector) collectPods() (count uint, err error) {
+	startedAt := time.Now()
+	defer func() {
+		g.metr.ContainersCollected(count, 0, startedAt)
+	}()
+
+	pods, err := g.client.listPods(g.ctx, g.labelSelector())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pods {
+		name := p.Metadata.Name
+		createdAt := p.Metadata.CreationTimestamp
+		if createdAt == nil || g.now().Sub(*createdAt) < g.cfg.PodTTL || g.active.has(name) {
+			continue
+		}
+
+		err := g.client.deletePod(g.ctx, name)
+		if err != nil {
+			g.logger.Error().Err(err).Str("pod", name).Msg("failed to delete leaked pod")
+			continue
+		}
+
+		g.logger.Debug().Str("pod", name).Time("created_at", *createdAt).Msg("leaked pod has been deleted")
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,282 @@
+package k8s
+
+import (
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	containerName = "clickhouse"
+
+	podNamePrefix = "chp-"
+
+	// maxLabelValueLength is the max length of a label value accepted by Kubernetes.
+	maxLabelValueLength = 63
+
+	// httpPort is the port of the HTTP interface the readiness probe is sent to.
+	httpPort = 8123
+)
+
+// Values of object fields and statuses returned by the API.
+const (
+	podPhaseSucceeded = "Succeeded"
+	podPhaseFailed    = "Failed"
+
+	reasonErrImagePull      = "ErrImagePull"
+	reasonImagePullBackOff  = "ImagePullBackOff"
+	reasonInvalidImageName  = "InvalidImageName"
+	conditionReady          = "Ready"
+	conditionStatusTrue     = "True"
+	restartPolicyNever      = "Never"
+	watchEventError         = "ERROR"
+	watchEventDeleted       = "DELETED"
+	statusFailure           = "Failure"
+	statusReasonNonZeroExit = "NonZeroExitCode"
+	statusCauseExitCode     = "ExitCode"
+)
+
+// The subset of Kubernetes objects used by the runner.
+type (
+	pod struct {
+		APIVersion string     `json:"apiVersion,omitempty"`
+		Kind       string     `json:"kind,omitempty"`
+		Metadata   objectMeta `json:"metadata"`
+		Spec       *podSpec   `json:"spec,omitempty"`
+		Status     *podStatus `json:"status,omitempty"`
+	}
+
+	podList struct {
+		Items []pod `json:"items"`
+	}
+
+	objectMeta struct {
+		Name              string            `json:"name,omitempty"`
+		Namespace         string            `json:"namespace,omitempty"`
+		Labels            map[string]string `json:"labels,omitempty"`
+		CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+	}
+
+	podSpec struct {
+		Containers                   []container            `json:"containers"`
+		RestartPolicy                string                 `json:"restartPolicy,omitempty"`
+		NodeSelector                 map[string]string      `json:"nodeSelector,omitempty"`
+		ImagePullSecrets             []localObjectReference `json:"imagePullSecrets,omitempty"`
+		AutomountServiceAccountToken *bool                  `json:"automountServiceAccountToken,omitempty"`
+		EnableServiceLinks           *bool                  `json:"enableServiceLinks,omitempty"`
+		ActiveDeadlineSeconds        *int64                 `json:"activeDeadlineSeconds,omitempty"`
+	}
+
+	localObjectReference struct {
+		Name string `json:"name"`
+	}
+
+	container struct {
+		Name           string               `json:"name"`
+		Image          string               `json:"image"`
+		Resources      resourceRequirements `json:"resources"`
+		ReadinessProbe *probe               `json:"readinessProbe,omitempty"`
+	}
+
+	resourceRequirements struct {
+		Requests map[string]string `json:"requests,omitempty"`
+		Limits   map[string]string `json:"limits,omitempty"`
+	}
+
+	probe struct {
+		HTTPGet          *httpGetAction `json:"httpGet,omitempty"`
+		PeriodSeconds    int            `json:"periodSeconds,omitempty"`
+		FailureThreshold int            `json:"failureThreshold,omitempty"`
+	}
+
+	httpGetAction struct {
+		Path string `json:"path"`
+		Port int    `json:"port"`
+	}
+
+	podStatus struct {
+		Phase             string            `json:"phase,omitempty"`
+		Reason            string            `json:"reason,omitempty"`
+		Message           string            `json:"message,omitempty"`
+		Conditions        []podCondition    `json:"conditions,omitempty"`
+		ContainerStatuses []containerStatus `json:"containerStatuses,omitempty"`
+	}
+
+	podCondition struct {
+		Type   string `json:"type"`
+		Status string `json:"status"`
+	}
+
+	containerStatus struct {
+		Name  string         `json:"name"`
+		State containerState `json:"state"`
+	}
+
+	containerState struct {
+		Waiting *struct {
+			Reason  string `json:"reason,omitempty"`
+			Message string `json:"message,omitempty"`
+		} `json:"waiting,omitempty"`
+	}
+
+	// apiStatus is returned by failed requests and by the status channel of execs.
+	apiStatus struct {
+		Status  string `json:"status,omitempty"`
+		Message string `json:"message,omitempty"`
+		Reason  string `json:"reason,omitempty"`
+		Code    int    `json:"code,omitempty"`
+		Details *struct {
+			Causes []struct {
+				Reason  string `json:"reason,omitempty"`
+				Message string `json:"message,omitempty"`
+			} `json:"causes,omitempty"`
+		} `json:"details,omitempty"`
+	}
+)
+
+// podNameEncoding encodes run ids with lowercase letters and digits only, as pod names must be DNS subdomains.
+// Run ids may contain '_' and end with '-', and lowercasing them could make distinct ids collide.
+var podNameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// podName returns the name of the pod of the run. Distinct run ids always give distinct names.
+func podName(runID string) string {
+	return podNamePrefix + strings.ToLower(podNameEncoding.EncodeToString([]byte(runID)))
+}
+
+// podLabels returns the container labels of the run with values Kubernetes accepts.
+func podLabels(runnerName, runID, version, clientID string) map[string]string {
+	labels := qrunner.CreateContainerLabels(runnerName, runID, version, clientID)
+	for k, v := range labels {
+		labels[k] = labelValue(v)
+	}
+
+	return labels
+}
+
+// labelValue replaces characters that are not allowed in label values (e.g. colons of IPv6 client addresses)
+// and cuts the value to the max length. Values must start and end with an alphanumeric character.
+func labelValue(v string) string {
+	value := []byte(v)
+	for i, c := range value {
+		if !isAlphanumeric(c) && c != '-' && c != '_' && c != '.' {
+			value[i] = '-'
+		}
+	}
+	if len(value) > maxLabelValueLength {
+		value = value[:maxLabelValueLength]
+	}
+
+	// All the bytes are ASCII after the replacement.
+	return strings.TrimFunc(string(value), func(r rune) bool {
+		return !isAlphanumeric(byte(r))
+	})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// buildPod returns the pod of the run. The server is ready once it responds to /ping,
+// and the pod is never restarted, so a crashed server fails the run.
+func (r *Runner) buildPod(runID, version, clientID, image string) *pod {
+	requests := make(map[string]string)
+	limits := make(map[string]string)
+	setQuantity(requests, "cpu", r.cfg.Resources.CPURequest)
+	setQuantity(requests, "memory", r.cfg.Resources.MemoryRequest)
+	setQuantity(limits, "cpu", r.cfg.Resources.CPULimit)
+	setQuantity(limits, "memory", r.cfg.Resources.MemoryLimit)
+
+	disabled := false
+	spec := &podSpec{
+		Containers: []container{{
+			Name:      containerName,
+			Image:     image,
+			Resources: resourceRequirements{Requests: requests, Limits: limits},
+			ReadinessProbe: &probe{
+				HTTPGet:          &httpGetAction{Path: "/ping", Port: httpPort},
+				PeriodSeconds:    1,
+				FailureThreshold: 1,
+			},
+		}},
+		RestartPolicy:                restartPolicyNever,
+		NodeSelector:                 r.cfg.NodeSelector,
+		AutomountServiceAccountToken: &disabled,
+		EnableServiceLinks:           &disabled,
+	}
+	for _, secret := range r.cfg.ImagePullSecrets {
+		spec.ImagePullSecrets = append(spec.ImagePullSecrets, localObjectReference{Name: secret})
+	}
+	if r.cfg.GC != nil && r.cfg.GC.PodTTL > 0 {
+		deadline := int64(r.cfg.GC.PodTTL.Seconds())
+		spec.ActiveDeadlineSeconds = &deadline
+	}
+
+	return &pod{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Metadata: objectMeta{
+			Name:      podName(runID),
+			Namespace: r.cfg.Namespace,
+			Labels:    podLabels(r.name, runID, version, clientID),
+		},
+		Spec: spec,
+	}
+}
+
+func setQuantity(resources map[string]string, name, quantity string) {
+	if quantity != "" {
+		resources[name] = quantity
+	}
+}
+
+// podReadiness reports whether the server of the pod is ready. An error is returned if the pod cannot become ready,
+// e.g. its image cannot be pulled.
+func podReadiness(p *pod) (bool, error) {
+	if p.Status == nil {
+		return false, nil
+	}
+
+	if p.Status.Phase == podPhaseFailed || p.Status.Phase == podPhaseSucceeded {
+		return false, errors.Errorf("pod has terminated in phase %s: %s %s", p.Status.Phase, p.Status.Reason, p.Status.Message)
+	}
+
+	for _, cs := range p.Status.ContainerStatuses {
+		w := cs.State.Waiting
+		if w == nil {
+			continue
+		}
+
+		switch w.Reason {
+		case reasonErrImagePull, reasonImagePullBackOff, reasonInvalidImageName:
+			if isPullRateLimited(w.Message) {
+				return false, errors.Wrapf(qrunner.ErrPullRateLimited, "image pull failed: %s", w.Message)
+			}
+
+			return false, &qrunner.DependencyError{
+				Dependency: qrunner.DependencyRegistry,
+				Err:        errors.Errorf("image pull failed: %s: %s", w.Reason, w.Message),
+			}
+		}
+	}
+
+	for _, c := range p.Status.Conditions {
+		if c.Type == conditionReady && c.Status == conditionStatusTrue {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isPullRateLimited reports whether the kubelet has been rejected by the registry because of its rate limit.
+func isPullRateLimited(msg string) bool {
+	msg = strings.ToLower(msg)
+
+	return strings.Contains(msg, "toomanyrequests") ||
+		strings.Contains(msg, "429 too many requests") ||
+		strings.Contains(msg, "pull rate limit")
+}
@@ -0,0 +1,502 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/database"
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/pkg/chsemver"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+type ImageStorage interface {
+	Find(version string) (dockertag.Image, bool)
+}
+
+// execTimeoutGrace is the time the server is given to abort the query by max_execution_time
+// before the exec is cancelled.
+const execTimeoutGrace = 2 * time.Second
+
+// errOutputLimitReached stops reading the exec stream once the output limit of the run is reached.
+var errOutputLimitReached = errors.New("output limit reached")
+
+// Runner is a runner that executes runs in pods of a Kubernetes cluster. Every run gets a pod with the server
+// of the requested version, queries are executed by clickhouse-client in the pod, and the pod is removed
+// once the run is finished. The runner is stateless, pods are neither prewarmed nor reserved.
+type Runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// cleanupCtx outlives the runner context, so pods of runs finished during the shutdown are removed.
+	cleanupCtx context.Context
+
+	name   string
+	cfg    Config
+	logger zerolog.Logger
+
+	client     *client
+	tagStorage ImageStorage
+
+	active *activePods
+	gc     *garbageCollector
+	tasks  *qrunner.TaskGroup
+
+	pipelineMetr *metrics.PipelineExporter
+}
+
+func New(ctx context.Context, logger zerolog.Logger, name string, cfg Config, tagStorage ImageStorage) (*Runner, error) {
+	if cfg.Namespace == "" {
+		return nil, errors.New("namespace is required")
+	}
+
+	cli, err := newClient(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes client")
+	}
+
+	logger = logger.With().Str("runner", name).Logger()
+	ctx, cancel := context.WithCancel(ctx)
+	active := newActivePods()
+
+	return &Runner{
+		ctx:          ctx,
+		cancel:       cancel,
+		cleanupCtx:   context.WithoutCancel(ctx),
+		name:         name,
+		cfg:          cfg,
+		logger:       logger,
+		client:       cli,
+		tagStorage:   tagStorage,
+		active:       active,
+		gc:           newGarbageCollector(ctx, logger, name, cfg.GC, cli, active),
+		tasks:        qrunner.NewTaskGroup(logger, "runner-"+name),
+		pipelineMetr: metrics.NewPipelineExporter(string(qrunner.TypeKubernetes), name),
+	}, nil
+}
+
+func (r *Runner) Type() qrunner.Type {
+	return qrunner.TypeKubernetes
+}
+
+func (r *Runner) Name() string {
+	return r.name
+}
+
+// Status checks that the API server is reachable, and pods of the namespace can be listed.
+func (r *Runner) Status(ctx context.Context) qrunner.RunnerStatus {
+	err := r.client.ping(ctx)
+
+	return qrunner.RunnerStatus{
+		Alive:            err == nil,
+		LivenessProbeErr: err,
+	}
+}
+
+// Start runs the garbage collector of leaked pods.
+func (r *Runner) Start() error {
+	r.tasks.Go("gc", r.gc.start)
+
+	r.logger.Info().Str("namespace", r.cfg.Namespace).Msg("runner has been started")
+
+	return nil
+}
+
+func (r *Runner) Stop(shutdownCtx context.Context) error {
+	r.logger.Info().Msg("stopping")
+
+	r.cancel()
+	err := r.tasks.Wait(shutdownCtx)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Info().Msg("runner has been stopped")
+
+	return nil
+}
+
+// Prepare is not supported, pods are created per run.
+func (r *Runner) Prepare(_ context.Context, _ *queryrun.Run) (qrunner.Reservation, error) {
+	return qrunner.Reservation{}, qrunner.ErrPreparationDisabled
+}
+
+func (r *Runner) RunQuery(ctx context.Context, run *queryrun.Run) (res qrunner.Result, err error) {
+	if run.Tool != "" {
+		return qrunner.Result{}, errors.Wrap(qrunner.ErrInvalidToolRun, "tools are not supported by kubernetes runners")
+	}
+	if len(run.Files) > 0 {
+		return qrunner.Result{}, errors.New("files are not supported by kubernetes runners")
+	}
+	if run.Settings == nil || run.Settings.Type() != database.TypeClickHouse {
+		return qrunner.Result{}, errors.New("only clickhouse runs are supported by kubernetes runners")
+	}
+
+	image, err := r.image(run)
+	if err != nil {
+		return qrunner.Result{}, fmt.Errorf("failed to construct image name: %w", err)
+	}
+
+	name := podName(run.ID)
+	r.active.add(name)
+	defer r.active.remove(name)
+
+	startedAt := time.Now()
+	err = r.client.createPod(ctx, r.buildPod(run.ID, run.Version, run.ClientID, image))
+	r.pipelineMetr.CreateContainer(err == nil, run.Version, startedAt)
+	if err != nil {
+		return qrunner.Result{}, daemonFailure(errors.Wrap(err, "failed to create pod"))
+	}
+	run.Timeline.Record(queryrun.StageContainerCreate, startedAt)
+
+	// The pod is removed even if the run is cancelled, the cleanup context is not bound to the run.
+	defer func() {
+		startedAt := time.Now()
+		err := r.client.deletePod(r.cleanupCtx, name)
+		r.pipelineMetr.RemoveContainer(err == nil, run.Version, startedAt)
+		run.Timeline.Record(queryrun.StageCleanup, startedAt)
+		if err != nil {
+			r.logger.Error().Err(err).Str("run_id", run.ID).Str("pod", name).Msg("failed to delete pod, it will be collected by gc")
+		}
+	}()
+
+	err = r.waitForPod(ctx, run, name)
+	if err != nil {
+		return qrunner.Result{}, err
+	}
+
+	return r.runQuery(ctx, run, name)
+}
+
+// image returns the image of the run. Pinned runs are executed on the image they have been executed on before.
+func (r *Runner) image(run *queryrun.Run) (string, error) {
+	if run.PinnedImage {
+		repository, err := qrunner.ParseRepositoryRef(run.ImageRepository)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid repository")
+		}
+
+		return qrunner.DigestImageName(repository, run.ImageDigest), nil
+	}
+
+	img, found := r.tagStorage.Find(run.Version)
+	if !found {
+		return "", errors.New("version not found")
+	}
+
+	repository, err := qrunner.ParseRepositoryRef(img.Repository)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid repository")
+	}
+
+	return qrunner.FullImageName(repository, run.Version), nil
+}
+
+// waitForPod waits until the pod is scheduled, its image is pulled, and the server responds to the readiness probe.
+// It fails with qrunner.ErrServerNotReady if the pod is not ready by the readiness timeout.
+func (r *Runner) waitForPod(ctx context.Context, run *queryrun.Run, name string) error {
+	timeout := r.cfg.ReadinessTimeout
+	if run.Deadlines != nil && run.Deadlines.ReadinessTimeout > 0 {
+		timeout = run.Deadlines.ReadinessTimeout
+	}
+
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	startedAt := time.Now()
+	var readinessErr error
+	err := r.client.watchPod(waitCtx, name, func(p *pod) (bool, error) {
+		ready, err := podReadiness(p)
+		readinessErr = err
+
+		return ready, err
+	})
+	switch {
+	case err == nil:
+		run.Timeline.Record(queryrun.StageReadiness, startedAt)
+		r.pipelineMetr.Readiness(chsemver.Series(run.Version), 1, startedAt)
+
+		return nil
+
+	case readinessErr != nil:
+		var depErr *qrunner.DependencyError
+		if errors.As(readinessErr, &depErr) || errors.Is(readinessErr, qrunner.ErrPullRateLimited) {
+			return readinessErr
+		}
+
+		return errors.Wrap(qrunner.ErrServerNotReady, readinessErr.Error())
+
+	case ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded):
+		r.logger.Warn().Str("run_id", run.ID).Dur("timeout", timeout).Msg("pod is not ready by the readiness timeout")
+		return qrunner.ErrServerNotReady
+
+	case ctx.Err() != nil:
+		return ctx.Err()
+
+	default:
+		return daemonFailure(errors.Wrap(err, "failed to watch pod"))
+	}
+}
+
+// runQuery executes the query or the statements of the run in the pod. The server version is queried first,
+// so it's reported like by other runners.
+func (r *Runner) runQuery(ctx context.Context, run *queryrun.Run, name string) (res qrunner.Result, err error) {
+	invokedAt := time.Now()
+	defer func() {
+		if errors.Is(err, context.Canceled) {
+			r.pipelineMetr.RunQueryCanceled(run.Version, invokedAt)
+			return
+		}
+
+		var timeoutErr *qrunner.QueryTimeoutError
+		if errors.As(err, &timeoutErr) {
+			r.pipelineMetr.RunQueryTimedOut(run.Version, invokedAt)
+			return
+		}
+
+		r.pipelineMetr.RunQuery(err == nil, run.Version, invokedAt)
+	}()
+
+	probe, err := r.exec(ctx, name, run.Version, qrunner.ServerVersionQuery, &runsettings.ClickHouseSettings{OutputFormat: "TabSeparated"}, nil, newOutputLimit(0))
+	if err != nil {
+		return qrunner.Result{}, daemonFailure(errors.Wrap(err, "failed to query server version"))
+	}
+	if !qrunner.CheckIfClickHouseIsReady(probe) {
+		return qrunner.Result{}, errors.Wrap(qrunner.ErrServerNotReady, probe.Stderr)
+	}
+	serverVersion := strings.TrimSpace(probe.Stdout)
+
+	execCtx := ctx
+	if r.cfg.MaxExecutionTime > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, r.cfg.MaxExecutionTime+execTimeoutGrace)
+		defer cancel()
+	}
+
+	limit := newOutputLimit(r.cfg.MaxOutputBytes)
+
+	startedAt := time.Now()
+	if len(run.Statements) > 0 {
+		res, err = r.execStatements(execCtx, run, name, limit)
+	} else {
+		res, err = r.exec(execCtx, name, run.Version, run.Input, run.Settings, run.OutputStream, limit)
+	}
+	if err != nil {
+		// Only the runner limit is reported as the timeout, the caller's deadline is handled by the caller.
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return qrunner.Result{}, &qrunner.QueryTimeoutError{Timeout: r.cfg.MaxExecutionTime}
+		}
+		if ctx.Err() != nil {
+			return qrunner.Result{}, ctx.Err()
+		}
+
+		return qrunner.Result{}, daemonFailure(errors.Wrap(err, "failed to run query"))
+	}
+	run.Timeline.Record(queryrun.StageExec, startedAt)
+
+	if res.Truncated {
+		res.DroppedBytes = limit.dropped
+		r.pipelineMetr.TruncatedOutput(run.Version)
+	}
+
+	run.ServerVersion = serverVersion
+	run.VersionMismatch = qrunner.IsServerVersionMismatch(run.Version, serverVersion)
+	if run.VersionMismatch {
+		run.Warn(queryrun.WarningVersionMismatch,
+			fmt.Sprintf("the server reports version %s, which does not match the image tag %s", serverVersion, run.Version),
+			map[string]string{"server_version": serverVersion})
+		r.pipelineMetr.ServerVersionMismatch(run.Version)
+	}
+
+	return res, nil
+}
+
+// execStatements executes the statements one by one in the pod of the run, so they share the server
+// and its tables. The run is stopped at the first failed statement unless it continues on errors.
+// The combined result has the exit code of the first failed statement.
+func (r *Runner) execStatements(ctx context.Context, run *queryrun.Run, name string, limit *outputLimit) (qrunner.Result, error) {
+	var stdout, stderr strings.Builder
+	var exitCode int
+	var truncated bool
+	for i := range run.Statements {
+		if exitCode != 0 && !run.ContinueOnError {
+			break
+		}
+
+		statement := &run.Statements[i]
+
+		startedAt := time.Now()
+		res, err := r.exec(ctx, name, run.Version, statement.Query, run.Settings, run.OutputStream, limit)
+		if err != nil {
+			return qrunner.Result{}, errors.Wrapf(err, "statement %d failed", i+1)
+		}
+
+		statement.Executed = true
+		statement.Stdout = res.Stdout
+		statement.Stderr = res.Stderr
+		statement.ExitCode = res.ExitCode
+		statement.Elapsed = time.Since(startedAt)
+
+		stdout.WriteString(res.Stdout)
+		stderr.WriteString(res.Stderr)
+		if exitCode == 0 {
+			exitCode = res.ExitCode
+		}
+
+		// The output of the run is exhausted, so the remaining statements are not executed.
+		if res.Truncated {
+			truncated = true
+			break
+		}
+	}
+
+	return qrunner.Result{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: exitCode, Truncated: truncated}, nil
+}
+
+// exec runs clickhouse-client with the query in the pod.
+func (r *Runner) exec(
+	ctx context.Context,
+	name string,
+	version string,
+	query string,
+	settings runsettings.RunSettings,
+	outputStream io.Writer,
+	limit *outputLimit,
+) (res qrunner.Result, err error) {
+	invokedAt := time.Now()
+	defer func() {
+		r.pipelineMetr.ExecCommand(err == nil, version, invokedAt)
+	}()
+
+	chSettings, ok := settings.(*runsettings.ClickHouseSettings)
+	if !ok {
+		return qrunner.Result{}, errors.Errorf("invalid settings for type %s", settings.Type())
+	}
+
+	args := []string{"clickhouse", "client", "-n", "-m", "--query", query}
+	args = append(args, chSettings.FormatArgs(version, r.cfg.DefaultOutputFormat)...)
+	if r.cfg.MaxExecutionTime > 0 {
+		args = append(args, "--max_execution_time", fmt.Sprint(int64(r.cfg.MaxExecutionTime.Seconds())))
+	}
+
+	var outBuf, errBuf bytes.Buffer
+	var stdout io.Writer = &outBuf
+	if outputStream != nil {
+		stdout = io.MultiWriter(&outBuf, outputStream)
+	}
+
+	exitCode, err := r.client.exec(ctx, name, args, limit.writer(stdout), limit.writer(&errBuf))
+	if errors.Is(err, errOutputLimitReached) {
+		// The stream is closed, so the client dies of the broken pipe, and its exit code is not known.
+		return qrunner.Result{Stdout: outBuf.String(), Stderr: errBuf.String(), Truncated: true}, nil
+	}
+	if err != nil {
+		return qrunner.Result{}, errors.Wrap(err, "exec failed")
+	}
+
+	return qrunner.Result{Stdout: outBuf.String(), Stderr: errBuf.String(), ExitCode: exitCode}, nil
+}
+
+// daemonFailure marks the error as caused by the API server, so it's counted by the daemon circuit breaker.
+func daemonFailure(err error) error {
+	var depErr *qrunner.DependencyError
+	if errors.As(err, &depErr) {
+		return err
+	}
+
+	return &qrunner.DependencyError{Dependency: qrunner.DependencyDaemon, Err: err}
+}
+
+// activePods are pods of runs in progress, the garbage collector never removes them.
+type activePods struct {
+	mu   sync.Mutex
+	pods map[string]struct{}
+}
+
+func newActivePods() *activePods {
+	return &activePods{pods: make(map[string]struct{})}
+}
+
+func (a *activePods) add(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pods[name] = struct{}{}
+}
+
+func (a *activePods) remove(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.pods, name)
+}
+
+func (a *activePods) has(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.pods[name]
+
+	return ok
+}
+
+// outputLimit bounds the output of a run across its streams and execs, so a huge result is not buffered in memory.
+type outputLimit struct {
+	// max is the number of bytes kept. If 0, the output is unlimited.
+	max uint64
+
+	written uint64
+	dropped uint64
+}
+
+func newOutputLimit(max uint64) *outputLimit {
+	return &outputLimit{max: max}
+}
+
+func (l *outputLimit) writer(dst io.Writer) io.Writer {
+	return &limitedWriter{dst: dst, limit: l}
+}
+
+type limitedWriter struct {
+	dst   io.Writer
+	limit *outputLimit
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	l := w.limit
+	if l.max == 0 {
+		return w.dst.Write(p)
+	}
+
+	remaining := l.max - l.written
+	if uint64(len(p)) <= remaining {
+		n, err := w.dst.Write(p)
+		l.written += uint64(n)
+
+		return n, err
+	}
+
+	n, err := w.dst.Write(p[:remaining])
+	l.written += uint64(n)
+	l.dropped += uint64(len(p) - n)
+	if err != nil {
+		return n, err
+	}
+
+	return n, errOutputLimitReached
+}
@@ -0,0 +1,297 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+const testNamespace = "playground"
+
+type staticImages map[string]dockertag.Image
+
+func (s staticImages) Find(version string) (dockertag.Image, bool) {
+	img, found := s[version]
+	return img, found
+}
+
+// fakeAPIServer serves the pod endpoints of a namespace. Watches stream the events, execs are answered by exec.
+type fakeAPIServer struct {
+	mu      sync.Mutex
+	created *pod
+	deleted []string
+	execs   [][]string
+	tokens  []string
+
+	events []string
+	pods   []pod
+	exec   func(cmd []string) (stdout, stderr, status string)
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+	f.mu.Unlock()
+
+	podsPath := "/api/v1/namespaces/" + testNamespace + "/pods"
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/exec"):
+		websocket.Server{Handler: f.serveExec}.ServeHTTP(w, r)
+
+	case r.Method == http.MethodPost && r.URL.Path == podsPath:
+		p := new(pod)
+		_ = json.NewDecoder(r.Body).Decode(p)
+		f.mu.Lock()
+		f.created = p
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(p)
+
+	case r.Method == http.MethodGet && r.URL.Path == podsPath && r.URL.Query().Get("watch") == "1":
+		for _, event := range f.events {
+			_, _ = w.Write([]byte(event + "\n"))
+		}
+
+	case r.Method == http.MethodGet && r.URL.Path == podsPath:
+		_ = json.NewEncoder(w).Encode(podList{Items: f.pods})
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, podsPath+"/"):
+		f.mu.Lock()
+		f.deleted = append(f.deleted, strings.TrimPrefix(r.URL.Path, podsPath+"/"))
+		f.mu.Unlock()
+		_, _ = w.Write([]byte(`{}`))
+
+	default:
+		http.Error(w, `{"message": "unexpected call", "reason": "NotFound"}`, http.StatusNotFound)
+	}
+}
+
+func (f *fakeAPIServer) serveExec(conn *websocket.Conn) {
+	defer conn.Close()
+	conn.PayloadType = websocket.BinaryFrame
+
+	cmd := conn.Request().URL.Query()["command"]
+	f.mu.Lock()
+	f.execs = append(f.execs, cmd)
+	f.mu.Unlock()
+
+	stdout, stderr, status := f.exec(cmd)
+	for _, frame := range [][]byte{
+		append([]byte{channelStdout}, stdout...),
+		append([]byte{channelStderr}, stderr...),
+		append([]byte{channelStatus}, status...),
+	} {
+		_, _ = conn.Write(frame)
+	}
+}
+
+func podEvent(eventType string, status string) string {
+	return `{"type": "` + eventType + `", "object": {"metadata": {"name": "` + podName("run-1") + `"}, "status": ` + status + `}}`
+}
+
+// newTestRunner creates a runner of the server. Names must be unique, as they label the metrics of the runner.
+func newTestRunner(t *testing.T, srv *httptest.Server, name string) *Runner {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("secret\n"), 0o600))
+
+	cfg := DefaultConfig
+	cfg.APIServer = srv.URL
+	cfg.TokenPath = tokenPath
+	cfg.CAPath = ""
+	cfg.Namespace = testNamespace
+	cfg.ImagePullSecrets = []string{"hub"}
+	cfg.NodeSelector = map[string]string{"pool": "playground"}
+	cfg.Resources = Resources{CPULimit: "2", MemoryRequest: "1Gi", MemoryLimit: "2Gi"}
+
+	images := staticImages{"23.3": {Repository: "clickhouse/clickhouse-server", Tag: "23.3"}}
+	r, err := New(context.Background(), zerolog.Nop(), name, cfg, images)
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestRunner_RunQuery(t *testing.T) {
+	api := &fakeAPIServer{
+		events: []string{
+			podEvent("ADDED", `{"phase": "Pending"}`),
+			podEvent("MODIFIED", `{"phase": "Running", "conditions": [{"type": "Ready", "status": "True"}]}`),
+		},
+		exec: func(cmd []string) (string, string, string) {
+			if cmd[5] == qrunner.ServerVersionQuery {
+				return "23.3.1.2823\n", "", `{"status": "Success"}`
+			}
+
+			return "1\n", "warning\n", `{"status": "Failure", "reason": "NonZeroExitCode", "details": {"causes": [{"reason": "ExitCode", "message": "62"}]}}`
+		},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	r := newTestRunner(t, srv, "k8s-1")
+	run := &queryrun.Run{
+		ID:       "run-1",
+		Version:  "23.3",
+		Input:    "SELECT 1",
+		Settings: &runsettings.ClickHouseSettings{},
+		ClientID: "::1",
+		Timeline: &queryrun.Timeline{},
+	}
+
+	res, err := r.RunQuery(context.Background(), run)
+	require.NoError(t, err)
+	assert.Equal(t, qrunner.Result{Stdout: "1\n", Stderr: "warning\n", ExitCode: 62}, res)
+	assert.Equal(t, "23.3.1.2823", run.ServerVersion)
+
+	require.NotNil(t, api.created)
+	assert.Equal(t, podName("run-1"), api.created.Metadata.Name)
+	assert.Equal(t, map[string]string{
+		qrunner.LabelOwnership: "1",
+		qrunner.LabelRun:       "run-1",
+		qrunner.LabelVersion:   "23.3",
+		qrunner.LabelRunner:    "k8s-1",
+		qrunner.LabelClient:    "1",
+	}, api.created.Metadata.Labels)
+
+	spec := api.created.Spec
+	require.NotNil(t, spec)
+	require.Len(t, spec.Containers, 1)
+	assert.Equal(t, "clickhouse/clickhouse-server:23.3", spec.Containers[0].Image)
+	assert.Equal(t, map[string]string{"memory": "1Gi"}, spec.Containers[0].Resources.Requests)
+	assert.Equal(t, map[string]string{"cpu": "2", "memory": "2Gi"}, spec.Containers[0].Resources.Limits)
+	assert.Equal(t, map[string]string{"pool": "playground"}, spec.NodeSelector)
+	assert.Equal(t, []localObjectReference{{Name: "hub"}}, spec.ImagePullSecrets)
+	assert.Equal(t, restartPolicyNever, spec.RestartPolicy)
+	require.NotNil(t, spec.ActiveDeadlineSeconds)
+	assert.Equal(t, int64(DefaultConfig.GC.PodTTL.Seconds()), *spec.ActiveDeadlineSeconds)
+
+	require.Len(t, api.execs, 2)
+	assert.Equal(t, []string{"clickhouse", "client", "-n", "-m", "--query", "SELECT 1"}, api.execs[1][:6])
+	assert.Equal(t, []string{"--format", "TabSeparated"}, api.execs[1][len(api.execs[1])-2:])
+	assert.Equal(t, []string{podName("run-1")}, api.deleted)
+	for _, token := range api.tokens {
+		assert.Equal(t, "Bearer secret", token)
+	}
+
+	var stages []string
+	for _, s := range run.Timeline.Stages() {
+		stages = append(stages, s.Name)
+	}
+	assert.Equal(t, []string{queryrun.StageContainerCreate, queryrun.StageReadiness, queryrun.StageExec, queryrun.StageCleanup}, stages)
+}
+
+func TestRunner_RunQuery_PodNotReady(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		check  func(t *testing.T, err error)
+	}{
+		{
+			name:   "image pull failed",
+			status: `{"phase": "Pending", "containerStatuses": [{"name": "clickhouse", "state": {"waiting": {"reason": "ErrImagePull", "message": "manifest unknown"}}}]}`,
+			check: func(t *testing.T, err error) {
+				var depErr *qrunner.DependencyError
+				require.True(t, errors.As(err, &depErr))
+				assert.Equal(t, qrunner.DependencyRegistry, depErr.Dependency)
+			},
+		},
+		{
+			name:   "pull rate limited",
+			status: `{"phase": "Pending", "containerStatuses": [{"name": "clickhouse", "state": {"waiting": {"reason": "ImagePullBackOff", "message": "toomanyrequests: pull rate limit"}}}]}`,
+			check: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, qrunner.ErrPullRateLimited)
+			},
+		},
+		{
+			name:   "pod failed",
+			status: `{"phase": "Failed", "reason": "Evicted"}`,
+			check: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, qrunner.ErrServerNotReady)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIServer{events: []string{podEvent("MODIFIED", tt.status)}}
+			srv := httptest.NewServer(api)
+			defer srv.Close()
+
+			r := newTestRunner(t, srv, "k8s-not-ready-"+labelValue(tt.name))
+			_, err := r.RunQuery(context.Background(), &queryrun.Run{
+				ID:       "run-1",
+				Version:  "23.3",
+				Input:    "SELECT 1",
+				Settings: &runsettings.ClickHouseSettings{},
+			})
+			require.Error(t, err)
+			tt.check(t, err)
+
+			assert.Empty(t, api.execs)
+			assert.Equal(t, []string{podName("run-1")}, api.deleted)
+		})
+	}
+}
+
+func TestGarbageCollector_CollectPods(t *testing.T) {
+	now := time.Now()
+	createdAt := func(age time.Duration) *time.Time {
+		ts := now.Add(-age)
+		return &ts
+	}
+
+	api := &fakeAPIServer{pods: []pod{
+		{Metadata: objectMeta{Name: "chp-leaked", CreationTimestamp: createdAt(time.Hour)}},
+		{Metadata: objectMeta{Name: "chp-fresh", CreationTimestamp: createdAt(time.Minute)}},
+		{Metadata: objectMeta{Name: "chp-active", CreationTimestamp: createdAt(time.Hour)}},
+	}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	r := newTestRunner(t, srv, "k8s-gc")
+	r.active.add("chp-active")
+
+	count, err := r.gc.collectPods()
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), count)
+	assert.Equal(t, []string{"chp-leaked"}, api.deleted)
+	assert.Equal(t, "clickhouse.playground.ownership=1,clickhouse.playground.runner=k8s-gc", r.gc.labelSelector())
+}
+
+func TestLabelValue(t *testing.T) {
+	assert.Equal(t, "23.3.1.2823", labelValue("23.3.1.2823"))
+	assert.Equal(t, "2001-db8--1", labelValue("2001:db8::1"))
+	assert.Equal(t, "runner-1", labelValue(" runner 1 "))
+	assert.Len(t, labelValue(strings.Repeat("a", 100)), maxLabelValueLength)
+}
+
+func TestPodName(t *testing.T) {
+	dnsLabel := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	for _, id := range []string{"Ab_c-", "ab_c-", "0f8fad5b-d9cb-469f-a165-70867728950e"} {
+		name := podName(id)
+		assert.Regexp(t, dnsLabel, name, id)
+		assert.LessOrEqual(t, len(name), 63, id)
+	}
+
+	assert.NotEqual(t, podName("Ab_c-"), podName("ab_c-"))
+}
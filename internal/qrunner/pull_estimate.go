@@ -0,0 +1,63 @@
+package qrunner
+
+import (
+	"context"
+	"time"
+)
+
+// PullThroughput is the range of image pull throughputs recently measured by runners, in bytes per second.
+type PullThroughput struct {
+	Min float64
+	Max float64
+}
+
+// Merge extends the range with another one.
+func (t PullThroughput) Merge(other PullThroughput) PullThroughput {
+	if other.Min < t.Min {
+		t.Min = other.Min
+	}
+	if other.Max > t.Max {
+		t.Max = other.Max
+	}
+
+	return t
+}
+
+// ImageState describes the image of a version on runners.
+type ImageState struct {
+	// Present is true if the image has already been pulled.
+	Present bool
+
+	// Throughput is nil if no image of a known size has been pulled recently.
+	Throughput *PullThroughput
+}
+
+// ImageInspector is implemented by runners that can tell whether the image of a version has been pulled.
+type ImageInspector interface {
+	ImageState(ctx context.Context, version string) (ImageState, error)
+}
+
+// ImageHolder is implemented by runners that can cheaply check whether the image of a version is present,
+// so runs can be routed to them when the image cannot be pulled.
+type ImageHolder interface {
+	HasImage(ctx context.Context, version string) (bool, error)
+}
+
+// PullEstimate is the range the pull duration of an image is expected to be within.
+type PullEstimate struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// EstimatePull estimates the pull duration of an image of the given compressed size.
+// If the size or the throughput is unknown, false is returned.
+func EstimatePull(size int64, throughput *PullThroughput) (PullEstimate, bool) {
+	if size <= 0 || throughput == nil || throughput.Min <= 0 || throughput.Max <= 0 {
+		return PullEstimate{}, false
+	}
+
+	return PullEstimate{
+		Min: time.Duration(float64(size) / throughput.Max * float64(time.Second)).Round(time.Second),
+		Max: time.Duration(float64(size) / throughput.Min * float64(time.Second)).Round(time.Second),
+	}, true
+}
@@ -0,0 +1,30 @@
+package qrunner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimatePull(t *testing.T) {
+	throughput := &PullThroughput{Min: 10 << 20, Max: 40 << 20}
+
+	estimate, ok := EstimatePull(400<<20, throughput)
+	assert.True(t, ok)
+	assert.Equal(t, PullEstimate{Min: 10 * time.Second, Max: 40 * time.Second}, estimate)
+
+	_, ok = EstimatePull(0, throughput)
+	assert.False(t, ok)
+
+	_, ok = EstimatePull(400<<20, nil)
+	assert.False(t, ok)
+
+	_, ok = EstimatePull(400<<20, &PullThroughput{})
+	assert.False(t, ok)
+}
+
+func TestPullThroughput_Merge(t *testing.T) {
+	merged := PullThroughput{Min: 10, Max: 20}.Merge(PullThroughput{Min: 5, Max: 15})
+	assert.Equal(t, PullThroughput{Min: 5, Max: 20}, merged)
+}
@@ -0,0 +1,41 @@
+package qrunner
+
+import "time"
+
+// Remediation actions runners take on their own when containers cannot be created or started.
+const (
+	RemediationGC       = "gc"       // a garbage collection pass is triggered to free disk space
+	RemediationRename   = "rename"   // the container is created again with another name
+	RemediationThrottle = "throttle" // the concurrency limit of the runner is reduced for a while
+)
+
+// Remediation is an action a runner has taken to recover from a failure of a container.
+type Remediation struct {
+	Action string
+
+	// Class is the class of the failure that has triggered the action, e.g. disk or memory.
+	Class   string
+	Details string
+
+	At time.Time
+}
+
+// RemediationStatus describes how a runner defends itself from failures of containers.
+type RemediationStatus struct {
+	Runner string
+
+	// ConcurrencyFactor scales the concurrency limit of the runner. It's below 1 until ThrottledUntil.
+	ConcurrencyFactor float64
+	ThrottledUntil    time.Time
+
+	// Recent remediations, the latest one goes first.
+	Recent []Remediation
+}
+
+// Remediator is implemented by runners that remediate failures of containers automatically.
+type Remediator interface {
+	// ConcurrencyFactor scales the concurrency limit of the runner, see RemediationStatus.
+	ConcurrencyFactor() float64
+
+	RemediationStatus() RemediationStatus
+}
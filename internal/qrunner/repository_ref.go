@@ -0,0 +1,131 @@
+package qrunner
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DockerHubRegistry = "docker.io"
+
+	// officialNamespace is the Docker Hub namespace of official images (e.g. clickhouse is library/clickhouse).
+	officialNamespace = "library"
+)
+
+// Docker Hub is also known by these hosts.
+var dockerHubAliases = map[string]struct{}{
+	"docker.io":               {},
+	"index.docker.io":         {},
+	"registry-1.docker.io":    {},
+	"registry.hub.docker.com": {},
+}
+
+var repositoryComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+
+// RepositoryRef is a normalized image repository reference.
+// The same repository can be spelled differently, e.g. clickhouse, library/clickhouse
+// and docker.io/library/clickhouse are the same repository.
+type RepositoryRef struct {
+	// Registry is the registry host, docker.io for Docker Hub.
+	Registry string
+
+	// Namespace is the path without the name, library for official Docker Hub images.
+	Namespace string
+
+	Name string
+}
+
+// ParseRepositoryRef parses a repository reference without a tag or a digest.
+// If the registry is omitted, Docker Hub is assumed. Official Docker Hub images get the library namespace.
+func ParseRepositoryRef(repository string) (RepositoryRef, error) {
+	if repository == "" {
+		return RepositoryRef{}, errors.New("repository cannot be empty")
+	}
+	if strings.Contains(repository, "@") {
+		return RepositoryRef{}, errors.Errorf("repository '%s' cannot contain a digest", repository)
+	}
+
+	components := strings.Split(repository, "/")
+
+	ref := RepositoryRef{Registry: DockerHubRegistry}
+	if len(components) > 1 && isRegistryHost(components[0]) {
+		ref.Registry = strings.ToLower(components[0])
+		if _, found := dockerHubAliases[ref.Registry]; found {
+			ref.Registry = DockerHubRegistry
+		}
+
+		components = components[1:]
+	}
+
+	for _, c := range components {
+		if strings.Contains(c, ":") {
+			return RepositoryRef{}, errors.Errorf("repository '%s' cannot contain a tag", repository)
+		}
+		if !repositoryComponentRegexp.MatchString(c) {
+			return RepositoryRef{}, errors.Errorf("repository '%s' has invalid component '%s'", repository, c)
+		}
+	}
+
+	ref.Name = components[len(components)-1]
+	ref.Namespace = strings.Join(components[:len(components)-1], "/")
+	if ref.Namespace == "" && ref.IsDockerHub() {
+		ref.Namespace = officialNamespace
+	}
+
+	return ref, nil
+}
+
+// isRegistryHost reports whether the first path component is a registry host, as Docker decides it.
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+func (r RepositoryRef) IsDockerHub() bool {
+	return r.Registry == DockerHubRegistry
+}
+
+// Path returns the repository path within the registry, e.g. library/clickhouse.
+// It's used by the Docker Hub API.
+func (r RepositoryRef) Path() string {
+	if r.Namespace == "" {
+		return r.Name
+	}
+
+	return r.Namespace + "/" + r.Name
+}
+
+// String returns the shortest name Docker resolves to the repository, e.g. clickhouse for library/clickhouse.
+// Docker Engine reports local images by such names.
+func (r RepositoryRef) String() string {
+	if !r.IsDockerHub() {
+		return r.Registry + "/" + r.Path()
+	}
+	if r.Namespace == officialNamespace {
+		return r.Name
+	}
+
+	return r.Path()
+}
+
+// ParseImageRepository parses the repository of an image name with an optional tag or digest,
+// e.g. ghcr.io/clickhouse/clickhouse-server:23.3.
+func ParseImageRepository(name string) (RepositoryRef, error) {
+	repository, _ := splitImageName(name)
+	return ParseRepositoryRef(repository)
+}
+
+// splitImageName splits an image name into the repository and the tag or digest.
+func splitImageName(name string) (repository string, reference string) {
+	if i := strings.Index(name, "@"); i != -1 {
+		return name[:i], name[i+1:]
+	}
+
+	// A colon before the last slash belongs to the registry port.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i], name[i+1:]
+	}
+
+	return name, ""
+}
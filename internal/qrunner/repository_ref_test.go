@@ -0,0 +1,86 @@
+package qrunner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRepositoryRef(t *testing.T) {
+	official := RepositoryRef{Registry: DockerHubRegistry, Namespace: "library", Name: "clickhouse"}
+	server := RepositoryRef{Registry: DockerHubRegistry, Namespace: "clickhouse", Name: "clickhouse-server"}
+
+	cases := []struct {
+		repository string
+		want       RepositoryRef
+	}{
+		{repository: "clickhouse", want: official},
+		{repository: "library/clickhouse", want: official},
+		{repository: "docker.io/clickhouse", want: official},
+		{repository: "docker.io/library/clickhouse", want: official},
+		{repository: "index.docker.io/library/clickhouse", want: official},
+		{repository: "registry-1.docker.io/library/clickhouse", want: official},
+		{repository: "clickhouse/clickhouse-server", want: server},
+		{repository: "docker.io/clickhouse/clickhouse-server", want: server},
+		{repository: "Docker.IO/clickhouse/clickhouse-server", want: server},
+		{
+			repository: "ghcr.io/altinity/clickhouse-server",
+			want:       RepositoryRef{Registry: "ghcr.io", Namespace: "altinity", Name: "clickhouse-server"},
+		},
+		{
+			repository: "localhost:5000/clickhouse",
+			want:       RepositoryRef{Registry: "localhost:5000", Name: "clickhouse"},
+		},
+		{
+			repository: "localhost/team/images/clickhouse",
+			want:       RepositoryRef{Registry: "localhost", Namespace: "team/images", Name: "clickhouse"},
+		},
+	}
+
+	for _, tc := range cases {
+		ref, err := ParseRepositoryRef(tc.repository)
+		require.NoError(t, err, tc.repository)
+		assert.Equal(t, tc.want, ref, tc.repository)
+	}
+}
+
+func TestParseRepositoryRef_Invalid(t *testing.T) {
+	cases := []string{
+		"",
+		"clickhouse:latest",
+		"clickhouse/clickhouse-server:23.3",
+		"clickhouse@sha256:f321ba",
+		"ClickHouse/clickhouse-server",
+		"clickhouse//clickhouse-server",
+		"clickhouse/",
+		"docker.io/",
+	}
+
+	for _, repository := range cases {
+		_, err := ParseRepositoryRef(repository)
+		assert.Error(t, err, repository)
+	}
+}
+
+func TestRepositoryRef_Names(t *testing.T) {
+	cases := []struct {
+		repository string
+		path       string
+		str        string
+	}{
+		{repository: "clickhouse", path: "library/clickhouse", str: "clickhouse"},
+		{repository: "docker.io/library/clickhouse", path: "library/clickhouse", str: "clickhouse"},
+		{repository: "docker.io/clickhouse/clickhouse-server", path: "clickhouse/clickhouse-server", str: "clickhouse/clickhouse-server"},
+		{repository: "ghcr.io/altinity/clickhouse-server", path: "altinity/clickhouse-server", str: "ghcr.io/altinity/clickhouse-server"},
+		{repository: "localhost:5000/clickhouse", path: "clickhouse", str: "localhost:5000/clickhouse"},
+	}
+
+	for _, tc := range cases {
+		ref, err := ParseRepositoryRef(tc.repository)
+		require.NoError(t, err, tc.repository)
+
+		assert.Equal(t, tc.path, ref.Path(), tc.repository)
+		assert.Equal(t, tc.str, ref.String(), tc.repository)
+	}
+}
@@ -0,0 +1,10 @@
+package qrunner
+
+import "time"
+
+// Reservation is a container started in advance for a client.
+// A run request carrying the token is processed in the reserved container.
+type Reservation struct {
+	Token     string
+	ExpiresAt time.Time
+}
@@ -0,0 +1,26 @@
+package qrunner
+
+// Result is the output of a run.
+type Result struct {
+	Stdout string
+
+	// Stderr has exceptions of the database client and messages of tools.
+	Stderr string
+
+	// ExitCode is the exit code of the database client or the tool. It's not 0 if the query has failed.
+	ExitCode int
+
+	// Truncated is set if the output has exceeded the limit of the runner, so the client has been stopped.
+	// DroppedBytes is the number of bytes that have been cut; the client may have produced more.
+	Truncated    bool
+	DroppedBytes uint64
+}
+
+// Output combines the streams the way runs returned them before the streams were separated.
+func (r Result) Output() string {
+	if r.Stderr == "" {
+		return r.Stdout
+	}
+
+	return r.Stdout + "\n" + r.Stderr
+}
@@ -12,7 +12,11 @@ type Runner interface {
 
 	Status(ctx context.Context) RunnerStatus
 
-	RunQuery(ctx context.Context, run *queryrun.Run) (string, error)
+	RunQuery(ctx context.Context, run *queryrun.Run) (Result, error)
+
+	// Prepare starts a container for the run's version and reserves it for the run's client.
+	// A subsequent run with the returned token is processed in the reserved container.
+	Prepare(ctx context.Context, run *queryrun.Run) (Reservation, error)
 
 	// Start initializes background processes (like garbage collection and status exporter).
 	// This function is non-blocking.
@@ -21,3 +25,15 @@ type Runner interface {
 	// Stop stops background tasks and waits for their finish.
 	Stop(shutdownCtx context.Context) error
 }
+
+// Snapshotter is implemented by runners that can capture containers of in-flight runs for debugging.
+type Snapshotter interface {
+	// Snapshot returns ErrRunNotInProgress if the run is not being processed by the runner.
+	Snapshot(ctx context.Context, runID string) (*queryrun.ContainerSnapshot, error)
+}
+
+// ImageRemover is implemented by runners that can remove images which are not needed anymore,
+// e.g. superseded builds of rolling tags.
+type ImageRemover interface {
+	RemoveImage(ctx context.Context, repository, digest string) error
+}
@@ -0,0 +1,18 @@
+package qrunner
+
+// SchedulerClass is the state of a priority class of the run scheduler.
+type SchedulerClass struct {
+	Priority string
+	Weight   uint
+
+	// MaxConcurrency and MaxQueued are 0 if the class is not limited.
+	MaxConcurrency uint
+	MaxQueued      uint
+
+	InFlight uint
+	Queued   uint
+
+	// Dispatched and Rejected count runs of the class since the start.
+	Dispatched uint64
+	Rejected   uint64
+}
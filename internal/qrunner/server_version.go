@@ -0,0 +1,26 @@
+package qrunner
+
+import (
+	"clickhouse-playground/pkg/chsemver"
+)
+
+// ServerVersionQuery is executed before a user query to find out the actual server version.
+const ServerVersionQuery = "SELECT version()"
+
+// IsServerVersionMismatch checks whether the version reported by a server
+// does not belong to the series described by the image tag.
+//
+// Only major and minor parts are compared: tag "21.8" matches server version "21.8.15.7".
+// Floating tags (head, latest, etc.) never mismatch.
+func IsServerVersionMismatch(tag, serverVersion string) bool {
+	parsedTag := chsemver.Parse(tag)
+	if !chsemver.IsNumeric(parsedTag) || serverVersion == "" {
+		return false
+	}
+
+	if len(parsedTag) > 2 {
+		parsedTag = parsedTag[:2]
+	}
+
+	return !chsemver.HasPrefix(chsemver.Parse(serverVersion), parsedTag)
+}
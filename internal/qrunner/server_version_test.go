@@ -0,0 +1,21 @@
+package qrunner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsServerVersionMismatch(t *testing.T) {
+	assert.False(t, IsServerVersionMismatch("21.8", "21.8.15.7"))
+	assert.False(t, IsServerVersionMismatch("21.8.15.7", "21.8.15.7"))
+	assert.False(t, IsServerVersionMismatch("21.8.3", "21.8.15.7"))
+	assert.False(t, IsServerVersionMismatch("21", "21.12.1.1"))
+	assert.False(t, IsServerVersionMismatch("head", "23.1.1.1"))
+	assert.False(t, IsServerVersionMismatch("21.8-alpine", "21.9.1.1"))
+	assert.False(t, IsServerVersionMismatch("21.8", ""))
+
+	assert.True(t, IsServerVersionMismatch("21.8", "21.9.1.1"))
+	assert.True(t, IsServerVersionMismatch("21.8.3", "22.8.3.1"))
+	assert.True(t, IsServerVersionMismatch("21", "22.1.1.1"))
+}
@@ -0,0 +1,27 @@
+package qrunner
+
+import (
+	"context"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+)
+
+// Session is a container kept for a series of queries of a client. Queries are executed one by one against
+// the same server, so tables created by a query are seen by the next ones.
+type Session interface {
+	// Exec executes the query in the container of the session. It returns ErrSessionClosed
+	// if the container has been removed.
+	Exec(ctx context.Context, query string) (Result, error)
+
+	// Close removes the container. It can be called more than once.
+	Close(ctx context.Context) error
+}
+
+// SessionOpener is implemented by runners that can keep containers for interactive sessions.
+type SessionOpener interface {
+	// OpenSession starts a container for the version of the run and waits for the server. The container
+	// is kept until the session is closed or the runner is stopped; the garbage collector does not remove it
+	// before expiresAt. Queries of the session use the settings of the run.
+	OpenSession(ctx context.Context, run *queryrun.Run, expiresAt time.Time) (Session, error)
+}
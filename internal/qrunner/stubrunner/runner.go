@@ -9,10 +9,10 @@ import (
 	"github.com/pkg/errors"
 )
 
-type Run = func(ctx context.Context, run *queryrun.Run) (string, error)
+type Run = func(ctx context.Context, run *queryrun.Run) (qrunner.Result, error)
 
-var StubRun = func(ctx context.Context, run *queryrun.Run) (string, error) {
-	return "", errors.New("stub cannot run queries")
+var StubRun = func(ctx context.Context, run *queryrun.Run) (qrunner.Result, error) {
+	return qrunner.Result{}, errors.New("stub cannot run queries")
 }
 
 // Runner is a stub runner for tests.
@@ -53,6 +53,10 @@ func (r *Runner) Stop(_ context.Context) error {
 	return nil
 }
 
-func (r *Runner) RunQuery(ctx context.Context, run *queryrun.Run) (string, error) {
+func (r *Runner) RunQuery(ctx context.Context, run *queryrun.Run) (qrunner.Result, error) {
 	return r.run(ctx, run)
 }
+
+func (r *Runner) Prepare(_ context.Context, _ *queryrun.Run) (qrunner.Reservation, error) {
+	return qrunner.Reservation{}, qrunner.ErrPreparationDisabled
+}
@@ -0,0 +1,116 @@
+package qrunner
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// TaskGroup tracks background goroutines of a component by name, so shutdowns wait for all of them
+// and report the ones that have not stopped in time. Tasks are expected to return once the context
+// of the component is done.
+type TaskGroup struct {
+	owner  string
+	logger zerolog.Logger
+
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	live map[string]int
+}
+
+func NewTaskGroup(logger zerolog.Logger, owner string) *TaskGroup {
+	return &TaskGroup{
+		owner:  owner,
+		logger: logger,
+		live:   make(map[string]int),
+	}
+}
+
+// Go runs the task in a new goroutine. A panic of the task is recovered and logged, so it doesn't crash the service.
+func (g *TaskGroup) Go(name string, task func()) {
+	g.started(name)
+	go func() {
+		defer g.finished(name)
+		defer func() {
+			if r := recover(); r != nil {
+				metrics.Tasks.Panicked(g.owner, name)
+				g.logger.Error().Str("task", name).Str("panic", fmt.Sprint(r)).Bytes("stack", debug.Stack()).
+					Msg("background task has panicked")
+			}
+		}()
+
+		task()
+	}()
+}
+
+func (g *TaskGroup) started(name string) {
+	g.wg.Add(1)
+
+	g.mu.Lock()
+	g.live[name]++
+	g.mu.Unlock()
+
+	metrics.Tasks.Started(g.owner, name)
+}
+
+func (g *TaskGroup) finished(name string) {
+	g.mu.Lock()
+	g.live[name]--
+	if g.live[name] == 0 {
+		delete(g.live, name)
+	}
+	g.mu.Unlock()
+
+	metrics.Tasks.Finished(g.owner, name)
+	g.wg.Done()
+}
+
+// Live returns the number of running tasks by name.
+func (g *TaskGroup) Live() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	live := make(map[string]int, len(g.live))
+	for name, count := range g.live {
+		live[name] = count
+	}
+
+	return live
+}
+
+// Wait waits for all the tasks until the context is done.
+// If some tasks are still running by then, the error lists them, and they are logged.
+func (g *TaskGroup) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+	}
+
+	live := g.Live()
+	names := make([]string, 0, len(live))
+	for name, count := range live {
+		names = append(names, fmt.Sprintf("%s (%d)", name, count))
+	}
+	sort.Strings(names)
+
+	g.logger.Error().Strs("tasks", names).Msg("background tasks have not stopped in time")
+
+	return errors.Errorf("background tasks have not stopped in time: %s", strings.Join(names, ", "))
+}
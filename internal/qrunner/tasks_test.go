@@ -0,0 +1,54 @@
+package qrunner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskGroup(t *testing.T) {
+	g := NewTaskGroup(zerolog.Nop(), "TestTaskGroup")
+
+	stop := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		g.Go("loop", func() {
+			<-stop
+		})
+	}
+	g.Go("panicking", func() {
+		panic("boom")
+	})
+
+	require.Eventually(t, func() bool {
+		return len(g.Live()) == 1
+	}, time.Second, time.Millisecond, "the panicking task must be finished")
+	assert.Equal(t, map[string]int{"loop": 2}, g.Live())
+
+	close(stop)
+	require.NoError(t, g.Wait(context.Background()))
+	assert.Empty(t, g.Live())
+}
+
+func TestTaskGroup_WaitTimeout(t *testing.T) {
+	g := NewTaskGroup(zerolog.Nop(), "TestTaskGroup_WaitTimeout")
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	g.Go("stuck", func() {
+		<-stop
+	})
+	g.Go("finished", func() {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := g.Wait(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stuck (1)")
+	assert.NotContains(t, err.Error(), "finished")
+}
@@ -6,4 +6,5 @@ const (
 	TypeCoordinator  Type = "COORDINATOR"
 	TypeStub         Type = "STUB"
 	TypeDockerEngine Type = "DOCKER_ENGINE"
+	TypeKubernetes   Type = "KUBERNETES"
 )
@@ -0,0 +1,175 @@
+package qrunner
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WarmPoolAllocation is the number of warm containers a runner keeps per version.
+type WarmPoolAllocation struct {
+	Runner string
+
+	// Budget is the total number of warm containers of the runner.
+	Budget uint
+
+	// Versions maps versions to the number of warm containers.
+	Versions map[string]uint
+
+	// Popularity is the input of the allocation: decayed run counts per version.
+	Popularity map[string]float64
+
+	ResizedAt time.Time
+}
+
+// WarmPoolResizer is implemented by runners that keep warm containers.
+type WarmPoolResizer interface {
+	// ResizeWarmPool distributes warm containers across versions according to their popularity.
+	ResizeWarmPool(popularity map[string]float64) WarmPoolAllocation
+
+	// WarmPoolAllocation returns the latest allocation.
+	WarmPoolAllocation() WarmPoolAllocation
+}
+
+// Popularity counts runs per version with exponential decay: a run weighs half as much after every half-life,
+// so the counts follow the recent demand without storing every run.
+type Popularity struct {
+	mu       sync.Mutex
+	halfLife time.Duration
+
+	counts    map[string]float64
+	updatedAt time.Time
+}
+
+func NewPopularity(halfLife time.Duration) *Popularity {
+	return &Popularity{
+		halfLife: halfLife,
+		counts:   make(map[string]float64),
+	}
+}
+
+// Record counts a run of the version.
+func (p *Popularity) Record(version string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.decay(at)
+	p.counts[version]++
+}
+
+// Snapshot returns the decayed counts. Versions whose counts are negligible are forgotten.
+func (p *Popularity) Snapshot(at time.Time) map[string]float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.decay(at)
+
+	snapshot := make(map[string]float64, len(p.counts))
+	for version, count := range p.counts {
+		snapshot[version] = count
+	}
+
+	return snapshot
+}
+
+// Restore adds the counts that have been snapshotted at savedAt, e.g. before a restart.
+// They are decayed by the time elapsed since then, as if they had been counted all along.
+func (p *Popularity) Restore(counts map[string]float64, savedAt time.Time, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.decay(at)
+
+	factor := 1.0
+	if elapsed := at.Sub(savedAt); elapsed > 0 {
+		factor = math.Pow(0.5, float64(elapsed)/float64(p.halfLife))
+	}
+
+	for version, count := range counts {
+		count *= factor
+		if count >= minPopularity {
+			p.counts[version] += count
+		}
+	}
+}
+
+// minPopularity is the count below which a version is forgotten.
+const minPopularity = 0.01
+
+func (p *Popularity) decay(at time.Time) {
+	if p.updatedAt.IsZero() {
+		p.updatedAt = at
+		return
+	}
+
+	elapsed := at.Sub(p.updatedAt)
+	if elapsed <= 0 {
+		return
+	}
+
+	factor := math.Pow(0.5, float64(elapsed)/float64(p.halfLife))
+	for version, count := range p.counts {
+		count *= factor
+		if count < minPopularity {
+			delete(p.counts, version)
+			continue
+		}
+
+		p.counts[version] = count
+	}
+
+	p.updatedAt = at
+}
+
+// WarmPoolHints are the popularity counts saved across restarts, so warm pools are refilled
+// before runs of the new process are counted.
+type WarmPoolHints struct {
+	SavedAt    time.Time          `json:"saved_at"`
+	Popularity map[string]float64 `json:"popularity"`
+}
+
+// LoadWarmPoolHints reads the hints from the file. The error wraps os.ErrNotExist if nothing has been saved yet.
+func LoadWarmPoolHints(path string) (WarmPoolHints, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return WarmPoolHints{}, errors.Wrap(err, "failed to read warm pool hints")
+	}
+
+	var hints WarmPoolHints
+	err = json.Unmarshal(data, &hints)
+	if err != nil {
+		return WarmPoolHints{}, errors.Wrap(err, "failed to parse warm pool hints")
+	}
+
+	return hints, nil
+}
+
+// SaveWarmPoolHints writes the hints to a temporary file and renames it, so an interrupted save
+// doesn't leave a partial file behind.
+func SaveWarmPoolHints(path string, hints WarmPoolHints) error {
+	data, err := json.Marshal(hints)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal warm pool hints")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create warm pool hints")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write warm pool hints")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "failed to save warm pool hints")
+}
@@ -0,0 +1,58 @@
+package qrunner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopularity(t *testing.T) {
+	now := time.Now()
+	p := NewPopularity(time.Hour)
+
+	for i := 0; i < 4; i++ {
+		p.Record("23.3", now)
+	}
+	p.Record("22.8", now)
+
+	assert.Equal(t, map[string]float64{"23.3": 4, "22.8": 1}, p.Snapshot(now))
+
+	// Counts are halved after the half-life.
+	p.Record("22.8", now.Add(time.Hour))
+	assert.InDeltaMapValues(t, map[string]float64{"23.3": 2, "22.8": 1.5}, p.Snapshot(now.Add(time.Hour)), 1e-9)
+
+	// Stale versions are forgotten.
+	assert.Empty(t, p.Snapshot(now.Add(24*time.Hour)))
+}
+
+func TestPopularity_Restore(t *testing.T) {
+	now := time.Now()
+	p := NewPopularity(time.Hour)
+	p.Record("23.3", now)
+
+	// Saved counts are decayed by the downtime and added to the counted ones.
+	p.Restore(map[string]float64{"23.3": 4, "22.8": 2, "21.8": 0.01}, now.Add(-time.Hour), now)
+	assert.InDeltaMapValues(t, map[string]float64{"23.3": 3, "22.8": 1}, p.Snapshot(now), 1e-9)
+}
+
+func TestWarmPoolHints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hints.json")
+
+	_, err := LoadWarmPoolHints(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	saved := WarmPoolHints{SavedAt: time.Now().UTC().Truncate(time.Second), Popularity: map[string]float64{"23.3": 2.5}}
+	require.NoError(t, SaveWarmPoolHints(path, saved))
+
+	loaded, err := LoadWarmPoolHints(path)
+	require.NoError(t, err)
+	assert.Equal(t, saved, loaded)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be removed")
+}
@@ -0,0 +1,158 @@
+package queryrun
+
+import (
+	"sync/atomic"
+	"time"
+
+	"clickhouse-playground/pkg/chsemver"
+
+	"github.com/pkg/errors"
+)
+
+// Deadlines are the effective limits of a run. They are resolved once per run, after the version resolution.
+type Deadlines struct {
+	// ReadinessTimeout bounds the wait for the database server to accept queries.
+	// If it's 0, only MaxExecRetries bounds the wait.
+	ReadinessTimeout time.Duration `dynamodbav:"ReadinessTimeout,omitempty"`
+
+	// MaxExecRetries is the number of readiness probes.
+	MaxExecRetries int `dynamodbav:"MaxExecRetries"`
+
+	// RunTimeout is the deadline of the whole run.
+	RunTimeout time.Duration `dynamodbav:"RunTimeout"`
+}
+
+// DeadlineRule overrides deadlines for versions in the [MinVersion, MaxVersion] range.
+// Both bounds are optional and inclusive; MaxVersion is compared by prefix ("20.3" includes "20.3.8").
+// Unset overrides keep the defaults.
+type DeadlineRule struct {
+	MinVersion string
+	MaxVersion string
+
+	ReadinessTimeout *time.Duration
+	MaxExecRetries   *int
+	RunTimeout       *time.Duration
+}
+
+// DeadlineConfig is the default deadlines and the version rules overriding them.
+type DeadlineConfig struct {
+	Defaults Deadlines
+
+	// Rules must be ordered by versions and must not overlap, so at most one rule matches a version.
+	Rules []DeadlineRule
+}
+
+func (r *DeadlineRule) validate() error {
+	if r.MinVersion == "" && r.MaxVersion == "" {
+		return errors.New("at least one of min and max versions is required")
+	}
+	if r.MinVersion != "" && r.MaxVersion != "" && !chsemver.InRange(r.MinVersion, "", r.MaxVersion) {
+		return errors.Errorf("min version %s is greater than max version %s", r.MinVersion, r.MaxVersion)
+	}
+	if r.ReadinessTimeout == nil && r.MaxExecRetries == nil && r.RunTimeout == nil {
+		return errors.New("at least one deadline is required")
+	}
+	if r.ReadinessTimeout != nil && *r.ReadinessTimeout < 0 {
+		return errors.New("readiness timeout cannot be negative")
+	}
+	if r.MaxExecRetries != nil && *r.MaxExecRetries < 1 {
+		return errors.New("max exec retries must be > 0")
+	}
+	if r.RunTimeout != nil && *r.RunTimeout <= 0 {
+		return errors.New("run timeout must be > 0")
+	}
+
+	return nil
+}
+
+// below reports whether all versions of the rule are lower than versions of the next one.
+func (r *DeadlineRule) below(next *DeadlineRule) bool {
+	if r.MaxVersion == "" || next.MinVersion == "" {
+		return false
+	}
+
+	return !chsemver.InRange(next.MinVersion, "", r.MaxVersion)
+}
+
+func (r *DeadlineRule) apply(d Deadlines) Deadlines {
+	if r.ReadinessTimeout != nil {
+		d.ReadinessTimeout = *r.ReadinessTimeout
+	}
+	if r.MaxExecRetries != nil {
+		d.MaxExecRetries = *r.MaxExecRetries
+	}
+	if r.RunTimeout != nil {
+		d.RunTimeout = *r.RunTimeout
+	}
+
+	return d
+}
+
+// Validate checks the defaults and the rules: every rule must be valid, and the rules must go in the ascending
+// order of versions without overlapping.
+func (c *DeadlineConfig) Validate() error {
+	if c.Defaults.MaxExecRetries < 1 {
+		return errors.New("default max exec retries must be > 0")
+	}
+	if c.Defaults.RunTimeout <= 0 {
+		return errors.New("default run timeout must be > 0")
+	}
+	if c.Defaults.ReadinessTimeout < 0 {
+		return errors.New("default readiness timeout cannot be negative")
+	}
+
+	for i := range c.Rules {
+		err := c.Rules[i].validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid deadline rule #%d", i+1)
+		}
+
+		if i > 0 && !c.Rules[i-1].below(&c.Rules[i]) {
+			return errors.Errorf("deadline rule #%d overlaps or precedes rule #%d, rules must be ordered by versions", i+1, i)
+		}
+	}
+
+	return nil
+}
+
+// DeadlinePolicy resolves deadlines of runs by their versions. Its config can be replaced at runtime.
+type DeadlinePolicy struct {
+	cfg atomic.Pointer[DeadlineConfig]
+}
+
+func NewDeadlinePolicy(cfg DeadlineConfig) (*DeadlinePolicy, error) {
+	p := &DeadlinePolicy{}
+
+	err := p.Update(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Update replaces the config. The previous config is kept if the new one is invalid.
+func (p *DeadlinePolicy) Update(cfg DeadlineConfig) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	p.cfg.Store(&cfg)
+
+	return nil
+}
+
+// Resolve merges the rule matching the version over the defaults.
+func (p *DeadlinePolicy) Resolve(version string) Deadlines {
+	cfg := p.cfg.Load()
+
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if chsemver.InRange(version, rule.MinVersion, rule.MaxVersion) {
+			return rule.apply(cfg.Defaults)
+		}
+	}
+
+	return cfg.Defaults
+}
@@ -0,0 +1,128 @@
+package queryrun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadlinePolicy_Resolve(t *testing.T) {
+	readiness := 30 * time.Second
+	retries := 100
+	runTimeout := 90 * time.Second
+
+	defaults := Deadlines{MaxExecRetries: 20, RunTimeout: time.Minute}
+	policy, err := NewDeadlinePolicy(DeadlineConfig{
+		Defaults: defaults,
+		Rules: []DeadlineRule{
+			{MaxVersion: "20", ReadinessTimeout: &readiness, MaxExecRetries: &retries, RunTimeout: &runTimeout},
+			{MinVersion: "21.1", MaxVersion: "21.3", MaxExecRetries: &retries},
+		},
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		version   string
+		deadlines Deadlines
+	}{
+		{version: "19.17.4.11", deadlines: Deadlines{ReadinessTimeout: readiness, MaxExecRetries: retries, RunTimeout: runTimeout}},
+		{version: "20.3.8", deadlines: Deadlines{ReadinessTimeout: readiness, MaxExecRetries: retries, RunTimeout: runTimeout}},
+		{version: "21.1.2", deadlines: Deadlines{MaxExecRetries: retries, RunTimeout: time.Minute}},
+		{version: "21.3", deadlines: Deadlines{MaxExecRetries: retries, RunTimeout: time.Minute}},
+		{version: "21.8", deadlines: defaults},
+		{version: "23.8.1.2992", deadlines: defaults},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.deadlines, policy.Resolve(tc.version), tc.version)
+	}
+}
+
+func TestDeadlineConfig_Validate(t *testing.T) {
+	retries := 100
+	zero := 0
+
+	defaults := Deadlines{MaxExecRetries: 20, RunTimeout: time.Minute}
+
+	tests := []struct {
+		name  string
+		cfg   DeadlineConfig
+		valid bool
+	}{
+		{
+			name: "ordered",
+			cfg: DeadlineConfig{Defaults: defaults, Rules: []DeadlineRule{
+				{MaxVersion: "20", MaxExecRetries: &retries},
+				{MinVersion: "21", MaxVersion: "21.3", MaxExecRetries: &retries},
+				{MinVersion: "21.4", MaxExecRetries: &retries},
+			}},
+			valid: true,
+		},
+		{
+			name: "misordered",
+			cfg: DeadlineConfig{Defaults: defaults, Rules: []DeadlineRule{
+				{MinVersion: "21", MaxExecRetries: &retries},
+				{MaxVersion: "20", MaxExecRetries: &retries},
+			}},
+		},
+		{
+			name: "overlapping",
+			cfg: DeadlineConfig{Defaults: defaults, Rules: []DeadlineRule{
+				{MaxVersion: "20", MaxExecRetries: &retries},
+				{MinVersion: "20.3", MaxVersion: "21", MaxExecRetries: &retries},
+			}},
+		},
+		{
+			name: "min above max",
+			cfg: DeadlineConfig{Defaults: defaults, Rules: []DeadlineRule{
+				{MinVersion: "22", MaxVersion: "21", MaxExecRetries: &retries},
+			}},
+		},
+		{
+			name: "no overrides",
+			cfg:  DeadlineConfig{Defaults: defaults, Rules: []DeadlineRule{{MaxVersion: "20"}}},
+		},
+		{
+			name: "zero retries",
+			cfg:  DeadlineConfig{Defaults: defaults, Rules: []DeadlineRule{{MaxVersion: "20", MaxExecRetries: &zero}}},
+		},
+		{
+			name: "no default run timeout",
+			cfg:  DeadlineConfig{Defaults: Deadlines{MaxExecRetries: 20}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestDeadlinePolicy_Update(t *testing.T) {
+	retries := 100
+
+	policy, err := NewDeadlinePolicy(DeadlineConfig{
+		Defaults: Deadlines{MaxExecRetries: 20, RunTimeout: time.Minute},
+		Rules:    []DeadlineRule{{MaxVersion: "20", MaxExecRetries: &retries}},
+	})
+	require.NoError(t, err)
+
+	// Invalid rules are rejected and the previous ones are kept.
+	err = policy.Update(DeadlineConfig{
+		Defaults: Deadlines{MaxExecRetries: 20, RunTimeout: time.Minute},
+		Rules:    []DeadlineRule{{MinVersion: "21"}, {MaxVersion: "20", MaxExecRetries: &retries}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, retries, policy.Resolve("20.3").MaxExecRetries)
+
+	require.NoError(t, policy.Update(DeadlineConfig{Defaults: Deadlines{MaxExecRetries: 10, RunTimeout: time.Minute}}))
+	assert.Equal(t, 10, policy.Resolve("20.3").MaxExecRetries)
+}
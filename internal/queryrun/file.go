@@ -0,0 +1,36 @@
+package queryrun
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxFileNameLength bounds names of run files, it's the common limit of file names.
+const maxFileNameLength = 255
+
+// File is placed into the user files directory of the server before the query, so file() and INFILE can read it.
+type File struct {
+	Name    string `dynamodbav:"Name"`
+	Content []byte `dynamodbav:"Content"`
+}
+
+// CheckFileName rejects names that could escape the user files directory. Files are placed flat,
+// so names cannot contain path separators.
+func CheckFileName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("file name cannot be empty")
+
+	case len(name) > maxFileNameLength:
+		return errors.Errorf("file name cannot be longer than %d bytes", maxFileNameLength)
+
+	case name == "." || name == "..":
+		return errors.Errorf("invalid file name '%s'", name)
+
+	case strings.ContainsAny(name, "/\\\x00"):
+		return errors.Errorf("file name '%s' cannot contain path separators", name)
+	}
+
+	return nil
+}
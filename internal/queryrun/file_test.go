@@ -0,0 +1,18 @@
+package queryrun
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFileName(t *testing.T) {
+	assert.NoError(t, CheckFileName("data.csv"))
+	assert.NoError(t, CheckFileName(".hidden.tsv"))
+	assert.NoError(t, CheckFileName("two..dots.json"))
+
+	for _, name := range []string{"", ".", "..", "../etc/passwd", "dir/data.csv", "/abs.csv", `..\\data.csv`, "nul\x00.csv", strings.Repeat("a", 256)} {
+		assert.Error(t, CheckFileName(name), name)
+	}
+}
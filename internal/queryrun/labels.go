@@ -0,0 +1,39 @@
+package queryrun
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const MaxLabels = 10
+const MaxLabelLength = 64
+
+var labelRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._:-]*$`)
+
+// NormalizeLabels validates user-defined labels and drops duplicates preserving the order.
+func NormalizeLabels(labels []string) ([]string, error) {
+	if len(labels) > MaxLabels {
+		return nil, errors.Errorf("too many labels (%d), at most %d are allowed", len(labels), MaxLabels)
+	}
+
+	seen := make(map[string]struct{}, len(labels))
+	normalized := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if len(l) > MaxLabelLength {
+			return nil, errors.Errorf("label '%s' is longer than %d characters", l, MaxLabelLength)
+		}
+		if !labelRegexp.MatchString(l) {
+			return nil, errors.Errorf("label '%s' contains invalid characters (allowed: letters, digits, '.', '_', ':', '-')", l)
+		}
+
+		if _, exists := seen[l]; exists {
+			continue
+		}
+
+		seen[l] = struct{}{}
+		normalized = append(normalized, l)
+	}
+
+	return normalized, nil
+}
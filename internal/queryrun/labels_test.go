@@ -0,0 +1,88 @@
+package queryrun
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	labels, err := NormalizeLabels([]string{"issue-42731", "customer-x", "issue-42731", "v21.8:regression"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"issue-42731", "customer-x", "v21.8:regression"}, labels)
+
+	labels, err = NormalizeLabels(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, labels)
+
+	_, err = NormalizeLabels([]string{"with space"})
+	assert.Error(t, err)
+
+	_, err = NormalizeLabels([]string{""})
+	assert.Error(t, err)
+
+	_, err = NormalizeLabels([]string{"-leading-dash"})
+	assert.Error(t, err)
+
+	_, err = NormalizeLabels([]string{strings.Repeat("a", MaxLabelLength+1)})
+	assert.Error(t, err)
+
+	tooMany := make([]string, MaxLabels+1)
+	for i := range tooMany {
+		tooMany[i] = strings.Repeat("a", i+1)
+	}
+	_, err = NormalizeLabels(tooMany)
+	assert.Error(t, err)
+}
+
+func TestEditToken(t *testing.T) {
+	run := New("SELECT 1", "clickhouse", "21.8", nil)
+	token := run.GenerateEditToken()
+
+	assert.NotEmpty(t, run.EditTokenHash)
+	assert.NotEqual(t, token, run.EditTokenHash)
+	assert.True(t, run.CheckEditToken(token))
+	assert.False(t, run.CheckEditToken("invalid"))
+	assert.False(t, run.CheckEditToken(""))
+}
+
+func TestRetryUnprocessed(t *testing.T) {
+	unprocessedRetryDelay = time.Millisecond
+
+	put := func(label string) types.WriteRequest {
+		return types.WriteRequest{PutRequest: &types.PutRequest{Item: map[string]types.AttributeValue{
+			"Label": &types.AttributeValueMemberS{Value: label},
+		}}}
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		var written [][]types.WriteRequest
+		err := retryUnprocessed(context.Background(), []types.WriteRequest{put("a"), put("b")}, func(batch []types.WriteRequest) ([]types.WriteRequest, error) {
+			written = append(written, batch)
+			if len(written) == 1 {
+				return batch[1:], nil
+			}
+
+			return nil, nil
+		})
+		require.NoError(t, err)
+		require.Len(t, written, 2)
+		assert.Equal(t, []types.WriteRequest{put("b")}, written[1])
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		attempts := 0
+		err := retryUnprocessed(context.Background(), []types.WriteRequest{put("a")}, func(batch []types.WriteRequest) ([]types.WriteRequest, error) {
+			attempts++
+			return batch, nil
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "1 label items have not been processed")
+		assert.Equal(t, maxUnprocessedRetries+1, attempts)
+	})
+}
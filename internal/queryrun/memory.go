@@ -0,0 +1,276 @@
+package queryrun
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMemoryMaxRuns is the default number of runs kept in memory.
+const DefaultMemoryMaxRuns = 10000
+
+// MemoryRepo keeps runs in memory, so they are lost on restart. It's meant for local deployments
+// that have no DynamoDB tables.
+type MemoryRepo struct {
+	// ttl is how long runs are kept. If it's 0, runs are kept until restart or until they are evicted.
+	ttl time.Duration
+
+	// maxRuns is the number of runs kept. Once it's exceeded, the oldest runs are evicted.
+	maxRuns int
+
+	mu   sync.Mutex
+	runs map[string]*Run
+	// order lists ids of the runs in the order they were added, so the oldest ones are evicted first.
+	// It may contain ids of runs that have been swept already.
+	order     []string
+	lastSweep time.Time
+}
+
+// NewMemoryRepository creates a repository that keeps at most maxRuns runs.
+// If maxRuns is 0, DefaultMemoryMaxRuns is used.
+func NewMemoryRepository(ttl time.Duration, maxRuns int) *MemoryRepo {
+	if maxRuns <= 0 {
+		maxRuns = DefaultMemoryMaxRuns
+	}
+
+	return &MemoryRepo{
+		ttl:       ttl,
+		maxRuns:   maxRuns,
+		runs:      make(map[string]*Run),
+		lastSweep: time.Now(),
+	}
+}
+
+func (r *MemoryRepo) Create(_ context.Context, run *Run) error {
+	if IsReservedID(run.ID) {
+		return errors.Wrap(ErrReservedID, run.ID)
+	}
+	prepareCreate(run, r.ttl)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := *run
+	r.put(&stored, time.Now())
+
+	return nil
+}
+
+// put stores the run, sweeps expired runs and evicts the oldest ones over the limit.
+// It must be called under the lock.
+func (r *MemoryRepo) put(run *Run, now time.Time) {
+	if _, found := r.runs[run.ID]; !found {
+		r.order = append(r.order, run.ID)
+	}
+	r.runs[run.ID] = run
+
+	r.sweep(now)
+
+	for len(r.runs) > r.maxRuns {
+		delete(r.runs, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// sweepInterval is how often expired runs are swept. Records of runs in flight expire
+// even if the TTL is not set, so they are swept as well.
+func (r *MemoryRepo) sweepInterval() time.Duration {
+	if r.ttl == 0 {
+		return inProgressTTL / 2
+	}
+
+	return min(r.ttl, inProgressTTL) / 2
+}
+
+// sweep removes expired runs. Every run is checked at most once per sweep interval, so creations stay cheap.
+// It must be called under the lock.
+func (r *MemoryRepo) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.sweepInterval() {
+		return
+	}
+
+	for id, run := range r.runs {
+		if run.Expired(now) {
+			delete(r.runs, id)
+		}
+	}
+
+	order := r.order[:0]
+	for _, id := range r.order {
+		if _, found := r.runs[id]; found {
+			order = append(order, id)
+		}
+	}
+	r.order = order
+	r.lastSweep = now
+}
+
+// get returns the stored run. It must be called under the lock.
+func (r *MemoryRepo) get(id string) (*Run, error) {
+	run, ok := r.runs[id]
+	if !ok || run.InProgress {
+		return nil, ErrNotFound
+	}
+	if run.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	return run, nil
+}
+
+func (r *MemoryRepo) Get(_ context.Context, id string) (*Run, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run, err := r.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	found := *run
+
+	return &found, nil
+}
+
+func (r *MemoryRepo) GetInProgress(_ context.Context, id string) (*Run, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run, ok := r.runs[id]
+	if !ok || run.Expired(time.Now()) || !run.InProgress {
+		return nil, ErrNotFound
+	}
+
+	found := *run
+
+	return &found, nil
+}
+
+func (r *MemoryRepo) SaveStages(_ context.Context, run *Run) error {
+	if IsReservedID(run.ID) {
+		return errors.Wrap(ErrReservedID, run.ID)
+	}
+
+	now := time.Now()
+	record := newInProgressRecord(run, now)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored, ok := r.runs[run.ID]; ok && !stored.InProgress {
+		return nil
+	}
+	r.put(record, now)
+
+	return nil
+}
+
+func (r *MemoryRepo) UpdateLabels(_ context.Context, run *Run, labels []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, err := r.get(run.ID)
+	if err != nil {
+		return err
+	}
+
+	stored.Labels = labels
+	run.Labels = labels
+
+	return nil
+}
+
+func (r *MemoryRepo) ListByLabel(_ context.Context, label string, limit int) ([]Summary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	var labeled []*Run
+	for _, run := range r.runs {
+		if run.Expired(now) || run.Deleted() {
+			continue
+		}
+
+		for _, l := range run.Labels {
+			if l == label {
+				labeled = append(labeled, run)
+				break
+			}
+		}
+	}
+
+	sort.Slice(labeled, func(i, j int) bool {
+		return labelSortKey(labeled[i]) > labelSortKey(labeled[j])
+	})
+	if len(labeled) > limit {
+		labeled = labeled[:limit]
+	}
+
+	summaries := make([]Summary, 0, len(labeled))
+	for _, run := range labeled {
+		summaries = append(summaries, Summary{ID: run.ID, Version: run.Version, CreatedAt: run.CreatedAt})
+	}
+
+	return summaries, nil
+}
+
+func (r *MemoryRepo) Delete(_ context.Context, run *Run, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.get(run.ID)
+	if err != nil {
+		return err
+	}
+
+	deletedAt := time.Now()
+	r.runs[run.ID] = &Run{
+		ID:             run.ID,
+		CreatedAt:      run.CreatedAt,
+		ExpiresAt:      run.ExpiresAt,
+		DeletedAt:      &deletedAt,
+		DeletionReason: reason,
+	}
+
+	run.Input = ""
+	run.Output = ""
+	run.Labels = nil
+	run.DeletedAt = &deletedAt
+	run.DeletionReason = reason
+
+	return nil
+}
+
+func (r *MemoryRepo) ListStages(_ context.Context, since time.Time, limit int) ([]RunStages, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	var recent []*Run
+	for _, run := range r.runs {
+		if run.StagesDay == "" || run.CreatedAt.Before(since) || run.Expired(now) {
+			continue
+		}
+
+		recent = append(recent, run)
+	}
+
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].CreatedAt.After(recent[j].CreatedAt)
+	})
+	if len(recent) > limit {
+		recent = recent[:limit]
+	}
+
+	runs := make([]RunStages, 0, len(recent))
+	for _, run := range recent {
+		runs = append(runs, RunStages{Version: run.Version, Stages: run.Stages})
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,189 @@
+package queryrun
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(0, 0)
+
+	old := New("SELECT 1", "clickhouse", "23.3", nil)
+	old.CreatedAt = old.CreatedAt.Add(-time.Minute)
+	old.Labels = []string{"bug-123"}
+	recent := New("SELECT 2", "clickhouse", "23.8", nil)
+	recent.Labels = []string{"bug-123", "perf"}
+
+	require.NoError(t, repo.Create(ctx, old))
+	require.NoError(t, repo.Create(ctx, recent))
+
+	found, err := repo.Get(ctx, old.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 1", found.Input)
+	assert.NotEmpty(t, found.ContentHash)
+	assert.Zero(t, found.ExpiresAt)
+
+	summaries, err := repo.ListByLabel(ctx, "bug-123", 10)
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, recent.ID, summaries[0].ID, "recent runs go first")
+
+	require.NoError(t, repo.UpdateLabels(ctx, found, nil))
+	summaries, err = repo.ListByLabel(ctx, "bug-123", 10)
+	require.NoError(t, err)
+	assert.Len(t, summaries, 1)
+
+	require.NoError(t, repo.Delete(ctx, found, DeletionReasonOwner))
+	deleted, err := repo.Get(ctx, old.ID)
+	require.NoError(t, err)
+	assert.True(t, deleted.Deleted())
+	assert.Empty(t, deleted.Input)
+
+	_, err = repo.Get(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryRepo_TTL(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(time.Hour, 0)
+
+	expired := New("SELECT 1", "clickhouse", "23.3", nil)
+	expired.CreatedAt = time.Now().Add(-2 * time.Hour)
+	live := New("SELECT 2", "clickhouse", "23.3", nil)
+
+	require.NoError(t, repo.Create(ctx, expired))
+	require.NoError(t, repo.Create(ctx, live))
+	assert.Equal(t, live.CreatedAt.Add(time.Hour).Unix(), live.ExpiresAt)
+
+	_, err := repo.Get(ctx, expired.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = repo.Get(ctx, live.ID)
+	assert.NoError(t, err)
+
+	// Expired runs are swept by the next creation once half of the TTL has passed.
+	repo.lastSweep = time.Now().Add(-time.Hour)
+	require.NoError(t, repo.Create(ctx, New("SELECT 3", "clickhouse", "23.3", nil)))
+	assert.Len(t, repo.runs, 2)
+}
+
+func TestMemoryRepo_MaxRuns(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(0, 2)
+
+	runs := make([]*Run, 3)
+	for i := range runs {
+		runs[i] = New("SELECT 1", "clickhouse", "23.3", nil)
+		require.NoError(t, repo.Create(ctx, runs[i]))
+	}
+
+	_, err := repo.Get(ctx, runs[0].ID)
+	assert.ErrorIs(t, err, ErrNotFound, "the oldest run is evicted")
+	for _, run := range runs[1:] {
+		_, err = repo.Get(ctx, run.ID)
+		assert.NoError(t, err)
+	}
+
+	// Saving the stages of a run that has been saved in flight does not make it count twice.
+	run := New("SELECT 2", "clickhouse", "23.3", nil)
+	require.NoError(t, repo.SaveStages(ctx, run))
+	require.NoError(t, repo.Create(ctx, run))
+	assert.Len(t, repo.runs, 2)
+	assert.Len(t, repo.order, 2)
+	_, err = repo.Get(ctx, run.ID)
+	assert.NoError(t, err)
+}
+
+func TestMemoryRepo_SweepInProgressWithoutTTL(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(0, 0)
+
+	abandoned := New("SELECT 1", "clickhouse", "23.3", nil)
+	require.NoError(t, repo.SaveStages(ctx, abandoned))
+	repo.runs[abandoned.ID].ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	repo.lastSweep = time.Now().Add(-inProgressTTL)
+	require.NoError(t, repo.Create(ctx, New("SELECT 2", "clickhouse", "23.3", nil)))
+	assert.NotContains(t, repo.runs, abandoned.ID)
+	assert.Len(t, repo.order, 1)
+}
+
+func TestMemoryRepo_ReservedIDs(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(0, 0)
+
+	run := New("SELECT 1", "clickhouse", "23.3", nil)
+	run.ID = ReservedIDPrefix + "blocklist"
+	assert.ErrorIs(t, repo.Create(ctx, run), ErrReservedID)
+	assert.ErrorIs(t, repo.SaveStages(ctx, run), ErrReservedID)
+
+	_, err := repo.Get(ctx, run.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, repo.Delete(ctx, run, "abuse"), ErrNotFound)
+}
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	assert.Len(t, id, 12)
+	assert.Regexp(t, `^[A-Za-z0-9_-]+$`, id)
+	assert.False(t, IsReservedID(id))
+	assert.NotEqual(t, id, NewID())
+}
+
+func TestMemoryRepo_InProgress(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(0, 0)
+
+	run := New("SELECT 1", "clickhouse", "23.3", nil)
+	run.Timeline.Record(StageImagePull, time.Now())
+	require.NoError(t, repo.SaveStages(ctx, run))
+
+	_, err := repo.Get(ctx, run.ID)
+	assert.ErrorIs(t, err, ErrNotFound, "runs in flight are not served as saved ones")
+
+	inProgress, err := repo.GetInProgress(ctx, run.ID)
+	require.NoError(t, err)
+	require.Len(t, inProgress.Stages, 1)
+	assert.Equal(t, StageImagePull, inProgress.Stages[0].Name)
+
+	run.Stages = run.Timeline.Stages()
+	require.NoError(t, repo.Create(ctx, run))
+
+	// A late save of the stages does not overwrite the saved run.
+	require.NoError(t, repo.SaveStages(ctx, run))
+	saved, err := repo.Get(ctx, run.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 1", saved.Input)
+
+	_, err = repo.GetInProgress(ctx, run.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryRepo_ListStages(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository(0, 0)
+
+	for i := 0; i < 5; i++ {
+		run := New("SELECT 1", "clickhouse", fmt.Sprintf("23.%d", i), nil)
+		run.CreatedAt = time.Now().Add(time.Duration(i-5) * time.Minute)
+		run.Stages = []Stage{{Name: StageExec, Duration: time.Second}}
+		require.NoError(t, repo.Create(ctx, run))
+	}
+	require.NoError(t, repo.Create(ctx, New("SELECT 2", "clickhouse", "23.8", nil)))
+
+	failed := New("SELECT 3", "clickhouse", "23.9", nil)
+	failed.Stages = []Stage{{Name: StageReadiness, Duration: time.Minute}}
+	failed.Error = "database server has not become ready"
+	require.NoError(t, repo.Create(ctx, failed))
+
+	runs, err := repo.ListStages(ctx, time.Now().Add(-4*time.Minute-30*time.Second), 3)
+	require.NoError(t, err)
+	require.Len(t, runs, 3, "runs without stages and failed runs are skipped")
+	assert.Equal(t, []string{"23.4", "23.3", "23.2"}, []string{runs[0].Version, runs[1].Version, runs[2].Version},
+		"the most recent runs are returned")
+}
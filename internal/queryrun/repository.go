@@ -2,6 +2,9 @@ package queryrun
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"clickhouse-playground/internal/database"
 	"clickhouse-playground/internal/database/runsettings"
@@ -15,33 +18,163 @@ import (
 
 var ErrNotFound = errors.New("not found")
 
+// ErrExpired is returned for runs that have outlived the storage TTL but have not been removed yet.
+// It wraps ErrNotFound, so callers that don't tell expired runs apart treat them as missing.
+var ErrExpired = fmt.Errorf("run has expired: %w", ErrNotFound)
+var ErrLabelIndexDisabled = errors.New("label index is not configured")
+var ErrReservedID = errors.New("id is reserved")
+var ErrStagesIndexDisabled = errors.New("stages index is not configured")
+
+// ReservedIDPrefix starts keys of documents that share the runs table with runs, e.g. the block list.
+// Generated run ids never contain it, and such items are never read or written as runs.
+const ReservedIDPrefix = "#"
+
+// IsReservedID reports whether the id is a key of a document that is not a run.
+func IsReservedID(id string) bool {
+	return strings.HasPrefix(id, ReservedIDPrefix)
+}
+
+// inProgressTTL is how long a record of a run in flight is kept. Runs that are not saved at the end
+// (e.g. failed ones) leave their records behind, so they must not be served as in progress forever.
+const inProgressTTL = time.Hour
+
 type Repository interface {
-	Create(run *Run) error
-	Get(id string) (*Run, error)
+	Create(ctx context.Context, run *Run) error
+	Get(ctx context.Context, id string) (*Run, error)
+
+	// UpdateLabels replaces labels of the run.
+	UpdateLabels(ctx context.Context, run *Run, labels []string) error
+
+	// ListByLabel returns the most recent runs with the given label.
+	ListByLabel(ctx context.Context, label string, limit int) ([]Summary, error)
+
+	// Delete removes the run data and its label items. A tombstone with the reason is kept in place of the run.
+	Delete(ctx context.Context, run *Run, reason string) error
+
+	// SaveStages saves the completed stages of a run in flight, so its timings can be read by any instance
+	// before the run is saved. A saved run is never overwritten.
+	SaveStages(ctx context.Context, run *Run) error
+
+	// GetInProgress returns the record of a run in flight saved by SaveStages.
+	GetInProgress(ctx context.Context, id string) (*Run, error)
+
+	// ListStages returns stages of at most limit most recent runs created since the given time.
+	ListStages(ctx context.Context, since time.Time, limit int) ([]RunStages, error)
+}
+
+// Summary is a short description of a run used in listings.
+type Summary struct {
+	ID        string    `dynamodbav:"RunId"`
+	Version   string    `dynamodbav:"Version"`
+	CreatedAt time.Time `dynamodbav:"CreatedAt"`
+}
+
+// labelItem links a label to a run. Label items are stored in a separate table
+// with the (Label, SortKey) primary key, so runs can be found by a label without full scans.
+type labelItem struct {
+	Label   string `dynamodbav:"Label"`
+	SortKey string `dynamodbav:"SortKey"`
+
+	// ExpiresAt is copied from the run, so label items expire together with it.
+	ExpiresAt int64 `dynamodbav:"ExpiresAt,omitempty"`
+
+	Summary
+}
+
+func newLabelItem(label string, run *Run) labelItem {
+	return labelItem{
+		Label:     label,
+		SortKey:   labelSortKey(run),
+		ExpiresAt: run.ExpiresAt,
+		Summary: Summary{
+			ID:        run.ID,
+			Version:   run.Version,
+			CreatedAt: run.CreatedAt,
+		},
+	}
+}
+
+// labelSortKey orders label items by the run creation time.
+func labelSortKey(run *Run) string {
+	return run.CreatedAt.UTC().Format(time.RFC3339Nano) + "#" + run.ID
+}
+
+// stagesDay is the partition of the stages index the run created at the time belongs to.
+func stagesDay(createdAt time.Time) string {
+	return createdAt.UTC().Format("2006-01-02")
+}
+
+// prepareCreate fills in the attributes computed when the run is saved.
+func prepareCreate(run *Run, ttl time.Duration) {
+	run.ContentHash = run.computeContentHash()
+	run.InProgress = false
+	if len(run.Stages) > 0 && !run.Failed() {
+		run.StagesDay = stagesDay(run.CreatedAt)
+	}
+	if ttl > 0 {
+		run.ExpiresAt = run.CreatedAt.Add(ttl).Unix()
+	}
+}
+
+// newInProgressRecord makes the record of a run in flight with the stages completed so far.
+func newInProgressRecord(run *Run, now time.Time) *Run {
+	return &Run{
+		ID:         run.ID,
+		Version:    run.Version,
+		CreatedAt:  run.CreatedAt,
+		Stages:     run.Timeline.Stages(),
+		Deadlines:  run.Deadlines,
+		InProgress: true,
+		ExpiresAt:  now.Add(inProgressTTL).Unix(),
+	}
 }
 
 type Repo struct {
-	ctx    context.Context
 	client *dynamodb.Client
 
 	tableName *string
+
+	// labelsTableName is optional. If it's nil, runs cannot be found by labels.
+	labelsTableName *string
+
+	// stagesIndexName is a global secondary index of the runs table with the StagesDay partition key
+	// and the CreatedAt sort key. It's optional, if it's nil, stages of recent runs cannot be listed.
+	stagesIndexName *string
+
+	// ttl is how long runs are kept. If it's 0, runs are kept forever.
+	// Expired items are removed by the DynamoDB TTL, the ExpiresAt attribute must be enabled as the TTL attribute.
+	ttl time.Duration
 }
 
-func NewRepository(ctx context.Context, client *dynamodb.Client, tableName string) *Repo {
-	return &Repo{
-		ctx:       ctx,
+func NewRepository(client *dynamodb.Client, tableName string, labelsTableName string, stagesIndexName string, ttl time.Duration) *Repo {
+	r := &Repo{
 		client:    client,
 		tableName: aws.String(tableName),
+		ttl:       ttl,
+	}
+	if labelsTableName != "" {
+		r.labelsTableName = aws.String(labelsTableName)
 	}
+	if stagesIndexName != "" {
+		r.stagesIndexName = aws.String(stagesIndexName)
+	}
+
+	return r
 }
 
-func (r *Repo) Create(run *Run) error {
+// Create saves the run. The content hash is computed here, so it's not recomputed on every read.
+func (r *Repo) Create(ctx context.Context, run *Run) error {
+	if IsReservedID(run.ID) {
+		return errors.Wrap(ErrReservedID, run.ID)
+	}
+	prepareCreate(run, r.ttl)
+
 	marshaled, err := attributevalue.MarshalMap(run)
 	if err != nil {
 		return errors.Wrap(err, "marshal failed")
 	}
 
-	_, err = r.client.PutItem(r.ctx, &dynamodb.PutItemInput{
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: r.tableName,
 		Item:      marshaled,
 	})
@@ -49,11 +182,96 @@ func (r *Repo) Create(run *Run) error {
 		return errors.Wrap(err, "put failed")
 	}
 
+	err = r.writeLabels(ctx, run, run.Labels, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to index labels")
+	}
+
+	return nil
+}
+
+// healthCheckRunID never refers to a run, it's requested to check the table is reachable.
+const healthCheckRunID = "health-check"
+
+// Ping makes a round-trip to the runs table.
+func (r *Repo) Ping(ctx context.Context) error {
+	_, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: r.tableName,
+		Key: map[string]types.AttributeValue{
+			"Id": &types.AttributeValueMemberS{Value: healthCheckRunID},
+		},
+		ProjectionExpression: aws.String("Id"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "get failed")
+	}
+
+	return nil
+}
+
+func (r *Repo) Get(ctx context.Context, id string) (*Run, error) {
+	run, err := r.getItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if run.InProgress {
+		return nil, ErrNotFound
+	}
+
+	return run, nil
+}
+
+func (r *Repo) GetInProgress(ctx context.Context, id string) (*Run, error) {
+	run, err := r.getItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !run.InProgress {
+		return nil, ErrNotFound
+	}
+
+	return run, nil
+}
+
+// SaveStages puts the record of the run in flight unless the run has been saved meanwhile.
+func (r *Repo) SaveStages(ctx context.Context, run *Run) error {
+	if IsReservedID(run.ID) {
+		return errors.Wrap(ErrReservedID, run.ID)
+	}
+
+	marshaled, err := attributevalue.MarshalMap(newInProgressRecord(run, time.Now()))
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           r.tableName,
+		Item:                marshaled,
+		ConditionExpression: aws.String("attribute_not_exists(Id) OR InProgress = :inProgress"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inProgress": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "put failed")
+	}
+
 	return nil
 }
 
-func (r *Repo) Get(id string) (*Run, error) {
-	out, err := r.client.GetItem(r.ctx, &dynamodb.GetItemInput{
+// getItem returns the stored item of the run, either a saved run or a record of a run in flight.
+// Documents stored under reserved ids are not runs, so they are never found.
+func (r *Repo) getItem(ctx context.Context, id string) (*Run, error) {
+	if IsReservedID(id) {
+		return nil, ErrNotFound
+	}
+
+	out, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: r.tableName,
 		Key: map[string]types.AttributeValue{
 			"Id": &types.AttributeValueMemberS{Value: id},
@@ -81,6 +299,294 @@ func (r *Repo) Get(id string) (*Run, error) {
 	if run.ID == "" {
 		return nil, ErrNotFound
 	}
+	// DynamoDB removes expired items within a few days, they must not be served meanwhile.
+	if run.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
 
 	return run, nil
 }
+
+func (r *Repo) UpdateLabels(ctx context.Context, run *Run, labels []string) error {
+	if IsReservedID(run.ID) {
+		return ErrNotFound
+	}
+
+	marshaled, err := attributevalue.Marshal(labels)
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: r.tableName,
+		Key: map[string]types.AttributeValue{
+			"Id": &types.AttributeValueMemberS{Value: run.ID},
+		},
+		UpdateExpression: aws.String("SET Labels = :labels"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":labels": marshaled,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "update failed")
+	}
+
+	err = r.writeLabels(ctx, run, labels, run.Labels)
+	if err != nil {
+		return errors.Wrap(err, "failed to index labels")
+	}
+
+	run.Labels = labels
+
+	return nil
+}
+
+func (r *Repo) Delete(ctx context.Context, run *Run, reason string) error {
+	if IsReservedID(run.ID) {
+		return ErrNotFound
+	}
+
+	err := r.writeLabels(ctx, run, nil, run.Labels)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete label items")
+	}
+
+	deletedAt := time.Now()
+	tombstone := &Run{
+		ID:             run.ID,
+		CreatedAt:      run.CreatedAt,
+		ExpiresAt:      run.ExpiresAt,
+		DeletedAt:      &deletedAt,
+		DeletionReason: reason,
+	}
+
+	marshaled, err := attributevalue.MarshalMap(tombstone)
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	// The item is replaced as a whole, so the input and the output are dropped.
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           r.tableName,
+		Item:                marshaled,
+		ConditionExpression: aws.String("attribute_exists(Id)"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "put failed")
+	}
+
+	run.Input = ""
+	run.Output = ""
+	run.Labels = nil
+	run.DeletedAt = &deletedAt
+	run.DeletionReason = reason
+
+	return nil
+}
+
+// writeLabels puts label items for added labels and deletes items of removed labels.
+func (r *Repo) writeLabels(ctx context.Context, run *Run, labels []string, previous []string) error {
+	if r.labelsTableName == nil {
+		return nil
+	}
+
+	current := make(map[string]struct{}, len(labels))
+	for _, l := range labels {
+		current[l] = struct{}{}
+	}
+
+	var requests []types.WriteRequest
+	for _, l := range previous {
+		if _, kept := current[l]; kept {
+			continue
+		}
+
+		requests = append(requests, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{
+				Key: map[string]types.AttributeValue{
+					"Label":   &types.AttributeValueMemberS{Value: l},
+					"SortKey": &types.AttributeValueMemberS{Value: labelSortKey(run)},
+				},
+			},
+		})
+	}
+
+	for _, l := range labels {
+		item, err := attributevalue.MarshalMap(newLabelItem(l, run))
+		if err != nil {
+			return errors.Wrap(err, "marshal failed")
+		}
+
+		requests = append(requests, types.WriteRequest{
+			PutRequest: &types.PutRequest{Item: item},
+		})
+	}
+
+	// BatchWriteItem accepts at most 25 requests.
+	const batchSize = 25
+	for len(requests) > 0 {
+		n := batchSize
+		if len(requests) < n {
+			n = len(requests)
+		}
+
+		err := retryUnprocessed(ctx, requests[:n], func(batch []types.WriteRequest) ([]types.WriteRequest, error) {
+			out, err := r.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{
+					*r.labelsTableName: batch,
+				},
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "batch write failed")
+			}
+
+			return out.UnprocessedItems[*r.labelsTableName], nil
+		})
+		if err != nil {
+			return err
+		}
+
+		requests = requests[n:]
+	}
+
+	return nil
+}
+
+const maxUnprocessedRetries = 5
+
+// unprocessedRetryDelay is the first delay before items are written again, it doubles with every retry.
+var unprocessedRetryDelay = 50 * time.Millisecond
+
+// retryUnprocessed writes the batch and retries the items the table has not processed, e.g. because of throttling.
+// It fails if some items are still unprocessed after all retries.
+func retryUnprocessed(ctx context.Context, batch []types.WriteRequest, write func([]types.WriteRequest) ([]types.WriteRequest, error)) error {
+	delay := unprocessedRetryDelay
+	for attempt := 0; ; attempt++ {
+		unprocessed, err := write(batch)
+		if err != nil {
+			return err
+		}
+		if len(unprocessed) == 0 {
+			return nil
+		}
+		if attempt == maxUnprocessedRetries {
+			return errors.Errorf("%d label items have not been processed", len(unprocessed))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(ctx.Err(), "%d label items have not been processed", len(unprocessed))
+		case <-timer.C:
+		}
+
+		batch = unprocessed
+		delay *= 2
+	}
+}
+
+func (r *Repo) ListByLabel(ctx context.Context, label string, limit int) ([]Summary, error) {
+	if r.labelsTableName == nil {
+		return nil, ErrLabelIndexDisabled
+	}
+
+	out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              r.labelsTableName,
+		KeyConditionExpression: aws.String("Label = :label"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":label": &types.AttributeValueMemberS{Value: label},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	var items []labelItem
+	err = attributevalue.UnmarshalListOfMaps(out.Items, &items)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal failed")
+	}
+
+	now := time.Now()
+	summaries := make([]Summary, 0, len(items))
+	for _, item := range items {
+		if item.ExpiresAt != 0 && now.Unix() >= item.ExpiresAt {
+			continue
+		}
+
+		summaries = append(summaries, item.Summary)
+	}
+
+	return summaries, nil
+}
+
+// ListStages queries the stages index day by day from the most recent runs backwards.
+func (r *Repo) ListStages(ctx context.Context, since time.Time, limit int) ([]RunStages, error) {
+	if r.stagesIndexName == nil {
+		return nil, ErrStagesIndexDisabled
+	}
+
+	sinceValue, err := attributevalue.Marshal(since)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal failed")
+	}
+
+	var runs []RunStages
+	sinceDay := stagesDay(since)
+	for day := time.Now().UTC(); stagesDay(day) >= sinceDay && len(runs) < limit; day = day.AddDate(0, 0, -1) {
+		runs, err = r.listDayStages(ctx, stagesDay(day), since, sinceValue, runs, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return runs, nil
+}
+
+// listDayStages appends stages of runs of the day to runs until the limit is reached.
+func (r *Repo) listDayStages(ctx context.Context, day string, since time.Time, sinceValue types.AttributeValue, runs []RunStages, limit int) ([]RunStages, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              r.tableName,
+		IndexName:              r.stagesIndexName,
+		KeyConditionExpression: aws.String("StagesDay = :day AND CreatedAt >= :since"),
+		ProjectionExpression:   aws.String("CreatedAt, Version, Stages"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":day":   &types.AttributeValueMemberS{Value: day},
+			":since": sinceValue,
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit - len(runs))),
+	}
+
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+	for paginator.HasMorePages() && len(runs) < limit {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "query failed")
+		}
+
+		var items []struct {
+			CreatedAt time.Time `dynamodbav:"CreatedAt"`
+			Version   string    `dynamodbav:"Version"`
+			Stages    []Stage   `dynamodbav:"Stages"`
+		}
+		err = attributevalue.UnmarshalListOfMaps(out.Items, &items)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshal failed")
+		}
+
+		for _, item := range items {
+			// Timestamps are compared as strings by DynamoDB, so they are checked once again.
+			if item.CreatedAt.Before(since) || len(runs) >= limit {
+				continue
+			}
+
+			runs = append(runs, RunStages{Version: item.Version, Stages: item.Stages})
+		}
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,27 @@
+package queryrun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The block list shares the runs table, so documents under reserved ids must never reach DynamoDB as runs.
+// The repository has no client here: it must not be called.
+func TestRepo_ReservedIDs(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository(nil, "runs", "", "", 0)
+
+	run := New("SELECT 1", "clickhouse", "23.3", nil)
+	run.ID = ReservedIDPrefix + "blocklist"
+
+	_, err := repo.Get(ctx, run.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = repo.GetInProgress(ctx, run.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, repo.UpdateLabels(ctx, run, []string{"bug"}), ErrNotFound)
+	assert.ErrorIs(t, repo.Delete(ctx, run, "abuse"), ErrNotFound)
+	assert.ErrorIs(t, repo.Create(ctx, run), ErrReservedID)
+	assert.ErrorIs(t, repo.SaveStages(ctx, run), ErrReservedID)
+}
@@ -1,34 +1,347 @@
 package queryrun
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"clickhouse-playground/internal/database/runsettings"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// NetworkNone is the network mode of runs that have opted out of the deployment network.
+const NetworkNone = "none"
+
+// Priority classes of runs. Interactive runs are dispatched before async ones, and both are dispatched
+// before background work (e.g. canary checks) when runners are busy.
+const (
+	PriorityInteractive = "interactive"
+	PriorityAsync       = "async"
+	PriorityBackground  = "background"
+)
+
+// Priorities lists the priority classes from the highest one.
+var Priorities = []string{PriorityInteractive, PriorityAsync, PriorityBackground}
+
+// Reasons of run deletions.
+const (
+	DeletionReasonOwner = "removed by owner"
+	DeletionReasonAdmin = "removed by administrator"
 )
 
 type Run struct {
 	ID string `dynamodbav:"Id"`
 
 	Version string `dynamodbav:"Version"`
-	Input   string `dynamodbav:"Input"`
-	Output  string `dynamodbav:"Output"`
+
+	// RequestedVersion is the version provided by a user. It may be partial (e.g. "21.8"),
+	// while Version is the concrete tag it has been resolved to.
+	RequestedVersion string `dynamodbav:"RequestedVersion,omitempty"`
+
+	// ServerVersion is the version reported by the database server.
+	// VersionMismatch is true if it does not match Version.
+	ServerVersion   string `dynamodbav:"ServerVersion,omitempty"`
+	VersionMismatch bool   `dynamodbav:"VersionMismatch,omitempty"`
+
+	// ImageRepository and ImageDigest identify the image Version has been resolved to.
+	// They are empty for runs saved before digests were recorded.
+	ImageRepository string `dynamodbav:"ImageRepository,omitempty"`
+	ImageDigest     string `dynamodbav:"ImageDigest,omitempty"`
+
+	// ImageBuildDate is set for runs of rolling tags (e.g. head), which are re-pushed with every build.
+	ImageBuildDate *time.Time `dynamodbav:"ImageBuildDate,omitempty"`
+
+	// Runner is the name of the runner that has executed the run.
+	Runner string `dynamodbav:"Runner,omitempty"`
+
+	// ExecutionProfile is the settings profile enforced by the deployment, e.g. "restricted".
+	ExecutionProfile string `dynamodbav:"ExecutionProfile,omitempty"`
+
+	// Tool is set if an auxiliary tool (e.g. clickhouse-benchmark) has been run instead of the query.
+	// Input is passed to the tool then.
+	Tool       string            `dynamodbav:"Tool,omitempty"`
+	ToolParams map[string]string `dynamodbav:"ToolParams,omitempty"`
+
+	// Network is NetworkNone if the run has opted out of the deployment network. Otherwise, it's empty.
+	Network string `dynamodbav:"Network,omitempty"`
+
+	// EgressDenied lists destinations rejected by the restricted egress allowlist during the run.
+	EgressDenied []string `dynamodbav:"EgressDenied,omitempty"`
+
+	// EmulatedArchitecture is the architecture of the image if it differs from the host one,
+	// so the run has been executed under emulation and its timings are not representative.
+	EmulatedArchitecture string `dynamodbav:"EmulatedArchitecture,omitempty"`
+
+	// Warnings are non-fatal notices for the user, e.g. the version is deprecated.
+	// They are added by the API and by the runner and are kept with the run.
+	Warnings []Warning `dynamodbav:"Warnings,omitempty"`
+
+	// ParentID is the run this run re-runs, possibly on another version.
+	ParentID string `dynamodbav:"ParentId,omitempty"`
+
+	// ImportedFrom is the url the input has been imported from. Imported runs have no output until they are re-run.
+	ImportedFrom string `dynamodbav:"ImportedFrom,omitempty"`
+
+	// Canary is true if the run has been executed by the service to validate the version.
+	Canary bool `dynamodbav:"Canary,omitempty"`
+
+	// Abandoned is true if the client has disconnected before the run was finished.
+	Abandoned bool `dynamodbav:"Abandoned,omitempty"`
+
+	Input  string `dynamodbav:"Input"`
+	Output string `dynamodbav:"Output"`
+
+	// Statements are set if the statements of Input are executed separately in the same container,
+	// then they keep the result of every statement. Output and Stderr combine the results.
+	// The run is stopped at the first failed statement unless ContinueOnError is set.
+	Statements      []Statement `dynamodbav:"Statements,omitempty"`
+	ContinueOnError bool        `dynamodbav:"ContinueOnError,omitempty"`
+
+	// Stderr is the error stream of the run. Output contains both streams: stdout, then stderr.
+	// It's empty for runs saved before streams were tracked separately.
+	Stderr string `dynamodbav:"Stderr,omitempty"`
+
+	// ExitCode is the exit code of the database client or the tool. It's 0 for runs saved before it was recorded.
+	ExitCode int `dynamodbav:"ExitCode,omitempty"`
+
+	// Truncated is set if the output has exceeded the limit of the runner. DroppedBytes have been cut at least.
+	Truncated    bool   `dynamodbav:"Truncated,omitempty"`
+	DroppedBytes uint64 `dynamodbav:"DroppedBytes,omitempty"`
 
 	Database string                  `dynamodbav:"Database"`
 	Settings runsettings.RunSettings `dynamodbav:"Settings"`
 
+	// User-defined labels for search.
+	Labels []string `dynamodbav:"Labels,omitempty"`
+
+	// EditTokenHash is a hash of the token that allows editing the run.
+	EditTokenHash string `dynamodbav:"EditTokenHash,omitempty"`
+
 	CreatedAt     time.Time     `dynamodbav:"CreatedAt"`
 	ExecutionTime time.Duration `dynamodbav:"ExecutionTime"`
+
+	// ContentHash is a hash of the immutable run content, it's computed when the run is saved.
+	// Labels are not included, as they can be changed.
+	ContentHash string `dynamodbav:"ContentHash,omitempty"`
+
+	// SetupTime is spent on the container (pull, create, start and readiness), QueryTime is spent on the query.
+	// They are taken from Stages and are zero for runs saved before stages were tracked.
+	SetupTime time.Duration `dynamodbav:"SetupTime,omitempty"`
+	QueryTime time.Duration `dynamodbav:"QueryTime,omitempty"`
+
+	// DeletedAt is set when the run has been deleted. Only a tombstone with the deletion reason is kept,
+	// so lookups can tell deleted runs from unknown ones.
+	DeletedAt      *time.Time `dynamodbav:"DeletedAt,omitempty"`
+	DeletionReason string     `dynamodbav:"DeletionReason,omitempty"`
+
+	// ContainerSnapshot is captured before cleanup if the run has failed because of the infrastructure.
+	// It's available only to administrators.
+	ContainerSnapshot *ContainerSnapshot `dynamodbav:"ContainerSnapshot,omitempty"`
+
+	// Error describes why the run has failed. Failed runs are saved only if they have a container snapshot.
+	Error string `dynamodbav:"Error,omitempty"`
+
+	// Stages are the pipeline steps of the run. They are taken from Timeline when the run is saved.
+	Stages []Stage `dynamodbav:"Stages,omitempty"`
+
+	// StagesDay is the creation day of a saved run with stages. It's the partition key of the stages index,
+	// so recent runs are listed day by day in the creation order.
+	StagesDay string `dynamodbav:"StagesDay,omitempty"`
+
+	// InProgress is set on the record of a run in flight that has only its completed stages saved.
+	// The record is replaced by the complete run when it's saved.
+	InProgress bool `dynamodbav:"InProgress,omitempty"`
+
+	// Deadlines are the limits the run has been executed with. If it's nil, the runner uses its defaults.
+	Deadlines *Deadlines `dynamodbav:"Deadlines,omitempty"`
+
+	// ExpiresAt is the unix time (in seconds) the run is removed at, it's the TTL attribute of the table.
+	// It's 0 if runs are kept forever.
+	ExpiresAt int64 `dynamodbav:"ExpiresAt,omitempty"`
+
+	// Timeline is filled in by the runner while the run is in flight.
+	Timeline *Timeline `dynamodbav:"-"`
+
+	// OutputStream receives stdout of the query as it's produced. Write errors are not reported by it,
+	// so the run is not failed by a slow or gone client. It's nil if the output is not streamed.
+	OutputStream io.Writer `dynamodbav:"-"`
+
+	// ClientID identifies the client that has sent the run request.
+	ClientID string `dynamodbav:"-"`
+
+	// TargetRunner is the runner explicitly selected by the client. If it's empty, any runner can be used.
+	TargetRunner string `dynamodbav:"-"`
+
+	// PreparationToken refers to a container reserved for the run in advance.
+	PreparationToken string `dynamodbav:"-"`
+
+	// KeepContainerOnFailure overrides the deployment setting that holds containers of failed runs for inspection.
+	KeepContainerOnFailure *bool `dynamodbav:"-"`
+
+	// Priority is the class the run is scheduled in. If it's empty, the run is interactive.
+	Priority string `dynamodbav:"-"`
+
+	// Resources override the container limits of the runner. If it's nil, the runner limits are used.
+	Resources *Resources `dynamodbav:"-"`
+
+	// PinnedImage makes the runner use ImageRepository and ImageDigest instead of resolving Version again,
+	// so a run is reproduced on the same image even if its tag has been re-pushed.
+	PinnedImage bool `dynamodbav:"-"`
+
+	// AllowEmulation acknowledges that the run may be executed under emulation. Tools that need native
+	// execution (e.g. benchmarks) refuse to run under emulation otherwise.
+	AllowEmulation bool `dynamodbav:"-"`
+
+	// Files are placed into the container before the query. They are saved with the run, so re-runs
+	// and bundles can restore them; their total size is bounded by the max files size of the API.
+	Files []File `dynamodbav:"Files,omitempty"`
+}
+
+// Resources are container limits. Zero fields keep the limits of the runner.
+type Resources struct {
+	MemoryLimit uint64 // In bytes.
+	CPULimit    uint64 // In nano cpus.
+	PidsLimit   int64
 }
 
 func New(input string, database string, version string, settings runsettings.RunSettings) *Run {
 	return &Run{
-		ID:        uuid.New().String(),
+		ID:        NewID(),
 		CreatedAt: time.Now(),
 		Input:     input,
 		Database:  database,
 		Version:   version,
 		Settings:  settings,
+		Timeline:  NewTimeline(),
+	}
+}
+
+// idLength is the number of random bytes of run IDs. 9 bytes are 12 characters in base64.
+const idLength = 9
+
+// NewID generates a short URL-safe run ID, so shared links stay readable.
+// Runs created before have UUIDs, both kinds are looked up the same way.
+func NewID() string {
+	b := make([]byte, idLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(errors.Wrap(err, "failed to generate run id"))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Expired reports whether the run has outlived the storage TTL. Expired runs may be still stored for a while,
+// as expired items are removed by the storage in the background.
+func (r *Run) Expired(now time.Time) bool {
+	return r.ExpiresAt != 0 && now.Unix() >= r.ExpiresAt
+}
+
+// Deleted reports whether the run has been deleted.
+func (r *Run) Deleted() bool {
+	return r.DeletedAt != nil
+}
+
+// Failed reports whether the run has failed and has been saved only for debugging.
+// Failed runs are available to administrators only, they are not included in the history and stats.
+func (r *Run) Failed() bool {
+	return r.Error != ""
+}
+
+// Stdout returns the standard output stream of the run.
+// If streams have not been tracked separately, the whole output is returned.
+func (r *Run) Stdout() string {
+	if r.Stderr == "" {
+		return r.Output
+	}
+
+	return strings.TrimSuffix(r.Output, "\n"+r.Stderr)
+}
+
+// Digest returns the hash of the immutable run content.
+// It's computed on the fly for runs saved before the hash was stored.
+func (r *Run) Digest() string {
+	if r.ContentHash != "" {
+		return r.ContentHash
 	}
+
+	return r.computeContentHash()
+}
+
+func (r *Run) computeContentHash() string {
+	h := sha256.New()
+
+	toolParams := make([]string, 0, len(r.ToolParams))
+	for name, value := range r.ToolParams {
+		toolParams = append(toolParams, name+"="+value)
+	}
+	sort.Strings(toolParams)
+
+	fields := []string{
+		r.ID, r.Version, r.RequestedVersion, r.ServerVersion, strconv.FormatBool(r.VersionMismatch),
+		r.ExecutionProfile, r.Tool, strings.Join(toolParams, "&"), r.ParentID, r.ImportedFrom, r.Network, strings.Join(r.EgressDenied, ","),
+		r.Database, fmt.Sprintf("%+v", r.Settings),
+		r.Input, r.Output, r.Stderr, r.CreatedAt.UTC().Format(time.RFC3339Nano),
+		r.ExecutionTime.String(), r.SetupTime.String(), r.QueryTime.String(),
+	}
+
+	// Statements are hashed only if they are set, so hashes of runs saved before them are not changed.
+	if len(r.Statements) > 0 {
+		fields = append(fields, strconv.FormatBool(r.ContinueOnError))
+		for _, s := range r.Statements {
+			fields = append(fields, s.Query, strconv.FormatBool(s.Executed), s.Stdout, s.Stderr,
+				strconv.Itoa(s.ExitCode), s.Elapsed.String())
+		}
+	}
+
+	if r.Truncated {
+		fields = append(fields, strconv.FormatUint(r.DroppedBytes, 10))
+	}
+
+	// Files are hashed only if they are set, so hashes of runs saved before them are not changed.
+	for _, f := range r.Files {
+		fields = append(fields, f.Name, string(f.Content))
+	}
+
+	// Fields are prefixed with their lengths, so they cannot be shifted from one to another.
+	for _, f := range fields {
+		_, _ = fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GenerateEditToken generates a new token that allows editing the run.
+// Only the token hash is stored in the run.
+func (r *Run) GenerateEditToken() string {
+	token := uuid.New().String()
+	r.EditTokenHash = hashEditToken(token)
+
+	return token
+}
+
+// CheckEditToken verifies the provided edit token.
+func (r *Run) CheckEditToken(token string) bool {
+	if token == "" || r.EditTokenHash == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashEditToken(token)), []byte(r.EditTokenHash)) == 1
+}
+
+func hashEditToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,37 @@
+package queryrun
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun_Stdout(t *testing.T) {
+	run := &Run{Output: "1\n2\n"}
+	assert.Equal(t, "1\n2\n", run.Stdout())
+
+	run = &Run{Output: "1\n\nCode: 60. Unknown table", Stderr: "Code: 60. Unknown table"}
+	assert.Equal(t, "1\n", run.Stdout())
+}
+
+func TestRun_Digest(t *testing.T) {
+	run := New("SELECT 1", "clickhouse", "23.3.1.2823", nil)
+	run.Output = "1\n"
+
+	digest := run.Digest()
+	assert.Len(t, digest, 64)
+	assert.Equal(t, digest, run.Digest())
+
+	// Labels can be changed, so they do not affect the digest.
+	run.Labels = []string{"bug"}
+	assert.Equal(t, digest, run.Digest())
+
+	// Fields cannot be shifted from one to another.
+	shifted := *run
+	shifted.Input, shifted.Output = run.Input+run.Output, ""
+	assert.NotEqual(t, digest, shifted.Digest())
+
+	// The stored hash is used as is.
+	run.ContentHash = "stored"
+	assert.Equal(t, "stored", run.Digest())
+}
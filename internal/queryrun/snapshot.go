@@ -0,0 +1,47 @@
+package queryrun
+
+import "time"
+
+// ContainerSnapshot describes the state of a run container for debugging.
+// It's captured on demand for in-flight runs and automatically before cleanup of failed runs.
+type ContainerSnapshot struct {
+	ContainerID string    `json:"container_id"`
+	Image       string    `json:"image"`
+	CapturedAt  time.Time `json:"captured_at"`
+
+	// Reason is why the snapshot has been captured: on request or the failure of the run.
+	Reason string `json:"reason"`
+
+	State     ContainerState     `json:"state"`
+	Resources ContainerResources `json:"resources"`
+	Mounts    []string           `json:"mounts,omitempty"`
+
+	// Stats is nil if the container is not running.
+	Stats *ContainerStats `json:"stats,omitempty"`
+
+	// Logs is the tail of the container logs. LogsTruncated is true if older logs have been dropped.
+	Logs          string `json:"logs"`
+	LogsTruncated bool   `json:"logs_truncated,omitempty"`
+}
+
+type ContainerState struct {
+	Status     string `json:"status"`
+	OOMKilled  bool   `json:"oom_killed"`
+	ExitCode   int    `json:"exit_code"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+type ContainerResources struct {
+	NanoCPUs int64  `json:"nano_cpus"`
+	CPUSet   string `json:"cpuset,omitempty"`
+	Memory   int64  `json:"memory"`
+}
+
+type ContainerStats struct {
+	CPUUsage    uint64 `json:"cpu_usage_ns"`
+	MemoryUsage uint64 `json:"memory_usage"`
+	MemoryLimit uint64 `json:"memory_limit"`
+	PIDs        uint64 `json:"pids"`
+}
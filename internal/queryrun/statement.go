@@ -0,0 +1,34 @@
+package queryrun
+
+import (
+	"strings"
+	"time"
+)
+
+// Statement is a step of a run that executes statements separately, and its result.
+type Statement struct {
+	Query string `dynamodbav:"Query"`
+
+	// Executed is false if the statement has been skipped, since a previous one has failed.
+	Executed bool `dynamodbav:"Executed,omitempty"`
+
+	Stdout   string        `dynamodbav:"Stdout,omitempty"`
+	Stderr   string        `dynamodbav:"Stderr,omitempty"`
+	ExitCode int           `dynamodbav:"ExitCode,omitempty"`
+	Elapsed  time.Duration `dynamodbav:"Elapsed,omitempty"`
+}
+
+// NewStatements returns statements that have not been executed yet.
+func NewStatements(queries []string) []Statement {
+	statements := make([]Statement, 0, len(queries))
+	for _, q := range queries {
+		statements = append(statements, Statement{Query: q})
+	}
+
+	return statements
+}
+
+// JoinStatements joins the statements into a single input, so the run can be shared and re-run as a whole.
+func JoinStatements(queries []string) string {
+	return strings.Join(queries, ";\n") + ";"
+}
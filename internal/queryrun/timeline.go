@@ -0,0 +1,332 @@
+package queryrun
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"clickhouse-playground/pkg/chsemver"
+)
+
+// Pipeline stages of a run.
+const (
+	StageQueue           = "queue"
+	StageImagePull       = "image_pull"
+	StageContainerCreate = "container_create"
+	StageContainerStart  = "container_start"
+	StageReadiness       = "readiness"
+	StageExec            = "exec"
+	StageCleanup         = "cleanup"
+)
+
+// Stage is a completed step of the run pipeline.
+type Stage struct {
+	Name      string        `dynamodbav:"Name"`
+	StartedAt time.Time     `dynamodbav:"StartedAt"`
+	Duration  time.Duration `dynamodbav:"Duration"`
+
+	// Attempts is the number of tries made by a retried stage (e.g. readiness probes).
+	Attempts int `dynamodbav:"Attempts,omitempty"`
+
+	// Source is where the stage got its data from, e.g. the registry mirror that served the image pull.
+	Source string `dynamodbav:"Source,omitempty"`
+}
+
+func (s Stage) FinishedAt() time.Time {
+	return s.StartedAt.Add(s.Duration)
+}
+
+// Timeline collects stages while the run is being processed.
+// It's safe for concurrent use, so stages can be read while the run is in flight.
+type Timeline struct {
+	mu      sync.Mutex
+	stages  []Stage
+	changed chan struct{}
+}
+
+func NewTimeline() *Timeline {
+	return &Timeline{}
+}
+
+// Record adds a stage that started at startedAt and has just been completed.
+// It does nothing if the timeline is nil.
+func (t *Timeline) Record(name string, startedAt time.Time) {
+	t.RecordAttempts(name, startedAt, 0)
+}
+
+// RecordAttempts works like Record for stages that are retried.
+func (t *Timeline) RecordAttempts(name string, startedAt time.Time, attempts int) {
+	t.add(Stage{
+		Name:      name,
+		StartedAt: startedAt,
+		Duration:  time.Since(startedAt),
+		Attempts:  attempts,
+	})
+}
+
+// RecordSource works like Record for stages that can be served by different sources.
+func (t *Timeline) RecordSource(name string, startedAt time.Time, source string) {
+	t.add(Stage{
+		Name:      name,
+		StartedAt: startedAt,
+		Duration:  time.Since(startedAt),
+		Source:    source,
+	})
+}
+
+func (t *Timeline) add(stage Stage) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stages = append(t.stages, stage)
+
+	select {
+	case t.changedChan() <- struct{}{}:
+	default:
+	}
+}
+
+// Changed is notified when a stage is added. Notifications made before the previous one is received are merged.
+func (t *Timeline) Changed() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.changedChan()
+}
+
+// changedChan must be called under the lock.
+func (t *Timeline) changedChan() chan struct{} {
+	if t.changed == nil {
+		t.changed = make(chan struct{}, 1)
+	}
+
+	return t.changed
+}
+
+// Stages returns a copy of the completed stages.
+func (t *Timeline) Stages() []Stage {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stages := make([]Stage, len(t.stages))
+	copy(stages, t.stages)
+
+	return stages
+}
+
+// RunStages are the stages of a stored run.
+type RunStages struct {
+	Version string
+	Stages  []Stage
+}
+
+// StageSummary aggregates durations of a stage across runs.
+type StageSummary struct {
+	Name  string
+	Count int
+
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// SummarizeStages computes percentiles of stage durations. If a stage happened several times
+// in a run, the durations are summed up. Stages are ordered by the pipeline order.
+func SummarizeStages(runs []RunStages) []StageSummary {
+	durations := make(map[string][]time.Duration)
+	for _, run := range runs {
+		perRun := make(map[string]time.Duration)
+		for _, s := range run.Stages {
+			perRun[s.Name] += s.Duration
+		}
+
+		for name, d := range perRun {
+			durations[name] = append(durations[name], d)
+		}
+	}
+
+	summaries := make([]StageSummary, 0, len(durations))
+	for name, ds := range durations {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+
+		summaries = append(summaries, StageSummary{
+			Name:  name,
+			Count: len(ds),
+			P50:   percentile(ds, 50),
+			P90:   percentile(ds, 90),
+			P99:   percentile(ds, 99),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		oi, oj := stageOrder(summaries[i].Name), stageOrder(summaries[j].Name)
+		if oi != oj {
+			return oi < oj
+		}
+
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	return summaries
+}
+
+// SplitDurations returns the time spent on the container setup (image pull, container creation and start,
+// readiness wait) and on the query execution. The queue and cleanup stages are not counted.
+func SplitDurations(stages []Stage) (setup time.Duration, query time.Duration) {
+	for _, s := range stages {
+		switch s.Name {
+		case StageImagePull, StageContainerCreate, StageContainerStart, StageReadiness:
+			setup += s.Duration
+
+		case StageExec:
+			query += s.Duration
+		}
+	}
+
+	return setup, query
+}
+
+// LatencySummary aggregates setup and query durations of runs of a version series.
+type LatencySummary struct {
+	Series string
+	Runs   int
+
+	P50Setup time.Duration
+	P95Setup time.Duration
+
+	P50Query time.Duration
+	P95Query time.Duration
+}
+
+// SummarizeLatency computes percentiles of setup and query durations per version series,
+// so the infrastructure latency can be told from the query latency. Summaries are ordered by the series.
+func SummarizeLatency(runs []RunStages) []LatencySummary {
+	setups := make(map[string][]time.Duration)
+	queries := make(map[string][]time.Duration)
+	for _, run := range runs {
+		if len(run.Stages) == 0 {
+			continue
+		}
+
+		setup, query := SplitDurations(run.Stages)
+		series := chsemver.Series(run.Version)
+		setups[series] = append(setups[series], setup)
+		queries[series] = append(queries[series], query)
+	}
+
+	summaries := make([]LatencySummary, 0, len(setups))
+	for series, ss := range setups {
+		qs := queries[series]
+		sort.Slice(ss, func(i, j int) bool { return ss[i] < ss[j] })
+		sort.Slice(qs, func(i, j int) bool { return qs[i] < qs[j] })
+
+		summaries = append(summaries, LatencySummary{
+			Series:   series,
+			Runs:     len(ss),
+			P50Setup: percentile(ss, 50),
+			P95Setup: percentile(ss, 95),
+			P50Query: percentile(qs, 50),
+			P95Query: percentile(qs, 95),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return chsemver.IsGreater(chsemver.Parse(summaries[j].Series), chsemver.Parse(summaries[i].Series))
+	})
+
+	return summaries
+}
+
+// ReadinessSummary aggregates the readiness stage of runs of a version series.
+type ReadinessSummary struct {
+	Series string
+	Runs   int
+
+	P50Wait time.Duration
+	P95Wait time.Duration
+
+	P50Attempts int
+	P95Attempts int
+}
+
+// SummarizeReadiness computes percentiles of the readiness wait and attempts per version series.
+// Summaries are ordered by the series.
+func SummarizeReadiness(runs []RunStages) []ReadinessSummary {
+	waits := make(map[string][]time.Duration)
+	attempts := make(map[string][]int)
+	for _, run := range runs {
+		for _, s := range run.Stages {
+			if s.Name != StageReadiness {
+				continue
+			}
+
+			series := chsemver.Series(run.Version)
+			waits[series] = append(waits[series], s.Duration)
+			attempts[series] = append(attempts[series], s.Attempts)
+		}
+	}
+
+	summaries := make([]ReadinessSummary, 0, len(waits))
+	for series, ws := range waits {
+		as := attempts[series]
+		sort.Slice(ws, func(i, j int) bool { return ws[i] < ws[j] })
+		sort.Ints(as)
+
+		summaries = append(summaries, ReadinessSummary{
+			Series:      series,
+			Runs:        len(ws),
+			P50Wait:     percentile(ws, 50),
+			P95Wait:     percentile(ws, 95),
+			P50Attempts: percentile(as, 50),
+			P95Attempts: percentile(as, 95),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return chsemver.IsGreater(chsemver.Parse(summaries[j].Series), chsemver.Parse(summaries[i].Series))
+	})
+
+	return summaries
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile[T int | time.Duration](sorted []T, p int) T {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+var stagesInOrder = []string{
+	StageQueue,
+	StageImagePull,
+	StageContainerCreate,
+	StageContainerStart,
+	StageReadiness,
+	StageExec,
+	StageCleanup,
+}
+
+func stageOrder(name string) int {
+	for i, s := range stagesInOrder {
+		if s == name {
+			return i
+		}
+	}
+
+	return len(stagesInOrder)
+}
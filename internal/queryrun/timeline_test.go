@@ -0,0 +1,132 @@
+package queryrun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeline(t *testing.T) {
+	var nilTimeline *Timeline
+	nilTimeline.Record(StageExec, time.Now())
+	assert.Nil(t, nilTimeline.Stages())
+
+	tl := NewTimeline()
+	startedAt := time.Now().Add(-time.Second)
+	tl.Record(StageQueue, startedAt)
+
+	stages := tl.Stages()
+	require.Len(t, stages, 1)
+	assert.Equal(t, StageQueue, stages[0].Name)
+	assert.GreaterOrEqual(t, stages[0].Duration, time.Second)
+	assert.Equal(t, startedAt.Add(stages[0].Duration), stages[0].FinishedAt())
+
+	// The returned stages are a copy.
+	stages[0].Name = "changed"
+	assert.Equal(t, StageQueue, tl.Stages()[0].Name)
+
+	tl.RecordSource(StageImagePull, time.Now(), "mirror.local:5000")
+	stages = tl.Stages()
+	require.Len(t, stages, 2)
+	assert.Equal(t, StageImagePull, stages[1].Name)
+	assert.Equal(t, "mirror.local:5000", stages[1].Source)
+	assert.Empty(t, stages[0].Source)
+
+	// Both stages are announced by a single notification.
+	select {
+	case <-tl.Changed():
+	default:
+		t.Fatal("stages must be announced")
+	}
+	select {
+	case <-tl.Changed():
+		t.Fatal("notifications must be merged")
+	default:
+	}
+}
+
+func TestSummarizeStages(t *testing.T) {
+	var runs []RunStages
+	for i := 1; i <= 100; i++ {
+		runs = append(runs, RunStages{Stages: []Stage{
+			{Name: StageExec, Duration: time.Duration(i) * time.Millisecond},
+			{Name: StageQueue, Duration: time.Millisecond},
+		}})
+	}
+
+	// Repeated stages are summed up per run.
+	runs = append(runs, RunStages{Stages: []Stage{
+		{Name: StageImagePull, Duration: time.Second},
+		{Name: StageImagePull, Duration: time.Second},
+	}})
+
+	summaries := SummarizeStages(runs)
+	require.Len(t, summaries, 3)
+
+	assert.Equal(t, StageSummary{Name: StageQueue, Count: 100, P50: time.Millisecond, P90: time.Millisecond, P99: time.Millisecond}, summaries[0])
+	assert.Equal(t, StageSummary{Name: StageImagePull, Count: 1, P50: 2 * time.Second, P90: 2 * time.Second, P99: 2 * time.Second}, summaries[1])
+	assert.Equal(t, StageSummary{Name: StageExec, Count: 100, P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond}, summaries[2])
+
+	assert.Empty(t, SummarizeStages(nil))
+}
+
+func TestSummarizeReadiness(t *testing.T) {
+	var runs []RunStages
+	for i := 1; i <= 20; i++ {
+		runs = append(runs, RunStages{Version: "23.3.1.2823", Stages: []Stage{
+			{Name: StageReadiness, Duration: time.Duration(i) * time.Second, Attempts: i},
+			{Name: StageExec, Duration: time.Second},
+		}})
+	}
+	runs = append(runs,
+		RunStages{Version: "21.8.3.44", Stages: []Stage{{Name: StageReadiness, Duration: time.Second, Attempts: 1}}},
+		RunStages{Version: "21.8.4.51", Stages: []Stage{{Name: StageReadiness, Duration: 3 * time.Second, Attempts: 3}}},
+		RunStages{Version: "head", Stages: []Stage{{Name: StageExec, Duration: time.Second}}},
+	)
+
+	summaries := SummarizeReadiness(runs)
+	require.Len(t, summaries, 2)
+
+	assert.Equal(t, ReadinessSummary{Series: "21.8", Runs: 2, P50Wait: time.Second, P95Wait: 3 * time.Second, P50Attempts: 1, P95Attempts: 3}, summaries[0])
+	assert.Equal(t, ReadinessSummary{Series: "23.3", Runs: 20, P50Wait: 10 * time.Second, P95Wait: 19 * time.Second, P50Attempts: 10, P95Attempts: 19}, summaries[1])
+
+	assert.Empty(t, SummarizeReadiness(nil))
+}
+
+func TestSplitDurations(t *testing.T) {
+	setup, query := SplitDurations([]Stage{
+		{Name: StageQueue, Duration: time.Second},
+		{Name: StageImagePull, Duration: 10 * time.Second},
+		{Name: StageContainerCreate, Duration: time.Second},
+		{Name: StageContainerStart, Duration: time.Second},
+		{Name: StageReadiness, Duration: 2 * time.Second},
+		{Name: StageExec, Duration: 300 * time.Millisecond},
+		{Name: StageCleanup, Duration: time.Second},
+	})
+
+	assert.Equal(t, 14*time.Second, setup)
+	assert.Equal(t, 300*time.Millisecond, query)
+}
+
+func TestSummarizeLatency(t *testing.T) {
+	var runs []RunStages
+	for i := 1; i <= 20; i++ {
+		runs = append(runs, RunStages{Version: "22.8.1.1", Stages: []Stage{
+			{Name: StageContainerStart, Duration: time.Duration(i) * time.Second},
+			{Name: StageExec, Duration: time.Duration(i) * time.Millisecond},
+		}})
+	}
+	runs = append(runs,
+		RunStages{Version: "head", Stages: []Stage{{Name: StageExec, Duration: time.Second}}},
+		RunStages{Version: "22.3.1.1"},
+	)
+
+	summaries := SummarizeLatency(runs)
+	require.Len(t, summaries, 2)
+
+	// Floating versions go before numbered series.
+	assert.Equal(t, LatencySummary{Series: "head", Runs: 1, P50Query: time.Second, P95Query: time.Second}, summaries[0])
+	assert.Equal(t, LatencySummary{Series: "22.8", Runs: 20, P50Setup: 10 * time.Second, P95Setup: 19 * time.Second, P50Query: 10 * time.Millisecond, P95Query: 19 * time.Millisecond}, summaries[1])
+}
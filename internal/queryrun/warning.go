@@ -0,0 +1,50 @@
+package queryrun
+
+// Codes of run warnings.
+const (
+	// WarningDeprecatedVersion is added if the version is not supported upstream anymore.
+	WarningDeprecatedVersion = "deprecated_version"
+
+	// WarningVersionResolved is added if a partial version (e.g. "23.3") has been resolved to a tag.
+	WarningVersionResolved = "version_resolved"
+
+	// WarningVersionMismatch is added if the server version does not match the tag of the image.
+	WarningVersionMismatch = "version_mismatch"
+
+	// WarningEmulatedArchitecture is added if the image architecture differs from the host one,
+	// so the run has been executed under emulation and is much slower than a native one.
+	WarningEmulatedArchitecture = "emulated_architecture"
+
+	// WarningEgressDenied is added if the query has tried to reach hosts that are not in the egress allowlist.
+	WarningEgressDenied = "egress_denied"
+
+	// WarningCachedResult is added if the output has been taken from the result cache.
+	WarningCachedResult = "cached_result"
+
+	// WarningRollingVersion is added if the version is a rolling tag (e.g. head), so the result depends on the build.
+	WarningRollingVersion = "rolling_version"
+
+	// WarningOutputProcessed is added if the deployment has changed the output, e.g. redacted credentials.
+	WarningOutputProcessed = "output_processed"
+
+	// WarningFallbackRunner is added if the run has been executed by a fallback runner, since primary ones
+	// have been saturated, dead or have failed the run.
+	WarningFallbackRunner = "fallback_runner"
+)
+
+// Warning is a non-fatal notice for the user. Code is stable and can be matched by clients,
+// Message is human-readable.
+type Warning struct {
+	Code    string            `dynamodbav:"Code"`
+	Message string            `dynamodbav:"Message"`
+	Details map[string]string `dynamodbav:"Details,omitempty"`
+}
+
+// Warn adds a warning to the run.
+func (r *Run) Warn(code, message string, details map[string]string) {
+	r.Warnings = append(r.Warnings, Warning{
+		Code:    code,
+		Message: message,
+		Details: details,
+	})
+}
@@ -0,0 +1,153 @@
+package resultcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Entry is a cached result of a query run.
+type Entry struct {
+	RunID  string
+	Output string
+
+	// ImageDigest is the image the result has been produced on.
+	ImageDigest string
+
+	// Stderr is the part of Output written to the error stream.
+	Stderr   string
+	ExitCode int
+
+	ServerVersion   string
+	VersionMismatch bool
+
+	// The settings profile enforced by the runner that produced the result.
+	ExecutionProfile string
+
+	// When the result was originally produced.
+	ExecutedAt    time.Time
+	ExecutionTime time.Duration
+	SetupTime     time.Duration
+	QueryTime     time.Duration
+}
+
+type item struct {
+	key      string
+	entry    Entry
+	storedAt time.Time
+}
+
+// Cache is an in-memory LRU cache of query run results.
+// Entries expire after Config.TTL, and the total output size is bounded by Config.MaxSizeBytes.
+type Cache struct {
+	cfg Config
+
+	mu    sync.Mutex
+	size  uint64
+	order *list.List
+	items map[string]*list.Element
+}
+
+func New(cfg Config) *Cache {
+	return &Cache{
+		cfg:   cfg,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns a non-expired entry stored by the key.
+func (c *Cache) Get(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.items[key]
+	if !found {
+		return Entry{}, false
+	}
+
+	it := elem.Value.(*item)
+	if time.Since(it.storedAt) > c.cfg.TTL {
+		c.removeElement(elem)
+		return Entry{}, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return it.entry, true
+}
+
+// Put saves the entry. Entries that do not fit into the size budget are not saved.
+func (c *Cache) Put(key string, entry Entry) {
+	size := uint64(len(entry.Output))
+	if size > c.cfg.MaxSizeBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.items[key]; found {
+		c.removeElement(elem)
+	}
+
+	c.items[key] = c.order.PushFront(&item{
+		key:      key,
+		entry:    entry,
+		storedAt: time.Now(),
+	})
+	c.size += size
+
+	// Evict the least recently used entries until the budget is satisfied.
+	for c.size > c.cfg.MaxSizeBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// RemoveRun drops entries produced by the run, e.g. when the run has been deleted.
+func (c *Cache) RemoveRun(runID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*item).entry.RunID == runID {
+			c.removeElement(elem)
+		}
+
+		elem = next
+	}
+}
+
+// RemoveDigest drops entries produced on the image, e.g. when a rolling tag has moved to a new build,
+// so they don't take the space until they expire.
+func (c *Cache) RemoveDigest(digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*item).entry.ImageDigest == digest {
+			c.removeElement(elem)
+		}
+
+		elem = next
+	}
+}
+
+// Len returns the number of stored entries.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// removeElement must be called under the acquired lock.
+func (c *Cache) removeElement(elem *list.Element) {
+	it := elem.Value.(*item)
+
+	c.order.Remove(elem)
+	delete(c.items, it.key)
+	c.size -= uint64(len(it.entry.Output))
+}
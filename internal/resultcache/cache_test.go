@@ -0,0 +1,141 @@
+package resultcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(Config{TTL: time.Minute, MaxSizeBytes: 10})
+
+	c.Put("a", Entry{Output: "aaaa"})
+	c.Put("b", Entry{Output: "bbbb"})
+
+	// Touch "a" so that "b" becomes the least recently used entry.
+	_, found := c.Get("a")
+	assert.True(t, found)
+
+	c.Put("c", Entry{Output: "cccc"})
+
+	_, found = c.Get("b")
+	assert.False(t, found)
+
+	entry, found := c.Get("a")
+	assert.True(t, found)
+	assert.Equal(t, "aaaa", entry.Output)
+
+	_, found = c.Get("c")
+	assert.True(t, found)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestCache_RemoveRun(t *testing.T) {
+	c := New(Config{TTL: time.Minute, MaxSizeBytes: 100})
+
+	c.Put("a", Entry{RunID: "1", Output: "aaaa"})
+	c.Put("b", Entry{RunID: "2", Output: "bbbb"})
+	c.Put("c", Entry{RunID: "1", Output: "cccc"})
+
+	c.RemoveRun("1")
+
+	_, found := c.Get("a")
+	assert.False(t, found)
+	_, found = c.Get("c")
+	assert.False(t, found)
+	_, found = c.Get("b")
+	assert.True(t, found)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCache_RemoveDigest(t *testing.T) {
+	c := New(Config{TTL: time.Minute, MaxSizeBytes: 100})
+
+	c.Put("a", Entry{RunID: "1", Output: "aaaa", ImageDigest: "sha256:1"})
+	c.Put("b", Entry{RunID: "2", Output: "bbbb", ImageDigest: "sha256:2"})
+
+	c.RemoveDigest("sha256:1")
+
+	_, found := c.Get("a")
+	assert.False(t, found)
+	_, found = c.Get("b")
+	assert.True(t, found)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCache_TooLargeEntryIsSkipped(t *testing.T) {
+	c := New(Config{TTL: time.Minute, MaxSizeBytes: 3})
+
+	c.Put("a", Entry{Output: "aaaa"})
+
+	_, found := c.Get("a")
+	assert.False(t, found)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_Expiration(t *testing.T) {
+	c := New(Config{TTL: time.Millisecond, MaxSizeBytes: 100})
+
+	c.Put("a", Entry{Output: "a"})
+	time.Sleep(5 * time.Millisecond)
+
+	_, found := c.Get("a")
+	assert.False(t, found)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestIsDeterministic(t *testing.T) {
+	cases := []struct {
+		query string
+		want  bool
+	}{
+		{query: "SELECT 1", want: true},
+		{query: "SELECT * FROM numbers(10)", want: true},
+		{query: "SELECT now()", want: false},
+		{query: "SELECT NOW ()", want: false},
+		{query: "SELECT rand() % 10", want: false},
+		{query: "SELECT generateUUIDv4()", want: false},
+		{query: "SELECT 'now' AS word", want: true},
+		{query: "SELECT operand()", want: true},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, IsDeterministic(tc.query), tc.query)
+	}
+}
+
+func TestKey_IgnoresWhitespace(t *testing.T) {
+	a := Key("SELECT  1\n", "clickhouse", "sha256:1", "TabSeparated")
+	b := Key(" SELECT 1", "clickhouse", "sha256:1", "TabSeparated")
+	c := Key("SELECT 1", "clickhouse", "sha256:2", "TabSeparated")
+
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{query: "  SELECT\n\t1 ,  2\n", want: "SELECT 1 , 2"},
+		{query: "SELECT  'a  b',  \"c  d\",  `e  f`", want: "SELECT 'a  b', \"c  d\", `e  f`"},
+		{query: "SELECT  'it''s  \\'  x'  AS  s", want: "SELECT 'it''s  \\'  x' AS s"},
+		{query: "SELECT  1  -- it's  a  comment\nFROM  t", want: "SELECT 1 -- it's  a  comment\nFROM t"},
+		{query: "SELECT 1 -- comment\n  FROM t  -- end", want: "SELECT 1 -- comment\nFROM t -- end"},
+		{query: "SELECT  /* it's */  'a  b'", want: "SELECT /* it's */ 'a  b'"},
+		{query: "SELECT  'unterminated  ", want: "SELECT 'unterminated  "},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, NormalizeQuery(tc.query), tc.query)
+	}
+}
+
+func TestKey_KeepsWhitespaceInLiterals(t *testing.T) {
+	a := Key("SELECT 'a  b'", "clickhouse", "sha256:1", "TabSeparated")
+	b := Key("SELECT 'a b'", "clickhouse", "sha256:1", "TabSeparated")
+
+	assert.NotEqual(t, a, b)
+}
@@ -0,0 +1,15 @@
+package resultcache
+
+import "time"
+
+const DefaultTTL = 10 * time.Minute
+const DefaultMaxSizeBytes = 64 * 1024 * 1024
+
+type Config struct {
+	// How long a cached result can be served.
+	TTL time.Duration
+
+	// Total size of cached outputs. When the budget is exceeded,
+	// the least recently used entries are evicted.
+	MaxSizeBytes uint64
+}
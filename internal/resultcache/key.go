@@ -0,0 +1,129 @@
+package resultcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// nonDeterministicFunctions is a list of functions whose result differs from run to run.
+// Queries that call any of them are never cached.
+var nonDeterministicFunctions = []string{
+	"now",
+	"now64",
+	"nowInBlock",
+	"today",
+	"yesterday",
+	"rand",
+	"rand32",
+	"rand64",
+	"randConstant",
+	"randCanonical",
+	"canonicalRand",
+	"generateUUIDv4",
+	"generateRandom",
+	"randomString",
+	"randomFixedString",
+	"randomPrintableASCII",
+	"randomStringUTF8",
+	"fuzzBits",
+	"uptime",
+	"rowNumberInAllBlocks",
+	"currentQueryID",
+	"queryID",
+	"initialQueryID",
+}
+
+var nonDeterministicRegexp = regexp.MustCompile(
+	`(?i)\b(` + strings.Join(nonDeterministicFunctions, "|") + `)\s*\(`,
+)
+
+// IsDeterministic reports whether the query result may be reused for identical queries.
+// It's a heuristic: a query is treated as non-deterministic if it calls a known non-deterministic function.
+func IsDeterministic(query string) bool {
+	return !nonDeterministicRegexp.MatchString(query)
+}
+
+// NormalizeQuery trims the query and collapses whitespace sequences so that formatting differences
+// do not produce different keys. String literals, quoted identifiers and comments are kept as is,
+// whitespaces within them are a part of the query.
+func NormalizeQuery(query string) string {
+	var b strings.Builder
+	space := false
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		var n int
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			space = true
+			i++
+			continue
+
+		case strings.HasPrefix(query[i:], "--") || c == '#':
+			// The line break is kept, the comment would swallow the rest of the query otherwise.
+			n = strings.IndexByte(query[i:], '\n') + 1
+			if n == 0 {
+				n = len(query) - i
+			}
+
+		case strings.HasPrefix(query[i:], "/*"):
+			n = strings.Index(query[i+2:], "*/")
+			if n == -1 {
+				n = len(query) - i
+			} else {
+				n += 4
+			}
+
+		case c == '\'' || c == '"' || c == '`':
+			n = quotedLength(query[i:])
+
+		default:
+			n = 1
+		}
+
+		if space && b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		b.WriteString(query[i : i+n])
+		i += n
+	}
+
+	return b.String()
+}
+
+// quotedLength returns the length of the literal that starts with a quote character, including the quotes.
+// Backslash escapes and doubled quotes are supported. An unterminated literal lasts until the end of the query.
+func quotedLength(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+
+		case s[i] == quote && i+1 < len(s) && s[i+1] == quote:
+			i++
+
+		case s[i] == quote:
+			return i + 1
+		}
+	}
+
+	return len(s)
+}
+
+// Key builds a cache key from the normalized query, the exact image digest, the database and run settings.
+// The settings must be passed in a stable serialized form.
+func Key(query, database, imageDigest, settings string) string {
+	h := sha256.New()
+	for _, part := range []string{NormalizeQuery(query), database, imageDigest, settings} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -47,3 +47,73 @@ func IsAtLeastMajor(version, major string) bool {
 
 	return !IsGreater(Parse(major), Parse(version))
 }
+
+// InRange checks whether the version belongs to the [min, max] range. Both bounds are optional.
+// The max bound is compared by prefix, so InRange("21.8.3", "", "21.8") = true.
+// Floating versions (head, latest) are considered to be greater than any other version.
+func InRange(version, min, max string) bool {
+	if min != "" && !IsAtLeastMajor(version, min) {
+		return false
+	}
+
+	if max == "" {
+		return true
+	}
+
+	if strings.HasPrefix(version, "head") || strings.HasPrefix(version, "latest") {
+		return false
+	}
+
+	parsed := Parse(version)
+	upper := Parse(max)
+	if len(parsed) > len(upper) {
+		parsed = parsed[:len(upper)]
+	}
+
+	return !IsGreater(parsed, upper)
+}
+
+// IsNumeric checks whether all parts of the version are numbers.
+// For example, "21.8.3" is numeric, but "21.8-alpine" and "head" are not.
+func IsNumeric(v Semver) bool {
+	for _, part := range v {
+		_, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return false
+		}
+	}
+
+	return len(v) > 0
+}
+
+// CommonPrefixLen returns the number of leading parts the two versions have in common.
+func CommonPrefixLen(a, b Semver) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// HasPrefix checks whether the version belongs to the series described by prefix.
+//
+// Example:
+// HasPrefix(Parse("21.8.3"), Parse("21.8")) = true
+func HasPrefix(v, prefix Semver) bool {
+	return len(prefix) <= len(v) && CommonPrefixLen(v, prefix) == len(prefix)
+}
+
+// Series returns the major.minor series of the version, e.g. "21.8" for "21.8.3.44-alpine".
+// Floating versions are returned by their name ("head", "latest").
+func Series(version string) string {
+	parsed := Parse(version)
+	if len(parsed) == 0 {
+		return version
+	}
+	if len(parsed) == 1 || !IsNumeric(parsed[:2]) {
+		return parsed[0]
+	}
+
+	return parsed[0] + "." + parsed[1]
+}
@@ -89,3 +89,54 @@ func TestIsAtLeastMajor(t *testing.T) {
 		})
 	}
 }
+
+func TestInRange(t *testing.T) {
+	cases := []struct {
+		Version  string
+		Min      string
+		Max      string
+		Expected bool
+	}{
+		{Version: "21.7.11", Max: "21.7", Expected: true},
+		{Version: "21.8.1", Max: "21.7", Expected: false},
+		{Version: "21.7", Max: "21.7", Expected: true},
+		{Version: "21", Max: "21.7", Expected: true},
+		{Version: "21.10", Max: "21.7", Expected: false},
+		{Version: "21.8", Min: "21.8", Expected: true},
+		{Version: "21.7.99", Min: "21.8", Expected: false},
+		{Version: "22.1", Min: "21.8", Max: "22.3", Expected: true},
+		{Version: "22.4", Min: "21.8", Max: "22.3", Expected: false},
+		{Version: "head", Min: "21.8", Expected: true},
+		{Version: "latest", Max: "22.3", Expected: false},
+		{Version: "1.1.54", Expected: true},
+	}
+
+	for _, test := range cases {
+		t.Run(fmt.Sprintf("%s in [%s, %s]?", test.Version, test.Min, test.Max), func(t *testing.T) {
+			assert.Equal(t, test.Expected, InRange(test.Version, test.Min, test.Max))
+		})
+	}
+}
+
+func TestHasPrefix(t *testing.T) {
+	assert.True(t, HasPrefix(Parse("21.8.3"), Parse("21.8")))
+	assert.True(t, HasPrefix(Parse("21.8"), Parse("21.8")))
+	assert.False(t, HasPrefix(Parse("21.80.1"), Parse("21.8")))
+	assert.False(t, HasPrefix(Parse("21"), Parse("21.8")))
+}
+
+func TestIsNumeric(t *testing.T) {
+	assert.True(t, IsNumeric(Parse("21.8.3.44")))
+	assert.False(t, IsNumeric(Parse("21.8-alpine")))
+	assert.False(t, IsNumeric(Parse("head")))
+	assert.False(t, IsNumeric(Parse("")))
+}
+
+func TestSeries(t *testing.T) {
+	assert.Equal(t, "21.8", Series("21.8.3.44"))
+	assert.Equal(t, "21.8", Series("21.8-alpine"))
+	assert.Equal(t, "22", Series("22"))
+	assert.Equal(t, "head", Series("head"))
+	assert.Equal(t, "latest", Series("latest-alpine"))
+	assert.Equal(t, "", Series(""))
+}
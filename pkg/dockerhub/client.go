@@ -1,10 +1,14 @@
 package dockerhub
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	zlog "github.com/rs/zerolog/log"
@@ -12,37 +16,145 @@ import (
 )
 
 const DockerHubURL = "https://hub.docker.com/v2"
+const RegistryURL = "https://registry-1.docker.io/v2"
+const AuthURL = "https://auth.docker.io/token"
 const DefaultMaxRPS = 5
+const DefaultRequestTimeout = 30 * time.Second
+const DefaultPageSize = 100
+const DefaultMaxPages = 100
+const DefaultFetchTimeout = 5 * time.Minute
+const DefaultMissTTL = time.Minute
+
+// ErrTagNotFound is returned if the repository has no such tag.
+var ErrTagNotFound = errors.New("tag not found")
+
+// ErrTooManyPages is returned if the tags have not been listed within MaxPages pages.
+var ErrTooManyPages = errors.New("too many pages of tags")
+
+type Config struct {
+	APIURL string
+	MaxRPS int
+
+	// RegistryURL and AuthURL are used to check the pull rate limit and tag availability.
+	// If they are empty, Docker Hub endpoints are used.
+	RegistryURL string
+	AuthURL     string
+
+	// Tags found missing by TagExists are not checked again for MissTTL. If it's 0, misses are not cached.
+	MissTTL time.Duration
+
+	// Every HTTP request is bounded by RequestTimeout. If it's 0, only the caller's context is used.
+	RequestTimeout time.Duration
+
+	// Tags are listed by pages of PageSize tags. Listing fails if it takes more than MaxPages pages
+	// or FetchTimeout in total, so a partial list is never returned. Zero values disable the limits,
+	// and the page size of the API is used if PageSize is 0.
+	PageSize     int
+	MaxPages     int
+	FetchTimeout time.Duration
+
+	// Retry configures retries of requests throttled by Docker Hub. If MaxAttempts is 0, requests are not retried.
+	Retry RetryConfig
+
+	// HTTPClient is used to send requests (it can be configured to use a proxy).
+	// If it's nil, http.DefaultClient is used. Its transport is wrapped to export request metrics.
+	HTTPClient *http.Client
+}
+
+var DefaultConfig = Config{
+	APIURL:         DockerHubURL,
+	MaxRPS:         DefaultMaxRPS,
+	RegistryURL:    RegistryURL,
+	AuthURL:        AuthURL,
+	RequestTimeout: DefaultRequestTimeout,
+	PageSize:       DefaultPageSize,
+	MaxPages:       DefaultMaxPages,
+	FetchTimeout:   DefaultFetchTimeout,
+	Retry:          DefaultRetryConfig,
+	MissTTL:        DefaultMissTTL,
+}
 
 type Client struct {
-	apiURL string
-	rl     ratelimit.Limiter
+	apiURL      string
+	registryURL string
+	authURL     string
+	timeout     time.Duration
+	rl          ratelimit.Limiter
+
+	pageSize     int
+	maxPages     int
+	fetchTimeout time.Duration
+
+	retry    RetryConfig
+	throttle throttle
+
+	missTTL  time.Duration
+	missesMu sync.Mutex
+	misses   map[string]time.Time // Expiration times of missing tags by repository:tag.
+	now      func() time.Time
 
 	cli *http.Client
 }
 
-func NewClient(apiURL string, maxRPS int, httpCli ...*http.Client) *Client {
+func NewClient(cfg Config) *Client {
 	c := &Client{
-		apiURL: apiURL,
-		rl:     ratelimit.New(maxRPS),
-		cli:    http.DefaultClient,
+		apiURL:      cfg.APIURL,
+		registryURL: cfg.RegistryURL,
+		authURL:     cfg.AuthURL,
+		timeout:     cfg.RequestTimeout,
+		rl:          ratelimit.New(cfg.MaxRPS),
+		cli:         http.DefaultClient,
+
+		pageSize:     cfg.PageSize,
+		maxPages:     cfg.MaxPages,
+		fetchTimeout: cfg.FetchTimeout,
+
+		retry: cfg.Retry,
+
+		missTTL: cfg.MissTTL,
+		misses:  make(map[string]time.Time),
+		now:     time.Now,
+	}
+	if c.retry.MaxAttempts <= 0 {
+		c.retry.MaxAttempts = 1
 	}
-	if len(httpCli) == 1 {
-		c.cli = httpCli[0]
+	if c.registryURL == "" {
+		c.registryURL = RegistryURL
 	}
+	if c.authURL == "" {
+		c.authURL = AuthURL
+	}
+	if cfg.HTTPClient != nil {
+		c.cli = cfg.HTTPClient
+	}
+	c.cli = instrument(c.cli, c.authURL)
 
 	return c
 }
 
-// GetTags fetches tags of the given image.
-func (c *Client) GetTags(repository string) ([]ImageTag, error) {
+// GetTags fetches tags of the given image following the next links of the pages.
+// The context is honored during the whole pagination process. Either all tags are returned or an error.
+func (c *Client) GetTags(ctx context.Context, repository string) ([]ImageTag, error) {
+	if c.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.fetchTimeout)
+		defer cancel()
+	}
+
 	nextURL := fmt.Sprintf("%s/repositories/%s/tags/", c.apiURL, repository)
+	if c.pageSize > 0 {
+		nextURL += fmt.Sprintf("?page_size=%d", c.pageSize)
+	}
 
 	var tags []ImageTag
-	for {
-		resp, err := c.getTags(nextURL)
+	for page := 1; ; page++ {
+		if c.maxPages > 0 && page > c.maxPages {
+			return nil, errors.Wrapf(ErrTooManyPages, "%d pages have been fetched, %d tags", c.maxPages, len(tags))
+		}
+
+		resp, err := c.getTags(ctx, nextURL)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "failed to fetch page %d", page)
 		}
 
 		tags = append(tags, resp.Results...)
@@ -56,27 +168,134 @@ func (c *Client) GetTags(repository string) ([]ImageTag, error) {
 	return tags, nil
 }
 
-func (c *Client) getTags(url string) (*GetImageTagsResponse, error) {
-	c.rl.Take()
+func (c *Client) getTags(ctx context.Context, url string) (*GetImageTagsResponse, error) {
+	response := new(GetImageTagsResponse)
+	err := c.send(ctx, http.MethodGet, url, func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "body read failed")
+		}
+
+		// Error responses are JSON objects as well, they must not be taken for the last page.
+		if resp.StatusCode != http.StatusOK {
+			zlog.Error().Int("status", resp.StatusCode).Str("url", url).Str("body", string(body)).Msg("failed to fetch image tags")
+
+			return errors.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		err = json.Unmarshal(body, response)
+		if err != nil {
+			zlog.Error().Err(err).Str("url", url).Str("body", string(body)).Msg("failed to fetch image tags")
+
+			return errors.Wrap(err, "unmarshal failed")
+		}
 
-	resp, err := c.cli.Get(url)
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "request failed")
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	return response, nil
+}
+
+// TagExists checks whether the tag is still available in the repository.
+// Only the manifest headers are requested from the registry, so it's not counted as a pull.
+// Missing tags are cached for MissTTL.
+func (c *Client) TagExists(ctx context.Context, repository, tag string) (bool, error) {
+	key := repository + ":" + tag
+	if c.cachedMiss(key) {
+		return false, nil
+	}
+
+	exists, err := c.headManifest(ctx, repository, tag)
 	if err != nil {
-		return nil, errors.Wrap(err, "body read failed")
+		return false, err
+	}
+	if !exists && c.missTTL > 0 {
+		c.missesMu.Lock()
+		c.misses[key] = c.now().Add(c.missTTL)
+		c.missesMu.Unlock()
 	}
 
-	response := new(GetImageTagsResponse)
-	err = json.Unmarshal(body, response)
+	return exists, nil
+}
+
+// cachedMiss reports whether the tag has been found missing recently. Expired misses are dropped.
+func (c *Client) cachedMiss(key string) bool {
+	c.missesMu.Lock()
+	defer c.missesMu.Unlock()
+
+	expiresAt, found := c.misses[key]
+	if !found {
+		return false
+	}
+	if !c.now().Before(expiresAt) {
+		delete(c.misses, key)
+		return false
+	}
+
+	return true
+}
+
+func (c *Client) headManifest(ctx context.Context, repository, tag string) (bool, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	token, err := c.pullToken(ctx, repository)
 	if err != nil {
-		zlog.Error().Err(err).Str("url", url).Str("body", string(body)).Msg("failed to fetch image tags")
+		return false, errors.Wrap(err, "failed to get token")
+	}
+
+	c.rl.Take()
 
-		return nil, errors.Wrap(err, "unmarshal failed")
+	manifestURL := fmt.Sprintf("%s/%s/manifests/%s", c.registryURL, repository, tag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, http.NoBody)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create request")
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", strings.Join(append(manifestListMediaTypes, manifestMediaTypes...), ", "))
 
-	return response, nil
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// GetTag fetches a single tag of the repository. It's much cheaper than listing all tags,
+// so tags that are re-pushed often can be refreshed frequently.
+func (c *Client) GetTag(ctx context.Context, repository, tag string) (*ImageTag, error) {
+	imageTag := new(ImageTag)
+
+	url := fmt.Sprintf("%s/repositories/%s/tags/%s", c.apiURL, repository, tag)
+	err := c.send(ctx, http.MethodGet, url, func(resp *http.Response) error {
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return ErrTagNotFound
+		default:
+			return errors.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		return errors.Wrap(json.NewDecoder(resp.Body).Decode(imageTag), "unmarshal failed")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return imageTag, nil
 }
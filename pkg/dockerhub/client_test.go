@@ -0,0 +1,389 @@
+package dockerhub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_GetTags_Pagination(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := GetImageTagsResponse{}
+
+		switch r.URL.Query().Get("page") {
+		case "":
+			next := fmt.Sprintf("%s%s?page=2", srv.URL, r.URL.Path)
+			resp.Next = &next
+			resp.Results = []ImageTag{{Name: "head"}, {Name: "latest"}}
+
+		case "2":
+			resp.Results = []ImageTag{{Name: "21.8"}}
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, HTTPClient: srv.Client()})
+
+	tags, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	require.NoError(t, err)
+	require.Len(t, tags, 3)
+	assert.Equal(t, "head", tags[0].Name)
+	assert.Equal(t, "21.8", tags[2].Name)
+}
+
+// newPaginatedServer serves pages of one tag each, the page failing is answered with 500.
+func newPaginatedServer(t *testing.T, pages, failing int) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "100", r.URL.Query().Get("page_size"))
+
+		page := 1
+		if p := r.URL.Query().Get("page"); p != "" {
+			page, _ = strconv.Atoi(p)
+		}
+		if page == failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message": "internal error"}`))
+
+			return
+		}
+
+		resp := GetImageTagsResponse{Results: []ImageTag{{Name: fmt.Sprintf("20.%d", page)}}}
+		if page < pages {
+			next := fmt.Sprintf("%s%s?page_size=100&page=%d", srv.URL, r.URL.Path, page+1)
+			resp.Next = &next
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClient_GetTags_AllPages(t *testing.T) {
+	srv := newPaginatedServer(t, 5, 0)
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, PageSize: 100, MaxPages: 5, HTTPClient: srv.Client()})
+
+	tags, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	require.NoError(t, err)
+	require.Len(t, tags, 5)
+	assert.Equal(t, "20.5", tags[4].Name)
+}
+
+func TestClient_GetTags_FailedPage(t *testing.T) {
+	srv := newPaginatedServer(t, 5, 3)
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, PageSize: 100, HTTPClient: srv.Client()})
+
+	tags, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	assert.ErrorContains(t, err, "page 3")
+	assert.Nil(t, tags, "a partial list must not be returned")
+}
+
+func TestClient_GetTags_MaxPages(t *testing.T) {
+	srv := newPaginatedServer(t, 5, 0)
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, PageSize: 100, MaxPages: 4, HTTPClient: srv.Client()})
+
+	tags, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	assert.ErrorIs(t, err, ErrTooManyPages)
+	assert.Nil(t, tags)
+}
+
+func TestClient_GetTags_Cancellation(t *testing.T) {
+	released := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-released:
+		}
+	}))
+	defer srv.Close()
+	defer close(released)
+
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, HTTPClient: srv.Client()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	startedAt := time.Now()
+	_, err := cli.GetTags(ctx, "clickhouse/clickhouse-server")
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(startedAt), 5*time.Second)
+}
+
+func TestClient_GetTags_Timeout(t *testing.T) {
+	released := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-released:
+		}
+	}))
+	defer srv.Close()
+	defer close(released)
+
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, RequestTimeout: 50 * time.Millisecond, HTTPClient: srv.Client()})
+
+	_, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClient_TagExists(t *testing.T) {
+	var manifestRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+			return
+		}
+
+		atomic.AddInt32(&manifestRequests, 1)
+		assert.Equal(t, http.MethodHead, r.Method)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json")
+
+		switch r.URL.Path {
+		case "/v2/clickhouse/clickhouse-server/manifests/21.8":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/clickhouse/clickhouse-server/manifests/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Date(2023, 4, 1, 3, 0, 0, 0, time.UTC)
+	cli := NewClient(Config{
+		APIURL:      srv.URL + "/hub",
+		MaxRPS:      100,
+		RegistryURL: srv.URL + "/v2",
+		AuthURL:     srv.URL + "/token",
+		MissTTL:     time.Minute,
+		HTTPClient:  srv.Client(),
+	})
+	cli.now = func() time.Time { return now }
+
+	exists, err := cli.TagExists(context.Background(), "clickhouse/clickhouse-server", "21.8")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = cli.TagExists(context.Background(), "clickhouse/clickhouse-server", "broken")
+	assert.Error(t, err)
+
+	for i := 0; i < 2; i++ {
+		exists, err = cli.TagExists(context.Background(), "clickhouse/clickhouse-server", "21.9")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&manifestRequests), "the miss must be cached")
+
+	now = now.Add(time.Minute)
+	exists, err = cli.TagExists(context.Background(), "clickhouse/clickhouse-server", "21.9")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&manifestRequests), "the expired miss must be checked again")
+}
+
+func TestClient_GetTag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repositories/clickhouse/clickhouse-server/tags/head" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(ImageTag{Name: "head", Images: []Image{{OS: "linux", Architecture: "amd64", Digest: "sha256:ab"}}})
+	}))
+	defer srv.Close()
+
+	cli := NewClient(Config{APIURL: srv.URL, MaxRPS: 100, HTTPClient: srv.Client()})
+
+	tag, err := cli.GetTag(context.Background(), "clickhouse/clickhouse-server", "head")
+	require.NoError(t, err)
+	assert.Equal(t, "head", tag.Name)
+	require.Len(t, tag.Images, 1)
+	assert.Equal(t, "sha256:ab", tag.Images[0].Digest)
+
+	_, err = cli.GetTag(context.Background(), "clickhouse/clickhouse-server", "missing")
+	assert.ErrorIs(t, err, ErrTagNotFound)
+}
+
+func TestClient_ImageConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			assert.Equal(t, "repository:clickhouse/clickhouse-server:pull", r.URL.Query().Get("scope"))
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+
+		case "/v2/clickhouse/clickhouse-server/manifests/sha256:ab":
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			assert.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.manifest.v1+json")
+			_, _ = w.Write([]byte(`{"config": {"digest": "sha256:cd"}}`))
+
+		case "/v2/clickhouse/clickhouse-server/blobs/sha256:cd":
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(`{"created": "2023-04-01T03:00:00Z", "config": {"Labels": {"build-url": "https://example.com/1"}}}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cli := NewClient(Config{
+		MaxRPS:      100,
+		RegistryURL: srv.URL + "/v2",
+		AuthURL:     srv.URL + "/token",
+		HTTPClient:  srv.Client(),
+	})
+
+	cfg, err := cli.ImageConfig(context.Background(), "clickhouse/clickhouse-server", "sha256:ab")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 4, 1, 3, 0, 0, 0, time.UTC), cfg.Created)
+	assert.Equal(t, map[string]string{"build-url": "https://example.com/1"}, cfg.Labels)
+
+	_, err = cli.ImageConfig(context.Background(), "clickhouse/clickhouse-server", "sha256:ef")
+	assert.Error(t, err)
+}
+
+func TestClient_PullRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			assert.Equal(t, "repository:ratelimitpreview/test:pull", r.URL.Query().Get("scope"))
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+
+		case "/v2/ratelimitpreview/test/manifests/latest":
+			assert.Equal(t, http.MethodHead, r.Method)
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+			w.Header().Set("RateLimit-Limit", "100;w=21600")
+			w.Header().Set("RateLimit-Remaining", "0;w=21600")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cli := NewClient(Config{
+		MaxRPS:      100,
+		RegistryURL: srv.URL + "/v2",
+		AuthURL:     srv.URL + "/token",
+		HTTPClient:  srv.Client(),
+	})
+
+	rl, err := cli.PullRateLimit(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, rl)
+	assert.Equal(t, RateLimit{Limit: 100, Remaining: 0, Window: 6 * time.Hour}, *rl)
+
+	now := time.Now()
+	resetAt, ok := rl.ResetAt(now)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(6*time.Hour), resetAt)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	header := http.Header{}
+	rl, err := parseRateLimit(header)
+	require.NoError(t, err)
+	assert.Nil(t, rl, "unlimited accounts don't get the headers")
+
+	header.Set("RateLimit-Limit", "200;w=21600")
+	header.Set("RateLimit-Remaining", "0;w=21600")
+	header.Set("Retry-After", "120")
+	rl, err = parseRateLimit(header)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, rl.Reset)
+
+	now := time.Now()
+	resetAt, ok := rl.ResetAt(now)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(2*time.Minute), resetAt)
+
+	header.Set("RateLimit-Remaining", "many")
+	_, err = parseRateLimit(header)
+	assert.Error(t, err)
+}
+
+func TestClient_GetTags_Throttled(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(GetImageTagsResponse{Results: []ImageTag{{Name: "23.3"}}})
+	}))
+	defer srv.Close()
+
+	cli := NewClient(Config{
+		APIURL:     srv.URL,
+		MaxRPS:     100,
+		Retry:      RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+		HTTPClient: srv.Client(),
+	})
+
+	tags, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	require.NoError(t, err)
+	assert.Len(t, tags, 1)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestClient_GetTags_RetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	cli := NewClient(Config{
+		APIURL:     srv.URL,
+		MaxRPS:     100,
+		Retry:      RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Second},
+		HTTPClient: srv.Client(),
+	})
+
+	// The registry asks to wait longer than the client is willing to, so the request is not retried.
+	_, err := cli.GetTags(context.Background(), "clickhouse/clickhouse-server")
+	var throttled *ThrottledError
+	require.ErrorAs(t, err, &throttled)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), throttled.Until, 5*time.Second)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Requests are rejected without being sent until the registry allows them.
+	_, err = cli.GetTag(context.Background(), "clickhouse/clickhouse-server", "23.3")
+	assert.ErrorIs(t, err, ErrThrottled)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Minute, parseRetryAfter("Mon, 01 May 2023 10:01:00 GMT", now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("-1", now))
+	assert.Zero(t, parseRetryAfter("Mon, 01 May 2023 09:00:00 GMT", now), "dates in the past are ignored")
+}
@@ -0,0 +1,106 @@
+package dockerhub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// manifestListMediaTypes are the multi-platform manifests the registry may return for a tag.
+var manifestListMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// manifestMediaTypes are the single-platform manifests the registry may return for a platform digest.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ImageConfig is the part of the image configuration describing the build.
+type ImageConfig struct {
+	Created time.Time
+	Labels  map[string]string
+}
+
+// ImageConfig fetches the configuration of the image with the given platform digest from the registry.
+// Two requests are sent: the manifest to find the configuration blob, and the blob itself. Neither is counted as a pull.
+func (c *Client) ImageConfig(ctx context.Context, repository, digest string) (*ImageConfig, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	token, err := c.pullToken(ctx, repository)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get token")
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	manifestURL := fmt.Sprintf("%s/%s/manifests/%s", c.registryURL, repository, digest)
+	err = c.getRegistryJSON(ctx, manifestURL, token, strings.Join(manifestMediaTypes, ", "), &manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get manifest")
+	}
+	if manifest.Config.Digest == "" {
+		return nil, errors.New("manifest has no config")
+	}
+
+	var config struct {
+		Created time.Time `json:"created"`
+		Config  struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	blobURL := fmt.Sprintf("%s/%s/blobs/%s", c.registryURL, repository, manifest.Config.Digest)
+	err = c.getRegistryJSON(ctx, blobURL, token, "", &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get config")
+	}
+
+	return &ImageConfig{
+		Created: config.Created,
+		Labels:  config.Config.Labels,
+	}, nil
+}
+
+func (c *Client) getRegistryJSON(ctx context.Context, url, token, accept string, v interface{}) error {
+	c.rl.Take()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal failed")
+	}
+
+	return nil
+}
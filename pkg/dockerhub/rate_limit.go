@@ -0,0 +1,177 @@
+package dockerhub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rateLimitRepository is the repository Docker suggests for checking the limit.
+// HEAD requests of its manifest are not counted as pulls.
+const rateLimitRepository = "ratelimitpreview/test"
+
+// RateLimit is the pull rate limit of the client reported by the registry headers,
+// e.g. "RateLimit-Limit: 100;w=21600" and "RateLimit-Remaining: 0;w=21600".
+type RateLimit struct {
+	Limit     int
+	Remaining int
+
+	// Window is the period the limit is counted over.
+	Window time.Duration
+
+	// Reset is the time left until the limit is reset. It's 0 if the registry doesn't report it.
+	Reset time.Duration
+}
+
+// ResetAt estimates when pulls are allowed again. Docker Hub applies a sliding window, so if the reset time
+// isn't reported, the end of the window is returned as the upper bound. It returns false if it cannot be estimated.
+func (l RateLimit) ResetAt(now time.Time) (time.Time, bool) {
+	switch {
+	case l.Reset > 0:
+		return now.Add(l.Reset), true
+
+	case l.Remaining > 0:
+		return now, true
+
+	case l.Window > 0:
+		return now.Add(l.Window), true
+
+	default:
+		return time.Time{}, false
+	}
+}
+
+// PullRateLimit checks the pull rate limit of the client address. It returns nil if the registry doesn't limit pulls.
+func (c *Client) PullRateLimit(ctx context.Context) (*RateLimit, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	token, err := c.pullToken(ctx, rateLimitRepository)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get token")
+	}
+
+	c.rl.Take()
+
+	manifestURL := fmt.Sprintf("%s/%s/manifests/latest", c.registryURL, rateLimitRepository)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, http.NoBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return parseRateLimit(resp.Header)
+}
+
+func (c *Client) pullToken(ctx context.Context, repository string) (string, error) {
+	c.rl.Take()
+
+	query := url.Values{}
+	query.Set("service", "registry.docker.io")
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", repository))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.authURL+"?"+query.Encode(), http.NoBody)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrap(err, "unmarshal failed")
+	}
+
+	return body.Token, nil
+}
+
+// parseRateLimit reads the rate limit headers. It returns nil if there are none.
+func parseRateLimit(header http.Header) (*RateLimit, error) {
+	limitHeader := header.Get("RateLimit-Limit")
+	if limitHeader == "" {
+		return nil, nil
+	}
+
+	limit, window, err := parseRateLimitValue(limitHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid RateLimit-Limit")
+	}
+
+	remaining, _, err := parseRateLimitValue(header.Get("RateLimit-Remaining"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid RateLimit-Remaining")
+	}
+
+	rl := &RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window,
+	}
+
+	for _, name := range []string{"RateLimit-Reset", "Retry-After"} {
+		seconds, err := strconv.Atoi(header.Get(name))
+		if err == nil && seconds > 0 {
+			rl.Reset = time.Duration(seconds) * time.Second
+			break
+		}
+	}
+
+	return rl, nil
+}
+
+// parseRateLimitValue parses values like "100;w=21600", where w is the window in seconds.
+func parseRateLimitValue(value string) (int, time.Duration, error) {
+	parts := strings.Split(value, ";")
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "invalid count")
+	}
+
+	var window time.Duration
+	for _, param := range parts[1:] {
+		name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if name != "w" {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "invalid window")
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+
+	return count, window, nil
+}
@@ -0,0 +1,183 @@
+package dockerhub
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultMaxAttempts    = 4
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+// ErrThrottled is wrapped by ThrottledError.
+var ErrThrottled = errors.New("docker hub is throttling requests")
+
+// ThrottledError is returned if Docker Hub has kept responding with 429 Too Many Requests. Requests are not sent
+// until Until, so the registry is not hammered while it's throttling the client.
+type ThrottledError struct {
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s until %s", ErrThrottled, e.Until.Format(time.RFC3339))
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrThrottled
+}
+
+// RetryConfig configures retries of throttled Docker Hub API requests.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a request, including the first one. If it's 1, requests are not retried.
+	MaxAttempts int
+
+	// Backoffs grow exponentially from InitialBackoff up to MaxBackoff, and they are jittered.
+	// Retry-After of the response is honored instead if it's set. If it exceeds MaxBackoff,
+	// the request is not retried, and requests are rejected until then.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts:    DefaultMaxAttempts,
+	InitialBackoff: DefaultInitialBackoff,
+	MaxBackoff:     DefaultMaxBackoff,
+}
+
+// throttle rejects requests while Docker Hub is throttling the client.
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+func (t *throttle) check(now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Before(t.until) {
+		return &ThrottledError{Until: t.until}
+	}
+
+	return nil
+}
+
+func (t *throttle) open(until time.Time) *ThrottledError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if until.After(t.until) {
+		t.until = until
+	}
+
+	return &ThrottledError{Until: t.until}
+}
+
+// backoff returns the jittered delay before the attempt following the given one: a random value
+// between the half and the full exponential delay.
+func (cfg RetryConfig) backoff(attempt int) time.Duration {
+	delay := cfg.InitialBackoff << (attempt - 1)
+	if delay > cfg.MaxBackoff || delay <= 0 {
+		delay = cfg.MaxBackoff
+	}
+
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// parseRetryAfter parses the delay in seconds or the HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+
+	return 0
+}
+
+// send sends the API request and passes the response to handle. Throttled requests are retried with backoffs,
+// every attempt is bounded by the request timeout. The response body is closed after handle.
+func (c *Client) send(ctx context.Context, method, url string, handle func(resp *http.Response) error) error {
+	for attempt := 1; ; attempt++ {
+		err := c.throttle.check(time.Now())
+		if err != nil {
+			metrics.DockerHub.Throttled("rejected")
+			return err
+		}
+
+		retryAfter, throttled, err := c.attempt(ctx, method, url, handle)
+		if !throttled {
+			return err
+		}
+
+		delay := c.retry.backoff(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		if attempt >= c.retry.MaxAttempts || delay > c.retry.MaxBackoff {
+			metrics.DockerHub.Throttled("given_up")
+			return c.throttle.open(time.Now().Add(delay))
+		}
+
+		metrics.DockerHub.Throttled("retried")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// attempt sends the request once. It reports whether the response is 429 and the delay the registry has asked for.
+func (c *Client) attempt(ctx context.Context, method, url string, handle func(resp *http.Response) error) (time.Duration, bool, error) {
+	c.rl.Take()
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, http.NoBody)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), true, nil
+	}
+
+	return 0, false, handle(resp)
+}
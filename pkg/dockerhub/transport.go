@@ -0,0 +1,77 @@
+package dockerhub
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+)
+
+// instrumentedTransport exports metrics of every request sent by the client, labeled by the endpoint class.
+type instrumentedTransport struct {
+	next    http.RoundTripper
+	authURL string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := t.endpoint(req)
+
+	metrics.DockerHub.RequestStarted()
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = statusClass(resp.StatusCode)
+	}
+	metrics.DockerHub.RequestFinished(endpoint, status, time.Since(start))
+
+	return resp, err
+}
+
+// endpoint classifies the request: "auth" for tokens, "tags_page" for tag listing pages, "tag" for checks of
+// a single tag, "manifest" for registry manifests, "blob" for registry blobs and "other" for the rest.
+func (t *instrumentedTransport) endpoint(req *http.Request) string {
+	path := req.URL.Path
+
+	switch {
+	case strings.HasPrefix(req.URL.String(), t.authURL):
+		return "auth"
+
+	case strings.Contains(path, "/manifests/"):
+		return "manifest"
+
+	case strings.Contains(path, "/blobs/"):
+		return "blob"
+
+	case strings.HasSuffix(path, "/tags/"):
+		return "tags_page"
+
+	case strings.Contains(path, "/tags/"):
+		return "tag"
+
+	default:
+		return "other"
+	}
+}
+
+// statusClass returns "2xx" for 200, "4xx" for 404, etc.
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// instrument returns a copy of the client which transport exports metrics.
+func instrument(cli *http.Client, authURL string) *http.Client {
+	next := cli.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	instrumented := *cli
+	instrumented.Transport = &instrumentedTransport{next: next, authURL: authURL}
+
+	return &instrumented
+}
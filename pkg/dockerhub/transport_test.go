@@ -0,0 +1,33 @@
+package dockerhub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedTransport_Endpoint(t *testing.T) {
+	tr := &instrumentedTransport{authURL: AuthURL}
+
+	cases := map[string]string{
+		AuthURL + "?service=registry.docker.io&scope=repository:ratelimitpreview/test:pull": "auth",
+		DockerHubURL + "/repositories/clickhouse/clickhouse-server/tags/":                   "tags_page",
+		DockerHubURL + "/repositories/clickhouse/clickhouse-server/tags/?page=2":            "tags_page",
+		DockerHubURL + "/repositories/clickhouse/clickhouse-server/tags/23.3":               "tag",
+		RegistryURL + "/ratelimitpreview/test/manifests/latest":                             "manifest",
+		RegistryURL + "/clickhouse/clickhouse-server/blobs/sha256:ab":                       "blob",
+		DockerHubURL + "/repositories/clickhouse/clickhouse-server":                         "other",
+	}
+	for url, endpoint := range cases {
+		req := httptest.NewRequest(http.MethodGet, url, http.NoBody)
+		assert.Equal(t, endpoint, tr.endpoint(req), url)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(http.StatusOK))
+	assert.Equal(t, "4xx", statusClass(http.StatusTooManyRequests))
+	assert.Equal(t, "5xx", statusClass(http.StatusBadGateway))
+}
@@ -0,0 +1,223 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultTokenLifetime is assumed if the token response has no expiration, as the distribution spec suggests.
+const defaultTokenLifetime = 60 * time.Second
+
+type token struct {
+	value     string
+	expiresAt time.Time
+}
+
+// tokenCache keeps bearer tokens by repository. If the registry has asked for basic auth instead,
+// the credentials are sent with every request.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]token
+	basic  bool
+}
+
+func (t *tokenCache) get(repository string, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tok, ok := t.tokens[repository]
+	if !ok || !now.Before(tok.expiresAt) {
+		return "", false
+	}
+
+	return tok.value, true
+}
+
+func (t *tokenCache) put(repository string, tok token) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tokens[repository] = tok
+}
+
+func (t *tokenCache) useBasic() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.basic
+}
+
+func (t *tokenCache) setBasic() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.basic = true
+}
+
+// setAuthorization adds the static token, the cached bearer token of the repository or basic credentials.
+func (c *Client) setAuthorization(req *http.Request, repository string) {
+	switch {
+	case c.credentials.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.credentials.Token)
+
+	case c.tokens.useBasic():
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+
+	default:
+		if tok, ok := c.tokens.get(repository, time.Now()); ok {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+	}
+}
+
+// authorize follows the challenge of a 401 response: a bearer token is requested from the realm
+// with the credentials, or basic auth is used from now on.
+func (c *Client) authorize(ctx context.Context, repository, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.credentials.Username == "" {
+			return errors.New("registry requires credentials")
+		}
+		c.tokens.setBasic()
+
+		return nil
+
+	case "bearer":
+		tok, err := c.fetchToken(ctx, repository, params)
+		if err != nil {
+			return err
+		}
+		c.tokens.put(repository, tok)
+
+		return nil
+
+	default:
+		return errors.Errorf("unsupported challenge '%s'", challenge)
+	}
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// fetchToken requests a pull token of the repository from the realm. Anonymous tokens are requested
+// if the client has no credentials.
+func (c *Client) fetchToken(ctx context.Context, repository string, params map[string]string) (token, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return token{}, errors.Errorf("invalid realm '%s'", params["realm"])
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + repository + ":pull"
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	c.rl.Take()
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), http.NoBody)
+	if err != nil {
+		return token{}, errors.Wrap(err, "failed to create token request")
+	}
+	if c.credentials.Username != "" {
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return token{}, errors.Wrap(err, "token request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return token{}, errors.Errorf("unexpected token status %d", resp.StatusCode)
+	}
+
+	var tr tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return token{}, errors.Wrap(err, "token unmarshal failed")
+	}
+
+	tok := token{value: tr.Token, expiresAt: time.Now().Add(defaultTokenLifetime)}
+	if tok.value == "" {
+		tok.value = tr.AccessToken
+	}
+	if tok.value == "" {
+		return token{}, errors.New("token response has no token")
+	}
+	if tr.ExpiresIn > 0 {
+		tok.expiresAt = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	return tok, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g. `Bearer realm="https://ghcr.io/token",service="ghcr.io"`.
+// Quoted values may contain commas.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := make(map[string]string)
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end == -1 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = strings.TrimPrefix(strings.TrimSpace(value[end+2:]), ",")
+
+			continue
+		}
+
+		value, rest, _ = strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(value)
+	}
+
+	return scheme, params
+}
+
+// cancelingBody releases the request timeout once the body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
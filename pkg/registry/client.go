@@ -0,0 +1,370 @@
+// Package registry lists tags of repositories hosted by OCI distribution registries other than Docker Hub,
+// e.g. GHCR or a private registry. Tags are listed by /v2/<name>/tags/list, and the images of a tag
+// are resolved from its manifest. Results are returned in the models of the Docker Hub API,
+// so the tag cache treats both registries the same way.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/pkg/errors"
+	"go.uber.org/ratelimit"
+)
+
+const (
+	DefaultMaxRPS         = 5
+	DefaultRequestTimeout = 30 * time.Second
+	DefaultPageSize       = 100
+	DefaultMaxPages       = 100
+	DefaultFetchTimeout   = 5 * time.Minute
+)
+
+// Credentials authenticate the client in a private registry. Anonymous access is used if they are empty.
+type Credentials struct {
+	Username string
+	Password string
+
+	// Token is a bearer token sent as is. It cannot be set together with the username and the password.
+	Token string
+}
+
+func (c Credentials) IsZero() bool {
+	return c.Username == "" && c.Password == "" && c.Token == ""
+}
+
+type Config struct {
+	// URL is the base URL of the registry API, e.g. https://ghcr.io.
+	URL string
+
+	Credentials Credentials
+
+	MaxRPS int
+
+	// Every HTTP request is bounded by RequestTimeout. If it's 0, only the caller's context is used.
+	RequestTimeout time.Duration
+
+	// Tags are listed by pages of PageSize tags. Listing fails if it takes more than MaxPages pages
+	// or FetchTimeout in total, so a partial list is never returned. Zero values disable the limits,
+	// and the page size of the registry is used if PageSize is 0.
+	PageSize     int
+	MaxPages     int
+	FetchTimeout time.Duration
+
+	// HTTPClient is used to send requests. If it's nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// DefaultConfig is the config of a registry without the URL and credentials.
+var DefaultConfig = Config{
+	MaxRPS:         DefaultMaxRPS,
+	RequestTimeout: DefaultRequestTimeout,
+	PageSize:       DefaultPageSize,
+	MaxPages:       DefaultMaxPages,
+	FetchTimeout:   DefaultFetchTimeout,
+}
+
+type Client struct {
+	baseURL     *url.URL
+	credentials Credentials
+	timeout     time.Duration
+	rl          ratelimit.Limiter
+
+	pageSize     int
+	maxPages     int
+	fetchTimeout time.Duration
+
+	tokens tokenCache
+
+	// images keeps the images of manifests by repositories and digests. Manifests addressed by digests
+	// cannot change, so a tag is resolved by a single request while it's not re-pushed.
+	imagesMu sync.Mutex
+	images   map[string]map[string][]dockerhub.Image
+
+	cli *http.Client
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid registry url")
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, errors.Errorf("registry url '%s' must start with http:// or https://", cfg.URL)
+	}
+	if cfg.Credentials.Token != "" && (cfg.Credentials.Username != "" || cfg.Credentials.Password != "") {
+		return nil, errors.New("token cannot be set together with username and password")
+	}
+
+	maxRPS := cfg.MaxRPS
+	if maxRPS <= 0 {
+		maxRPS = DefaultMaxRPS
+	}
+
+	c := &Client{
+		baseURL:      baseURL,
+		credentials:  cfg.Credentials,
+		timeout:      cfg.RequestTimeout,
+		rl:           ratelimit.New(maxRPS),
+		pageSize:     cfg.PageSize,
+		maxPages:     cfg.MaxPages,
+		fetchTimeout: cfg.FetchTimeout,
+		tokens:       tokenCache{tokens: make(map[string]token)},
+		images:       make(map[string]map[string][]dockerhub.Image),
+		cli:          http.DefaultClient,
+	}
+	if cfg.HTTPClient != nil {
+		c.cli = cfg.HTTPClient
+	}
+
+	return c, nil
+}
+
+type tagsListResponse struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// GetTags lists the tags of the repository and resolves their images. Either all tags are returned or an error.
+// Every tag costs a manifest request, the images of manifests that have been resolved before are reused.
+func (c *Client) GetTags(ctx context.Context, repository string) ([]dockerhub.ImageTag, error) {
+	if c.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.fetchTimeout)
+		defer cancel()
+	}
+
+	names, err := c.listTags(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]dockerhub.ImageTag, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		digest, err := c.manifestDigest(ctx, repository, name)
+		if errors.Is(err, dockerhub.ErrTagNotFound) {
+			// The tag has been deleted while the list was fetched.
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve tag %s", name)
+		}
+		seen[digest] = struct{}{}
+
+		tag, err := c.resolveTag(ctx, repository, name, digest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve tag %s", name)
+		}
+
+		tags = append(tags, *tag)
+	}
+
+	c.forgetImages(repository, seen)
+
+	return tags, nil
+}
+
+// listTags follows the next links of the tags list.
+func (c *Client) listTags(ctx context.Context, repository string) ([]string, error) {
+	next := c.url(fmt.Sprintf("/v2/%s/tags/list", repository))
+	if c.pageSize > 0 {
+		next += fmt.Sprintf("?n=%d", c.pageSize)
+	}
+
+	var names []string
+	for page := 1; next != ""; page++ {
+		if c.maxPages > 0 && page > c.maxPages {
+			return nil, errors.Wrapf(dockerhub.ErrTooManyPages, "%d pages have been fetched, %d tags", c.maxPages, len(names))
+		}
+
+		var list tagsListResponse
+		resp, err := c.getJSON(ctx, repository, next, "", &list)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch page %d", page)
+		}
+		names = append(names, list.Tags...)
+
+		next, err = c.nextPage(next, resp.Header.Get("Link"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid next link of page %d", page)
+		}
+	}
+
+	return names, nil
+}
+
+// nextPage returns the absolute URL of the next page from the Link header, e.g. `</v2/a/tags/list?last=b>; rel="next"`.
+// It's empty on the last page.
+func (c *Client) nextPage(current, link string) (string, error) {
+	if link == "" {
+		return "", nil
+	}
+
+	target, params, _ := strings.Cut(link, ";")
+	if !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+		return "", nil
+	}
+
+	target = strings.Trim(strings.TrimSpace(target), "<>")
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+// TagExists checks whether the tag is still available in the repository. Only the manifest headers are requested.
+func (c *Client) TagExists(ctx context.Context, repository, tag string) (bool, error) {
+	_, err := c.manifestDigest(ctx, repository, tag)
+	if errors.Is(err, dockerhub.ErrTagNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetTag resolves the images of the tag. A multi-platform tag has an image per platform, their sizes are unknown.
+func (c *Client) GetTag(ctx context.Context, repository, tag string) (*dockerhub.ImageTag, error) {
+	digest, err := c.manifestDigest(ctx, repository, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.resolveTag(ctx, repository, tag, digest)
+}
+
+func (c *Client) resolveTag(ctx context.Context, repository, tag, digest string) (*dockerhub.ImageTag, error) {
+	images, err := c.manifestImages(ctx, repository, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	imageTag := &dockerhub.ImageTag{Name: tag, Images: images}
+	for _, img := range images {
+		if img.LastPushed.After(imageTag.TagLastPushed) {
+			imageTag.TagLastPushed = img.LastPushed
+			imageTag.LastUpdated = img.LastPushed
+		}
+	}
+
+	return imageTag, nil
+}
+
+// ImageConfig fetches the configuration of the image with the given platform digest.
+func (c *Client) ImageConfig(ctx context.Context, repository, digest string) (*dockerhub.ImageConfig, error) {
+	var m manifest
+	_, err := c.getJSON(ctx, repository, c.manifestURL(repository, digest), strings.Join(imageManifestTypes, ", "), &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get manifest")
+	}
+	if m.Config.Digest == "" {
+		return nil, errors.New("manifest has no config")
+	}
+
+	cfg, err := c.imageConfig(ctx, repository, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerhub.ImageConfig{
+		Created: cfg.Created,
+		Labels:  cfg.Config.Labels,
+	}, nil
+}
+
+func (c *Client) url(path string) string {
+	return c.baseURL.String() + path
+}
+
+func (c *Client) manifestURL(repository, reference string) string {
+	return c.url(fmt.Sprintf("/v2/%s/manifests/%s", repository, reference))
+}
+
+// getJSON sends an authenticated GET request and decodes the response.
+func (c *Client) getJSON(ctx context.Context, repository, url, accept string, v interface{}) (*http.Response, error) {
+	resp, err := c.send(ctx, repository, http.MethodGet, url, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, dockerhub.ErrTagNotFound
+	default:
+		return nil, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal failed")
+	}
+
+	return resp, nil
+}
+
+// send sends the request with the credentials of the repository. If the registry asks for a token it has not been
+// given yet, the token is requested, and the request is sent again. The caller must close the response body.
+func (c *Client) send(ctx context.Context, repository, method, url, accept string) (*http.Response, error) {
+	resp, err := c.attempt(ctx, repository, method, url, accept)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.credentials.Token != "" {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	err = c.authorize(ctx, repository, challenge)
+	if err != nil {
+		return nil, errors.Wrap(err, "authorization failed")
+	}
+
+	return c.attempt(ctx, repository, method, url, accept)
+}
+
+func (c *Client) attempt(ctx context.Context, repository, method, url, accept string) (*http.Response, error) {
+	c.rl.Take()
+
+	// The timeout is bound to the request only, the response body is read by the caller.
+	var cancel context.CancelFunc = func() {}
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, http.NoBody)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	c.setAuthorization(req, repository)
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "request failed")
+	}
+	resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	indexDigest    = "sha256:1111"
+	amd64Digest    = "sha256:2222"
+	arm64Digest    = "sha256:3333"
+	singleDigest   = "sha256:4444"
+	configDigest   = "sha256:5555"
+	testRepository = "clickhouse/clickhouse-server"
+)
+
+// newRegistry serves a repository with a multi-platform tag 23.3 and a single-platform tag head.
+// Tags are listed by pages of one tag, every request needs a bearer token of the realm.
+func newRegistry(t *testing.T, tokenRequests *int32) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(tokenRequests, 1)
+			assert.Equal(t, "repository:"+testRepository+":pull", r.URL.Query().Get("scope"))
+			assert.Equal(t, "registry.test", r.URL.Query().Get("service"))
+
+			_ = json.NewEncoder(w).Encode(tokenResponse{Token: "t0ken", ExpiresIn: 300})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="registry.test",scope="repository:%s:pull"`, srv.URL, testRepository))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		prefix := "/v2/" + testRepository
+		switch r.URL.Path {
+		case prefix + "/tags/list":
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/tags/list?n=1&last=23.3>; rel="next"`, prefix))
+				_ = json.NewEncoder(w).Encode(tagsListResponse{Name: testRepository, Tags: []string{"23.3"}})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(tagsListResponse{Name: testRepository, Tags: []string{"head"}})
+
+		case prefix + "/manifests/23.3", prefix + "/manifests/" + indexDigest:
+			w.Header().Set("Docker-Content-Digest", indexDigest)
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+			_, _ = fmt.Fprintf(w, `{
+				"mediaType": %q,
+				"manifests": [
+					{"digest": %q, "platform": {"architecture": "amd64", "os": "linux"}},
+					{"digest": %q, "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}},
+					{"digest": "sha256:9999", "platform": {"architecture": "unknown", "os": "unknown"}}
+				],
+				"annotations": {"org.opencontainers.image.created": "2023-04-01T10:00:00Z"}
+			}`, mediaTypeOCIIndex, amd64Digest, arm64Digest)
+
+		case prefix + "/manifests/head", prefix + "/manifests/" + singleDigest:
+			w.Header().Set("Docker-Content-Digest", singleDigest)
+			_, _ = fmt.Fprintf(w, `{
+				"mediaType": %q,
+				"config": {"digest": %q},
+				"layers": [{"size": 100}, {"size": 50}]
+			}`, mediaTypeOCIManifest, configDigest)
+
+		case prefix + "/blobs/" + configDigest:
+			_, _ = w.Write([]byte(`{
+				"architecture": "amd64",
+				"os": "linux",
+				"created": "2023-04-02T10:00:00Z",
+				"config": {"Labels": {"version": "head"}}
+			}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return srv
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server, cfg Config) *Client {
+	cfg.URL = srv.URL
+	cfg.MaxRPS = 1000
+	cfg.HTTPClient = srv.Client()
+
+	cli, err := NewClient(cfg)
+	require.NoError(t, err)
+
+	return cli
+}
+
+func TestClient_GetTags(t *testing.T) {
+	var tokenRequests int32
+	srv := newRegistry(t, &tokenRequests)
+	defer srv.Close()
+
+	cli := newTestClient(t, srv, Config{PageSize: 1})
+
+	tags, err := cli.GetTags(context.Background(), testRepository)
+	require.NoError(t, err)
+	require.Len(t, tags, 2)
+
+	multi := tags[0]
+	assert.Equal(t, "23.3", multi.Name)
+	assert.Equal(t, time.Date(2023, 4, 1, 10, 0, 0, 0, time.UTC), multi.TagLastPushed)
+	require.Len(t, multi.Images, 2)
+	assert.Equal(t, "amd64", multi.Images[0].Architecture)
+	assert.Equal(t, amd64Digest, multi.Images[0].Digest)
+	assert.Nil(t, multi.Images[0].Variant)
+	assert.Equal(t, "arm64", multi.Images[1].Architecture)
+	require.NotNil(t, multi.Images[1].Variant)
+	assert.Equal(t, "v8", *multi.Images[1].Variant)
+
+	single := tags[1]
+	assert.Equal(t, "head", single.Name)
+	require.Len(t, single.Images, 1)
+	assert.Equal(t, singleDigest, single.Images[0].Digest)
+	assert.Equal(t, "linux", single.Images[0].OS)
+	assert.Equal(t, 150, single.Images[0].Size)
+	assert.Equal(t, time.Date(2023, 4, 2, 10, 0, 0, 0, time.UTC), single.TagLastPushed)
+
+	// The token is cached for the repository.
+	assert.EqualValues(t, 1, atomic.LoadInt32(&tokenRequests))
+}
+
+func TestClient_GetTags_TooManyPages(t *testing.T) {
+	var tokenRequests int32
+	srv := newRegistry(t, &tokenRequests)
+	defer srv.Close()
+
+	cli := newTestClient(t, srv, Config{PageSize: 1, MaxPages: 1})
+
+	_, err := cli.GetTags(context.Background(), testRepository)
+	require.ErrorIs(t, err, dockerhub.ErrTooManyPages)
+}
+
+func TestClient_TagExists(t *testing.T) {
+	var tokenRequests int32
+	srv := newRegistry(t, &tokenRequests)
+	defer srv.Close()
+
+	cli := newTestClient(t, srv, Config{})
+
+	exists, err := cli.TagExists(context.Background(), testRepository, "23.3")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = cli.TagExists(context.Background(), testRepository, "21.8")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestClient_ImageConfig(t *testing.T) {
+	var tokenRequests int32
+	srv := newRegistry(t, &tokenRequests)
+	defer srv.Close()
+
+	cli := newTestClient(t, srv, Config{})
+
+	cfg, err := cli.ImageConfig(context.Background(), testRepository, singleDigest)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"version": "head"}, cfg.Labels)
+}
+
+func TestClient_BasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(tagsListResponse{Tags: []string{}})
+	}))
+	defer srv.Close()
+
+	cli := newTestClient(t, srv, Config{Credentials: Credentials{Username: "user", Password: "pass"}})
+
+	tags, err := cli.GetTags(context.Background(), testRepository)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	anonymous := newTestClient(t, srv, Config{})
+	_, err = anonymous.GetTags(context.Background(), testRepository)
+	require.Error(t, err)
+}
+
+func TestNewClient_Invalid(t *testing.T) {
+	_, err := NewClient(Config{URL: "ghcr.io"})
+	require.Error(t, err)
+
+	_, err = NewClient(Config{URL: "https://ghcr.io", Credentials: Credentials{Username: "user", Token: "t0ken"}})
+	require.Error(t, err)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:a/b:pull,push"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://ghcr.io/token",
+		"service": "ghcr.io",
+		"scope":   "repository:a/b:pull,push",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, params)
+}
@@ -0,0 +1,228 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeOCIIndex             = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList           = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest          = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	annotationCreated             = "org.opencontainers.image.created"
+	maxManifestLength       int64 = 4 << 20
+)
+
+// imageManifestTypes are the single-platform manifests.
+var imageManifestTypes = []string{mediaTypeOCIManifest, mediaTypeDockerManifest}
+
+// manifestTypes are all manifests a tag can point to.
+var manifestTypes = []string{mediaTypeOCIIndex, mediaTypeDockerList, mediaTypeOCIManifest, mediaTypeDockerManifest}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+// manifest is either an index of platform manifests or a single-platform manifest.
+type manifest struct {
+	MediaType   string            `json:"mediaType"`
+	Manifests   []descriptor      `json:"manifests"`
+	Config      descriptor        `json:"config"`
+	Layers      []descriptor      `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (m *manifest) isIndex() bool {
+	return m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList || len(m.Manifests) > 0
+}
+
+type imageConfig struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Variant      string    `json:"variant"`
+	Created      time.Time `json:"created"`
+	Config       struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// manifestDigest returns the digest of the manifest the reference points to. Only the headers are requested.
+func (c *Client) manifestDigest(ctx context.Context, repository, reference string) (string, error) {
+	resp, err := c.send(ctx, repository, http.MethodHead, c.manifestURL(repository, reference), strings.Join(manifestTypes, ", "))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", dockerhub.ErrTagNotFound
+	default:
+		return "", errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest != "" {
+		return digest, nil
+	}
+
+	// Registries are not required to report the digest, so the manifest is hashed then.
+	body, _, err := c.getManifest(ctx, repository, reference)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// getManifest fetches the raw manifest, so its digest can be computed.
+func (c *Client) getManifest(ctx context.Context, repository, reference string) ([]byte, *manifest, error) {
+	resp, err := c.send(ctx, repository, http.MethodGet, c.manifestURL(repository, reference), strings.Join(manifestTypes, ", "))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil, dockerhub.ErrTagNotFound
+	default:
+		return nil, nil, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestLength))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "body read failed")
+	}
+
+	m := new(manifest)
+	err = json.Unmarshal(body, m)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unmarshal failed")
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	return body, m, nil
+}
+
+// manifestImages returns the images of the manifest with the digest: an image per platform of an index,
+// or the single image of a platform manifest.
+func (c *Client) manifestImages(ctx context.Context, repository, digest string) ([]dockerhub.Image, error) {
+	c.imagesMu.Lock()
+	images, found := c.images[repository][digest]
+	c.imagesMu.Unlock()
+	if found {
+		return images, nil
+	}
+
+	_, m, err := c.getManifest(ctx, repository, digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get manifest")
+	}
+
+	if m.isIndex() {
+		pushedAt, _ := time.Parse(time.RFC3339, m.Annotations[annotationCreated])
+		for _, d := range m.Manifests {
+			// Attestations and other artifacts are listed with the unknown platform.
+			if d.Platform == nil || d.Platform.OS == "unknown" {
+				continue
+			}
+
+			images = append(images, dockerhub.Image{
+				Architecture: d.Platform.Architecture,
+				Variant:      optional(d.Platform.Variant),
+				OS:           d.Platform.OS,
+				Digest:       d.Digest,
+				Status:       "active",
+				LastPushed:   pushedAt,
+			})
+		}
+	} else {
+		if m.Config.Digest == "" {
+			return nil, errors.New("manifest has no config")
+		}
+
+		cfg, err := c.imageConfig(ctx, repository, m.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		var size int64
+		for _, l := range m.Layers {
+			size += l.Size
+		}
+
+		images = []dockerhub.Image{{
+			Architecture: cfg.Architecture,
+			Variant:      optional(cfg.Variant),
+			OS:           cfg.OS,
+			Digest:       digest,
+			Size:         int(size),
+			Status:       "active",
+			LastPushed:   cfg.Created,
+		}}
+	}
+
+	c.imagesMu.Lock()
+	if c.images[repository] == nil {
+		c.images[repository] = make(map[string][]dockerhub.Image)
+	}
+	c.images[repository][digest] = images
+	c.imagesMu.Unlock()
+
+	return images, nil
+}
+
+// forgetImages drops the images of manifests no tag of the repository points to anymore.
+func (c *Client) forgetImages(repository string, digests map[string]struct{}) {
+	c.imagesMu.Lock()
+	defer c.imagesMu.Unlock()
+
+	for digest := range c.images[repository] {
+		if _, found := digests[digest]; !found {
+			delete(c.images[repository], digest)
+		}
+	}
+}
+
+func (c *Client) imageConfig(ctx context.Context, repository, digest string) (*imageConfig, error) {
+	cfg := new(imageConfig)
+	_, err := c.getJSON(ctx, repository, c.url(fmt.Sprintf("/v2/%s/blobs/%s", repository, digest)), "", cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get config")
+	}
+
+	return cfg, nil
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
@@ -0,0 +1,58 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// ReasonClientAbandoned is set when the client has disconnected before the run has been finished.
+const ReasonClientAbandoned = "client_abandoned"
+
+// StatusClientClosedRequest is the nginx convention for requests closed by the client.
+// Abandoned runs are reported with it, so they are not counted as server failures.
+const StatusClientClosedRequest = 499
+
+// runContext returns the context of the run execution. If abandoned runs are finished,
+// the run outlives the request and is limited by the run timeout only.
+func (h *queryHandler) runContext(r *http.Request, run *queryrun.Run) (context.Context, context.CancelFunc) {
+	ctx := r.Context()
+	if h.finishAbandoned {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, run.Deadlines.RunTimeout)
+}
+
+// clientAbandoned tells whether the run has failed because the client has disconnected.
+// Expired run deadlines are not abandonments, as the request context has no deadline of its own.
+func clientAbandoned(r *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) && errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// clientGone tells whether the client has disconnected, e.g. while an abandoned run was being finished.
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// writeClientAbandoned responds to the disconnected client. Nobody reads the response,
+// but its status distinguishes the run from failures in access logs and metrics.
+func writeClientAbandoned(w http.ResponseWriter) {
+	writeErrorResponse(w, &ErrorResponse{
+		Message: "client has disconnected before the run was finished",
+		Code:    StatusClientClosedRequest,
+		Reason:  ReasonClientAbandoned,
+	})
+}
+
+// statusText extends http.StatusText with StatusClientClosedRequest.
+func statusText(code int) string {
+	if code == StatusClientClosedRequest {
+		return "Client Closed Request"
+	}
+
+	return http.StatusText(code)
+}
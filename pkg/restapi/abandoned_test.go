@@ -0,0 +1,138 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticTagStorage resolves every version to itself. Methods that are not needed by tests are not implemented.
+type staticTagStorage struct {
+	TagStorage
+}
+
+func (staticTagStorage) Resolve(version string, _ bool) (dockertag.Image, bool) {
+	return dockertag.Image{Tag: version}, true
+}
+
+func (staticTagStorage) Deprecation(string) (dockertag.Deprecation, bool) {
+	return dockertag.Deprecation{}, false
+}
+
+// slowRunner blocks runs until they are released or their context is done.
+type slowRunner struct {
+	QueryRunner
+
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowRunner() *slowRunner {
+	return &slowRunner{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *slowRunner) RunQuery(ctx context.Context, _ *queryrun.Run) (qrunner.Result, error) {
+	close(s.started)
+
+	select {
+	case <-s.release:
+		return qrunner.Result{Stdout: "1\n"}, nil
+	case <-ctx.Done():
+		return qrunner.Result{}, ctx.Err()
+	}
+}
+
+func TestAbandonedRuns(t *testing.T) {
+	// serve runs the query and disconnects the client once the run has started.
+	serve := func(h *queryHandler, runner *slowRunner, afterDisconnect func()) *httptest.ResponseRecorder {
+		ctx, disconnect := context.WithCancel(context.Background())
+		defer disconnect()
+
+		body := strings.NewReader(`{"query": "SELECT 1", "version": "23.3.1.2823"}`)
+		req := httptest.NewRequest(http.MethodPost, "/runs", body).WithContext(ctx)
+		rec := httptest.NewRecorder()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.runQuery(rec, req)
+		}()
+
+		<-runner.started
+		disconnect()
+		afterDisconnect()
+		<-done
+
+		return rec
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		runner := newSlowRunner()
+		repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+		h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+		rec := serve(h, runner, func() {})
+		assert.Equal(t, StatusClientClosedRequest, rec.Code)
+
+		var resp Response
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.NotNil(t, resp.Error)
+		assert.Equal(t, ReasonClientAbandoned, resp.Error.Reason)
+		assert.Empty(t, repo.runs)
+	})
+
+	t.Run("finished", func(t *testing.T) {
+		runner := newSlowRunner()
+		repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+		h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+		h.finishAbandoned = true
+
+		// The run is released after the disconnect, it must not be cancelled by then.
+		serve(h, runner, func() { close(runner.release) })
+
+		require.Len(t, repo.runs, 1)
+		for _, run := range repo.runs {
+			assert.True(t, run.Abandoned)
+			assert.Equal(t, "1\n", run.Output)
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		runner := newSlowRunner()
+		repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+		h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Millisecond, 1000, 1000)
+
+		body := strings.NewReader(`{"query": "SELECT 1", "version": "23.3.1.2823"}`)
+		rec := httptest.NewRecorder()
+		h.runQuery(rec, httptest.NewRequest(http.MethodPost, "/runs", body))
+
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Empty(t, repo.runs)
+	})
+}
+
+func TestClientAbandoned(t *testing.T) {
+	ctx, disconnect := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/runs", nil).WithContext(ctx)
+
+	assert.False(t, clientAbandoned(req, context.Canceled))
+
+	disconnect()
+	assert.True(t, clientAbandoned(req, context.Canceled))
+	assert.False(t, clientAbandoned(req, context.DeadlineExceeded))
+	assert.False(t, clientAbandoned(req, nil))
+}
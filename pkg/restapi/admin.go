@@ -0,0 +1,546 @@
+package restapi
+
+import (
+	"net/http"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// AdminRouterOpts configures the admin API. It must be served by a separate listener
+// that is not exposed to the public.
+type AdminRouterOpts struct {
+	Logger      zerolog.Logger
+	RunRepo     queryrun.Repository
+	Snapshotter ContainerSnapshotter
+	WarmPools   WarmPoolStatus
+	Containers  ContainerLister
+	Health      HealthReporter
+	RunLimiter  *ClientRunLimiter
+
+	// Canary is optional. If it's nil, canary checks cannot be triggered.
+	Canary Canary
+
+	// GC is optional. If it's nil, garbage collection reports are not served.
+	GC GCReporter
+
+	// Scheduler is optional. If it's nil, the status has no scheduler section.
+	Scheduler SchedulerStatus
+
+	// Remediations is optional. If it's nil, the status has no remediations section.
+	Remediations Remediations
+
+	// CircuitBreakers is optional. If it's nil, circuit breakers are not served.
+	CircuitBreakers CircuitBreakers
+
+	// ResultCache is optional. If it's nil, deleted runs have no cached results to drop.
+	ResultCache ResultCache
+
+	// BlockList is optional. If it's nil, the block list cannot be managed.
+	BlockList BlockList
+
+	// Maintenance is optional. If it's nil, the maintenance mode cannot be forced.
+	Maintenance MaintenanceControl
+
+	// Timeout limits requests to the admin API.
+	Timeout time.Duration
+
+	// StatsMaxRuns limits the number of runs aggregated by stats views.
+	StatsMaxRuns int
+}
+
+func NewAdminRouter(opts AdminRouterOpts) http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{
+		Logger:  &opts.Logger,
+		NoColor: true,
+	}))
+	r.Use(middleware.Recoverer)
+	r.Use(timeoutMiddleware(opts.Timeout))
+
+	r.Route("/admin", func(r chi.Router) {
+		adminHandler := newAdminHandler(opts.RunRepo, opts.Snapshotter, opts.WarmPools, opts.Containers, opts.StatsMaxRuns)
+		adminHandler.runLimiter = opts.RunLimiter
+		adminHandler.scheduler = opts.Scheduler
+		adminHandler.remediations = opts.Remediations
+		adminHandler.resultCache = opts.ResultCache
+		adminHandler.handle(r)
+
+		if opts.Health != nil {
+			r.Get("/health", newHealthHandler(opts.Health, true).getHealth)
+		}
+
+		if opts.Canary != nil {
+			newCanaryHandler(opts.Canary).handle(r)
+		}
+
+		if opts.GC != nil {
+			newGCReportHandler(opts.GC).handle(r)
+		}
+
+		if opts.CircuitBreakers != nil {
+			newCircuitBreakerHandler(opts.CircuitBreakers).handle(r)
+		}
+
+		if opts.BlockList != nil {
+			newBlockListHandler(opts.BlockList).handle(r)
+		}
+
+		if opts.Maintenance != nil {
+			newMaintenanceHandler(opts.Maintenance).handle(r)
+		}
+	})
+
+	return r
+}
+
+const (
+	defaultStatsWindow = 24 * time.Hour
+	maxStatsWindow     = 7 * 24 * time.Hour
+)
+
+type adminHandler struct {
+	runRepo      queryrun.Repository
+	snapshotter  ContainerSnapshotter
+	containers   ContainerLister
+	statsMaxRuns int
+
+	// warmPools is optional. If it's nil, warm pools are not reported.
+	warmPools WarmPoolStatus
+
+	// runLimiter is optional. If it's nil, in-flight runs of clients are not reported.
+	runLimiter *ClientRunLimiter
+
+	// scheduler is optional. If it's nil, priority classes are not reported.
+	scheduler SchedulerStatus
+
+	// remediations is optional. If it's nil, remediations of container failures are not reported.
+	remediations Remediations
+
+	// resultCache is optional. If it's nil, deleted runs have no cached results to drop.
+	resultCache ResultCache
+}
+
+func newAdminHandler(
+	runRepo queryrun.Repository,
+	snapshotter ContainerSnapshotter,
+	warmPools WarmPoolStatus,
+	containers ContainerLister,
+	statsMaxRuns int,
+) *adminHandler {
+	return &adminHandler{
+		runRepo:      runRepo,
+		snapshotter:  snapshotter,
+		warmPools:    warmPools,
+		containers:   containers,
+		statsMaxRuns: statsMaxRuns,
+	}
+}
+
+func (h *adminHandler) handle(r chi.Router) {
+	r.Get("/status", h.getStatus)
+	r.Get("/containers", h.listContainers)
+	r.Get("/runs/{id}/container", h.getRunContainer)
+	r.Delete("/runs/{id}", requireRunStorage(h.runRepo, h.deleteRun))
+	r.Get("/stats/startup", requireRunStorage(h.runRepo, h.getStartupStats))
+	r.Get("/stats/latency", requireRunStorage(h.runRepo, h.getLatencyStats))
+}
+
+// deleteRun removes a stored run for abuse handling. The admin listener is not exposed to the public,
+// so no edit token is needed. Runs in flight are not stored yet, they are not found.
+func (h *adminHandler) deleteRun(w http.ResponseWriter, r *http.Request) {
+	deleteStoredRun(w, r, h.runRepo, h.resultCache, func(*queryrun.Run) (string, string, bool) {
+		return queryrun.DeletionReasonAdmin, "admin", true
+	})
+}
+
+type RunContainerOutput struct {
+	QueryRunID string `json:"query_run_id"`
+
+	// InProgress is true if the snapshot has been captured right now.
+	// Otherwise, it has been captured before cleanup of the failed run.
+	InProgress bool `json:"in_progress"`
+
+	// Error is the failure of a finished run.
+	Error string `json:"error,omitempty"`
+
+	Snapshot *queryrun.ContainerSnapshot `json:"snapshot"`
+}
+
+// getRunContainer returns the live container state of an in-flight run or
+// the snapshot captured before cleanup of a failed run.
+func (h *adminHandler) getRunContainer(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	snapshot, err := h.snapshotter.Snapshot(r.Context(), id)
+	if err == nil {
+		writeResult(w, RunContainerOutput{
+			QueryRunID: id,
+			InProgress: true,
+			Snapshot:   snapshot,
+		})
+
+		return
+	}
+	if !errors.Is(err, qrunner.ErrRunNotInProgress) {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to capture container snapshot")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if h.runRepo == nil {
+		writeError(w, errRunStorageDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	run, err := h.runRepo.Get(r.Context(), id)
+	if errors.Is(err, queryrun.ErrNotFound) {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if run.ContainerSnapshot == nil {
+		writeError(w, "run has no container snapshot", http.StatusNotFound)
+		return
+	}
+
+	writeResult(w, RunContainerOutput{
+		QueryRunID: run.ID,
+		Error:      run.Error,
+		Snapshot:   run.ContainerSnapshot,
+	})
+}
+
+type StartupStatsOutput struct {
+	Window   string                `json:"window"`
+	Runs     int                   `json:"runs"`
+	Versions []SeriesStartupOutput `json:"versions"`
+}
+
+type SeriesStartupOutput struct {
+	Series string `json:"series"`
+	Runs   int    `json:"runs"`
+
+	P50WaitMs int64 `json:"p50_wait_ms"`
+	P95WaitMs int64 `json:"p95_wait_ms"`
+
+	P50Attempts int `json:"p50_attempts"`
+	P95Attempts int `json:"p95_attempts"`
+}
+
+// statsWindow parses the window of stats views. It's passed as a Go duration (e.g. 6h),
+// it's 24h by default and cannot exceed 7 days.
+func statsWindow(r *http.Request) (time.Duration, error) {
+	raw := r.URL.Query().Get("window")
+	if raw == "" {
+		return defaultStatsWindow, nil
+	}
+
+	window, err := time.ParseDuration(raw)
+	if err != nil || window <= 0 {
+		return 0, errors.New("invalid window")
+	}
+	if window > maxStatsWindow {
+		return 0, errors.New("window cannot exceed " + maxStatsWindow.String())
+	}
+
+	return window, nil
+}
+
+// listStages returns stages of runs within the window of the stats view.
+// It writes the failure response itself, so nothing must be written if it fails.
+func (h *adminHandler) listStages(w http.ResponseWriter, r *http.Request) ([]queryrun.RunStages, time.Duration, bool) {
+	window, err := statsWindow(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	runs, err := h.runRepo.ListStages(r.Context(), time.Now().Add(-window), h.statsMaxRuns)
+	if errors.Is(err, queryrun.ErrStagesIndexDisabled) {
+		writeError(w, err.Error(), http.StatusNotImplemented)
+		return nil, 0, false
+	}
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to list run stages")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return nil, 0, false
+	}
+
+	return runs, window, true
+}
+
+// getStartupStats returns percentiles of the readiness wait of database servers per version series.
+func (h *adminHandler) getStartupStats(w http.ResponseWriter, r *http.Request) {
+	runs, window, ok := h.listStages(w, r)
+	if !ok {
+		return
+	}
+
+	summaries := queryrun.SummarizeReadiness(runs)
+
+	output := StartupStatsOutput{
+		Window:   window.String(),
+		Runs:     len(runs),
+		Versions: make([]SeriesStartupOutput, 0, len(summaries)),
+	}
+	for _, s := range summaries {
+		output.Versions = append(output.Versions, SeriesStartupOutput{
+			Series:      s.Series,
+			Runs:        s.Runs,
+			P50WaitMs:   s.P50Wait.Milliseconds(),
+			P95WaitMs:   s.P95Wait.Milliseconds(),
+			P50Attempts: s.P50Attempts,
+			P95Attempts: s.P95Attempts,
+		})
+	}
+
+	writeResult(w, output)
+}
+
+type LatencyStatsOutput struct {
+	Window   string                `json:"window"`
+	Runs     int                   `json:"runs"`
+	Versions []SeriesLatencyOutput `json:"versions"`
+}
+
+type SeriesLatencyOutput struct {
+	Series string `json:"series"`
+	Runs   int    `json:"runs"`
+
+	P50SetupMs int64 `json:"p50_setup_ms"`
+	P95SetupMs int64 `json:"p95_setup_ms"`
+
+	P50QueryMs int64 `json:"p50_query_ms"`
+	P95QueryMs int64 `json:"p95_query_ms"`
+}
+
+// getLatencyStats returns percentiles of the container setup and the query execution durations per version series.
+func (h *adminHandler) getLatencyStats(w http.ResponseWriter, r *http.Request) {
+	runs, window, ok := h.listStages(w, r)
+	if !ok {
+		return
+	}
+
+	summaries := queryrun.SummarizeLatency(runs)
+
+	output := LatencyStatsOutput{
+		Window:   window.String(),
+		Runs:     len(runs),
+		Versions: make([]SeriesLatencyOutput, 0, len(summaries)),
+	}
+	for _, s := range summaries {
+		output.Versions = append(output.Versions, SeriesLatencyOutput{
+			Series:     s.Series,
+			Runs:       s.Runs,
+			P50SetupMs: s.P50Setup.Milliseconds(),
+			P95SetupMs: s.P95Setup.Milliseconds(),
+			P50QueryMs: s.P50Query.Milliseconds(),
+			P95QueryMs: s.P95Query.Milliseconds(),
+		})
+	}
+
+	writeResult(w, output)
+}
+
+type StatusOutput struct {
+	WarmPools []WarmPoolOutput `json:"warm_pools"`
+
+	// Clients are clients with runs in progress, the busiest ones go first.
+	Clients []ClientInFlightOutput `json:"clients"`
+
+	// Scheduler lists priority classes from the highest one. It's empty if runs are not scheduled by priority.
+	Scheduler []SchedulerClassOutput `json:"scheduler,omitempty"`
+
+	// Remediations lists runners that remediate failures of containers automatically.
+	Remediations []RunnerRemediationsOutput `json:"remediations,omitempty"`
+}
+
+type RunnerRemediationsOutput struct {
+	Runner string `json:"runner"`
+
+	// ConcurrencyFactor scales the concurrency limit of the runner. It's below 1 while the runner is throttled.
+	ConcurrencyFactor float64    `json:"concurrency_factor"`
+	ThrottledUntil    *time.Time `json:"throttled_until,omitempty"`
+
+	// Recent remediations, the latest one goes first.
+	Recent []RemediationOutput `json:"recent"`
+}
+
+type RemediationOutput struct {
+	Action  string    `json:"action"`
+	Class   string    `json:"class"`
+	Details string    `json:"details"`
+	At      time.Time `json:"at"`
+}
+
+type SchedulerClassOutput struct {
+	Priority string `json:"priority"`
+	Weight   uint   `json:"weight"`
+
+	// MaxConcurrency and MaxQueued are 0 if the class is not limited.
+	MaxConcurrency uint `json:"max_concurrency"`
+	MaxQueued      uint `json:"max_queued"`
+
+	InFlight   uint   `json:"in_flight"`
+	Queued     uint   `json:"queued"`
+	Dispatched uint64 `json:"dispatched"`
+	Rejected   uint64 `json:"rejected"`
+}
+
+type ClientInFlightOutput struct {
+	// Client is the address of an anonymous client or the name of the API key.
+	Client        string `json:"client"`
+	Authenticated bool   `json:"authenticated"`
+	InFlight      uint   `json:"in_flight"`
+
+	// Limit is 0 if the client is not limited.
+	Limit uint `json:"limit"`
+}
+
+type WarmPoolOutput struct {
+	Runner     string             `json:"runner"`
+	Budget     uint               `json:"budget"`
+	Versions   map[string]uint    `json:"versions"`
+	Popularity map[string]float64 `json:"popularity"`
+
+	// ResizedAt is empty if the pool has not been resized yet.
+	ResizedAt *time.Time `json:"resized_at,omitempty"`
+}
+
+// getStatus returns the state of the runners: how warm containers are distributed across versions
+// and the popularity the distribution is based on.
+func (h *adminHandler) getStatus(w http.ResponseWriter, _ *http.Request) {
+	output := StatusOutput{
+		WarmPools: make([]WarmPoolOutput, 0),
+		Clients:   make([]ClientInFlightOutput, 0),
+	}
+
+	if h.warmPools != nil {
+		for _, a := range h.warmPools.WarmPools() {
+			pool := WarmPoolOutput{
+				Runner:     a.Runner,
+				Budget:     a.Budget,
+				Versions:   a.Versions,
+				Popularity: a.Popularity,
+			}
+			if !a.ResizedAt.IsZero() {
+				resizedAt := a.ResizedAt
+				pool.ResizedAt = &resizedAt
+			}
+
+			output.WarmPools = append(output.WarmPools, pool)
+		}
+	}
+
+	if h.runLimiter != nil {
+		for _, c := range h.runLimiter.InFlight() {
+			output.Clients = append(output.Clients, ClientInFlightOutput{
+				Client:        c.Client,
+				Authenticated: c.Authenticated,
+				InFlight:      c.InFlight,
+				Limit:         c.Limit,
+			})
+		}
+	}
+
+	if h.scheduler != nil {
+		for _, c := range h.scheduler.SchedulerClasses() {
+			output.Scheduler = append(output.Scheduler, SchedulerClassOutput{
+				Priority:       c.Priority,
+				Weight:         c.Weight,
+				MaxConcurrency: c.MaxConcurrency,
+				MaxQueued:      c.MaxQueued,
+				InFlight:       c.InFlight,
+				Queued:         c.Queued,
+				Dispatched:     c.Dispatched,
+				Rejected:       c.Rejected,
+			})
+		}
+	}
+
+	if h.remediations != nil {
+		for _, s := range h.remediations.Remediations() {
+			runner := RunnerRemediationsOutput{
+				Runner:            s.Runner,
+				ConcurrencyFactor: s.ConcurrencyFactor,
+				Recent:            make([]RemediationOutput, 0, len(s.Recent)),
+			}
+			if !s.ThrottledUntil.IsZero() {
+				throttledUntil := s.ThrottledUntil
+				runner.ThrottledUntil = &throttledUntil
+			}
+			for _, r := range s.Recent {
+				runner.Recent = append(runner.Recent, RemediationOutput{
+					Action:  r.Action,
+					Class:   r.Class,
+					Details: r.Details,
+					At:      r.At,
+				})
+			}
+
+			output.Remediations = append(output.Remediations, runner)
+		}
+	}
+
+	writeResult(w, output)
+}
+
+type ContainerOutput struct {
+	ID         string    `json:"id"`
+	Runner     string    `json:"runner"`
+	QueryRunID string    `json:"query_run_id,omitempty"`
+	Version    string    `json:"version"`
+	State      string    `json:"state"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Held is true if the container of a failed run is kept for inspection until HeldUntil.
+	Held      bool       `json:"held"`
+	HeldUntil *time.Time `json:"held_until,omitempty"`
+}
+
+type ListContainersOutput struct {
+	Containers []ContainerOutput `json:"containers"`
+}
+
+// listContainers returns containers of alive runners: in-flight, warm, reserved and held ones.
+func (h *adminHandler) listContainers(w http.ResponseWriter, r *http.Request) {
+	containers, err := h.containers.Containers(r.Context())
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to list containers")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	output := ListContainersOutput{Containers: make([]ContainerOutput, 0, len(containers))}
+	for _, c := range containers {
+		output.Containers = append(output.Containers, ContainerOutput{
+			ID:         c.ID,
+			Runner:     c.Runner,
+			QueryRunID: c.RunID,
+			Version:    c.Version,
+			State:      c.State,
+			CreatedAt:  c.CreatedAt,
+			Held:       c.HeldUntil != nil,
+			HeldUntil:  c.HeldUntil,
+		})
+	}
+
+	writeResult(w, output)
+}
@@ -0,0 +1,57 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStatus_NoSources(t *testing.T) {
+	h := newAdminHandler(nil, nil, nil, nil, 0)
+
+	rec := httptest.NewRecorder()
+	h.getStatus(rec, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Result StatusOutput `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Empty(t, resp.Result.WarmPools)
+	assert.Empty(t, resp.Result.Clients)
+}
+
+func TestAdminDeleteRun(t *testing.T) {
+	repo := queryrun.NewMemoryRepository(0, 0)
+	run := queryrun.New("SELECT 1", ClickHouseDatabase, "23.3", &runsettings.ClickHouseSettings{})
+	require.NoError(t, repo.Create(context.Background(), run))
+
+	r := chi.NewRouter()
+	newAdminHandler(repo, nil, nil, nil, 0).handle(r)
+
+	remove := func(id string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/runs/"+id, nil))
+		return rec.Code
+	}
+
+	// No edit token is needed on the admin listener.
+	require.Equal(t, http.StatusNoContent, remove(run.ID))
+
+	deleted, err := repo.Get(context.Background(), run.ID)
+	require.NoError(t, err)
+	assert.True(t, deleted.Deleted())
+	assert.Equal(t, queryrun.DeletionReasonAdmin, deleted.DeletionReason)
+
+	assert.Equal(t, http.StatusGone, remove(run.ID))
+	assert.Equal(t, http.StatusNotFound, remove("unknown"))
+}
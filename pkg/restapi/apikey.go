@@ -0,0 +1,110 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+// Permissions that can be granted to API keys.
+const (
+	// PermissionSelectRunner allows choosing the runner that executes the query.
+	PermissionSelectRunner = "select_runner"
+
+	// PermissionDeleteRuns allows deleting any run, e.g. to handle abuse reports.
+	PermissionDeleteRuns = "delete_runs"
+
+	// PermissionKeepContainer allows holding the container of a failed run for inspection, see keep_container_on_failure.
+	PermissionKeepContainer = "keep_container"
+
+	// PermissionSetPriority allows choosing the priority class the run is scheduled in.
+	PermissionSetPriority = "set_priority"
+
+	// PermissionSetResources allows overriding the container limits of the runner, see resources.
+	PermissionSetResources = "set_resources"
+)
+
+// Permissions lists the permissions that can be granted to API keys.
+var Permissions = []string{
+	PermissionSelectRunner,
+	PermissionDeleteRuns,
+	PermissionKeepContainer,
+	PermissionSetPriority,
+	PermissionSetResources,
+}
+
+// APIKey grants additional permissions to clients that present it.
+// Requests without a key are served with the public tier permissions.
+type APIKey struct {
+	Name        string
+	Permissions []string
+}
+
+func (k APIKey) has(permission string) bool {
+	for _, p := range k.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIKeys maps keys to their descriptions.
+type APIKeys map[string]APIKey
+
+type apiKeyCtxKey struct{}
+
+// apiKeyMiddleware authenticates clients that pass a key in the X-API-Key header or
+// in the Authorization header with the Bearer scheme. Unknown keys are rejected with 401.
+func apiKeyMiddleware(keys APIKeys) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := requestAPIKey(r)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key, found := keys[value]
+			if !found {
+				writeError(w, "invalid api key", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, key)))
+		})
+	}
+}
+
+func requestAPIKey(r *http.Request) string {
+	if value := r.Header.Get(HeaderAPIKey); value != "" {
+		return value
+	}
+
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
+
+// hasPermission reports whether the request has been authenticated with a key granting the permission.
+func hasPermission(r *http.Request, permission string) bool {
+	key, ok := requestKey(r)
+	if !ok {
+		return false
+	}
+
+	return key.has(permission)
+}
+
+// requestKey returns the key the request has been authenticated with.
+func requestKey(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyCtxKey{}).(APIKey)
+
+	return key, ok
+}
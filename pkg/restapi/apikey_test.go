@@ -0,0 +1,51 @@
+package restapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	keys := APIKeys{
+		"secret": {Name: "internal", Permissions: []string{PermissionSelectRunner}},
+		"public": {Name: "public"},
+	}
+
+	tests := []struct {
+		name          string
+		header        string
+		value         string
+		code          int
+		selectRunners bool
+	}{
+		{name: "anonymous", code: http.StatusOK},
+		{name: "api key header", header: HeaderAPIKey, value: "secret", code: http.StatusOK, selectRunners: true},
+		{name: "bearer token", header: "Authorization", value: "Bearer secret", code: http.StatusOK, selectRunners: true},
+		{name: "no permission", header: HeaderAPIKey, value: "public", code: http.StatusOK},
+		{name: "unknown key", header: HeaderAPIKey, value: "unknown", code: http.StatusUnauthorized},
+		{name: "basic auth", header: "Authorization", value: "Basic secret", code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var selectRunners bool
+			handler := apiKeyMiddleware(keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				selectRunners = hasPermission(r, PermissionSelectRunner)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/api/runs", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, tt.selectRunners, selectRunners)
+		})
+	}
+}
@@ -0,0 +1,660 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/pkg/chsemver"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// Predicates of bisections: the output of every version is compared to the expected output
+// or to the output of the oldest version.
+const (
+	BisectExpectExact  = "exact"
+	BisectExpectOldest = "oldest"
+)
+
+// Search modes of bisections.
+const (
+	BisectSearchBinary = "binary"
+	BisectSearchLinear = "linear"
+)
+
+const ContentTypeEventStream = "text/event-stream"
+
+// bisectWriteGrace is added to the bisection timeout to write the partial result once the deadline is reached.
+const bisectWriteGrace = 10 * time.Second
+
+// BisectConfig bounds bisections. Every version probed by a bisection is a separate run.
+type BisectConfig struct {
+	// MaxRuns limits runs of a bisection. Linear searches over longer ranges are rejected.
+	MaxRuns uint
+
+	// Parallelism is the max number of versions run at once. Every run also takes a slot of the client in-flight limit.
+	Parallelism uint
+
+	// Timeout bounds the whole bisection. The narrowest bounds found by then are returned.
+	Timeout time.Duration
+}
+
+type bisectHandler struct {
+	queries *queryHandler
+	cfg     BisectConfig
+}
+
+func newBisectHandler(queries *queryHandler, cfg BisectConfig) *bisectHandler {
+	return &bisectHandler{
+		queries: queries,
+		cfg:     cfg,
+	}
+}
+
+func (h *bisectHandler) handle(r chi.Router) {
+	// The quota is charged per probed version. The first one is charged before the bisection starts,
+	// so clients that have exhausted their budget are rejected with 429.
+	if h.queries.quota != nil {
+		r = r.With(h.queries.quota.limitRuns)
+	}
+
+	r.Post("/bisect", h.bisect)
+}
+
+type BisectInput struct {
+	Query    string `json:"query"`
+	Database string `json:"database"`
+	Format   string `json:"format,omitempty"`
+
+	// From and To bound the range of versions, e.g. 21.8 and 22.6. Both bounds are inclusive and compared by prefix.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	Expect BisectExpectation `json:"expect"`
+
+	// Search is binary by default. Binary search assumes the behavior changes once within the range,
+	// linear search runs every version from the oldest one until the output changes.
+	Search string `json:"search,omitempty"`
+
+	// Parallelism lowers the parallelism of the deployment.
+	Parallelism uint `json:"parallelism,omitempty"`
+}
+
+type BisectExpectation struct {
+	// Mode is exact (the output must be equal to Output) or oldest (the output must be equal to the oldest one).
+	Mode   string `json:"mode"`
+	Output string `json:"output,omitempty"`
+}
+
+type BisectOutput struct {
+	// Complete is false if the bisection has been stopped early, Error tells why.
+	// Before and After are the narrowest bounds found by then.
+	Complete bool   `json:"complete"`
+	Error    string `json:"error,omitempty"`
+
+	// Versions are the latest builds of every minor series within the range, from the oldest one.
+	Versions []string `json:"versions"`
+
+	// Changed is true if a version behaves unlike the oldest one: its output matches the expectation
+	// while the oldest one does not, or vice versa.
+	Changed bool `json:"changed"`
+
+	// Before is the last version known to behave like the oldest one, After is the first version known to differ.
+	Before *BisectRunOutput `json:"before,omitempty"`
+	After  *BisectRunOutput `json:"after,omitempty"`
+
+	// Runs are the probed versions, from the oldest one.
+	Runs []BisectRunOutput `json:"runs"`
+}
+
+type BisectRunOutput struct {
+	Version    string `json:"version"`
+	QueryRunID string `json:"query_run_id"`
+	Output     string `json:"output"`
+	ExitCode   int    `json:"exit_code"`
+	Matches    bool   `json:"matches"`
+}
+
+// bisect runs the query across the versions of the range to find the first version where the output changes.
+// Progress is streamed as server-sent events if the client accepts them: a run event per probed version
+// and the result event at the end.
+func (h *bisectHandler) bisect(w http.ResponseWriter, r *http.Request) {
+	var input BisectInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versions, status, err := h.validate(&input)
+	if err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+
+	// Bisections run every version, so they are not served from the result cache.
+	if maintenance, ok := h.queries.maintenanceState(); ok {
+		writeMaintenance(w, maintenance)
+		return
+	}
+	if h.queries.drain.Draining() {
+		writeShuttingDown(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.cfg.Timeout)
+	defer cancel()
+
+	// The bisection outlives the write timeout of the server, it's bounded by its own timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(h.cfg.Timeout + bisectWriteGrace))
+
+	var stream *eventStream
+	if strings.Contains(r.Header.Get("Accept"), ContentTypeEventStream) {
+		stream = newEventStream(w, rc)
+	}
+
+	b := newBisection(versions, input.Search == BisectSearchLinear)
+	parallelism := h.cfg.Parallelism
+	if input.Parallelism > 0 && input.Parallelism < parallelism {
+		parallelism = input.Parallelism
+	}
+
+	// In the oldest mode, the expected output is known once the oldest version has been run.
+	expected := input.Expect.Output
+
+	var runErr error
+	for runs := uint(0); !b.done(); {
+		if ctx.Err() != nil {
+			runErr = ctx.Err()
+			break
+		}
+
+		batch := b.next(int(parallelism))
+		if runs+uint(len(batch)) > h.cfg.MaxRuns {
+			if remaining := int(h.cfg.MaxRuns - runs); remaining > 0 {
+				batch = batch[:remaining]
+			} else {
+				runErr = errors.Errorf("run limit (%d) has been reached", h.cfg.MaxRuns)
+				break
+			}
+		}
+
+		// Runs over the daily budget are dropped from the batch, the bisection stops after it.
+		prepaid := 0
+		if runs == 0 {
+			prepaid = 1
+		}
+		charged, quotaErr := h.chargeRuns(r, len(batch)-prepaid)
+		batch = batch[:prepaid+charged]
+		if len(batch) == 0 {
+			runErr = quotaErr
+			break
+		}
+		runs += uint(len(batch))
+
+		results, errs, err := h.runBatch(ctx, r, &input, versions, batch)
+		if err != nil {
+			runErr = err
+			break
+		}
+
+		// In the oldest mode, outputs cannot be compared if the oldest version has failed.
+		if input.Expect.Mode == BisectExpectOldest {
+			for i, idx := range batch {
+				if idx == 0 && errs[i] != nil {
+					runErr = errs[i]
+				}
+			}
+			if runErr != nil {
+				break
+			}
+		}
+
+		// The first failure stops the bisection, but results of the other runs of the batch are kept.
+		for i, res := range results {
+			if errs[i] != nil {
+				if runErr == nil {
+					runErr = errs[i]
+				}
+				continue
+			}
+
+			if batch[i] == 0 && input.Expect.Mode == BisectExpectOldest {
+				expected = res.Output
+			}
+			res.Matches = sameOutput(res.Output, expected)
+
+			b.record(batch[i], res)
+			if stream != nil {
+				stream.send("run", res)
+			}
+		}
+		if runErr == nil {
+			runErr = quotaErr
+		}
+		if runErr != nil {
+			break
+		}
+	}
+
+	output := b.output()
+	if runErr != nil {
+		output.Error = bisectErrorMessage(ctx, runErr)
+		zlog.Info().Err(runErr).Str("from", input.From).Str("to", input.To).Msg("bisection has been stopped early")
+	}
+
+	if stream != nil {
+		stream.send("result", output)
+		return
+	}
+
+	writeResult(w, output)
+}
+
+// sameOutput compares outputs ignoring trailing line breaks, so expected outputs can be passed without them.
+func sameOutput(a, b string) bool {
+	return strings.TrimRight(a, "\r\n") == strings.TrimRight(b, "\r\n")
+}
+
+// validate checks the input and returns the versions of the range. It returns an http status code
+// describing the failure if the input is not valid.
+func (h *bisectHandler) validate(input *BisectInput) ([]string, int, error) {
+	if input.Query == "" {
+		return nil, http.StatusBadRequest, errors.New("query cannot be empty")
+	}
+	if uint64(len(input.Query)) > h.queries.maxQueryLength {
+		return nil, http.StatusBadRequest, errors.Errorf("query length (%d) cannot exceed %d", len(input.Query), h.queries.maxQueryLength)
+	}
+	if h.queries.policy != nil {
+		err := h.queries.policy.Check(input.Query)
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+	}
+
+	switch input.Expect.Mode {
+	case BisectExpectExact:
+	case BisectExpectOldest:
+		if input.Expect.Output != "" {
+			return nil, http.StatusBadRequest, errors.New("expected output cannot be set with the oldest mode")
+		}
+	default:
+		return nil, http.StatusBadRequest, errors.Errorf("unknown expectation mode %s (allowed: %s, %s)", input.Expect.Mode, BisectExpectExact, BisectExpectOldest)
+	}
+
+	if input.Search == "" {
+		input.Search = BisectSearchBinary
+	}
+	if input.Search != BisectSearchBinary && input.Search != BisectSearchLinear {
+		return nil, http.StatusBadRequest, errors.Errorf("unknown search %s (allowed: %s, %s)", input.Search, BisectSearchBinary, BisectSearchLinear)
+	}
+
+	if input.From == "" || input.To == "" {
+		return nil, http.StatusBadRequest, errors.New("from and to versions are required")
+	}
+
+	versions := bisectVersions(h.queries.tagStorage.GetAll(), input.From, input.To, func(tag string) bool {
+		deprecation, deprecated := h.queries.tagStorage.Deprecation(tag)
+		return deprecated && deprecation.Rejected
+	})
+	if len(versions) < 2 {
+		return nil, http.StatusBadRequest, errors.Errorf("range from %s to %s must have at least 2 versions, %d found", input.From, input.To, len(versions))
+	}
+	if input.Search == BisectSearchLinear && uint(len(versions)) > h.cfg.MaxRuns {
+		return nil, http.StatusBadRequest, errors.Errorf("range has %d versions, linear search is limited to %d runs, use binary search or a shorter range",
+			len(versions), h.cfg.MaxRuns)
+	}
+
+	return versions, http.StatusOK, nil
+}
+
+// bisectVersions returns the latest builds of every minor series within the range, from the oldest one.
+func bisectVersions(images []dockertag.Image, from, to string, rejected func(tag string) bool) []string {
+	latest := make(map[string]string)
+	for _, img := range images {
+		parsed := chsemver.Parse(img.Tag)
+		if img.Rolling || len(parsed) < 2 || !chsemver.IsNumeric(parsed) {
+			continue
+		}
+		if !chsemver.InRange(img.Tag, from, to) || rejected(img.Tag) {
+			continue
+		}
+
+		series := chsemver.Series(img.Tag)
+		if current, ok := latest[series]; !ok || chsemver.IsGreater(parsed, chsemver.Parse(current)) {
+			latest[series] = img.Tag
+		}
+	}
+
+	versions := make([]string, 0, len(latest))
+	for _, tag := range latest {
+		versions = append(versions, tag)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return chsemver.IsGreater(chsemver.Parse(versions[j]), chsemver.Parse(versions[i]))
+	})
+
+	return versions
+}
+
+// runBatch runs the versions at once. Results and errors of the runs are returned in the order of the batch,
+// the error is set for every failed run. It fails only if the runs cannot be created.
+func (h *bisectHandler) runBatch(ctx context.Context, r *http.Request, input *BisectInput, versions []string, batch []int) ([]BisectRunOutput, []error, error) {
+	// Runs are created one by one, as the first one takes the request id.
+	runs := make([]*queryrun.Run, len(batch))
+	for i, idx := range batch {
+		req := RunQueryInput{
+			Query:    input.Query,
+			Version:  versions[idx],
+			Database: input.Database,
+			Format:   input.Format,
+			Strict:   true,
+		}
+
+		run, err := h.queries.newRun(r, &req)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "run of %s cannot be created", versions[idx])
+		}
+		runs[i] = run
+	}
+
+	results := make([]BisectRunOutput, len(batch))
+	errs := make([]error, len(batch))
+
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = h.runVersion(ctx, r, runs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = errors.Wrapf(err, "run of %s failed", runs[i].Version)
+		}
+	}
+
+	return results, errs, nil
+}
+
+// chargeRuns counts n runs against the daily budget of the client. It returns how many of them fit into the budget,
+// and the error once the budget is exhausted.
+func (h *bisectHandler) chargeRuns(r *http.Request, n int) (int, error) {
+	if h.queries.quota == nil {
+		return n, nil
+	}
+
+	for i := 0; i < n; i++ {
+		err := h.queries.quota.takeRun(r)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return n, nil
+}
+
+var errBisectClientLimit = errors.New("too many runs of the client are in progress")
+
+// runVersion executes the run or takes its result from the cache. Executed runs are saved like other runs.
+func (h *bisectHandler) runVersion(ctx context.Context, r *http.Request, run *queryrun.Run) (BisectRunOutput, error) {
+	q := h.queries
+	result := BisectRunOutput{Version: run.Version}
+
+	cacheKey, cacheable := q.resultCacheKey(&RunQueryInput{Query: run.Input, Database: run.Database, Version: run.Version}, run.Settings)
+	if cacheable {
+		if entry, found := q.resultCache.Get(cacheKey); found {
+			result.QueryRunID = entry.RunID
+			result.Output = entry.Output
+			result.ExitCode = entry.ExitCode
+
+			return result, nil
+		}
+	}
+
+	if q.runLimiter != nil {
+		release, _, ok := q.runLimiter.acquire(r)
+		if !ok {
+			return result, errBisectClientLimit
+		}
+		defer release()
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, run.Deadlines.RunTimeout)
+	defer cancel()
+
+	q.inflight.add(run)
+	defer q.inflight.remove(run)
+
+	startedAt := time.Now()
+	res, err := q.r.RunQuery(runCtx, run)
+	if err != nil {
+		return result, err
+	}
+
+	if q.outputProcessor != nil {
+		res, err = q.processOutput(run, res)
+		if err != nil {
+			return result, errors.Wrap(err, "output cannot be processed")
+		}
+	}
+
+	run.Output = res.Output()
+	if uint64(len(run.Output)) > q.maxOutputLength {
+		return result, errors.Errorf("output length (%d) cannot exceed %d", len(run.Output), q.maxOutputLength)
+	}
+	run.Stderr = res.Stderr
+	run.ExitCode = res.ExitCode
+	run.ExecutionTime = time.Since(startedAt)
+	run.Stages = run.Timeline.Stages()
+	run.SetupTime, run.QueryTime = queryrun.SplitDurations(run.Stages)
+
+	if q.runRepo != nil {
+		err = q.runRepo.Create(ctx, run)
+		if err != nil {
+			zlog.Error().Err(err).Str("id", run.ID).Msg("a bisection run cannot be saved")
+			return result, errors.Wrap(err, "run cannot be saved")
+		}
+	}
+
+	if cacheable {
+		q.putResult(cacheKey, run)
+	}
+
+	result.QueryRunID = run.ID
+	result.Output = run.Output
+	result.ExitCode = run.ExitCode
+
+	return result, nil
+}
+
+func bisectErrorMessage(ctx context.Context, err error) string {
+	var oomErr *qrunner.MemoryLimitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "bisection deadline has been reached"
+	case errors.Is(err, context.Canceled):
+		return "client has disconnected"
+	case errors.Is(err, errBisectClientLimit):
+		return errBisectClientLimit.Error()
+	case errors.Is(err, qrunner.ErrNoAvailableRunners):
+		return qrunner.ErrNoAvailableRunners.Error()
+	case errors.As(err, &oomErr):
+		return oomErr.Error()
+	default:
+		return err.Error()
+	}
+}
+
+// bisection keeps the state of the search over versions ordered from the oldest one.
+// The oldest version is the baseline: other versions either behave like it or differ.
+type bisection struct {
+	versions []string
+	linear   bool
+
+	probes map[int]BisectRunOutput
+
+	// lo is the last version known to behave like the oldest one. hi is the first version known to differ,
+	// it's len(versions) if no such version is known.
+	lo, hi int
+}
+
+func newBisection(versions []string, linear bool) *bisection {
+	return &bisection{
+		versions: versions,
+		linear:   linear,
+		probes:   make(map[int]BisectRunOutput),
+		hi:       len(versions),
+	}
+}
+
+func (b *bisection) baselineKnown() bool {
+	_, ok := b.probes[0]
+	return ok
+}
+
+// done reports whether the change has been found or the range has no change.
+func (b *bisection) done() bool {
+	if !b.baselineKnown() {
+		return false
+	}
+
+	if b.hi < len(b.versions) {
+		return b.hi-b.lo == 1
+	}
+
+	return b.lo == len(b.versions)-1
+}
+
+// next returns indexes of at most n versions to probe next.
+func (b *bisection) next(n int) []int {
+	if n < 1 {
+		n = 1
+	}
+
+	if !b.baselineKnown() {
+		return []int{0}
+	}
+
+	var batch []int
+	add := func(idx int) {
+		if _, probed := b.probes[idx]; probed || idx <= b.lo || idx >= b.hi {
+			return
+		}
+		if len(batch) > 0 && batch[len(batch)-1] == idx {
+			return
+		}
+		batch = append(batch, idx)
+	}
+
+	switch {
+	case b.linear:
+		for idx := b.lo + 1; idx < b.hi && len(batch) < n; idx++ {
+			add(idx)
+		}
+
+	case b.hi == len(b.versions):
+		// The newest version is probed first, so a range without changes is told in one step.
+		last := len(b.versions) - 1
+		for k := 1; k <= n; k++ {
+			add(b.lo + (k*(last-b.lo)+n-1)/n)
+		}
+
+	default:
+		for k := 1; k <= n; k++ {
+			add(b.lo + k*(b.hi-b.lo)/(n+1))
+		}
+	}
+
+	return batch
+}
+
+// record applies the result of a probed version to the bounds.
+func (b *bisection) record(idx int, res BisectRunOutput) {
+	b.probes[idx] = res
+
+	baseline := b.probes[0].Matches
+	b.hi = len(b.versions)
+	for i := range b.versions {
+		if p, ok := b.probes[i]; ok && p.Matches != baseline {
+			b.hi = i
+			break
+		}
+	}
+
+	b.lo = 0
+	for i := 0; i < b.hi; i++ {
+		if _, ok := b.probes[i]; ok {
+			b.lo = i
+		}
+	}
+}
+
+func (b *bisection) output() BisectOutput {
+	output := BisectOutput{
+		Complete: b.done(),
+		Versions: b.versions,
+		Runs:     make([]BisectRunOutput, 0, len(b.probes)),
+	}
+
+	for i := range b.versions {
+		if p, ok := b.probes[i]; ok {
+			output.Runs = append(output.Runs, p)
+		}
+	}
+
+	if before, ok := b.probes[b.lo]; ok {
+		output.Before = &before
+	}
+	if after, ok := b.probes[b.hi]; ok {
+		output.After = &after
+		output.Changed = true
+	}
+
+	return output
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newEventStream(w http.ResponseWriter, rc *http.ResponseController) *eventStream {
+	w.Header().Set("Content-Type", ContentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	return &eventStream{w: w, rc: rc}
+}
+
+func (s *eventStream) send(event string, data interface{}) {
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		zlog.Error().Err(err).Str("event", event).Msg("event encoding failed")
+		return
+	}
+
+	_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, serialized)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	if err != nil {
+		zlog.Debug().Err(err).Str("event", event).Msg("event cannot be sent")
+	}
+}
@@ -0,0 +1,258 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBisectVersions(t *testing.T) {
+	images := []dockertag.Image{
+		{Tag: "head", Rolling: true},
+		{Tag: "latest"},
+		{Tag: "22.8.5.29"},
+		{Tag: "22.6.9.11"},
+		{Tag: "22.6.1.1985"},
+		{Tag: "22.3.19.6"},
+		{Tag: "22.3.19.6-alpine"},
+		{Tag: "22.1.4.30"},
+		{Tag: "21.12.4.1"},
+		{Tag: "21.8.15.7"},
+		{Tag: "21.7.11.3"},
+		{Tag: "22"},
+	}
+	rejected := func(tag string) bool {
+		return tag == "22.1.4.30"
+	}
+
+	versions := bisectVersions(images, "21.8", "22.6", rejected)
+	assert.Equal(t, []string{"21.8.15.7", "21.12.4.1", "22.3.19.6", "22.6.9.11"}, versions)
+}
+
+func TestBisection(t *testing.T) {
+	versions := make([]string, 20)
+	for i := range versions {
+		versions[i] = strings.Repeat("v", i+1)
+	}
+
+	tests := []struct {
+		name        string
+		linear      bool
+		parallelism int
+		changedAt   int
+		maxRuns     int
+	}{
+		{name: "binary", parallelism: 1, changedAt: 13, maxRuns: 7},
+		{name: "binary parallel", parallelism: 3, changedAt: 5, maxRuns: 9},
+		{name: "binary newest", parallelism: 1, changedAt: 19, maxRuns: 7},
+		{name: "binary without change", parallelism: 1, changedAt: -1, maxRuns: 2},
+		{name: "linear", linear: true, parallelism: 2, changedAt: 7, maxRuns: 9},
+		{name: "linear without change", linear: true, parallelism: 4, changedAt: -1, maxRuns: 20},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBisection(versions, tt.linear)
+
+			runs := 0
+			for !b.done() {
+				batch := b.next(tt.parallelism)
+				require.NotEmpty(t, batch)
+				require.LessOrEqual(t, len(batch), tt.parallelism)
+
+				for _, idx := range batch {
+					runs++
+					b.record(idx, BisectRunOutput{Version: versions[idx], Matches: tt.changedAt == -1 || idx < tt.changedAt})
+				}
+			}
+			assert.LessOrEqual(t, runs, tt.maxRuns)
+
+			output := b.output()
+			assert.True(t, output.Complete)
+			if tt.changedAt == -1 {
+				assert.False(t, output.Changed)
+				assert.Nil(t, output.After)
+
+				return
+			}
+
+			assert.True(t, output.Changed)
+			require.NotNil(t, output.Before)
+			require.NotNil(t, output.After)
+			assert.Equal(t, versions[tt.changedAt-1], output.Before.Version)
+			assert.Equal(t, versions[tt.changedAt], output.After.Version)
+		})
+	}
+}
+
+type seriesTagStorage struct {
+	staticTagStorage
+}
+
+func (seriesTagStorage) GetAll() []dockertag.Image {
+	return []dockertag.Image{
+		{Tag: "22.6.9.11"}, {Tag: "22.3.19.6"}, {Tag: "22.1.4.30"}, {Tag: "21.12.4.1"}, {Tag: "21.8.15.7"},
+	}
+}
+
+func (seriesTagStorage) Find(tag string) (dockertag.Image, bool) {
+	return dockertag.Image{Tag: tag}, true
+}
+
+func TestBisect(t *testing.T) {
+	runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+		if run.Version >= "22.3" {
+			return "2\n", nil
+		}
+
+		return "1\n", nil
+	}}
+
+	newRequest := func(body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/api/bisect", strings.NewReader(body))
+	}
+
+	queries := newQueryHandler(runner, nil, seriesTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+	h := newBisectHandler(queries, BisectConfig{MaxRuns: 10, Parallelism: 2, Timeout: time.Minute})
+
+	t.Run("exact", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.bisect(rec, newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "exact", "output": "1"}}`))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Result BisectOutput `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+		output := resp.Result
+		assert.True(t, output.Complete)
+		assert.True(t, output.Changed)
+		assert.Equal(t, []string{"21.8.15.7", "21.12.4.1", "22.1.4.30", "22.3.19.6", "22.6.9.11"}, output.Versions)
+		require.NotNil(t, output.Before)
+		require.NotNil(t, output.After)
+		assert.Equal(t, "22.1.4.30", output.Before.Version)
+		assert.Equal(t, "1\n", output.Before.Output)
+		assert.Equal(t, "22.3.19.6", output.After.Version)
+		assert.Equal(t, "2\n", output.After.Output)
+		assert.False(t, output.After.Matches)
+	})
+
+	t.Run("event stream", func(t *testing.T) {
+		req := newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "oldest"}, "search": "linear", "parallelism": 1}`)
+		req.Header.Set("Accept", ContentTypeEventStream)
+
+		rec := httptest.NewRecorder()
+		h.bisect(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, ContentTypeEventStream, rec.Header().Get("Content-Type"))
+
+		body := rec.Body.String()
+		assert.Equal(t, 4, strings.Count(body, "event: run\n"), "versions are run until the output changes")
+		assert.Equal(t, 1, strings.Count(body, "event: result\n"))
+		assert.Contains(t, body, `"after":{"version":"22.3.19.6"`)
+	})
+
+	t.Run("linear range over the run limit", func(t *testing.T) {
+		limited := newBisectHandler(queries, BisectConfig{MaxRuns: 3, Parallelism: 1, Timeout: time.Minute})
+
+		rec := httptest.NewRecorder()
+		limited.bisect(rec, newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "oldest"}, "search": "linear"}`))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("partial result", func(t *testing.T) {
+		limited := newBisectHandler(queries, BisectConfig{MaxRuns: 2, Parallelism: 1, Timeout: time.Minute})
+
+		rec := httptest.NewRecorder()
+		limited.bisect(rec, newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "oldest"}}`))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Result BisectOutput `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+		output := resp.Result
+		assert.False(t, output.Complete)
+		assert.Contains(t, output.Error, "run limit")
+		assert.Len(t, output.Runs, 2)
+		require.NotNil(t, output.After)
+		assert.Equal(t, "22.6.9.11", output.After.Version, "the newest version bounds the change")
+	})
+
+	t.Run("failed run", func(t *testing.T) {
+		failing := funcRunner{run: func(run *queryrun.Run) (string, error) {
+			switch {
+			case run.Version == "22.1.4.30":
+				return "", errors.New("container run failed")
+			case run.Version >= "22.3":
+				return "2\n", nil
+			}
+
+			return "1\n", nil
+		}}
+		queries := newQueryHandler(failing, nil, seriesTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+		h := newBisectHandler(queries, BisectConfig{MaxRuns: 10, Parallelism: 2, Timeout: time.Minute})
+
+		rec := httptest.NewRecorder()
+		h.bisect(rec, newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "exact", "output": "1"}}`))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Result BisectOutput `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+		output := resp.Result
+		assert.False(t, output.Complete)
+		assert.Contains(t, output.Error, "run of 22.1.4.30 failed")
+
+		// The newest version has been run in the same batch as the failed one.
+		require.Len(t, output.Runs, 2)
+		assert.Equal(t, "21.8.15.7", output.Runs[0].Version)
+		assert.Equal(t, "22.6.9.11", output.Runs[1].Version)
+		assert.Equal(t, "2\n", output.Runs[1].Output)
+	})
+
+	t.Run("daily runs", func(t *testing.T) {
+		quota, err := NewQuota(QuotaConfig{DailyRuns: 3}, NewMemoryQuotaStore())
+		require.NoError(t, err)
+
+		queries := newQueryHandler(runner, nil, seriesTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+		queries.quota = quota
+		router := chi.NewRouter()
+		router.Route("/api", newBisectHandler(queries, BisectConfig{MaxRuns: 10, Parallelism: 2, Timeout: time.Minute}).handle)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "exact", "output": "1"}}`))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Result BisectOutput `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+		// Every probed version is charged, the bisection stops once the budget is exhausted.
+		output := resp.Result
+		assert.False(t, output.Complete)
+		assert.Contains(t, output.Error, "daily limit of 3 runs")
+		assert.Len(t, output.Runs, 3)
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, newRequest(`{"query": "SELECT 1", "from": "21.8", "to": "22.6", "expect": {"mode": "exact", "output": "1"}}`))
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	})
+}
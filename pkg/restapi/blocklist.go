@@ -0,0 +1,219 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"clickhouse-playground/internal/blocklist"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// ReasonClientBlocked distinguishes requests of blocked clients from other 403 errors.
+const ReasonClientBlocked = "client_blocked"
+
+// DefaultBlockedMessage is returned to blocked clients if the deployment has not set its own message.
+const DefaultBlockedMessage = "access has been blocked"
+
+// blockListMiddleware rejects requests of blocked clients before they reach any handler.
+// Clients are matched by the hash of the presented API key, even if the key is not valid, and by the address.
+func blockListMiddleware(list BlockList, message string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var keyHash string
+			if key := requestAPIKey(r); key != "" {
+				keyHash = blocklist.HashKey(key)
+			}
+
+			entry, blocked := list.Match(keyHash, net.ParseIP(clientID(r)))
+			if !blocked {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			zlog.Info().
+				Bool("audit", true).
+				Str("entry_id", entry.ID).
+				Str("kind", string(entry.Kind)).
+				Str("client", clientID(r)).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Msg("request of a blocked client has been rejected")
+
+			writeErrorResponse(w, &ErrorResponse{
+				Message: message,
+				Code:    http.StatusForbidden,
+				Reason:  ReasonClientBlocked,
+			})
+		})
+	}
+}
+
+type blockListHandler struct {
+	blockList BlockList
+}
+
+func newBlockListHandler(list BlockList) *blockListHandler {
+	return &blockListHandler{blockList: list}
+}
+
+func (h *blockListHandler) handle(r chi.Router) {
+	r.Get("/blocklist", h.list)
+	r.Post("/blocklist", h.add)
+	r.Delete("/blocklist/{id}", h.remove)
+}
+
+type BlockListEntryOutput struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason,omitempty"`
+
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	RemovedAt     *time.Time `json:"removed_at,omitempty"`
+	RemovalReason string     `json:"removal_reason,omitempty"`
+	Active        bool       `json:"active"`
+
+	// Hits are counted since the start of the instance serving the request.
+	Hits      uint64     `json:"hits"`
+	LastHitAt *time.Time `json:"last_hit_at,omitempty"`
+}
+
+type ListBlockListOutput struct {
+	Entries []BlockListEntryOutput `json:"entries"`
+}
+
+func newBlockListEntryOutput(s blocklist.Status, now time.Time) BlockListEntryOutput {
+	output := BlockListEntryOutput{
+		ID:            s.ID,
+		Kind:          string(s.Kind),
+		Value:         s.Value,
+		Reason:        s.Reason,
+		CreatedAt:     s.CreatedAt,
+		ExpiresAt:     s.ExpiresAt,
+		RemovedAt:     s.RemovedAt,
+		RemovalReason: s.RemovalReason,
+		Active:        s.Active(now),
+		Hits:          s.Count,
+	}
+	if !s.LastHitAt.IsZero() {
+		lastHitAt := s.LastHitAt
+		output.LastHitAt = &lastHitAt
+	}
+
+	return output
+}
+
+// list returns the active entries with their hits. Removed and expired entries are included with all=true.
+func (h *blockListHandler) list(w http.ResponseWriter, r *http.Request) {
+	statuses := h.blockList.Entries(r.URL.Query().Get("all") == "true")
+
+	now := time.Now()
+	output := ListBlockListOutput{Entries: make([]BlockListEntryOutput, 0, len(statuses))}
+	for _, s := range statuses {
+		output.Entries = append(output.Entries, newBlockListEntryOutput(s, now))
+	}
+
+	writeResult(w, output)
+}
+
+type AddBlockListEntryInput struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+
+	// ExpiresAt and TTL are mutually exclusive. The entry never expires if neither is set.
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+}
+
+// add blocks clients matching the new entry. It takes effect on this instance right away,
+// other instances pick it up on the next refresh.
+func (h *blockListHandler) add(w http.ResponseWriter, r *http.Request) {
+	var input AddBlockListEntryInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry := blocklist.Entry{
+		Kind:      blocklist.Kind(input.Kind),
+		Value:     input.Value,
+		Reason:    input.Reason,
+		ExpiresAt: input.ExpiresAt,
+	}
+	if input.TTL != "" {
+		if input.ExpiresAt != nil {
+			writeError(w, "expires_at and ttl cannot be set together", http.StatusBadRequest)
+			return
+		}
+
+		ttl, err := time.ParseDuration(input.TTL)
+		if err != nil || ttl <= 0 {
+			writeError(w, "ttl must be a positive duration, e.g. 24h", http.StatusBadRequest)
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl).UTC()
+		entry.ExpiresAt = &expiresAt
+	}
+
+	entry, err = h.blockList.Add(r.Context(), entry)
+	if errors.Is(err, blocklist.ErrInvalidEntry) {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to add a block list entry")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	zlog.Info().
+		Bool("audit", true).
+		Str("entry_id", entry.ID).
+		Str("kind", string(entry.Kind)).
+		Str("value", entry.Value).
+		Str("reason", entry.Reason).
+		Str("client", clientID(r)).
+		Msg("block list entry has been added")
+
+	w.WriteHeader(http.StatusCreated)
+	writeResult(w, newBlockListEntryOutput(blocklist.Status{Entry: entry}, time.Now()))
+}
+
+// remove unblocks clients matched by the entry. The entry is kept in the list as removed for the audit trail.
+func (h *blockListHandler) remove(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	reason := r.URL.Query().Get("reason")
+
+	entry, err := h.blockList.Remove(r.Context(), id, reason)
+	if errors.Is(err, blocklist.ErrNotFound) {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("entry_id", id).Msg("failed to remove a block list entry")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	zlog.Info().
+		Bool("audit", true).
+		Str("entry_id", entry.ID).
+		Str("kind", string(entry.Kind)).
+		Str("value", entry.Value).
+		Str("reason", reason).
+		Str("client", clientID(r)).
+		Msg("block list entry has been removed")
+
+	writeResult(w, newBlockListEntryOutput(blocklist.Status{Entry: entry}, time.Now()))
+}
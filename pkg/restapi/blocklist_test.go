@@ -0,0 +1,72 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"clickhouse-playground/internal/blocklist"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockListMiddleware(t *testing.T) {
+	ctx := context.Background()
+	list := blocklist.New(ctx, zerolog.Nop(), blocklist.Config{}, blocklist.NewMemoryStore())
+	_, err := list.Add(ctx, blocklist.Entry{Kind: blocklist.KindCIDR, Value: "203.0.113.0/24"})
+	require.NoError(t, err)
+	_, err = list.Add(ctx, blocklist.Entry{Kind: blocklist.KindKeyHash, Value: blocklist.HashKey("leaked")})
+	require.NoError(t, err)
+
+	reached := false
+	handler := blockListMiddleware(list, "go away")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name    string
+		addr    string
+		key     string
+		blocked bool
+	}{
+		{name: "blocked network", addr: "203.0.113.7:5000", blocked: true},
+		{name: "blocked key", addr: "198.51.100.1:5000", key: "leaked", blocked: true},
+		{name: "allowed", addr: "198.51.100.1:5000", key: "valid"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+
+			req := httptest.NewRequest(http.MethodPost, "/api/runs", nil)
+			req.RemoteAddr = tt.addr
+			if tt.key != "" {
+				req.Header.Set(HeaderAPIKey, tt.key)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if !tt.blocked {
+				assert.True(t, reached)
+				assert.Equal(t, http.StatusNoContent, rec.Code)
+
+				return
+			}
+
+			assert.False(t, reached, "blocked requests must not reach handlers")
+			require.Equal(t, http.StatusForbidden, rec.Code)
+
+			var resp Response
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, "go away", resp.Error.Message)
+			assert.Equal(t, ReasonClientBlocked, resp.Error.Reason)
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package restapi
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// bundleUserFilesDir is the directory of the bundle with the files of the run.
+const bundleUserFilesDir = "user_files/"
+
+// defaultBundleRepository is used in the reproduction script of runs saved before image repositories were recorded.
+const defaultBundleRepository = "clickhouse/clickhouse-server"
+
+// BundleMetadata is metadata.json of the reproduction bundle.
+type BundleMetadata struct {
+	QueryRunID       string            `json:"query_run_id"`
+	Digest           string            `json:"digest"`
+	CreatedAt        time.Time         `json:"created_at"`
+	Database         string            `json:"database"`
+	Version          string            `json:"version"`
+	RequestedVersion string            `json:"requested_version,omitempty"`
+	ServerVersion    string            `json:"server_version,omitempty"`
+	Image            string            `json:"image"`
+	ImageDigest      string            `json:"image_digest,omitempty"`
+	Profile          string            `json:"profile,omitempty"`
+	Tool             string            `json:"tool,omitempty"`
+	ToolParams       map[string]string `json:"tool_params,omitempty"`
+	Network          string            `json:"network,omitempty"`
+	ParentRunID      string            `json:"parent_run_id,omitempty"`
+	Stages           []StageOutput     `json:"stages,omitempty"`
+	SetupMs          int64             `json:"setup_ms"`
+	QueryMs          int64             `json:"query_ms"`
+	ExecutionMs      int64             `json:"execution_ms"`
+	ExitCode         int               `json:"exit_code"`
+
+	// OutputTruncated is true if output.txt has been cut by the output length limit.
+	OutputTruncated bool `json:"output_truncated,omitempty"`
+
+	// Playground is the build of the server that has generated the bundle.
+	Playground string `json:"playground"`
+}
+
+// getBundle streams a tar.gz with everything needed to reproduce the run locally: the query, the settings,
+// the metadata and a script running the query on the same image digest. Edit tokens, container snapshots
+// and client addresses are never included.
+func (h *queryHandler) getBundle(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	run, err := h.runRepo.Get(r.Context(), id)
+	if errors.Is(err, queryrun.ErrNotFound) {
+		h.writeRunNotFound(w, id)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if run.Deleted() {
+		writeDeleted(w, run)
+		return
+	}
+	if run.Failed() {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="run-%s.tar.gz"`, run.ID))
+	w.Header().Set("ETag", runETag(run, "bundle"))
+	w.Header().Set("Cache-Control", outputCacheControl(run, time.Now()))
+
+	// The archive is written right to the response, so the status cannot be changed once it has started.
+	err = writeBundle(w, run, h.maxOutputLength)
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to write run bundle")
+	}
+}
+
+func writeBundle(w http.ResponseWriter, run *queryrun.Run, maxOutputLength uint64) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	dir := "run-" + run.ID + "/"
+	modTime := run.CreatedAt
+
+	output := run.Stdout()
+	truncated := uint64(len(output)) > maxOutputLength
+	if truncated {
+		output = output[:maxOutputLength]
+	}
+
+	metadata, err := json.MarshalIndent(newBundleMetadata(run, truncated), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal metadata")
+	}
+
+	settings, err := json.MarshalIndent(bundleSettings(run), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal settings")
+	}
+
+	files := []struct {
+		name    string
+		mode    int64
+		content string
+	}{
+		{name: bundleInputName(run), mode: 0o644, content: run.Input},
+		{name: "settings.json", mode: 0o644, content: string(settings)},
+		{name: "metadata.json", mode: 0o644, content: string(metadata)},
+		{name: "output.txt", mode: 0o644, content: output},
+		{name: "stderr.txt", mode: 0o644, content: run.Stderr},
+	}
+	if run.Tool == "" {
+		files = append(files, struct {
+			name    string
+			mode    int64
+			content string
+		}{name: "docker-run.sh", mode: 0o755, content: reproductionScript(run)})
+	}
+	for _, f := range run.Files {
+		files = append(files, struct {
+			name    string
+			mode    int64
+			content string
+		}{name: bundleUserFilesDir + f.Name, mode: 0o444, content: string(f.Content)})
+	}
+
+	for _, f := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    dir + f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.content)),
+			ModTime: modTime,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to write %s header", f.name)
+		}
+
+		_, err = tw.Write([]byte(f.content))
+		if err != nil {
+			return errors.Wrapf(err, "failed to write %s", f.name)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close tar")
+	}
+
+	return gz.Close()
+}
+
+// bundleSettings returns the run settings in the request format, so they can be sent to POST /api/runs as is.
+func bundleSettings(run *queryrun.Run) RunSettings {
+	var settings RunSettings
+	if chSettings, ok := run.Settings.(*runsettings.ClickHouseSettings); ok {
+		settings.ClickHouseSettings = &ClickHouseSettings{OutputFormat: chSettings.OutputFormat}
+	}
+
+	return settings
+}
+
+// bundleInputName returns query.sql for queries. Tool runs pass the input to the tool, so it's kept as is.
+func bundleInputName(run *queryrun.Run) string {
+	if run.Tool != "" {
+		return "input.txt"
+	}
+
+	return "query.sql"
+}
+
+func newBundleMetadata(run *queryrun.Run, outputTruncated bool) BundleMetadata {
+	stages := make([]StageOutput, 0, len(run.Stages))
+	for _, s := range run.Stages {
+		stages = append(stages, newStageOutput(s))
+	}
+
+	return BundleMetadata{
+		QueryRunID:       run.ID,
+		Digest:           run.Digest(),
+		CreatedAt:        run.CreatedAt,
+		Database:         run.Database,
+		Version:          run.Version,
+		RequestedVersion: run.RequestedVersion,
+		ServerVersion:    run.ServerVersion,
+		Image:            bundleImage(run),
+		ImageDigest:      run.ImageDigest,
+		Profile:          run.ExecutionProfile,
+		Tool:             run.Tool,
+		ToolParams:       run.ToolParams,
+		Network:          run.Network,
+		ParentRunID:      run.ParentID,
+		Stages:           stages,
+		SetupMs:          run.SetupTime.Milliseconds(),
+		QueryMs:          run.QueryTime.Milliseconds(),
+		ExecutionMs:      run.ExecutionTime.Milliseconds(),
+		ExitCode:         run.ExitCode,
+		OutputTruncated:  outputTruncated,
+		Playground:       playgroundBuild(),
+	}
+}
+
+// bundleImage returns the image reference pinned by digest if it's known, so the run is reproduced
+// on the same build even if the tag has been re-pushed since.
+func bundleImage(run *queryrun.Run) string {
+	repository := run.ImageRepository
+	if repository == "" {
+		repository = defaultBundleRepository
+	}
+	if run.ImageDigest != "" {
+		return repository + "@" + run.ImageDigest
+	}
+
+	return repository + ":" + run.Version
+}
+
+// reproductionScript starts the server of the run version and executes query.sql with the same output settings.
+func reproductionScript(run *queryrun.Run) string {
+	var args []string
+	if s, ok := run.Settings.(*runsettings.ClickHouseSettings); ok && s.OutputFormat != "" {
+		args = append(args, "--format", shellQuote(s.OutputFormat))
+	}
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Reproduces run %s on ClickHouse %s.\n", run.ID, run.Version)
+	b.WriteString("set -eu\n\n")
+	b.WriteString("cd \"$(dirname \"$0\")\"\n\n")
+	fmt.Fprintf(&b, "IMAGE=%s\n", shellQuote(bundleImage(run)))
+	fmt.Fprintf(&b, "CONTAINER=%s\n\n", shellQuote("chp-repro-"+run.ID))
+	if len(run.Files) > 0 {
+		// The files of the run are mounted where the playground places them.
+		b.WriteString("docker run -d --name \"$CONTAINER\" -v \"$(pwd)/user_files:/var/lib/clickhouse/user_files:ro\" \"$IMAGE\" >/dev/null\n")
+	} else {
+		b.WriteString("docker run -d --name \"$CONTAINER\" \"$IMAGE\" >/dev/null\n")
+	}
+	b.WriteString("trap 'docker rm -f \"$CONTAINER\" >/dev/null' EXIT\n\n")
+	b.WriteString("until docker exec \"$CONTAINER\" clickhouse client --query 'SELECT 1' >/dev/null 2>&1; do\n")
+	b.WriteString("  sleep 0.5\n")
+	b.WriteString("done\n\n")
+	fmt.Fprintf(&b, "docker exec -i \"$CONTAINER\" clickhouse client -n -m %s< query.sql\n", strings.Join(append(args, ""), " "))
+
+	return b.String()
+}
+
+// shellQuote quotes the value for POSIX shells.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// playgroundBuild describes the server build from the embedded build info.
+func playgroundBuild() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	settings := make(map[string]string, len(info.Settings))
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+
+	parts := []string{info.Main.Path, info.Main.Version}
+	if revision := settings["vcs.revision"]; revision != "" {
+		parts = append(parts, revision)
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,98 @@
+package restapi
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readBundle(t *testing.T, body io.Reader) map[string]string {
+	gz, err := gzip.NewReader(body)
+	require.NoError(t, err)
+
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[path.Base(header.Name)] = string(content)
+	}
+
+	return files
+}
+
+func TestWriteBundle(t *testing.T) {
+	run := &queryrun.Run{
+		ID:              "abc",
+		Database:        "clickhouse",
+		Version:         "23.3",
+		ImageRepository: "clickhouse/clickhouse-server",
+		ImageDigest:     "sha256:0123",
+		Input:           "SELECT 1",
+		Output:          "1234567890",
+		Settings:        &runsettings.ClickHouseSettings{OutputFormat: "JSON"},
+		CreatedAt:       time.Now(),
+	}
+	run.GenerateEditToken()
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, writeBundle(rec, run, 4))
+
+	files := readBundle(t, rec.Body)
+	assert.Equal(t, "SELECT 1", files["query.sql"])
+	assert.Equal(t, "1234", files["output.txt"], "output is cut by the limit")
+	assert.JSONEq(t, `{"clickhouse": {"output_format": "JSON"}}`, files["settings.json"])
+	assert.Contains(t, files["docker-run.sh"], "IMAGE='clickhouse/clickhouse-server@sha256:0123'")
+	assert.Contains(t, files["docker-run.sh"], "--format 'JSON'")
+
+	var metadata BundleMetadata
+	require.NoError(t, json.Unmarshal([]byte(files["metadata.json"]), &metadata))
+	assert.Equal(t, "abc", metadata.QueryRunID)
+	assert.Equal(t, run.Digest(), metadata.Digest)
+	assert.True(t, metadata.OutputTruncated)
+
+	for name, content := range files {
+		assert.NotContains(t, content, run.EditTokenHash, name)
+	}
+
+	t.Run("files", func(t *testing.T) {
+		run.Files = []queryrun.File{{Name: "data.csv", Content: []byte("1,a\n")}}
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, writeBundle(rec, run, 4))
+
+		files := readBundle(t, rec.Body)
+		assert.Equal(t, "1,a\n", files["data.csv"])
+		assert.Contains(t, files["docker-run.sh"], `-v "$(pwd)/user_files:/var/lib/clickhouse/user_files:ro"`)
+	})
+}
+
+func TestBundleImage(t *testing.T) {
+	assert.Equal(t, "clickhouse/clickhouse-server:22.8", bundleImage(&queryrun.Run{Version: "22.8"}))
+	assert.Equal(t, "yandex/clickhouse-server@sha256:1", bundleImage(&queryrun.Run{
+		Version:         "20.3",
+		ImageRepository: "yandex/clickhouse-server",
+		ImageDigest:     "sha256:1",
+	}))
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
@@ -0,0 +1,83 @@
+package restapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+)
+
+const (
+	// outputMaxAge is the longest time clients may keep outputs of runs that never expire.
+	outputMaxAge = 365 * 24 * time.Hour
+
+	// cacheControlRevalidate makes clients check with the server before using a cached copy.
+	// It's set for runs that are in flight or can be changed (e.g. their labels).
+	cacheControlRevalidate = "no-cache"
+)
+
+// outputCacheControl returns the caching policy of run outputs and bundles.
+// Outputs never change, but the run can be deleted or expire, so shared caches must not keep them
+// and clients must not keep them longer than the run is stored.
+func outputCacheControl(run *queryrun.Run, now time.Time) string {
+	maxAge := int64(outputMaxAge.Seconds())
+	if run.ExpiresAt != 0 {
+		maxAge = max(min(maxAge, run.ExpiresAt-now.Unix()), 0)
+	}
+
+	return "private, max-age=" + strconv.FormatInt(maxAge, 10)
+}
+
+// runETag returns a strong ETag of a representation of the run.
+// It's derived from the stored content hash, so large outputs are not rehashed per request.
+func runETag(run *queryrun.Run, representation string) string {
+	return `"` + run.Digest()[:32] + "-" + representation + `"`
+}
+
+// runDocumentETag returns the ETag of the JSON run representation of the API version.
+// It includes labels, as they can be changed.
+func runDocumentETag(run *queryrun.Run, apiVersion int) string {
+	sum := sha256.Sum256([]byte(strings.Join(run.Labels, "\n")))
+
+	representation := "json-"
+	if apiVersion != apiVersion1 {
+		representation = "json" + strconv.Itoa(apiVersion) + "-"
+	}
+
+	return runETag(run, representation+hex.EncodeToString(sum[:4]))
+}
+
+// writeNotModified sets caching headers and responds with 304 Not Modified
+// if the client's copy matches the ETag. It reports whether the response has been written.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string, cacheControl string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+
+	return true
+}
+
+// etagMatches checks the If-None-Match header, which may contain several ETags.
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,136 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/internal/resultcache"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRunRepo keeps runs in memory. Methods that are not needed by tests are not implemented.
+type memoryRunRepo struct {
+	queryrun.Repository
+	runs map[string]*queryrun.Run
+}
+
+func (m *memoryRunRepo) Create(_ context.Context, run *queryrun.Run) error {
+	run.ContentHash = run.Digest()
+	m.runs[run.ID] = run
+
+	return nil
+}
+
+func (m *memoryRunRepo) Get(_ context.Context, id string) (*queryrun.Run, error) {
+	run, found := m.runs[id]
+	if !found {
+		return nil, queryrun.ErrNotFound
+	}
+
+	return run, nil
+}
+
+func TestRunCaching(t *testing.T) {
+	repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+	inflight := &inflightRuns{}
+	h := newQueryHandler(nil, repo, nil, nil, nil, nil, inflight, time.Minute, 1000, 1000)
+
+	router := chi.NewRouter()
+	h.handleLookups(router)
+
+	get := func(path string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	run := queryrun.New("SELECT 1", ClickHouseDatabase, "23.3.1.2823", &runsettings.ClickHouseSettings{})
+
+	// In-flight runs are not cached.
+	inflight.add(run)
+	for _, path := range []string{"/runs/" + run.ID, "/runs/" + run.ID + "/raw"} {
+		rec := get(path, "")
+		assert.Equal(t, http.StatusNotFound, rec.Code, path)
+		assert.Contains(t, rec.Body.String(), "in progress", path)
+		assert.Equal(t, cacheControlRevalidate, rec.Header().Get("Cache-Control"), path)
+		assert.Empty(t, rec.Header().Get("ETag"), path)
+	}
+
+	// Completed runs get ETags.
+	run.Output = "1\n"
+	require.NoError(t, repo.Create(context.Background(), run))
+	inflight.remove(run)
+
+	rec := get("/runs/"+run.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, cacheControlRevalidate, rec.Header().Get("Cache-Control"))
+
+	rec = get("/runs/"+run.ID, etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	// Changed labels change the ETag of the document.
+	run.Labels = []string{"bug"}
+	rec = get("/runs/"+run.ID, etag)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+	// Outputs never change, but are kept only privately.
+	rec = get("/runs/"+run.ID+"/raw", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1\n", rec.Body.String())
+	assert.Equal(t, "private, max-age=31536000", rec.Header().Get("Cache-Control"))
+	rawETag := rec.Header().Get("ETag")
+
+	rec = get("/runs/"+run.ID+"/raw", rawETag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+}
+
+func TestResultCacheKey_Pinned(t *testing.T) {
+	h := newQueryHandler(funcRunner{}, nil, repushedTagStorage{}, nil, resultcache.New(resultcache.Config{TTL: time.Hour, MaxSizeBytes: 1 << 20}),
+		nil, &inflightRuns{}, time.Minute, 1000, 1000)
+	settings := &runsettings.ClickHouseSettings{}
+
+	req := &RunQueryInput{Query: "SELECT 1", Database: ClickHouseDatabase, Version: "22.3"}
+	current, cacheable := h.resultCacheKey(req, settings)
+	require.True(t, cacheable)
+
+	// Pinned re-runs must not be served outputs of the image the version is resolved to now.
+	req.pinned = &dockertag.Image{Tag: "22.3", Digest: "sha256:old"}
+	pinned, cacheable := h.resultCacheKey(req, settings)
+	require.True(t, cacheable)
+	assert.NotEqual(t, current, pinned)
+}
+
+func TestOutputCacheControl(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	assert.Equal(t, "private, max-age=31536000", outputCacheControl(&queryrun.Run{}, now))
+	assert.Equal(t, "private, max-age=3600", outputCacheControl(&queryrun.Run{ExpiresAt: now.Unix() + 3600}, now))
+	assert.Equal(t, "private, max-age=0", outputCacheControl(&queryrun.Run{ExpiresAt: now.Unix() - 10}, now))
+}
+
+func TestETagMatches(t *testing.T) {
+	assert.False(t, etagMatches("", `"a"`))
+	assert.True(t, etagMatches(`"a"`, `"a"`))
+	assert.True(t, etagMatches(`"b", W/"a"`, `"a"`))
+	assert.True(t, etagMatches("*", `"a"`))
+	assert.False(t, etagMatches(`"b"`, `"a"`))
+}
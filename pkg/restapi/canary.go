@@ -0,0 +1,90 @@
+package restapi
+
+import (
+	"net/http"
+	"time"
+
+	"clickhouse-playground/internal/canary"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+type canaryHandler struct {
+	canary Canary
+}
+
+func newCanaryHandler(c Canary) *canaryHandler {
+	return &canaryHandler{canary: c}
+}
+
+func (h *canaryHandler) handle(r chi.Router) {
+	r.Get("/canary", h.listResults)
+	r.Post("/canary/{version}", h.trigger)
+}
+
+type CanaryResultOutput struct {
+	Version   string     `json:"version"`
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	RunID     string     `json:"run_id,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+type ListCanaryResultsOutput struct {
+	Results []CanaryResultOutput `json:"results"`
+}
+
+// listResults returns the latest canary verdicts on versions.
+func (h *canaryHandler) listResults(w http.ResponseWriter, _ *http.Request) {
+	results := h.canary.Results()
+
+	output := ListCanaryResultsOutput{Results: make([]CanaryResultOutput, 0, len(results))}
+	for _, res := range results {
+		out := CanaryResultOutput{
+			Version: res.Version,
+			Status:  string(res.Status),
+			Reason:  res.Reason,
+			RunID:   res.RunID,
+		}
+		if !res.CheckedAt.IsZero() {
+			checkedAt := res.CheckedAt
+			out.CheckedAt = &checkedAt
+		}
+
+		output.Results = append(output.Results, out)
+	}
+
+	writeResult(w, output)
+}
+
+type TriggerCanaryOutput struct {
+	Version string `json:"version"`
+	Status  string `json:"status"`
+}
+
+// trigger queues the canary check of the version. The check is executed in the background.
+func (h *canaryHandler) trigger(w http.ResponseWriter, r *http.Request) {
+	version := chi.URLParam(r, "version")
+
+	err := h.canary.Trigger(version)
+	switch {
+	case errors.Is(err, canary.ErrUnknownVersion):
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+
+	case errors.Is(err, canary.ErrQueueFull):
+		writeError(w, err.Error(), http.StatusTooManyRequests)
+		return
+
+	case err != nil:
+		writeError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	writeResult(w, TriggerCanaryOutput{
+		Version: version,
+		Status:  string(canary.StatusQueued),
+	})
+}
@@ -0,0 +1,104 @@
+package restapi
+
+import (
+	"net/http"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+type circuitBreakerHandler struct {
+	breakers CircuitBreakers
+}
+
+func newCircuitBreakerHandler(breakers CircuitBreakers) *circuitBreakerHandler {
+	return &circuitBreakerHandler{breakers: breakers}
+}
+
+func (h *circuitBreakerHandler) handle(r chi.Router) {
+	r.Get("/circuit-breakers", h.list)
+	r.Post("/circuit-breakers/{dependency}/reset", h.reset)
+}
+
+type CircuitBreakerOutput struct {
+	Dependency string `json:"dependency"`
+
+	// Runner is set for daemon circuit breakers, which are kept per runner.
+	Runner string `json:"runner,omitempty"`
+
+	// State is "closed", "open" or "half_open".
+	State string `json:"state"`
+
+	// Requests and Failures are counted over the current window.
+	Requests uint `json:"requests"`
+	Failures uint `json:"failures"`
+
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Rejected  uint64     `json:"rejected"`
+}
+
+type ListCircuitBreakersOutput struct {
+	CircuitBreakers []CircuitBreakerOutput `json:"circuit_breakers"`
+}
+
+func newCircuitBreakerOutput(s qrunner.CircuitBreakerStatus) CircuitBreakerOutput {
+	output := CircuitBreakerOutput{
+		Dependency: string(s.Dependency),
+		Runner:     s.Runner,
+		State:      s.State,
+		Requests:   s.Requests,
+		Failures:   s.Failures,
+		LastError:  s.LastError,
+		Rejected:   s.Rejected,
+	}
+	if !s.OpenedAt.IsZero() {
+		openedAt := s.OpenedAt
+		output.OpenedAt = &openedAt
+	}
+
+	return output
+}
+
+// list returns the state of the circuit breakers of the run dependencies.
+func (h *circuitBreakerHandler) list(w http.ResponseWriter, _ *http.Request) {
+	statuses := h.breakers.CircuitBreakers()
+
+	output := ListCircuitBreakersOutput{CircuitBreakers: make([]CircuitBreakerOutput, 0, len(statuses))}
+	for _, s := range statuses {
+		output.CircuitBreakers = append(output.CircuitBreakers, newCircuitBreakerOutput(s))
+	}
+
+	writeResult(w, output)
+}
+
+// reset closes the circuits of the dependency, so runs are dispatched right away.
+// The response lists the circuit breakers of the dependency, the daemon has one per runner.
+func (h *circuitBreakerHandler) reset(w http.ResponseWriter, r *http.Request) {
+	dependency := chi.URLParam(r, "dependency")
+
+	err := h.breakers.ResetCircuitBreaker(dependency)
+	if errors.Is(err, qrunner.ErrUnknownDependency) {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("dependency", dependency).Msg("failed to reset circuit breaker")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	output := ListCircuitBreakersOutput{CircuitBreakers: make([]CircuitBreakerOutput, 0)}
+	for _, s := range h.breakers.CircuitBreakers() {
+		if string(s.Dependency) == dependency {
+			output.CircuitBreakers = append(output.CircuitBreakers, newCircuitBreakerOutput(s))
+		}
+	}
+
+	writeResult(w, output)
+}
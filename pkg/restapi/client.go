@@ -0,0 +1,143 @@
+package restapi
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderForwardedFor = "X-Forwarded-For"
+	HeaderRealIP       = "X-Real-IP"
+)
+
+// TrustedProxies is a list of networks of proxies which are allowed to pass the client address
+// in X-Forwarded-For and X-Real-IP headers.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDRs of trusted proxies. Single addresses are accepted as well.
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	return parseNetworks(cidrs, "proxy")
+}
+
+// parseNetworks parses CIDRs and single addresses. The kind of the networks is used in errors.
+func parseNetworks(cidrs []string, kind string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid %s address '%s'", kind, cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s network '%s'", kind, cidr)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func (p TrustedProxies) trusts(ip net.IP) bool {
+	return containsIP(p, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP derives the client address of the request.
+// Proxy headers are taken into account only if the immediate peer is trusted,
+// otherwise anyone could spoof the address.
+func (p TrustedProxies) clientIP(r *http.Request) string {
+	peer := hostOf(r.RemoteAddr)
+
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !p.trusts(peerIP) {
+		return peer
+	}
+
+	if forwardedFor := r.Header.Values(HeaderForwardedFor); len(forwardedFor) > 0 {
+		return p.rightmostUntrusted(peer, strings.Join(forwardedFor, ","))
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get(HeaderRealIP))); realIP != nil {
+		return realIP.String()
+	}
+
+	return peer
+}
+
+// rightmostUntrusted walks X-Forwarded-For hops from the nearest one and returns the first untrusted hop.
+// A malformed hop stops the walk because the hops to the left of it cannot be trusted,
+// the last checked address is returned in this case.
+func (p TrustedProxies) rightmostUntrusted(peer string, forwardedFor string) string {
+	hops := strings.Split(forwardedFor, ",")
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hostOf(strings.TrimSpace(hops[i])))
+		if ip == nil {
+			return client
+		}
+
+		client = ip.String()
+		if !p.trusts(ip) {
+			return client
+		}
+	}
+
+	// All hops are trusted proxies, the leftmost one is the closest to the client.
+	return client
+}
+
+// hostOf strips the port from the address if it's presented.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// clientIPMiddleware replaces the remote address of the request with the derived client address,
+// so access logs and the request handlers identify the client consistently.
+func clientIPMiddleware(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(proxies) > 0 {
+				r.RemoteAddr = proxies.clientIP(r)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientID identifies the client that has sent the request.
+func clientID(r *http.Request) string {
+	return hostOf(r.RemoteAddr)
+}
@@ -0,0 +1,115 @@
+package restapi
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReasonTooManyInFlightRuns distinguishes the in-flight limit from other 429 errors, e.g. exhausted runners.
+const ReasonTooManyInFlightRuns = "too_many_inflight_runs"
+
+// ClientRunLimits bound the number of runs a single client can have in progress. Zero means no limit.
+type ClientRunLimits struct {
+	// Anonymous clients are identified by the address.
+	Anonymous uint
+	// Authenticated clients are identified by the API key, so all clients sharing the key share the limit.
+	Authenticated uint
+}
+
+// ClientRunLimiter counts in-flight runs per client. It's shared by the API and the admin API.
+type ClientRunLimiter struct {
+	limits ClientRunLimits
+
+	mu     sync.Mutex
+	counts map[string]uint
+}
+
+func NewClientRunLimiter(limits ClientRunLimits) *ClientRunLimiter {
+	return &ClientRunLimiter{
+		limits: limits,
+		counts: make(map[string]uint),
+	}
+}
+
+// ClientInFlight is the number of runs of the client in progress.
+type ClientInFlight struct {
+	Client        string
+	Authenticated bool
+	InFlight      uint
+	Limit         uint
+}
+
+// limitedClient returns the key the client is counted by and its limit.
+// Keys are prefixed, so an address cannot collide with a key name.
+func (l *ClientRunLimiter) limitedClient(r *http.Request) (client string, limit uint) {
+	if key, ok := requestKey(r); ok {
+		return "key:" + key.Name, l.limits.Authenticated
+	}
+
+	return "ip:" + clientID(r), l.limits.Anonymous
+}
+
+// acquire counts a new run of the client. If the client has reached the limit, it returns false
+// and the current number of the client runs. Otherwise, release must be called once the run is finished.
+func (l *ClientRunLimiter) acquire(r *http.Request) (release func(), inFlight uint, ok bool) {
+	client, limit := l.limitedClient(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inFlight = l.counts[client]
+	if limit > 0 && inFlight >= limit {
+		return nil, inFlight, false
+	}
+
+	l.counts[client] = inFlight + 1
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.counts[client]--
+			if l.counts[client] == 0 {
+				delete(l.counts, client)
+			}
+		})
+	}
+
+	return release, inFlight + 1, true
+}
+
+// InFlight returns clients with runs in progress, the busiest ones go first.
+func (l *ClientRunLimiter) InFlight() []ClientInFlight {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clients := make([]ClientInFlight, 0, len(l.counts))
+	for client, count := range l.counts {
+		authenticated := strings.HasPrefix(client, "key:")
+		limit := l.limits.Anonymous
+		if authenticated {
+			limit = l.limits.Authenticated
+		}
+
+		clients = append(clients, ClientInFlight{
+			Client:        strings.SplitN(client, ":", 2)[1],
+			Authenticated: authenticated,
+			InFlight:      count,
+			Limit:         limit,
+		})
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].InFlight != clients[j].InFlight {
+			return clients[i].InFlight > clients[j].InFlight
+		}
+
+		return clients[i].Client < clients[j].Client
+	})
+
+	return clients
+}
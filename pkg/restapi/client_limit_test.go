@@ -0,0 +1,161 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLimitedRequest(addr string, key *APIKey) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/runs", nil)
+	r.RemoteAddr = addr
+	if key != nil {
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, *key))
+	}
+
+	return r
+}
+
+func TestClientRunLimiter(t *testing.T) {
+	l := NewClientRunLimiter(ClientRunLimits{Anonymous: 1, Authenticated: 2})
+	key := &APIKey{Name: "internal"}
+
+	release, inFlight, ok := l.acquire(newLimitedRequest("203.0.113.7:5000", nil))
+	require.True(t, ok)
+	assert.Equal(t, uint(1), inFlight)
+
+	// Another port of the same address is the same client.
+	_, inFlight, ok = l.acquire(newLimitedRequest("203.0.113.7:5001", nil))
+	assert.False(t, ok)
+	assert.Equal(t, uint(1), inFlight)
+
+	_, _, ok = l.acquire(newLimitedRequest("203.0.113.8:5000", nil))
+	assert.True(t, ok)
+
+	// Clients sharing the key share the limit of the authenticated tier.
+	_, _, ok = l.acquire(newLimitedRequest("203.0.113.7:5000", key))
+	assert.True(t, ok)
+	_, _, ok = l.acquire(newLimitedRequest("198.51.100.1:5000", key))
+	assert.True(t, ok)
+	_, inFlight, ok = l.acquire(newLimitedRequest("198.51.100.2:5000", key))
+	assert.False(t, ok)
+	assert.Equal(t, uint(2), inFlight)
+
+	assert.Equal(t, []ClientInFlight{
+		{Client: "internal", Authenticated: true, InFlight: 2, Limit: 2},
+		{Client: "203.0.113.7", InFlight: 1, Limit: 1},
+		{Client: "203.0.113.8", InFlight: 1, Limit: 1},
+	}, l.InFlight())
+
+	// Repeated releases are ignored.
+	release()
+	release()
+
+	_, _, ok = l.acquire(newLimitedRequest("203.0.113.7:5000", nil))
+	assert.True(t, ok)
+}
+
+func TestClientRunLimiterReleasesOnPanic(t *testing.T) {
+	l := NewClientRunLimiter(ClientRunLimits{Anonymous: 1})
+	r := newLimitedRequest("203.0.113.7:5000", nil)
+
+	assert.Panics(t, func() {
+		release, _, ok := l.acquire(r)
+		require.True(t, ok)
+		defer release()
+
+		panic("handler failed")
+	})
+
+	assert.Empty(t, l.InFlight())
+}
+
+func TestClientRunLimiterConcurrency(t *testing.T) {
+	const limit = 5
+	l := NewClientRunLimiter(ClientRunLimits{Anonymous: limit})
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acquired int
+		maxSeen  uint
+	)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release, inFlight, ok := l.acquire(newLimitedRequest("203.0.113.7:5000", nil))
+			if !ok {
+				return
+			}
+			defer release()
+
+			mu.Lock()
+			acquired++
+			if inFlight > maxSeen {
+				maxSeen = inFlight
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.Positive(t, acquired)
+	assert.LessOrEqual(t, maxSeen, uint(limit))
+	assert.Empty(t, l.InFlight())
+}
+
+func TestRunQueueRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{
+			name:       "queue is full",
+			err:        &qrunner.QueueRejectedError{Reason: "queue is full", RetryAfter: 1500 * time.Millisecond},
+			status:     http.StatusTooManyRequests,
+			retryAfter: "2",
+		},
+		{
+			name:   "runners are busy",
+			err:    qrunner.ErrNoAvailableRunners,
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:       "circuit is open",
+			err:        &qrunner.CircuitOpenError{Dependency: qrunner.DependencyDaemon, RetryAfter: 20 * time.Second},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "20",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			runner := funcRunner{run: func(*queryrun.Run) (string, error) {
+				return "", tt.err
+			}}
+			repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+			h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+			rec := httptest.NewRecorder()
+			h.runQuery(rec, httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(`{"query": "SELECT 1", "version": "23.3"}`)))
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.retryAfter, rec.Header().Get("Retry-After"))
+			assert.Contains(t, rec.Body.String(), qrunner.ErrNoAvailableRunners.Error())
+		})
+	}
+}
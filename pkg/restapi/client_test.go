@@ -0,0 +1,122 @@
+package restapi
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	require.NoError(t, err)
+	require.Len(t, proxies, 3)
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	_, err = ParseTrustedProxies([]string{"proxy.local"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	require.NoError(t, err)
+
+	cases := []struct {
+		Name       string
+		RemoteAddr string
+		ForwardFor []string
+		RealIP     string
+		Expected   string
+	}{
+		{
+			Name:       "no headers",
+			RemoteAddr: "10.0.0.1:5000",
+			Expected:   "10.0.0.1",
+		},
+		{
+			Name:       "untrusted peer",
+			RemoteAddr: "1.2.3.4:5000",
+			ForwardFor: []string{"5.6.7.8"},
+			RealIP:     "5.6.7.8",
+			Expected:   "1.2.3.4",
+		},
+		{
+			Name:       "single hop",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"5.6.7.8"},
+			Expected:   "5.6.7.8",
+		},
+		{
+			Name:       "multiple hops",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"},
+			Expected:   "5.6.7.8",
+		},
+		{
+			Name:       "multiple headers",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"9.9.9.9", "5.6.7.8", "10.0.0.2"},
+			Expected:   "5.6.7.8",
+		},
+		{
+			Name:       "all hops are trusted",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"10.0.0.3, 10.0.0.2"},
+			Expected:   "10.0.0.3",
+		},
+		{
+			Name:       "hop with port",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"5.6.7.8:1234"},
+			Expected:   "5.6.7.8",
+		},
+		{
+			Name:       "ipv6",
+			RemoteAddr: "[fd00::1]:5000",
+			ForwardFor: []string{"2001:db8::1, fd00::2"},
+			Expected:   "2001:db8::1",
+		},
+		{
+			Name:       "malformed hop",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"5.6.7.8, garbage, 10.0.0.2"},
+			Expected:   "10.0.0.2",
+		},
+		{
+			Name:       "malformed nearest hop",
+			RemoteAddr: "10.0.0.1:5000",
+			ForwardFor: []string{"5.6.7.8, "},
+			Expected:   "10.0.0.1",
+		},
+		{
+			Name:       "real ip",
+			RemoteAddr: "10.0.0.1:5000",
+			RealIP:     "5.6.7.8",
+			Expected:   "5.6.7.8",
+		},
+		{
+			Name:       "malformed real ip",
+			RemoteAddr: "10.0.0.1:5000",
+			RealIP:     "5.6.7",
+			Expected:   "10.0.0.1",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.RemoteAddr
+			for _, v := range test.ForwardFor {
+				r.Header.Add(HeaderForwardedFor, v)
+			}
+			if test.RealIP != "" {
+				r.Header.Set(HeaderRealIP, test.RealIP)
+			}
+
+			assert.Equal(t, test.Expected, proxies.clientIP(r))
+		})
+	}
+}
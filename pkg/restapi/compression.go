@@ -0,0 +1,178 @@
+package restapi
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	ContentEncodingGzip = "gzip"
+	ContentEncodingZstd = "zstd"
+)
+
+// ContentEncodings are encodings of compressed request bodies.
+var ContentEncodings = []string{ContentEncodingGzip, ContentEncodingZstd}
+
+// Reasons of 413 responses to compressed bodies.
+const (
+	reasonCompressedBodyTooLarge = "compressed_body_too_large"
+	reasonExpandedBodyTooLarge   = "expanded_body_too_large"
+)
+
+// BodyLimits bound compressed request bodies. Uncompressed bodies are limited by the handlers.
+type BodyLimits struct {
+	// MaxCompressedLength is the max length of a compressed body as it's sent.
+	MaxCompressedLength uint64
+
+	// MaxExpandedLength is the max length of a decompressed body. It guards against decompression bombs.
+	// If it's 0, compressed bodies are not accepted.
+	MaxExpandedLength uint64
+}
+
+// bodyTooLargeError tells which limit of a compressed body has been exceeded.
+type bodyTooLargeError struct {
+	reason string
+	limit  uint64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	if e.reason == reasonCompressedBodyTooLarge {
+		return fmt.Sprintf("compressed body cannot exceed %d bytes", e.limit)
+	}
+
+	return fmt.Sprintf("decompressed body cannot exceed %d bytes", e.limit)
+}
+
+// cappedReader fails with the error once more than limit bytes are read.
+type cappedReader struct {
+	r    io.Reader
+	left uint64
+	err  *bodyTooLargeError
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	// One extra byte is read to detect bodies exceeding the limit.
+	if uint64(len(p)) > c.left+1 {
+		p = p[:c.left+1]
+	}
+
+	n, err := c.r.Read(p)
+	if uint64(n) > c.left || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		// zstd rejects frames which declared size exceeds the limit before decoding them.
+		return 0, c.err
+	}
+	c.left -= uint64(n)
+
+	return n, err
+}
+
+// decompressBody replaces the body of the request by the decompressed one according to its Content-Encoding.
+// The body is decompressed as it's read, and reads fail with bodyTooLargeError once a limit is exceeded.
+// It returns an http status code describing the failure if the encoding is not supported.
+func decompressBody(r *http.Request, limits BodyLimits) (int, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return http.StatusOK, nil
+	}
+
+	supported := false
+	for _, e := range ContentEncodings {
+		supported = supported || e == encoding
+	}
+	if !supported || limits.MaxExpandedLength == 0 {
+		msg := fmt.Sprintf("unsupported content encoding %s", encoding)
+		if limits.MaxExpandedLength != 0 {
+			msg += fmt.Sprintf(" (supported: %s)", strings.Join(ContentEncodings, ", "))
+		}
+
+		return http.StatusUnsupportedMediaType, errors.New(msg)
+	}
+
+	body := r.Body
+	compressed := &cappedReader{
+		r:    body,
+		left: limits.MaxCompressedLength,
+		err:  &bodyTooLargeError{reason: reasonCompressedBodyTooLarge, limit: limits.MaxCompressedLength},
+	}
+
+	var decompressed io.ReadCloser
+	switch encoding {
+	case ContentEncodingGzip:
+		zr, err := gzip.NewReader(compressed)
+		if err != nil {
+			return bodyReadStatus(err), errors.Wrap(err, "invalid gzip body")
+		}
+
+		decompressed = zr
+
+	case ContentEncodingZstd:
+		// A single goroutine decodes the stream synchronously, and the window is bounded by the expanded limit.
+		zr, err := zstd.NewReader(compressed,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(limits.MaxExpandedLength),
+		)
+		if err != nil {
+			return http.StatusBadRequest, errors.Wrap(err, "invalid zstd body")
+		}
+
+		decompressed = zr.IOReadCloser()
+	}
+
+	expanded := &cappedReader{
+		r:    decompressed,
+		left: limits.MaxExpandedLength,
+		err:  &bodyTooLargeError{reason: reasonExpandedBodyTooLarge, limit: limits.MaxExpandedLength},
+	}
+	r.Body = &decompressedBody{
+		Reader:       expanded,
+		decompressor: decompressed,
+		body:         body,
+	}
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+
+	return http.StatusOK, nil
+}
+
+type decompressedBody struct {
+	io.Reader
+	decompressor io.Closer
+	body         io.Closer
+}
+
+func (b *decompressedBody) Close() error {
+	_ = b.decompressor.Close()
+	return b.body.Close()
+}
+
+// bodyReadStatus returns 413 if the body has exceeded a limit, otherwise, it's 400.
+func bodyReadStatus(err error) int {
+	var tooLarge *bodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// writeBodyReadError writes the error of reading a body. Exceeded limits are told by the reason.
+func writeBodyReadError(w http.ResponseWriter, err error, status int) {
+	var tooLarge *bodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		writeErrorResponse(w, &ErrorResponse{
+			Message: tooLarge.Error(),
+			Code:    http.StatusRequestEntityTooLarge,
+			Reason:  tooLarge.reason,
+		})
+
+		return
+	}
+
+	writeError(w, err.Error(), status)
+}
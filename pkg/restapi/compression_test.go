@@ -0,0 +1,133 @@
+package restapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding, body string) []byte {
+	var buf bytes.Buffer
+	switch encoding {
+	case ContentEncodingGzip:
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+	case ContentEncodingZstd:
+		w, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+	default:
+		buf.WriteString(body)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCompressedRuns(t *testing.T) {
+	// The insert compresses well, as generated reproductions do.
+	insert := "INSERT INTO t VALUES " + strings.Repeat("(1, 'value'), ", 100)
+	jsonBody := `{"query": "` + insert + `", "version": "23.3"}`
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		limits   BodyLimits
+		status   int
+		reason   string
+	}{
+		{
+			name:     "gzip",
+			encoding: ContentEncodingGzip,
+			body:     jsonBody,
+			limits:   BodyLimits{MaxCompressedLength: 200, MaxExpandedLength: 2000},
+			status:   http.StatusOK,
+		},
+		{
+			name:     "zstd",
+			encoding: ContentEncodingZstd,
+			body:     jsonBody,
+			limits:   BodyLimits{MaxCompressedLength: 200, MaxExpandedLength: 2000},
+			status:   http.StatusOK,
+		},
+		{
+			name:     "compressed limit",
+			encoding: ContentEncodingGzip,
+			body:     jsonBody,
+			limits:   BodyLimits{MaxCompressedLength: 20, MaxExpandedLength: 2000},
+			status:   http.StatusRequestEntityTooLarge,
+			reason:   reasonCompressedBodyTooLarge,
+		},
+		{
+			name:     "expanded limit",
+			encoding: ContentEncodingZstd,
+			body:     jsonBody,
+			limits:   BodyLimits{MaxCompressedLength: 200, MaxExpandedLength: 500},
+			status:   http.StatusRequestEntityTooLarge,
+			reason:   reasonExpandedBodyTooLarge,
+		},
+		{
+			name:     "query limit applies to the expanded query",
+			encoding: ContentEncodingGzip,
+			body:     `{"query": "` + insert + insert + `", "version": "23.3"}`,
+			limits:   BodyLimits{MaxCompressedLength: 200, MaxExpandedLength: 5000},
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "unsupported encoding",
+			encoding: "br",
+			body:     jsonBody,
+			limits:   BodyLimits{MaxCompressedLength: 200, MaxExpandedLength: 2000},
+			status:   http.StatusUnsupportedMediaType,
+		},
+		{
+			name:     "compression disabled",
+			encoding: ContentEncodingGzip,
+			body:     jsonBody,
+			status:   http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+				assert.Equal(t, insert, run.Input)
+				return "", nil
+			}}
+			h := newQueryHandler(runner, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 2000, 1000)
+			h.bodyLimits = tt.limits
+
+			req := httptest.NewRequest(http.MethodPost, "/runs", bytes.NewReader(compress(t, tt.encoding, tt.body)))
+			req.Header.Set("Content-Encoding", tt.encoding)
+
+			rec := httptest.NewRecorder()
+			h.runQuery(rec, req)
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+
+			if tt.reason != "" {
+				var resp Response
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+				require.NotNil(t, resp.Error)
+				assert.Equal(t, tt.reason, resp.Error.Reason)
+			}
+		})
+	}
+}
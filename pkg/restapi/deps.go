@@ -2,16 +2,188 @@ package restapi
 
 import (
 	"context"
+	"io"
+	"net"
+	"time"
 
+	"clickhouse-playground/internal/blocklist"
+	"clickhouse-playground/internal/canary"
 	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/health"
+	"clickhouse-playground/internal/outputproc"
+	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/internal/resultcache"
+	"clickhouse-playground/pkg/dockerhub"
 )
 
 type TagStorage interface {
 	GetAll() []dockertag.Image
+	Snapshot() dockertag.Snapshot
 	Exists(tag string) bool
+	Find(tag string) (dockertag.Image, bool)
+	Resolve(version string, strict bool) (dockertag.Image, bool)
+	Suggest(version string, limit int) []string
+	Deprecation(tag string) (dockertag.Deprecation, bool)
 }
 
 type QueryRunner interface {
-	RunQuery(ctx context.Context, run *queryrun.Run) (string, error)
+	RunQuery(ctx context.Context, run *queryrun.Run) (qrunner.Result, error)
+	Prepare(ctx context.Context, run *queryrun.Run) (qrunner.Reservation, error)
+}
+
+// SessionOpener keeps containers for interactive sessions.
+// It returns qrunner.ErrSessionsUnsupported if the runner cannot keep containers.
+type SessionOpener interface {
+	OpenSession(ctx context.Context, run *queryrun.Run, expiresAt time.Time) (qrunner.Session, error)
+}
+
+// QueryPolicy rejects disallowed queries before execution.
+// It returns *policy.Violation if the query is not allowed.
+type QueryPolicy interface {
+	Check(query string) error
+}
+
+// QuotaStore keeps quota counters of clients. The memory store limits clients on every replica
+// of the server separately, a shared store (e.g. Redis) limits them across replicas.
+type QuotaStore interface {
+	// TakeToken takes a token from the bucket of the client, which is refilled at rate tokens per second
+	// up to burst tokens. If the bucket is empty, it returns false and when the next token is available.
+	TakeToken(ctx context.Context, client string, rate float64, burst uint, now time.Time) (ok bool, availableAt time.Time, err error)
+
+	// CountRun counts a run of the client within the day starting at day unless the client has already made
+	// limit runs that day. It returns false if the run has not been counted.
+	CountRun(ctx context.Context, client string, day time.Time, limit uint) (ok bool, err error)
+}
+
+// ResultCache stores results of deterministic query runs.
+// If it's nil, every query is executed by the runner.
+type ResultCache interface {
+	Get(key string) (resultcache.Entry, bool)
+	Put(key string, entry resultcache.Entry)
+
+	// RemoveRun drops entries produced by the run.
+	RemoveRun(runID string)
+}
+
+// OutputProcessor transforms outputs of runs before they are stored and returned, e.g. redacts credentials.
+// It reports what has been changed.
+type OutputProcessor interface {
+	Process(output string) (string, []outputproc.Change, error)
+
+	// Wrap returns a writer passing a streamed output through the processors to w.
+	Wrap(w io.Writer) *outputproc.PipelineStream
+}
+
+// FiddleFetcher downloads content of fiddles imported from external links.
+// It returns fiddleimport errors describing rejected urls and contents.
+type FiddleFetcher interface {
+	Fetch(ctx context.Context, url string) (string, error)
+}
+
+// PullRateLimitInspector reports the registry pull rate limit, so clients can be told when to retry.
+// It returns nil if pulls are not limited.
+type PullRateLimitInspector interface {
+	PullRateLimit(ctx context.Context) (*dockerhub.RateLimit, error)
+}
+
+// CanaryStatus reports versions which latest canary check has failed.
+type CanaryStatus interface {
+	Degraded(version string) (reason string, degraded bool)
+	Verdict(version string) (canary.Result, bool)
+}
+
+// TagJournal reports changes of the tag list after a generation or a time.
+type TagJournal interface {
+	ChangesSince(generation uint64) dockertag.Changelog
+	ChangesAfter(t time.Time) dockertag.Changelog
+}
+
+// Canary checks versions with canary queries on demand.
+// Trigger returns canary.ErrUnknownVersion or canary.ErrQueueFull if the check cannot be queued.
+type Canary interface {
+	Trigger(version string) error
+	Results() []canary.Result
+}
+
+// HealthReporter returns the cached verdicts on the service dependencies.
+type HealthReporter interface {
+	Report() health.Report
+}
+
+// ReadinessChecker probes the dependencies the service cannot serve requests without.
+type ReadinessChecker interface {
+	Check(ctx context.Context) health.Report
+}
+
+// ImageInspector tells whether runners have pulled the image of a version and how fast they pull images.
+type ImageInspector interface {
+	ImageState(ctx context.Context, version string) (qrunner.ImageState, error)
+}
+
+// ContainerLister lists containers of the runners.
+type ContainerLister interface {
+	Containers(ctx context.Context) ([]qrunner.Container, error)
+}
+
+// WarmPoolStatus reports how runners distribute warm containers across versions.
+type WarmPoolStatus interface {
+	WarmPools() []qrunner.WarmPoolAllocation
+}
+
+// SchedulerStatus reports the state of the priority classes the runs are scheduled in.
+// It returns nil if runs are not scheduled by priority.
+type SchedulerStatus interface {
+	SchedulerClasses() []qrunner.SchedulerClass
+}
+
+// Remediations reports remediations of container failures applied by the runners.
+type Remediations interface {
+	Remediations() []qrunner.RemediationStatus
+}
+
+// DeadlineResolver resolves deadlines of runs by their versions.
+type DeadlineResolver interface {
+	Resolve(version string) queryrun.Deadlines
+}
+
+// GCReporter returns reports of recent garbage collection passes of the runners.
+type GCReporter interface {
+	GCReports() []qrunner.GCReport
+}
+
+// ContainerSnapshotter captures containers of in-flight runs.
+// It returns qrunner.ErrRunNotInProgress if the run is not being processed.
+type ContainerSnapshotter interface {
+	Snapshot(ctx context.Context, runID string) (*queryrun.ContainerSnapshot, error)
+}
+
+// CircuitBreakers reports and resets the circuit breakers of the run dependencies.
+// ResetCircuitBreaker returns qrunner.ErrUnknownDependency if there is no such circuit breaker.
+type CircuitBreakers interface {
+	CircuitBreakers() []qrunner.CircuitBreakerStatus
+	ResetCircuitBreaker(dependency string) error
+}
+
+// BlockList rejects requests of blocked clients and manages the entries.
+// Add returns blocklist.ErrInvalidEntry if the entry is malformed, Remove returns blocklist.ErrNotFound
+// if there is no active entry with the id.
+type BlockList interface {
+	Match(keyHash string, ip net.IP) (blocklist.Entry, bool)
+	Entries(all bool) []blocklist.Status
+	Add(ctx context.Context, entry blocklist.Entry) (blocklist.Entry, error)
+	Remove(ctx context.Context, id string, reason string) (blocklist.Entry, error)
+}
+
+// MaintenanceMode reports whether the service is in the maintenance mode, so runs cannot be executed.
+type MaintenanceMode interface {
+	State() health.MaintenanceState
+}
+
+// MaintenanceControl forces the maintenance mode on operator demand. Clear stops forcing it,
+// but the mode stays active while runners are down.
+type MaintenanceControl interface {
+	MaintenanceMode
+	Force(message string, recovery *time.Time) health.MaintenanceState
+	Clear() health.MaintenanceState
 }
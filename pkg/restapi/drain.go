@@ -0,0 +1,39 @@
+package restapi
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ReasonShuttingDown distinguishes runs rejected by a server that is shutting down from other 429 errors.
+// Such runs can be retried at once, they are routed to another server.
+const ReasonShuttingDown = "shutting_down"
+
+// Drain rejects new runs once the server is shutting down, so runs in progress are finished before runners stop.
+// Cached results and stored runs are served as usual.
+type Drain struct {
+	draining atomic.Bool
+}
+
+func NewDrain() *Drain {
+	return &Drain{}
+}
+
+// Start stops accepting new runs.
+func (d *Drain) Start() {
+	d.draining.Store(true)
+}
+
+// Draining reports whether new runs are rejected. It's false for a nil drain.
+func (d *Drain) Draining() bool {
+	return d != nil && d.draining.Load()
+}
+
+func writeShuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeErrorResponse(w, &ErrorResponse{
+		Message: "server is shutting down, try again",
+		Code:    http.StatusTooManyRequests,
+		Reason:  ReasonShuttingDown,
+	})
+}
@@ -0,0 +1,67 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	runner := newSlowRunner()
+	h := newQueryHandler(runner, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+	h.drain = NewDrain()
+
+	r := chi.NewRouter()
+	h.handleRuns(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	post := func() (*http.Response, error) {
+		return http.Post(srv.URL+"/runs", "application/json", strings.NewReader(`{"query": "SELECT 1", "version": "23.3.1.2823"}`))
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	inProgress := make(chan result, 1)
+	go func() {
+		resp, err := post()
+		inProgress <- result{resp: resp, err: err}
+	}()
+	<-runner.started
+
+	// The server is shut down the way main does it on SIGTERM.
+	h.drain.Start()
+
+	rejected, err := post()
+	require.NoError(t, err)
+	defer rejected.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, rejected.StatusCode)
+
+	var resp Response
+	require.NoError(t, json.NewDecoder(rejected.Body).Decode(&resp))
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, ReasonShuttingDown, resp.Error.Reason)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Config.Shutdown(context.Background())
+	}()
+
+	close(runner.release)
+
+	finished := <-inProgress
+	require.NoError(t, finished.err)
+	defer finished.resp.Body.Close()
+	assert.Equal(t, http.StatusOK, finished.resp.StatusCode, "the run started before the drain is finished")
+	require.NoError(t, <-shutdown)
+}
@@ -0,0 +1,129 @@
+package restapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"clickhouse-playground/internal/policy"
+	"clickhouse-playground/pkg/chsemver"
+
+	"github.com/pkg/errors"
+)
+
+// explainKinds are the kinds of EXPLAIN accepted by /explain with the versions they have appeared in.
+// An empty version means the kind is supported by all versions.
+var explainKinds = []struct {
+	kind       string
+	minVersion string
+}{
+	{kind: "AST"},
+	{kind: "SYNTAX", minVersion: "20.6"},
+	{kind: "PLAN", minVersion: "20.6"},
+	{kind: "PIPELINE", minVersion: "20.6"},
+}
+
+// ExplainInput is a run of the query wrapped into EXPLAIN of the kind.
+type ExplainInput struct {
+	RunQueryInput
+
+	// ExplainKind is AST, SYNTAX, PLAN or PIPELINE. Default: PLAN.
+	ExplainKind string `json:"explain_kind"`
+}
+
+// explain wraps the single statement of the request into EXPLAIN and runs it as usual,
+// so the result has the shape of other runs. Raw SQL bodies take the kind from the explain_kind parameter.
+func (h *queryHandler) explain(w http.ResponseWriter, r *http.Request) {
+	status, err := decompressBody(r, h.bodyLimits)
+	if err != nil {
+		writeBodyReadError(w, err, status)
+		return
+	}
+
+	req, status, err := h.decodeExplainInput(r)
+	if err != nil {
+		writeBodyReadError(w, err, status)
+		return
+	}
+
+	query, err := h.explainQuery(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Query = query
+
+	if isStreamRequested(r) {
+		w = newOutputStream(w)
+	}
+
+	h.execute(w, r, &req.RunQueryInput, nil)
+}
+
+func (h *queryHandler) decodeExplainInput(r *http.Request) (ExplainInput, int, error) {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); contentType == "" || (err == nil && mediaType == ContentTypeJSON) {
+		var req ExplainInput
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return req, http.StatusBadRequest, err
+		}
+
+		return req, http.StatusOK, nil
+	}
+
+	runReq, status, err := h.decodeRunQueryInput(r)
+
+	return ExplainInput{
+		RunQueryInput: runReq,
+		ExplainKind:   paramOrHeader(r, "explain_kind", "X-ClickHouse-Explain-Kind"),
+	}, status, err
+}
+
+// explainQuery validates the request and returns the statement wrapped into EXPLAIN. A trailing semicolon is stripped.
+// Kinds unsupported by the requested version are rejected, if the version is unknown, it's reported by the run.
+func (h *queryHandler) explainQuery(req *ExplainInput) (string, error) {
+	if len(req.Statements) > 0 {
+		return "", errors.New("explain accepts a single query, statements cannot be set")
+	}
+	if req.Tool != nil {
+		return "", errors.New("tool runs cannot be explained")
+	}
+
+	kind := strings.ToUpper(strings.TrimSpace(req.ExplainKind))
+	if kind == "" {
+		kind = "PLAN"
+	}
+
+	minVersion, found := "", false
+	names := make([]string, 0, len(explainKinds))
+	for _, k := range explainKinds {
+		names = append(names, k.kind)
+		if k.kind == kind {
+			minVersion, found = k.minVersion, true
+		}
+	}
+	if !found {
+		return "", errors.Errorf("unknown explain kind %s (supported: %s)", req.ExplainKind, strings.Join(names, ", "))
+	}
+
+	query := strings.TrimRight(strings.TrimSpace(req.Query), "; \t\n")
+	statements, err := policy.CountStatements(query)
+	if errors.Is(err, policy.ErrNoStatements) || query == "" {
+		return "", errors.New("query cannot be empty")
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "query is not valid SQL")
+	}
+	if statements > 1 {
+		return "", errors.Errorf("explain accepts a single statement, but %d have been found", statements)
+	}
+
+	if img, found := h.tagStorage.Resolve(req.Version, req.Strict); found && minVersion != "" && !chsemver.IsAtLeastMajor(img.Tag, minVersion) {
+		return "", errors.Errorf("EXPLAIN %s is supported since %s, but version %s has been requested", kind, minVersion, img.Tag)
+	}
+
+	return fmt.Sprintf("EXPLAIN %s %s", kind, query), nil
+}
@@ -0,0 +1,76 @@
+package restapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainQuery(t *testing.T) {
+	h := newQueryHandler(nil, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+	tests := []struct {
+		name     string
+		input    ExplainInput
+		expected string
+		errPart  string
+	}{
+		{
+			name:     "default kind",
+			input:    ExplainInput{RunQueryInput: RunQueryInput{Query: "SELECT 1", Version: "23.3"}},
+			expected: "EXPLAIN PLAN SELECT 1",
+		},
+		{
+			name:     "trailing semicolon",
+			input:    ExplainInput{RunQueryInput: RunQueryInput{Query: " SELECT 1;\n", Version: "23.3"}, ExplainKind: "pipeline"},
+			expected: "EXPLAIN PIPELINE SELECT 1",
+		},
+		{
+			name:     "ast on old version",
+			input:    ExplainInput{RunQueryInput: RunQueryInput{Query: "SELECT 1", Version: "20.3"}, ExplainKind: "AST"},
+			expected: "EXPLAIN AST SELECT 1",
+		},
+		{
+			name:    "pipeline on old version",
+			input:   ExplainInput{RunQueryInput: RunQueryInput{Query: "SELECT 1", Version: "20.5.4"}, ExplainKind: "PIPELINE"},
+			errPart: "supported since 20.6",
+		},
+		{
+			name:    "unknown kind",
+			input:   ExplainInput{RunQueryInput: RunQueryInput{Query: "SELECT 1"}, ExplainKind: "ESTIMATES"},
+			errPart: "unknown explain kind",
+		},
+		{
+			name:    "multiple statements",
+			input:   ExplainInput{RunQueryInput: RunQueryInput{Query: "SELECT 1; SELECT 2"}},
+			errPart: "single statement",
+		},
+		{
+			name:    "empty query",
+			input:   ExplainInput{RunQueryInput: RunQueryInput{Query: " ; "}},
+			errPart: "empty",
+		},
+		{
+			name:    "statements",
+			input:   ExplainInput{RunQueryInput: RunQueryInput{Statements: []string{"SELECT 1"}}},
+			errPart: "statements cannot be set",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := h.explainQuery(&tt.input)
+			if tt.errPart != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errPart)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, query)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"clickhouse-playground/internal/fiddleimport"
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/policy"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+type importHandler struct {
+	queries *queryHandler
+	fetcher FiddleFetcher
+}
+
+func newImportHandler(queries *queryHandler, fetcher FiddleFetcher) *importHandler {
+	return &importHandler{
+		queries: queries,
+		fetcher: fetcher,
+	}
+}
+
+func (h *importHandler) handle(r chi.Router) {
+	r.Post("/import", h.importFiddle)
+}
+
+type ImportInput struct {
+	URL string `json:"url"`
+
+	// Version is the version the fiddle is saved with. If it's empty, the latest version is used.
+	Version  string `json:"version"`
+	Database string `json:"database"`
+	Strict   bool   `json:"strict"`
+
+	Labels []string `json:"labels,omitempty"`
+}
+
+type ImportOutput struct {
+	// QueryRunID refers to the saved fiddle. It has no output until it's run with /api/runs/{id}/rerun.
+	QueryRunID string `json:"query_run_id"`
+	Version    string `json:"version"`
+	Statements int    `json:"statements"`
+	Input      string `json:"input"`
+
+	Warnings  []WarningOutput `json:"warnings,omitempty"`
+	EditToken string          `json:"edit_token"`
+}
+
+// importFiddle fetches SQL shared by an external link (e.g. a raw gist) and saves it as a fiddle ready to run.
+// Only allowlisted hosts are contacted, see fiddleimport.Fetcher.
+func (h *importHandler) importFiddle(w http.ResponseWriter, r *http.Request) {
+	var input ImportInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if input.URL == "" {
+		writeError(w, "url cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if input.Version == "" {
+		input.Version = "latest"
+	}
+
+	query, err := h.fetcher.Fetch(r.Context(), input.URL)
+	if err != nil {
+		metrics.FiddleImport.Imported("rejected")
+
+		zlog.Debug().Err(err).Str("url", input.URL).Msg("failed to fetch an imported fiddle")
+
+		status, msg := importErrorStatus(err)
+		writeError(w, msg, status)
+
+		return
+	}
+
+	statements, err := policy.CountStatements(query)
+	if err != nil {
+		metrics.FiddleImport.Imported("rejected")
+		writeError(w, fmt.Sprintf("content is not valid SQL: %s", err), http.StatusUnprocessableEntity)
+
+		return
+	}
+	if uint64(len(query)) > h.queries.maxQueryLength {
+		metrics.FiddleImport.Imported("rejected")
+		writeError(w, fmt.Sprintf("query length (%d) cannot exceed %d", len(query), h.queries.maxQueryLength), http.StatusUnprocessableEntity)
+
+		return
+	}
+	if h.queries.policy != nil {
+		err = h.queries.policy.Check(query)
+		if err != nil {
+			metrics.FiddleImport.Imported("rejected")
+			writeError(w, err.Error(), http.StatusForbidden)
+
+			return
+		}
+	}
+
+	req := RunQueryInput{
+		Query:    query,
+		Version:  input.Version,
+		Database: input.Database,
+		Strict:   input.Strict,
+		Labels:   input.Labels,
+	}
+	run, err := h.queries.newRun(r, &req)
+	if err != nil {
+		metrics.FiddleImport.Imported("rejected")
+		writeError(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	run.ImportedFrom = input.URL
+	editToken := run.GenerateEditToken()
+
+	err = h.queries.runRepo.Create(r.Context(), run)
+	if err != nil {
+		metrics.FiddleImport.Imported("failed")
+		zlog.Error().Err(err).Str("run_id", run.ID).Msg("failed to save an imported fiddle")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	metrics.FiddleImport.Imported("imported")
+	writeResult(w, ImportOutput{
+		QueryRunID: run.ID,
+		Version:    run.Version,
+		Statements: statements,
+		Input:      run.Input,
+		Warnings:   newWarningsOutput(run.Warnings),
+		EditToken:  editToken,
+	})
+}
+
+// importErrorStatus maps fetch failures to the response status and the message shown to the client.
+// Details of the remote host are not exposed beyond the status code.
+func importErrorStatus(err error) (int, string) {
+	var statusErr *fiddleimport.StatusError
+
+	switch {
+	case errors.Is(err, fiddleimport.ErrInvalidURL), errors.Is(err, fiddleimport.ErrHostNotAllowed):
+		return http.StatusBadRequest, err.Error()
+
+	case errors.Is(err, fiddleimport.ErrNotPublic):
+		return http.StatusBadRequest, "url must point to a public address"
+
+	case errors.Is(err, fiddleimport.ErrTooLarge), errors.Is(err, fiddleimport.ErrBadContent):
+		return http.StatusUnprocessableEntity, err.Error()
+
+	case errors.As(err, &statusErr):
+		return http.StatusBadGateway, fmt.Sprintf("remote host responded with status %d", statusErr.StatusCode)
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "remote host has not responded in time"
+
+	default:
+		return http.StatusBadGateway, "failed to fetch the url"
+	}
+}
@@ -0,0 +1,144 @@
+package restapi
+
+import (
+	"net/http"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type gcReportHandler struct {
+	gc GCReporter
+}
+
+func newGCReportHandler(gc GCReporter) *gcReportHandler {
+	return &gcReportHandler{gc: gc}
+}
+
+func (h *gcReportHandler) handle(r chi.Router) {
+	r.Get("/gc/report", h.getReports)
+}
+
+type GCReportsOutput struct {
+	Reports []GCReportOutput `json:"reports"`
+}
+
+type GCReportOutput struct {
+	Runner     string    `json:"runner"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+
+	Inputs GCInputsOutput `json:"inputs"`
+
+	Containers    []GCDecisionOutput `json:"containers"`
+	ImagesByCount []GCDecisionOutput `json:"images_by_count"`
+	ImagesBySize  []GCDecisionOutput `json:"images_by_size"`
+
+	ImagesByDiskPressure []GCDecisionOutput `json:"images_by_disk_pressure"`
+
+	Volumes                  []GCDecisionOutput `json:"volumes"`
+	VolumesReclaimedBytes    uint64             `json:"volumes_reclaimed_bytes"`
+	BuildCacheReclaimedBytes uint64             `json:"build_cache_reclaimed_bytes"`
+}
+
+type GCInputsOutput struct {
+	ContainerTTLMs       *int64 `json:"container_ttl_ms"`
+	PausedContainerTTLMs int64  `json:"paused_container_ttl_ms"`
+
+	ImageCountThreshold *uint   `json:"image_count_threshold"`
+	ImageBufferSize     uint    `json:"image_buffer_size"`
+	ImageSizeBudget     *uint64 `json:"image_size_budget"`
+
+	ImageCount int    `json:"image_count"`
+	ImageUsage uint64 `json:"image_usage"`
+
+	DiskHighWatermark float64 `json:"disk_high_watermark"`
+	DiskLowWatermark  float64 `json:"disk_low_watermark"`
+	DiskUsage         uint64  `json:"disk_usage"`
+	DiskCapacity      uint64  `json:"disk_capacity"`
+}
+
+type GCDecisionOutput struct {
+	ID        string   `json:"id"`
+	Names     []string `json:"names,omitempty"`
+	Removed   bool     `json:"removed"`
+	Reason    string   `json:"reason"`
+	SizeBytes uint64   `json:"size_bytes"`
+	AgeMs     int64    `json:"age_ms"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// getReports returns the latest garbage collection report of every runner.
+// If history=true is passed, all the kept reports are returned.
+func (h *gcReportHandler) getReports(w http.ResponseWriter, r *http.Request) {
+	history := r.URL.Query().Get("history") == "true"
+
+	output := GCReportsOutput{Reports: make([]GCReportOutput, 0)}
+	seen := make(map[string]struct{})
+	for _, report := range h.gc.GCReports() {
+		if _, found := seen[report.Runner]; found && !history {
+			continue
+		}
+		seen[report.Runner] = struct{}{}
+
+		output.Reports = append(output.Reports, convertGCReport(report))
+	}
+
+	writeResult(w, output)
+}
+
+func convertGCReport(report qrunner.GCReport) GCReportOutput {
+	output := GCReportOutput{
+		Runner:     report.Runner,
+		StartedAt:  report.StartedAt,
+		FinishedAt: report.FinishedAt,
+		Error:      report.Error,
+		Inputs: GCInputsOutput{
+			PausedContainerTTLMs: report.Inputs.PausedContainerTTL.Milliseconds(),
+			ImageCountThreshold:  report.Inputs.ImageCountThreshold,
+			ImageBufferSize:      report.Inputs.ImageBufferSize,
+			ImageSizeBudget:      report.Inputs.ImageSizeBudget,
+			ImageCount:           report.Inputs.ImageCount,
+			ImageUsage:           report.Inputs.ImageUsage,
+			DiskHighWatermark:    report.Inputs.DiskHighWatermark,
+			DiskLowWatermark:     report.Inputs.DiskLowWatermark,
+			DiskUsage:            report.Inputs.DiskUsage,
+			DiskCapacity:         report.Inputs.DiskCapacity,
+		},
+		Containers:    convertGCDecisions(report.Containers),
+		ImagesByCount: convertGCDecisions(report.ImagesByCount),
+		ImagesBySize:  convertGCDecisions(report.ImagesBySize),
+
+		ImagesByDiskPressure: convertGCDecisions(report.ImagesByDiskPressure),
+
+		Volumes:                  convertGCDecisions(report.Volumes),
+		VolumesReclaimedBytes:    report.VolumesReclaimed,
+		BuildCacheReclaimedBytes: report.BuildCacheReclaimed,
+	}
+	if ttl := report.Inputs.ContainerTTL; ttl != nil {
+		ms := ttl.Milliseconds()
+		output.Inputs.ContainerTTLMs = &ms
+	}
+
+	return output
+}
+
+func convertGCDecisions(decisions []qrunner.GCDecision) []GCDecisionOutput {
+	output := make([]GCDecisionOutput, 0, len(decisions))
+	for _, d := range decisions {
+		output = append(output, GCDecisionOutput{
+			ID:        d.ID,
+			Names:     d.Names,
+			Removed:   d.Removed,
+			Reason:    d.Reason,
+			SizeBytes: d.SizeBytes,
+			AgeMs:     d.Age.Milliseconds(),
+			Error:     d.Error,
+		})
+	}
+
+	return output
+}
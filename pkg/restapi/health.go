@@ -0,0 +1,120 @@
+package restapi
+
+import (
+	"net/http"
+	"time"
+
+	"clickhouse-playground/internal/health"
+)
+
+type healthHandler struct {
+	reporter HealthReporter
+
+	// detailed exposes errors of dependency checks. They may reveal internal addresses,
+	// so they are returned only by the admin API.
+	detailed bool
+}
+
+func newHealthHandler(reporter HealthReporter, detailed bool) *healthHandler {
+	return &healthHandler{
+		reporter: reporter,
+		detailed: detailed,
+	}
+}
+
+type HealthOutput struct {
+	// Status is "ok", "degraded" or "unhealthy".
+	Status       string             `json:"status"`
+	Dependencies []DependencyOutput `json:"dependencies"`
+}
+
+type DependencyOutput struct {
+	Name        string `json:"name"`
+	Criticality string `json:"criticality"`
+
+	// Status is "ok", "failing" or "unknown" if the dependency has not been checked yet.
+	Status    string     `json:"status"`
+	LatencyMs int64      `json:"latency_ms"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// getHealth returns the cached verdicts on dependencies. The status is 503 only if the service is unhealthy,
+// degraded services still serve requests.
+func (h *healthHandler) getHealth(w http.ResponseWriter, _ *http.Request) {
+	report := h.reporter.Report()
+
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == health.StatusUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	writeResult(w, newHealthOutput(report, h.detailed))
+}
+
+func newHealthOutput(report health.Report, detailed bool) HealthOutput {
+	output := HealthOutput{
+		Status:       string(report.Status),
+		Dependencies: make([]DependencyOutput, 0, len(report.Dependencies)),
+	}
+	for _, d := range report.Dependencies {
+		dep := DependencyOutput{
+			Name:        d.Name,
+			Criticality: string(d.Criticality),
+			Status:      string(d.Status),
+			LatencyMs:   d.Latency.Milliseconds(),
+			LastSuccess: d.LastSuccess,
+		}
+		if !d.CheckedAt.IsZero() {
+			checkedAt := d.CheckedAt
+			dep.CheckedAt = &checkedAt
+		}
+		if detailed {
+			dep.LastError = d.LastError
+		}
+
+		output.Dependencies = append(output.Dependencies, dep)
+	}
+
+	return output
+}
+
+// Probes are polled by orchestrators every few seconds, so they are excluded from access logs and metrics.
+const (
+	pathLiveness  = "/healthz"
+	pathReadiness = "/readyz"
+)
+
+func isProbeRequest(r *http.Request) bool {
+	return r.URL.Path == pathLiveness || r.URL.Path == pathReadiness
+}
+
+// getLiveness tells that the process is up and serves requests. It doesn't check dependencies,
+// so a failing dependency doesn't get the instance restarted.
+func getLiveness(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeResult(w, HealthOutput{Status: string(health.StatusOK), Dependencies: []DependencyOutput{}})
+}
+
+type readinessHandler struct {
+	checker ReadinessChecker
+}
+
+func newReadinessHandler(checker ReadinessChecker) *readinessHandler {
+	return &readinessHandler{checker: checker}
+}
+
+// getReadiness probes the dependencies on every request. The status is 503 until all of them respond,
+// the checker bounds the response time even if a dependency hangs.
+func (h *readinessHandler) getReadiness(w http.ResponseWriter, r *http.Request) {
+	report := h.checker.Check(r.Context())
+
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != health.StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	writeResult(w, newHealthOutput(report, false))
+}
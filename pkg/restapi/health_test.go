@@ -0,0 +1,67 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"clickhouse-playground/internal/health"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticReadiness struct {
+	report health.Report
+}
+
+func (s *staticReadiness) Check(context.Context) health.Report {
+	return s.report
+}
+
+func TestProbes(t *testing.T) {
+	var logs bytes.Buffer
+	readiness := &staticReadiness{report: health.Report{
+		Status: health.StatusUnhealthy,
+		Dependencies: []health.Result{
+			{Name: "dockertag", Criticality: health.CriticalityCritical, Status: health.StatusFailing, LastError: "has never been updated"},
+			{Name: "runners", Criticality: health.CriticalityCritical, Status: health.StatusOK},
+		},
+	}}
+	router := NewRouter(RouterOpts{
+		Logger:     zerolog.New(&logs),
+		RequestLog: RequestLogConfig{SuccessLevel: zerolog.InfoLevel},
+		Readiness:  readiness,
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		return rec
+	}
+
+	rec := serve("/healthz")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var resp struct {
+		Result HealthOutput `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "unhealthy", resp.Result.Status)
+	require.Len(t, resp.Result.Dependencies, 2)
+	assert.Equal(t, "failing", resp.Result.Dependencies[0].Status)
+	assert.Empty(t, resp.Result.Dependencies[0].LastError, "errors are not exposed by the public API")
+
+	readiness.report = health.Report{Status: health.StatusOK}
+	assert.Equal(t, http.StatusOK, serve("/readyz").Code)
+
+	assert.Empty(t, logs.String(), "probes must not be logged")
+}
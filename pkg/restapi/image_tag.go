@@ -2,35 +2,293 @@ package restapi
 
 import (
 	"net/http"
+	"strconv"
+	"time"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/pkg/chsemver"
 
 	"github.com/go-chi/chi/v5"
+	zlog "github.com/rs/zerolog/log"
 )
 
 type imageTagHandler struct {
 	tagStorage TagStorage
+	images     ImageInspector
+
+	// canary is optional. If it's nil, versions are never reported as degraded.
+	canary CanaryStatus
+
+	// journal is optional. If it's nil, changes of the tag list are not served.
+	journal TagJournal
 }
 
-func newImageTagHandler(storage TagStorage) *imageTagHandler {
+func newImageTagHandler(storage TagStorage, images ImageInspector) *imageTagHandler {
 	return &imageTagHandler{
 		tagStorage: storage,
+		images:     images,
 	}
 }
 
 func (h *imageTagHandler) handle(r chi.Router) {
 	r.Get("/tags", h.getImageTags)
+	if h.journal != nil {
+		r.Get("/tags/changes", h.getTagChanges)
+	}
+	r.Get("/tags/{version}/estimate", h.getPullEstimate)
+	r.Get("/versions", h.listVersions)
 }
 
 type GetImageTagsOutput struct {
 	Tags []string `json:"tags"`
+
+	// Versions describe the same tags in more detail.
+	Versions []VersionOutput `json:"versions"`
+
+	// Generation of the tag list can be passed to GET /api/tags/changes to get the changes after it.
+	Generation uint64 `json:"generation"`
+}
+
+type VersionOutput struct {
+	Tag string `json:"tag"`
+
+	// Deprecated versions are not supported upstream anymore. Message explains why.
+	Deprecated bool   `json:"deprecated,omitempty"`
+	Message    string `json:"message,omitempty"`
+
+	// Degraded versions have failed the latest canary check. DegradedReason describes the failure.
+	Degraded       bool   `json:"degraded,omitempty"`
+	DegradedReason string `json:"degraded_reason,omitempty"`
 }
 
 func (h *imageTagHandler) getImageTags(w http.ResponseWriter, _ *http.Request) {
-	tags := h.tagStorage.GetAll()
+	snapshot := h.tagStorage.Snapshot()
+	tags := snapshot.Images
 
 	names := make([]string, 0, len(tags))
+	versions := make([]VersionOutput, 0, len(tags))
 	for _, t := range tags {
 		names = append(names, t.Tag)
+
+		deprecation, deprecated := h.tagStorage.Deprecation(t.Tag)
+		version := VersionOutput{
+			Tag:        t.Tag,
+			Deprecated: deprecated,
+			Message:    deprecation.Message,
+		}
+		if h.canary != nil {
+			version.DegradedReason, version.Degraded = h.canary.Degraded(t.Tag)
+		}
+
+		versions = append(versions, version)
+	}
+
+	writeResult(w, GetImageTagsOutput{Tags: names, Versions: versions, Generation: snapshot.Generation})
+}
+
+type ListVersionsOutput struct {
+	Versions []KnownVersionOutput `json:"versions"`
+
+	// UpdatedAt is when the versions have been fetched from the registry. It's null until the first fetch.
+	UpdatedAt *time.Time `json:"updated_at"`
+
+	// Generation of the tag list can be passed to GET /api/tags/changes to get the changes after it.
+	Generation uint64 `json:"generation"`
+}
+
+type KnownVersionOutput struct {
+	Tag        string    `json:"tag"`
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	PushedAt   time.Time `json:"pushed_at"`
+
+	// Architectures are the architectures the version is built for, e.g. amd64 and arm64.
+	// Runners of other architectures refuse the version.
+	Architectures []string `json:"architectures"`
+
+	// Rolling tags (e.g. head) are rebuilt regularly, BuildDate is when the current digest has been built.
+	Rolling   bool       `json:"rolling,omitempty"`
+	BuildDate *time.Time `json:"build_date,omitempty"`
+}
+
+// listVersions returns tags that can be passed to runs with their digests and push times.
+// Tags can be filtered by a version prefix (e.g. "21.8"), and floating tags (latest, head)
+// and image variants (e.g. "-alpine") are hidden if releases_only=true is passed.
+func (h *imageTagHandler) listVersions(w http.ResponseWriter, r *http.Request) {
+	prefix := chsemver.Parse(r.URL.Query().Get("prefix"))
+	releasesOnly := r.URL.Query().Get("releases_only") == "true"
+
+	snapshot := h.tagStorage.Snapshot()
+
+	output := ListVersionsOutput{
+		Versions:   make([]KnownVersionOutput, 0, len(snapshot.Images)),
+		Generation: snapshot.Generation,
+	}
+	if !snapshot.UpdatedAt.IsZero() {
+		output.UpdatedAt = &snapshot.UpdatedAt
+	}
+
+	for _, img := range snapshot.Images {
+		parsed := chsemver.Parse(img.Tag)
+		if !chsemver.HasPrefix(parsed, prefix) || (releasesOnly && !chsemver.IsNumeric(parsed)) {
+			continue
+		}
+
+		version := KnownVersionOutput{
+			Tag:           img.Tag,
+			Repository:    img.Repository,
+			Digest:        img.Digest,
+			PushedAt:      img.PushedAt,
+			Architectures: img.Architectures(),
+			Rolling:       img.Rolling,
+		}
+		if !img.BuildDate.IsZero() {
+			buildDate := img.BuildDate
+			version.BuildDate = &buildDate
+		}
+
+		output.Versions = append(output.Versions, version)
+	}
+
+	writeResult(w, output)
+}
+
+type PullEstimateOutput struct {
+	// Version is the tag the requested version has been resolved to.
+	Version string `json:"version"`
+
+	// Present is true if the image has already been pulled by an alive runner, so there is no pull.
+	Present bool `json:"present"`
+
+	// SizeBytes is the compressed image size. It's null if Docker Hub has not reported it.
+	SizeBytes *int64 `json:"size_bytes"`
+
+	// EstimatedPull is null if the image is present or there is not enough data to estimate the pull.
+	EstimatedPull *DurationRangeOutput `json:"estimated_pull"`
+}
+
+type DurationRangeOutput struct {
+	MinMs int64 `json:"min_ms"`
+	MaxMs int64 `json:"max_ms"`
+}
+
+// getPullEstimate tells whether a run of the version is going to wait for the image pull and how long.
+// The estimate is based on the image size and the throughput of recent pulls.
+func (h *imageTagHandler) getPullEstimate(w http.ResponseWriter, r *http.Request) {
+	img, found := h.tagStorage.Resolve(chi.URLParam(r, "version"), false)
+	if !found {
+		writeError(w, "unknown version", http.StatusNotFound)
+		return
+	}
+
+	output := PullEstimateOutput{Version: img.Tag}
+	if img.Size > 0 {
+		output.SizeBytes = &img.Size
+	}
+
+	if h.images == nil {
+		writeResult(w, output)
+		return
+	}
+
+	state, err := h.images.ImageState(r.Context(), img.Tag)
+	if err != nil {
+		zlog.Error().Err(err).Str("version", img.Tag).Msg("failed to get image state")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	output.Present = state.Present
+	if !state.Present {
+		if estimate, ok := qrunner.EstimatePull(img.Size, state.Throughput); ok {
+			output.EstimatedPull = &DurationRangeOutput{
+				MinMs: estimate.Min.Milliseconds(),
+				MaxMs: estimate.Max.Milliseconds(),
+			}
+		}
+	}
+
+	writeResult(w, output)
+}
+
+type TagChangesOutput struct {
+	// Generation is the current generation, it's passed as since by the next request.
+	Generation uint64 `json:"generation"`
+
+	// Complete is false if some changes have been dropped from the journal, so the whole list must be reloaded.
+	Complete bool `json:"complete"`
+
+	Entries []TagChangesEntryOutput `json:"entries"`
+}
+
+type TagChangesEntryOutput struct {
+	Generation uint64            `json:"generation"`
+	At         time.Time         `json:"at"`
+	Changes    []TagChangeOutput `json:"changes"`
+}
+
+type TagChangeOutput struct {
+	// Kind is added, removed or digest_changed.
+	Kind           string `json:"kind"`
+	Tag            string `json:"tag"`
+	Digest         string `json:"digest,omitempty"`
+	PreviousDigest string `json:"previous_digest,omitempty"`
+
+	// Canary is the latest canary verdict on an added tag, e.g. passed. It's omitted until the tag is checked.
+	Canary       string `json:"canary,omitempty"`
+	CanaryReason string `json:"canary_reason,omitempty"`
+}
+
+// getTagChanges returns changes of the tag list after the point passed in since:
+// a generation returned by the versions endpoints or an RFC 3339 time. Without it, all journaled changes are returned.
+func (h *imageTagHandler) getTagChanges(w http.ResponseWriter, r *http.Request) {
+	var changelog dockertag.Changelog
+
+	since := r.URL.Query().Get("since")
+	if generation, err := strconv.ParseUint(since, 10, 64); err == nil || since == "" {
+		changelog = h.journal.ChangesSince(generation)
+	} else {
+		at, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeError(w, "since must be a generation or an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+
+		changelog = h.journal.ChangesAfter(at)
+	}
+
+	output := TagChangesOutput{
+		Generation: changelog.Generation,
+		Complete:   changelog.Complete,
+		Entries:    make([]TagChangesEntryOutput, 0, len(changelog.Entries)),
+	}
+	for _, e := range changelog.Entries {
+		entry := TagChangesEntryOutput{
+			Generation: e.Generation,
+			At:         e.At,
+			Changes:    make([]TagChangeOutput, 0, len(e.Changes)),
+		}
+		for _, c := range e.Changes {
+			change := TagChangeOutput{
+				Kind:           string(c.Kind),
+				Tag:            c.Tag,
+				Digest:         c.Digest,
+				PreviousDigest: c.PreviousDigest,
+			}
+			if c.Kind == dockertag.ChangeAdded && h.canary != nil {
+				if verdict, found := h.canary.Verdict(c.Tag); found {
+					change.Canary = string(verdict.Status)
+					change.CanaryReason = verdict.Reason
+				}
+			}
+
+			entry.Changes = append(entry.Changes, change)
+		}
+
+		output.Entries = append(output.Entries, entry)
 	}
 
-	writeResult(w, GetImageTagsOutput{Tags: names})
+	writeResult(w, output)
 }
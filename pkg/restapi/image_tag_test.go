@@ -0,0 +1,156 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/canary"
+	"clickhouse-playground/internal/dockertag"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotTagStorage serves a fixed snapshot. Methods that are not needed by tests are not implemented.
+type snapshotTagStorage struct {
+	TagStorage
+	snapshot dockertag.Snapshot
+}
+
+func (s snapshotTagStorage) Snapshot() dockertag.Snapshot {
+	return s.snapshot
+}
+
+func TestListVersions(t *testing.T) {
+	var images []dockertag.Image
+	for _, tag := range []string{"latest", "head", "22.3.12.19", "22.3.12.19-alpine", "21.8.15.7", "21.80.1"} {
+		images = append(images, dockertag.Image{Tag: tag, Digest: "sha256:" + tag})
+	}
+	images[1].Rolling = true
+	images[1].BuildDate = time.Now()
+
+	router := chi.NewRouter()
+	storage := snapshotTagStorage{snapshot: dockertag.Snapshot{Images: images, UpdatedAt: time.Now()}}
+	newImageTagHandler(storage, nil).handle(router)
+
+	list := func(query string) []string {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/versions"+query, http.NoBody))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Result ListVersionsOutput `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.NotNil(t, resp.Result.UpdatedAt)
+
+		tags := make([]string, 0, len(resp.Result.Versions))
+		for _, v := range resp.Result.Versions {
+			assert.Equal(t, "sha256:"+v.Tag, v.Digest)
+			assert.Equal(t, v.Tag == "head", v.Rolling)
+			assert.Equal(t, v.Tag == "head", v.BuildDate != nil)
+			tags = append(tags, v.Tag)
+		}
+
+		return tags
+	}
+
+	assert.Len(t, list(""), len(images))
+	assert.Equal(t, []string{"22.3.12.19", "21.8.15.7", "21.80.1"}, list("?releases_only=true"))
+	assert.Equal(t, []string{"21.8.15.7"}, list("?prefix=21.8"))
+	assert.Equal(t, []string{"22.3.12.19", "22.3.12.19-alpine"}, list("?prefix=22.3"))
+	assert.Equal(t, []string{"22.3.12.19"}, list("?prefix=22.3&releases_only=true"))
+	assert.Equal(t, []string{"latest"}, list("?prefix=latest"))
+	assert.Empty(t, list("?prefix=19"))
+}
+
+type staticTagJournal struct {
+	changelog dockertag.Changelog
+	since     *uint64
+	after     *time.Time
+}
+
+func (j *staticTagJournal) ChangesSince(generation uint64) dockertag.Changelog {
+	j.since = &generation
+	return j.changelog
+}
+
+func (j *staticTagJournal) ChangesAfter(t time.Time) dockertag.Changelog {
+	j.after = &t
+	return j.changelog
+}
+
+type verdictCanary struct {
+	verdicts map[string]canary.Result
+}
+
+func (c verdictCanary) Degraded(string) (string, bool) {
+	return "", false
+}
+
+func (c verdictCanary) Verdict(version string) (canary.Result, bool) {
+	res, found := c.verdicts[version]
+	return res, found
+}
+
+func TestTagChanges(t *testing.T) {
+	journal := &staticTagJournal{changelog: dockertag.Changelog{
+		Generation: 7,
+		Complete:   true,
+		Entries: []dockertag.JournalEntry{{
+			Generation: 7,
+			At:         time.Now(),
+			Changes: []dockertag.Change{
+				{Kind: dockertag.ChangeAdded, Tag: "23.4", Digest: "sha256:b"},
+				{Kind: dockertag.ChangeAdded, Tag: "23.5", Digest: "sha256:c"},
+				{Kind: dockertag.ChangeRemoved, Tag: "23.3", PreviousDigest: "sha256:a"},
+			},
+		}},
+	}}
+
+	router := chi.NewRouter()
+	h := newImageTagHandler(snapshotTagStorage{}, nil)
+	h.journal = journal
+	h.canary = verdictCanary{verdicts: map[string]canary.Result{
+		"23.4": {Version: "23.4", Status: canary.StatusFailed, Reason: "server has not started"},
+	}}
+	h.handle(router)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tags/changes"+query, http.NoBody))
+
+		return rec
+	}
+
+	rec := get("?since=6")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, journal.since)
+	assert.Equal(t, uint64(6), *journal.since)
+
+	var resp struct {
+		Result TagChangesOutput `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, uint64(7), resp.Result.Generation)
+	assert.True(t, resp.Result.Complete)
+	require.Len(t, resp.Result.Entries, 1)
+
+	changes := resp.Result.Entries[0].Changes
+	require.Len(t, changes, 3)
+	assert.Equal(t, "failed", changes[0].Canary)
+	assert.Equal(t, "server has not started", changes[0].CanaryReason)
+	assert.Empty(t, changes[1].Canary, "the version has not been checked yet")
+	assert.Equal(t, "removed", changes[2].Kind)
+
+	rec = get("?since=2023-05-01T10:00:00Z")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, journal.after)
+	assert.Equal(t, 2023, journal.after.Year())
+
+	assert.Equal(t, http.StatusBadRequest, get("?since=yesterday").Code)
+}
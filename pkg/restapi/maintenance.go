@@ -0,0 +1,132 @@
+package restapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"clickhouse-playground/internal/health"
+
+	"github.com/go-chi/chi/v5"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// ReasonMaintenance is set when a run cannot be executed because the service is in the maintenance mode
+// and the result is not cached.
+const ReasonMaintenance = "maintenance"
+
+// MaintenanceOutput is the state of the maintenance mode. While it's active, runs are served from the result cache
+// only, stored runs are served as usual.
+type MaintenanceOutput struct {
+	Active bool `json:"active"`
+
+	// Forced is true if operators have entered the mode, otherwise, runners are down.
+	Forced bool `json:"forced"`
+
+	Since             *time.Time `json:"since,omitempty"`
+	Message           string     `json:"message,omitempty"`
+	EstimatedRecovery *time.Time `json:"estimated_recovery,omitempty"`
+}
+
+func newMaintenanceOutput(state health.MaintenanceState) MaintenanceOutput {
+	output := MaintenanceOutput{
+		Active:            state.Active,
+		Forced:            state.Forced,
+		Message:           state.Message,
+		EstimatedRecovery: state.EstimatedRecovery,
+	}
+	if state.Active && !state.Since.IsZero() {
+		since := state.Since
+		output.Since = &since
+	}
+
+	return output
+}
+
+// maintenanceState returns the state of the mode if it's active.
+func (h *queryHandler) maintenanceState() (health.MaintenanceState, bool) {
+	if h.maintenance == nil {
+		return health.MaintenanceState{}, false
+	}
+
+	state := h.maintenance.State()
+
+	return state, state.Active
+}
+
+// writeMaintenance responds to a request that needs a runner while the service is in the maintenance mode.
+func writeMaintenance(w http.ResponseWriter, state health.MaintenanceState) {
+	resp := &ErrorResponse{
+		Message: fmt.Sprintf("service is under maintenance: %s", state.Message),
+		Code:    http.StatusServiceUnavailable,
+		Reason:  ReasonMaintenance,
+	}
+
+	if state.EstimatedRecovery != nil {
+		retryAt := state.EstimatedRecovery.UTC()
+		resp.RetryAt = &retryAt
+
+		retryAfter := math.Ceil(time.Until(retryAt).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(retryAfter, 0))))
+	}
+
+	writeErrorResponse(w, resp)
+}
+
+type maintenanceHandler struct {
+	maintenance MaintenanceControl
+}
+
+func newMaintenanceHandler(maintenance MaintenanceControl) *maintenanceHandler {
+	return &maintenanceHandler{maintenance: maintenance}
+}
+
+func (h *maintenanceHandler) handle(r chi.Router) {
+	r.Get("/maintenance", h.get)
+	r.Post("/maintenance", h.force)
+	r.Delete("/maintenance", h.clear)
+}
+
+type ForceMaintenanceInput struct {
+	Message           string     `json:"message"`
+	EstimatedRecovery *time.Time `json:"estimated_recovery"`
+}
+
+func (h *maintenanceHandler) get(w http.ResponseWriter, _ *http.Request) {
+	writeResult(w, newMaintenanceOutput(h.maintenance.State()))
+}
+
+// force enters the maintenance mode until it's cleared.
+func (h *maintenanceHandler) force(w http.ResponseWriter, r *http.Request) {
+	var input ForceMaintenanceInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.EstimatedRecovery != nil && !input.EstimatedRecovery.After(time.Now()) {
+		writeError(w, "estimated recovery must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	state := h.maintenance.Force(input.Message, input.EstimatedRecovery)
+	zlog.Info().
+		Bool("audit", true).
+		Str("message", input.Message).
+		Interface("estimated_recovery", input.EstimatedRecovery).
+		Msg("maintenance mode has been forced")
+
+	writeResult(w, newMaintenanceOutput(state))
+}
+
+// clear stops forcing the maintenance mode. It stays active while runners are down.
+func (h *maintenanceHandler) clear(w http.ResponseWriter, _ *http.Request) {
+	state := h.maintenance.Clear()
+	zlog.Info().Bool("audit", true).Msg("forced maintenance mode has been cleared")
+
+	writeResult(w, newMaintenanceOutput(state))
+}
@@ -0,0 +1,126 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/health"
+	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/internal/resultcache"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticMaintenance struct {
+	state health.MaintenanceState
+}
+
+func (m *staticMaintenance) State() health.MaintenanceState {
+	return m.state
+}
+
+func TestRunUnderMaintenance(t *testing.T) {
+	runs := 0
+	runner := funcRunner{run: func(*queryrun.Run) (string, error) {
+		runs++
+		return "1\n", nil
+	}}
+
+	maintenance := &staticMaintenance{}
+	h := newQueryHandler(runner, nil, seriesTagStorage{}, nil, resultcache.New(resultcache.Config{TTL: time.Hour, MaxSizeBytes: 1 << 20}),
+		nil, &inflightRuns{}, time.Minute, 1000, 1000)
+	h.maintenance = maintenance
+
+	run := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.runQuery(rec, httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(body)))
+
+		return rec
+	}
+
+	rec := run(`{"query": "SELECT 1", "version": "22.3.19.6"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 1, runs)
+
+	recovery := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	maintenance.state = health.MaintenanceState{Active: true, Message: "upgrade", EstimatedRecovery: &recovery, Revision: 1}
+
+	t.Run("cache hit", func(t *testing.T) {
+		rec := run(`{"query": "SELECT 1", "version": "22.3.19.6", "no_cache": true}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 1, runs, "cached results are served even if the cache is bypassed")
+
+		var resp struct {
+			Result RunQueryOutput `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.True(t, resp.Result.Cached)
+		assert.Equal(t, "1\n", resp.Result.Stdout)
+	})
+
+	t.Run("cache miss", func(t *testing.T) {
+		rec := run(`{"query": "SELECT 2", "version": "22.3.19.6"}`)
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, 1, runs)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+		var resp struct {
+			Error ErrorResponse `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, ReasonMaintenance, resp.Error.Reason)
+		assert.Contains(t, resp.Error.Message, "upgrade")
+		require.NotNil(t, resp.Error.RetryAt)
+		assert.True(t, recovery.Equal(*resp.Error.RetryAt))
+	})
+}
+
+func TestMetaMaintenance(t *testing.T) {
+	store, err := NewMetaStore(Meta{Branding: Branding{Name: "public"}})
+	require.NoError(t, err)
+
+	maintenance := &staticMaintenance{}
+	h := newMetaHandler(store)
+	h.maintenance = maintenance
+
+	router := chi.NewRouter()
+	h.handle(router)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/meta", http.NoBody)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := get("")
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.Equal(t, http.StatusNotModified, get(etag).Code)
+
+	maintenance.state = health.MaintenanceState{Active: true, Forced: true, Since: time.Now(), Message: "upgrade", Revision: 1}
+	rec = get(etag)
+	require.Equal(t, http.StatusOK, rec.Code, "the document changes with the maintenance state")
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+	var resp struct {
+		Result Meta `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.NotNil(t, resp.Result.Maintenance)
+	assert.True(t, resp.Result.Maintenance.Active)
+	assert.True(t, resp.Result.Maintenance.Forced)
+	assert.Equal(t, "upgrade", resp.Result.Maintenance.Message)
+	assert.NotNil(t, resp.Result.Maintenance.Since)
+}
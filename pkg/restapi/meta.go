@@ -0,0 +1,187 @@
+package restapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+// Meta describes capabilities of the deployment, so clients do not hardcode limits and features
+// that differ between deployments.
+type Meta struct {
+	Branding Branding     `json:"branding"`
+	Limits   MetaLimits   `json:"limits"`
+	Features MetaFeatures `json:"features"`
+	Formats  MetaFormats  `json:"formats"`
+
+	// Settings are run settings accepted by the deployment.
+	Settings []string `json:"settings"`
+
+	Versions MetaVersions `json:"versions"`
+
+	// Maintenance is the state of the maintenance mode, so clients can show a banner.
+	// It's set by the handler, since it changes apart from the config.
+	Maintenance *MaintenanceOutput `json:"maintenance,omitempty"`
+}
+
+type Branding struct {
+	Name       string `json:"name,omitempty"`
+	ContactURL string `json:"contact_url,omitempty"`
+}
+
+type MetaLimits struct {
+	MaxQueryLength  uint64 `json:"max_query_length"`
+	MaxOutputLength uint64 `json:"max_output_length"`
+
+	// TimeoutMs is the deadline of runs and container preparations.
+	TimeoutMs int64 `json:"timeout_ms"`
+
+	// MaxStatements is the max number of statements in a query. Zero means no limit.
+	MaxStatements int `json:"max_statements"`
+
+	// ContentEncodings are accepted encodings of compressed run bodies. Their decompressed length
+	// cannot exceed MaxExpandedBodyLength, the query length limit applies to the decompressed query.
+	ContentEncodings      []string `json:"content_encodings"`
+	MaxExpandedBodyLength uint64   `json:"max_expanded_body_length"`
+
+	// MaxFilesSize is the max total size of files of a run. Zero means files are not accepted.
+	MaxFilesSize uint64 `json:"max_files_size"`
+}
+
+type MetaFeatures struct {
+	// Sessions is true if interactive sessions are configured.
+	Sessions bool `json:"sessions"`
+
+	// Uploads is true if runs can have files. Datasets are not supported by the server yet, they are always disabled.
+	Uploads  bool `json:"uploads"`
+	Datasets bool `json:"datasets"`
+
+	// Compare is true if runs can be re-run on another version to compare outputs.
+	Compare bool `json:"compare"`
+	// Benchmark is true if the benchmark tool is configured.
+	Benchmark bool `json:"benchmark"`
+
+	Import      bool `json:"import"`
+	Bisect      bool `json:"bisect"`
+	Prepare     bool `json:"prepare"`
+	ResultCache bool `json:"result_cache"`
+
+	// Tools are names of auxiliary tools that can be run instead of queries.
+	Tools []string `json:"tools"`
+
+	// NetworkIsolation is the network access of query containers: none, internal, egress or default.
+	// If runners differ, the least isolated mode is reported.
+	NetworkIsolation string `json:"network_isolation"`
+}
+
+// Network isolation modes reported in MetaFeatures, from the most isolated one.
+const (
+	NetworkIsolationNone     = "none"
+	NetworkIsolationInternal = "internal"
+	NetworkIsolationEgress   = "egress"
+	NetworkIsolationDefault  = "default"
+)
+
+type MetaFormats struct {
+	Default string `json:"default"`
+
+	// Allowed output formats. Empty list means any format is allowed.
+	Allowed []string `json:"allowed"`
+}
+
+type MetaVersions struct {
+	// Default is the version preselected by clients.
+	Default string `json:"default,omitempty"`
+
+	// Deprecated are ranges of deprecated versions. If RejectDeprecated is true, they cannot be run.
+	Deprecated       []DeprecatedVersions `json:"deprecated"`
+	RejectDeprecated bool                 `json:"reject_deprecated"`
+}
+
+type DeprecatedVersions struct {
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+type metaDocument struct {
+	meta Meta
+	etag string
+}
+
+// MetaStore keeps the deployment description. It's replaced when the config is reloaded.
+type MetaStore struct {
+	doc atomic.Pointer[metaDocument]
+}
+
+func NewMetaStore(meta Meta) (*MetaStore, error) {
+	s := &MetaStore{}
+
+	err := s.Set(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Set replaces the description. The ETag is derived from the document, so it changes only with the config.
+func (s *MetaStore) Set(meta Meta) error {
+	serialized, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	sum := sha256.Sum256(serialized)
+	s.doc.Store(&metaDocument{
+		meta: meta,
+		etag: `"` + hex.EncodeToString(sum[:16]) + `"`,
+	})
+
+	return nil
+}
+
+func (s *MetaStore) get() *metaDocument {
+	return s.doc.Load()
+}
+
+type metaHandler struct {
+	store *MetaStore
+
+	// maintenance is optional. If it's nil, the description has no maintenance section.
+	maintenance MaintenanceMode
+}
+
+func newMetaHandler(store *MetaStore) *metaHandler {
+	return &metaHandler{store: store}
+}
+
+func (h *metaHandler) handle(r chi.Router) {
+	r.Get("/meta", h.getMeta)
+}
+
+func (h *metaHandler) getMeta(w http.ResponseWriter, r *http.Request) {
+	doc := h.store.get()
+	meta, etag := doc.meta, doc.etag
+
+	// The document changes on config reloads and maintenance transitions only, so clients revalidate it cheaply.
+	if h.maintenance != nil {
+		state := h.maintenance.State()
+		maintenance := newMaintenanceOutput(state)
+		meta.Maintenance = &maintenance
+		etag = fmt.Sprintf(`%s-%d"`, strings.TrimSuffix(etag, `"`), state.Revision)
+	}
+
+	if writeNotModified(w, r, etag, cacheControlRevalidate) {
+		return
+	}
+
+	writeResult(w, meta)
+}
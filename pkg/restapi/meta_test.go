@@ -0,0 +1,98 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeta(t *testing.T) {
+	store, err := NewMetaStore(Meta{
+		Branding: Branding{Name: "public"},
+		Limits:   MetaLimits{MaxQueryLength: 2500},
+	})
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	newMetaHandler(store).handle(router)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/meta", http.NoBody)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := get("")
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, cacheControlRevalidate, rec.Header().Get("Cache-Control"))
+
+	var resp struct {
+		Result Meta `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "public", resp.Result.Branding.Name)
+	assert.Equal(t, uint64(2500), resp.Result.Limits.MaxQueryLength)
+
+	assert.Equal(t, http.StatusNotModified, get(etag).Code)
+
+	// The same document keeps the ETag.
+	require.NoError(t, store.Set(Meta{
+		Branding: Branding{Name: "public"},
+		Limits:   MetaLimits{MaxQueryLength: 2500},
+	}))
+	assert.Equal(t, http.StatusNotModified, get(etag).Code)
+
+	// A reloaded config changes it.
+	require.NoError(t, store.Set(Meta{
+		Branding: Branding{Name: "internal"},
+		Limits:   MetaLimits{MaxQueryLength: 2500},
+	}))
+	rec = get(etag)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestCheckFormat(t *testing.T) {
+	withFormat := func(format string) *RunQueryInput {
+		return &RunQueryInput{Settings: RunSettings{ClickHouseSettings: &ClickHouseSettings{OutputFormat: format}}}
+	}
+
+	h := &queryHandler{}
+	assert.NoError(t, h.checkFormat(withFormat("Vertical")))
+	assert.ErrorContains(t, h.checkFormat(withFormat("JSON --query 'SELECT 2'")), "invalid output format")
+
+	h.allowedFormats = []string{"TabSeparated", "JSON"}
+	assert.NoError(t, h.checkFormat(withFormat("JSON")))
+	assert.NoError(t, h.checkFormat(withFormat("")))
+	assert.NoError(t, h.checkFormat(&RunQueryInput{}))
+	assert.ErrorContains(t, h.checkFormat(withFormat("Vertical")), "unsupported output format Vertical")
+}
+
+func TestApplyFormat(t *testing.T) {
+	req := &RunQueryInput{Format: "JSON"}
+	require.NoError(t, applyFormat(req))
+	assert.Equal(t, "JSON", req.Settings.ClickHouseSettings.OutputFormat)
+
+	req = &RunQueryInput{Format: "JSON", Settings: RunSettings{ClickHouseSettings: &ClickHouseSettings{OutputFormat: "JSON"}}}
+	assert.NoError(t, applyFormat(req))
+
+	req = &RunQueryInput{Format: "JSON", Settings: RunSettings{ClickHouseSettings: &ClickHouseSettings{OutputFormat: "CSV"}}}
+	assert.ErrorContains(t, applyFormat(req), "conflicts")
+
+	req = &RunQueryInput{}
+	require.NoError(t, applyFormat(req))
+	assert.Nil(t, req.Settings.ClickHouseSettings)
+}
@@ -0,0 +1,104 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+// ContentTypeNDJSON is the content type of streamed runs: a JSON object per line.
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// OutputChunkFrame is a part of stdout of a streamed run.
+type OutputChunkFrame struct {
+	Stdout string `json:"stdout"`
+}
+
+// outputStream streams stdout of a run as newline-delimited JSON frames. Until the first chunk is sent,
+// the response is written as usual, so requests failed beforehand get their status codes. Once the stream
+// has started, the status cannot be changed anymore: the response written by the handler becomes the trailing
+// frame, either a result or an error one, and chunks arriving after it are dropped.
+type outputStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	mu        sync.Mutex
+	started   bool
+	responded bool
+}
+
+func newOutputStream(w http.ResponseWriter) *outputStream {
+	return &outputStream{w: w, rc: http.NewResponseController(w)}
+}
+
+// isStreamRequested tells whether the client has asked for streaming by the stream query parameter.
+func isStreamRequested(r *http.Request) bool {
+	stream, _ := strconv.ParseBool(r.URL.Query().Get("stream"))
+	return stream
+}
+
+func (s *outputStream) Header() http.Header {
+	return s.w.Header()
+}
+
+func (s *outputStream) WriteHeader(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started || s.responded {
+		return
+	}
+	s.responded = true
+	s.w.WriteHeader(code)
+}
+
+func (s *outputStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responded = true
+
+	return s.w.Write(b)
+}
+
+func (s *outputStream) Unwrap() http.ResponseWriter {
+	return s.w
+}
+
+// WriteChunk sends a chunk of stdout and flushes it. Errors are only logged: if the client is gone,
+// the run is cancelled by the request context anyway.
+func (s *outputStream) WriteChunk(chunk []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.responded {
+		return
+	}
+	if !s.started {
+		s.w.Header().Set("Content-Type", ContentTypeNDJSON)
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+
+	err := json.NewEncoder(s.w).Encode(OutputChunkFrame{Stdout: string(chunk)})
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	if err != nil {
+		zlog.Debug().Err(err).Msg("output chunk cannot be sent")
+	}
+}
+
+// chunkWriter adapts the stream to io.Writer of runners, which report every chunk as written.
+type chunkWriter struct {
+	stream *outputStream
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	c.stream.WriteChunk(p)
+	return len(p), nil
+}
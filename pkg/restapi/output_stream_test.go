@@ -0,0 +1,42 @@
+package restapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	stream := newOutputStream(rec)
+	w := chunkWriter{stream: stream}
+
+	_, _ = w.Write([]byte("1\n"))
+	_, _ = w.Write([]byte("2\n"))
+
+	// The status cannot be changed once the stream has started, the error becomes the trailing frame.
+	writeError(stream, "output length (10) cannot exceed 5", http.StatusBadRequest)
+	_, _ = w.Write([]byte("3\n"))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeNDJSON, rec.Header().Get("Content-Type"))
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, `{"stdout":"1\n"}
+{"stdout":"2\n"}
+{"error":{"message":"output length (10) cannot exceed 5","code":400}}
+`, rec.Body.String())
+}
+
+func TestOutputStream_FailedBeforeStart(t *testing.T) {
+	rec := httptest.NewRecorder()
+	stream := newOutputStream(rec)
+
+	writeError(stream, "unknown version", http.StatusBadRequest)
+	_, _ = chunkWriter{stream: stream}.Write([]byte("1\n"))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `{"error":{"message":"unknown version","code":400}}
+`, rec.Body.String())
+}
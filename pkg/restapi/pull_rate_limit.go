@@ -0,0 +1,67 @@
+package restapi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+// ReasonPullRateLimited is set when the image cannot be pulled because of the registry rate limit
+// and no runner has pulled it before.
+const ReasonPullRateLimited = "pull_rate_limited"
+
+// pullRateLimitTimeout bounds the registry request made on the failure path of a run.
+const pullRateLimitTimeout = 3 * time.Second
+
+// writePullRateLimited responds to a run that no runner can serve because of the pull rate limit.
+// The reset time is estimated from the registry rate limit headers if possible.
+func (h *queryHandler) writePullRateLimited(ctx context.Context, w http.ResponseWriter, version string) {
+	resp := &ErrorResponse{
+		Message: fmt.Sprintf("Docker Hub pull rate limit has been reached and no runner has pulled version %s yet", version),
+		Code:    http.StatusServiceUnavailable,
+		Reason:  ReasonPullRateLimited,
+	}
+
+	retryAt, ok := h.pullRateLimitReset(ctx)
+	if ok {
+		resp.Message += fmt.Sprintf(", try again after %s", retryAt.Format(time.RFC3339))
+		resp.RetryAt = &retryAt
+
+		retryAfter := math.Ceil(time.Until(retryAt).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(retryAfter, 0))))
+	} else {
+		resp.Message += ", try again later"
+	}
+
+	writeErrorResponse(w, resp)
+}
+
+func (h *queryHandler) pullRateLimitReset(ctx context.Context) (time.Time, bool) {
+	if h.pullRateLimits == nil {
+		return time.Time{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pullRateLimitTimeout)
+	defer cancel()
+
+	rl, err := h.pullRateLimits.PullRateLimit(ctx)
+	if err != nil {
+		zlog.Warn().Err(err).Msg("failed to check pull rate limit")
+		return time.Time{}, false
+	}
+	if rl == nil {
+		return time.Time{}, false
+	}
+
+	resetAt, ok := rl.ResetAt(time.Now())
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return resetAt.UTC().Truncate(time.Second), true
+}
@@ -0,0 +1,57 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"clickhouse-playground/pkg/dockerhub"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pullRateLimitStub struct {
+	rl  *dockerhub.RateLimit
+	err error
+}
+
+func (s pullRateLimitStub) PullRateLimit(context.Context) (*dockerhub.RateLimit, error) {
+	return s.rl, s.err
+}
+
+func TestWritePullRateLimited(t *testing.T) {
+	respond := func(inspector PullRateLimitInspector) (*httptest.ResponseRecorder, ErrorResponse) {
+		h := &queryHandler{pullRateLimits: inspector}
+
+		rec := httptest.NewRecorder()
+		h.writePullRateLimited(context.Background(), rec, "23.3")
+
+		var resp Response
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.NotNil(t, resp.Error)
+
+		return rec, *resp.Error
+	}
+
+	rec, resp := respond(pullRateLimitStub{rl: &dockerhub.RateLimit{Limit: 100, Reset: time.Hour}})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, ReasonPullRateLimited, resp.Reason)
+	require.NotNil(t, resp.RetryAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *resp.RetryAt, time.Minute)
+	assert.Contains(t, resp.Message, "Docker Hub pull rate limit")
+	assert.Contains(t, resp.Message, "try again after")
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	for _, inspector := range []PullRateLimitInspector{nil, pullRateLimitStub{err: errors.New("unreachable")}, pullRateLimitStub{}} {
+		rec, resp = respond(inspector)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Nil(t, resp.RetryAt)
+		assert.Contains(t, resp.Message, "try again later")
+		assert.Empty(t, rec.Header().Get("Retry-After"))
+	}
+}
@@ -1,14 +1,22 @@
 package restapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
 	"clickhouse-playground/internal/qrunner"
 	"clickhouse-playground/internal/queryrun"
+	"clickhouse-playground/internal/resultcache"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/pkg/errors"
@@ -19,36 +27,176 @@ const (
 	ClickHouseDatabase = "clickhouse"
 )
 
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeSQL  = "application/sql"
+	ContentTypeText = "text/plain"
+)
+
+// How many closest versions are suggested when the requested version is unknown.
+const maxVersionSuggestions = 5
+
+var supportedRunContentTypes = []string{ContentTypeJSON, ContentTypeSQL, ContentTypeText}
+
 type queryHandler struct {
 	r       QueryRunner
 	runRepo queryrun.Repository
 
-	tagStorage TagStorage
+	tagStorage  TagStorage
+	policy      QueryPolicy
+	resultCache ResultCache
+
+	// runners are names of runners that can be selected by clients with the permission.
+	runners []string
+
+	// inflight exposes runs being processed to the timings handler.
+	inflight *inflightRuns
+
+	// runLimiter is optional. If it's nil, clients can run any number of queries at once.
+	runLimiter *ClientRunLimiter
+
+	// quota is optional. If it's nil, the daily runs of clients are not limited.
+	quota *Quota
+
+	// pullRateLimits is optional. If it's nil, the reset time of the pull rate limit is not reported.
+	pullRateLimits PullRateLimitInspector
+
+	// runTimeout is a deadline of run executions and container preparations.
+	runTimeout time.Duration
+
+	// deadlines is optional. If it's set, it resolves the run timeout and readiness limits by versions.
+	deadlines DeadlineResolver
+
+	// allowedFormats are output formats runs can request. If it's empty, any format is allowed.
+	allowedFormats []string
+
+	// finishAbandoned keeps runs going after their clients have disconnected. Otherwise, such runs are cancelled.
+	finishAbandoned bool
+
+	// exposeServerLogs returns the logs tail of database servers that have not started with the run error.
+	exposeServerLogs bool
+
+	// outputProcessor is optional. If it's nil, outputs are stored and returned as is.
+	outputProcessor OutputProcessor
+
+	// bodyLimits bound compressed bodies of runs. Compressed bodies are not accepted if the expanded limit is 0.
+	bodyLimits BodyLimits
+
+	// maintenance is optional. If it's nil, runs are always executed.
+	maintenance MaintenanceMode
+
+	// drain is optional. If it's nil, runs are accepted until the server is stopped.
+	drain *Drain
 
 	maxQueryLength  uint64
 	maxOutputLength uint64
+
+	// maxFilesSize bounds the total size of files of a run. Files are rejected if it's 0.
+	maxFilesSize uint64
 }
 
-func newQueryHandler(r QueryRunner, runRepo queryrun.Repository, storage TagStorage, maxQueryLength, maxOutputLength uint64) *queryHandler {
+func newQueryHandler(r QueryRunner, runRepo queryrun.Repository, storage TagStorage, policy QueryPolicy, resultCache ResultCache, runners []string, inflight *inflightRuns, runTimeout time.Duration, maxQueryLength, maxOutputLength uint64) *queryHandler {
 	return &queryHandler{
 		r:               r,
 		runRepo:         runRepo,
 		tagStorage:      storage,
+		policy:          policy,
+		resultCache:     resultCache,
+		runners:         runners,
+		inflight:        inflight,
+		runTimeout:      runTimeout,
 		maxQueryLength:  maxQueryLength,
 		maxOutputLength: maxOutputLength,
 	}
 }
 
-func (h *queryHandler) handle(r chi.Router) {
-	r.Post("/runs", h.runQuery)
-	r.Get("/runs/{id}", h.getQueryRun)
+// handleRuns registers routes which execute queries. They are limited by the run timeout
+// and must not be wrapped into the generic timeout middleware.
+func (h *queryHandler) handleRuns(r chi.Router) {
+	// Preparations are not counted by the daily quota, they are followed by runs.
+	runs := r
+	if h.quota != nil {
+		runs = r.With(h.quota.limitRuns)
+	}
+
+	runs.Post("/runs", h.runQuery)
+	runs.Post("/runs/{id}/rerun", requireRunStorage(h.runRepo, h.rerun))
+	r.Post("/prepare", h.prepare)
+	runs.Post("/explain", h.explain)
+}
+
+// handleLookups registers routes which are served from the storage only.
+func (h *queryHandler) handleLookups(r chi.Router) {
+	r.Get("/runs", requireRunStorage(h.runRepo, h.listQueryRuns))
+	r.Get("/runs/{id}", requireRunStorage(h.runRepo, h.getQueryRun))
+	r.Get("/runs/{id}/raw", requireRunStorage(h.runRepo, h.getRawOutput))
+	r.Get("/runs/{id}/bundle", requireRunStorage(h.runRepo, h.getBundle))
+	r.Patch("/runs/{id}/labels", requireRunStorage(h.runRepo, h.updateLabels))
+	r.Delete("/runs/{id}", requireRunStorage(h.runRepo, h.deleteRun))
 }
 
 type RunQueryInput struct {
-	Query    string      `json:"query"`
+	Query string `json:"query"`
+
+	// Statements are executed one by one in the same container instead of the query, and the result of every
+	// statement is returned. The run is stopped at the first failed statement unless ContinueOnError is set.
+	Statements      []string `json:"statements,omitempty"`
+	ContinueOnError bool     `json:"continue_on_error,omitempty"`
+
 	Version  string      `json:"version"`
 	Database string      `json:"database"`
 	Settings RunSettings `json:"settings"`
+
+	// Format is a shorthand for settings.clickhouse.output_format, e.g. "JSON".
+	Format string `json:"format,omitempty"`
+
+	// NoCache forces the query to be executed even if there is a cached result.
+	NoCache bool `json:"no_cache"`
+
+	// Strict disables resolution of partial versions: the version must be an existing tag.
+	Strict bool `json:"strict"`
+
+	// PreparationToken refers to a container prepared by the /prepare request.
+	PreparationToken string `json:"preparation_token,omitempty"`
+
+	// User-defined labels that can be used to find the run later.
+	Labels []string `json:"labels,omitempty"`
+
+	// Runner selects the runner that executes the query. It requires the select_runner permission.
+	Runner string `json:"runner,omitempty"`
+
+	// Tool runs an auxiliary tool configured by the operator instead of the query.
+	// The query is passed to the tool as its input.
+	Tool *ToolInput `json:"tool,omitempty"`
+
+	// Network opts out of the deployment network (e.g. restricted egress). The only allowed value is "none".
+	Network string `json:"network,omitempty"`
+
+	// AllowEmulation acknowledges that the run may be executed under emulation, so tools that need
+	// native execution (e.g. benchmarks) are run anyway.
+	AllowEmulation bool `json:"allow_emulation,omitempty"`
+
+	// KeepContainerOnFailure overrides the deployment setting that holds containers of failed runs for inspection.
+	// It requires the keep_container permission.
+	KeepContainerOnFailure *bool `json:"keep_container_on_failure,omitempty"`
+
+	// Priority is the class the run is scheduled in while runners are busy: interactive (default), async or background.
+	// It requires the set_priority permission.
+	Priority string `json:"priority,omitempty"`
+
+	// Resources override the container limits of the runner. It requires the set_resources permission.
+	Resources *ResourcesInput `json:"resources,omitempty"`
+
+	// Files are placed into the user files directory of the server before the query. They are saved with the run.
+	Files []FileInput `json:"files,omitempty"`
+
+	// pinned is the image of the original run if a re-run is pinned to it. The version is not resolved then.
+	pinned *dockertag.Image
+}
+
+type ToolInput struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params,omitempty"`
 }
 
 type RunSettings struct {
@@ -60,9 +208,71 @@ type ClickHouseSettings struct {
 }
 
 type RunQueryOutput struct {
-	QueryRunID  string `json:"query_run_id"`
-	Output      string `json:"output"`
+	QueryRunID string `json:"query_run_id"`
+	StreamsOutput
 	TimeElapsed string `json:"time_elapsed"`
+
+	// SetupMs is the time spent on the container (pull, create, start and readiness), QueryMs is the time
+	// spent on the query itself. A cold image makes the setup slow, not the query.
+	SetupMs int64 `json:"setup_ms"`
+	QueryMs int64 `json:"query_ms"`
+
+	// Timings break the elapsed time down by stages. Cached outputs have the total only.
+	Timings *TimingsOutput `json:"timings"`
+
+	// Version is the tag the requested version has been resolved to.
+	Version          string `json:"version"`
+	RequestedVersion string `json:"requested_version"`
+
+	// ServerVersion is the version reported by the database server.
+	// VersionMismatch is true if it does not match the resolved version.
+	ServerVersion   string `json:"server_version,omitempty"`
+	VersionMismatch bool   `json:"version_mismatch,omitempty"`
+
+	// ImageDigest is the digest of the image the version has been resolved to.
+	// ImageBuildDate is set for rolling tags (e.g. head) only.
+	ImageDigest    string     `json:"image_digest,omitempty"`
+	ImageBuildDate *time.Time `json:"image_build_date,omitempty"`
+
+	// Profile is the settings profile enforced by the deployment, e.g. "restricted".
+	Profile string `json:"profile,omitempty"`
+
+	Labels []string `json:"labels,omitempty"`
+
+	// Runner is the runner that has executed the query. It's returned only if the runner has been selected explicitly.
+	Runner string `json:"runner,omitempty"`
+
+	// Tool is the name of the tool that has been run instead of the query.
+	Tool string `json:"tool,omitempty"`
+
+	Network string `json:"network,omitempty"`
+
+	// EgressDenied lists destinations rejected by the restricted egress allowlist.
+	EgressDenied []string `json:"egress_denied,omitempty"`
+
+	// EmulatedArchitecture is the architecture of the image if the run has been executed under emulation.
+	EmulatedArchitecture string `json:"emulated_architecture,omitempty"`
+
+	// Warnings are non-fatal notices, e.g. the version is deprecated.
+	Warnings []WarningOutput `json:"warnings,omitempty"`
+
+	// Statements are the results of the statements if they have been executed separately.
+	Statements []StatementOutput `json:"statements,omitempty"`
+
+	// Files are the files that have been placed for the query.
+	Files []RunFileOutput `json:"files,omitempty"`
+
+	// EditToken allows editing the run (e.g. its labels). It's returned only once, when the run is created.
+	EditToken string `json:"edit_token,omitempty"`
+
+	// ParentRunID is the run that has been re-run. OutputChanged tells whether the output differs from the parent one.
+	ParentRunID   string `json:"parent_run_id,omitempty"`
+	OutputChanged *bool  `json:"output_changed,omitempty"`
+
+	// Cached is true when the output has been taken from the result cache.
+	// ExecutedAt is when the cached output was originally produced.
+	Cached     bool       `json:"cached,omitempty"`
+	ExecutedAt *time.Time `json:"executed_at,omitempty"`
 }
 
 func convertSettings(req *RunQueryInput) (runsettings.RunSettings, error) {
@@ -85,18 +295,126 @@ func convertSettings(req *RunQueryInput) (runsettings.RunSettings, error) {
 	return runSettings, nil
 }
 
-func (h *queryHandler) runQuery(w http.ResponseWriter, r *http.Request) {
+// decodeRunQueryInput parses the request body according to its content type.
+//
+// JSON is the default and fully-featured format. For raw SQL bodies (application/sql and text/plain),
+// the body is the query itself, and other parameters are taken from the URL query or X-ClickHouse-* headers.
+// It returns an http status code describing the failure if the input cannot be decoded.
+func (h *queryHandler) decodeRunQueryInput(r *http.Request) (RunQueryInput, int, error) {
 	var req RunQueryInput
-	err := json.NewDecoder(r.Body).Decode(&req)
+
+	mediaType := ContentTypeJSON
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return req, http.StatusBadRequest, errors.Wrap(err, "invalid content type")
+		}
+	}
+
+	switch mediaType {
+	case ContentTypeJSON:
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return req, http.StatusBadRequest, err
+		}
+
+	case ContentTypeSQL, ContentTypeText:
+		// Read one extra byte to detect bodies exceeding the limit.
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(h.maxQueryLength)+1))
+		if err != nil {
+			return req, http.StatusBadRequest, errors.Wrap(err, "failed to read body")
+		}
+
+		req.Query = string(body)
+		req.Version = paramOrHeader(r, "version", "X-ClickHouse-Version")
+		req.Database = paramOrHeader(r, "database", "X-ClickHouse-Database")
+		req.NoCache = paramOrHeader(r, "no_cache", "X-ClickHouse-No-Cache") == "true"
+		req.Strict = paramOrHeader(r, "strict", "X-ClickHouse-Strict") == "true"
+		req.PreparationToken = paramOrHeader(r, "preparation_token", "X-ClickHouse-Preparation-Token")
+		req.Runner = paramOrHeader(r, "runner", "X-ClickHouse-Runner")
+		req.Network = paramOrHeader(r, "network", "X-ClickHouse-Network")
+		req.Priority = paramOrHeader(r, "priority", "X-ClickHouse-Priority")
+
+		if labels := paramOrHeader(r, "labels", "X-ClickHouse-Labels"); labels != "" {
+			req.Labels = strings.Split(labels, ",")
+		}
+
+		req.Format = paramOrHeader(r, "format", "X-ClickHouse-Format")
+
+	default:
+		msg := fmt.Sprintf("unsupported content type %s (supported: %s)", mediaType, strings.Join(supportedRunContentTypes, ", "))
+		return req, http.StatusUnsupportedMediaType, errors.New(msg)
+	}
+
+	return req, http.StatusOK, nil
+}
+
+// paramOrHeader returns the URL query parameter value if it's set. Otherwise, the header value is returned.
+func paramOrHeader(r *http.Request, param, header string) string {
+	if value := r.URL.Query().Get(param); value != "" {
+		return value
+	}
+
+	return r.Header.Get(header)
+}
+
+func (h *queryHandler) runQuery(w http.ResponseWriter, r *http.Request) {
+	// The limits of the input are applied to the decompressed body.
+	status, err := decompressBody(r, h.bodyLimits)
 	if err != nil {
-		writeError(w, err.Error(), http.StatusBadRequest)
+		writeBodyReadError(w, err, status)
+		return
+	}
+
+	req, status, err := h.decodeRunQueryInput(r)
+	if err != nil {
+		writeBodyReadError(w, err, status)
 		return
 	}
 
-	if req.Query == "" {
+	if isStreamRequested(r) {
+		w = newOutputStream(w)
+	}
+
+	h.execute(w, r, &req, nil)
+}
+
+// execute validates the request, runs it and saves the new run.
+// If the run is a re-run of a stored one, parent is the original run.
+func (h *queryHandler) execute(w http.ResponseWriter, r *http.Request, req *RunQueryInput, parent *queryrun.Run) {
+	if len(req.Statements) > 0 {
+		err := checkStatements(req)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The statements are checked by the length limit and the policy as a whole, and they are stored as the input.
+		req.Query = queryrun.JoinStatements(req.Statements)
+	}
+	if req.Query == "" && req.Tool == nil {
 		writeError(w, "query cannot be empty", http.StatusBadRequest)
 		return
 	}
+	if req.Tool != nil && req.Tool.Name == "" {
+		writeError(w, "tool name cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if req.Tool != nil && req.PreparationToken != "" {
+		writeError(w, "tool runs cannot use prepared containers", http.StatusBadRequest)
+		return
+	}
+	if req.Tool != nil && len(req.Files) > 0 {
+		writeError(w, "tool runs cannot have files", http.StatusBadRequest)
+		return
+	}
+	if req.Network != "" && req.Network != queryrun.NetworkNone {
+		msg := fmt.Sprintf("unsupported network %s (supported: %s)", req.Network, queryrun.NetworkNone)
+		writeError(w, msg, http.StatusBadRequest)
+
+		return
+	}
 	if uint64(len(req.Query)) > h.maxQueryLength {
 		msg := fmt.Sprintf("query length (%d) cannot exceed %d", len(req.Query), h.maxQueryLength)
 		writeError(w, msg, http.StatusBadRequest)
@@ -104,32 +422,215 @@ func (h *queryHandler) runQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !h.tagStorage.Exists(req.Version) {
-		writeError(w, "unknown version", http.StatusBadRequest)
+	if h.policy != nil {
+		err := h.policy.Check(req.Query)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if req.KeepContainerOnFailure != nil && !hasPermission(r, PermissionKeepContainer) {
+		writeError(w, "keeping containers is not allowed", http.StatusForbidden)
 		return
 	}
 
-	// Set default database for backward compatibility
-	if req.Database == "" {
-		req.Database = ClickHouseDatabase
+	if req.Priority != "" {
+		status, err := checkPriority(r, req.Priority)
+		if err != nil {
+			writeError(w, err.Error(), status)
+			return
+		}
+	}
+
+	if req.Resources != nil {
+		if !hasPermission(r, PermissionSetResources) {
+			writeError(w, "overriding container limits is not allowed", http.StatusForbidden)
+			return
+		}
+
+		err := req.Resources.validate()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	runSettings, err := convertSettings(&req)
+	if req.Runner != "" {
+		status, err := h.checkRunner(r, req.Runner)
+		if err != nil {
+			writeError(w, err.Error(), status)
+			return
+		}
+	}
+
+	var files []queryrun.File
+	if len(req.Files) > 0 {
+		var status int
+		var err error
+		files, status, err = h.decodeFiles(req.Files)
+		if err != nil {
+			// Files of re-runs are restored from the original run, the limits may have been lowered since.
+			// The run is not executed without them.
+			if parent != nil {
+				err = errors.Wrap(err, "files of the run cannot be restored")
+			}
+			writeError(w, err.Error(), status)
+
+			return
+		}
+	}
+
+	run, err := h.newRun(r, req)
 	if err != nil {
 		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if parent != nil {
+		run.ParentID = parent.ID
+	}
+	run.Files = files
 
-	run := queryrun.New(req.Query, req.Database, req.Version, runSettings)
+	// Streamed chunks are passed through the output processors (e.g. redacted) as they are produced.
+	var processedStream io.Closer
+	if stream, ok := w.(*outputStream); ok {
+		run.OutputStream = chunkWriter{stream: stream}
+		if h.outputProcessor != nil {
+			s := h.outputProcessor.Wrap(run.OutputStream)
+			run.OutputStream, processedStream = s, s
+		}
+	}
+
+	// Cached results are not bound to a runner, so runs targeting a runner are always executed.
+	// Results of url() and s3() depend on the network, so runs without it are executed as well.
+	// Results of file() depend on the files, which are not a part of the key.
+	cacheKey, cacheable := h.resultCacheKey(req, run.Settings)
+	cacheable = cacheable && req.Runner == "" && req.Tool == nil && req.Network == "" && len(req.Statements) == 0 && len(req.Files) == 0
+
+	// Under maintenance, cached results are served even if the client has asked to bypass the cache,
+	// since the run cannot be executed anyway.
+	maintenance, underMaintenance := h.maintenanceState()
+	if cacheable && (!req.NoCache || underMaintenance) {
+		entry, found := h.resultCache.Get(cacheKey)
+		if found {
+			zlog.Info().Str("id", entry.RunID).Msg("serving a cached run")
+
+			run.Warn(queryrun.WarningCachedResult, "the output has been produced by a previous run of the same query",
+				map[string]string{"query_run_id": entry.RunID, "executed_at": entry.ExecutedAt.UTC().Format(time.RFC3339)})
+			writeResult(w, RunQueryOutput{
+				QueryRunID:       entry.RunID,
+				StreamsOutput:    newStreamsOutput(r, &queryrun.Run{Output: entry.Output, Stderr: entry.Stderr, ExitCode: entry.ExitCode}),
+				TimeElapsed:      entry.ExecutionTime.Round(time.Millisecond).String(),
+				SetupMs:          entry.SetupTime.Milliseconds(),
+				QueryMs:          entry.QueryTime.Milliseconds(),
+				Timings:          newTimingsOutput(nil, entry.ExecutionTime),
+				Version:          run.Version,
+				RequestedVersion: run.RequestedVersion,
+				ServerVersion:    entry.ServerVersion,
+				VersionMismatch:  entry.VersionMismatch,
+				ImageDigest:      entry.ImageDigest,
+				ImageBuildDate:   run.ImageBuildDate,
+				Profile:          entry.ExecutionProfile,
+				Warnings:         newWarningsOutput(run.Warnings),
+				Cached:           true,
+				ExecutedAt:       &entry.ExecutedAt,
+				ParentRunID:      run.ParentID,
+				OutputChanged:    outputChanged(parent, entry.Output),
+			})
+
+			return
+		}
+	}
+
+	if underMaintenance {
+		writeMaintenance(w, maintenance)
+		return
+	}
+	if h.drain.Draining() {
+		writeShuttingDown(w)
+		return
+	}
+
+	// The slot is released on every path out of the handler: completion, timeout, client disconnect and panic.
+	if h.runLimiter != nil {
+		release, inFlight, ok := h.runLimiter.acquire(r)
+		if !ok {
+			writeErrorResponse(w, &ErrorResponse{
+				Message:  fmt.Sprintf("too many runs in progress (%d), wait for them to finish", inFlight),
+				Code:     http.StatusTooManyRequests,
+				Reason:   ReasonTooManyInFlightRuns,
+				InFlight: &inFlight,
+			})
+
+			return
+		}
+		defer release()
+	}
+
+	ctx, cancel := h.runContext(r, run)
+	defer cancel()
+
+	h.inflight.add(run)
+	defer h.inflight.remove(run)
+
+	stopStages := persistStages(h.runRepo, run)
+	defer stopStages()
 
 	startedAt := time.Now()
-	output, err := h.r.RunQuery(r.Context(), run)
+	res, err := h.r.RunQuery(ctx, run)
+	stopStages()
+
+	// Data buffered by the processors is sent before the response becomes the trailing frame.
+	if processedStream != nil {
+		closeErr := processedStream.Close()
+		if closeErr != nil {
+			zlog.Debug().Err(closeErr).Str("id", run.ID).Msg("processed output stream cannot be closed")
+		}
+	}
+	if err != nil && clientAbandoned(r, err) {
+		// The container is removed by the runner anyway, the run is not saved.
+		zlog.Info().Str("id", run.ID).Msg("query run has been abandoned by the client")
+		writeClientAbandoned(w)
+
+		return
+	}
 	if err != nil {
-		zlog.Error().Err(err).Interface("request", req).Msg("query run failed")
+		zlog.Error().Err(err).Str("id", run.ID).Interface("request", req).Msg("query run failed")
+
+		if run.ContainerSnapshot != nil {
+			h.saveFailedRun(r.Context(), run, err)
+		}
 
+		var oomErr *qrunner.MemoryLimitError
+		var timeoutErr *qrunner.QueryTimeoutError
 		switch {
 		case errors.Is(err, qrunner.ErrNoAvailableRunners):
-			writeError(w, err.Error(), http.StatusTooManyRequests)
+			writeNoAvailableRunners(w, err)
+
+		case errors.Is(err, context.DeadlineExceeded):
+			writeError(w, "query run timed out", http.StatusGatewayTimeout)
+
+		case errors.Is(err, qrunner.ErrRunnerDisconnected):
+			writeError(w, qrunner.ErrRunnerDisconnected.Error(), http.StatusServiceUnavailable)
+
+		case errors.Is(err, qrunner.ErrServerNotReady):
+			h.writeServerNotReady(w, err)
+
+		case errors.Is(err, qrunner.ErrPullRateLimited):
+			h.writePullRateLimited(r.Context(), w, run.Version)
+
+		case errors.Is(err, qrunner.ErrImageDigestUnavailable):
+			h.writeImageDigestUnavailable(w, run)
+
+		case errors.Is(err, qrunner.ErrUnknownRunner), errors.Is(err, qrunner.ErrInvalidToolRun),
+			errors.Is(err, qrunner.ErrEmulationRefused), errors.Is(err, qrunner.ErrArchitectureUnavailable):
+			writeError(w, err.Error(), http.StatusBadRequest)
+
+		case errors.As(err, &oomErr):
+			writeError(w, oomErr.Error(), http.StatusBadRequest)
+
+		case errors.As(err, &timeoutErr):
+			writeError(w, timeoutErr.Error(), http.StatusRequestTimeout)
 
 		default:
 			writeError(w, "internal error", http.StatusInternalServerError)
@@ -137,6 +638,18 @@ func (h *queryHandler) runQuery(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
+
+	if h.outputProcessor != nil {
+		res, err = h.processOutput(run, res)
+		if err != nil {
+			zlog.Error().Err(err).Str("id", run.ID).Msg("output cannot be processed")
+			writeError(w, "internal error", http.StatusInternalServerError)
+
+			return
+		}
+	}
+
+	output := res.Output()
 	if uint64(len(output)) > h.maxOutputLength {
 		msg := fmt.Sprintf("output length (%d) cannot exceed %d", len(output), h.maxOutputLength)
 		writeError(w, msg, http.StatusBadRequest)
@@ -146,9 +659,27 @@ func (h *queryHandler) runQuery(w http.ResponseWriter, r *http.Request) {
 
 	timeElapsed := time.Since(startedAt)
 	run.Output = output
+	run.Stderr = res.Stderr
+	run.ExitCode = res.ExitCode
+	run.Truncated = res.Truncated
+	run.DroppedBytes = res.DroppedBytes
 	run.ExecutionTime = timeElapsed
+	run.Stages = run.Timeline.Stages()
+	run.SetupTime, run.QueryTime = queryrun.SplitDurations(run.Stages)
+	run.Abandoned = clientGone(r)
 
-	err = h.runRepo.Create(run)
+	// If runs are not saved, they cannot be edited either.
+	var editToken string
+	if h.runRepo != nil {
+		editToken = run.GenerateEditToken()
+		err = h.runRepo.Create(ctx, run)
+	}
+	if err != nil && clientAbandoned(r, err) {
+		zlog.Info().Str("id", run.ID).Msg("query run has been abandoned by the client before it was saved")
+		writeClientAbandoned(w)
+
+		return
+	}
 	if err != nil {
 		zlog.Error().Err(err).Interface("model", run).Msg("a run cannot be saved")
 		writeError(w, "internal error", http.StatusInternalServerError)
@@ -156,12 +687,462 @@ func (h *queryHandler) runQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	zlog.Info().Str("id", run.ID).Dur("elapsed", timeElapsed).Msg("saved a new run")
+	zlog.Info().Str("id", run.ID).Dur("elapsed", timeElapsed).Bool("abandoned", run.Abandoned).Bool("saved", h.runRepo != nil).Msg("a new run has been finished")
+
+	// Emulated runs are not cached, so a native runner produces the result next time.
+	// Truncated outputs are not cached either, they depend on the limit of the runner.
+	if cacheable && run.EmulatedArchitecture == "" && !run.Truncated {
+		h.putResult(cacheKey, run)
+	}
 
 	writeResult(w, RunQueryOutput{
-		QueryRunID:  run.ID,
-		Output:      run.Output,
-		TimeElapsed: timeElapsed.Round(time.Millisecond).String(),
+		QueryRunID:           run.ID,
+		StreamsOutput:        newStreamsOutput(r, run),
+		TimeElapsed:          timeElapsed.Round(time.Millisecond).String(),
+		SetupMs:              run.SetupTime.Milliseconds(),
+		QueryMs:              run.QueryTime.Milliseconds(),
+		Timings:              newTimingsOutput(run.Stages, run.ExecutionTime),
+		Version:              run.Version,
+		RequestedVersion:     run.RequestedVersion,
+		ServerVersion:        run.ServerVersion,
+		VersionMismatch:      run.VersionMismatch,
+		ImageDigest:          run.ImageDigest,
+		ImageBuildDate:       run.ImageBuildDate,
+		Profile:              run.ExecutionProfile,
+		Labels:               run.Labels,
+		Runner:               targetRunner(run),
+		Tool:                 run.Tool,
+		Network:              run.Network,
+		EgressDenied:         run.EgressDenied,
+		EmulatedArchitecture: run.EmulatedArchitecture,
+		Warnings:             newWarningsOutput(run.Warnings),
+		Statements:           newStatementsOutput(run.Statements),
+		Files:                newRunFilesOutput(run.Files),
+		EditToken:            editToken,
+		ParentRunID:          run.ParentID,
+		OutputChanged:        outputChanged(parent, run.Output),
+	})
+}
+
+// processOutput passes stdout and stderr of the run through the output processor separately.
+// Every change is reported by a warning.
+func (h *queryHandler) processOutput(run *queryrun.Run, res qrunner.Result) (qrunner.Result, error) {
+	streams := []struct {
+		name  string
+		value *string
+	}{
+		{name: rawStreamStdout, value: &res.Stdout},
+		{name: rawStreamStderr, value: &res.Stderr},
+	}
+
+	for _, s := range streams {
+		processed, changes, err := h.outputProcessor.Process(*s.value)
+		if err != nil {
+			return qrunner.Result{}, errors.Wrapf(err, "failed to process %s", s.name)
+		}
+		*s.value = processed
+
+		for _, c := range changes {
+			run.Warn(queryrun.WarningOutputProcessed, s.name+": "+c.Summary,
+				map[string]string{"stream": s.name, "processor": c.Processor})
+		}
+	}
+
+	// Results of the statements are parts of the combined streams, so their changes have been reported already.
+	for i := range run.Statements {
+		s := &run.Statements[i]
+		for _, value := range []*string{&s.Stdout, &s.Stderr} {
+			processed, _, err := h.outputProcessor.Process(*value)
+			if err != nil {
+				return qrunner.Result{}, errors.Wrapf(err, "failed to process statement %d", i+1)
+			}
+			*value = processed
+		}
+	}
+
+	return res, nil
+}
+
+// StreamsOutput are the output streams of a run.
+type StreamsOutput struct {
+	// Output combines stdout and stderr. It's returned to clients of API version 1 only.
+	Output *string `json:"output,omitempty"`
+
+	Stdout string `json:"stdout"`
+
+	// Stderr has exceptions of the database client. It's empty if the query has succeeded.
+	Stderr string `json:"stderr"`
+
+	// ExitCode is the exit code of the database client or the tool. It's 0 for runs saved before it was recorded.
+	ExitCode int `json:"exit_code"`
+
+	// Truncated is true if the output has exceeded the limit of the runner, DroppedBytes have been cut at least.
+	Truncated    bool   `json:"truncated,omitempty"`
+	DroppedBytes uint64 `json:"dropped_bytes,omitempty"`
+}
+
+func newStreamsOutput(r *http.Request, run *queryrun.Run) StreamsOutput {
+	streams := StreamsOutput{
+		Stdout:       run.Stdout(),
+		Stderr:       run.Stderr,
+		ExitCode:     run.ExitCode,
+		Truncated:    run.Truncated,
+		DroppedBytes: run.DroppedBytes,
+	}
+	if requestedAPIVersion(r) == apiVersion1 {
+		output := run.Output
+		streams.Output = &output
+	}
+
+	return streams
+}
+
+// targetRunner returns the runner that has executed the run if the client has selected it.
+func targetRunner(run *queryrun.Run) string {
+	if run.TargetRunner == "" {
+		return ""
+	}
+
+	return run.Runner
+}
+
+// checkRunner verifies that the client is allowed to select the runner.
+// It returns an http status code describing the failure.
+func (h *queryHandler) checkRunner(r *http.Request, name string) (int, error) {
+	if !hasPermission(r, PermissionSelectRunner) {
+		return http.StatusForbidden, errors.New("runner selection is not allowed")
+	}
+
+	for _, runner := range h.runners {
+		if runner == name {
+			return http.StatusOK, nil
+		}
+	}
+
+	return http.StatusBadRequest, errors.Errorf("unknown runner %s (allowed: %s)", name, strings.Join(h.runners, ", "))
+}
+
+// checkPriority verifies that the client is allowed to choose the priority class.
+// It returns an http status code describing the failure.
+func checkPriority(r *http.Request, priority string) (int, error) {
+	if !hasPermission(r, PermissionSetPriority) {
+		return http.StatusForbidden, errors.New("priority selection is not allowed")
+	}
+
+	for _, p := range queryrun.Priorities {
+		if p == priority {
+			return http.StatusOK, nil
+		}
+	}
+
+	return http.StatusBadRequest, errors.Errorf("unknown priority %s (allowed: %s)", priority, strings.Join(queryrun.Priorities, ", "))
+}
+
+// newRun resolves the requested version, converts settings and creates a new run.
+// The version in the request is replaced with the resolved one.
+func (h *queryHandler) newRun(r *http.Request, req *RunQueryInput) (*queryrun.Run, error) {
+	requestedVersion := req.Version
+	img, found := h.tagStorage.Resolve(req.Version, req.Strict)
+	if req.pinned != nil {
+		img, found = *req.pinned, true
+	}
+	if !found {
+		if suggestions := h.tagStorage.Suggest(req.Version, maxVersionSuggestions); len(suggestions) > 0 {
+			return nil, errors.Errorf("unknown version (closest matches: %s)", strings.Join(suggestions, ", "))
+		}
+
+		return nil, errors.New("unknown version")
+	}
+
+	req.Version = img.Tag
+
+	deprecation, deprecated := h.tagStorage.Deprecation(img.Tag)
+	if deprecated && deprecation.Rejected {
+		return nil, errors.Errorf("version %s cannot be used: %s", img.Tag, deprecation.Message)
+	}
+
+	// Set default database for backward compatibility
+	if req.Database == "" {
+		req.Database = ClickHouseDatabase
+	}
+
+	err := applyFormat(req)
+	if err != nil {
+		return nil, err
+	}
+
+	runSettings, err := convertSettings(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.checkFormat(req)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := queryrun.NormalizeLabels(req.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	run := queryrun.New(req.Query, req.Database, req.Version, runSettings)
+	run.Labels = labels
+	run.RequestedVersion = requestedVersion
+	run.ImageRepository = img.Repository
+	run.ImageDigest = img.Digest
+	run.PinnedImage = req.pinned != nil
+	run.ClientID = clientID(r)
+	run.PreparationToken = req.PreparationToken
+	run.TargetRunner = req.Runner
+	run.Network = req.Network
+	run.AllowEmulation = req.AllowEmulation
+	run.KeepContainerOnFailure = req.KeepContainerOnFailure
+	run.Priority = req.Priority
+	if len(req.Statements) > 0 {
+		run.Statements = queryrun.NewStatements(req.Statements)
+		run.ContinueOnError = req.ContinueOnError
+	}
+	if req.Resources != nil {
+		run.Resources = req.Resources.toResources()
+	}
+	run.Deadlines = h.resolveDeadlines(img.Tag)
+	annotateRequest(r, run)
+	if req.Tool != nil {
+		run.Tool = req.Tool.Name
+		run.ToolParams = req.Tool.Params
+	}
+
+	if requestedVersion != "" && requestedVersion != img.Tag {
+		run.Warn(queryrun.WarningVersionResolved, fmt.Sprintf("version %s has been resolved to %s", requestedVersion, img.Tag),
+			map[string]string{"requested_version": requestedVersion, "version": img.Tag})
+	}
+	if deprecated {
+		run.Warn(queryrun.WarningDeprecatedVersion, deprecation.Message, nil)
+	}
+	if img.Rolling {
+		warnRollingVersion(run, img)
+	}
+
+	return run, nil
+}
+
+// warnRollingVersion records the build of the rolling tag the run has been resolved to,
+// so results of runs against head can be told apart.
+func warnRollingVersion(run *queryrun.Run, img dockertag.Image) {
+	details := map[string]string{"digest": img.Digest}
+	message := fmt.Sprintf("%s is rebuilt regularly, the run has used the image %s", img.Tag, img.Digest)
+	if !img.BuildDate.IsZero() {
+		buildDate := img.BuildDate
+		run.ImageBuildDate = &buildDate
+		details["build_date"] = buildDate.Format(time.RFC3339)
+		message = fmt.Sprintf("%s is rebuilt regularly, the run has used the build of %s", img.Tag, buildDate.Format(time.RFC3339))
+	}
+
+	run.Warn(queryrun.WarningRollingVersion, message, details)
+}
+
+// applyFormat moves the format shorthand to the settings. It fails if the settings request another format.
+func applyFormat(req *RunQueryInput) error {
+	if req.Format == "" {
+		return nil
+	}
+
+	if req.Settings.ClickHouseSettings == nil {
+		req.Settings.ClickHouseSettings = &ClickHouseSettings{}
+	}
+
+	settings := req.Settings.ClickHouseSettings
+	if settings.OutputFormat != "" && settings.OutputFormat != req.Format {
+		return errors.Errorf("format %s conflicts with settings.clickhouse.output_format %s", req.Format, settings.OutputFormat)
+	}
+	settings.OutputFormat = req.Format
+
+	return nil
+}
+
+// resolveDeadlines returns the deadlines of a run of the version. Without version rules,
+// only the run timeout is set, and runners use their own readiness limits.
+func (h *queryHandler) resolveDeadlines(version string) *queryrun.Deadlines {
+	if h.deadlines == nil {
+		return &queryrun.Deadlines{RunTimeout: h.runTimeout}
+	}
+
+	deadlines := h.deadlines.Resolve(version)
+
+	return &deadlines
+}
+
+// checkFormat verifies that the requested output format is a format name allowed by the deployment.
+func (h *queryHandler) checkFormat(req *RunQueryInput) error {
+	if req.Settings.ClickHouseSettings == nil || req.Settings.ClickHouseSettings.OutputFormat == "" {
+		return nil
+	}
+
+	format := req.Settings.ClickHouseSettings.OutputFormat
+	if !isFormatName(format) {
+		return errors.Errorf("invalid output format %q", format)
+	}
+	if len(h.allowedFormats) == 0 {
+		return nil
+	}
+
+	for _, allowed := range h.allowedFormats {
+		if format == allowed {
+			return nil
+		}
+	}
+
+	return errors.Errorf("unsupported output format %s (allowed: %s)", format, strings.Join(h.allowedFormats, ", "))
+}
+
+// isFormatName reports whether the format looks like a ClickHouse format name, e.g. "JSONEachRow".
+// Unknown names are rejected by the server, this only keeps arbitrary strings away from the client command.
+func isFormatName(format string) bool {
+	for _, c := range format {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+
+	return format != ""
+}
+
+type PrepareInput struct {
+	Version  string      `json:"version"`
+	Database string      `json:"database"`
+	Settings RunSettings `json:"settings"`
+	Strict   bool        `json:"strict"`
+}
+
+type PrepareOutput struct {
+	PreparationToken string          `json:"preparation_token"`
+	Version          string          `json:"version"`
+	ExpiresAt        time.Time       `json:"expires_at"`
+	Warnings         []WarningOutput `json:"warnings,omitempty"`
+}
+
+// prepare starts a container for the requested version in advance.
+// The returned token should be passed in the following run request.
+func (h *queryHandler) prepare(w http.ResponseWriter, r *http.Request) {
+	var input PrepareInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if maintenance, ok := h.maintenanceState(); ok {
+		writeMaintenance(w, maintenance)
+		return
+	}
+	if h.drain.Draining() {
+		writeShuttingDown(w)
+		return
+	}
+
+	req := RunQueryInput{
+		Version:  input.Version,
+		Database: input.Database,
+		Settings: input.Settings,
+		Strict:   input.Strict,
+	}
+
+	run, err := h.newRun(r, &req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), run.Deadlines.RunTimeout)
+	defer cancel()
+
+	res, err := h.r.Prepare(ctx, run)
+	if err != nil {
+		zlog.Error().Err(err).Interface("request", input).Msg("container preparation failed")
+
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			writeError(w, "container preparation timed out", http.StatusGatewayTimeout)
+
+		case errors.Is(err, qrunner.ErrNoAvailableRunners), errors.Is(err, qrunner.ErrReservationLimitExceeded):
+			writeError(w, err.Error(), http.StatusTooManyRequests)
+
+		case errors.Is(err, qrunner.ErrRunnerDisconnected):
+			writeError(w, qrunner.ErrRunnerDisconnected.Error(), http.StatusServiceUnavailable)
+
+		case errors.Is(err, qrunner.ErrServerNotReady):
+			writeError(w, qrunner.ErrServerNotReady.Error(), http.StatusServiceUnavailable)
+
+		case errors.Is(err, qrunner.ErrPullRateLimited):
+			h.writePullRateLimited(r.Context(), w, run.Version)
+
+		case errors.Is(err, qrunner.ErrPreparationDisabled):
+			writeError(w, err.Error(), http.StatusNotImplemented)
+
+		case errors.Is(err, qrunner.ErrArchitectureUnavailable):
+			writeError(w, err.Error(), http.StatusBadRequest)
+
+		default:
+			writeError(w, "internal error", http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	writeResult(w, PrepareOutput{
+		PreparationToken: res.Token,
+		Version:          run.Version,
+		ExpiresAt:        res.ExpiresAt,
+		Warnings:         newWarningsOutput(run.Warnings),
+	})
+}
+
+// resultCacheKey returns a result cache key for the request.
+// The second returned value is false if the result must not be cached:
+// the cache is disabled, the query is non-deterministic, the image is unknown
+// or the run is labeled (labeled runs must be stored).
+func (h *queryHandler) resultCacheKey(req *RunQueryInput, settings runsettings.RunSettings) (string, bool) {
+	if h.resultCache == nil || len(req.Labels) > 0 || !resultcache.IsDeterministic(req.Query) {
+		return "", false
+	}
+
+	// Pinned re-runs are keyed by the pinned image, the version may be resolved to another one by now.
+	var img dockertag.Image
+	if req.pinned != nil {
+		img = *req.pinned
+	} else {
+		var found bool
+		img, found = h.tagStorage.Find(req.Version)
+		if !found {
+			return "", false
+		}
+	}
+
+	serialized, err := json.Marshal(settings)
+	if err != nil {
+		zlog.Error().Err(err).Interface("settings", settings).Msg("failed to serialize settings")
+		return "", false
+	}
+
+	return resultcache.Key(req.Query, req.Database, img.Digest, string(serialized)), true
+}
+
+// putResult caches the output of the finished run.
+func (h *queryHandler) putResult(key string, run *queryrun.Run) {
+	h.resultCache.Put(key, resultcache.Entry{
+		RunID:            run.ID,
+		Output:           run.Output,
+		ImageDigest:      run.ImageDigest,
+		Stderr:           run.Stderr,
+		ExitCode:         run.ExitCode,
+		ServerVersion:    run.ServerVersion,
+		VersionMismatch:  run.VersionMismatch,
+		ExecutionProfile: run.ExecutionProfile,
+		ExecutedAt:       run.CreatedAt,
+		ExecutionTime:    run.ExecutionTime,
+		SetupTime:        run.SetupTime,
+		QueryTime:        run.QueryTime,
 	})
 }
 
@@ -170,12 +1151,33 @@ type GetQueryRunInput struct {
 }
 
 type GetQueryRunOutput struct {
-	QueryRunID string                  `json:"query_run_id"`
-	Database   string                  `json:"database,omitempty"`
-	Version    string                  `json:"version"`
-	Settings   runsettings.RunSettings `json:"settings,omitempty"`
-	Input      string                  `json:"input"`
-	Output     string                  `json:"output"`
+	QueryRunID           string                  `json:"query_run_id"`
+	Database             string                  `json:"database,omitempty"`
+	Version              string                  `json:"version"`
+	RequestedVersion     string                  `json:"requested_version,omitempty"`
+	ServerVersion        string                  `json:"server_version,omitempty"`
+	VersionMismatch      bool                    `json:"version_mismatch,omitempty"`
+	ImageDigest          string                  `json:"image_digest,omitempty"`
+	ImageBuildDate       *time.Time              `json:"image_build_date,omitempty"`
+	Profile              string                  `json:"profile,omitempty"`
+	Labels               []string                `json:"labels,omitempty"`
+	Tool                 string                  `json:"tool,omitempty"`
+	ToolParams           map[string]string       `json:"tool_params,omitempty"`
+	ParentRunID          string                  `json:"parent_run_id,omitempty"`
+	ImportedFrom         string                  `json:"imported_from,omitempty"`
+	Canary               bool                    `json:"canary,omitempty"`
+	Abandoned            bool                    `json:"abandoned,omitempty"`
+	Network              string                  `json:"network,omitempty"`
+	EgressDenied         []string                `json:"egress_denied,omitempty"`
+	EmulatedArchitecture string                  `json:"emulated_architecture,omitempty"`
+	Warnings             []WarningOutput         `json:"warnings,omitempty"`
+	Statements           []StatementOutput       `json:"statements,omitempty"`
+	SetupMs              int64                   `json:"setup_ms"`
+	QueryMs              int64                   `json:"query_ms"`
+	Timings              *TimingsOutput          `json:"timings"`
+	Settings             runsettings.RunSettings `json:"settings,omitempty"`
+	Input                string                  `json:"input"`
+	StreamsOutput
 }
 
 func (h *queryHandler) getQueryRun(w http.ResponseWriter, r *http.Request) {
@@ -185,9 +1187,12 @@ func (h *queryHandler) getQueryRun(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	run, err := h.runRepo.Get(id)
+	// Runs that are in flight, missing or deleted must not be cached.
+	w.Header().Set("Cache-Control", cacheControlRevalidate)
+
+	run, err := h.runRepo.Get(r.Context(), id)
 	if errors.Is(err, queryrun.ErrNotFound) {
-		writeError(w, "run not found", http.StatusNotFound)
+		h.writeRunNotFound(w, id)
 		return
 	}
 	if err != nil {
@@ -196,13 +1201,329 @@ func (h *queryHandler) getQueryRun(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
+	if run.Deleted() {
+		writeDeleted(w, run)
+		return
+	}
+	if run.Failed() {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	// Labels can be changed, so the document is revalidated, which is cheap with the stored content hash.
+	w.Header().Set("Vary", "Accept")
+	if writeNotModified(w, r, runDocumentETag(run, requestedAPIVersion(r)), cacheControlRevalidate) {
+		return
+	}
 
 	writeResult(w, GetQueryRunOutput{
+		QueryRunID:           run.ID,
+		Database:             run.Database,
+		Version:              run.Version,
+		RequestedVersion:     run.RequestedVersion,
+		ServerVersion:        run.ServerVersion,
+		VersionMismatch:      run.VersionMismatch,
+		ImageDigest:          run.ImageDigest,
+		ImageBuildDate:       run.ImageBuildDate,
+		Profile:              run.ExecutionProfile,
+		Labels:               run.Labels,
+		Tool:                 run.Tool,
+		ToolParams:           run.ToolParams,
+		ParentRunID:          run.ParentID,
+		ImportedFrom:         run.ImportedFrom,
+		Canary:               run.Canary,
+		Abandoned:            run.Abandoned,
+		Network:              run.Network,
+		EgressDenied:         run.EgressDenied,
+		EmulatedArchitecture: run.EmulatedArchitecture,
+		Warnings:             newWarningsOutput(run.Warnings),
+		Statements:           newStatementsOutput(run.Statements),
+		SetupMs:              run.SetupTime.Milliseconds(),
+		QueryMs:              run.QueryTime.Milliseconds(),
+		Timings:              newTimingsOutput(run.Stages, run.ExecutionTime),
+		Settings:             run.Settings,
+		Input:                run.Input,
+		StreamsOutput:        newStreamsOutput(r, run),
+	})
+}
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+type RunSummary struct {
+	QueryRunID string    `json:"query_run_id"`
+	Version    string    `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type ListQueryRunsOutput struct {
+	Runs []RunSummary `json:"runs"`
+}
+
+// listQueryRuns returns the most recent runs with the given label.
+func (h *queryHandler) listQueryRuns(w http.ResponseWriter, r *http.Request) {
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		writeError(w, "label filter is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultListLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			writeError(w, fmt.Sprintf("limit must be an integer in [1, %d]", maxListLimit), http.StatusBadRequest)
+			return
+		}
+
+		limit = parsed
+	}
+
+	summaries, err := h.runRepo.ListByLabel(r.Context(), label, limit)
+	if errors.Is(err, queryrun.ErrLabelIndexDisabled) {
+		writeError(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("label", label).Msg("failed to list runs")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	runs := make([]RunSummary, 0, len(summaries))
+	for _, s := range summaries {
+		runs = append(runs, RunSummary{
+			QueryRunID: s.ID,
+			Version:    s.Version,
+			CreatedAt:  s.CreatedAt,
+		})
+	}
+
+	writeResult(w, ListQueryRunsOutput{Runs: runs})
+}
+
+type UpdateLabelsInput struct {
+	Labels []string `json:"labels"`
+}
+
+type UpdateLabelsOutput struct {
+	QueryRunID string   `json:"query_run_id"`
+	Labels     []string `json:"labels"`
+}
+
+// updateLabels replaces labels of a run. The request must carry the edit token
+// returned on the run creation in the X-Edit-Token header.
+func (h *queryHandler) updateLabels(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req UpdateLabelsInput
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labels, err := queryrun.NormalizeLabels(req.Labels)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	run, err := h.runRepo.Get(r.Context(), id)
+	if errors.Is(err, queryrun.ErrNotFound) {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if run.Deleted() {
+		writeDeleted(w, run)
+		return
+	}
+	if run.Failed() {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	if !run.CheckEditToken(r.Header.Get("X-Edit-Token")) {
+		writeError(w, "invalid edit token", http.StatusForbidden)
+		return
+	}
+
+	err = h.runRepo.UpdateLabels(r.Context(), run, labels)
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to update labels")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	writeResult(w, UpdateLabelsOutput{
 		QueryRunID: run.ID,
-		Database:   run.Database,
-		Version:    run.Version,
-		Settings:   run.Settings,
-		Input:      run.Input,
-		Output:     run.Output,
+		Labels:     run.Labels,
 	})
 }
+
+// deleteRun removes a stored run. It's allowed to the run owner (the edit token must be passed
+// in the X-Edit-Token header) and to clients with the delete_runs permission.
+func (h *queryHandler) deleteRun(w http.ResponseWriter, r *http.Request) {
+	if _, found := h.inflight.get(chi.URLParam(r, "id")); found {
+		writeError(w, "run is in progress", http.StatusConflict)
+		return
+	}
+
+	deleteStoredRun(w, r, h.runRepo, h.resultCache, func(run *queryrun.Run) (string, string, bool) {
+		switch {
+		case run.CheckEditToken(r.Header.Get("X-Edit-Token")):
+			return queryrun.DeletionReasonOwner, "owner", true
+
+		case hasPermission(r, PermissionDeleteRuns):
+			key, _ := requestKey(r)
+			return queryrun.DeletionReasonAdmin, "api_key:" + key.Name, true
+
+		default:
+			return "", "", false
+		}
+	})
+}
+
+// deleteStoredRun removes the run of the id URL parameter and records the deletion in the audit log.
+// authorize returns the deletion reason and the actor of the audit log, or false if the request cannot delete the run.
+// The result cache is optional.
+func deleteStoredRun(w http.ResponseWriter, r *http.Request, runRepo queryrun.Repository, resultCache ResultCache,
+	authorize func(run *queryrun.Run) (reason, actor string, ok bool)) {
+	id := chi.URLParam(r, "id")
+
+	run, err := runRepo.Get(r.Context(), id)
+	if errors.Is(err, queryrun.ErrNotFound) {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if run.Deleted() {
+		writeDeleted(w, run)
+		return
+	}
+	if run.Failed() {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	reason, actor, ok := authorize(run)
+	if !ok {
+		writeError(w, "invalid edit token", http.StatusForbidden)
+		return
+	}
+
+	err = runRepo.Delete(r.Context(), run, reason)
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to delete a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	if resultCache != nil {
+		resultCache.RemoveRun(run.ID)
+	}
+
+	zlog.Info().
+		Bool("audit", true).
+		Str("id", run.ID).
+		Str("actor", actor).
+		Str("client", clientID(r)).
+		Str("reason", reason).
+		Msg("run has been deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveFailedRun stores the failed run with its container snapshot, so administrators can debug the failure.
+// Failed runs are not visible through the public API.
+func (h *queryHandler) saveFailedRun(ctx context.Context, run *queryrun.Run, runErr error) {
+	if h.runRepo == nil {
+		return
+	}
+
+	run.Error = runErr.Error()
+	run.Labels = nil
+	run.Stages = run.Timeline.Stages()
+
+	err := h.runRepo.Create(ctx, run)
+	if err != nil {
+		zlog.Error().Err(err).Str("id", run.ID).Msg("a failed run cannot be saved")
+		return
+	}
+
+	zlog.Info().Str("id", run.ID).Msg("saved a failed run with the container snapshot")
+}
+
+// writeRunNotFound responds with 404 Not Found telling whether the run is still in progress.
+func (h *queryHandler) writeRunNotFound(w http.ResponseWriter, id string) {
+	if _, found := h.inflight.get(id); found {
+		writeError(w, "run is in progress", http.StatusNotFound)
+		return
+	}
+
+	writeError(w, "run not found", http.StatusNotFound)
+}
+
+// writeDeleted responds with 410 Gone and the deletion reason.
+func writeDeleted(w http.ResponseWriter, run *queryrun.Run) {
+	writeError(w, "run has been deleted: "+run.DeletionReason, http.StatusGone)
+}
+
+// writeNoAvailableRunners responds to a run that has not been dispatched. If the run has been rejected
+// by the scheduler queue, the Retry-After header tells when the queue is expected to have room.
+// Runs rejected by an open circuit get 503, as the deployment is failing rather than busy.
+func writeNoAvailableRunners(w http.ResponseWriter, err error) {
+	var circuitErr *qrunner.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		writeRetryAfter(w, circuitErr.RetryAfter)
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	var rejected *qrunner.QueueRejectedError
+	if errors.As(err, &rejected) {
+		writeRetryAfter(w, rejected.RetryAfter)
+	}
+
+	writeError(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// writeServerNotReady responds to a run which database server has not started. The logs tail of the server
+// is returned only if the deployment exposes it.
+func (h *queryHandler) writeServerNotReady(w http.ResponseWriter, err error) {
+	resp := &ErrorResponse{
+		Message: qrunner.ErrServerNotReady.Error(),
+		Code:    http.StatusServiceUnavailable,
+	}
+
+	var startupErr *qrunner.ServerStartupError
+	if h.exposeServerLogs && errors.As(err, &startupErr) {
+		resp.ServerLogs = startupErr.Logs
+	}
+
+	writeErrorResponse(w, resp)
+}
+
+// writeRetryAfter sets the Retry-After header in seconds. It does nothing if the delay is unknown.
+func writeRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+}
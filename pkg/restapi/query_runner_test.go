@@ -0,0 +1,127 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/outputproc"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessOutput(t *testing.T) {
+	redactor, err := outputproc.NewRedactor([]string{`password=\S+`}, "")
+	require.NoError(t, err)
+	h := &queryHandler{outputProcessor: outputproc.NewPipeline(redactor, outputproc.NewSizeGuard(16))}
+
+	run := queryrun.New("SELECT 1", "clickhouse", "23.3", nil)
+	res, err := h.processOutput(run, qrunner.Result{
+		Stdout:   "password=hunter2\n",
+		Stderr:   "Code: 62. DB::Exception: Syntax error",
+		ExitCode: 62,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "[REDACTED]\n", res.Stdout)
+	assert.Equal(t, "Code: 62. DB::Ex", res.Stderr)
+	assert.Equal(t, 62, res.ExitCode)
+	assert.Equal(t, []queryrun.Warning{
+		{
+			Code:    queryrun.WarningOutputProcessed,
+			Message: "stdout: 1 value redacted",
+			Details: map[string]string{"stream": "stdout", "processor": "redactor"},
+		},
+		{
+			Code:    queryrun.WarningOutputProcessed,
+			Message: "stderr: output has been truncated to 16 bytes, 21 bytes dropped",
+			Details: map[string]string{"stream": "stderr", "processor": "size_guard"},
+		},
+	}, run.Warnings)
+}
+
+func TestRunQuery_ServerNotReady(t *testing.T) {
+	startupErr := &qrunner.ServerStartupError{
+		Err:  errors.Wrap(qrunner.ErrServerNotReady, "database server has exited with code 132"),
+		Logs: "Illegal instruction (core dumped)\n",
+	}
+
+	tests := []struct {
+		name         string
+		runErr       error
+		exposeLogs   bool
+		expectedLogs string
+	}{
+		{name: "logs exposed", runErr: startupErr, exposeLogs: true, expectedLogs: startupErr.Logs},
+		{name: "logs hidden", runErr: startupErr},
+		{name: "no logs", runErr: qrunner.ErrServerNotReady, exposeLogs: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			runner := funcRunner{run: func(*queryrun.Run) (string, error) {
+				return "", errors.Wrap(tt.runErr, "failed to run query")
+			}}
+			h := newQueryHandler(runner, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+			h.exposeServerLogs = tt.exposeLogs
+
+			rec := httptest.NewRecorder()
+			h.runQuery(rec, httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(`{"query": "SELECT 1", "version": "23.3.1.2823"}`)))
+			require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+			var resp Response
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			require.NotNil(t, resp.Error)
+			assert.Equal(t, qrunner.ErrServerNotReady.Error(), resp.Error.Message)
+			assert.Equal(t, tt.expectedLogs, resp.Error.ServerLogs)
+		})
+	}
+}
+
+func TestRunQuery_StreamProcessed(t *testing.T) {
+	redactor, err := outputproc.NewRedactor([]string{`password=\S+`}, "")
+	require.NoError(t, err)
+
+	runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+		// The secret is split across chunks, so it's redacted only if the stream is processed as a whole.
+		_, _ = run.OutputStream.Write([]byte("1\npassword=hun"))
+		_, _ = run.OutputStream.Write([]byte("ter2\n"))
+
+		return "1\npassword=hunter2\n", nil
+	}}
+	h := newQueryHandler(runner, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+	h.outputProcessor = outputproc.NewPipeline(redactor)
+
+	rec := httptest.NewRecorder()
+	h.runQuery(rec, httptest.NewRequest(http.MethodPost, "/runs?stream=true", strings.NewReader(`{"query": "SELECT 1", "version": "23.3.1.2823"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentTypeNDJSON, rec.Header().Get("Content-Type"))
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+
+	var streamed strings.Builder
+	dec := json.NewDecoder(rec.Body)
+	for {
+		var frame struct {
+			Stdout *string         `json:"stdout"`
+			Result *RunQueryOutput `json:"result"`
+		}
+		require.NoError(t, dec.Decode(&frame))
+
+		if frame.Result != nil {
+			require.NotNil(t, frame.Result.Output)
+			assert.Equal(t, "1\n[REDACTED]\n", *frame.Result.Output)
+			break
+		}
+		require.NotNil(t, frame.Stdout)
+		streamed.WriteString(*frame.Stdout)
+	}
+	assert.Equal(t, "1\n[REDACTED]\n", streamed.String())
+}
@@ -0,0 +1,273 @@
+package restapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const (
+	// ReasonRateLimited distinguishes requests exceeding the request rate of the client from other 429 errors.
+	ReasonRateLimited = "rate_limited"
+
+	// ReasonDailyRunsExceeded distinguishes runs exceeding the daily budget of the client from other 429 errors.
+	ReasonDailyRunsExceeded = "daily_runs_exceeded"
+)
+
+const (
+	quotaRequests  = "requests"
+	quotaDailyRuns = "daily_runs"
+)
+
+// QuotaConfig bounds requests and runs of clients by their addresses. Zero means no limit.
+type QuotaConfig struct {
+	// RequestsPerMinute is the refill rate of the token bucket of a client, and Burst is its capacity.
+	// If Burst is 0, a minute worth of requests can be made at once.
+	RequestsPerMinute uint
+	Burst             uint
+
+	// DailyRuns bounds runs, re-runs and explains of a client per UTC day. Every probed version of a bisection,
+	// the opening of a session and every query of it are counted as runs as well.
+	DailyRuns uint
+
+	// Exempt are CIDRs of clients which are not limited, e.g. an office or CI. Single addresses are accepted as well.
+	Exempt []string
+}
+
+// Quota limits the request rate and the daily runs of clients identified by the address.
+// Proxy headers are taken into account according to the trusted proxies.
+type Quota struct {
+	cfg    QuotaConfig
+	exempt []*net.IPNet
+	store  QuotaStore
+
+	now func() time.Time
+}
+
+func NewQuota(cfg QuotaConfig, store QuotaStore) (*Quota, error) {
+	exempt, err := parseNetworks(cfg.Exempt, "exempt")
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Burst == 0 {
+		cfg.Burst = cfg.RequestsPerMinute
+	}
+
+	return &Quota{
+		cfg:    cfg,
+		exempt: exempt,
+		store:  store,
+		now:    time.Now,
+	}, nil
+}
+
+// limitedClient returns the address the client is limited by. Exempt clients are not limited.
+func (q *Quota) limitedClient(r *http.Request) (client string, limited bool) {
+	client = clientID(r)
+	if ip := net.ParseIP(client); ip != nil && containsIP(q.exempt, ip) {
+		return client, false
+	}
+
+	return client, true
+}
+
+// limitRequests rejects requests of clients which have exceeded their request rate.
+// If the store fails, requests are let through.
+func (q *Quota) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, limited := q.limitedClient(r)
+		if !limited || q.cfg.RequestsPerMinute == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rate := float64(q.cfg.RequestsPerMinute) / time.Minute.Seconds()
+		now := q.now()
+		ok, availableAt, err := q.store.TakeToken(r.Context(), client, rate, q.cfg.Burst, now)
+		if err != nil {
+			zlog.Error().Err(err).Str("client", client).Msg("request rate cannot be checked")
+		}
+		if ok || err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metrics.Quota.Throttled(quotaRequests)
+		writeQuotaExceeded(w, &ErrorResponse{
+			Message: fmt.Sprintf("rate limit of %d requests per minute has been exceeded, try again after %s",
+				q.cfg.RequestsPerMinute, availableAt.UTC().Format(time.RFC3339)),
+			Reason: ReasonRateLimited,
+			Limit:  &q.cfg.RequestsPerMinute,
+		}, now, availableAt)
+	})
+}
+
+// limitRuns rejects runs of clients which have exhausted their daily budget.
+// If the store fails, runs are let through.
+func (q *Quota) limitRuns(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var exceeded *quotaExceededError
+		if errors.As(q.takeRun(r), &exceeded) {
+			writeQuotaExceeded(w, exceeded.resp, exceeded.now, exceeded.retryAt)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeRun counts a run of the client against its daily budget. It returns quotaExceededError
+// once the budget is exhausted. If the store fails, the run is let through.
+func (q *Quota) takeRun(r *http.Request) error {
+	client, limited := q.limitedClient(r)
+	if !limited || q.cfg.DailyRuns == 0 {
+		return nil
+	}
+
+	now := q.now()
+	day := now.UTC().Truncate(24 * time.Hour)
+	ok, err := q.store.CountRun(r.Context(), client, day, q.cfg.DailyRuns)
+	if err != nil {
+		zlog.Error().Err(err).Str("client", client).Msg("daily runs cannot be counted")
+	}
+	if ok || err != nil {
+		return nil
+	}
+
+	resetAt := day.Add(24 * time.Hour)
+	metrics.Quota.Throttled(quotaDailyRuns)
+
+	return &quotaExceededError{
+		resp: &ErrorResponse{
+			Message: fmt.Sprintf("daily limit of %d runs has been exceeded, try again after %s",
+				q.cfg.DailyRuns, resetAt.Format(time.RFC3339)),
+			Code:    http.StatusTooManyRequests,
+			Reason:  ReasonDailyRunsExceeded,
+			RetryAt: &resetAt,
+			Limit:   &q.cfg.DailyRuns,
+		},
+		now:     now,
+		retryAt: resetAt,
+	}
+}
+
+// quotaExceededError is the response to a run that exceeds the quota of the client.
+type quotaExceededError struct {
+	resp    *ErrorResponse
+	now     time.Time
+	retryAt time.Time
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.resp.Message
+}
+
+func writeQuotaExceeded(w http.ResponseWriter, resp *ErrorResponse, now time.Time, retryAt time.Time) {
+	retryAt = retryAt.UTC()
+	resp.Code = http.StatusTooManyRequests
+	resp.RetryAt = &retryAt
+
+	writeRetryAfter(w, retryAt.Sub(now))
+	writeErrorResponse(w, resp)
+}
+
+// MemoryQuotaStore keeps quota counters of clients in memory.
+type MemoryQuotaStore struct {
+	mu sync.Mutex
+
+	buckets   map[string]*tokenBucket
+	sweptAt   time.Time
+	day       time.Time
+	dailyRuns map[string]uint
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// quotaSweepInterval is how often full buckets are dropped, a missing bucket is a full one.
+const quotaSweepInterval = time.Minute
+
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		buckets:   make(map[string]*tokenBucket),
+		dailyRuns: make(map[string]uint),
+	}
+}
+
+func (s *MemoryQuotaStore) TakeToken(_ context.Context, client string, rate float64, burst uint, now time.Time) (bool, time.Time, error) {
+	if rate <= 0 || burst == 0 {
+		return false, time.Time{}, errors.New("rate and burst must be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, found := s.buckets[client]
+	if !found {
+		b = &tokenBucket{tokens: float64(burst), updatedAt: now}
+		s.buckets[client] = b
+	}
+
+	if elapsed := now.Sub(b.updatedAt).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.updatedAt = now
+	}
+
+	if b.tokens < 1 {
+		return false, now.Add(time.Duration((1 - b.tokens) / rate * float64(time.Second))), nil
+	}
+
+	b.tokens--
+	b.fullAt = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+
+	return true, now, nil
+}
+
+// sweep drops buckets that have been refilled, so the store does not grow with every client ever seen.
+func (s *MemoryQuotaStore) sweep(now time.Time) {
+	if now.Sub(s.sweptAt) < quotaSweepInterval {
+		return
+	}
+	s.sweptAt = now
+
+	for client, b := range s.buckets {
+		if !now.Before(b.fullAt) {
+			delete(s.buckets, client)
+		}
+	}
+}
+
+func (s *MemoryQuotaStore) CountRun(_ context.Context, client string, day time.Time, limit uint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Counters of the previous day are dropped at once.
+	if !day.Equal(s.day) {
+		s.day = day
+		s.dailyRuns = make(map[string]uint)
+	}
+
+	if s.dailyRuns[client] >= limit {
+		return false, nil
+	}
+	s.dailyRuns[client]++
+
+	return true, nil
+}
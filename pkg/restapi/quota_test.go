@@ -0,0 +1,124 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryQuotaStore_TakeToken(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryQuotaStore()
+	now := time.Date(2023, 4, 1, 18, 0, 0, 0, time.UTC)
+
+	// 1 token per second, 2 tokens at once.
+	for i := 0; i < 2; i++ {
+		ok, _, err := s.TakeToken(ctx, "203.0.113.7", 1, 2, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	ok, availableAt, err := s.TakeToken(ctx, "203.0.113.7", 1, 2, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, now.Add(time.Second), availableAt)
+
+	ok, _, _ = s.TakeToken(ctx, "203.0.113.8", 1, 2, now)
+	assert.True(t, ok, "clients have their own buckets")
+
+	ok, _, _ = s.TakeToken(ctx, "203.0.113.7", 1, 2, now.Add(time.Second))
+	assert.True(t, ok, "the bucket is refilled")
+
+	// Refilled buckets are dropped.
+	s.TakeToken(ctx, "203.0.113.9", 1, 2, now.Add(time.Hour))
+	assert.Len(t, s.buckets, 1)
+}
+
+func TestMemoryQuotaStore_CountRun(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryQuotaStore()
+	day := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		ok, err := s.CountRun(ctx, "203.0.113.7", day, 2)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	ok, _ := s.CountRun(ctx, "203.0.113.7", day, 2)
+	assert.False(t, ok)
+
+	ok, _ = s.CountRun(ctx, "203.0.113.7", day.Add(24*time.Hour), 2)
+	assert.True(t, ok, "the budget is reset the next day")
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2023, 4, 1, 18, 0, 0, 0, time.UTC)
+	q, err := NewQuota(QuotaConfig{
+		RequestsPerMinute: 60,
+		Burst:             3,
+		DailyRuns:         2,
+		Exempt:            []string{"198.51.100.0/24"},
+	}, NewMemoryQuotaStore())
+	require.NoError(t, err)
+	q.now = func() time.Time { return now }
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	runs := q.limitRequests(q.limitRuns(ok))
+
+	serve := func(addr string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		runs.ServeHTTP(rec, newLimitedRequest(addr, nil))
+		return rec
+	}
+
+	decode := func(rec *httptest.ResponseRecorder) *ErrorResponse {
+		var resp Response
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.NotNil(t, resp.Error)
+		return resp.Error
+	}
+
+	assert.Equal(t, http.StatusOK, serve("203.0.113.7:5000").Code)
+	assert.Equal(t, http.StatusOK, serve("203.0.113.7:5001").Code)
+
+	rec := serve("203.0.113.7:5000")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "21600", rec.Header().Get("Retry-After"))
+	resp := decode(rec)
+	assert.Equal(t, ReasonDailyRunsExceeded, resp.Reason)
+	require.NotNil(t, resp.Limit)
+	assert.Equal(t, uint(2), *resp.Limit)
+	require.NotNil(t, resp.RetryAt)
+	assert.Equal(t, time.Date(2023, 4, 2, 0, 0, 0, 0, time.UTC), *resp.RetryAt)
+
+	// The rejected run has taken the last token of the burst.
+	rec = serve("203.0.113.7:5000")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	resp = decode(rec)
+	assert.Equal(t, ReasonRateLimited, resp.Reason)
+	require.NotNil(t, resp.Limit)
+	assert.Equal(t, uint(60), *resp.Limit)
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, serve("198.51.100.1:5000").Code, "exempt clients are not limited")
+	}
+}
+
+func TestNewQuota(t *testing.T) {
+	q, err := NewQuota(QuotaConfig{RequestsPerMinute: 30}, NewMemoryQuotaStore())
+	require.NoError(t, err)
+	assert.Equal(t, uint(30), q.cfg.Burst)
+
+	_, err = NewQuota(QuotaConfig{Exempt: []string{"office"}}, NewMemoryQuotaStore())
+	assert.Error(t, err)
+}
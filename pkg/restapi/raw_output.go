@@ -0,0 +1,111 @@
+package restapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const (
+	rawStreamStdout = "stdout"
+	rawStreamStderr = "stderr"
+)
+
+// getRawOutput returns the stored output stream as is, without the JSON envelope.
+// Range requests are supported, so large outputs can be downloaded in parts.
+func (h *queryHandler) getRawOutput(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		stream = rawStreamStdout
+	}
+	if stream != rawStreamStdout && stream != rawStreamStderr {
+		writeError(w, "stream must be stdout or stderr", http.StatusBadRequest)
+		return
+	}
+
+	// Runs that are in flight, missing or deleted must not be cached.
+	w.Header().Set("Cache-Control", cacheControlRevalidate)
+
+	run, err := h.runRepo.Get(r.Context(), id)
+	if errors.Is(err, queryrun.ErrNotFound) {
+		h.writeRunNotFound(w, id)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if run.Deleted() {
+		writeDeleted(w, run)
+		return
+	}
+	if run.Failed() {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	content := run.Stdout()
+	contentType := outputContentType(run.Settings)
+	if stream == rawStreamStderr {
+		content = run.Stderr
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	// The output is produced by untrusted queries, so browsers must not interpret it as a page.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	// Outputs never change, so clients can keep them while the run is stored. ServeContent handles conditional and range requests.
+	w.Header().Set("ETag", runETag(run, stream))
+	w.Header().Set("Cache-Control", outputCacheControl(run, time.Now()))
+
+	http.ServeContent(w, r, "", run.CreatedAt, strings.NewReader(content))
+}
+
+// outputContentType maps the output format of the run to the content type.
+// Formats that are not known are served as plain text.
+func outputContentType(settings runsettings.RunSettings) string {
+	chSettings, ok := settings.(*runsettings.ClickHouseSettings)
+	if !ok {
+		return "text/plain; charset=utf-8"
+	}
+
+	format := strings.ToLower(chSettings.OutputFormat)
+	switch {
+	case strings.HasPrefix(format, "jsoneachrow"), strings.HasPrefix(format, "jsoncompacteachrow"),
+		strings.HasPrefix(format, "jsonstringseachrow"), strings.HasPrefix(format, "jsonlines"),
+		format == "ndjson":
+		return "application/x-ndjson"
+
+	case strings.HasPrefix(format, "json"):
+		return "application/json"
+
+	case strings.HasPrefix(format, "csv"):
+		return "text/csv; charset=utf-8"
+
+	case strings.HasPrefix(format, "tabseparated"), strings.HasPrefix(format, "tsv"):
+		return "text/tab-separated-values; charset=utf-8"
+
+	case format == "xml":
+		return "application/xml"
+
+	case format == "parquet", format == "arrow", format == "arrowstream", format == "orc",
+		format == "avro", format == "native", format == "rowbinary", format == "msgpack":
+		return "application/octet-stream"
+
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
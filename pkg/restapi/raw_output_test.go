@@ -0,0 +1,32 @@
+package restapi
+
+import (
+	"testing"
+
+	"clickhouse-playground/internal/database/runsettings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputContentType(t *testing.T) {
+	cases := map[string]string{
+		"":                   "text/plain; charset=utf-8",
+		"Pretty":             "text/plain; charset=utf-8",
+		"JSON":               "application/json",
+		"JSONCompact":        "application/json",
+		"JSONEachRow":        "application/x-ndjson",
+		"CSVWithNames":       "text/csv; charset=utf-8",
+		"TabSeparated":       "text/tab-separated-values; charset=utf-8",
+		"TSVWithNames":       "text/tab-separated-values; charset=utf-8",
+		"XML":                "application/xml",
+		"Parquet":            "application/octet-stream",
+		"HTML-like-unknowns": "text/plain; charset=utf-8",
+	}
+
+	for format, want := range cases {
+		got := outputContentType(&runsettings.ClickHouseSettings{OutputFormat: format})
+		assert.Equal(t, want, got, format)
+	}
+
+	assert.Equal(t, "text/plain; charset=utf-8", outputContentType(nil))
+}
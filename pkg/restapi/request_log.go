@@ -0,0 +1,141 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+const HeaderRequestID = "X-Request-Id"
+
+// maxRequestIDLength bounds request ids accepted from clients, so they cannot bloat the logs.
+const maxRequestIDLength = 128
+
+// RequestLogConfig configures access logs of the API. Failed requests are always logged:
+// 5xx errors with the error level, 4xx errors with the warn level.
+type RequestLogConfig struct {
+	// SuccessLevel is the level of successful requests.
+	SuccessLevel zerolog.Level
+
+	// SuccessSampling logs every Nth successful request. 0 and 1 log every request.
+	SuccessSampling uint64
+}
+
+// requestInfo is filled by the handlers with the run details, so they are logged with the request.
+type requestInfo struct {
+	id string
+
+	// generated is set if the id has been generated by the server rather than passed by the client.
+	// Only generated ids are reused as run ids, so clients cannot choose ids of runs.
+	generated bool
+
+	runID       string
+	version     string
+	queryLength int
+}
+
+type requestInfoCtxKey struct{}
+
+// requestLogMiddleware assigns a request id and logs the handled request. The id is taken from the X-Request-Id
+// header if the client has passed it, and is returned in the same response header. The context of the request
+// carries the id and a logger with it, see zerolog.Ctx.
+func requestLogMiddleware(logger zerolog.Logger, cfg RequestLogConfig) func(http.Handler) http.Handler {
+	var successes atomic.Uint64
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isProbeRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+
+			info := &requestInfo{id: r.Header.Get(HeaderRequestID)}
+			if !validRequestID(info.id) {
+				info.id = queryrun.NewID()
+				info.generated = true
+			}
+			w.Header().Set(HeaderRequestID, info.id)
+
+			reqLogger := logger.With().Str("request_id", info.id).Logger()
+			ctx := context.WithValue(r.Context(), requestInfoCtxKey{}, info)
+			ctx = context.WithValue(ctx, middleware.RequestIDKey, info.id)
+			ctx = reqLogger.WithContext(ctx)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			var event *zerolog.Event
+			switch {
+			case status >= http.StatusInternalServerError:
+				event = reqLogger.Error()
+			case status >= http.StatusBadRequest:
+				event = reqLogger.Warn()
+			default:
+				if n := successes.Add(1); cfg.SuccessSampling > 1 && n%cfg.SuccessSampling != 1 {
+					return
+				}
+				event = reqLogger.WithLevel(cfg.SuccessLevel)
+			}
+
+			event = event.
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Int("status", status).
+				Dur("duration", time.Since(start)).
+				Str("client", clientID(r)).
+				Int("bytes", ww.BytesWritten())
+			if info.runID != "" {
+				event = event.Str("run_id", info.runID)
+			}
+			if info.version != "" {
+				event = event.Str("version", info.version).Int("query_length", info.queryLength)
+			}
+			event.Msg("request has been handled")
+		})
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// annotateRequest adds the run details to the request log. The run takes the id of the request
+// if it has been generated by the server, so logs of the request and the run share the id.
+func annotateRequest(r *http.Request, run *queryrun.Run) {
+	info, ok := r.Context().Value(requestInfoCtxKey{}).(*requestInfo)
+	if !ok {
+		return
+	}
+
+	// A request creates a single run, the check keeps ids unique anyway.
+	if info.generated && info.runID == "" {
+		run.ID = info.id
+	}
+
+	info.runID = run.ID
+	info.version = run.RequestedVersion
+	info.queryLength = len(run.Input)
+}
@@ -0,0 +1,67 @@
+package restapi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+
+	var run *queryrun.Run
+	handler := requestLogMiddleware(logger, RequestLogConfig{SuccessLevel: zerolog.InfoLevel, SuccessSampling: 2})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			run = queryrun.New("SELECT 1", "clickhouse", "23.3.1.2823", nil)
+			run.RequestedVersion = "23.3"
+			annotateRequest(r, run)
+
+			if r.URL.Path == "/fail" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}),
+	)
+
+	serve := func(path string, requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if requestID != "" {
+			req.Header.Set(HeaderRequestID, requestID)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := serve("/api/runs", "")
+	id := rec.Header().Get(HeaderRequestID)
+	require.NotEmpty(t, id)
+	assert.Equal(t, id, run.ID, "generated ids are reused by runs")
+	assert.Contains(t, logs.String(), `"request_id":"`+id+`"`)
+	assert.Contains(t, logs.String(), `"version":"23.3","query_length":8`)
+
+	rec = serve("/api/runs", "client-id")
+	assert.Equal(t, "client-id", rec.Header().Get(HeaderRequestID))
+	assert.NotEqual(t, "client-id", run.ID, "ids passed by clients are not reused by runs")
+
+	rec = serve("/api/runs", strings.Repeat("x", maxRequestIDLength+1))
+	assert.Len(t, rec.Header().Get(HeaderRequestID), 12, "invalid ids are replaced")
+
+	serve("/fail", "")
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 3, "every second successful request is logged, failures are always logged")
+	assert.Contains(t, lines[1], `"level":"info"`)
+	assert.Contains(t, lines[2], `"level":"warn"`)
+	assert.Contains(t, lines[2], `"status":400`)
+}
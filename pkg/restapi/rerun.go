@@ -0,0 +1,166 @@
+package restapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+type RerunInput struct {
+	// Version is the version to run on. If it's empty, the version of the original run is used.
+	Version string `json:"version"`
+
+	// Strict disables resolution of partial versions: the version must be an existing tag.
+	Strict bool `json:"strict"`
+
+	// PinDigest runs the exact image of the original run instead of resolving its version again,
+	// which may give another image if the tag has been re-pushed.
+	PinDigest bool `json:"pin_digest"`
+}
+
+// ReasonImageDigestUnavailable is set when a re-run is pinned to an image that is not available anymore.
+const ReasonImageDigestUnavailable = "image_digest_unavailable"
+
+// rerun executes a stored run again, possibly on another version. The body is optional.
+// The new run refers to the original one, and the response tells whether the output has changed.
+func (h *queryHandler) rerun(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var input RerunInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parent, err := h.runRepo.Get(r.Context(), id)
+	if errors.Is(err, queryrun.ErrExpired) {
+		writeError(w, "run has expired", http.StatusGone)
+		return
+	}
+	if errors.Is(err, queryrun.ErrNotFound) {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+	if parent.Deleted() {
+		writeDeleted(w, parent)
+		return
+	}
+	if parent.Failed() {
+		writeError(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	req := rerunInput(parent)
+	if input.Version != "" {
+		req.Version = input.Version
+		req.Strict = input.Strict
+	}
+
+	if input.PinDigest {
+		if input.Version != "" && input.Version != parent.Version {
+			writeError(w, "the version cannot be changed if the digest is pinned", http.StatusBadRequest)
+			return
+		}
+		if parent.ImageDigest == "" {
+			writeError(w, "the run has no recorded image digest, re-run it without pin_digest", http.StatusBadRequest)
+			return
+		}
+
+		req.pinned = &dockertag.Image{
+			Repository: parent.ImageRepository,
+			Tag:        parent.Version,
+			Digest:     parent.ImageDigest,
+			Rolling:    parent.ImageBuildDate != nil,
+		}
+		if parent.ImageBuildDate != nil {
+			req.pinned.BuildDate = *parent.ImageBuildDate
+		}
+	}
+
+	h.execute(w, r, &req, parent)
+}
+
+// rerunInput builds the request that reproduces the stored run.
+// The result cache is bypassed, as the point of a re-run is a fresh execution.
+func rerunInput(run *queryrun.Run) RunQueryInput {
+	req := RunQueryInput{
+		Query:    run.Input,
+		Version:  run.Version,
+		Database: run.Database,
+		Strict:   true,
+		NoCache:  true,
+		Network:  run.Network,
+	}
+
+	if chSettings, ok := run.Settings.(*runsettings.ClickHouseSettings); ok {
+		req.Settings.ClickHouseSettings = &ClickHouseSettings{OutputFormat: chSettings.OutputFormat}
+	}
+
+	// The input of a run of statements joins them, they are executed separately again.
+	if len(run.Statements) > 0 {
+		req.Query = ""
+		req.ContinueOnError = run.ContinueOnError
+		for _, s := range run.Statements {
+			req.Statements = append(req.Statements, s.Query)
+		}
+	}
+
+	for _, f := range run.Files {
+		req.Files = append(req.Files, FileInput{Name: f.Name, Content: base64.StdEncoding.EncodeToString(f.Content)})
+	}
+
+	if run.Tool != "" {
+		req.Tool = &ToolInput{
+			Name:   run.Tool,
+			Params: run.ToolParams,
+		}
+	}
+
+	return req
+}
+
+// outputChanged reports whether the output differs from the output of the parent run.
+// It's nil if the run has no parent or the parent is an imported fiddle that has never been run.
+func outputChanged(parent *queryrun.Run, output string) *bool {
+	if parent == nil || parent.ImportedFrom != "" && parent.Output == "" {
+		return nil
+	}
+
+	changed := parent.Output != output
+
+	return &changed
+}
+
+// writeImageDigestUnavailable responds to a pinned re-run whose image is gone. The current digest of the version
+// is reported, so the client can decide to re-run without pinning.
+func (h *queryHandler) writeImageDigestUnavailable(w http.ResponseWriter, run *queryrun.Run) {
+	resp := &ErrorResponse{
+		Message: fmt.Sprintf("image %s of version %s is not available anymore", run.ImageDigest, run.Version),
+		Code:    http.StatusGone,
+		Reason:  ReasonImageDigestUnavailable,
+	}
+
+	if img, found := h.tagStorage.Resolve(run.Version, true); found {
+		resp.Message += fmt.Sprintf(", the version is resolved to %s now", img.Digest)
+		resp.CurrentDigest = img.Digest
+	}
+
+	writeErrorResponse(w, resp)
+}
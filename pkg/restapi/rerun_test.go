@@ -0,0 +1,269 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/database/runsettings"
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRerunInput(t *testing.T) {
+	run := queryrun.New("SELECT 1", ClickHouseDatabase, "23.3.1.2823", &runsettings.ClickHouseSettings{OutputFormat: "JSON"})
+	run.Labels = []string{"bug"}
+
+	req := rerunInput(run)
+	assert.Equal(t, "SELECT 1", req.Query)
+	assert.Equal(t, "23.3.1.2823", req.Version)
+	assert.Equal(t, ClickHouseDatabase, req.Database)
+	assert.True(t, req.Strict)
+	assert.True(t, req.NoCache)
+	assert.Empty(t, req.Labels)
+	assert.Nil(t, req.Tool)
+	require.NotNil(t, req.Settings.ClickHouseSettings)
+	assert.Equal(t, "JSON", req.Settings.ClickHouseSettings.OutputFormat)
+
+	run.Files = []queryrun.File{{Name: "data.csv", Content: []byte("1,a\n")}}
+
+	req = rerunInput(run)
+	assert.Equal(t, []FileInput{{Name: "data.csv", Content: "MSxhCg=="}}, req.Files)
+
+	run.Files = nil
+	run.Tool = "benchmark"
+	run.ToolParams = map[string]string{"iterations": "10"}
+
+	req = rerunInput(run)
+	require.NotNil(t, req.Tool)
+	assert.Equal(t, "benchmark", req.Tool.Name)
+	assert.Equal(t, run.ToolParams, req.Tool.Params)
+}
+
+func TestOutputChanged(t *testing.T) {
+	assert.Nil(t, outputChanged(nil, "1"))
+
+	parent := &queryrun.Run{Output: "1\n"}
+
+	changed := outputChanged(parent, "1\n")
+	require.NotNil(t, changed)
+	assert.False(t, *changed)
+
+	changed = outputChanged(parent, "2\n")
+	require.NotNil(t, changed)
+	assert.True(t, *changed)
+
+	imported := &queryrun.Run{ImportedFrom: "https://gist.githubusercontent.com/u/1/raw/q.sql"}
+	assert.Nil(t, outputChanged(imported, "1\n"))
+}
+
+// repushedTagStorage resolves every version to an image pushed after the stored runs.
+type repushedTagStorage struct {
+	staticTagStorage
+}
+
+func (repushedTagStorage) Resolve(version string, _ bool) (dockertag.Image, bool) {
+	return dockertag.Image{Repository: "clickhouse/clickhouse-server", Tag: version, Digest: "sha256:new"}, true
+}
+
+func (s repushedTagStorage) Find(version string) (dockertag.Image, bool) {
+	return s.Resolve(version, false)
+}
+
+func TestRerunPinDigest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		digest    string
+		runErr    error
+		status    int
+		pinned    bool
+		runDigest string
+	}{
+		{
+			name:      "pinned",
+			body:      `{"pin_digest": true}`,
+			digest:    "sha256:old",
+			status:    http.StatusOK,
+			pinned:    true,
+			runDigest: "sha256:old",
+		},
+		{
+			name:      "resolved again",
+			digest:    "sha256:old",
+			status:    http.StatusOK,
+			runDigest: "sha256:new",
+		},
+		{
+			name:   "pinned image is gone",
+			body:   `{"pin_digest": true}`,
+			digest: "sha256:old",
+			runErr: errors.Wrap(qrunner.ErrImageDigestUnavailable, "docker pull failed: manifest unknown"),
+			status: http.StatusGone,
+		},
+		{
+			name:   "no recorded digest",
+			body:   `{"pin_digest": true}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "another version",
+			body:   `{"pin_digest": true, "version": "23.8"}`,
+			digest: "sha256:old",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			parent := queryrun.New("SELECT 1", ClickHouseDatabase, "22.3", &runsettings.ClickHouseSettings{})
+			parent.ImageRepository = "clickhouse/clickhouse-server"
+			parent.ImageDigest = tt.digest
+
+			repo := &memoryRunRepo{runs: map[string]*queryrun.Run{parent.ID: parent}}
+
+			var executed *queryrun.Run
+			runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+				executed = run
+				return "1\n", tt.runErr
+			}}
+			h := newQueryHandler(runner, repo, repushedTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", parent.ID)
+			r := httptest.NewRequest(http.MethodPost, "/runs/"+parent.ID+"/rerun", strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			rec := httptest.NewRecorder()
+			h.rerun(rec, r)
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+
+			switch tt.status {
+			case http.StatusOK:
+				require.NotNil(t, executed)
+				assert.Equal(t, tt.pinned, executed.PinnedImage)
+				assert.Equal(t, tt.runDigest, executed.ImageDigest)
+				assert.Equal(t, "22.3", executed.Version)
+
+				var resp struct {
+					Result RunQueryOutput `json:"result"`
+				}
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+				assert.Equal(t, tt.runDigest, resp.Result.ImageDigest)
+
+			case http.StatusGone:
+				var resp Response
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+				require.NotNil(t, resp.Error)
+				assert.Equal(t, ReasonImageDigestUnavailable, resp.Error.Reason)
+				assert.Equal(t, "sha256:new", resp.Error.CurrentDigest)
+			}
+		})
+	}
+}
+
+func TestRerunGoneParent(t *testing.T) {
+	repo := queryrun.NewMemoryRepository(time.Hour, 0)
+
+	expired := queryrun.New("SELECT 1", ClickHouseDatabase, "22.3", &runsettings.ClickHouseSettings{})
+	expired.CreatedAt = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, repo.Create(context.Background(), expired))
+
+	deleted := queryrun.New("SELECT 2", ClickHouseDatabase, "22.3", &runsettings.ClickHouseSettings{})
+	require.NoError(t, repo.Create(context.Background(), deleted))
+	require.NoError(t, repo.Delete(context.Background(), deleted, "user request"))
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+		error  string
+	}{
+		{name: "expired", id: expired.ID, status: http.StatusGone, error: "run has expired"},
+		{name: "deleted", id: deleted.ID, status: http.StatusGone},
+		{name: "unknown", id: "unknown", status: http.StatusNotFound, error: "run not found"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+				t.Fatal("the run must not be executed")
+				return "", nil
+			}}
+			h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", tt.id)
+			r := httptest.NewRequest(http.MethodPost, "/runs/"+tt.id+"/rerun", nil)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			rec := httptest.NewRecorder()
+			h.rerun(rec, r)
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+
+			if tt.error != "" {
+				var resp Response
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+				require.NotNil(t, resp.Error)
+				assert.Equal(t, tt.error, resp.Error.Message)
+			}
+		})
+	}
+}
+
+func TestRerunFiles(t *testing.T) {
+	parent := queryrun.New("SELECT * FROM file('data.csv')", ClickHouseDatabase, "22.3", &runsettings.ClickHouseSettings{})
+	parent.Files = []queryrun.File{{Name: "data.csv", Content: []byte("1,a\n")}}
+	repo := &memoryRunRepo{runs: map[string]*queryrun.Run{parent.ID: parent}}
+
+	tests := []struct {
+		name         string
+		maxFilesSize uint64
+		status       int
+	}{
+		{name: "restored", maxFilesSize: 1024, status: http.StatusOK},
+		{name: "over the lowered limit", maxFilesSize: 2, status: http.StatusRequestEntityTooLarge},
+		{name: "files are disabled", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var executed *queryrun.Run
+			runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+				executed = run
+				return "1\n", nil
+			}}
+			h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+			h.maxFilesSize = tt.maxFilesSize
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", parent.ID)
+			r := httptest.NewRequest(http.MethodPost, "/runs/"+parent.ID+"/rerun", nil)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			rec := httptest.NewRecorder()
+			h.rerun(rec, r)
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+
+			if tt.status != http.StatusOK {
+				assert.Nil(t, executed, "the run is not executed without its files")
+				assert.Contains(t, rec.Body.String(), "files of the run cannot be restored")
+
+				return
+			}
+
+			require.NotNil(t, executed)
+			assert.Equal(t, parent.Files, executed.Files)
+		})
+	}
+}
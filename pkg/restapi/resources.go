@@ -0,0 +1,33 @@
+package restapi
+
+import (
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// ResourcesInput are container limits of the run. Missing fields keep the limits of the runner.
+type ResourcesInput struct {
+	MemoryLimitMB uint64  `json:"memory_limit_mb,omitempty"`
+	CPULimit      float64 `json:"cpu_limit,omitempty"`
+	PidsLimit     int64   `json:"pids_limit,omitempty"`
+}
+
+func (in *ResourcesInput) validate() error {
+	if in.CPULimit < 0 {
+		return errors.New("resources.cpu_limit cannot be negative")
+	}
+	if in.PidsLimit < 0 {
+		return errors.New("resources.pids_limit cannot be negative")
+	}
+
+	return nil
+}
+
+func (in *ResourcesInput) toResources() *queryrun.Resources {
+	return &queryrun.Resources{
+		MemoryLimit: in.MemoryLimitMB * 1e6,    // mb -> bytes.
+		CPULimit:    uint64(in.CPULimit * 1e9), // cpu -> nano cpu.
+		PidsLimit:   in.PidsLimit,
+	}
+}
@@ -0,0 +1,97 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunResources(t *testing.T) {
+	privileged := &APIKey{Name: "internal", Permissions: []string{PermissionSetResources}}
+
+	tests := []struct {
+		name      string
+		body      string
+		key       *APIKey
+		runErr    error
+		status    int
+		resources *queryrun.Resources
+		message   string
+	}{
+		{
+			name:   "runner limits",
+			body:   `{"query": "SELECT 1", "version": "23.3"}`,
+			status: http.StatusOK,
+		},
+		{
+			name:      "overridden",
+			body:      `{"query": "SELECT 1", "version": "23.3", "resources": {"memory_limit_mb": 4000, "cpu_limit": 0.5}}`,
+			key:       privileged,
+			status:    http.StatusOK,
+			resources: &queryrun.Resources{MemoryLimit: 4e9, CPULimit: 5e8},
+		},
+		{
+			name:   "not permitted",
+			body:   `{"query": "SELECT 1", "version": "23.3", "resources": {"memory_limit_mb": 4000}}`,
+			key:    &APIKey{Name: "other"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "negative",
+			body:   `{"query": "SELECT 1", "version": "23.3", "resources": {"pids_limit": -1}}`,
+			key:    privileged,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:    "out of memory",
+			body:    `{"query": "SELECT * FROM numbers(1e12) ORDER BY number", "version": "23.3"}`,
+			runErr:  errors.Wrap(&qrunner.MemoryLimitError{Limit: 1e9}, "failed to run query"),
+			status:  http.StatusBadRequest,
+			message: "query exceeded the memory limit (1000 MB)",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var executed *queryrun.Run
+			runner := funcRunner{run: func(run *queryrun.Run) (string, error) {
+				executed = run
+				if tt.runErr != nil {
+					return "", tt.runErr
+				}
+
+				return "1\n", nil
+			}}
+
+			repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+			h := newQueryHandler(runner, repo, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+			r := httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(tt.body))
+			if tt.key != nil {
+				r = r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, *tt.key))
+			}
+
+			rec := httptest.NewRecorder()
+			h.runQuery(rec, r)
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+
+			if tt.message != "" {
+				assert.Contains(t, rec.Body.String(), tt.message)
+			}
+			if tt.status == http.StatusOK {
+				require.NotNil(t, executed)
+				assert.Equal(t, tt.resources, executed.Resources)
+			}
+		})
+	}
+}
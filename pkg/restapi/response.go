@@ -3,6 +3,7 @@ package restapi
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	zlog "github.com/rs/zerolog/log"
 )
@@ -15,20 +16,44 @@ type Response struct {
 type ErrorResponse struct {
 	Message string `json:"message"`
 	Code    int    `json:"code"`
+
+	// Reason distinguishes errors with the same code, e.g. "too_many_inflight_runs".
+	Reason string `json:"reason,omitempty"`
+
+	// InFlight is the number of runs of the client in progress. It's set if the in-flight limit is exceeded.
+	InFlight *uint `json:"in_flight,omitempty"`
+
+	// RetryAt is the estimated time the request can succeed. It's set if the image pull is rate limited
+	// or the client has exceeded its quota.
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+
+	// Limit is the exceeded quota: requests per minute or runs per day, depending on the reason.
+	Limit *uint `json:"limit,omitempty"`
+
+	// CurrentDigest is the digest the version is resolved to now. It's set if the pinned image is not available.
+	CurrentDigest string `json:"current_digest,omitempty"`
+
+	// ServerLogs is the sanitized logs tail of the database server that has not started. It's set only
+	// if the deployment exposes server logs.
+	ServerLogs string `json:"server_logs,omitempty"`
 }
 
 func writeError(w http.ResponseWriter, msg string, code int) {
-	if code < 600 { // nolint
-		w.WriteHeader(code)
+	writeErrorResponse(w, &ErrorResponse{
+		Message: msg,
+		Code:    code,
+	})
+}
+
+func writeErrorResponse(w http.ResponseWriter, resp *ErrorResponse) {
+	if resp.Code < 600 { // nolint
+		w.WriteHeader(resp.Code)
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 
 	writeResponse(w, &Response{
-		Error: &ErrorResponse{
-			Message: msg,
-			Code:    code,
-		},
+		Error: resp,
 	})
 }
 
@@ -3,7 +3,6 @@ package restapi
 import (
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"clickhouse-playground/internal/metrics"
@@ -19,57 +18,259 @@ type RouterOpts struct {
 	Logger     zerolog.Logger
 	Runner     QueryRunner
 	TagStorage TagStorage
-	RunRepo    queryrun.Repository
+	// RunRepo is optional. If it's nil, runs are not saved, and routes reading saved runs respond with 501.
+	RunRepo queryrun.Repository
 
+	// RequestLog configures access logs.
+	RequestLog RequestLogConfig
+
+	// TrustedProxies are allowed to pass the client address in proxy headers.
+	TrustedProxies TrustedProxies
+
+	// BlockList is optional. If it's nil, no client is blocked.
+	BlockList BlockList
+	// BlockedMessage is returned to blocked clients. If it's empty, DefaultBlockedMessage is used.
+	BlockedMessage string
+
+	// APIKeys grant permissions to clients, e.g. runner selection. Requests without a key are anonymous.
+	APIKeys APIKeys
+	// Runners are names of runners that can be selected by clients with the select_runner permission.
+	Runners []string
+
+	// Policy is optional. If it's nil, all queries are allowed.
+	Policy QueryPolicy
+
+	// OutputProcessor is optional. If it's nil, outputs are stored and returned as is.
+	OutputProcessor OutputProcessor
+
+	// ResultCache is optional. If it's nil, results are not cached.
+	ResultCache ResultCache
+
+	// Images is optional. If it's nil, pull estimates are not available.
+	Images ImageInspector
+
+	// RunLimiter is optional. If it's nil, the number of runs in progress is not limited per client.
+	RunLimiter *ClientRunLimiter
+
+	// Quota is optional. If it's nil, the request rate and daily runs are not limited per client.
+	Quota *Quota
+
+	// PullRateLimits is optional. If it's nil, rate limited runs are rejected without the reset time.
+	PullRateLimits PullRateLimitInspector
+
+	// Canary is optional. If it's nil, versions are never reported as degraded.
+	Canary CanaryStatus
+
+	// TagJournal is optional. If it's nil, changes of the tag list are not served.
+	TagJournal TagJournal
+
+	// Meta is optional. If it's nil, the deployment description is not served.
+	Meta *MetaStore
+
+	// Maintenance is optional. If it's nil, runs are always executed, and the description has no maintenance section.
+	Maintenance MaintenanceMode
+
+	// Drain is optional. If it's nil, runs are accepted until the server is stopped.
+	Drain *Drain
+
+	// Health is optional. If it's nil, the health document is not served.
+	Health HealthReporter
+	// Readiness is optional. If it's nil, the readiness probe is not served, the liveness probe always is.
+	Readiness ReadinessChecker
+
+	// Fetcher is optional. If it's nil, fiddles cannot be imported from external links.
+	Fetcher FiddleFetcher
+
+	// Bisect is optional. If it's nil, queries cannot be bisected across versions.
+	Bisect *BisectConfig
+
+	// Sessions is optional. If it's nil, interactive sessions are not available. SessionOpener is required then.
+	Sessions      *SessionConfig
+	SessionOpener SessionOpener
+
+	// Timeout is a deadline of run executions and container preparations.
 	Timeout time.Duration
+	// Deadlines is optional. If it's set, it overrides Timeout and readiness limits of runners by versions.
+	Deadlines DeadlineResolver
+	// FinishAbandonedRuns keeps runs going after their clients have disconnected, so the results are saved.
+	FinishAbandonedRuns bool
+	// ExposeServerLogs returns the logs tail of database servers that have not started with the run error.
+	ExposeServerLogs bool
+	// LookupTimeout limits requests served from the storage: versions and runs lookups.
+	LookupTimeout time.Duration
+
+	// TimingsWindow is a period of runs aggregated by the timings summary.
+	TimingsWindow time.Duration
+	// TimingsMaxRuns limits the number of runs aggregated by the timings summary.
+	TimingsMaxRuns int
+
+	// AllowedFormats are output formats runs can request. If it's empty, any format is allowed.
+	AllowedFormats []string
 
 	MaxQueryLength  uint64
 	MaxOutputLength uint64
+
+	// MaxFilesSize bounds the total size of files of a run (in bytes). If it's 0, runs cannot have files.
+	MaxFilesSize uint64
+
+	// BodyLimits bound compressed bodies of runs. If the expanded limit is 0, compressed bodies are not accepted.
+	BodyLimits BodyLimits
+}
+
+var allowedHeaders = []string{
+	"Accept", "Authorization", "Content-Type", "Content-Encoding", "X-CSRF-Token", "If-None-Match", "Range",
+	"X-ClickHouse-Version", "X-ClickHouse-Database", "X-ClickHouse-Format", "X-ClickHouse-No-Cache", "X-ClickHouse-Strict",
+	"X-ClickHouse-Preparation-Token", "X-ClickHouse-Labels", "X-ClickHouse-Runner", "X-ClickHouse-Network",
+	"X-ClickHouse-Priority", "X-Edit-Token",
+	HeaderAPIKey, HeaderRequestID,
 }
 
 func NewRouter(opts RouterOpts) http.Handler {
 	r := chi.NewRouter()
 
-	r.Use(metricsMiddleware)
+	r.Use(metricsMiddleware(r))
 
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{
-		Logger:  &opts.Logger,
-		NoColor: true,
-	}))
+	// The client address is derived first, so it's logged.
+	r.Use(clientIPMiddleware(opts.TrustedProxies))
+	r.Use(requestLogMiddleware(opts.Logger, opts.RequestLog))
 	r.Use(middleware.Recoverer)
 
-	r.Use(middleware.Timeout(opts.Timeout))
-
 	r.Use(cors.Handler(cors.Options{
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   allowedHeaders,
+		ExposedHeaders:   []string{"Link", "ETag", HeaderRequestID},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
+	// Blocked clients are rejected before the key is checked, so they are blocked even with a revoked key.
+	if opts.BlockList != nil {
+		message := opts.BlockedMessage
+		if message == "" {
+			message = DefaultBlockedMessage
+		}
+		r.Use(blockListMiddleware(opts.BlockList, message))
+	}
+
+	r.Use(apiKeyMiddleware(opts.APIKeys))
+
+	if opts.Health != nil {
+		r.Get("/health", newHealthHandler(opts.Health, false).getHealth)
+	}
+	r.Get(pathLiveness, getLiveness)
+	if opts.Readiness != nil {
+		r.Get(pathReadiness, newReadinessHandler(opts.Readiness).getReadiness)
+	}
+
 	r.Route("/api", func(r chi.Router) {
-		newQueryHandler(opts.Runner, opts.RunRepo, opts.TagStorage, opts.MaxQueryLength, opts.MaxOutputLength).handle(r)
-		newImageTagHandler(opts.TagStorage).handle(r)
+		if opts.Quota != nil {
+			r.Use(opts.Quota.limitRequests)
+		}
+
+		inflight := &inflightRuns{}
+		queryHandler := newQueryHandler(opts.Runner, opts.RunRepo, opts.TagStorage, opts.Policy, opts.ResultCache, opts.Runners, inflight, opts.Timeout, opts.MaxQueryLength, opts.MaxOutputLength)
+		queryHandler.runLimiter = opts.RunLimiter
+		queryHandler.quota = opts.Quota
+		queryHandler.pullRateLimits = opts.PullRateLimits
+		queryHandler.finishAbandoned = opts.FinishAbandonedRuns
+		queryHandler.exposeServerLogs = opts.ExposeServerLogs
+		queryHandler.allowedFormats = opts.AllowedFormats
+		queryHandler.deadlines = opts.Deadlines
+		queryHandler.outputProcessor = opts.OutputProcessor
+		queryHandler.bodyLimits = opts.BodyLimits
+		queryHandler.maintenance = opts.Maintenance
+		queryHandler.drain = opts.Drain
+		queryHandler.maxFilesSize = opts.MaxFilesSize
+
+		// Run routes take the deadline from the run timeout.
+		queryHandler.handleRuns(r)
+
+		// Imports are limited by the fetcher timeout.
+		if opts.Fetcher != nil {
+			newImportHandler(queryHandler, opts.Fetcher).handle(r)
+		}
+
+		// Bisections are limited by their own timeout.
+		if opts.Bisect != nil {
+			newBisectHandler(queryHandler, *opts.Bisect).handle(r)
+		}
+
+		// Sessions are limited by their own duration and idle timeout.
+		if opts.Sessions != nil {
+			newSessionHandler(queryHandler, opts.SessionOpener, *opts.Sessions).handle(r)
+		}
+
+		r.Group(func(r chi.Router) {
+			r.Use(timeoutMiddleware(opts.LookupTimeout))
+
+			queryHandler.handleLookups(r)
+			imageTagHandler := newImageTagHandler(opts.TagStorage, opts.Images)
+			imageTagHandler.canary = opts.Canary
+			imageTagHandler.journal = opts.TagJournal
+			imageTagHandler.handle(r)
+			newTimingsHandler(opts.RunRepo, inflight, opts.TimingsWindow, opts.TimingsMaxRuns).handle(r)
+
+			if opts.Meta != nil {
+				metaHandler := newMetaHandler(opts.Meta)
+				metaHandler.maintenance = opts.Maintenance
+				metaHandler.handle(r)
+			}
+		})
 	})
 
 	return r
 }
 
-func metricsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+// longRunningRoutes wait for query runs, their durations are exported apart from other routes.
+var longRunningRoutes = map[string]struct{}{
+	"POST /api/runs":            {},
+	"POST /api/runs/{id}/rerun": {},
+	"POST /api/prepare":         {},
+	"POST /api/bisect":          {},
+	"GET /api/sessions":         {},
+}
 
-		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
-		next.ServeHTTP(ww, r)
+func isLongRunningRoute(method string, routePattern string) bool {
+	_, ok := longRunningRoutes[method+" "+routePattern]
+	return ok
+}
 
-		rctx := chi.RouteContext(r.Context())
-		routePattern := strings.Join(rctx.RoutePatterns, "")
+// matchRoutePattern returns the pattern of the route that will handle the request.
+// It's empty if no route matches.
+func matchRoutePattern(routes chi.Routes, r *http.Request) string {
+	rctx := chi.NewRouteContext()
+	if !routes.Match(rctx, r.Method, r.URL.Path) {
+		return ""
+	}
 
-		status := fmt.Sprintf("%d %s", ww.Status(), http.StatusText(ww.Status()))
-		metrics.RestAPI.NewRequest(r.Method, routePattern, status, time.Since(start))
-	})
+	return rctx.RoutePattern()
+}
+
+// metricsMiddleware exports metrics of requests per route.
+// The route is matched beforehand to track in-flight requests, since it's known only after the request is handled.
+func metricsMiddleware(routes chi.Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isProbeRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+
+			inFlight := metrics.RestAPI.InFlight(r.Method, matchRoutePattern(routes, r))
+			inFlight.Inc()
+			defer inFlight.Dec()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			routePattern := chi.RouteContext(r.Context()).RoutePattern()
+
+			status := fmt.Sprintf("%d %s", ww.Status(), statusText(ww.Status()))
+			metrics.RestAPI.NewRequest(r.Method, routePattern, status, time.Since(start), ww.BytesWritten(), isLongRunningRoute(r.Method, routePattern))
+		})
+	}
 }
@@ -0,0 +1,41 @@
+package restapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchRoutePattern(t *testing.T) {
+	noop := func(http.ResponseWriter, *http.Request) {}
+
+	r := chi.NewRouter()
+	r.Route("/api", func(r chi.Router) {
+		r.Post("/runs", noop)
+		r.Get("/runs/{id}", noop)
+		r.Post("/runs/{id}/rerun", noop)
+	})
+
+	tests := []struct {
+		method      string
+		path        string
+		pattern     string
+		longRunning bool
+	}{
+		{http.MethodPost, "/api/runs", "/api/runs", true},
+		{http.MethodGet, "/api/runs/3f1c", "/api/runs/{id}", false},
+		{http.MethodPost, "/api/runs/3f1c/rerun", "/api/runs/{id}/rerun", true},
+		{http.MethodGet, "/api/unknown", "", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+
+		pattern := matchRoutePattern(r, req)
+		assert.Equal(t, tt.pattern, pattern, tt.path)
+		assert.Equal(t, tt.longRunning, isLongRunningRoute(tt.method, pattern), tt.path)
+	}
+}
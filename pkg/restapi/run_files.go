@@ -0,0 +1,81 @@
+package restapi
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// maxRunFiles bounds the number of files of a run.
+const maxRunFiles = 16
+
+// FileInput is a file placed into the user files directory of the server, so file() and INFILE can read it.
+type FileInput struct {
+	Name string `json:"name"`
+
+	// Content is encoded in base64.
+	Content string `json:"content"`
+}
+
+// RunFileOutput confirms that a file has been placed for the run.
+type RunFileOutput struct {
+	Name      string `json:"name"`
+	SizeBytes int    `json:"size_bytes"`
+}
+
+// decodeFiles checks the names and decodes the contents of the files. The total size of decoded files
+// is limited by maxFilesSize, files are rejected if it's 0. It returns an http status code describing the failure.
+func (h *queryHandler) decodeFiles(input []FileInput) ([]queryrun.File, int, error) {
+	if h.maxFilesSize == 0 {
+		return nil, http.StatusBadRequest, errors.New("files are not enabled")
+	}
+	if len(input) > maxRunFiles {
+		return nil, http.StatusBadRequest, errors.Errorf("number of files (%d) cannot exceed %d", len(input), maxRunFiles)
+	}
+
+	files := make([]queryrun.File, 0, len(input))
+	seen := make(map[string]struct{}, len(input))
+	var total uint64
+	for _, f := range input {
+		err := queryrun.CheckFileName(f.Name)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if _, found := seen[f.Name]; found {
+			return nil, http.StatusBadRequest, errors.Errorf("file %s is duplicated", f.Name)
+		}
+		seen[f.Name] = struct{}{}
+
+		content, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.Wrapf(err, "content of file %s is not valid base64", f.Name)
+		}
+
+		total += uint64(len(content))
+		if total > h.maxFilesSize {
+			msg := fmt.Sprintf("total size of files cannot exceed %d bytes", h.maxFilesSize)
+			return nil, http.StatusRequestEntityTooLarge, errors.New(msg)
+		}
+
+		files = append(files, queryrun.File{Name: f.Name, Content: content})
+	}
+
+	return files, http.StatusOK, nil
+}
+
+func newRunFilesOutput(files []queryrun.File) []RunFileOutput {
+	if len(files) == 0 {
+		return nil
+	}
+
+	output := make([]RunFileOutput, 0, len(files))
+	for _, f := range files {
+		output = append(output, RunFileOutput{Name: f.Name, SizeBytes: len(f.Content)})
+	}
+
+	return output
+}
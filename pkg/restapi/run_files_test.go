@@ -0,0 +1,49 @@
+package restapi
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeFiles(t *testing.T) {
+	h := &queryHandler{maxFilesSize: 10}
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	files, status, err := h.decodeFiles([]FileInput{{Name: "a.csv", Content: encode("1,2\n")}, {Name: "b.tsv", Content: encode("3\t4\n")}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []queryrun.File{{Name: "a.csv", Content: []byte("1,2\n")}, {Name: "b.tsv", Content: []byte("3\t4\n")}}, files)
+	assert.Equal(t, []RunFileOutput{{Name: "a.csv", SizeBytes: 4}, {Name: "b.tsv", SizeBytes: 4}}, newRunFilesOutput(files))
+
+	tests := []struct {
+		name   string
+		files  []FileInput
+		status int
+	}{
+		{"path traversal", []FileInput{{Name: "../users.xml", Content: encode("x")}}, http.StatusBadRequest},
+		{"duplicated", []FileInput{{Name: "a.csv"}, {Name: "a.csv"}}, http.StatusBadRequest},
+		{"invalid base64", []FileInput{{Name: "a.csv", Content: "not base64!"}}, http.StatusBadRequest},
+		{"too many", make([]FileInput, maxRunFiles+1), http.StatusBadRequest},
+		{"too large", []FileInput{{Name: "a.csv", Content: encode("123456")}, {Name: "b.csv", Content: encode("123456")}}, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, status, err := h.decodeFiles(tt.files)
+			assert.Error(t, err)
+			assert.Equal(t, tt.status, status)
+		})
+	}
+
+	_, _, err = (&queryHandler{}).decodeFiles([]FileInput{{Name: "a.csv"}})
+	assert.EqualError(t, err, "files are not enabled")
+}
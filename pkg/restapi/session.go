@@ -0,0 +1,330 @@
+package restapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-playground/internal/metrics"
+	"clickhouse-playground/internal/qrunner"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// ReasonTooManySessions distinguishes the limit of open sessions from other 429 errors.
+const ReasonTooManySessions = "too_many_sessions"
+
+// Reasons sessions end with, they label the session duration metric.
+const (
+	sessionEndClosed  = "closed"
+	sessionEndIdle    = "idle"
+	sessionEndExpired = "expired"
+	sessionEndError   = "error"
+)
+
+// SessionConfig bounds interactive sessions. Every open session keeps a container.
+type SessionConfig struct {
+	// MaxDuration bounds a session since it's opened. The query in progress is cancelled once it's reached.
+	MaxDuration time.Duration
+
+	// IdleTimeout closes sessions that have not sent a query for so long.
+	IdleTimeout time.Duration
+
+	// MaxSessions limits sessions open at once on the server.
+	MaxSessions uint
+}
+
+type sessionHandler struct {
+	queries *queryHandler
+	opener  SessionOpener
+	cfg     SessionConfig
+
+	active atomic.Int64
+}
+
+func newSessionHandler(queries *queryHandler, opener SessionOpener, cfg SessionConfig) *sessionHandler {
+	return &sessionHandler{
+		queries: queries,
+		opener:  opener,
+		cfg:     cfg,
+	}
+}
+
+func (h *sessionHandler) handle(r chi.Router) {
+	// The opening of a session is charged as a run, and so is every query of it.
+	if h.queries.quota != nil {
+		r = r.With(h.queries.quota.limitRuns)
+	}
+
+	r.Get("/sessions", h.open)
+}
+
+// SessionQueryOutput is the result of a query of a session.
+type SessionQueryOutput struct {
+	StreamsOutput
+
+	ElapsedMs int64 `json:"elapsed_ms"`
+}
+
+// SessionOpenedOutput is the first message of a session, it's sent once the server is ready.
+type SessionOpenedOutput struct {
+	QueryRunID    string    `json:"query_run_id"`
+	Version       string    `json:"version"`
+	ServerVersion string    `json:"server_version,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// open starts a container for the version, format and database of the query parameters and upgrades
+// the connection to a WebSocket. Every text message is executed as a query, and its result is sent back
+// in the envelope of API responses. The container is removed once the connection is closed for any reason.
+func (h *sessionHandler) open(w http.ResponseWriter, r *http.Request) {
+	if maintenance, active := h.queries.maintenanceState(); active {
+		writeMaintenance(w, maintenance)
+		return
+	}
+	if h.queries.drain.Draining() {
+		writeShuttingDown(w)
+		return
+	}
+
+	// The slot is taken before the container is started, so concurrent requests cannot exceed the limit.
+	if h.active.Add(1) > int64(h.cfg.MaxSessions) {
+		h.active.Add(-1)
+		metrics.Session.Rejected()
+		writeErrorResponse(w, &ErrorResponse{
+			Message: fmt.Sprintf("too many open sessions (%d), try again later", h.cfg.MaxSessions),
+			Code:    http.StatusTooManyRequests,
+			Reason:  ReasonTooManySessions,
+		})
+
+		return
+	}
+	defer h.active.Add(-1)
+
+	params := r.URL.Query()
+	req := RunQueryInput{
+		Version:  params.Get("version"),
+		Database: params.Get("database"),
+		Format:   params.Get("format"),
+	}
+
+	run, err := h.queries.newRun(r, &req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	openCtx, cancel := context.WithTimeout(r.Context(), h.queries.runTimeout)
+	defer cancel()
+
+	expiresAt := time.Now().Add(h.cfg.MaxDuration)
+	sess, err := h.opener.OpenSession(openCtx, run, expiresAt)
+	if err != nil {
+		zlog.Error().Err(err).Str("id", run.ID).Msg("session cannot be opened")
+		writeSessionError(w, err)
+
+		return
+	}
+
+	startedAt := time.Now()
+	metrics.Session.Opened()
+	reason := sessionEndError
+
+	// The container is removed even if the handshake fails or the handler panics.
+	defer func() {
+		metrics.Session.Closed(reason, startedAt)
+
+		err := sess.Close(context.Background())
+		if err != nil {
+			zlog.Error().Err(err).Str("id", run.ID).Msg("container of the session cannot be removed")
+		}
+		zlog.Info().Str("id", run.ID).Str("reason", reason).Dur("elapsed", time.Since(startedAt)).Msg("session has been closed")
+	}()
+
+	server := websocket.Server{
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+
+			err := websocket.JSON.Send(conn, &Response{Result: SessionOpenedOutput{
+				QueryRunID:    run.ID,
+				Version:       run.Version,
+				ServerVersion: run.ServerVersion,
+				ExpiresAt:     expiresAt.UTC(),
+			}})
+			if err != nil {
+				return
+			}
+
+			reason = h.serve(r.Context(), conn, sess, expiresAt)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// serve executes queries of the connection until it's closed, idle or expired, or a query breaks the session.
+// It returns the reason the session has ended with.
+func (h *sessionHandler) serve(ctx context.Context, conn *websocket.Conn, sess qrunner.Session, expiresAt time.Time) string {
+	// A query in progress is cancelled once the session expires.
+	ctx, cancel := context.WithDeadline(ctx, expiresAt)
+	defer cancel()
+
+	for {
+		deadline := time.Now().Add(h.cfg.IdleTimeout)
+		if deadline.After(expiresAt) {
+			deadline = expiresAt
+		}
+		_ = conn.SetReadDeadline(deadline)
+
+		var query string
+		err := websocket.Message.Receive(conn, &query)
+		var netErr net.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &netErr) && netErr.Timeout() && !time.Now().Before(expiresAt):
+			sendSessionError(conn, "session has expired", http.StatusRequestTimeout)
+			return sessionEndExpired
+		case errors.As(err, &netErr) && netErr.Timeout():
+			sendSessionError(conn, "session has been idle for too long", http.StatusRequestTimeout)
+			return sessionEndIdle
+		case errors.Is(err, io.EOF):
+			return sessionEndClosed
+		default:
+			return sessionEndError
+		}
+
+		status, err := h.checkQuery(query)
+		if err != nil {
+			sendSessionError(conn, err.Error(), status)
+			continue
+		}
+
+		if h.queries.quota != nil {
+			var exceeded *quotaExceededError
+			if errors.As(h.queries.quota.takeRun(conn.Request()), &exceeded) {
+				sendSessionErrorResponse(conn, exceeded.resp)
+				continue
+			}
+		}
+
+		startedAt := time.Now()
+		res, err := sess.Exec(ctx, query)
+		metrics.Session.Query(err == nil && res.ExitCode == 0)
+		if err != nil {
+			// The state of the container is unknown after a failed execution, so the session ends.
+			var timeoutErr *qrunner.QueryTimeoutError
+			switch {
+			case !time.Now().Before(expiresAt):
+				sendSessionError(conn, "session has expired", http.StatusRequestTimeout)
+				return sessionEndExpired
+			case errors.As(err, &timeoutErr):
+				sendSessionError(conn, timeoutErr.Error(), http.StatusRequestTimeout)
+			case errors.Is(err, qrunner.ErrSessionClosed):
+				sendSessionError(conn, err.Error(), http.StatusGone)
+			default:
+				zlog.Error().Err(err).Msg("session query failed")
+				sendSessionError(conn, "internal error", http.StatusInternalServerError)
+			}
+
+			return sessionEndError
+		}
+
+		if h.queries.outputProcessor != nil {
+			res, err = h.processOutput(res)
+			if err != nil {
+				zlog.Error().Err(err).Msg("output of the session cannot be processed")
+				sendSessionError(conn, "internal error", http.StatusInternalServerError)
+
+				continue
+			}
+		}
+
+		err = websocket.JSON.Send(conn, &Response{Result: SessionQueryOutput{
+			StreamsOutput: StreamsOutput{
+				Stdout:       res.Stdout,
+				Stderr:       res.Stderr,
+				ExitCode:     res.ExitCode,
+				Truncated:    res.Truncated,
+				DroppedBytes: res.DroppedBytes,
+			},
+			ElapsedMs: time.Since(startedAt).Milliseconds(),
+		}})
+		if err != nil {
+			return sessionEndError
+		}
+	}
+}
+
+// checkQuery applies the limits of runs to a query of a session. It returns an http status code describing the failure.
+func (h *sessionHandler) checkQuery(query string) (int, error) {
+	if query == "" {
+		return http.StatusBadRequest, errors.New("query cannot be empty")
+	}
+	if uint64(len(query)) > h.queries.maxQueryLength {
+		return http.StatusBadRequest, errors.Errorf("query length (%d) cannot exceed %d", len(query), h.queries.maxQueryLength)
+	}
+
+	if h.queries.policy != nil {
+		err := h.queries.policy.Check(query)
+		if err != nil {
+			return http.StatusForbidden, err
+		}
+	}
+
+	return 0, nil
+}
+
+// processOutput passes stdout and stderr of the query through the output processor. Changes are not reported,
+// results of sessions have no warnings.
+func (h *sessionHandler) processOutput(res qrunner.Result) (qrunner.Result, error) {
+	for _, value := range []*string{&res.Stdout, &res.Stderr} {
+		processed, _, err := h.queries.outputProcessor.Process(*value)
+		if err != nil {
+			return qrunner.Result{}, err
+		}
+		*value = processed
+	}
+
+	return res, nil
+}
+
+func sendSessionError(conn *websocket.Conn, msg string, code int) {
+	sendSessionErrorResponse(conn, &ErrorResponse{Message: msg, Code: code})
+}
+
+func sendSessionErrorResponse(conn *websocket.Conn, resp *ErrorResponse) {
+	err := websocket.JSON.Send(conn, &Response{Error: resp})
+	if err != nil {
+		zlog.Debug().Err(err).Msg("session error cannot be sent")
+	}
+}
+
+// writeSessionError responds to a request which session cannot be opened.
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, qrunner.ErrNoAvailableRunners):
+		writeNoAvailableRunners(w, err)
+
+	case errors.Is(err, qrunner.ErrSessionsUnsupported):
+		writeError(w, err.Error(), http.StatusNotImplemented)
+
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, "session cannot be opened in time", http.StatusGatewayTimeout)
+
+	case errors.Is(err, qrunner.ErrRunnerDisconnected), errors.Is(err, qrunner.ErrServerNotReady),
+		errors.Is(err, qrunner.ErrPullRateLimited):
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+
+	case errors.Is(err, qrunner.ErrEmulationRefused), errors.Is(err, qrunner.ErrArchitectureUnavailable):
+		writeError(w, err.Error(), http.StatusBadRequest)
+
+	default:
+		writeError(w, "internal error", http.StatusInternalServerError)
+	}
+}
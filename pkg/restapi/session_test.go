@@ -0,0 +1,144 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+type echoSession struct {
+	closed *atomic.Int32
+}
+
+func (s echoSession) Exec(_ context.Context, query string) (qrunner.Result, error) {
+	return qrunner.Result{Stdout: strings.ToUpper(query) + "\n"}, nil
+}
+
+func (s echoSession) Close(context.Context) error {
+	s.closed.Add(1)
+	return nil
+}
+
+type echoSessionOpener struct {
+	closed atomic.Int32
+}
+
+func (o *echoSessionOpener) OpenSession(context.Context, *queryrun.Run, time.Time) (qrunner.Session, error) {
+	return echoSession{closed: &o.closed}, nil
+}
+
+type sessionMessage struct {
+	Result *SessionQueryOutput `json:"result"`
+	Error  *ErrorResponse      `json:"error"`
+}
+
+func TestSession(t *testing.T) {
+	opener := &echoSessionOpener{}
+	queries := newQueryHandler(funcRunner{}, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 10, 1000)
+	h := newSessionHandler(queries, opener, SessionConfig{MaxDuration: time.Minute, IdleTimeout: 200 * time.Millisecond, MaxSessions: 1})
+
+	r := chi.NewRouter()
+	h.handle(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/sessions?version=23.3"
+	conn, err := websocket.Dial(url, "", srv.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var opened struct {
+		Result SessionOpenedOutput `json:"result"`
+	}
+	require.NoError(t, websocket.JSON.Receive(conn, &opened))
+	assert.Equal(t, "23.3", opened.Result.Version)
+
+	t.Run("query", func(t *testing.T) {
+		require.NoError(t, websocket.Message.Send(conn, "select 1"))
+
+		var msg sessionMessage
+		require.NoError(t, websocket.JSON.Receive(conn, &msg))
+		require.NotNil(t, msg.Result)
+		assert.Equal(t, "SELECT 1\n", msg.Result.Stdout)
+	})
+
+	t.Run("query over the length limit", func(t *testing.T) {
+		require.NoError(t, websocket.Message.Send(conn, strings.Repeat("1", 11)))
+
+		var msg sessionMessage
+		require.NoError(t, websocket.JSON.Receive(conn, &msg))
+		require.NotNil(t, msg.Error)
+		assert.Equal(t, http.StatusBadRequest, msg.Error.Code)
+	})
+
+	t.Run("session limit", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/sessions?version=23.3")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		var msg sessionMessage
+		require.NoError(t, websocket.JSON.Receive(conn, &msg))
+		require.NotNil(t, msg.Error)
+		assert.Contains(t, msg.Error.Message, "idle")
+
+		assert.Eventually(t, func() bool { return opener.closed.Load() == 1 }, time.Second, 10*time.Millisecond,
+			"the container is removed once the session ends")
+	})
+}
+
+func TestSession_DailyRuns(t *testing.T) {
+	quota, err := NewQuota(QuotaConfig{DailyRuns: 2}, NewMemoryQuotaStore())
+	require.NoError(t, err)
+
+	queries := newQueryHandler(funcRunner{}, nil, staticTagStorage{}, nil, nil, nil, &inflightRuns{}, time.Minute, 10, 1000)
+	queries.quota = quota
+	h := newSessionHandler(queries, &echoSessionOpener{}, SessionConfig{MaxDuration: time.Minute, IdleTimeout: time.Second, MaxSessions: 2})
+
+	r := chi.NewRouter()
+	h.handle(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/sessions?version=23.3"
+	conn, err := websocket.Dial(url, "", srv.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var opened struct {
+		Result SessionOpenedOutput `json:"result"`
+	}
+	require.NoError(t, websocket.JSON.Receive(conn, &opened))
+
+	// The opening has taken the first run of the budget, the first query takes the last one.
+	require.NoError(t, websocket.Message.Send(conn, "select 1"))
+	var msg sessionMessage
+	require.NoError(t, websocket.JSON.Receive(conn, &msg))
+	require.NotNil(t, msg.Result)
+
+	require.NoError(t, websocket.Message.Send(conn, "select 2"))
+	msg = sessionMessage{}
+	require.NoError(t, websocket.JSON.Receive(conn, &msg))
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, http.StatusTooManyRequests, msg.Error.Code)
+	assert.Equal(t, ReasonDailyRunsExceeded, msg.Error.Reason)
+
+	resp, err := http.Get(srv.URL + "/sessions?version=23.3")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "sessions cannot be opened over the budget")
+}
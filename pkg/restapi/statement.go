@@ -0,0 +1,68 @@
+package restapi
+
+import (
+	"strings"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/pkg/errors"
+)
+
+// maxStatements limits the number of statements of a run, every statement is a separate client invocation.
+const maxStatements = 50
+
+// StatementOutput is the result of a statement of a run.
+type StatementOutput struct {
+	Query string `json:"query"`
+
+	// Executed is false if the statement has been skipped, since a previous one has failed.
+	Executed  bool   `json:"executed"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exit_code"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+func newStatementsOutput(statements []queryrun.Statement) []StatementOutput {
+	if len(statements) == 0 {
+		return nil
+	}
+
+	output := make([]StatementOutput, 0, len(statements))
+	for _, s := range statements {
+		output = append(output, StatementOutput{
+			Query:     s.Query,
+			Executed:  s.Executed,
+			Stdout:    s.Stdout,
+			Stderr:    s.Stderr,
+			ExitCode:  s.ExitCode,
+			ElapsedMs: s.Elapsed.Milliseconds(),
+		})
+	}
+
+	return output
+}
+
+// checkStatements validates the statements of the request. Trailing semicolons are trimmed,
+// so statements copied from a script can be sent as is.
+func checkStatements(req *RunQueryInput) error {
+	if req.Query != "" {
+		return errors.New("query and statements cannot be set together")
+	}
+	if req.Tool != nil {
+		return errors.New("tool runs cannot have statements")
+	}
+	if len(req.Statements) > maxStatements {
+		return errors.Errorf("number of statements (%d) cannot exceed %d", len(req.Statements), maxStatements)
+	}
+
+	for i, s := range req.Statements {
+		s = strings.TrimRight(strings.TrimSpace(s), "; \t\n")
+		if s == "" {
+			return errors.Errorf("statement %d is empty", i+1)
+		}
+		req.Statements[i] = s
+	}
+
+	return nil
+}
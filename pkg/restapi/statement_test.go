@@ -0,0 +1,23 @@
+package restapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStatements(t *testing.T) {
+	req := &RunQueryInput{Statements: []string{"CREATE TABLE t (a Int8) ENGINE = Memory;", " SELECT * FROM t ;\n"}}
+	require.NoError(t, checkStatements(req))
+	assert.Equal(t, []string{"CREATE TABLE t (a Int8) ENGINE = Memory", "SELECT * FROM t"}, req.Statements)
+
+	err := checkStatements(&RunQueryInput{Statements: []string{"SELECT 1", " ; "}})
+	assert.EqualError(t, err, "statement 2 is empty")
+
+	err = checkStatements(&RunQueryInput{Query: "SELECT 1", Statements: []string{"SELECT 2"}})
+	assert.EqualError(t, err, "query and statements cannot be set together")
+
+	err = checkStatements(&RunQueryInput{Statements: make([]string, maxStatements+1)})
+	assert.EqualError(t, err, "number of statements (51) cannot exceed 50")
+}
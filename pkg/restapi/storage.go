@@ -0,0 +1,22 @@
+package restapi
+
+import (
+	"net/http"
+
+	"clickhouse-playground/internal/queryrun"
+)
+
+// errRunStorageDisabled is reported by routes reading saved runs if the deployment does not save runs.
+const errRunStorageDisabled = "runs are not saved by this deployment"
+
+// requireRunStorage responds with 501 Not Implemented instead of calling next if runs are not saved,
+// so handlers reading saved runs do not check the repository.
+func requireRunStorage(repo queryrun.Repository, next http.HandlerFunc) http.HandlerFunc {
+	if repo != nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, errRunStorageDisabled, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,55 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStorageDisabled(t *testing.T) {
+	runner := funcRunner{run: func(*queryrun.Run) (string, error) {
+		return "1\n", nil
+	}}
+	router := NewRouter(RouterOpts{
+		Logger:          zerolog.Nop(),
+		Runner:          runner,
+		TagStorage:      staticTagStorage{},
+		Timeout:         time.Minute,
+		LookupTimeout:   time.Minute,
+		MaxQueryLength:  1000,
+		MaxOutputLength: 1000,
+	})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/runs", strings.NewReader(`{"query": "SELECT 1", "version": "23.3"}`)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Result RunQueryOutput `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Result.Output)
+	assert.Equal(t, "1\n", *resp.Result.Output)
+	assert.Equal(t, "1\n", resp.Result.Stdout)
+	assert.NotEmpty(t, resp.Result.QueryRunID)
+	assert.Empty(t, resp.Result.EditToken, "runs that are not saved cannot be edited")
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/runs/"+resp.Result.QueryRunID, nil),
+		httptest.NewRequest(http.MethodPost, "/api/runs/"+resp.Result.QueryRunID+"/rerun", strings.NewReader(`{}`)),
+		httptest.NewRequest(http.MethodGet, "/api/timings/summary", nil),
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotImplemented, rec.Code, req.URL.Path)
+	}
+}
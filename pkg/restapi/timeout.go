@@ -0,0 +1,66 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// timeoutMiddleware limits the request processing time. The request context is cancelled
+// on the deadline, so downstream calls stop, and the client receives 504.
+//
+// Streaming routes must not be wrapped into the middleware because their responses
+// are written for an arbitrary time.
+func timeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+			next.ServeHTTP(tw, r.WithContext(ctx))
+
+			if tw.expired() {
+				writeError(w, "request timed out", http.StatusGatewayTimeout)
+			}
+		})
+	}
+}
+
+// timeoutWriter discards the handler response if the deadline has been exceeded
+// before the handler started writing it. Otherwise, the response is passed as is.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) expired() bool {
+	if !tw.timedOut && !tw.wroteHeader && tw.ctx.Err() == context.DeadlineExceeded {
+		tw.timedOut = true
+	}
+
+	return tw.timedOut
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	if tw.expired() || tw.wroteHeader {
+		return
+	}
+
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	return tw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,125 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedBody   string
+		errMsg         string
+	}{
+		{
+			name: "Answered in time",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "ok",
+		},
+		{
+			name: "Deadline exceeded",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				writeError(w, "internal error", http.StatusInternalServerError)
+			},
+			expectedStatus: http.StatusGatewayTimeout,
+			errMsg:         "request timed out",
+		},
+		{
+			name: "Response started before the deadline",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				<-r.Context().Done()
+				_, _ = w.Write([]byte("late"))
+			},
+			expectedStatus: http.StatusAccepted,
+			expectedBody:   "late",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			timeoutMiddleware(10*time.Millisecond)(tt.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			require.Equal(t, tt.expectedStatus, rec.Code, rec.Body.String())
+			if tt.errMsg == "" {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+				return
+			}
+
+			var resp Response
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			require.NotNil(t, resp.Error)
+			assert.Equal(t, tt.errMsg, resp.Error.Message)
+			assert.Equal(t, http.StatusGatewayTimeout, resp.Error.Code)
+		})
+	}
+}
+
+// blockingRunRepo answers lookups only when the request is cancelled.
+type blockingRunRepo struct {
+	queryrun.Repository
+}
+
+func (blockingRunRepo) Get(ctx context.Context, _ string) (*queryrun.Run, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRouter_Timeouts(t *testing.T) {
+	runner := funcRunner{run: func(*queryrun.Run) (string, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "1\n", nil
+	}}
+	newRouter := func(repo queryrun.Repository) http.Handler {
+		return NewRouter(RouterOpts{
+			Logger:          zerolog.Nop(),
+			Runner:          runner,
+			RunRepo:         repo,
+			TagStorage:      staticTagStorage{},
+			Timeout:         time.Minute,
+			LookupTimeout:   10 * time.Millisecond,
+			MaxQueryLength:  1000,
+			MaxOutputLength: 1000,
+		})
+	}
+
+	t.Run("Lookup", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		newRouter(blockingRunRepo{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/runs/3f1c", nil))
+
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code, rec.Body.String())
+	})
+
+	t.Run("Run is not limited by the lookup timeout", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		newRouter(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/runs", strings.NewReader(`{"query": "SELECT 1", "version": "23.3"}`)))
+
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var resp struct {
+			Result RunQueryOutput `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.NotNil(t, resp.Result.Output)
+		assert.Equal(t, "1\n", *resp.Result.Output)
+	})
+}
@@ -0,0 +1,310 @@
+package restapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// timingsSummaryTTL limits how often the summary is recomputed, as it queries the runs storage.
+const timingsSummaryTTL = time.Minute
+
+// stagesSaveTimeout bounds a save of the stages of a run in flight.
+const stagesSaveTimeout = 5 * time.Second
+
+// inflightRuns keeps runs that are being processed, so their timings can be read before they are saved.
+type inflightRuns struct {
+	runs sync.Map
+}
+
+func (i *inflightRuns) add(run *queryrun.Run) {
+	i.runs.Store(run.ID, run)
+}
+
+func (i *inflightRuns) remove(run *queryrun.Run) {
+	i.runs.Delete(run.ID)
+}
+
+func (i *inflightRuns) get(id string) (*queryrun.Run, bool) {
+	run, found := i.runs.Load(id)
+	if !found {
+		return nil, false
+	}
+
+	return run.(*queryrun.Run), true
+}
+
+// persistStages saves the stages of the run on its record as they are completed, so timings of the run in flight
+// are served by every instance. Saves are merged: the latest stages are saved once the previous save is done.
+// The returned function stops the saves and waits for the one in progress, it must be called before the run is saved.
+func persistStages(repo queryrun.Repository, run *queryrun.Run) (stop func()) {
+	if repo == nil || run.Timeline == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-run.Timeline.Changed():
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), stagesSaveTimeout)
+			err := repo.SaveStages(ctx, run)
+			cancel()
+			if err != nil {
+				zlog.Warn().Err(err).Str("id", run.ID).Msg("stages of the run in flight cannot be saved")
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
+
+type timingsHandler struct {
+	runRepo  queryrun.Repository
+	inflight *inflightRuns
+
+	window  time.Duration
+	maxRuns int
+
+	mu              sync.Mutex
+	summary         *TimingsSummaryOutput
+	summaryExpireAt time.Time
+}
+
+func newTimingsHandler(runRepo queryrun.Repository, inflight *inflightRuns, window time.Duration, maxRuns int) *timingsHandler {
+	return &timingsHandler{
+		runRepo:  runRepo,
+		inflight: inflight,
+		window:   window,
+		maxRuns:  maxRuns,
+	}
+}
+
+func (h *timingsHandler) handle(r chi.Router) {
+	r.Get("/runs/{id}/timings", requireRunStorage(h.runRepo, h.getRunTimings))
+	r.Get("/timings/summary", requireRunStorage(h.runRepo, h.getSummary))
+}
+
+type StageOutput struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Source     string    `json:"source,omitempty"`
+}
+
+// TimingsOutput are the durations of the run stages in milliseconds. Stages the run has skipped, e.g. the image pull
+// on a runner that has already pulled the image, are 0. TotalMs is the wall-clock time of the whole run.
+type TimingsOutput struct {
+	PullMs            int64 `json:"pull_ms"`
+	ContainerCreateMs int64 `json:"container_create_ms"`
+	ContainerStartMs  int64 `json:"container_start_ms"`
+	ReadinessMs       int64 `json:"readiness_ms"`
+	ExecMs            int64 `json:"exec_ms"`
+	TotalMs           int64 `json:"total_ms"`
+}
+
+// newTimingsOutput sums up the stages by name. Runners that don't record stages get the total only.
+func newTimingsOutput(stages []queryrun.Stage, total time.Duration) *TimingsOutput {
+	durations := make(map[string]time.Duration, len(stages))
+	for _, s := range stages {
+		durations[s.Name] += s.Duration
+	}
+
+	return &TimingsOutput{
+		PullMs:            durations[queryrun.StageImagePull].Milliseconds(),
+		ContainerCreateMs: durations[queryrun.StageContainerCreate].Milliseconds(),
+		ContainerStartMs:  durations[queryrun.StageContainerStart].Milliseconds(),
+		ReadinessMs:       durations[queryrun.StageReadiness].Milliseconds(),
+		ExecMs:            durations[queryrun.StageExec].Milliseconds(),
+		TotalMs:           total.Milliseconds(),
+	}
+}
+
+type RunTimingsOutput struct {
+	QueryRunID string `json:"query_run_id"`
+
+	// InProgress is true if the run is still being processed. Only completed stages are returned.
+	InProgress bool          `json:"in_progress"`
+	Stages     []StageOutput `json:"stages"`
+
+	// Deadlines are the limits the run has been executed with. They are missing for runs saved before
+	// deadlines were recorded.
+	Deadlines *DeadlinesOutput `json:"deadlines,omitempty"`
+}
+
+type DeadlinesOutput struct {
+	// ReadinessTimeoutMs is 0 if the readiness wait is bounded by MaxExecRetries only.
+	ReadinessTimeoutMs int64 `json:"readiness_timeout_ms"`
+
+	// MaxExecRetries is 0 if the runner default has been used.
+	MaxExecRetries int   `json:"max_exec_retries"`
+	RunTimeoutMs   int64 `json:"run_timeout_ms"`
+}
+
+func newDeadlinesOutput(d *queryrun.Deadlines) *DeadlinesOutput {
+	if d == nil {
+		return nil
+	}
+
+	return &DeadlinesOutput{
+		ReadinessTimeoutMs: d.ReadinessTimeout.Milliseconds(),
+		MaxExecRetries:     d.MaxExecRetries,
+		RunTimeoutMs:       d.RunTimeout.Milliseconds(),
+	}
+}
+
+// getRunTimings returns the pipeline stages of a run.
+func (h *timingsHandler) getRunTimings(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var (
+		stages     []queryrun.Stage
+		deadlines  *queryrun.Deadlines
+		inProgress bool
+	)
+
+	if run, found := h.inflight.get(id); found {
+		stages = run.Timeline.Stages()
+		deadlines = run.Deadlines
+		inProgress = true
+	} else {
+		run, err := h.runRepo.Get(r.Context(), id)
+		if errors.Is(err, queryrun.ErrNotFound) {
+			// The run may be in flight on another instance.
+			run, err = h.runRepo.GetInProgress(r.Context(), id)
+			inProgress = err == nil
+		}
+		if errors.Is(err, queryrun.ErrNotFound) {
+			writeError(w, "run not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			zlog.Error().Err(err).Str("id", id).Msg("failed to find a run")
+			writeError(w, "internal error", http.StatusInternalServerError)
+
+			return
+		}
+		if run.Deleted() {
+			writeDeleted(w, run)
+			return
+		}
+		if run.Failed() {
+			writeError(w, "run not found", http.StatusNotFound)
+			return
+		}
+
+		stages = run.Stages
+		deadlines = run.Deadlines
+	}
+
+	output := RunTimingsOutput{
+		QueryRunID: id,
+		InProgress: inProgress,
+		Stages:     make([]StageOutput, 0, len(stages)),
+		Deadlines:  newDeadlinesOutput(deadlines),
+	}
+	for _, s := range stages {
+		output.Stages = append(output.Stages, newStageOutput(s))
+	}
+
+	writeResult(w, output)
+}
+
+func newStageOutput(s queryrun.Stage) StageOutput {
+	return StageOutput{
+		Name:       s.Name,
+		StartedAt:  s.StartedAt,
+		FinishedAt: s.FinishedAt(),
+		DurationMs: s.Duration.Milliseconds(),
+		Attempts:   s.Attempts,
+		Source:     s.Source,
+	}
+}
+
+type StageSummaryOutput struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	P50Ms int64  `json:"p50_ms"`
+	P90Ms int64  `json:"p90_ms"`
+	P99Ms int64  `json:"p99_ms"`
+}
+
+type TimingsSummaryOutput struct {
+	Window     string               `json:"window"`
+	Runs       int                  `json:"runs"`
+	Stages     []StageSummaryOutput `json:"stages"`
+	ComputedAt time.Time            `json:"computed_at"`
+}
+
+// getSummary returns percentiles of stage durations of recent runs.
+// The lock is held only to read and replace the cached summary, so a slow listing does not block other requests.
+func (h *timingsHandler) getSummary(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	summary, expireAt := h.summary, h.summaryExpireAt
+	h.mu.Unlock()
+
+	if summary != nil && time.Now().Before(expireAt) {
+		writeResult(w, summary)
+		return
+	}
+
+	runs, err := h.runRepo.ListStages(r.Context(), time.Now().Add(-h.window), h.maxRuns)
+	if errors.Is(err, queryrun.ErrStagesIndexDisabled) {
+		writeError(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to list run stages")
+		writeError(w, "internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	summaries := queryrun.SummarizeStages(runs)
+
+	output := &TimingsSummaryOutput{
+		Window:     h.window.String(),
+		Runs:       len(runs),
+		Stages:     make([]StageSummaryOutput, 0, len(summaries)),
+		ComputedAt: time.Now(),
+	}
+	for _, s := range summaries {
+		output.Stages = append(output.Stages, StageSummaryOutput{
+			Name:  s.Name,
+			Count: s.Count,
+			P50Ms: s.P50.Milliseconds(),
+			P90Ms: s.P90.Milliseconds(),
+			P99Ms: s.P99.Milliseconds(),
+		})
+	}
+
+	h.mu.Lock()
+	h.summary = output
+	h.summaryExpireAt = time.Now().Add(timingsSummaryTTL)
+	h.mu.Unlock()
+
+	writeResult(w, output)
+}
@@ -0,0 +1,87 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTimingsOutput(t *testing.T) {
+	stages := []queryrun.Stage{
+		{Name: queryrun.StageQueue, Duration: 5 * time.Second},
+		{Name: queryrun.StageImagePull, Duration: 3 * time.Second},
+		{Name: queryrun.StageContainerCreate, Duration: 200 * time.Millisecond},
+		{Name: queryrun.StageContainerStart, Duration: 300 * time.Millisecond},
+		{Name: queryrun.StageReadiness, Duration: 400 * time.Millisecond},
+		{Name: queryrun.StageReadiness, Duration: 100 * time.Millisecond},
+		{Name: queryrun.StageExec, Duration: 50 * time.Millisecond},
+	}
+
+	assert.Equal(t, &TimingsOutput{
+		PullMs:            3000,
+		ContainerCreateMs: 200,
+		ContainerStartMs:  300,
+		ReadinessMs:       500,
+		ExecMs:            50,
+		TotalMs:           9100,
+	}, newTimingsOutput(stages, 9100*time.Millisecond))
+
+	assert.Equal(t, &TimingsOutput{TotalMs: 1200}, newTimingsOutput(nil, 1200*time.Millisecond),
+		"runners without stages report the total only")
+}
+
+func TestGetRunTimings_InProgressElsewhere(t *testing.T) {
+	repo := queryrun.NewMemoryRepository(0, 0)
+
+	// The run is in flight on another instance, only its saved stages are known here.
+	run := queryrun.New("SELECT 1", "clickhouse", "23.3", nil)
+	run.Timeline.Record(queryrun.StageImagePull, time.Now())
+	require.NoError(t, repo.SaveStages(context.Background(), run))
+
+	router := chi.NewRouter()
+	newTimingsHandler(repo, &inflightRuns{}, time.Hour, 100).handle(router)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs/"+run.ID+"/timings", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Result RunTimingsOutput `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.True(t, resp.Result.InProgress)
+	require.Len(t, resp.Result.Stages, 1)
+	assert.Equal(t, queryrun.StageImagePull, resp.Result.Stages[0].Name)
+}
+
+func TestPersistStages(t *testing.T) {
+	repo := queryrun.NewMemoryRepository(0, 0)
+	run := queryrun.New("SELECT 1", "clickhouse", "23.3", nil)
+
+	stop := persistStages(repo, run)
+	defer stop()
+
+	run.Timeline.Record(queryrun.StageQueue, time.Now())
+	assert.Eventually(t, func() bool {
+		saved, err := repo.GetInProgress(context.Background(), run.ID)
+		return err == nil && len(saved.Stages) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	run.Timeline.Record(queryrun.StageExec, time.Now())
+	assert.Eventually(t, func() bool {
+		saved, err := repo.GetInProgress(context.Background(), run.ID)
+		return err == nil && len(saved.Stages) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	stop()
+	stop()
+}
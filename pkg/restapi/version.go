@@ -0,0 +1,35 @@
+package restapi
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// API versions negotiated with the version parameter of the Accept header, e.g. "Accept: application/json; version=2".
+// Version 1 is served by default.
+const (
+	apiVersion1 = 1
+
+	// apiVersion2 returns the output streams of runs separately only, without the combined output.
+	apiVersion2 = 2
+)
+
+// requestedAPIVersion returns the highest supported version requested by the Accept header.
+func requestedAPIVersion(r *http.Request) int {
+	version := apiVersion1
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		requested, err := strconv.Atoi(params["version"])
+		if err == nil && requested > version && requested <= apiVersion2 {
+			version = requested
+		}
+	}
+
+	return version
+}
@@ -0,0 +1,100 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type resultRunner struct {
+	QueryRunner
+	res qrunner.Result
+}
+
+func (r resultRunner) RunQuery(context.Context, *queryrun.Run) (qrunner.Result, error) {
+	return r.res, nil
+}
+
+func TestRequestedAPIVersion(t *testing.T) {
+	tests := []struct {
+		accept  string
+		version int
+	}{
+		{accept: "", version: apiVersion1},
+		{accept: "application/json", version: apiVersion1},
+		{accept: "application/json; version=2", version: apiVersion2},
+		{accept: "text/html, application/json;version=2", version: apiVersion2},
+		{accept: "application/json; version=3", version: apiVersion1},
+		{accept: "application/json; version=x", version: apiVersion1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			assert.Equal(t, tt.version, requestedAPIVersion(r))
+		})
+	}
+}
+
+func TestRunStreams(t *testing.T) {
+	router := NewRouter(RouterOpts{
+		Logger: zerolog.Nop(),
+		Runner: resultRunner{res: qrunner.Result{
+			Stdout:   "1\n",
+			Stderr:   "Code: 62. DB::Exception: Syntax error",
+			ExitCode: 62,
+		}},
+		TagStorage:      staticTagStorage{},
+		Timeout:         time.Minute,
+		LookupTimeout:   time.Minute,
+		MaxQueryLength:  1000,
+		MaxOutputLength: 1000,
+	})
+
+	tests := []struct {
+		name   string
+		accept string
+		output *string
+	}{
+		{name: "version 1", output: stringPtr("1\n\nCode: 62. DB::Exception: Syntax error")},
+		{name: "version 2", accept: "application/json; version=2"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/runs", strings.NewReader(`{"query": "SELECT 1;;", "version": "23.3"}`))
+			req.Header.Set("Accept", tt.accept)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			var resp struct {
+				Result RunQueryOutput `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.output, resp.Result.Output)
+			assert.Equal(t, "1\n", resp.Result.Stdout)
+			assert.Equal(t, "Code: 62. DB::Exception: Syntax error", resp.Result.Stderr)
+			assert.Equal(t, 62, resp.Result.ExitCode)
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,27 @@
+package restapi
+
+import "clickhouse-playground/internal/queryrun"
+
+// WarningOutput is a non-fatal notice about a run. Clients should match Code, see queryrun.Warning* constants.
+type WarningOutput struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func newWarningsOutput(warnings []queryrun.Warning) []WarningOutput {
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	output := make([]WarningOutput, 0, len(warnings))
+	for _, w := range warnings {
+		output = append(output, WarningOutput{
+			Code:    w.Code,
+			Message: w.Message,
+			Details: w.Details,
+		})
+	}
+
+	return output
+}
@@ -0,0 +1,138 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-playground/internal/dockertag"
+	"clickhouse-playground/internal/qrunner"
+	"clickhouse-playground/internal/queryrun"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deprecatingTagStorage resolves 23.3 to its only tag and deprecates it.
+type deprecatingTagStorage struct {
+	TagStorage
+	rejected bool
+}
+
+func (deprecatingTagStorage) Resolve(string, bool) (dockertag.Image, bool) {
+	return dockertag.Image{Tag: "23.3.1.2823"}, true
+}
+
+func (s deprecatingTagStorage) Deprecation(string) (dockertag.Deprecation, bool) {
+	return dockertag.Deprecation{Message: "versions before 23.8 are EOL", Rejected: s.rejected}, true
+}
+
+type funcRunner struct {
+	QueryRunner
+	run func(run *queryrun.Run) (string, error)
+}
+
+func (f funcRunner) RunQuery(_ context.Context, run *queryrun.Run) (qrunner.Result, error) {
+	output, err := f.run(run)
+	return qrunner.Result{Stdout: output}, err
+}
+
+func TestRunWarnings(t *testing.T) {
+	mismatched := func(run *queryrun.Run) (string, error) {
+		run.VersionMismatch = true
+		run.Warn(queryrun.WarningVersionMismatch, "mismatch", map[string]string{"server_version": "23.3.2.1"})
+
+		return "1\n", nil
+	}
+	unavailable := func(run *queryrun.Run) (string, error) {
+		return "", qrunner.ErrNoAvailableRunners
+	}
+
+	tests := []struct {
+		name     string
+		storage  deprecatingTagStorage
+		run      func(run *queryrun.Run) (string, error)
+		status   int
+		warnings []string
+	}{
+		{
+			name:     "succeeded",
+			run:      mismatched,
+			status:   http.StatusOK,
+			warnings: []string{queryrun.WarningVersionResolved, queryrun.WarningDeprecatedVersion, queryrun.WarningVersionMismatch},
+		},
+		{
+			name:    "runner failed",
+			run:     unavailable,
+			status:  http.StatusTooManyRequests,
+			storage: deprecatingTagStorage{},
+		},
+		{
+			name:    "version rejected",
+			run:     mismatched,
+			status:  http.StatusBadRequest,
+			storage: deprecatingTagStorage{rejected: true},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &memoryRunRepo{runs: make(map[string]*queryrun.Run)}
+			h := newQueryHandler(funcRunner{run: tt.run}, repo, tt.storage, nil, nil, nil, &inflightRuns{}, time.Minute, 1000, 1000)
+
+			body := strings.NewReader(`{"query": "SELECT 1", "version": "23.3"}`)
+			rec := httptest.NewRecorder()
+			h.runQuery(rec, httptest.NewRequest(http.MethodPost, "/runs", body))
+			require.Equal(t, tt.status, rec.Code)
+
+			// Failures carry no warnings: they would describe a run that has not happened.
+			if tt.warnings == nil {
+				assert.NotContains(t, rec.Body.String(), "warnings")
+				assert.Empty(t, repo.runs)
+
+				return
+			}
+
+			var resp struct {
+				Result RunQueryOutput `json:"result"`
+			}
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+			var codes []string
+			for _, w := range resp.Result.Warnings {
+				assert.NotEmpty(t, w.Message, w.Code)
+				codes = append(codes, w.Code)
+			}
+			assert.Equal(t, tt.warnings, codes)
+			assert.Equal(t, "23.3", resp.Result.Warnings[0].Details["requested_version"])
+
+			// Warnings are kept with the run.
+			require.Len(t, repo.runs, 1)
+			assert.Len(t, repo.runs[resp.Result.QueryRunID].Warnings, len(tt.warnings))
+		})
+	}
+}
+
+func TestWarnRollingVersion(t *testing.T) {
+	buildDate := time.Date(2023, 4, 1, 3, 0, 0, 0, time.UTC)
+
+	run := queryrun.New("SELECT 1", "clickhouse", "head", nil)
+	warnRollingVersion(run, dockertag.Image{Tag: "head", Digest: "sha256:1", Rolling: true, BuildDate: buildDate})
+
+	require.NotNil(t, run.ImageBuildDate)
+	assert.Equal(t, buildDate, *run.ImageBuildDate)
+	require.Len(t, run.Warnings, 1)
+	assert.Equal(t, queryrun.WarningRollingVersion, run.Warnings[0].Code)
+	assert.Equal(t, map[string]string{"digest": "sha256:1", "build_date": "2023-04-01T03:00:00Z"}, run.Warnings[0].Details)
+
+	run = queryrun.New("SELECT 1", "clickhouse", "head", nil)
+	warnRollingVersion(run, dockertag.Image{Tag: "head", Digest: "sha256:1", Rolling: true})
+
+	assert.Nil(t, run.ImageBuildDate, "the build date is unknown")
+	require.Len(t, run.Warnings, 1)
+	assert.Equal(t, map[string]string{"digest": "sha256:1"}, run.Warnings[0].Details)
+}